@@ -2,87 +2,39 @@ package main
 
 import (
 	"context"
-	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"gorm.io/gorm"
-
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
-	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/logger"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 
 	_ "hyperpage/docs"
-	"hyperpage/meta/network"
 
 	"github.com/gofiber/template/html/v2"
 
 	"hyperpage/routes/api"
 	routes_paxcall "hyperpage/routes/paxcall"
+	routes_socket "hyperpage/routes/socket"
+	routes_stream "hyperpage/routes/stream"
 
 	"hyperpage/controllers"
 	"hyperpage/initializers"
-	"hyperpage/models"
+	"hyperpage/middleware"
 
 	// "hyperpage/meta/network"
 	"hyperpage/routes"
 	"hyperpage/utils"
-
-	"github.com/pion/webrtc/v3"
-	uuid "github.com/satori/go.uuid"
 )
 
-type TimeEntry struct {
-	Hour    int `json:"hour"`
-	Minutes int `json:"minutes"`
-	Seconds int `json:"seconds"`
-}
-
-type TimeArray []TimeEntry
-
-func GetDurationComponents(duration time.Duration) TimeArray {
-	hours := int(duration.Hours())
-	minutes := int(duration.Minutes()) % 60
-	seconds := int(duration.Seconds()) % 60
-
-	timeEntry := TimeEntry{
-		Hour:    hours,
-		Minutes: minutes,
-		Seconds: seconds,
-	}
-
-	return TimeArray{timeEntry}
-}
-
-var (
-	// Map to keep track of connected clients
-	clients    = make(map[string]*websocket.Conn)
-	w          = sync.WaitGroup{}
-	bufferPool = network.NewBufferPool("TestPool", 10, 1024)
-	byteQueue  = network.NewByteQueue()
-)
-
-// Функция для поиска клиента по его идентификатору
-func findClientByID(id string) (*websocket.Conn, bool) {
-	client, ok := clients[id]
-	return client, ok
-}
-
-type Peer struct {
-	Conn           *websocket.Conn
-	PeerConnection *webrtc.PeerConnection
-}
-
-var peers = make(map[string]*Peer)
-var peersLock sync.RWMutex
-var ClientsLock sync.RWMutex
-
 func init() {
 	config, err := initializers.LoadConfig(".")
 	if err != nil {
@@ -193,10 +145,22 @@ func main() {
 	engine := html.New("./views/main", ".html")
 	engine_paxcall := html.New("./views/paxcall", ".html")
 
+	// c.IP() is the address in PROXY_HEADER only for requests from the
+	// reverse proxies in TRUSTED_PROXIES, the peer address otherwise
+	var trustedProxies []string
+	for _, proxy := range strings.Split(config.TrustedProxies, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			trustedProxies = append(trustedProxies, proxy)
+		}
+	}
 	app := fiber.New(fiber.Config{
-		ServerHeader: "paxintrade",
-		Views:        engine,
-		BodyLimit:    20 * 1024 * 1024, // 20 MB
+		ServerHeader:            "paxintrade",
+		Views:                   engine,
+		BodyLimit:               20 * 1024 * 1024, // 20 MB
+		ProxyHeader:             config.ProxyHeader,
+		EnableTrustedProxyCheck: true,
+		TrustedProxies:          trustedProxies,
+		EnableIPValidation:      true,
 	})
 
 	micro_paxcall := fiber.New(fiber.Config{
@@ -211,11 +175,15 @@ func main() {
 
 	micro := fiber.New()
 
+	// Custom domains of user sites, before any route
+	app.Use(middleware.CustomDomain())
+
 	//VIEWS
 	routes.SwaggerRoute(app) // Register a route for API Docs (Swagger).
 	routes.MainView(app)     // Main page
 
 	//API'S
+	micro.Use(requestid.New()) // X-Request-ID, recorded with audit events
 	api.Register(micro)
 
 	//REGISTER NEW ROUTES
@@ -231,897 +199,22 @@ func main() {
 		AllowCredentials: true,
 	}))
 
-	var ClientsLock sync.Mutex
-	var Clients = make(map[string]*websocket.Conn)
-
-	var languageChan = make(chan string)
-
-	// bufferPool := network.NewBufferPool("WebSocketBufferPool", 10, 1024)
-
-	app.Use("/stream", func(c *fiber.Ctx) error {
-		if websocket.IsWebSocketUpgrade(c) {
-			c.Locals("allowed", true)
-			return c.Next()
-		}
-		return fiber.ErrUpgradeRequired
-	})
-
-	app.Get("/stream/live", websocket.New(func(c *websocket.Conn) {
-		idStr := c.Query("session")
-		language := c.Query("language")
-
-		if language == "" {
-			language = "en"
-		}
-
-		ClientsLock.Lock()
-		Clients[idStr] = c
-		ClientsLock.Unlock()
-
-		defer func() {
-			ClientsLock.Lock()
-			delete(Clients, idStr)
-			ClientsLock.Unlock()
-			c.Close()
-		}()
-
-		go func() {
-			for {
-				languageChan <- language
-				time.Sleep(2 * time.Second)
-			}
-		}()
-
-		type messageSocket struct {
-			MessageType string                   `json:"messageType"`
-			Data        []map[string]interface{} `json:"data"`
-		}
-
-		for {
-			// buffer := bufferPool.AcquireBuffer() // Получаем буфер из пула
-
-			_, message, err := c.ReadMessage()
-			if err != nil {
-				fmt.Println("error reading message from client:", err)
-				break
-			}
-
-			var messageData messageSocket
-			err = json.Unmarshal(message, &messageData)
-			if err != nil {
-				fmt.Println("error parsing message:", err)
-				continue
-			}
-
-			if messageData.MessageType == "getADS" {
-				var blogs []models.Blog
-				err := initializers.DB.
-					Preload("Photos").
-					Preload("City.Translations", "language = ?", language).
-					Preload("Catygory.Translations", "language = ?", language).
-					Preload("User").
-					Preload("Hashtags").
-					Order("RANDOM()").
-					Limit(2).
-					Find(&blogs).
-					Error
-				if err != nil {
-					fmt.Println("error fetching random blogs:", err)
-					// bufferPool.ReleaseBuffer(buffer)
-					return // Exit or handle the error appropriately
-				}
-
-				for _, blog := range blogs {
-					blogJSON, err := json.Marshal(blog)
-					if err != nil {
-						fmt.Println("error encoding blog to JSON:", err)
-						continue
-					}
-
-					buffer := bufferPool.AcquireBuffer()
-					copy(buffer, blogJSON)
-
-					byteQueue.Enqueue(buffer, 0, len(buffer))
-					bufferPool.ReleaseBuffer(buffer)
-
-					// fmt.Println(buffer)
-					// Send the JSON data to the client
-					err = c.WriteMessage(websocket.BinaryMessage, buffer)
-					if err != nil {
-						fmt.Println("error sending blog JSON to client:", err)
-						continue
-					}
-					bufferPool.ReleaseBuffer(buffer)
-
-				}
-			}
-
-			for byteQueue.Size() > 0 {
-				buffer := make([]byte, 1024)
-
-				n, err := byteQueue.Dequeue(buffer, 0, len(buffer))
-				if err != nil {
-					fmt.Println("error dequeuing bytes:", err)
-					continue
-				}
-
-				err = c.WriteMessage(websocket.BinaryMessage, buffer[:n])
-				if err != nil {
-					fmt.Println("error sending bytes to client:", err)
-					continue
-				}
-			}
-
-		}
-	}))
-
-	go func() {
-		defer func() {
-			for _, conn := range Clients {
-				conn.Close()
-			}
-		}()
-
-		ticker := time.NewTicker(2 * time.Second)
-		defer ticker.Stop()
-
-		var lang string
-		for {
-			select {
-			case <-ticker.C:
-				ClientsLock.Lock()
-				hasActiveClients := len(Clients) > 0
-				ClientsLock.Unlock()
-
-				if hasActiveClients {
-					var blog models.Blog
-					err := initializers.DB.
-						Preload("Photos").
-						Preload("City.Translations", "language = ?", lang).
-						Preload("Catygory.Translations", "language = ?", lang).
-						Preload("User").
-						Preload("Hashtags").
-						Order("RANDOM()").
-						Limit(1).
-						First(&blog).
-						Error
-					if err != nil {
-						fmt.Println("error fetching random blog:", err)
-						continue
-					}
-
-					blogJSON, err := json.Marshal(blog)
-					if err != nil {
-						fmt.Println("error encoding blog to JSON:", err)
-						continue
-					}
-
-					ClientsLock.Lock()
-					for _, conn := range Clients {
-						err := conn.WriteMessage(websocket.TextMessage, blogJSON)
-						if err != nil {
-							fmt.Println("error writing message to client:", err)
-						}
-					}
-					ClientsLock.Unlock()
-				}
-			case newLang := <-languageChan:
-				lang = newLang
-			}
-		}
-	}()
-
-	app.Use("/socket.io", func(c *fiber.Ctx) error {
-		// IsWebSocketUpgrade returns true if the client
-		// requested upgrade to the WebSocket protocol.
-		if websocket.IsWebSocketUpgrade(c) {
-			c.Locals("allowed", true)
-			return c.Next()
-		}
-		return fiber.ErrUpgradeRequired
-	})
-
-	app.Get("/socket.io/", websocket.New(func(c *websocket.Conn) {
-
-		type messageSocket struct {
-			MessageType string                   `json:"messageType"`
-			Data        []map[string]interface{} `json:"data"`
-		}
-
-		// Timeout client 5min.
-		c.SetReadDeadline(time.Now().Add(5 * time.Hour))
-
-		id := uuid.NewV4()
-		idStr := base64.URLEncoding.EncodeToString(id[:])
-
-		// Send the ID to the client
-
-		type SessionIDMessage struct {
-			SessionID string `json:"session"`
-		}
-
-		sessionIDMessage := SessionIDMessage{
-			SessionID: idStr,
-		}
-
-		jsonData, err := json.Marshal(sessionIDMessage)
-		if err != nil {
-			fmt.Println("Ошибка при преобразовании в JSON:", err)
-			return
-		}
-
-		err = c.WriteMessage(websocket.TextMessage, jsonData)
-		if err != nil {
-			fmt.Println("error writing message to client", idStr, ":", err)
-			return
-		}
-
-		// Initialize Redis client
-		configPath := "./app.env"
-		config, err := initializers.LoadConfig(configPath)
-		if err != nil {
-			fmt.Println("error loading config:", err)
-			return
-		}
-
-		// Connect to Redis
-		redisClient := initializers.ConnectRedis(&config)
-		defer redisClient.Close()
-
-		// Add client to clients map
-		ClientsLock.Lock()
-		utils.Clients[idStr] = c
-		ClientsLock.Unlock()
-
-		//CHECK USER LOGIN OR NOT
-		authToken := c.Cookies("access_token")
-
-		refresh_token := c.Cookies("refresh_token")
-
-		if authToken != "" {
-
-			xconfig, _ := initializers.LoadConfig(".")
-
-			tokenClaims, err := utils.ValidateToken(authToken, xconfig.AccessTokenPublicKey)
-			if err != nil {
-				fmt.Println("TOKEN DIE")
-
-				if refresh_token != "" {
-
-					fmt.Println("NEED MAKE NEW TOKEN HERE")
-
-				}
-
-			}
-			// Check if tokenClaims is nil before accessing its fields
-			if tokenClaims != nil {
-				UserID := tokenClaims.UserID
-				// Continue processing with UserID
-				var user models.User
-				if err := initializers.DB.Model(&user).Where("id = ?", UserID).First(&user).Error; err != nil {
-					_ = err
-
-					// Handle the error (e.g., user not found)
-					// You might return an error response or take appropriate action.
-				}
-				userName := user.Name
-				lastTimeStr := user.LastOnline.Format("2006-01-02 15:04:05")
-
-				if UserID != "" {
-					initializers.DB.Model(&user).Where("id = ?", UserID).Updates(map[string]interface{}{"online": true, "session": idStr})
-					utils.UserActivity("userOnline", userName, lastTimeStr)
-
-				} else {
-					fmt.Println("User is not logged in")
-				}
-			}
-			// extract the TokenUuid field from tokenClaims
-
-		}
-
-		defer delete(utils.Clients, idStr)
-		startTime := time.Now()
-
-		// Setup dials time in min
-
-		defer func() {
-			peersLock.Lock()
-			delete(peers, idStr)
-			peersLock.Unlock()
-			bufferPool.Free()
-			byteQueue.Clear()
-
-			// Remove client from clients map
-			// Calculate and log elapsed time for the client
-			elapsedTime := time.Since(startTime)
-			durationComponents := GetDurationComponents(elapsedTime)
-			log.Printf("Client %s disconnected after %s", idStr, elapsedTime)
-
-			///var clientsMap map[string]*websocket.Conn
-			clients = utils.Clients
-
-			fmt.Println(clients)
-
-			// Remove client from clients map
-			delete(clients, idStr)
-
-			fmt.Println("client deleted from Redis:", idStr)
-
-			// Close WebSocket connection
-			err = c.Close()
-			if err != nil {
-				fmt.Println("error closing WebSocket connection:", err)
-				return
-			}
-
-			// var user models.User
-			// initializers.DB.Where("session = ?", idStr).First(&user)
-
-			now := time.Now()
-
-			//CHECK USER IS LOGIN OR NOT
-			authToken := c.Cookies("access_token")
-			// fmt.Println("authToken", authToken)
-			var user models.User
-			zeroUUID := uuid.Nil // Zero UUID значение
-
-			if user.ID == zeroUUID { // если пользователь не найден по токену
-				initializers.DB.Where("session = ?", idStr).First(&user)
-			}
-
-			if user.ID != zeroUUID { // пользователь найден
-				existingHours := user.OnlineHours
-
-				hours := int(durationComponents[0].Hour)
-				minutes := int(durationComponents[0].Minutes)
-				seconds := int(durationComponents[0].Seconds)
-
-				if len(existingHours) > 0 {
-					lastEntry := existingHours[len(existingHours)-1]
-					totalSeconds := lastEntry.Seconds + seconds
-					totalMinutes := lastEntry.Minutes + minutes + totalSeconds/60
-					totalHours := lastEntry.Hour + hours + totalMinutes/60
-
-					lastEntry.Seconds = totalSeconds % 60
-					lastEntry.Minutes = totalMinutes % 60
-					lastEntry.Hour = totalHours % 24
-
-					existingHours[len(existingHours)-1] = lastEntry
-				} else {
-					timeEntry := models.TimeEntry{
-						Hour:    hours,
-						Minutes: minutes,
-						Seconds: seconds,
-					}
-					existingHours = append(existingHours, timeEntry)
-				}
-
-				jsonBytes, err := json.Marshal(existingHours)
-				if err != nil {
-					fmt.Println("Ошибка маршалинга онлайн часов:", err)
-					return
-				}
-
-				var updatedHours []models.TimeEntry
-				err = json.Unmarshal(jsonBytes, &updatedHours)
-				if err != nil {
-					fmt.Println("Ошибка анмаршалинга онлайн часов:", err)
-					return
-				}
-
-				user.OnlineHours = updatedHours
-				formattedTime := string(jsonBytes)
-
-				initializers.DB.Model(&user).Updates(map[string]interface{}{
-					"online":       false,
-					"last_online":  now,
-					"online_hours": formattedTime,
-					"session":      nil,
-				})
-
-				userName := user.Name
-				lastTimeStr := user.LastOnline.Format("2006-01-02 15:04:05")
-				utils.UserActivity("userOffline", userName, lastTimeStr)
-			} else {
-				fmt.Println("Пользователь не залогинен")
-			}
-
-			if authToken != "" {
-
-				xconfig, _ := initializers.LoadConfig(".")
-
-				tokenClaims, err := utils.ValidateToken(authToken, xconfig.AccessTokenPublicKey)
-				if err != nil {
-					// handle error
-					_ = err
-				}
-
-				if tokenClaims == nil {
-					fmt.Println("Token is missing or invalid")
-					return // Return if tokenClaims is nil
-				}
-
-				// extract the TokenUuid field from tokenClaims
-				UserID := tokenClaims.UserID
-
-				if UserID != "" {
-					var user models.User
-					// now := time.Now()
-
-					initializers.DB.Where("id = ?", UserID).First(&user)
-					existingHours := user.OnlineHours // Initialize existingHours as a TimeEntryScanner
-
-					hours := int(durationComponents[0].Hour)
-					minutes := int(durationComponents[0].Minutes)
-					seconds := int(durationComponents[0].Seconds)
-
-					if len(existingHours) > 0 {
-						lastEntry := existingHours[len(existingHours)-1]
-						totalSeconds := lastEntry.Seconds + seconds
-						totalMinutes := lastEntry.Minutes + minutes + totalSeconds/60
-						totalHours := lastEntry.Hour + hours + totalMinutes/60
-
-						lastEntry.Seconds = totalSeconds % 60
-						lastEntry.Minutes = totalMinutes % 60
-						lastEntry.Hour = totalHours % 24
-
-						existingHours[len(existingHours)-1] = lastEntry
-					} else {
-						// No existing hours, create a new entry
-						timeEntry := models.TimeEntry{
-							Hour:    hours,
-							Minutes: minutes,
-							Seconds: seconds,
-						}
-						existingHours = append(existingHours, timeEntry)
-					}
-
-					jsonBytes, err := json.Marshal(existingHours)
-					if err != nil {
-						// Handle the error
-						_ = err
-
-					}
-
-					var updatedHours []models.TimeEntry // Define a variable of type []models.TimeEntry
-
-					err = json.Unmarshal(jsonBytes, &updatedHours) // Unmarshal jsonBytes into updatedHours
-					if err != nil {
-						// Handle the error
-						_ = err
-
-					}
-
-					user.OnlineHours = updatedHours // Assign updatedHours to user.OnlineHours
-					formattedTime := string(jsonBytes)
-
-					// Lost connection
-					initializers.DB.Model(&user).Updates(map[string]interface{}{"online": false, "last_online": now, "online_hours": formattedTime, "session": nil})
-
-					// Access the user's ID with `user.ID`
-					// userID := user.ID.String()
-					userName := user.Name
-					lastTimeStr := user.LastOnline.Format("2006-01-02 15:04:05")
-					//CHECK USER LOGIN OR NOT
-					// authToken := c.Cookies("access_token")
-
-					utils.UserActivity("userOffline", userName, lastTimeStr)
-					// initializers.DB.Model(&user).Where("ID = ?", UserID).Updates(map[string]interface{}{"online": true})
-				} else {
-					fmt.Println("User is not logged in")
-				}
-
-			}
-
-			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-			defer cancel()
-
-			// Set the clients JSON string as the value in a Redis hash
-			redisKey := "connected_clients"
-			err := redisClient.HDel(ctx, redisKey, idStr).Err()
-			if err != nil {
-				fmt.Println("error deleting client info from Redis:", err)
-				return
-			}
-
-			fmt.Println("WebSocket client disconnected:", idStr)
-
-		}()
-
-		// // Convert the Clients map to a JSON string
-		// clientsJson, err := json.Marshal(utils.Clients)
-		// if err != nil {
-		// 	fmt.Println("error marshaling clients to JSON:", err)
-		// 	return
-		// }
-
-		// Create a context with a timeout of 10 seconds
-		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-		defer cancel()
+	// Ad rotation of the live stream, one per connection
+	routes_stream.Register(app)
 
-		// Set the clients JSON string as the value in a Redis hash
-		redisKey := "connected_clients"
-		clientInfo, err := json.Marshal(utils.Clients)
-		err = redisClient.HSet(ctx, redisKey, idStr, clientInfo).Err()
-		if err != nil {
-			fmt.Println("error setting client info in Redis:", err)
-			return
-		}
-
-		go func() {
-			ticker := time.NewTicker(10 * time.Second)
-			defer ticker.Stop()
-
-			for range ticker.C {
-				if err := c.WriteMessage(websocket.PingMessage, nil); err != nil {
-					fmt.Println("Ошибка при отправке ping сообщения:", err)
-					return
-				}
-			}
-		}()
-
-		c.SetPingHandler(func(appData string) error {
-			fmt.Println("Получено ping сообщение")
-			if err := c.WriteControl(websocket.PongMessage, nil, time.Now().Add(time.Second)); err != nil {
-				fmt.Println("Ошибка при отправке pong сообщения:", err)
-				return err
-			}
-			return nil
-		})
-
-		// c.SetPongHandler(func(appData string) error {
-		// 	fmt.Println("Получено pong сообщение")
-		// 	return nil
-		// })
-
-		// Wait for messages from the client
-		for {
-
-			_, message, err := c.ReadMessage()
-			if err != nil {
-				fmt.Println("error reading message from client", idStr, ":", err)
-				break
-			}
-
-			var Message messageSocket
-			if err := json.Unmarshal(message, &Message); err != nil {
-				fmt.Println("error unmarshalling JSON:", err)
-				continue
-			}
-			if Message.MessageType == "UserIsTyping" {
-				if len(Message.Data) > 0 {
-					// Assuming there is at least one item in Data and it contains access_token
-					authTokenInterface, exists := Message.Data[0]["access_token"]
-					if !exists {
-						log.Print("access token not provided")
-						continue
-					}
-
-					authToken, ok := authTokenInterface.(string)
-					if !ok {
-						log.Print("access token format invalid")
-						continue
-					}
-
-					xconfig, _ := initializers.LoadConfig(".")
-
-					tokenClaims, err := utils.ValidateToken(authToken, xconfig.AccessTokenPublicKey)
-					if err != nil {
-						log.Printf("Error validating token: %s", err)
-						continue
-					}
-
-					if tokenClaims == nil {
-						fmt.Println("Token is missing or invalid")
-						continue // Exit if tokenClaims is nil
-					}
-
-					UserID := tokenClaims.UserID
-
-					if UserID != "" {
-						var user models.User
-
-						result := initializers.DB.Where("id = ?", UserID).First(&user)
-						if result.Error != nil {
-							log.Printf("Error getting User from DB :%s", err)
-							continue
-						}
-
-						// Extract the roomID for the first item
-						if roomID, exists := Message.Data[0]["roomID"].(string); exists {
-							fmt.Println("User is Typing in RoomID:", roomID)
-							err := controllers.SendUserTypingToCentrifugo(user.ID, roomID)
-							if err != nil {
-								fmt.Printf("error sending message to centrifugo for user %s: %s\n", user.ID, err)
-								continue
-							}
-						} else {
-							log.Printf("RoomID not found in message data")
-							continue
-						}
-					} else {
-						log.Printf("UserID is empty")
-						continue
-					}
-				}
-			}
-			if Message.MessageType == "getMySessionId" {
-				fmt.Println("WebSocket client connected with ID:", idStr)
-				w.Add(1)
-
-				type SessionIDMessage struct {
-					SessionID string `json:"session"`
-				}
-
-				sessionIDMessage := SessionIDMessage{
-					SessionID: idStr,
-				}
-
-				jsonData, err := json.Marshal(sessionIDMessage)
-				if err != nil {
-					fmt.Println("Ошибка при преобразовании в JSON:", err)
-					return
-				}
-
-				go func() {
-
-					err := c.WriteMessage(websocket.TextMessage, jsonData)
-
-					// err := utils.UserActivity("sessionId", idStr)
-					if err != nil {
-						fmt.Println("error writing message to client", idStr, ":", err)
-						return
-					}
-					// w.Wait()
-				}()
-			}
-
-			if Message.MessageType == "webcall" {
-
-				var Message messageSocket
-				if err := json.Unmarshal(message, &Message); err != nil {
-					fmt.Println("error unmarshalling JSON:", err)
-					continue
-				}
-
-				for _, dataMap := range Message.Data {
-					caller, callerExists := dataMap["caller"].(string)
-					if callerExists {
-						fmt.Println("Caller:", caller)
-					}
-
-					uuid, uuidExists := dataMap["uuid"].(string)
-					if uuidExists {
-						fmt.Println("Handle:", uuid)
-					}
-
-					handle, handleExists := dataMap["handle"].(string)
-					if handleExists {
-						fmt.Println("Handle:", handle)
-					}
-
-					session, sessionExists := dataMap["session"].(string)
-					if sessionExists {
-						fmt.Println("session:", session)
-					}
-
-					sdpArray, sdpExists := dataMap["sdp"].([]interface{})
-					if sdpExists {
-						for _, sdpItem := range sdpArray {
-							sdpMap, ok := sdpItem.(map[string]interface{})
-							if !ok {
-								fmt.Println("SDP item is not a map[string]interface{}")
-								continue
-							}
-
-							sdpType, typeExists := sdpMap["type"].(string)
-							if typeExists {
-								fmt.Println("SDP Type:", sdpType)
-							}
-
-							sdpContent, sdpExists := sdpMap["sdp"].(string)
-							if sdpExists {
-								fmt.Println("SDP Content:", sdpContent)
-							}
-						}
-					}
-
-					// id := session
-					// targetClientConn, ok := findClientByID(id)
-					// if !ok {
-					// 	fmt.Printf("Клиент с идентификатором %s не найден\n", id)
-					// 	return
-					// }
-
-					// dataForUser := payloadData{
-					// 	Command: "endc",
-					// }
-
-				}
-			}
-
-			if Message.MessageType == "updateProfile" {
-				type Message struct {
-					MessageType string `json:"MessageType"`
-					Data        []struct {
-						UserID string `json:"id"`
-					} `json:"data"`
-				}
-				var data Message
-				if err := json.Unmarshal([]byte(message), &data); err != nil {
-					fmt.Println("Ошибка при разборе JSON:", err)
-					return
-				}
-
-				fmt.Println("user online again:", data)
-
-			}
-
-			if Message.MessageType == "reject" {
-				type RejectMessage struct {
-					Command string `json:"command"`
-				}
-
-				type YourMessageType struct {
-					MessageType string `json:"MessageType"`
-					Data        []struct {
-						ID string `json:"id"`
-					} `json:"data"`
-				}
-
-				var data YourMessageType
-
-				if err := json.Unmarshal([]byte(message), &data); err != nil {
-					fmt.Println("Ошибка при разборе JSON:", err)
-					return
-				}
-
-				for _, data := range data.Data {
-					id := data.ID
-
-					targetClientConn, ok := findClientByID(id)
-					if !ok {
-						fmt.Printf("Клиент с идентификатором %s не найден\n", id)
-						return
-					}
-
-					rejectMessage := RejectMessage{
-						Command: "endc",
-					}
-
-					jsonData, err := json.Marshal(rejectMessage)
-					if err != nil {
-						fmt.Println("Ошибка при преобразовании в JSON:", err)
-						return
-					}
-
-					err = targetClientConn.WriteMessage(websocket.TextMessage, jsonData)
-					if err != nil {
-						fmt.Printf("Ошибка отправки запроса: %v\n", err)
-						return
-					}
-				}
-
-			}
-
-			if Message.MessageType == "sdpAnswer" {
-				type Message struct {
-					Command string `json:"command"`
-					UserB   string `json:"userb"`
-					SDP     string `json:"sdp"`
-					UserA   string `json:"usera"`
-				}
-
-				var data map[string]interface{}
-				if err := json.Unmarshal([]byte(message), &data); err != nil {
-					fmt.Println("Ошибка при разборе JSON:", err)
-					return
-				}
-
-				id, ok := data["sessionID"].(string)
-				if !ok {
-					fmt.Println("Не удалось получить значение id или тип не является строкой")
-					return
-				}
-
-				sdp, ok := data["sdpAnswer"].(string)
-				if !ok {
-					fmt.Println("Не удалось получить значение sdpAnswer или тип не является строкой")
-					return
-				}
-
-				message := Message{
-					Command: "sdpAnswer",
-					UserB:   id,
-					SDP:     sdp,
-					UserA:   idStr,
-				}
-
-				jsonData, err := json.Marshal(message)
-				if err != nil {
-					fmt.Println("Ошибка при преобразовании в JSON:", err)
-					return
-				}
-
-				targetClientConn, ok := findClientByID(id)
-				if !ok {
-					fmt.Printf("Клиент с идентификатором %s не найден\n", id)
-					return
-				}
-
-				err = targetClientConn.WriteMessage(websocket.TextMessage, jsonData)
-				if err != nil {
-					fmt.Printf("Ошибка отправки запроса: %v\n", err)
-					return
-				}
-
-			}
-
-		}
-
-		// Show log of all clients currently connected
-		fmt.Println("Currently connected clients:")
-		for id := range utils.Clients {
-			fmt.Println(id)
-		}
-	}))
+	// Realtime websocket, routed across nodes by the gateway
+	routes_socket.Register(app)
 
 	routes.NotFoundRoute(app) // Register route for 404 Error.
 
-	// uncomment for test reset .... witouth wait
+	// SIGTERM starts the graceful shutdown at the end of main
+	shutdown, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
 
-	// resetAndSaveOnlineData()
-	// Emulate the current time
+	// Tickers and the gateway run until the requests are drained
+	background, stopBackground := context.WithCancel(context.Background())
+	var tickers sync.WaitGroup
 
-	// currentTime := time.Date(2027, 1, 31, 23, 59, 59, 0, time.UTC) // Set the desired date and time for testing
-
-	currentTime := time.Now().UTC()
-
-	// Calculate the end of the current month
-	year, month, _ := currentTime.Date()
-	nextMonth := time.Date(year, month+1, 1, 0, 0, 0, 0, currentTime.Location())
-	lastDayOfMonth := nextMonth.Add(-24 * time.Hour)
-
-	// Check if the current day is the last day of the month
-	if currentTime.Day() == lastDayOfMonth.Day() && currentTime.Hour() == 23 && currentTime.Minute() == 59 {
-		resetAndSaveOnlineData()
-	} else {
-		// Calculate the desired execution time (23:59:00) on the last day of the month
-		desiredTime := time.Date(year, month, lastDayOfMonth.Day(), 23, 59, 0, 0, currentTime.Location())
-
-		// Calculate the duration until the desired execution time
-		durationUntilDesiredTime := desiredTime.Sub(currentTime)
-
-		// Create a timer with the duration until the desired execution time
-		timer := time.NewTimer(durationUntilDesiredTime)
-
-		go func() {
-			<-timer.C
-			resetAndSaveOnlineData()
-
-			// Calculate the start of the next day
-			nextDay := currentTime.Truncate(24 * time.Hour).Add(24 * time.Hour)
-
-			// Calculate the duration until the start of the next day
-			durationUntilNextDay := nextDay.Sub(time.Now().UTC())
-
-			// Create a ticker with the duration until the start of the next day
-			if durationUntilNextDay > 0 {
-				ticker := time.NewTicker(durationUntilNextDay)
-
-				// Start the ticker loop
-				for range ticker.C {
-					currentTime = time.Now().UTC()
-					if currentTime.Hour() == 23 && currentTime.Minute() == 59 {
-						resetAndSaveOnlineData()
-					}
-				}
-			}
-		}()
-	}
-
-	//Check blog Expired
-	ticker := time.NewTicker(24 * time.Hour)
 	config2, _ := initializers.LoadConfig(".")
 
 	cfg := &initializers.Config{
@@ -1139,18 +232,61 @@ func main() {
 		log.Fatal(err)
 	}
 
-	// Get a channel that continuously receives updates from the chat.
-	defer ticker.Stop()
+	//Check blog Expired
+	runTicker(background, &tickers, 24*time.Hour, func() {
+		// utils.CheckExpiration(bot)
+		utils.MoveToArch(bot)
+		utils.CheckPlan(bot)
+		utils.CheckSite(bot)
+		utils.CheckSiteTime(bot)
+		utils.ExpireCustomDomains()
+		utils.RenewDomainCertificates()
+		utils.ExpireDataExports()
+		utils.PruneAuditLog()
+		utils.RollMonthlyBlogCounters()
+	})
+
+	// Publish scheduled blogs, expire promotions and retry syndication
+	runTicker(background, &tickers, time.Minute, func() {
+		utils.PublishScheduledBlogs()
+		utils.ExpirePromotions()
+		utils.ProcessSyndicationQueue()
+		utils.ExpirePresence()
+		utils.ExpireCalls()
+		utils.MeterConsultations()
+		utils.RemindAppointments()
+		utils.CompleteAppointments()
+		utils.RemindLeadFollowUps()
+		utils.EndAdCampaigns()
+	})
+
+	// Build data exports in their own workers, zipping the media of a user
+	// can take longer than the minute ticker
+	tickers.Add(1)
 	go func() {
-		for range ticker.C {
-			// utils.CheckExpiration(bot)
-			utils.MoveToArch(bot)
-			utils.CheckPlan(bot)
-			utils.CheckSite(bot)
-			utils.CheckSiteTime(bot)
-		}
+		defer tickers.Done()
+		utils.RunDataExports(background)
 	}()
 
+	// Roll up blog view analytics and online time
+	runTicker(background, &tickers, 10*time.Minute, func() {
+		utils.RollupBlogStats()
+		utils.RollupPresence()
+	})
+
+	// Send saved search digests, verify pending custom domains and roll up
+	// the platform KPIs
+	runTicker(background, &tickers, time.Hour, func() {
+		utils.SendSavedSearchDigests()
+		utils.VerifyPendingCustomDomains()
+		utils.ProcessAccountDeletions()
+		utils.RollupPlatformStats()
+	})
+
+	// Join the websocket gateway so messages for sessions connected to other
+	// nodes are routed there
+	utils.StartGateway(background)
+
 	// Create a channel to receive messages that contain the desired words.
 
 	// Define the words to filter for.
@@ -1489,183 +625,61 @@ func main() {
 	// 	controllers.GetMeH(msg[0], msg[1])
 	// }
 
-	log.Fatal(app.Listen(":8888"))
-	// log.Fatal(app.ListenTLS(":8888", "./selfsigned.crt", "./selfsigned.key"))
-
-}
-
-// currentTime := time.Date(2023, 12, 31, 23, 59, 0, 0, time.UTC) // Set the desired date and time for testing
-// if currentDay == time.Date(currentYear, currentMonth, time.Date(currentYear, currentMonth+1, 0, 0, 0, 0, 0, time.UTC).Day(), 23, 59, 0, 0, time.UTC).Day() {
-// WORKING RESET TIMER FIRST EXP
-func resetAndSaveOnlineData() {
-	fmt.Println("ok?")
-	// Get the current month and year
-	currentTime := time.Now()
-	// currentTime := time.Date(2023, 3, 25, 23, 59, 59, 0, time.UTC) // Set the desired date and time for testing
-	currentYear, currentMonth, currentDay := currentTime.Date()
-
-	// Find all users
-	var users []models.User
-	if err := initializers.DB.Find(&users).Error; err != nil {
-		fmt.Println("Error finding users:", err)
-		return
-	}
-
-	// Iterate over each user
-	for _, user := range users {
-		// Retrieve the current online hours data from the user
-		originalOnlineHours := user.OnlineHours
-		originalTotalBlogs := user.TotalBlogs
-
-		// Retrieve the current total online hours data from the user
-		totalOnlineHours := user.TotalOnlineHours
-		totalRestBlogs := user.TotalRestBlogs
-
-		// Sum the current online hours and add them to the total online hours
-		totalOnlineHours[0].Hour += originalOnlineHours[0].Hour
-		totalOnlineHours[0].Minutes += originalOnlineHours[0].Minutes
-		totalOnlineHours[0].Seconds += originalOnlineHours[0].Seconds
-
-		// Perform carry-over to adjust the time units
-		totalOnlineHours[0].Minutes += totalOnlineHours[0].Seconds / 60
-		totalOnlineHours[0].Seconds = totalOnlineHours[0].Seconds % 60
-
-		totalOnlineHours[0].Hour += totalOnlineHours[0].Minutes / 60
-		totalOnlineHours[0].Minutes = totalOnlineHours[0].Minutes % 60
-
-		totalRestBlogs += originalTotalBlogs
-		// Reset the online hours for each user
-		user.OnlineHours = models.TimeEntryScanner{
-			models.TimeEntry{
-				Hour:    0,
-				Minutes: 0,
-				Seconds: 0,
-			},
-		}
-
-		user.TotalBlogs = 0
-
-		// Update the total online hours for the user
-		user.TotalOnlineHours = totalOnlineHours
-		user.TotalRestBlogs = totalRestBlogs
-		// Save the updated user in the database
-		if err := initializers.DB.Save(&user).Error; err != nil {
-			fmt.Println("Error saving user:", err)
-			continue
-		}
-
-		// Find the corresponding online storage entry for the current year and user
-		var onlineStorage models.OnlineStorage
-		if err := initializers.DB.Where("user_id = ? AND year = ?", user.ID, currentYear).First(&onlineStorage).Error; err != nil {
-			if err != gorm.ErrRecordNotFound {
-				fmt.Println("Error finding online storage:", err)
-				continue
-			}
-
-			// If the online storage entry for the current year does not exist, create a new one
-			onlineStorage = models.OnlineStorage{
-				UserID: user.ID,
-				Year:   currentYear,
-				Data:   []byte("[]"), // Initialize with empty array for month data
-			}
-		}
-
-		// Parse the existing online storage data from JSON
-		var monthData []models.MonthData
-		if err := json.Unmarshal(onlineStorage.Data, &monthData); err != nil {
-			fmt.Println("Error unmarshaling online storage data:", err)
-			continue
-		}
-
-		// Find the current month's data in the online storage data
-		found := false
-		for i, data := range monthData {
-			if data.Month == currentMonth.String() {
-				// Update the hours with the retrieved online hours data
-				monthData[i].Hours = []models.TimeEntry(originalOnlineHours)
-				monthData[i].PostsCount = originalTotalBlogs
-				found = true
-				break
-			}
-		}
-
-		// If the current month's data was not found, create a new entry with the retrieved online hours data
-		if !found {
-			newMonthData := models.MonthData{
-				Month:      currentMonth.String(),
-				Hours:      []models.TimeEntry(originalOnlineHours),
-				PostsCount: originalTotalBlogs,
-				// ...
-			}
-			monthData = append(monthData, newMonthData)
-		}
-
-		// Serialize the updated online storage data to JSON
-		updatedData, err := json.Marshal(monthData)
-		if err != nil {
-			fmt.Println("Error marshaling updated month data:", err)
-			continue
-		}
-
-		// Update the online storage data in the database
-		onlineStorage.Data = updatedData
-		if err := initializers.DB.Save(&onlineStorage).Error; err != nil {
-			fmt.Println("Error saving online storage:", err)
-			continue
-		}
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- app.Listen(":8888")
+		// listenErr <- app.ListenTLS(":8888", "./selfsigned.crt", "./selfsigned.key")
+	}()
 
-		fmt.Printf("Online hours reset and online storage updated for user ID: %s\n", user.ID)
+	select {
+	case err := <-listenErr:
+		log.Fatal(err)
+	case <-shutdown.Done():
 	}
+	stopSignals()
 
-	// Check if it's the last day of December
-	if (currentMonth == time.December && currentDay == time.Date(currentYear, 12, 31, 0, 0, 0, 0, time.UTC).Day()) ||
-		(currentMonth == time.February && currentDay == time.Date(currentYear, 2, getLastDayOfFebruary(currentYear), 0, 0, 0, 0, time.UTC).Day()) {
-		// Find all users again
-		var users []models.User
-		if err := initializers.DB.Find(&users).Error; err != nil {
-			fmt.Println("Error finding users:", err)
-			return
-		}
+	// Report not ready first so the load balancer stops sending traffic,
+	// then move the websocket clients to other nodes and let the in-flight
+	// requests finish.
+	settings := utils.CurrentShutdownSettings()
+	log.Println("Shutting down, draining for", settings.DrainDelay)
+	utils.SetDraining()
+	time.Sleep(settings.DrainDelay)
 
-		// Iterate over each user
-		for _, user := range users {
-			// Check if the next year's online storage entry already exists for the user
-			var nextYearOnlineStorage models.OnlineStorage
-			err := initializers.DB.Where("user_id = ? AND year = ?", user.ID, currentYear+1).First(&nextYearOnlineStorage).Error
-			if err != nil {
-				if err != gorm.ErrRecordNotFound {
-					fmt.Println("Error finding next year's online storage:", err)
-					continue
-				}
+	sockets := utils.DrainGateway(settings.DrainDelay) + routes_stream.Drain()
+	log.Println("Closed", sockets, "websocket connections")
 
-				// Create a new row in the "online_storages" table for the next year
-				nextYear := currentYear + 1
-				newOnlineStorage := models.OnlineStorage{
-					UserID: user.ID,
-					Year:   nextYear,
-					Data:   []byte("[]"), // Initialize with empty array for month data
-				}
-				if err := initializers.DB.Create(&newOnlineStorage).Error; err != nil {
-					fmt.Println("Error creating online storage for the next year:", err)
-				}
-			}
-		}
+	if err := app.ShutdownWithTimeout(settings.Timeout); err != nil {
+		log.Println("Failed to drain requests:", err)
 	}
 
-}
+	stopBackground()
+	tickers.Wait()
 
-// getLastDayOfFebruary returns the last day of February for the given year
-func getLastDayOfFebruary(year int) int {
-	if isLeapYear(year) {
-		return 29
+	bot.StopReceivingUpdates()
+	conn.Close()
+	if db, err := initializers.DB.DB(); err == nil {
+		db.Close()
 	}
-	return 28
+	initializers.RedisClient.Close()
+	log.Println("Server stopped")
 }
 
-// Function to check if a year is a leap year
-func isLeapYear(year int) bool {
-	if year%4 == 0 && (year%100 != 0 || year%400 == 0) {
-		return true
-	}
-	return false
+// runTicker runs task every interval until ctx is done. A running task is
+// finished before it stops, wg waits for that.
+func runTicker(ctx context.Context, wg *sync.WaitGroup, interval time.Duration, task func()) {
+	ticker := time.NewTicker(interval)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				task()
+			}
+		}
+	}()
 }
@@ -0,0 +1,219 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"strconv"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+	"hyperpage/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// CreateAdCampaign starts an ad campaign for a promoted post of the current
+// user, its budget is reserved from their balance.
+func CreateAdCampaign(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	var payload utils.AdCampaignInput
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	campaign, err := utils.CreateAdCampaign(user.ID, payload)
+	if err != nil {
+		return adErrorResponse(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"status": "success",
+		"data":   campaign,
+	})
+}
+
+// GetAdCampaigns lists the ad campaigns of the current user, newest first.
+// status and blogId filter them.
+func GetAdCampaigns(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	limit, err := strconv.Atoi(c.Query("limit", "20"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid limit parameter",
+		})
+	}
+	skip, err := strconv.Atoi(c.Query("skip", "0"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid skip parameter",
+		})
+	}
+
+	query := initializers.DB.Model(&models.AdCampaign{}).Where("user_id = ?", user.ID)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if blogID := c.Query("blogId"); blogID != "" {
+		query = query.Where("blog_id = ?", blogID)
+	}
+
+	var total int64
+	query.Count(&total)
+
+	var campaigns []models.AdCampaign
+	if err := query.Preload("Targets").Order("created_at DESC").Limit(limit).Offset(skip).Find(&campaigns).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve data",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   campaigns,
+		"meta": fiber.Map{
+			"total": total,
+			"limit": limit,
+			"skip":  skip,
+		},
+	})
+}
+
+// GetAdCampaign returns an ad campaign of the current user with its daily
+// impressions, clicks and spending.
+func GetAdCampaign(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid campaign ID",
+		})
+	}
+
+	campaign, err := utils.FindAdCampaign(user.ID, id)
+	if err != nil {
+		return adErrorResponse(c, err)
+	}
+	days, err := utils.AdCampaignDays(campaign.ID)
+	if err != nil {
+		return adErrorResponse(c, err)
+	}
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data": fiber.Map{
+			"campaign": campaign,
+			"days":     days,
+		},
+	})
+}
+
+// PauseAdCampaign takes a running ad campaign of the current user out of
+// the rotation.
+func PauseAdCampaign(c *fiber.Ctx) error {
+	return setAdCampaignPaused(c, true)
+}
+
+// ResumeAdCampaign puts a paused ad campaign of the current user back into
+// the rotation.
+func ResumeAdCampaign(c *fiber.Ctx) error {
+	return setAdCampaignPaused(c, false)
+}
+
+func setAdCampaignPaused(c *fiber.Ctx, pause bool) error {
+	user := c.Locals("user").(models.UserResponse)
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid campaign ID",
+		})
+	}
+
+	campaign, err := utils.PauseAdCampaign(user.ID, id, pause)
+	if err != nil {
+		return adErrorResponse(c, err)
+	}
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   campaign,
+	})
+}
+
+// EndAdCampaign ends an ad campaign of the current user and refunds the
+// rest of its budget.
+func EndAdCampaign(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid campaign ID",
+		})
+	}
+
+	campaign, err := utils.EndAdCampaign(user.ID, id)
+	if err != nil {
+		return adErrorResponse(c, err)
+	}
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   campaign,
+	})
+}
+
+// RecordAdClick records the click on an ad the rotation showed to the same
+// visitor.
+func RecordAdClick(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("impressionId"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid impression ID",
+		})
+	}
+
+	viewerKey := utils.VisitorKey(optionalUserID(c), c.IP(), c.Get(fiber.HeaderUserAgent))
+	if err := utils.RecordAdClick(id, viewerKey); err != nil {
+		return adErrorResponse(c, err)
+	}
+	return c.JSON(fiber.Map{
+		"status": "success",
+	})
+}
+
+func adErrorResponse(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, utils.ErrAdCampaignInvalid), err == utils.ErrAdNotPromoted:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	case err == utils.ErrAdCampaignNotFound, err == utils.ErrAdImpressionNotFound:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	case err == utils.ErrAdCampaignState:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	case err == utils.ErrInsufficientBalance:
+		return c.Status(fiber.StatusPaymentRequired).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Insufficient balance",
+		})
+	}
+	log.Println("Ad campaign error:", err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"status":  "error",
+		"message": "Could not process the campaign",
+	})
+}
@@ -0,0 +1,228 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+	"hyperpage/utils"
+
+	"github.com/gofiber/fiber/v2"
+	uuid "github.com/satori/go.uuid"
+)
+
+const analyticsDateLayout = "2006-01-02"
+
+// maxAnalyticsDays limits the date range of a single analytics request.
+const maxAnalyticsDays = 366
+
+// optionalUserID returns the ID of the logged in user on public routes, or
+// nil for guests.
+func optionalUserID(c *fiber.Ctx) *uuid.UUID {
+	var accessToken string
+	if authorization := c.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		accessToken = strings.TrimPrefix(authorization, "Bearer ")
+	} else {
+		accessToken = c.Cookies("access_token")
+	}
+	if accessToken == "" {
+		return nil
+	}
+
+	config, _ := initializers.LoadConfig(".")
+	tokenClaims, err := utils.ValidateToken(accessToken, config.AccessTokenPublicKey)
+	if err != nil {
+		return nil
+	}
+
+	userID, err := uuid.FromString(tokenClaims.UserID)
+	if err != nil {
+		return nil
+	}
+	return &userID
+}
+
+// analyticsRange parses the from and to query parameters, by default the
+// last 30 days.
+func analyticsRange(c *fiber.Ctx) (time.Time, time.Time, error) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	from := today.AddDate(0, 0, -29)
+	to := today
+
+	if value := c.Query("from"); value != "" {
+		parsed, err := time.Parse(analyticsDateLayout, value)
+		if err != nil {
+			return from, to, err
+		}
+		from = parsed
+	}
+	if value := c.Query("to"); value != "" {
+		parsed, err := time.Parse(analyticsDateLayout, value)
+		if err != nil {
+			return from, to, err
+		}
+		to = parsed
+	}
+
+	if to.Before(from) || to.Sub(from) > maxAnalyticsDays*24*time.Hour {
+		return from, to, fmt.Errorf("invalid date range")
+	}
+	return from, to, nil
+}
+
+type analyticsDay struct {
+	Date         string `json:"date"`
+	Views        int64  `json:"views"`
+	Favorites    int64  `json:"favorites"`
+	Votes        int64  `json:"votes"`
+	ChatRooms    int64  `json:"chatRooms"`
+	CallRequests int64  `json:"callRequests"`
+}
+
+// loadAnalytics sums the daily stats of the posts, one entry per day of the
+// range including the days without activity.
+func loadAnalytics(blogIDs []uint64, from, to time.Time) ([]analyticsDay, error) {
+	var rows []analyticsDay
+	if len(blogIDs) > 0 {
+		if err := initializers.DB.Model(&models.BlogDailyStat{}).
+			Select("to_char(date, 'YYYY-MM-DD') AS date, SUM(views) AS views, SUM(favorites) AS favorites, SUM(votes) AS votes, SUM(chat_rooms) AS chat_rooms, SUM(call_requests) AS call_requests").
+			Where("blog_id IN ? AND date BETWEEN ? AND ?", blogIDs, from, to).
+			Group("date").
+			Scan(&rows).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	byDate := make(map[string]analyticsDay, len(rows))
+	for _, row := range rows {
+		byDate[row.Date] = row
+	}
+
+	days := []analyticsDay{}
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		date := day.Format(analyticsDateLayout)
+		entry, ok := byDate[date]
+		if !ok {
+			entry = analyticsDay{Date: date}
+		}
+		days = append(days, entry)
+	}
+	return days, nil
+}
+
+func sendAnalytics(c *fiber.Ctx, name string, days []analyticsDay) error {
+	var total analyticsDay
+	for _, day := range days {
+		total.Views += day.Views
+		total.Favorites += day.Favorites
+		total.Votes += day.Votes
+		total.ChatRooms += day.ChatRooms
+		total.CallRequests += day.CallRequests
+	}
+
+	if c.Query("format") != "csv" {
+		return c.JSON(fiber.Map{
+			"status": "success",
+			"data":   days,
+			"meta": fiber.Map{
+				"views":        total.Views,
+				"favorites":    total.Favorites,
+				"votes":        total.Votes,
+				"chatRooms":    total.ChatRooms,
+				"callRequests": total.CallRequests,
+			},
+		})
+	}
+
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	_ = writer.Write([]string{"date", "views", "favorites", "votes", "chat_rooms", "call_requests"})
+	for _, day := range days {
+		_ = writer.Write([]string{
+			day.Date,
+			strconv.FormatInt(day.Views, 10),
+			strconv.FormatInt(day.Favorites, 10),
+			strconv.FormatInt(day.Votes, 10),
+			strconv.FormatInt(day.ChatRooms, 10),
+			strconv.FormatInt(day.CallRequests, 10),
+		})
+	}
+	writer.Flush()
+
+	c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s.csv"`, name))
+	return c.Send(buf.Bytes())
+}
+
+func GetBlogAnalytics(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	var blog models.Blog
+	if err := initializers.DB.Where("id = ?", c.Params("id")).First(&blog).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Element not found",
+		})
+	}
+
+	if user.Role != "admin" && blog.UserID != user.ID {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Unauthorized",
+		})
+	}
+
+	from, to, err := analyticsRange(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid date range",
+		})
+	}
+
+	days, err := loadAnalytics([]uint64{blog.ID}, from, to)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve data",
+		})
+	}
+
+	return sendAnalytics(c, fmt.Sprintf("blog-%d-%s-%s", blog.ID, from.Format(analyticsDateLayout), to.Format(analyticsDateLayout)), days)
+}
+
+// GetAuthorAnalytics sums the analytics of all posts of the current user.
+func GetAuthorAnalytics(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	from, to, err := analyticsRange(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid date range",
+		})
+	}
+
+	var blogIDs []uint64
+	if err := initializers.DB.Model(&models.Blog{}).Where("user_id = ?", user.ID).Pluck("id", &blogIDs).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve data",
+		})
+	}
+
+	days, err := loadAnalytics(blogIDs, from, to)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve data",
+		})
+	}
+
+	return sendAnalytics(c, fmt.Sprintf("blogs-%s-%s", from.Format(analyticsDateLayout), to.Format(analyticsDateLayout)), days)
+}
@@ -0,0 +1,436 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+	"hyperpage/utils"
+
+	"github.com/gofiber/fiber/v2"
+	uuid "github.com/satori/go.uuid"
+)
+
+type BookAppointmentRequest struct {
+	SellerID string    `json:"sellerId"`
+	StartsAt time.Time `json:"startsAt"`
+	Note     string    `json:"note"`
+}
+
+type RescheduleAppointmentRequest struct {
+	StartsAt time.Time `json:"startsAt"`
+}
+
+// GetAppointmentSchedule returns the schedule of the current user with the
+// URL of its iCalendar feed and the exceptions to come.
+func GetAppointmentSchedule(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	schedule, err := utils.GetAppointmentSchedule(user.ID)
+	if err != nil {
+		return appointmentErrorResponse(c, err)
+	}
+	var exceptions []models.AppointmentException
+	initializers.DB.Where("user_id = ? AND date >= ?", user.ID, time.Now().AddDate(0, 0, -1).Format("2006-01-02")).
+		Order("date").Find(&exceptions)
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data": fiber.Map{
+			"schedule":   schedule,
+			"exceptions": exceptions,
+			"feedUrl":    utils.AppointmentFeedURL(schedule.FeedToken),
+		},
+	})
+}
+
+// SaveAppointmentSchedule publishes the weekly availability of the current
+// user, a seller, with the length, buffer and price of the slots.
+func SaveAppointmentSchedule(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+	if !user.Seller {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Only sellers can take appointments",
+		})
+	}
+
+	var payload utils.ScheduleInput
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	schedule, err := utils.SaveAppointmentSchedule(user.ID, payload)
+	if err != nil {
+		return appointmentErrorResponse(c, err)
+	}
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data": fiber.Map{
+			"schedule": schedule,
+			"feedUrl":  utils.AppointmentFeedURL(schedule.FeedToken),
+		},
+	})
+}
+
+// AddAppointmentException blocks or opens a window on a date of the
+// schedule of the current user.
+func AddAppointmentException(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	var payload models.AppointmentException
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	exception, err := utils.AddAppointmentException(user.ID, payload)
+	if err != nil {
+		return appointmentErrorResponse(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"status": "success",
+		"data":   exception,
+	})
+}
+
+// DeleteAppointmentException removes an exception of the schedule of the
+// current user.
+func DeleteAppointmentException(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	result := initializers.DB.Where("id = ? AND user_id = ?", c.Params("id"), user.ID).Delete(&models.AppointmentException{})
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not delete the exception",
+		})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Exception not found",
+		})
+	}
+	return c.JSON(fiber.Map{
+		"status": "success",
+	})
+}
+
+// RotateAppointmentFeed gives the iCalendar feed of the current user a new
+// URL.
+func RotateAppointmentFeed(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	token, err := utils.RotateAppointmentFeed(user.ID)
+	if err != nil {
+		return appointmentErrorResponse(c, err)
+	}
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data": fiber.Map{
+			"feedUrl": utils.AppointmentFeedURL(token),
+		},
+	})
+}
+
+// GetAppointmentFeed serves the iCalendar feed of a seller to calendar
+// clients, the token of its URL authenticates it.
+func GetAppointmentFeed(c *fiber.Ctx) error {
+	feed, err := utils.AppointmentFeed(strings.TrimSuffix(c.Params("token"), ".ics"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).SendString("Calendar not found")
+	}
+	c.Set(fiber.HeaderContentType, "text/calendar; charset=utf-8")
+	c.Set(fiber.HeaderCacheControl, "private, max-age=300")
+	return c.Send(feed)
+}
+
+// GetAppointmentSlots lists the free slots of a seller for days days from
+// the from date, 7 days from today by default.
+func GetAppointmentSlots(c *fiber.Ctx) error {
+	sellerID, err := uuid.FromString(c.Params("userId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid user ID",
+		})
+	}
+
+	from := time.Now()
+	if date := c.Query("from"); date != "" {
+		if from, err = time.Parse("2006-01-02", date); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Invalid from parameter, YYYY-MM-DD is expected",
+			})
+		}
+	}
+	days, err := strconv.Atoi(c.Query("days", "7"))
+	if err != nil || days < 1 || days > 62 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid days parameter",
+		})
+	}
+
+	schedule, slots, err := utils.FreeAppointmentSlots(sellerID, from, days)
+	if err != nil {
+		return appointmentErrorResponse(c, err)
+	}
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data": fiber.Map{
+			"timezone":    schedule.Timezone,
+			"slotMinutes": schedule.SlotMinutes,
+			"price":       schedule.Price,
+			"slots":       slots,
+		},
+	})
+}
+
+// BookAppointment books a free slot of a seller for the current user.
+func BookAppointment(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	var payload BookAppointmentRequest
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+	sellerID, err := uuid.FromString(payload.SellerID)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid seller ID",
+		})
+	}
+
+	appointment, err := utils.BookAppointment(user.ID, sellerID, payload.StartsAt, payload.Note)
+	if err != nil {
+		return appointmentErrorResponse(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"status": "success",
+		"data":   appointment,
+	})
+}
+
+// GetAppointments lists the appointments of the current user by start,
+// as=buyer or as=seller keeps one side and upcoming=true the ones to come.
+func GetAppointments(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	limit, err := strconv.Atoi(c.Query("limit", "20"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid limit parameter",
+		})
+	}
+	skip, err := strconv.Atoi(c.Query("skip", "0"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid skip parameter",
+		})
+	}
+
+	query := initializers.DB.Model(&models.Appointment{})
+	switch c.Query("as") {
+	case "buyer":
+		query = query.Where("buyer_id = ?", user.ID)
+	case "seller":
+		query = query.Where("seller_id = ?", user.ID)
+	default:
+		query = query.Where("buyer_id = ? OR seller_id = ?", user.ID, user.ID)
+	}
+	order := "starts_at DESC"
+	if c.Query("upcoming") == "true" {
+		query = query.Where("status = ? AND ends_at > ?", models.AppointmentStatusBooked, time.Now())
+		order = "starts_at"
+	}
+
+	var total int64
+	query.Count(&total)
+
+	var appointments []models.Appointment
+	if err := query.Order(order).Limit(limit).Offset(skip).Find(&appointments).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve data",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   appointments,
+		"meta": fiber.Map{
+			"total": total,
+			"limit": limit,
+			"skip":  skip,
+		},
+	})
+}
+
+// GetAppointment returns an appointment of the current user.
+func GetAppointment(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+	id, err := uuid.FromString(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid appointment ID",
+		})
+	}
+
+	appointment, err := utils.FindAppointment(user.ID, id)
+	if err != nil {
+		return appointmentErrorResponse(c, err)
+	}
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   appointment,
+	})
+}
+
+// GetAppointmentICS downloads an appointment of the current user as an
+// .ics file.
+func GetAppointmentICS(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+	id, err := uuid.FromString(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid appointment ID",
+		})
+	}
+
+	appointment, err := utils.FindAppointment(user.ID, id)
+	if err != nil {
+		return appointmentErrorResponse(c, err)
+	}
+	c.Set(fiber.HeaderContentType, "text/calendar; charset=utf-8")
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="appointment-`+appointment.ID.String()+`.ics"`)
+	return c.Send(utils.AppointmentICS(appointment))
+}
+
+// RescheduleAppointment moves an appointment of the current user to another
+// free slot.
+func RescheduleAppointment(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+	id, err := uuid.FromString(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid appointment ID",
+		})
+	}
+
+	var payload RescheduleAppointmentRequest
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	appointment, err := utils.RescheduleAppointment(user.ID, id, payload.StartsAt)
+	if err != nil {
+		return appointmentErrorResponse(c, err)
+	}
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   appointment,
+	})
+}
+
+// CancelAppointment cancels an appointment of the current user and refunds
+// its prepayment.
+func CancelAppointment(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+	id, err := uuid.FromString(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid appointment ID",
+		})
+	}
+
+	appointment, err := utils.CancelAppointment(user.ID, id)
+	if err != nil {
+		return appointmentErrorResponse(c, err)
+	}
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   appointment,
+	})
+}
+
+// JoinAppointment issues the token of the meeting of an appointment to the
+// current user.
+func JoinAppointment(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+	id, err := uuid.FromString(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid appointment ID",
+		})
+	}
+
+	join, err := utils.JoinAppointment(user.ID, id)
+	if err != nil {
+		return appointmentErrorResponse(c, err)
+	}
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   join,
+	})
+}
+
+func appointmentErrorResponse(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, utils.ErrScheduleInvalid), err == utils.ErrAppointmentSelf:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	case err == utils.ErrScheduleNotFound, err == utils.ErrAppointmentNotFound:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	case err == utils.ErrSlotUnavailable, err == utils.ErrAppointmentState:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	case err == utils.ErrInsufficientBalance:
+		return c.Status(fiber.StatusPaymentRequired).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Insufficient balance",
+		})
+	case err == utils.ErrPaxmeetNotConfigured:
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Meetings are not available",
+		})
+	}
+	log.Println("Appointment error:", err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"status":  "error",
+		"message": "Could not process the appointment",
+	})
+}
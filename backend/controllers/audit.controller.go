@@ -0,0 +1,271 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+	"hyperpage/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// maxAuditExport limits the events of a single export.
+const maxAuditExport = 50000
+
+// auditEventsQuery applies the filters of the admin audit API. Dates are
+// inclusive days, action ending with * matches a prefix.
+func auditEventsQuery(c *fiber.Ctx) (*gorm.DB, error) {
+	query := initializers.DB.Model(&models.AuditEvent{})
+
+	if actorID := c.Query("actorId"); actorID != "" {
+		query = query.Where("actor_id = ?", actorID)
+	}
+	if action := c.Query("action"); strings.HasSuffix(action, "*") {
+		query = query.Where("action LIKE ?", strings.TrimSuffix(action, "*")+"%")
+	} else if action != "" {
+		query = query.Where("action = ?", action)
+	}
+	if category := c.Query("category"); category != "" {
+		query = query.Where("category = ?", category)
+	}
+	if targetType := c.Query("targetType"); targetType != "" {
+		query = query.Where("target_type = ?", targetType)
+	}
+	if targetID := c.Query("targetId"); targetID != "" {
+		query = query.Where("target_id = ?", targetID)
+	}
+	if requestID := c.Query("requestId"); requestID != "" {
+		query = query.Where("request_id = ?", requestID)
+	}
+	if ip := c.Query("ip"); ip != "" {
+		query = query.Where("ip = ?", ip)
+	}
+	switch c.Query("outcome") {
+	case "success":
+		query = query.Where("status < 400")
+	case "failure":
+		query = query.Where("status >= 400")
+	}
+	if value := c.Query("from"); value != "" {
+		from, err := time.Parse(analyticsDateLayout, value)
+		if err != nil {
+			return nil, err
+		}
+		query = query.Where("created_at >= ?", from)
+	}
+	if value := c.Query("to"); value != "" {
+		to, err := time.Parse(analyticsDateLayout, value)
+		if err != nil {
+			return nil, err
+		}
+		query = query.Where("created_at < ?", to.AddDate(0, 0, 1))
+	}
+	return query, nil
+}
+
+// GetAuditEvents lists the audit log for admins, newest first.
+func GetAuditEvents(c *fiber.Ctx) error {
+	query, err := auditEventsQuery(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid date, use YYYY-MM-DD",
+		})
+	}
+
+	limit, err := strconv.Atoi(c.Query("limit", "50"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid limit parameter",
+		})
+	}
+	skip, err := strconv.Atoi(c.Query("skip", "0"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid skip parameter",
+		})
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve data",
+		})
+	}
+
+	var events []models.AuditEvent
+	if err := query.Order("id DESC").Limit(limit).Offset(skip).Find(&events).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve data",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   events,
+		"meta": fiber.Map{
+			"total": total,
+			"limit": limit,
+			"skip":  skip,
+		},
+	})
+}
+
+// ExportAuditEvents exports the filtered audit log as CSV, or as JSON lines
+// with format=json, oldest first.
+func ExportAuditEvents(c *fiber.Ctx) error {
+	query, err := auditEventsQuery(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid date, use YYYY-MM-DD",
+		})
+	}
+
+	var events []models.AuditEvent
+	if err := query.Order("id").Limit(maxAuditExport).Find(&events).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve data",
+		})
+	}
+
+	var buf bytes.Buffer
+	if c.Query("format") == "json" {
+		encoder := json.NewEncoder(&buf)
+		for _, event := range events {
+			_ = encoder.Encode(event)
+		}
+		c.Set(fiber.HeaderContentType, "application/x-ndjson")
+		c.Set(fiber.HeaderContentDisposition, `attachment; filename="audit.jsonl"`)
+		return c.Send(buf.Bytes())
+	}
+
+	writer := csv.NewWriter(&buf)
+	_ = writer.Write([]string{"id", "created_at", "category", "action", "actor_id", "actor_role", "target_type", "target_id",
+		"status", "ip", "user_agent", "request_id", "method", "path", "before", "after", "prev_hash", "hash"})
+	for _, event := range events {
+		actorID := ""
+		if event.ActorID != nil {
+			actorID = event.ActorID.String()
+		}
+		_ = writer.Write([]string{
+			strconv.FormatUint(event.ID, 10),
+			event.CreatedAt.UTC().Format(time.RFC3339Nano),
+			event.Category,
+			event.Action,
+			actorID,
+			event.ActorRole,
+			event.TargetType,
+			event.TargetID,
+			strconv.Itoa(event.Status),
+			event.IP,
+			event.UserAgent,
+			event.RequestID,
+			event.Method,
+			event.Path,
+			string(event.Before),
+			string(event.After),
+			event.PrevHash,
+			event.Hash,
+		})
+	}
+	writer.Flush()
+
+	c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="audit.csv"`)
+	return c.Send(buf.Bytes())
+}
+
+// VerifyAuditLog checks the hash chain of the whole audit log.
+func VerifyAuditLog(c *fiber.Ctx) error {
+	checked, broken, err := utils.VerifyAuditChain()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not verify audit log",
+		})
+	}
+
+	data := fiber.Map{
+		"valid":   broken == nil,
+		"checked": checked,
+	}
+	if broken != nil {
+		data["brokenAt"] = broken.ID
+	}
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   data,
+	})
+}
+
+type SecurityActivity struct {
+	ID        uint64    `json:"id"`
+	Action    string    `json:"action"`
+	Success   bool      `json:"success"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// GetSecurityActivity lists the logins, password and session events of the
+// user, failed logins to the account included.
+func GetSecurityActivity(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	limit, err := strconv.Atoi(c.Query("limit", "20"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid limit parameter",
+		})
+	}
+	skip, err := strconv.Atoi(c.Query("skip", "0"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid skip parameter",
+		})
+	}
+
+	var events []models.AuditEvent
+	if err := initializers.DB.
+		Where("category = ?", models.AuditCategorySecurity).
+		Where("actor_id = ? OR (target_type = ? AND target_id = ?)", user.ID, "user", user.ID.String()).
+		Order("id DESC").Limit(limit).Offset(skip).
+		Find(&events).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve data",
+		})
+	}
+
+	activity := make([]SecurityActivity, 0, len(events))
+	for _, event := range events {
+		activity = append(activity, SecurityActivity{
+			ID:        event.ID,
+			Action:    event.Action,
+			Success:   event.Status < fiber.StatusBadRequest,
+			IP:        event.IP,
+			UserAgent: event.UserAgent,
+			CreatedAt: event.CreatedAt,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   activity,
+	})
+}
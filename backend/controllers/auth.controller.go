@@ -85,6 +85,7 @@ func SignUpUser(c *fiber.Ctx) error {
 	} else if result.Error != nil {
 		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"status": "error", "message": "Something bad happened"})
 	}
+	utils.AuditTarget(c, "user", newUser.ID.String())
 
 	code := make([]byte, 20)
 
@@ -141,14 +142,6 @@ func SignUpUser(c *fiber.Ctx) error {
 		Status:      `CLOSED_1`,
 	}
 
-	// Create and save the OnlineStorage object to the database
-	onlineStorage := models.OnlineStorage{
-		UserID: newUser.ID,
-		Year:   time.Now().Year(), // Set the current year
-		Data:   []byte("[]"),      // Set the desired data
-	}
-
-	initializers.DB.Create(&onlineStorage)
 	initializers.DB.Create(&transaction)
 	initializers.DB.Create(&billing)
 
@@ -249,18 +242,10 @@ func SignUpBot(c *fiber.Ctx) error {
 		Status:      `CLOSED_1`,
 	}
 
-	// Create and save the OnlineStorage object to the database
-	onlineStorage := models.OnlineStorage{
-		UserID: newUser.ID,
-		Year:   time.Now().Year(), // Set the current year
-		Data:   []byte("[]"),      // Set the desired data
-	}
-
 	profile := models.Profile{
 		UserID: newUser.ID,
 	}
 
-	initializers.DB.Create(&onlineStorage)
 	initializers.DB.Create(&transaction)
 	initializers.DB.Create(&billing)
 	initializers.DB.Create(&profile)
@@ -319,6 +304,7 @@ func SignInUser(c *fiber.Ctx) error {
 		}
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "fail", "message": "Internal server error"})
 	}
+	utils.AuditTarget(c, "user", user.ID.String())
 
 	// Check if the user is verified
 	if !user.Verified {
@@ -330,6 +316,14 @@ func SignInUser(c *fiber.Ctx) error {
 	if err != nil {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"status": "fail", "message": message})
 	}
+	// Logins with the right password are always audited, failed ones are
+	// rate limited as anonymous
+	utils.AuditActor(c, user.ID)
+
+	// Check if the user is banned
+	if user.Banned {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"status": "fail", "message": "Account is banned"})
+	}
 
 	// Load configuration
 	config, _ := initializers.LoadConfig(".")
@@ -345,9 +339,8 @@ func SignInUser(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"status": "fail", "message": "Failed to create refresh token"})
 	}
 
-	// Update user session and status
+	// Update user session
 	user.Session = payload.Session
-	user.Online = true
 
 	// Save updated user information to the database
 	if err := initializers.DB.Save(&user).Error; err != nil {
@@ -357,9 +350,15 @@ func SignInUser(c *fiber.Ctx) error {
 	// Set user data in the context
 	c.Locals("user", &user)
 
-	userID := user.ID.String()
-	var addintinal = ""
-	utils.UserActivity("userOnline", userID, addintinal)
+	// The websocket of the session was opened before the login
+	if payload.Session != "" {
+		if err := utils.PresenceConnect(user.ID, payload.Session, c.Get(fiber.HeaderUserAgent)); err != nil {
+			log.Println("Could not start presence session:", err)
+		}
+		if err := utils.SocketHub.BindUser(payload.Session, user.ID); err != nil {
+			log.Println("Could not bind session to user:", err)
+		}
+	}
 	// Send a personal message to the client
 	if err := utils.SendPersonalMessageToClient(payload.Session, "Hello Client"); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "fail", "message": "Failed to send message to client"})
@@ -441,6 +440,12 @@ func RefreshAccessToken(c *fiber.Ctx) error {
 		}
 	}
 
+	utils.AuditActor(c, user.ID)
+
+	if user.Banned {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"status": "fail", "message": "Account is banned"})
+	}
+
 	accessTokenDetails, err := utils.CreateToken(user.ID.String(), config.AccessTokenExpiresIn, config.AccessTokenPrivateKey)
 	if err != nil {
 		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"status": "fail", "message": err.Error()})
@@ -488,6 +493,7 @@ func ForgotPassword(c *fiber.Ctx) error {
 			"message": "Invalid email",
 		})
 	}
+	utils.AuditTarget(c, "user", user.ID.String())
 
 	// TODO: Generate a password reset token and save it to the database
 	resetToken := make([]byte, 20)
@@ -597,6 +603,7 @@ func ResetPassword(c *fiber.Ctx) error {
 			"message": "The reset token is invalid or has expired",
 		})
 	}
+	utils.AuditTarget(c, "user", user.ID.String())
 
 	// Update the user's password and clear the password reset token
 	user.Password = hashedPassword
@@ -671,6 +678,13 @@ func LogoutUser(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "fail", "message": "User not found in the database"})
 	}
 
+	// The websocket stays open but is no longer the user's
+	if userRecord.Session != "" {
+		if err := utils.PresenceDisconnect(userRecord.Session); err != nil {
+			log.Println("Could not end presence session:", err)
+		}
+		utils.SocketHub.UnbindUser(userRecord.Session)
+	}
 	userRecord.Session = ""
 
 	// Сохраните изменения и проверьте запрос
@@ -9,8 +9,6 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"os"
-	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -28,7 +26,6 @@ import (
 	"hyperpage/utils"
 
 	gt "github.com/bas24/googletranslatefree"
-	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
 // test
@@ -131,8 +128,14 @@ type blogResponse struct {
 	Sticker          string                `json:"sticker"`
 	Hashtags         []string              `json:"hashtags"`
 	UserProfile      UserProfileJSON       `json:"userProfile"`
+	CommentsCount    int                   `json:"commentsCount"`
+	CommentsLocked   bool                  `json:"commentsLocked"`
 }
 
+// maxPinnedSlots is the number of pinned promotions shown on top of a
+// category or city.
+const maxPinnedSlots = 3
+
 func AddFav(c *fiber.Ctx) error {
 	favorite := new(models.Favorite)
 
@@ -171,6 +174,7 @@ func AddFav(c *fiber.Ctx) error {
 			"error": "Could not create favorite",
 		})
 	}
+	utils.TrackBlogEvent(blog.ID, models.BlogStatFavorites)
 
 	return c.Status(fiber.StatusOK).JSON(favorite)
 }
@@ -296,6 +300,10 @@ func GetAllBlogs(c *fiber.Ctx) error {
 
 	if isArchive == "true" {
 		query = query.Where("status = ?", "ARCHIVED")
+	} else if c.Query("isPending") == "true" {
+		query = query.Where("status IN (?)", []string{models.BlogStatusPending, models.BlogStatusRejected})
+	} else if c.Query("isDraft") == "true" {
+		query = query.Where("status IN (?)", []string{models.BlogStatusDraft, models.BlogStatusScheduled})
 	} else {
 		query = query.Where("status = ?", "ACTIVE")
 	}
@@ -370,6 +378,9 @@ func SendToArchive(c *fiber.Ctx) error {
 		}
 	}
 
+	utils.InvalidateSEOCache()
+	go utils.SyndicateBlog(blog.ID, models.SyndicationActionDelete)
+
 	return c.JSON(fiber.Map{
 		"status": "success",
 		"data":   "ok",
@@ -563,6 +574,27 @@ func CreateBlog(c *fiber.Ctx) error {
 		})
 	}
 
+	// Drafts and scheduled posts are moderated when they are published,
+	// other posts are held for review when the author is untrusted or a
+	// pre-check fails
+	var publishing struct {
+		Draft bool `json:"draft"`
+	}
+	_ = c.BodyParser(&publishing)
+
+	var flags []utils.ModerationFlag
+	publishFrom := time.Now()
+	if publishing.Draft {
+		blog.Status = models.BlogStatusDraft
+		blog.PublishAt = nil
+	} else if blog.PublishAt != nil && blog.PublishAt.After(publishFrom) {
+		blog.Status = models.BlogStatusScheduled
+		publishFrom = *blog.PublishAt
+	} else {
+		blog.PublishAt = &publishFrom
+		flags = moderateBlogStatus(user, blog)
+	}
+
 	var commission float64
 
 	// Add an amount variable to store the amount for the blog post
@@ -728,16 +760,11 @@ func CreateBlog(c *fiber.Ctx) error {
 			// }
 			// Prepare the private message
 			blog.UserID = uid
-			blog.ExpiredAt = new(time.Time)
 			blog.UniqId = uniqueID
 
-			if blog.Days == 10 {
-				expDate := time.Now().AddDate(10, 0, 0) // Add 10 years
-				blog.ExpiredAt = &expDate
-			} else {
-				expDate := time.Now().AddDate(0, 0, blog.Days)
-				blog.ExpiredAt = &expDate
-			}
+			// For drafts the expiry date is a preview, it is recalculated on publishing
+			expDate := utils.BlogExpiry(blog.Days, publishFrom)
+			blog.ExpiredAt = &expDate
 
 			blog.UserAvatar = user.Photo
 
@@ -756,6 +783,10 @@ func CreateBlog(c *fiber.Ctx) error {
 			// Create blog record in database
 			if err := initializers.DB.Create(&blog).Error; err != nil {
 				log.Println("Could not create blog:", err)
+			} else if len(flags) > 0 {
+				utils.FlagBlogForReview(blog, flags)
+			} else if blog.Status == models.BlogStatusActive {
+				go utils.MatchSavedSearches(blog.ID)
 			}
 		}()
 
@@ -769,16 +800,11 @@ func CreateBlog(c *fiber.Ctx) error {
 	}
 
 	blog.UserID = uid
-	blog.ExpiredAt = new(time.Time)
 	blog.UniqId = uniqueID
 
-	if blog.Days == 10 {
-		expDate := time.Now().AddDate(10, 0, 0) // Add 10 years
-		blog.ExpiredAt = &expDate
-	} else {
-		expDate := time.Now().AddDate(0, 0, blog.Days)
-		blog.ExpiredAt = &expDate
-	}
+	// For drafts the expiry date is a preview, it is recalculated on publishing
+	expDate := utils.BlogExpiry(blog.Days, publishFrom)
+	blog.ExpiredAt = &expDate
 
 	blog.UserAvatar = user.Photo
 
@@ -797,6 +823,10 @@ func CreateBlog(c *fiber.Ctx) error {
 	// Create blog record in database
 	if err := initializers.DB.Create(&blog).Error; err != nil {
 		log.Println("Could not create blog:", err)
+	} else if len(flags) > 0 {
+		utils.FlagBlogForReview(blog, flags)
+	} else if blog.Status == models.BlogStatusActive {
+		go utils.MatchSavedSearches(blog.ID)
 	}
 
 	fmt.Println("END2")
@@ -808,87 +838,6 @@ func CreateBlog(c *fiber.Ctx) error {
 
 }
 
-func formatPriceWithDots(price int) string {
-	formattedPrice := strconv.Itoa(price)
-	n := len(formattedPrice)
-
-	var formattedPriceWithDots string
-	for i := 0; i < n; i++ {
-		formattedPriceWithDots += string(formattedPrice[i])
-		if (n-i-1)%3 == 0 && i != n-1 {
-			formattedPriceWithDots += "."
-		}
-	}
-
-	return formattedPriceWithDots
-}
-func SendBotCallRequest(c *fiber.Ctx) error {
-	// Define the struct to hold the message data
-	type MessageData struct {
-		Name     string `json:"name"`
-		Phone    string `json:"phone"`
-		Tid      int    `json:"blogdata"`
-		Uid      string `json:"uid"`
-		Slug     string `json:"slug"`
-		Category string `json:"category"`
-		Price    int    `json:"price"`
-	}
-
-	// Parse the POST request body into the struct
-	var messageData MessageData
-	if err := c.BodyParser(&messageData); err != nil {
-		// Handle parsing error
-		return err
-	}
-	config2, _ := initializers.LoadConfig(".")
-	cfg := &initializers.Config{
-		TELEGRAM_TOKEN: config2.TELEGRAM_TOKEN,
-		SERVER_URL:     config2.SERVER_URL,
-	}
-
-	// Format the message data
-	URL := fmt.Sprintf("%s/%s/%s", config2.SERVER_URL, messageData.Uid, messageData.Slug)
-	formattedPrice := formatPriceWithDots(messageData.Price)
-
-	// Start the goroutine to send the message
-	go func() {
-		// Create the Telegram bot
-		bot, err := initializers.ConnectTelegram(cfg)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer bot.StopReceivingUpdates()
-
-		chatID := int64(messageData.Tid)
-
-		// Create the message text
-		msgText := fmt.Sprintf("Здравствуйте, для вас новый запрос!\nИмя: %s\nТелефон: %s\nСсылка: %s\nКатегория: %s\nЦена: %s ₽",
-			messageData.Name, messageData.Phone, URL, messageData.Category, formattedPrice)
-
-		msg := tgbotapi.NewMessage(chatID, msgText)
-
-		// Send the message
-		_, err = bot.Send(msg)
-		if err != nil {
-			// Check if the error message indicates that the bot was blocked by the user
-			if err.Error() == "Forbidden: bot was blocked by the user" {
-				// Handle the case where the bot is blocked by the user
-				fmt.Println("Bot was blocked by the user")
-				return
-			}
-			log.Fatal(err)
-		}
-
-		// Call the controller to process the message
-		// ...
-	}()
-
-	return c.JSON(fiber.Map{
-		"status": "success",
-		"data":   "ok",
-	})
-}
-
 func AddHashTag(c *fiber.Ctx) error {
 
 	var hashtag models.Hashtags
@@ -1073,13 +1022,32 @@ func AddBlogTime(c *fiber.Ctx) error {
 
 	// Add the specified number of days to the existing expired_at value
 	newExpiredAt := blog.ExpiredAt.AddDate(0, 0, daysInt)
-
-	// Update the expired_at, days, and status columns in the database
-	err = initializers.DB.Model(&blog).Updates(map[string]interface{}{
+	updates := map[string]interface{}{
 		"expired_at": newExpiredAt,
 		"days":       daysInt,
-		"status":     "ACTIVE",
-	}).Error
+	}
+
+	// Only live and archived posts are published again, the others keep
+	// their status. Archived posts of untrusted authors go back to review.
+	previousStatus := blog.Status
+	var flags []utils.ModerationFlag
+	switch blog.Status {
+	case models.BlogStatusActive:
+		updates["status"] = models.BlogStatusActive
+	case models.BlogStatusArchived:
+		var author models.User
+		if err := initializers.DB.Where("id = ?", blog.UserID).First(&author).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Failed to fetch the author",
+			})
+		}
+		flags = moderateBlogStatus(&author, &blog)
+		updates["status"] = blog.Status
+	}
+
+	// Update the expired_at, days, and status columns in the database
+	err = initializers.DB.Model(&blog).Updates(updates).Error
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"status":  "error",
@@ -1087,6 +1055,12 @@ func AddBlogTime(c *fiber.Ctx) error {
 		})
 	}
 
+	if len(flags) > 0 {
+		utils.FlagBlogForReview(&blog, flags)
+	} else if previousStatus != models.BlogStatusActive && blog.Status == models.BlogStatusActive {
+		go utils.MatchSavedSearches(blog.ID)
+	}
+
 	return c.JSON(fiber.Map{
 		"status": "success",
 		"data":   "ok",
@@ -1143,13 +1117,9 @@ func CreateBlogPhoto(c *fiber.Ctx) error {
 		})
 	}
 
-	type File struct {
-		Path string `json:"path" validate:"required"`
-	}
-
-	// Parse the request body
+	// Parse the request body, the files keep the variants of the upload
 	var reqBody struct {
-		Files []File `json:"files" validate:"required"`
+		Files []models.PhotoFile `json:"files" validate:"required"`
 	}
 	if err := c.BodyParser(&reqBody); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -1157,9 +1127,12 @@ func CreateBlogPhoto(c *fiber.Ctx) error {
 		})
 	}
 
+	// The variants and placeholder come from the upload, not the client
+	files := utils.ResolvePhotoFiles(c.Locals("user").(models.UserResponse).ID, reqBody.Files)
+
 	// Convert []File to pgtype.JSONB
 	filesJSON := pgtype.JSONB{}
-	if err := filesJSON.Set(reqBody.Files); err != nil {
+	if err := filesJSON.Set(files); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"message": "Error converting files to JSON",
 		})
@@ -1205,21 +1178,6 @@ func CreateBlogPhoto(c *fiber.Ctx) error {
 		})
 	}
 
-	var path string
-	if len(blogPhoto.Files.Bytes) > 0 {
-		var jsonData []map[string]interface{}
-		if err := json.Unmarshal(blogPhoto.Files.Bytes, &jsonData); err != nil {
-			// Handle error
-			_ = err
-		}
-
-		if len(jsonData) > 0 {
-			if p, ok := jsonData[0]["path"].(string); ok {
-				path = p
-			}
-		}
-	}
-
 	userId := c.Locals("user")
 	userResp := userId.(models.UserResponse)
 	userObj := models.User{
@@ -1241,176 +1199,54 @@ func CreateBlogPhoto(c *fiber.Ctx) error {
 		log.Println("Error:", err)
 	}
 
-	hashtags := make([]string, len(blog.Hashtags))
-	for i, tag := range blog.Hashtags {
-		hashtags[i] = tag.Hashtag
-	}
-
-	var wg sync.WaitGroup
-
-	if user.TelegramActivated {
-		wg.Add(1)
-
-		// Start consuming messages in a separate goroutine
-		go func() {
-
-			defer wg.Done()
-
-			type forBot struct {
-				Name     string   `json:"title"`
-				Url      string   `json:"url"`
-				Cat      string   `json:"cat"`
-				Username string   `json:"name"`
-				City     string   `json:"city"`
-				Total    float64  `json:"total"`
-				Hashtags []string `json:"hashtags"`
-			}
-
-			forbot := forBot{
-				// City:     blog.City,
-				// Cat:      blog.Catygory,
-				Name:     blog.Title,
-				Total:    blog.Total,
-				Hashtags: hashtags,
-				Url:      "https://" + user.Name + ".myru.online/" + blog.UniqId + "/" + blog.Slug,
-				// Username: user.Name,
-			}
-
-			var addintinal = ""
-			utils.UserActivity("newblog", forbot.Username, addintinal)
-
-			var msgText string
-			if blog.Total == 0 {
-				msgText = fmt.Sprintf("\nГород: %s \nРубрика: %s \nЗаголовок: %s \nURL: %s\nАвтор: @%s", forbot.City, forbot.Cat, forbot.Name, forbot.Url, forbot.Username)
-			} else {
-				msgText = fmt.Sprintf("\nГород: %s \nРубрика: %s \nЗаголовок: %s \nЦена: %.2f ₽ \nURL: %s\nАвтор: @%s", forbot.City, forbot.Cat, forbot.Name, forbot.Total, forbot.Url, forbot.Username)
-			}
-
-			if len(forbot.Hashtags) > 0 {
-				hashtagsText := "\nХештеги: " + strings.Join(forbot.Hashtags, ", ")
-				msgText += hashtagsText
-			}
-
-			config, _ := initializers.LoadConfig(".")
-
-			cfg := &initializers.Config{
-				TELEGRAM_TOKEN:   config.TELEGRAM_TOKEN,
-				TELEGRAM_CHANNEL: config.TELEGRAM_CHANNEL,
-			}
-
-			bot, err := initializers.ConnectTelegram(cfg)
-			if err != nil {
-				log.Panic(err)
-			}
-
-			if userResp.Tcid == 0 {
-
-				// Set up an image file to send
-				absolutePath := filepath.Join(config.IMGStorePath, path)
-				imageFile, err := os.Open(absolutePath)
-				if err != nil {
-					log.Fatal(err)
-				}
-				defer imageFile.Close()
-
-				// Read the image file into a byte slice
-				imageInfo, _ := imageFile.Stat()
-				imageBytes := make([]byte, imageInfo.Size())
-				_, err = imageFile.Read(imageBytes)
-				if err != nil {
-					log.Fatal(err)
-				}
-
-				// Replace with the chat ID you want to send the image to
-				// chatID := int64(-userResp.Tcid)
-
-				// Create a photo message configuration
-				photoConfig := tgbotapi.NewPhoto(user.Tid, tgbotapi.FileBytes{
-					Name:  "image.jpg",
-					Bytes: imageBytes,
-				})
-
-				photoConfig.Caption = fmt.Sprintf("\nГород: %s \nРубрика: %s \nЗаголовок: %s \nURL: %s", forbot.City, forbot.Cat, forbot.Name, forbot.Url)
-
-				if len(forbot.Hashtags) > 0 {
-					hashtagsText := "\nХештеги: " + strings.Join(forbot.Hashtags, ", ")
-					photoConfig.Caption += hashtagsText
-				}
-
-				// Send the photo
-				_, err = bot.Send(photoConfig)
-				if err != nil {
-					log.Fatal(err)
-				}
-			}
-
-			// Set up an image file to send
-			absolutePath := filepath.Join(config.IMGStorePath, path)
-			imageFile, err := os.Open(absolutePath)
-			if err != nil {
-				log.Fatal(err)
-			}
-			defer imageFile.Close()
-
-			// Read the image file into a byte slice
-			imageInfo, _ := imageFile.Stat()
-			imageBytes := make([]byte, imageInfo.Size())
-			_, err = imageFile.Read(imageBytes)
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			// Create a photo message configuration
-			photoConfig := tgbotapi.NewPhoto(-userResp.Tcid, tgbotapi.FileBytes{
-				Name:  "image.jpg",
-				Bytes: imageBytes,
-			})
-
-			photoConfig.Caption = fmt.Sprintf("\nГород: %s \nРубрика: %s \nЗаголовок: %s \nURL: %s", forbot.City, forbot.Cat, forbot.Name, forbot.Url)
-
-			if len(forbot.Hashtags) > 0 {
-				hashtagsText := "\nХештеги: " + strings.Join(forbot.Hashtags, ", ")
-				photoConfig.Caption += hashtagsText
-			}
-
-			if user.TelegramActivated {
-				// Send the photo
-				sentMessage, err := bot.Send(photoConfig)
-				if err != nil {
-					// Check if the error is due to a not found or kicked chat
-					if strings.Contains(err.Error(), "chat not found") || strings.Contains(err.Error(), "bot was kicked") || strings.Contains(err.Error(), "chat_id is empty") {
-						fmt.Println("Chat not found or bot was kicked, skipping send message.")
-					} else {
-						// Handle other errors
-						log.Panic(err)
-					}
-				}
-
-				messageID := sentMessage.MessageID
-				blog.TmId = float64(messageID)
-			}
-
-			// Create blog record in database
-			if err := initializers.DB.Save(&blog).Error; err != nil {
-				log.Println("Could not create blog:", err)
+	// Photos arrive after the post itself, so run the duplicate image check here.
+	// Drafts and scheduled posts are checked when they are published.
+	if blog.Status == models.BlogStatusActive || blog.Status == models.BlogStatusPending {
+		duplicateCheck := utils.DuplicateImageCheck{}
+		blog.Photos = []models.BlogPhoto{blogPhoto}
+		if reason, flagged := duplicateCheck.Check(&blog); flagged {
+			if blog.Status == models.BlogStatusActive {
+				blog.Status = models.BlogStatusPending
+				initializers.DB.Model(&blog).Update("status", blog.Status)
 			}
-		}()
-
-		wg.Wait()
-
-		return c.JSON(fiber.Map{
-			"message": "Blog photo created successfully",
-		})
+			utils.FlagBlogForReview(&blog, []utils.ModerationFlag{{Check: duplicateCheck.Name(), Reason: reason}})
+		} else if blog.Status == models.BlogStatusActive {
+			utils.RecordBlogImageHashes(&blog)
+		}
+		blog.Photos = nil
 	}
 
-	// Wait for the goroutine to complete
-	fmt.Println("hello 2")
+	// Photos complete the post, it is cross-posted once the last one is in
+	if blog.Status == models.BlogStatusActive {
+		utils.UserActivity("newblog", user.Name, "")
+		utils.InvalidateSEOCache()
+		go utils.SyndicateBlogPhotos(blog.ID)
+	}
 
 	return c.JSON(fiber.Map{
 		"message": "Blog photo created successfully",
 	})
 }
 
+// canViewBlog reports whether a post is visible to a viewer. Posts that are
+// not live or archived are only visible to their author and admins.
+func canViewBlog(blog *models.Blog, viewerID *uuid.UUID) bool {
+	if blog.Status == models.BlogStatusActive || blog.Status == models.BlogStatusArchived {
+		return true
+	}
+	if viewerID == nil {
+		return false
+	}
+	if blog.UserID == *viewerID {
+		return true
+	}
+	var viewer models.User
+	if err := initializers.DB.Select("role").Where("id = ?", *viewerID).First(&viewer).Error; err != nil {
+		return false
+	}
+	return viewer.Role == string(models.RoleAdmin)
+}
+
 func GetBlogById(c *fiber.Ctx) error {
 
 	blogID := c.Params("id")
@@ -1429,6 +1265,16 @@ func GetBlogById(c *fiber.Ctx) error {
 			"message": "Element not found",
 		})
 	}
+	viewerID := optionalUserID(c)
+	for _, b := range blog {
+		if !canViewBlog(&b, viewerID) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Element not found",
+			})
+		}
+	}
+
 	var res []*blogResponse
 	for _, b := range blog {
 		userID := b.User.ID
@@ -1440,10 +1286,18 @@ func GetBlogById(c *fiber.Ctx) error {
 			fmt.Println("Error fetching user profile:", err)
 		}
 
-		b.Views++
-		// Save the changes
-		if err := initializers.DB.Save(&b).Error; err != nil {
-			return err
+		// Only the first view of a visitor per day on a live post is counted,
+		// crawlers and the author are skipped
+		if b.Status == models.BlogStatusActive && utils.TrackBlogView(&b, viewerID, c.IP(), c.Get(fiber.HeaderUserAgent)) {
+			b.Views++
+			// Clicks only count when the post was opened from a promoted
+			// slot of the feed, which links with the promo query
+			if c.QueryBool("promo") {
+				utils.TrackPromotionClick(b.ID)
+			}
+			if err := initializers.DB.Model(&b).UpdateColumn("views", gorm.Expr("views + 1")).Error; err != nil {
+				return err
+			}
 		}
 		hashtags := make([]string, len(b.Hashtags))
 		for i, tag := range b.Hashtags {
@@ -1498,20 +1352,22 @@ func GetBlogById(c *fiber.Ctx) error {
 			MultilangDescr:   b.MultilangDescr,
 			MultilangContent: b.MultilangContent,
 
-			Descr:      b.Descr,
-			Lang:       b.Lang,
-			Slug:       b.Slug,
-			Status:     b.Status,
-			Total:      b.Total,
-			Content:    b.Content,
-			City:       cities,
-			Views:      b.Views,
-			UserAvatar: b.UserAvatar,
-			Photos:     b.Photos,
-			CreatedAt:  b.CreatedAt,
-			UpdatedAt:  b.UpdatedAt,
-			Catygory:   categories,
-			Sticker:    b.Sticker,
+			Descr:          b.Descr,
+			Lang:           b.Lang,
+			Slug:           b.Slug,
+			Status:         b.Status,
+			Total:          b.Total,
+			Content:        b.Content,
+			City:           cities,
+			Views:          b.Views,
+			UserAvatar:     b.UserAvatar,
+			Photos:         b.Photos,
+			CreatedAt:      b.CreatedAt,
+			UpdatedAt:      b.UpdatedAt,
+			Catygory:       categories,
+			Sticker:        b.Sticker,
+			CommentsCount:  b.CommentsCount,
+			CommentsLocked: b.CommentsLocked,
 			UserProfile: UserProfileJSON{
 				MultilangDescr: userProfile.MultilangDescr,
 				Streaming:      userProfile.Streaming,
@@ -1624,10 +1480,8 @@ func DeleteBlog(c *fiber.Ctx) error {
 			})
 		}
 
-		// Decode the JSONB data (files) into a slice of strings
-		var filePaths []struct {
-			Path string `json:"path"`
-		}
+		// Decode the JSONB data (files) into a slice of photo files
+		var filePaths []models.PhotoFile
 		if err := files.AssignTo(&filePaths); err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"status":  "error",
@@ -1635,11 +1489,6 @@ func DeleteBlog(c *fiber.Ctx) error {
 			})
 		}
 
-		// Delete the associated files from the server
-		for _, filePath := range filePaths {
-			deleteFileFromServer(filePath.Path)
-		}
-
 		// Delete the blog photo entry from the "blog_photos" table
 		if err := initializers.DB.Delete(&blogPhoto).Error; err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -1647,8 +1496,18 @@ func DeleteBlog(c *fiber.Ctx) error {
 				"message": "Could not delete element",
 			})
 		}
+
+		// Release the files nothing else of the author references
+		for _, filePath := range filePaths {
+			utils.DeletePhotoFileIfUnused(blog.UserID, filePath)
+		}
 	}
 
+	// Delete the revisions together with the photos only they referenced
+	utils.DeleteBlogRevisions(blog.ID)
+	utils.InvalidateSEOCache()
+	go utils.SyndicateBlog(blog.ID, models.SyndicationActionDelete)
+
 	// Proceed with deleting the blog entry
 	err = initializers.DB.Delete(&blog).Error
 	if err != nil {
@@ -1684,7 +1543,8 @@ func GetAll(c *fiber.Ctx) error {
 		language = "en"
 	}
 
-	query := initializers.DB.Order("created_at DESC").
+	// Bumped posts are ranked by the time of the bump
+	query := initializers.DB.Order("COALESCE(blogs.bumped_at, blogs.created_at) DESC").
 		Preload("Catygory.Translations", "language = ?", language).
 		Preload("City.Translations", "language = ?", language).
 		Preload("Hashtags").
@@ -1692,6 +1552,10 @@ func GetAll(c *fiber.Ctx) error {
 		Preload("User").
 		Where("status = ?", "ACTIVE")
 
+	// Category or city the posts are filtered by, pinned promotions apply to it
+	var promotionScope string
+	var promotionScopeID uint
+
 	// Get the query parameters
 	city := c.Query("city")
 	skip := c.Query("skip")
@@ -1729,6 +1593,9 @@ func GetAll(c *fiber.Ctx) error {
 
 			// Добавим условие, чтобы ваш основной запрос включал только записи с blog_id из подзапроса
 			query = query.Where("blogs.id IN (?)", subQuery) // Specify the table alias for "blogs.id"
+
+			promotionScope = models.PromotionScopeCity
+			promotionScopeID = cityTranslation.CityID
 		}
 	}
 
@@ -1743,6 +1610,9 @@ func GetAll(c *fiber.Ctx) error {
 
 			// Добавим условие, чтобы ваш основной запрос включил только записи с blog_id из подзапроса
 			query = query.Where("blogs.id IN (?)", subQuery)
+
+			promotionScope = models.PromotionScopeCategory
+			promotionScopeID = guildTranslation.GuildID
 		}
 	}
 
@@ -1784,8 +1654,10 @@ func GetAll(c *fiber.Ctx) error {
 		})
 	}
 
+	skipInt := 0
 	if skip != "" {
-		skipInt, err := strconv.Atoi(skip)
+		var err error
+		skipInt, err = strconv.Atoi(skip)
 		if err != nil {
 			return err
 		}
@@ -1793,8 +1665,6 @@ func GetAll(c *fiber.Ctx) error {
 		if skipInt >= int(count) {
 			skipInt = 0
 		}
-
-		query = query.Offset(skipInt)
 	}
 
 	limit := c.Query("limit", "10")
@@ -1806,15 +1676,81 @@ func GetAll(c *fiber.Ctx) error {
 		})
 	}
 
+	// Posts pinned to the category or city take the top slots of the first
+	// page, in the order of the promotions. They count toward the limit and
+	// are left out of the rest of the list.
+	var pinned []models.Blog
+	if promotionScope != "" {
+		seen := make(map[uint64]bool)
+		var promotionIDs []uint64
+		for _, promotion := range utils.ActivePinnedPromotions(promotionScope, promotionScopeID, maxPinnedSlots) {
+			if !seen[promotion.BlogID] {
+				seen[promotion.BlogID] = true
+				promotionIDs = append(promotionIDs, promotion.ID)
+			}
+		}
+
+		if len(promotionIDs) > 0 {
+			initializers.DB.
+				Joins("JOIN promotions ON promotions.blog_id = blogs.id AND promotions.id IN ?", promotionIDs).
+				Order("promotions.impressions ASC").
+				Order("promotions.id ASC").
+				Preload("Catygory.Translations", "language = ?", language).
+				Preload("City.Translations", "language = ?", language).
+				Preload("Hashtags").
+				Preload("Photos").
+				Preload("User").
+				Find(&pinned)
+		}
+	}
+
+	if len(pinned) > 0 {
+		pinnedIDs := make([]uint64, len(pinned))
+		for i, b := range pinned {
+			pinnedIDs[i] = b.ID
+		}
+		query = query.Where("blogs.id NOT IN ?", pinnedIDs)
+
+		if skipInt == 0 {
+			if len(pinned) > limitInt {
+				pinned = pinned[:limitInt]
+			}
+			limitInt -= len(pinned)
+		} else {
+			skipInt -= len(pinned)
+			if skipInt < 0 {
+				skipInt = 0
+			}
+			pinned = nil
+		}
+	}
+
+	if skipInt > 0 {
+		query = query.Offset(skipInt)
+	}
 	query = query.Limit(limitInt)
 
-	err = query.Find(&blogs).Error
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"status":  "error",
-			"message": "Could not retrieve data",
-		})
+	if limitInt > 0 {
+		err = query.Find(&blogs).Error
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Could not retrieve data",
+			})
+		}
+	}
+
+	pinnedIDs := make(map[uint64]bool)
+	for _, b := range pinned {
+		pinnedIDs[b.ID] = true
+	}
+	blogs = append(pinned, blogs...)
+
+	blogIDs := make([]uint64, len(blogs))
+	for i, b := range blogs {
+		blogIDs[i] = b.ID
 	}
+	utils.TrackPromotionImpressions(blogIDs)
 
 	var res []*blogResponse
 	for _, b := range blogs {
@@ -1888,10 +1824,12 @@ func GetAll(c *fiber.Ctx) error {
 			Photos:         b.Photos,
 			CreatedAt:      b.CreatedAt,
 			UpdatedAt:      b.UpdatedAt,
-			Pined:          b.Pined,
+			Pined:          b.Pined || pinnedIDs[b.ID],
 			Catygory:       categories,
 			UniqId:         b.UniqId,
 			Sticker:        b.Sticker,
+			CommentsCount:  b.CommentsCount,
+			CommentsLocked: b.CommentsLocked,
 			User: userResponse{
 				TId:               b.User.Tid,
 				Online:            b.User.Online,
@@ -2136,14 +2074,12 @@ func UpdateBlog(c *fiber.Ctx) error {
 			ID uint64 `json:"id"`
 		} `json:"Catygory"`
 		Photos []struct {
-			ID        int64  `json:"ID"`
-			BlogID    int64  `json:"BlogID"`
-			CreatedAt string `json:"CreatedAt"`
-			UpdatedAt string `json:"UpdatedAt"`
-			DeletedAt string `json:"DeletedAt"`
-			Files     []struct {
-				Path string `json:"path"`
-			} `json:"files"`
+			ID        int64              `json:"ID"`
+			BlogID    int64              `json:"BlogID"`
+			CreatedAt string             `json:"CreatedAt"`
+			UpdatedAt string             `json:"UpdatedAt"`
+			DeletedAt string             `json:"DeletedAt"`
+			Files     []models.PhotoFile `json:"files"`
 		} `json:"photos"`
 	}
 
@@ -2197,6 +2133,16 @@ func UpdateBlog(c *fiber.Ctx) error {
 
 	}
 
+	// Keep the previous version so that it can be compared and rolled back
+	var currentPhotos []models.BlogPhoto
+	initializers.DB.Where("blog_id = ?", blog.ID).Find(&currentPhotos)
+	if _, err := utils.SnapshotBlogRevision(&blog, currentPhotos, userObj.ID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not save revision",
+		})
+	}
+
 	// Retrieve or create new Hashtags based on the request body
 	updatedHashtags := []models.Hashtags{}
 	for _, tag := range requestBody.Hashtags {
@@ -2327,6 +2273,16 @@ func UpdateBlog(c *fiber.Ctx) error {
 	blog.MultilangContent.Ka = translationsContent["ka"]
 	blog.MultilangContent.Es = translationsContent["es"]
 
+	// Edited posts of untrusted authors go back to the review queue
+	previousStatus := blog.Status
+	var flags []utils.ModerationFlag
+	if userObj.Role != "admin" && (blog.Status == models.BlogStatusActive || blog.Status == models.BlogStatusPending) {
+		var author models.User
+		if err := initializers.DB.Where("id = ?", blog.UserID).First(&author).Error; err == nil {
+			flags = moderateBlogStatus(&author, &blog)
+		}
+	}
+
 	if err := initializers.DB.Save(&blog).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"status":  "error",
@@ -2334,6 +2290,12 @@ func UpdateBlog(c *fiber.Ctx) error {
 		})
 	}
 
+	if len(flags) > 0 {
+		utils.FlagBlogForReview(&blog, flags)
+	} else if previousStatus != models.BlogStatusActive && blog.Status == models.BlogStatusActive {
+		go utils.MatchSavedSearches(blog.ID)
+	}
+
 	// Iterate over the photos in the request body
 	for _, photo := range requestBody.Photos {
 		// Find the corresponding blog_photos entry by ID
@@ -2348,8 +2310,8 @@ func UpdateBlog(c *fiber.Ctx) error {
 			})
 		}
 
-		// Convert the Files field to a JSONB value
-		filesJSON, err := json.Marshal(photo.Files)
+		// Convert the Files field to a JSONB value, rebuilt from the uploads
+		filesJSON, err := json.Marshal(utils.ResolvePhotoFiles(blog.UserID, photo.Files))
 		if err != nil {
 			// Handle the error if the conversion fails
 			// For example, you can return an error response
@@ -2369,8 +2331,7 @@ func UpdateBlog(c *fiber.Ctx) error {
 			})
 		}
 
-		// Delete the files that were removed
-		deleteRemovedFiles(blogPhoto.Files, filesJSONB)
+		existingFiles := blogPhoto.Files
 
 		// Update the Files field with the JSONB value
 		blogPhoto.Files = filesJSONB
@@ -2385,6 +2346,18 @@ func UpdateBlog(c *fiber.Ctx) error {
 				"message": "Failed to update photo",
 			})
 		}
+
+		// Delete the files that were removed
+		deleteRemovedFiles(blog.UserID, existingFiles, filesJSONB)
+	}
+
+	// Cross-posted messages follow the post, a post sent back to review is
+	// taken down until it is approved again
+	utils.InvalidateSEOCache()
+	if blog.Status == models.BlogStatusActive {
+		go utils.SyndicateBlog(blog.ID, models.SyndicationActionEdit)
+	} else if previousStatus == models.BlogStatusActive {
+		go utils.SyndicateBlog(blog.ID, models.SyndicationActionDelete)
 	}
 
 	return c.JSON(fiber.Map{
@@ -2394,54 +2367,31 @@ func UpdateBlog(c *fiber.Ctx) error {
 	})
 }
 
-type FileData struct {
-	Path string `json:"path"`
-}
-
-// Function to delete removed files from the server
-func deleteRemovedFiles(existingFiles pgtype.JSONB, newFiles pgtype.JSONB) {
-	var existingPaths []string
-	var newPaths []string
-
-	// Decode the existing and new files into slices of paths
-	var existingData []FileData
+// Function to delete removed files from the server. Files still referenced
+// by a revision are kept until the revision is pruned.
+func deleteRemovedFiles(userID uuid.UUID, existingFiles pgtype.JSONB, newFiles pgtype.JSONB) {
+	// Decode the existing and new files, variants go with their main file
+	var existingData []models.PhotoFile
 	_ = json.Unmarshal(existingFiles.Bytes, &existingData)
-	for _, file := range existingData {
-		existingPaths = append(existingPaths, file.Path)
-	}
 
-	var newData []FileData
+	var newData []models.PhotoFile
 	_ = json.Unmarshal(newFiles.Bytes, &newData)
-	for _, file := range newData {
-		newPaths = append(newPaths, file.Path)
-	}
 
 	// Create a map for faster lookup of new paths
 	newPathsMap := make(map[string]bool)
-	for _, path := range newPaths {
-		newPathsMap[path] = true
+	for _, file := range newData {
+		newPathsMap[file.Path] = true
 	}
 
 	// Check if each existing path is present in the new paths
 	// If not, delete the file from the server
-	for _, path := range existingPaths {
-		if !newPathsMap[path] {
-			deleteFileFromServer(path)
+	for _, file := range existingData {
+		if !newPathsMap[file.Path] {
+			utils.DeletePhotoFileIfUnused(userID, file)
 		}
 	}
 }
 
-// Function to delete a file from the server
-func deleteFileFromServer(path string) {
-	config, _ := initializers.LoadConfig(".")
-
-	// Implement the logic to delete the file from the server
-	// For example, you can use the os.Remove() function
-	absolutePath := filepath.Join(config.IMGStorePath, path)
-
-	_ = os.Remove(absolutePath)
-}
-
 // replaceSpecialChars replaces each special character in the input string
 func replaceSpecialChars(title string) string {
 	// Convert to lowercase
@@ -0,0 +1,220 @@
+package controllers
+
+import (
+	"strconv"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+	"hyperpage/utils"
+
+	"github.com/gofiber/fiber/v2"
+	uuid "github.com/satori/go.uuid"
+)
+
+// CallPeer is the other user of a call in the history.
+type CallPeer struct {
+	ID    uuid.UUID `json:"id"`
+	Name  string    `json:"name"`
+	Photo string    `json:"photo"`
+}
+
+// CallHistoryItem is a call seen from the current user, Outgoing when the
+// user made it.
+type CallHistoryItem struct {
+	models.Call
+	Outgoing bool     `json:"outgoing"`
+	Peer     CallPeer `json:"peer"`
+}
+
+// GetCalls lists the calls of the current user, newest first. The state
+// query filters them, e.g. state=missed.
+func GetCalls(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	limit, err := strconv.Atoi(c.Query("limit", "20"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid limit parameter",
+		})
+	}
+	skip, err := strconv.Atoi(c.Query("skip", "0"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid skip parameter",
+		})
+	}
+
+	query := initializers.DB.Model(&models.Call{}).Where("caller_id = ? OR callee_id = ?", user.ID, user.ID)
+	if state := c.Query("state"); state != "" {
+		query = query.Where("state = ?", state)
+	}
+
+	var total int64
+	query.Count(&total)
+
+	var calls []models.Call
+	if err := query.Order("created_at DESC").Limit(limit).Offset(skip).Find(&calls).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve data",
+		})
+	}
+
+	peerIDs := make([]uuid.UUID, 0, len(calls))
+	for _, call := range calls {
+		peerIDs = append(peerIDs, callPeerID(&call, user.ID))
+	}
+	var peers []CallPeer
+	initializers.DB.Model(&models.User{}).Select("id, name, photo").Where("id IN ?", peerIDs).Find(&peers)
+	peersByID := make(map[uuid.UUID]CallPeer, len(peers))
+	for _, peer := range peers {
+		peersByID[peer.ID] = peer
+	}
+
+	items := make([]CallHistoryItem, 0, len(calls))
+	for _, call := range calls {
+		peerID := callPeerID(&call, user.ID)
+		peer, ok := peersByID[peerID]
+		if !ok {
+			peer = CallPeer{ID: peerID}
+		}
+		items = append(items, CallHistoryItem{Call: call, Outgoing: call.CallerID == user.ID, Peer: peer})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   items,
+		"meta": fiber.Map{
+			"total": total,
+			"limit": limit,
+			"skip":  skip,
+		},
+	})
+}
+
+func callPeerID(call *models.Call, userID uuid.UUID) uuid.UUID {
+	if call.CallerID == userID {
+		return call.CalleeID
+	}
+	return call.CallerID
+}
+
+// GetCall returns a call of the current user.
+func GetCall(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	callID, err := uuid.FromString(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid call ID",
+		})
+	}
+
+	call, err := utils.FindCall(user.ID, callID)
+	if err != nil {
+		return callErrorResponse(c, err)
+	}
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   call,
+	})
+}
+
+// RejectCall declines a ringing call, for devices that are not connected to
+// the websocket, e.g. from the call screen of iOS.
+func RejectCall(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	callID, err := uuid.FromString(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid call ID",
+		})
+	}
+
+	call, err := utils.RejectCall(user.ID, callID)
+	if err != nil {
+		return callErrorResponse(c, err)
+	}
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   call,
+	})
+}
+
+// EndCall hangs up a call of the current user.
+func EndCall(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	callID, err := uuid.FromString(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid call ID",
+		})
+	}
+
+	call, err := utils.EndCall(user.ID, callID)
+	if err != nil {
+		return callErrorResponse(c, err)
+	}
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   call,
+	})
+}
+
+// EscalateCall moves a call in progress to a conference in the direct chat
+// of its users and ends the call.
+func EscalateCall(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	callID, err := uuid.FromString(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid call ID",
+		})
+	}
+
+	conference, err := utils.EscalateCall(user.ID, callID)
+	if err == utils.ErrCallNotFound || err == utils.ErrCallState {
+		return callErrorResponse(c, err)
+	}
+	if err == utils.ErrConsultationEscalation {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	}
+	if err != nil {
+		return conferenceErrorResponse(c, err)
+	}
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   conference,
+	})
+}
+
+func callErrorResponse(c *fiber.Ctx, err error) error {
+	switch err {
+	case utils.ErrCallNotFound:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Call not found",
+		})
+	case utils.ErrCallState:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"status":  "error",
+		"message": "Could not update the call",
+	})
+}
@@ -18,6 +18,7 @@ import (
 type CreateRoomRequest struct {
 	AcceptorId     string `json:"acceptorId"`
 	InitialMessage string `json:"initialMessage"`
+	BlogID         uint64 `json:"blogId"`
 }
 
 type SendMessageRequest struct {
@@ -106,6 +107,9 @@ func CreateChatRoomForDM(c *fiber.Ctx) error {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": "Failed to update room's last message"})
 		}
 
+		// Rooms opened from a post count towards its analytics
+		utils.TrackBlogEvent(payload.BlogID, models.BlogStatChatRooms)
+
 		serializedRoom := utils.SerializeChatRoom(newRoom.ID)
 		channels, err := GetRoomMemberChannels(newRoom.ID)
 		if err != nil {
@@ -8,6 +8,7 @@ import (
 
 	"hyperpage/initializers"
 	"hyperpage/models"
+	"hyperpage/utils"
 )
 
 // GetCitiesResponse represents the response structure for the GetCities function.
@@ -200,6 +201,9 @@ func CreateCity(c *fiber.Ctx) error {
 		})
 	}
 
+	utils.AuditTarget(c, "city", strconv.FormatUint(uint64(newCity.ID), 10))
+	utils.AuditChange(c, nil, newCity)
+
 	return c.JSON(fiber.Map{
 		"status":  "success",
 		"message": "New city added successfully",
@@ -240,6 +244,8 @@ func DeleteCity(c *fiber.Ctx) error {
 		})
 	}
 
+	utils.AuditChange(c, city, nil)
+
 	return c.JSON(fiber.Map{
 		"status":  "success",
 		"message": "City and associated translations deleted successfully",
@@ -265,6 +271,7 @@ func UpdateCity(c *fiber.Ctx) error {
 			"message": "City not found",
 		})
 	}
+	before := city
 
 	var updatedCity models.City
 	if err := c.BodyParser(&updatedCity); err != nil {
@@ -281,6 +288,8 @@ func UpdateCity(c *fiber.Ctx) error {
 		})
 	}
 
+	utils.AuditChange(c, before, city)
+
 	return c.JSON(fiber.Map{
 		"status":  "success",
 		"message": "City updated successfully",
@@ -328,6 +337,9 @@ func CreateCityTranslation(c *fiber.Ctx) error {
 		})
 	}
 
+	utils.AuditTarget(c, "city_translation", strconv.FormatUint(uint64(newTranslation.ID), 10))
+	utils.AuditChange(c, nil, newTranslation)
+
 	return c.JSON(fiber.Map{
 		"status":  "success",
 		"message": "New translation added successfully",
@@ -376,6 +388,8 @@ func UpdateCityTranslation(c *fiber.Ctx) error {
 			"message": "Translation not found",
 		})
 	}
+	utils.AuditTarget(c, "city_translation", translationID)
+	before := translation
 
 	var updatedTranslation models.CityTranslation
 	if err := c.BodyParser(&updatedTranslation); err != nil {
@@ -392,6 +406,8 @@ func UpdateCityTranslation(c *fiber.Ctx) error {
 		})
 	}
 
+	utils.AuditChange(c, before, translation)
+
 	return c.JSON(fiber.Map{
 		"status":  "success",
 		"message": "Translation updated successfully",
@@ -416,6 +432,7 @@ func DeleteCityTranslation(c *fiber.Ctx) error {
 			"message": "Translation not found",
 		})
 	}
+	utils.AuditTarget(c, "city_translation", translationID)
 
 	if err := initializers.DB.Delete(&translation).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -424,6 +441,8 @@ func DeleteCityTranslation(c *fiber.Ctx) error {
 		})
 	}
 
+	utils.AuditChange(c, translation, nil)
+
 	return c.JSON(fiber.Map{
 		"status":  "success",
 		"message": "Translation deleted successfully",
@@ -0,0 +1,424 @@
+package controllers
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+	"hyperpage/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+var mentionRegexp = regexp.MustCompile(`@([\p{L}\p{N}_.\-]{2,100})`)
+
+func blogPageURL(blog *models.Blog) string {
+	return "https://www.myru.online/" + blog.UniqId + "/" + blog.Slug
+}
+
+func parsePaging(c *fiber.Ctx) (int, int, error) {
+	limit, err := strconv.Atoi(c.Query("limit", "10"))
+	if err != nil || limit <= 0 {
+		return 0, 0, fmt.Errorf("invalid limit parameter")
+	}
+	skip, err := strconv.Atoi(c.Query("skip", "0"))
+	if err != nil || skip < 0 {
+		return 0, 0, fmt.Errorf("invalid skip parameter")
+	}
+	return limit, skip, nil
+}
+
+func commentResponses(comments []models.Comment) []models.CommentResponse {
+	res := make([]models.CommentResponse, 0, len(comments))
+	for i := range comments {
+		res = append(res, models.FilterCommentRecord(&comments[i]))
+	}
+	return res
+}
+
+// GetComments returns a page of comment threads of a post together with the
+// first replies of every thread.
+func GetComments(c *fiber.Ctx) error {
+	blogID := c.Params("id")
+
+	limit, skip, err := parsePaging(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	}
+
+	query := initializers.DB.Model(&models.Comment{}).Where("blog_id = ? AND parent_id IS NULL", blogID)
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve comments",
+		})
+	}
+
+	var roots []models.Comment
+	if err := query.Preload("User").Order("created_at DESC").Limit(limit).Offset(skip).Find(&roots).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve comments",
+		})
+	}
+
+	repliesLimit, _ := strconv.Atoi(c.Query("replies", "3"))
+
+	threads := make([]fiber.Map, 0, len(roots))
+	for i := range roots {
+		var replies []models.Comment
+		if repliesLimit > 0 && roots[i].RepliesCount > 0 {
+			initializers.DB.Preload("User").
+				Where("root_id = ?", roots[i].ID).
+				Order("created_at ASC").
+				Limit(repliesLimit).
+				Find(&replies)
+		}
+		threads = append(threads, fiber.Map{
+			"comment": models.FilterCommentRecord(&roots[i]),
+			"replies": commentResponses(replies),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   threads,
+		"meta": fiber.Map{
+			"total": total,
+			"limit": limit,
+			"skip":  skip,
+		},
+	})
+}
+
+// GetCommentReplies pages through all replies of a thread in creation order.
+func GetCommentReplies(c *fiber.Ctx) error {
+	rootID := c.Params("commentId")
+
+	limit, skip, err := parsePaging(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	}
+
+	query := initializers.DB.Model(&models.Comment{}).Where("root_id = ?", rootID)
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve replies",
+		})
+	}
+
+	var replies []models.Comment
+	if err := query.Preload("User").Order("created_at ASC").Limit(limit).Offset(skip).Find(&replies).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve replies",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   commentResponses(replies),
+		"meta": fiber.Map{
+			"total": total,
+			"limit": limit,
+			"skip":  skip,
+		},
+	})
+}
+
+func CreateComment(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	var payload models.CommentInput
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+	if errors := models.ValidateStruct(payload); errors != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "errors": errors})
+	}
+
+	var blog models.Blog
+	if err := initializers.DB.Where("id = ? AND status = ?", c.Params("id"), models.BlogStatusActive).First(&blog).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Blog not found",
+		})
+	}
+
+	if blog.CommentsLocked && blog.UserID != user.ID {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Comments are locked for this post",
+		})
+	}
+
+	comment := models.Comment{
+		BlogID:        blog.ID,
+		UserID:        user.ID,
+		Content:       payload.Content,
+		IsAuthorReply: blog.UserID == user.ID,
+	}
+
+	var parent models.Comment
+	if payload.ParentID != nil {
+		if err := initializers.DB.Where("id = ? AND blog_id = ?", *payload.ParentID, blog.ID).First(&parent).Error; err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Parent comment not found",
+			})
+		}
+		if parent.IsDeleted {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Cannot reply to a deleted comment",
+			})
+		}
+
+		rootID := parent.ID
+		if parent.RootID != nil {
+			rootID = *parent.RootID
+		}
+		comment.ParentID = &parent.ID
+		comment.RootID = &rootID
+	}
+
+	err := initializers.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&comment).Error; err != nil {
+			return err
+		}
+		if comment.RootID != nil {
+			if err := tx.Model(&models.Comment{}).Where("id = ?", *comment.RootID).
+				UpdateColumn("replies_count", gorm.Expr("replies_count + 1")).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(&models.Blog{}).Where("id = ?", blog.ID).
+			UpdateColumn("comments_count", gorm.Expr("comments_count + 1")).Error
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not create comment",
+		})
+	}
+
+	comment.User = models.User{ID: user.ID, Name: user.Name, Photo: user.Photo}
+	notifyCommentRecipients(&blog, &comment, &parent, user)
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   models.FilterCommentRecord(&comment),
+	})
+}
+
+// notifyCommentRecipients tells the post author, the author of the replied
+// comment and every mentioned user about the new comment. Each user is
+// notified once.
+func notifyCommentRecipients(blog *models.Blog, comment *models.Comment, parent *models.Comment, author models.UserResponse) {
+	pageURL := blogPageURL(blog)
+	notified := map[string]bool{author.ID.String(): true}
+
+	notify := func(userID, title string) {
+		if notified[userID] {
+			return
+		}
+		notified[userID] = true
+		if err := sendNotificationToOwner(userID, title, comment.Content, pageURL); err != nil {
+			fmt.Println("Failed to send comment notification:", err)
+		}
+	}
+
+	for _, match := range mentionRegexp.FindAllStringSubmatch(comment.Content, -1) {
+		var mentioned models.User
+		if err := initializers.DB.Where("name = ?", match[1]).First(&mentioned).Error; err != nil {
+			continue
+		}
+		notify(mentioned.ID.String(), author.Name+" mentioned you in a comment")
+	}
+
+	if comment.ParentID != nil {
+		notify(parent.UserID.String(), author.Name+" replied to your comment")
+	}
+
+	notify(blog.UserID.String(), author.Name+" commented on "+blog.Title)
+}
+
+func EditComment(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	var payload models.CommentInput
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+	if errors := models.ValidateStruct(payload); errors != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "errors": errors})
+	}
+
+	var comment models.Comment
+	if err := initializers.DB.Preload("User").Where("id = ?", c.Params("commentId")).First(&comment).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Comment not found",
+		})
+	}
+
+	if comment.UserID != user.ID {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Unauthorized",
+		})
+	}
+	if comment.IsDeleted {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Comment was deleted",
+		})
+	}
+
+	comment.Content = payload.Content
+	comment.IsEdited = true
+	if err := initializers.DB.Model(&comment).Updates(map[string]interface{}{
+		"content":   comment.Content,
+		"is_edited": true,
+	}).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not update comment",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   models.FilterCommentRecord(&comment),
+	})
+}
+
+// DeleteComment soft deletes a comment so that its replies stay in place.
+// Deletions by the post author or an admin are recorded in the moderation log.
+func DeleteComment(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	var comment models.Comment
+	if err := initializers.DB.Where("id = ?", c.Params("commentId")).First(&comment).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Comment not found",
+		})
+	}
+
+	var blog models.Blog
+	if err := initializers.DB.Where("id = ?", comment.BlogID).First(&blog).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Blog not found",
+		})
+	}
+
+	isOwner := comment.UserID == user.ID
+	if !isOwner && blog.UserID != user.ID && user.Role != "admin" {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Unauthorized",
+		})
+	}
+
+	if comment.IsDeleted {
+		return c.JSON(fiber.Map{
+			"status":  "success",
+			"message": "Comment already deleted",
+		})
+	}
+
+	err := initializers.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&comment).Updates(map[string]interface{}{
+			"is_deleted": true,
+			"content":    "",
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.Blog{}).Where("id = ? AND comments_count > 0", blog.ID).
+			UpdateColumn("comments_count", gorm.Expr("comments_count - 1")).Error
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not delete comment",
+		})
+	}
+
+	if !isOwner {
+		var body moderationActionRequest
+		_ = c.BodyParser(&body)
+
+		commentID := strconv.FormatUint(comment.ID, 10)
+		resolveReports(models.ReportTargetComment, commentID, models.ReportStatusResolved)
+		utils.LogModerationDecision(&user.ID, models.ReportTargetComment, commentID, models.ModerationActionReject, body.Reason)
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Comment deleted",
+	})
+}
+
+// LockComments lets the post author close or reopen the discussion.
+func LockComments(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	var body struct {
+		Locked bool `json:"locked"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	var blog models.Blog
+	if err := initializers.DB.Where("id = ?", c.Params("id")).First(&blog).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Blog not found",
+		})
+	}
+
+	if blog.UserID != user.ID && user.Role != "admin" {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Unauthorized",
+		})
+	}
+
+	if err := initializers.DB.Model(&blog).Update("comments_locked", body.Locked).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not update blog",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   fiber.Map{"commentsLocked": body.Locked},
+	})
+}
@@ -0,0 +1,120 @@
+package controllers
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+
+	"hyperpage/models"
+	"hyperpage/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// StartConference starts a conference in a chat room of the current user, or
+// returns the one in progress.
+func StartConference(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	roomID, err := strconv.ParseUint(c.Params("roomId"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid roomId format",
+		})
+	}
+
+	conference, err := utils.StartChatConference(roomID, user.ID, nil)
+	if err != nil {
+		return conferenceErrorResponse(c, err)
+	}
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   conference,
+	})
+}
+
+// GetConferenceToken issues a join token of a conference to the current
+// user, a member of its chat room.
+func GetConferenceToken(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	conferenceID, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid conference ID",
+		})
+	}
+
+	join, err := utils.ConferenceJoinToken(conferenceID, user.ID)
+	if err != nil {
+		return conferenceErrorResponse(c, err)
+	}
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   join,
+	})
+}
+
+// ConferenceWebhook receives the notifications of paxmeet rooms, signed with
+// the API secret in the Hash-Token header. The conference of a finished room
+// is marked ended.
+func ConferenceWebhook(c *fiber.Ctx) error {
+	token := c.Get("Hash-Token")
+	if token == "" {
+		token = c.Get(fiber.HeaderAuthorization)
+	}
+	if err := utils.VerifyPaxmeetWebhook(c.Body(), token); err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	}
+
+	var event utils.PaxmeetEvent
+	if err := json.Unmarshal(c.Body(), &event); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	if event.Event == "room_finished" && event.Room.RoomID != "" {
+		if err := utils.FinishConference(event.Room.RoomID); err != nil {
+			log.Println("Could not finish conference:", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Could not finish the conference",
+			})
+		}
+	}
+	return c.JSON(fiber.Map{
+		"status": "success",
+	})
+}
+
+func conferenceErrorResponse(c *fiber.Ctx, err error) error {
+	switch err {
+	case utils.ErrNotChatMember, utils.ErrConferenceNotFound:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	case utils.ErrConferenceEnded:
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	case utils.ErrPaxmeetNotConfigured:
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Conferences are not available",
+		})
+	}
+	log.Println("Conference error:", err)
+	return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+		"status":  "error",
+		"message": "Could not reach the conference server",
+	})
+}
@@ -0,0 +1,197 @@
+package controllers
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+	"hyperpage/utils"
+
+	"github.com/gofiber/fiber/v2"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+type ConsultationRateRequest struct {
+	PerMinute float64 `json:"perMinute"`
+	Active    *bool   `json:"active"`
+}
+
+// SimulateConsultationRequest replays call events of a consultation at the
+// rate for a client with the balance. The fee, reserved minutes and warning
+// default to the configured ones, a fee of 0 charges none.
+type SimulateConsultationRequest struct {
+	Rate           float64                   `json:"rate"`
+	Balance        float64                   `json:"balance"`
+	FeePercent     *float64                  `json:"feePercent"`
+	ReserveMinutes int                       `json:"reserveMinutes"`
+	WarnBefore     int                       `json:"warnBefore"`
+	Events         []utils.ConsultationEvent `json:"events"`
+}
+
+// GetConsultationRate returns the price per minute of the calls to a
+// seller.
+func GetConsultationRate(c *fiber.Ctx) error {
+	userID, err := uuid.FromString(c.Params("userId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid user ID",
+		})
+	}
+
+	var rate models.ConsultationRate
+	if err := initializers.DB.Where("user_id = ? AND active = ?", userID, true).First(&rate).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"status":  "error",
+				"message": "The user has no consultation rate",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve data",
+		})
+	}
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   rate,
+	})
+}
+
+// SetConsultationRate sets the price per minute of the calls to the current
+// user, a seller. Calls to them are paid while the rate is active.
+func SetConsultationRate(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+	if !user.Seller {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Only sellers can charge for consultations",
+		})
+	}
+
+	var payload ConsultationRateRequest
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+	active := true
+	if payload.Active != nil {
+		active = *payload.Active
+	}
+
+	rate, err := utils.SetConsultationRate(user.ID, payload.PerMinute, active)
+	if err != nil {
+		if err == utils.ErrConsultationRate {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"status":  "error",
+				"message": err.Error(),
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not save the rate",
+		})
+	}
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   rate,
+	})
+}
+
+// GetConsultations lists the paid calls of the current user, newest first.
+// as=client or as=seller keeps one side.
+func GetConsultations(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	limit, err := strconv.Atoi(c.Query("limit", "20"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid limit parameter",
+		})
+	}
+	skip, err := strconv.Atoi(c.Query("skip", "0"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid skip parameter",
+		})
+	}
+
+	query := initializers.DB.Model(&models.Consultation{})
+	switch c.Query("as") {
+	case "client":
+		query = query.Where("client_id = ?", user.ID)
+	case "seller":
+		query = query.Where("seller_id = ?", user.ID)
+	default:
+		query = query.Where("client_id = ? OR seller_id = ?", user.ID, user.ID)
+	}
+
+	var total int64
+	query.Count(&total)
+
+	var consultations []models.Consultation
+	if err := query.Order("created_at DESC").Limit(limit).Offset(skip).Find(&consultations).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve data",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   consultations,
+		"meta": fiber.Map{
+			"total": total,
+			"limit": limit,
+			"skip":  skip,
+		},
+	})
+}
+
+// SimulateConsultation runs simulated call events through the metering and
+// settlement of consultations, without moving any funds.
+func SimulateConsultation(c *fiber.Ctx) error {
+	var payload SimulateConsultationRequest
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	settings := utils.CurrentConsultationSettings()
+	if payload.FeePercent != nil {
+		if *payload.FeePercent < 0 || *payload.FeePercent >= 100 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"status":  "error",
+				"message": "The fee must be at least 0 and below 100 percent",
+			})
+		}
+		settings.FeePercent = *payload.FeePercent
+	}
+	if payload.ReserveMinutes > 0 {
+		settings.ReserveMinutes = payload.ReserveMinutes
+	}
+	if payload.WarnBefore > 0 {
+		settings.WarnBefore = time.Duration(payload.WarnBefore) * time.Second
+	}
+
+	steps, err := utils.SimulateConsultation(payload.Rate, payload.Balance, settings, payload.Events)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	}
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   steps,
+	})
+}
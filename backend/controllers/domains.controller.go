@@ -1,11 +1,14 @@
 package controllers
 
 import (
-	"fmt"
+	"errors"
 	"hyperpage/initializers"
 	"hyperpage/models"
+	"hyperpage/utils"
+	"strconv"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgtype"
 )
 
 func GetDomain(c *fiber.Ctx) error {
@@ -14,10 +17,14 @@ func GetDomain(c *fiber.Ctx) error {
 
 	var domain models.Domain
 	if err := initializers.DB.Where("name = ?", domainName).First(&domain).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"status":  "error",
-			"message": "Failed to fetch domain from database",
-		})
+		// Custom domains resolve to the site they point to
+		customDomain := utils.ResolveCustomDomain(domainName)
+		if customDomain == nil || initializers.DB.Where("id = ?", customDomain.DomainID).First(&domain).Error != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Failed to fetch domain from database",
+			})
+		}
 	}
 
 	settingsMap := make(map[string]interface{})
@@ -26,8 +33,6 @@ func GetDomain(c *fiber.Ctx) error {
 		_ = err
 	}
 
-	fmt.Println(settingsMap)
-
 	domainResponse := models.DomainResponse{
 		ID:       domain.ID,
 		UserID:   domain.UserID.String(),
@@ -44,7 +49,7 @@ func GetDomain(c *fiber.Ctx) error {
 
 func UpdateSite(c *fiber.Ctx) error {
 
-	var newSettings map[string]interface{}
+	var newSettings models.SiteSettings
 	if err := c.BodyParser(&newSettings); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"status":  "error",
@@ -52,10 +57,22 @@ func UpdateSite(c *fiber.Ctx) error {
 		})
 	}
 
+	if errors := models.ValidateStruct(newSettings); errors != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "errors": errors})
+	}
+
+	settings := pgtype.JSONB{}
+	if err := settings.Set(newSettings); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request data",
+		})
+	}
+
 	user := c.Locals("user").(models.UserResponse)
 	result := initializers.DB.Model(&models.Domain{}).
 		Where("user_id = ?", user.ID).
-		Update("settings", newSettings)
+		Update("settings", settings)
 
 	if result.Error != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -87,3 +104,235 @@ func GetSite(c *fiber.Ctx) error {
 		"data":   domain,
 	})
 }
+
+func GetCustomDomains(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	var domains []models.CustomDomain
+	if err := initializers.DB.Where("user_id = ?", user.ID).Order("id ASC").Find(&domains).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve data",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   domains,
+	})
+}
+
+// AddCustomDomain connects a domain to the site of the user. The response
+// tells where to put the verification token.
+func AddCustomDomain(c *fiber.Ctx) error {
+	userResp := c.Locals("user").(models.UserResponse)
+
+	var payload models.CustomDomainInput
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	if errors := models.ValidateStruct(payload); errors != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "errors": errors})
+	}
+
+	var user models.User
+	if err := initializers.DB.Where("id = ?", userResp.ID).First(&user).Error; err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid user ID",
+		})
+	}
+
+	var site models.Domain
+	if err := initializers.DB.Where("user_id = ? AND status = ?", user.ID, "activated").First(&site).Error; err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Activate your site first",
+		})
+	}
+
+	domain, err := utils.NewCustomDomain(&user, &site, &payload)
+	if errors.Is(err, utils.ErrCustomDomainPlan) || errors.Is(err, utils.ErrCustomDomainLimit) || errors.Is(err, utils.ErrCustomDomainTaken) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	} else if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not add domain",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data": fiber.Map{
+			"domain":  domain,
+			"txtName": utils.CustomDomainTXTName(domain.Host),
+			"httpUrl": "http://" + domain.Host + utils.CustomDomainVerificationPath,
+		},
+	})
+}
+
+func ownCustomDomain(c *fiber.Ctx) (*models.CustomDomain, error) {
+	user := c.Locals("user").(models.UserResponse)
+
+	var domain models.CustomDomain
+	if err := initializers.DB.Where("id = ? AND user_id = ?", c.Params("id"), user.ID).First(&domain).Error; err != nil {
+		return nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Domain not found",
+		})
+	}
+	return &domain, nil
+}
+
+func VerifyCustomDomain(c *fiber.Ctx) error {
+	domain, err := ownCustomDomain(c)
+	if domain == nil {
+		return err
+	}
+
+	if domain.Status != models.CustomDomainStatusPending {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Domain is already verified",
+		})
+	}
+
+	if err := utils.VerifyCustomDomain(domain); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   domain,
+	})
+}
+
+// RetryDomainCertificate requests the certificate again after a failed
+// issuance, at most every ten minutes.
+func RetryDomainCertificate(c *fiber.Ctx) error {
+	domain, err := ownCustomDomain(c)
+	if domain == nil {
+		return err
+	}
+
+	if domain.Status != models.CustomDomainStatusVerified && domain.Status != models.CustomDomainStatusActive {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Verify the domain first",
+		})
+	}
+
+	if err := utils.RetryDomainCertificate(domain); err == utils.ErrCertificateRetry {
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	} else if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not request certificate",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Certificate requested",
+	})
+}
+
+func DeleteCustomDomain(c *fiber.Ctx) error {
+	domain, err := ownCustomDomain(c)
+	if domain == nil {
+		return err
+	}
+
+	if err := utils.DeleteCustomDomain(domain); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not delete domain",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Domain deleted",
+	})
+}
+
+// GetPublicSite returns the settings and active posts of a site, found by
+// the custom domain of the request or the domain query parameter.
+func GetPublicSite(c *fiber.Ctx) error {
+	var site models.Domain
+	if customDomain, ok := c.Locals("siteDomain").(models.CustomDomain); ok {
+		if err := initializers.DB.Where("id = ?", customDomain.DomainID).First(&site).Error; err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Site not found",
+			})
+		}
+	} else if err := initializers.DB.Where("name = ?", c.Query("domain")).First(&site).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Site not found",
+		})
+	}
+
+	if site.Status != "activated" {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Site not found",
+		})
+	}
+
+	settingsMap := make(map[string]interface{})
+	_ = site.Settings.AssignTo(&settingsMap)
+
+	limit, _ := strconv.Atoi(c.Query("limit", "20"))
+	skip, _ := strconv.Atoi(c.Query("skip", "0"))
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+
+	language := c.Query("language", "en")
+	var blogs []models.Blog
+	if err := initializers.DB.Where("user_id = ? AND status = ?", site.UserID, models.BlogStatusActive).
+		Preload("Photos").Preload("Hashtags").
+		Preload("City.Translations", "language = ?", language).
+		Preload("Catygory.Translations", "language = ?", language).
+		Order("COALESCE(bumped_at, created_at) DESC").
+		Offset(skip).Limit(limit).
+		Find(&blogs).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve data",
+		})
+	}
+
+	var total int64
+	initializers.DB.Model(&models.Blog{}).Where("user_id = ? AND status = ?", site.UserID, models.BlogStatusActive).Count(&total)
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data": fiber.Map{
+			"site": models.DomainResponse{
+				ID:       site.ID,
+				UserID:   site.UserID.String(),
+				Username: site.Username,
+				Name:     site.Name,
+				Settings: settingsMap,
+			},
+			"blogs": blogs,
+			"total": total,
+		},
+	})
+}
@@ -3,6 +3,7 @@ package controllers
 import (
 	"hyperpage/initializers"
 	"hyperpage/models"
+	"hyperpage/utils"
 	"strconv"
 	"time"
 
@@ -241,6 +242,9 @@ func CreateGuild(c *fiber.Ctx) error {
 		})
 	}
 
+	utils.AuditTarget(c, "guild", strconv.FormatUint(uint64(newGuild.ID), 10))
+	utils.AuditChange(c, nil, newGuild)
+
 	return c.JSON(fiber.Map{
 		"status":  "success",
 		"message": "New guild added successfully",
@@ -281,6 +285,8 @@ func DeleteGuild(c *fiber.Ctx) error {
 		})
 	}
 
+	utils.AuditChange(c, guild, nil)
+
 	return c.JSON(fiber.Map{
 		"status":  "success",
 		"message": "Guild and associated translations deleted successfully",
@@ -306,6 +312,8 @@ func UpdateGuild(c *fiber.Ctx) error {
 		})
 	}
 
+	before := guild
+
 	var updatedGuild models.Guilds
 	if err := c.BodyParser(&updatedGuild); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -321,6 +329,8 @@ func UpdateGuild(c *fiber.Ctx) error {
 		})
 	}
 
+	utils.AuditChange(c, before, guild)
+
 	return c.JSON(fiber.Map{
 		"status":  "success",
 		"message": "Guild updated successfully",
@@ -368,6 +378,9 @@ func CreateGuildTranslation(c *fiber.Ctx) error {
 		})
 	}
 
+	utils.AuditTarget(c, "guild_translation", strconv.FormatUint(uint64(newTranslation.ID), 10))
+	utils.AuditChange(c, nil, newTranslation)
+
 	return c.JSON(fiber.Map{
 		"status":  "success",
 		"message": "New translation added successfully",
@@ -392,6 +405,8 @@ func UpdateGuildTranslation(c *fiber.Ctx) error {
 			"message": "Translation not found",
 		})
 	}
+	utils.AuditTarget(c, "guild_translation", translationID)
+	before := translation
 
 	var updatedTranslation models.GuildTranslation
 	if err := c.BodyParser(&updatedTranslation); err != nil {
@@ -408,6 +423,8 @@ func UpdateGuildTranslation(c *fiber.Ctx) error {
 		})
 	}
 
+	utils.AuditChange(c, before, translation)
+
 	return c.JSON(fiber.Map{
 		"status":  "success",
 		"message": "Translation updated successfully",
@@ -432,6 +449,7 @@ func DeleteGuildTranslation(c *fiber.Ctx) error {
 			"message": "Translation not found",
 		})
 	}
+	utils.AuditTarget(c, "guild_translation", translationID)
 
 	if err := initializers.DB.Delete(&translation).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -440,6 +458,8 @@ func DeleteGuildTranslation(c *fiber.Ctx) error {
 		})
 	}
 
+	utils.AuditChange(c, translation, nil)
+
 	return c.JSON(fiber.Map{
 		"status":  "success",
 		"message": "Translation deleted successfully",
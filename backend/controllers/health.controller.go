@@ -0,0 +1,54 @@
+package controllers
+
+import (
+	"hyperpage/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetLiveness tells whether the process is up. It checks no dependency, a
+// failing one is reported by GetReadiness instead.
+func GetLiveness(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   utils.Liveness(),
+	})
+}
+
+// GetReadiness tells whether the node can serve traffic: Postgres and Redis
+// are reachable and it is not shutting down. The other dependencies are
+// reported but do not fail it.
+func GetReadiness(c *fiber.Ctx) error {
+	report := utils.Readiness()
+	if !report.Ready {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Not ready",
+			"data":    report,
+		})
+	}
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   report,
+	})
+}
+
+// GetHealthChecker is the former health check, now backed by the
+// readiness of the node.
+func GetHealthChecker(c *fiber.Ctx) error {
+	report := utils.Readiness()
+	if !report.Ready {
+		message := "ddrw api server is unavailable"
+		if report.Draining {
+			message = "ddrw api server is shutting down"
+		}
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"status":  "error",
+			"message": message,
+		})
+	}
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "ddrw api server is online",
+	})
+}
@@ -0,0 +1,46 @@
+package controllers
+
+import (
+	"hyperpage/models"
+	"hyperpage/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetICEServers returns the ICE servers of the current user for WebRTC, with
+// TURN credentials. The region query picks the servers, the X-Region header
+// set by the edge otherwise.
+func GetICEServers(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+	return iceServers(c, user.ID.String())
+}
+
+// GetServiceICEServers returns ICE servers to the other services of the
+// platform, e.g. streaming, which hand them to their clients. The identity
+// query names the user the credentials are issued to.
+func GetServiceICEServers(c *fiber.Ctx) error {
+	return iceServers(c, c.Query("identity"))
+}
+
+func iceServers(c *fiber.Ctx, identity string) error {
+	region := c.Query("region", c.Get("X-Region"))
+	config, err := utils.GetICEConfig(identity, region)
+	if err == utils.ErrICENotConfigured {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"status":  "error",
+			"message": "ICE servers are not configured",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not issue ICE servers",
+		})
+	}
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   config,
+	})
+}
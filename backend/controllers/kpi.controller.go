@@ -0,0 +1,221 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strconv"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type platformTotals struct {
+	Signups          int64   `json:"signups"`
+	AvgDAU           float64 `json:"avgDau"`
+	MAU              int64   `json:"mau"`
+	ListingsCreated  int64   `json:"listingsCreated"`
+	ListingsArchived int64   `json:"listingsArchived"`
+	TopUps           int64   `json:"topUps"`
+	TopUpVolume      float64 `json:"topUpVolume"`
+	Donations        int64   `json:"donations"`
+	DonationVolume   float64 `json:"donationVolume"`
+	ChatMessages     int64   `json:"chatMessages"`
+	StreamSessions   int64   `json:"streamSessions"`
+	StreamSeconds    int64   `json:"streamSeconds"`
+}
+
+type listingStatRow struct {
+	Date        string `json:"date"`
+	DimensionID uint   `json:"id"`
+	Name        string `json:"name"`
+	Created     int64  `json:"created"`
+	Archived    int64  `json:"archived"`
+}
+
+type listingStatTotal struct {
+	DimensionID uint   `json:"id"`
+	Name        string `json:"name"`
+	Created     int64  `json:"created"`
+	Archived    int64  `json:"archived"`
+}
+
+func sendCSV(c *fiber.Ctx, filename string, header []string, rows [][]string) error {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	_ = writer.Write(header)
+	_ = writer.WriteAll(rows)
+
+	c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="`+filename+`"`)
+	return c.Send(buf.Bytes())
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', 2, 64)
+}
+
+// GetPlatformStats returns the daily platform KPIs of a range, the last 30
+// days by default, as JSON or with format=csv as CSV.
+func GetPlatformStats(c *fiber.Ctx) error {
+	from, to, err := analyticsRange(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid date range",
+		})
+	}
+
+	var days []models.PlatformDailyStat
+	if err := initializers.DB.Where("date >= ? AND date <= ?", from, to).Order("date").Find(&days).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve data",
+		})
+	}
+
+	if c.Query("format") == "csv" {
+		rows := make([][]string, 0, len(days))
+		for _, day := range days {
+			rows = append(rows, []string{
+				day.Date.Format(analyticsDateLayout),
+				strconv.FormatInt(day.Signups, 10),
+				strconv.FormatInt(day.DAU, 10),
+				strconv.FormatInt(day.MAU, 10),
+				strconv.FormatInt(day.ListingsCreated, 10),
+				strconv.FormatInt(day.ListingsArchived, 10),
+				strconv.FormatInt(day.TopUps, 10),
+				formatFloat(day.TopUpVolume),
+				strconv.FormatInt(day.Donations, 10),
+				formatFloat(day.DonationVolume),
+				strconv.FormatInt(day.ChatMessages, 10),
+				strconv.FormatInt(day.StreamSessions, 10),
+				strconv.FormatInt(day.StreamSeconds, 10),
+			})
+		}
+		return sendCSV(c, "platform.csv", []string{"date", "signups", "dau", "mau", "listings_created", "listings_archived",
+			"top_ups", "top_up_volume", "donations", "donation_volume", "chat_messages", "stream_sessions", "stream_seconds"}, rows)
+	}
+
+	var totals platformTotals
+	var dau int64
+	for _, day := range days {
+		totals.Signups += day.Signups
+		dau += day.DAU
+		totals.MAU = day.MAU
+		totals.ListingsCreated += day.ListingsCreated
+		totals.ListingsArchived += day.ListingsArchived
+		totals.TopUps += day.TopUps
+		totals.TopUpVolume += day.TopUpVolume
+		totals.Donations += day.Donations
+		totals.DonationVolume += day.DonationVolume
+		totals.ChatMessages += day.ChatMessages
+		totals.StreamSessions += day.StreamSessions
+		totals.StreamSeconds += day.StreamSeconds
+	}
+	if len(days) > 0 {
+		totals.AvgDAU = float64(dau) / float64(len(days))
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data": fiber.Map{
+			"from":   from.Format(analyticsDateLayout),
+			"to":     to.Format(analyticsDateLayout),
+			"totals": totals,
+			"days":   days,
+		},
+	})
+}
+
+// GetListingStats returns the listings created and archived per day and city,
+// or guild with by=guild, as JSON or with format=csv as CSV.
+func GetListingStats(c *fiber.Ctx) error {
+	from, to, err := analyticsRange(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid date range",
+		})
+	}
+
+	dimension, translations, column := models.ListingStatCity, "city_translations", "city_id"
+	switch c.Query("by", models.ListingStatCity) {
+	case models.ListingStatCity:
+	case models.ListingStatGuild:
+		dimension, translations, column = models.ListingStatGuild, "guild_translations", "guild_id"
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid by parameter, use city or guild",
+		})
+	}
+	language := c.Query("language", "en")
+
+	var stats []models.ListingDailyStat
+	if err := initializers.DB.Where("dimension = ? AND date >= ? AND date <= ?", dimension, from, to).
+		Order("date, dimension_id").Find(&stats).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve data",
+		})
+	}
+
+	type translation struct {
+		ID   uint
+		Name string
+	}
+	var names []translation
+	initializers.DB.Table(translations).Select(column+" AS id, name").Where("language = ?", language).Scan(&names)
+	nameOf := make(map[uint]string, len(names))
+	for _, name := range names {
+		nameOf[name.ID] = name.Name
+	}
+
+	rows := make([]listingStatRow, 0, len(stats))
+	totalOf := make(map[uint]*listingStatTotal)
+	var totals []*listingStatTotal
+	for _, stat := range stats {
+		rows = append(rows, listingStatRow{
+			Date:        stat.Date.Format(analyticsDateLayout),
+			DimensionID: stat.DimensionID,
+			Name:        nameOf[stat.DimensionID],
+			Created:     stat.Created,
+			Archived:    stat.Archived,
+		})
+		total, ok := totalOf[stat.DimensionID]
+		if !ok {
+			total = &listingStatTotal{DimensionID: stat.DimensionID, Name: nameOf[stat.DimensionID]}
+			totalOf[stat.DimensionID] = total
+			totals = append(totals, total)
+		}
+		total.Created += stat.Created
+		total.Archived += stat.Archived
+	}
+
+	if c.Query("format") == "csv" {
+		records := make([][]string, 0, len(rows))
+		for _, row := range rows {
+			records = append(records, []string{
+				row.Date,
+				strconv.FormatUint(uint64(row.DimensionID), 10),
+				row.Name,
+				strconv.FormatInt(row.Created, 10),
+				strconv.FormatInt(row.Archived, 10),
+			})
+		}
+		return sendCSV(c, "listings_"+dimension+".csv", []string{"date", dimension + "_id", "name", "created", "archived"}, records)
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data": fiber.Map{
+			"from":   from.Format(analyticsDateLayout),
+			"to":     to.Format(analyticsDateLayout),
+			"by":     dimension,
+			"totals": totals,
+			"days":   rows,
+		},
+	})
+}
@@ -0,0 +1,313 @@
+package controllers
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+	"hyperpage/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// CreateLeadRequest is a call-back request. Older forms name the post by
+// uid and slug instead of blogId.
+type CreateLeadRequest struct {
+	utils.LeadInput
+	Uid  string `json:"uid"`
+	Slug string `json:"slug"`
+}
+
+type LeadNoteRequest struct {
+	Text string `json:"text"`
+}
+
+type LeadSettingsRequest struct {
+	Channels string `json:"channels"`
+}
+
+// GetLeadChallenge issues the challenge token the call-back form of a post
+// sends with the request, from the same address.
+func GetLeadChallenge(c *fiber.Ctx) error {
+	blogID, err := strconv.ParseUint(c.Query("blogId"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid blogId parameter",
+		})
+	}
+
+	token, err := utils.IssueLeadChallenge(blogID, c.IP())
+	if err != nil {
+		return leadErrorResponse(c, err)
+	}
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data": fiber.Map{
+			"challenge": token,
+		},
+	})
+}
+
+// CreateLead stores a call-back request of a visitor and delivers it to the
+// seller of the post.
+func CreateLead(c *fiber.Ctx) error {
+	var payload CreateLeadRequest
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+	if payload.BlogID == 0 && payload.Uid != "" {
+		var blog models.Blog
+		if err := initializers.DB.Select("id").Where("uniq_id = ? AND slug = ?", payload.Uid, payload.Slug).First(&blog).Error; err == nil {
+			payload.BlogID = blog.ID
+		}
+	}
+
+	lead, err := utils.CreateLead(payload.LeadInput, c.IP())
+	if err != nil {
+		return leadErrorResponse(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"status": "success",
+		"data": fiber.Map{
+			"id": lead.ID,
+		},
+	})
+}
+
+// GetLeads lists the leads of the current user, newest first, with the
+// number of leads per status. status and blogId filter them.
+func GetLeads(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	limit, err := strconv.Atoi(c.Query("limit", "20"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid limit parameter",
+		})
+	}
+	skip, err := strconv.Atoi(c.Query("skip", "0"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid skip parameter",
+		})
+	}
+
+	query := initializers.DB.Model(&models.Lead{}).Where("seller_id = ?", user.ID)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if blogID := c.Query("blogId"); blogID != "" {
+		query = query.Where("blog_id = ?", blogID)
+	}
+
+	var total int64
+	query.Count(&total)
+
+	var leads []models.Lead
+	if err := query.Order("created_at DESC").Limit(limit).Offset(skip).Find(&leads).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve data",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   leads,
+		"meta": fiber.Map{
+			"total":    total,
+			"limit":    limit,
+			"skip":     skip,
+			"statuses": utils.LeadStatusCounts(user.ID),
+		},
+	})
+}
+
+// GetLead returns a lead of the current user with its notes.
+func GetLead(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid lead ID",
+		})
+	}
+
+	lead, err := utils.FindLead(user.ID, id)
+	if err != nil {
+		return leadErrorResponse(c, err)
+	}
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   lead,
+	})
+}
+
+// UpdateLead changes the status or the follow-up of a lead of the current
+// user.
+func UpdateLead(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid lead ID",
+		})
+	}
+
+	var payload utils.LeadUpdate
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	lead, err := utils.UpdateLead(user.ID, id, payload)
+	if err != nil {
+		return leadErrorResponse(c, err)
+	}
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   lead,
+	})
+}
+
+// AddLeadNote adds a note to a lead of the current user.
+func AddLeadNote(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid lead ID",
+		})
+	}
+
+	var payload LeadNoteRequest
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	note, err := utils.AddLeadNote(user.ID, id, payload.Text)
+	if err != nil {
+		return leadErrorResponse(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"status": "success",
+		"data":   note,
+	})
+}
+
+// GetLeadStats returns the conversion of the posts of the current user over
+// the last days days, 30 by default.
+func GetLeadStats(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	days, err := strconv.Atoi(c.Query("days", "30"))
+	if err != nil || days < 1 || days > 365 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid days parameter",
+		})
+	}
+	since := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 1-days)
+
+	stats, err := utils.LeadStats(user.ID, since)
+	if err != nil {
+		return leadErrorResponse(c, err)
+	}
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   stats,
+		"meta": fiber.Map{
+			"since": since,
+		},
+	})
+}
+
+// GetLeadSettings returns the channels leads of the current user are
+// delivered to.
+func GetLeadSettings(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   utils.GetLeadSettings(user.ID),
+	})
+}
+
+// SaveLeadSettings sets the channels leads of the current user are
+// delivered to.
+func SaveLeadSettings(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	var payload LeadSettingsRequest
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	settings, err := utils.SaveLeadSettings(user.ID, payload.Channels)
+	if err != nil {
+		return leadErrorResponse(c, err)
+	}
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   settings,
+	})
+}
+
+func leadErrorResponse(c *fiber.Ctx, err error) error {
+	switch err {
+	case utils.ErrLeadInvalid, utils.ErrLeadUpdate, utils.ErrLeadChannels:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	case utils.ErrLeadChallenge:
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	case utils.ErrLeadNotFound, utils.ErrLeadPostNotFound:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	case utils.ErrLeadDuplicate:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	case utils.ErrLeadRateLimited:
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	case utils.ErrLeadsNotConfigured:
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Call-back requests are not available",
+		})
+	}
+	log.Println("Lead error:", err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"status":  "error",
+		"message": "Could not process the lead",
+	})
+}
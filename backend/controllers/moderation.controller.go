@@ -0,0 +1,468 @@
+package controllers
+
+import (
+	"fmt"
+	"strconv"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+	"hyperpage/utils"
+
+	"github.com/gofiber/fiber/v2"
+	uuid "github.com/satori/go.uuid"
+)
+
+type moderationActionRequest struct {
+	Reason string `json:"reason"`
+}
+
+// moderateBlogStatus holds a new or edited post for review when the author
+// is not trusted or an automated pre-check fails. It returns the flags so
+// that the caller can store them once the post has an ID.
+func moderateBlogStatus(user *models.User, blog *models.Blog) []utils.ModerationFlag {
+	flags := utils.RunModerationChecks(blog)
+	if len(flags) > 0 || !utils.IsTrustedAuthor(user) {
+		blog.Status = models.BlogStatusPending
+	} else {
+		blog.Status = models.BlogStatusActive
+	}
+	return flags
+}
+
+func GetReportReasons(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   models.ReportReasons,
+	})
+}
+
+func CreateReport(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	var payload models.CreateReportInput
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	if errors := models.ValidateStruct(payload); errors != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "errors": errors})
+	}
+
+	validReason := false
+	for _, reason := range models.ReportReasons {
+		if reason == payload.Reason {
+			validReason = true
+			break
+		}
+	}
+	if !validReason {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Unknown report reason",
+		})
+	}
+
+	var count int64
+	switch payload.TargetType {
+	case models.ReportTargetBlog:
+		initializers.DB.Model(&models.Blog{}).Where("id = ?", payload.TargetID).Count(&count)
+	case models.ReportTargetUser:
+		initializers.DB.Model(&models.User{}).Where("id = ?", payload.TargetID).Count(&count)
+	case models.ReportTargetComment:
+		initializers.DB.Model(&models.Comment{}).Where("id = ? AND is_deleted = ?", payload.TargetID, false).Count(&count)
+	}
+	if count == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Reported element not found",
+		})
+	}
+
+	var existing int64
+	initializers.DB.Model(&models.Report{}).
+		Where("reporter_id = ? AND target_type = ? AND target_id = ? AND status = ?", user.ID, payload.TargetType, payload.TargetID, models.ReportStatusOpen).
+		Count(&existing)
+	if existing > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"status":  "error",
+			"message": "You have already reported this element",
+		})
+	}
+
+	reporterID := user.ID
+	report := models.Report{
+		ReporterID: &reporterID,
+		TargetType: payload.TargetType,
+		TargetID:   payload.TargetID,
+		Reason:     payload.Reason,
+		Comment:    payload.Comment,
+		Status:     models.ReportStatusOpen,
+	}
+	if err := initializers.DB.Create(&report).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not create report",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   report,
+	})
+}
+
+func GetModerationQueue(c *fiber.Ctx) error {
+	language := c.Query("language", "en")
+
+	limit, err := strconv.Atoi(c.Query("limit", "20"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid limit parameter",
+		})
+	}
+	skip, err := strconv.Atoi(c.Query("skip", "0"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid skip parameter",
+		})
+	}
+
+	var total int64
+	query := initializers.DB.Model(&models.Blog{}).Where("status = ?", models.BlogStatusPending)
+	if err := query.Count(&total).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve data",
+		})
+	}
+
+	var blogs []models.Blog
+	if err := query.Order("updated_at ASC").
+		Preload("Photos").
+		Preload("User").
+		Preload("City.Translations", "language = ?", language).
+		Preload("Catygory.Translations", "language = ?", language).
+		Limit(limit).Offset(skip).
+		Find(&blogs).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve data",
+		})
+	}
+
+	var reports []models.Report
+	if err := initializers.DB.Where("status = ?", models.ReportStatusOpen).
+		Order("created_at ASC").
+		Find(&reports).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve reports",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"data":    blogs,
+		"reports": reports,
+		"meta": fiber.Map{
+			"total": total,
+			"limit": limit,
+			"skip":  skip,
+		},
+	})
+}
+
+func ApproveBlog(c *fiber.Ctx) error {
+	return decideBlog(c, models.ModerationActionApprove)
+}
+
+func RejectBlog(c *fiber.Ctx) error {
+	return decideBlog(c, models.ModerationActionReject)
+}
+
+func decideBlog(c *fiber.Ctx, action string) error {
+	moderator := c.Locals("user").(models.UserResponse)
+	blogID := c.Params("id")
+
+	var body moderationActionRequest
+	_ = c.BodyParser(&body)
+
+	if action == models.ModerationActionReject && body.Reason == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Reason is required",
+		})
+	}
+
+	var blog models.Blog
+	if err := initializers.DB.Where("id = ?", blogID).First(&blog).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Blog not found",
+		})
+	}
+
+	status, err := utils.BlogDecisionStatus(blog.Status, action)
+	if err != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	}
+
+	var title, text string
+	if action == models.ModerationActionApprove {
+		title = "Post approved"
+		text = fmt.Sprintf("Your post %q has been approved and published.", blog.Title)
+	} else {
+		title = "Post rejected"
+		text = fmt.Sprintf("Your post %q has been rejected: %s", blog.Title, body.Reason)
+	}
+
+	// The status is checked again so that concurrent decisions apply once
+	result := initializers.DB.Model(&blog).Where("status = ?", blog.Status).Update("status", status)
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not update blog",
+		})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"status":  "error",
+			"message": utils.ErrBlogNotReviewable.Error(),
+		})
+	}
+
+	resolveReports(models.ReportTargetBlog, blogID, models.ReportStatusResolved)
+	utils.LogModerationDecision(&moderator.ID, models.ReportTargetBlog, blogID, action, body.Reason)
+	utils.InvalidateSEOCache()
+
+	if action == models.ModerationActionApprove {
+		initializers.DB.Preload("Photos").First(&blog, blog.ID)
+		utils.RecordBlogImageHashes(&blog)
+		go utils.MatchSavedSearches(blog.ID)
+		go utils.SyndicateBlog(blog.ID, models.SyndicationActionPost)
+	} else {
+		go utils.SyndicateBlog(blog.ID, models.SyndicationActionDelete)
+	}
+
+	pageURL := "https://myru.online/" + blog.UniqId + "/" + blog.Slug
+	if err := sendNotificationToOwner(blog.UserID.String(), title, text, pageURL); err != nil {
+		fmt.Println("Failed to notify blog author:", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   blog,
+	})
+}
+
+func BanUser(c *fiber.Ctx) error {
+	return setUserBanned(c, true)
+}
+
+func UnbanUser(c *fiber.Ctx) error {
+	return setUserBanned(c, false)
+}
+
+func setUserBanned(c *fiber.Ctx, banned bool) error {
+	moderator := c.Locals("user").(models.UserResponse)
+
+	userID, err := uuid.FromString(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid user ID",
+		})
+	}
+
+	var body moderationActionRequest
+	_ = c.BodyParser(&body)
+
+	if banned && body.Reason == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Reason is required",
+		})
+	}
+
+	var user models.User
+	if err := initializers.DB.Where("id = ?", userID).First(&user).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "User not found",
+		})
+	}
+
+	if user.Role == "admin" {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Admins cannot be banned",
+		})
+	}
+
+	updates := map[string]interface{}{"banned": banned}
+	if banned {
+		updates["online"] = false
+		updates["session"] = nil
+	}
+	if err := initializers.DB.Model(&user).Updates(updates).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not update user",
+		})
+	}
+
+	utils.AuditChange(c, fiber.Map{"banned": !banned}, fiber.Map{"banned": banned, "reason": body.Reason})
+
+	action := models.ModerationActionUnban
+	title := "Account restored"
+	text := "Your account has been restored."
+	if banned {
+		action = models.ModerationActionBan
+		title = "Account banned"
+		text = "Your account has been banned: " + body.Reason
+
+		resolveReports(models.ReportTargetUser, user.ID.String(), models.ReportStatusResolved)
+	}
+
+	utils.LogModerationDecision(&moderator.ID, models.ReportTargetUser, user.ID.String(), action, body.Reason)
+
+	if err := utils.Notification(title, text, user.ID.String(), ""); err != nil {
+		fmt.Println("Failed to create notification:", err)
+	}
+	if user.DeviceIOS != "" {
+		if err := utils.Push(title, text, user.DeviceIOS, ""); err != nil {
+			fmt.Println("Failed to send push notification:", err)
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": fmt.Sprintf("User %s has been updated", user.Name),
+	})
+}
+
+func DismissReport(c *fiber.Ctx) error {
+	moderator := c.Locals("user").(models.UserResponse)
+
+	var body moderationActionRequest
+	_ = c.BodyParser(&body)
+
+	var report models.Report
+	if err := initializers.DB.Where("id = ? AND status = ?", c.Params("id"), models.ReportStatusOpen).First(&report).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Report not found",
+		})
+	}
+
+	report.Status = models.ReportStatusDismissed
+	if err := initializers.DB.Save(&report).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not update report",
+		})
+	}
+
+	utils.LogModerationDecision(&moderator.ID, report.TargetType, report.TargetID, models.ModerationActionDismiss, body.Reason)
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   report,
+	})
+}
+
+func GetModerationLog(c *fiber.Ctx) error {
+	query := initializers.DB.Model(&models.ModerationDecision{}).Order("created_at DESC")
+
+	if targetType := c.Query("targetType"); targetType != "" {
+		query = query.Where("target_type = ?", targetType)
+	}
+	if targetID := c.Query("targetId"); targetID != "" {
+		query = query.Where("target_id = ?", targetID)
+	}
+	if moderatorID := c.Query("moderatorId"); moderatorID != "" {
+		query = query.Where("moderator_id = ?", moderatorID)
+	}
+
+	var decisions []models.ModerationDecision
+	return utils.Paginate(c, query, &decisions)
+}
+
+func GetModerationRules(c *fiber.Ctx) error {
+	var rules []models.ModerationRule
+	if err := initializers.DB.Order("kind, value").Find(&rules).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve rules",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   rules,
+	})
+}
+
+func CreateModerationRule(c *fiber.Ctx) error {
+	var rule models.ModerationRule
+	if err := c.BodyParser(&rule); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	if rule.Kind != models.ModerationRuleKeyword && rule.Kind != models.ModerationRuleLink {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Rule kind must be keyword or link",
+		})
+	}
+	if rule.Value == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Rule value is required",
+		})
+	}
+
+	rule.ID = 0
+	if err := initializers.DB.Create(&rule).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not create rule",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   rule,
+	})
+}
+
+func DeleteModerationRule(c *fiber.Ctx) error {
+	if err := initializers.DB.Delete(&models.ModerationRule{}, "id = ?", c.Params("id")).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not delete rule",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Rule deleted",
+	})
+}
+
+func resolveReports(targetType, targetID, status string) {
+	initializers.DB.Model(&models.Report{}).
+		Where("target_type = ? AND target_id = ? AND status = ?", targetType, targetID, models.ReportStatusOpen).
+		Update("status", status)
+}
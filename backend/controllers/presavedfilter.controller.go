@@ -3,6 +3,7 @@ package controllers
 import (
 	"hyperpage/initializers"
 	"hyperpage/models"
+	"hyperpage/utils"
 
 	"github.com/gofiber/fiber/v2"
 )
@@ -17,6 +18,13 @@ func CreatePresavedfilter(c *fiber.Ctx) error {
 
 	filter.UserID = user.ID
 
+	if err := utils.NormalizeSavedSearch(filter); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid alert frequency or channels",
+		})
+	}
+
 	result := initializers.DB.Create(filter)
 	if result.Error != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -25,6 +33,13 @@ func CreatePresavedfilter(c *fiber.Ctx) error {
 		})
 	}
 
+	if err := utils.IndexSavedSearch(filter); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to index presaved filter",
+		})
+	}
+
 	return c.JSON(fiber.Map{
 		"status":  "success",
 		"message": "Presaved filter created successfully",
@@ -75,6 +90,8 @@ func DeletePresavedFilter(c *fiber.Ctx) error {
 		})
 	}
 
+	utils.RemoveSavedSearch(filter.ID)
+
 	// Return success response
 	return c.JSON(fiber.Map{
 		"status":  "success",
@@ -110,6 +127,22 @@ func PatchPresavedFilter(c *fiber.Ctx) error {
 
 	// Update the presaved filter fields
 	filter.Name = reqBody.Name
+	if reqBody.Meta != nil {
+		filter.Meta = reqBody.Meta
+	}
+	if reqBody.Frequency != "" {
+		filter.Frequency = reqBody.Frequency
+	}
+	if reqBody.Channels != "" {
+		filter.Channels = reqBody.Channels
+	}
+
+	if err := utils.NormalizeSavedSearch(&filter); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid alert frequency or channels",
+		})
+	}
 
 	// Save the updated filter to the database
 	if err := initializers.DB.Save(&filter).Error; err != nil {
@@ -120,6 +153,13 @@ func PatchPresavedFilter(c *fiber.Ctx) error {
 		})
 	}
 
+	if err := utils.IndexSavedSearch(&filter); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to index presaved filter",
+		})
+	}
+
 	// Return success response
 	return c.JSON(fiber.Map{
 		"status":  "success",
@@ -0,0 +1,103 @@
+package controllers
+
+import (
+	"time"
+
+	"hyperpage/models"
+	"hyperpage/utils"
+
+	"github.com/gofiber/fiber/v2"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+// GetPresence reports whether a user is online and on how many devices.
+func GetPresence(c *fiber.Ctx) error {
+	userID, err := uuid.FromString(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid user ID",
+		})
+	}
+
+	status, err := utils.GetPresence(userID)
+	if err == gorm.ErrRecordNotFound {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "User not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve presence",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   status,
+	})
+}
+
+// GetPresenceStats returns the online time of a user per day, the last 30
+// days by default. The history is only shown to the user and to admins.
+func GetPresenceStats(c *fiber.Ctx) error {
+	userID, err := uuid.FromString(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid user ID",
+		})
+	}
+
+	user := c.Locals("user").(models.UserResponse)
+	if user.ID != userID && user.Role != "admin" {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"status":  "error",
+			"message": "You can only see your own online history",
+		})
+	}
+	return presenceStats(c, userID)
+}
+
+// GetMyPresenceStats returns the online time of the current user per day.
+func GetMyPresenceStats(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+	return presenceStats(c, user.ID)
+}
+
+func presenceStats(c *fiber.Ctx, userID uuid.UUID) error {
+	from, to, err := analyticsRange(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid date range",
+		})
+	}
+
+	stats, err := utils.UserPresenceStats(userID, from, to)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve data",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   stats,
+	})
+}
+
+// presenceTimeEntry converts seconds to the hour, minutes, seconds entry
+// used by the older endpoints.
+func presenceTimeEntry(seconds int64) models.TimeEntry {
+	duration := time.Duration(seconds) * time.Second
+	return models.TimeEntry{
+		Hour:    int(duration.Hours()),
+		Minutes: int(duration.Minutes()) % 60,
+		Seconds: int(duration.Seconds()) % 60,
+	}
+}
@@ -0,0 +1,173 @@
+package controllers
+
+import (
+	"errors"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+	"hyperpage/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+type DataExportResponse struct {
+	models.DataExport
+	URL string `json:"url,omitempty"`
+}
+
+// RequestDataExport queues an archive of the data of the user. The user is
+// notified with the download link once it is built.
+func RequestDataExport(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	export, err := utils.RequestDataExport(user.ID)
+	if errors.Is(err, utils.ErrDataExportPending) || errors.Is(err, utils.ErrDataExportRecent) {
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	} else if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not request export",
+		})
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"status": "success",
+		"data":   export,
+	})
+}
+
+// GetDataExports lists the exports of the user, ready ones with a link.
+func GetDataExports(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	var exports []models.DataExport
+	if err := initializers.DB.Where("user_id = ?", user.ID).Order("created_at DESC").Find(&exports).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not get exports",
+		})
+	}
+
+	data := make([]DataExportResponse, 0, len(exports))
+	for i := range exports {
+		response := DataExportResponse{DataExport: exports[i]}
+		if url, err := utils.DataExportURL(&exports[i]); err == nil {
+			response.URL = url
+		}
+		data = append(data, response)
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   data,
+	})
+}
+
+// ScheduleAccountDeletion schedules the erasure of the account, it can be
+// cancelled during the cooling-off period.
+func ScheduleAccountDeletion(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	var payload models.AccountDeletionInput
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&payload); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Invalid request body",
+			})
+		}
+	}
+
+	if errors := models.ValidateStruct(payload); errors != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "errors": errors})
+	}
+
+	deletion, err := utils.ScheduleAccountDeletion(user.ID, payload.Reason)
+	if errors.Is(err, utils.ErrAccountDeletionPending) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	} else if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not schedule account deletion",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   deletion,
+	})
+}
+
+// GetAccountDeletion returns the scheduled deletion of the account.
+func GetAccountDeletion(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	var deletion models.AccountDeletion
+	if err := initializers.DB.Where("user_id = ? AND status = ?", user.ID, models.AccountDeletionStatusScheduled).
+		First(&deletion).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "No deletion is scheduled",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   deletion,
+	})
+}
+
+// CancelAccountDeletion keeps the account.
+func CancelAccountDeletion(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	if err := utils.CancelAccountDeletion(user.ID); errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "No deletion is scheduled",
+		})
+	} else if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not cancel account deletion",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Account deletion cancelled",
+	})
+}
+
+// GetDeletionReceipt returns a receipt with the result of its signature
+// check. Given the email of the account, it also tells whether the receipt
+// belongs to it.
+func GetDeletionReceipt(c *fiber.Ctx) error {
+	var receipt models.DeletionReceipt
+	if err := initializers.DB.Where("id = ?", c.Params("id")).First(&receipt).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Receipt not found",
+		})
+	}
+
+	data := fiber.Map{
+		"receipt": receipt,
+		"valid":   utils.VerifyDeletionReceipt(&receipt),
+	}
+	if email := c.Query("email"); email != "" {
+		data["subjectMatches"] = utils.DeletionSubjectHash(email) == receipt.SubjectHash
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   data,
+	})
+}
@@ -1115,6 +1115,7 @@ func UpdateProfileDocuments(c *fiber.Ctx) error {
 	existingDocument.Descr = requestBody.Descr
 	// existingDocument.Additional = requestBody.Additional
 
+	existingFiles := documentFilenames(existingDocument.Files)
 	existingDocument.Files = pgtype.JSONB{Bytes: filesJSON, Status: pgtype.Present}
 
 	// Save the updated document to the database
@@ -1125,6 +1126,18 @@ func UpdateProfileDocuments(c *fiber.Ctx) error {
 		})
 	}
 
+	// Release the files removed from the document
+	ownerID := documentOwnerID(&existingDocument)
+	kept := make(map[string]bool)
+	for _, filename := range documentFilenames(existingDocument.Files) {
+		kept[filename] = true
+	}
+	for _, filename := range existingFiles {
+		if !kept[filename] {
+			utils.DeleteStoredFileIfUnused(ownerID, filename)
+		}
+	}
+
 	return c.JSON(fiber.Map{
 		"status": "success updated",
 		"data":   "ok",
@@ -1183,12 +1196,36 @@ func DeleteProfileDocuments(c *fiber.Ctx) error {
 		})
 	}
 
+	ownerID := documentOwnerID(&existingDocument)
+	for _, filename := range documentFilenames(existingDocument.Files) {
+		utils.DeleteStoredFileIfUnused(ownerID, filename)
+	}
+
 	return c.JSON(fiber.Map{
 		"status": "success",
 		"data":   "ok",
 	})
 }
 
+func documentFilenames(files pgtype.JSONB) []string {
+	var data []struct {
+		Filename string `json:"filename"`
+	}
+	_ = json.Unmarshal(files.Bytes, &data)
+
+	filenames := make([]string, 0, len(data))
+	for _, file := range data {
+		filenames = append(filenames, file.Filename)
+	}
+	return filenames
+}
+
+func documentOwnerID(document *models.ProfileDocuments) uuid.UUID {
+	var profile models.Profile
+	initializers.DB.Select("id", "user_id").Where("id = ?", document.ProfileID).First(&profile)
+	return profile.UserID
+}
+
 func NewProfileDocuments(c *fiber.Ctx) error {
 	user := c.Locals("user").(models.UserResponse)
 
@@ -1271,6 +1308,17 @@ func UpdateProfilePhotos(c *fiber.Ctx) error {
 			return err
 		}
 
+		// The variants and placeholder come from the uploads, not the client
+		if updatePhotos.Files.Status == pgtype.Present {
+			var files []models.PhotoFile
+			if err := updatePhotos.Files.AssignTo(&files); err != nil {
+				return err
+			}
+			if err := updatePhotos.Files.Set(utils.ResolvePhotoFiles(user.ID, files)); err != nil {
+				return err
+			}
+		}
+
 		existingFiles := existingPhoto.Files
 
 		existingPhoto.Files = updatePhotos.Files
@@ -1280,24 +1328,19 @@ func UpdateProfilePhotos(c *fiber.Ctx) error {
 			return err
 		}
 
-		deleteRemovedFiles(existingFiles, updatePhotos.Files)
+		deleteRemovedFiles(user.ID, existingFiles, updatePhotos.Files)
 
 		return c.JSON(existingPhoto)
 
 	}
 
-	var files []struct {
-		Path string `json:"path"`
-	}
+	var files []models.PhotoFile
 
 	if err := c.BodyParser(&files); err != nil {
 		// Handle parsing error
 		return err
 	}
-
-	type File struct {
-		Path string `json:"path"`
-	}
+	files = utils.ResolvePhotoFiles(user.ID, files)
 
 	// Iterate over the files
 	for _, file := range files {
@@ -1310,12 +1353,12 @@ func UpdateProfilePhotos(c *fiber.Ctx) error {
 			}
 
 			// Append the file path to the existing Files field
-			var existingFiles []File
+			var existingFiles []models.PhotoFile
 			if err := existingPhoto.Files.AssignTo(&existingFiles); err != nil {
 				// Handle the error when assigning existing files
 				fmt.Println("Error assigning existing files:", err)
 			}
-			existingFiles = append(existingFiles, File{Path: file.Path})
+			existingFiles = append(existingFiles, file)
 			newFiles, err := json.Marshal(existingFiles)
 			if err != nil {
 				// Handle the error when marshaling new files
@@ -1336,12 +1379,12 @@ func UpdateProfilePhotos(c *fiber.Ctx) error {
 		} else {
 			// Photo already exists, update the record if needed
 			// Append the file path to the existing Files field
-			var existingFiles []File
+			var existingFiles []models.PhotoFile
 			if err := existingPhoto.Files.AssignTo(&existingFiles); err != nil {
 				// Handle the error when assigning existing files
 				fmt.Println("Error assigning existing files:", err)
 			}
-			existingFiles = append(existingFiles, File{Path: file.Path})
+			existingFiles = append(existingFiles, file)
 			newFiles, err := json.Marshal(existingFiles)
 			if err != nil {
 				// Handle the error when marshaling new files
@@ -1633,6 +1676,19 @@ func UpdateProfileStreaming(c *fiber.Ctx) error {
 			"message": fmt.Sprintf("Failed to save user data: %v", err),
 		})
 	}
+
+	// Kept for the statistics once the stream ended
+	startedAt := streaming.CreatedAt
+	if startedAt.IsZero() {
+		startedAt = time.Now()
+	}
+	initializers.DB.Create(&models.StreamSession{
+		RoomID:    streaming.RoomID,
+		UserID:    streaming.UserID,
+		Title:     streaming.Title,
+		StartedAt: startedAt,
+	})
+
 	return c.JSON(fiber.Map{
 		"status": "success",
 		"data":   "ok",
@@ -1717,6 +1773,14 @@ func DeleteProfileStreaming(c *fiber.Ctx) error {
 			"message": fmt.Sprintf("Failed to parse request body: %v", err),
 		})
 	}
+	endedAt := requestData.DeletedAt
+	if endedAt.IsZero() {
+		endedAt = time.Now()
+	}
+	initializers.DB.Model(&models.StreamSession{}).
+		Where("room_id = ? AND user_id = ? AND ended_at IS NULL", roomID, requestData.UserID).
+		Update("ended_at", endedAt)
+
 	// if err := initializers.DB.Delete(&models.Streaming{}, "room_id = ? AND user_id = ?", roomID, requestData.UserID).Error; err != nil {
 	// 	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 	// 		"status":  "error",
@@ -0,0 +1,282 @@
+package controllers
+
+import (
+	"errors"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+	"hyperpage/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func GetPromotionProducts(c *fiber.Ctx) error {
+	query := initializers.DB.Order("kind ASC").Order("price ASC")
+	if c.Query("all") != "true" {
+		query = query.Where("active = ?", true)
+	}
+
+	var products []models.PromotionProduct
+	if err := query.Find(&products).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve data",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   products,
+	})
+}
+
+func CreatePromotionProduct(c *fiber.Ctx) error {
+	var payload models.PromotionProductInput
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	if errors := models.ValidateStruct(payload); errors != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "errors": errors})
+	}
+
+	if payload.Kind == models.PromotionKindHighlight && payload.Sticker == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Sticker is required for highlight products",
+		})
+	}
+
+	product := models.PromotionProduct{
+		Kind:    payload.Kind,
+		Name:    payload.Name,
+		Price:   payload.Price,
+		Days:    payload.Days,
+		Sticker: payload.Sticker,
+		Active:  payload.Active == nil || *payload.Active,
+	}
+	if err := initializers.DB.Create(&product).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not create product",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   product,
+	})
+}
+
+func UpdatePromotionProduct(c *fiber.Ctx) error {
+	var product models.PromotionProduct
+	if err := initializers.DB.Where("id = ?", c.Params("id")).First(&product).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Product not found",
+		})
+	}
+
+	var payload models.PromotionProductInput
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	if errors := models.ValidateStruct(payload); errors != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "errors": errors})
+	}
+
+	// Running promotions keep the price and period they were bought with
+	product.Kind = payload.Kind
+	product.Name = payload.Name
+	product.Price = payload.Price
+	product.Days = payload.Days
+	product.Sticker = payload.Sticker
+	if payload.Active != nil {
+		product.Active = *payload.Active
+	}
+
+	if err := initializers.DB.Save(&product).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not update product",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   product,
+	})
+}
+
+func PurchasePromotion(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	var blog models.Blog
+	if err := initializers.DB.Where("id = ?", c.Params("id")).First(&blog).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Element not found",
+		})
+	}
+
+	if blog.UserID != user.ID {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Unauthorized",
+		})
+	}
+
+	if blog.Status != models.BlogStatusActive {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Only published posts can be promoted",
+		})
+	}
+
+	var payload models.PurchasePromotionInput
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	if errors := models.ValidateStruct(payload); errors != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "errors": errors})
+	}
+
+	var product models.PromotionProduct
+	if err := initializers.DB.Where("id = ? AND active = ?", payload.ProductID, true).First(&product).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Product not found",
+		})
+	}
+
+	// A pin applies to a category or city the post belongs to
+	if product.Kind == models.PromotionKindPin {
+		var count int64
+		switch payload.Scope {
+		case models.PromotionScopeCategory:
+			initializers.DB.Table("blog_guilds").Where("blog_id = ? AND guilds_id = ?", blog.ID, payload.ScopeID).Count(&count)
+		case models.PromotionScopeCity:
+			initializers.DB.Table("blog_city").Where("blog_id = ? AND city_id = ?", blog.ID, payload.ScopeID).Count(&count)
+		}
+		if count == 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"status":  "error",
+				"message": "The post does not belong to this category or city",
+			})
+		}
+	} else {
+		payload.Scope = ""
+		payload.ScopeID = 0
+	}
+
+	promotion, err := utils.PurchasePromotion(&blog, &product, payload.Scope, payload.ScopeID)
+	if errors.Is(err, utils.ErrInsufficientBalance) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Insufficient balance",
+		})
+	} else if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not purchase promotion",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   promotion,
+	})
+}
+
+func GetMyPromotions(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	query := initializers.DB.Where("user_id = ?", user.ID).Order("created_at DESC")
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var promotions []models.Promotion
+	if err := query.Find(&promotions).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve data",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   promotions,
+	})
+}
+
+// GetPromotionReport returns the impressions and clicks collected by the
+// promotions of a post.
+func GetPromotionReport(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
+
+	var blog models.Blog
+	if err := initializers.DB.Where("id = ?", c.Params("id")).First(&blog).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Element not found",
+		})
+	}
+
+	if user.Role != "admin" && blog.UserID != user.ID {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Unauthorized",
+		})
+	}
+
+	var promotions []models.Promotion
+	if err := initializers.DB.Where("blog_id = ?", blog.ID).Order("starts_at DESC").Find(&promotions).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve data",
+		})
+	}
+
+	type promotionReport struct {
+		models.Promotion
+		CTR      float64 `json:"ctr"`
+		DaysLeft int     `json:"daysLeft"`
+	}
+
+	var impressions, clicks int64
+	report := make([]promotionReport, 0, len(promotions))
+	for _, promotion := range promotions {
+		entry := promotionReport{Promotion: promotion}
+		if promotion.Impressions > 0 {
+			entry.CTR = float64(promotion.Clicks) / float64(promotion.Impressions)
+		}
+		if promotion.Status == models.PromotionStatusActive {
+			entry.DaysLeft = int(time.Until(promotion.ExpiresAt).Hours()/24) + 1
+		}
+		impressions += promotion.Impressions
+		clicks += promotion.Clicks
+		report = append(report, entry)
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   report,
+		"meta": fiber.Map{
+			"impressions": impressions,
+			"clicks":      clicks,
+		},
+	})
+}
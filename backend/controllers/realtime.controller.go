@@ -0,0 +1,13 @@
+package controllers
+
+import (
+	"hyperpage/realtime"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetRealtimeSchema returns the JSON Schema of the websocket frames.
+func GetRealtimeSchema(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderContentType, "application/schema+json")
+	return c.Send(realtime.Schema)
+}
@@ -0,0 +1,338 @@
+package controllers
+
+import (
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+	"hyperpage/utils"
+
+	gt "github.com/bas24/googletranslatefree"
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgtype"
+)
+
+// ownBlog loads the post from the id param and checks that the current user
+// is its author or an admin.
+func ownBlog(c *fiber.Ctx) (*models.Blog, models.UserResponse, error) {
+	user := c.Locals("user").(models.UserResponse)
+
+	var blog models.Blog
+	if err := initializers.DB.Where("id = ?", c.Params("id")).First(&blog).Error; err != nil {
+		return nil, user, c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Element not found",
+		})
+	}
+
+	if user.Role != "admin" && blog.UserID != user.ID {
+		return nil, user, c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Unauthorized",
+		})
+	}
+	return &blog, user, nil
+}
+
+func PublishDraftBlog(c *fiber.Ctx) error {
+	blog, _, err := ownBlog(c)
+	if blog == nil {
+		return err
+	}
+
+	if blog.Status != models.BlogStatusDraft && blog.Status != models.BlogStatusScheduled {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Only drafts and scheduled posts can be published",
+		})
+	}
+
+	var body struct {
+		PublishAt *time.Time `json:"publishAt"`
+	}
+	if err := c.BodyParser(&body); err != nil && len(c.Body()) > 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	// A publish time in the future schedules the post instead
+	if body.PublishAt != nil && body.PublishAt.After(time.Now()) {
+		expiry := utils.BlogExpiry(blog.Days, *body.PublishAt)
+		blog.Status = models.BlogStatusScheduled
+		blog.PublishAt = body.PublishAt
+		blog.ExpiredAt = &expiry
+		if err := initializers.DB.Model(blog).Updates(map[string]interface{}{
+			"status":     blog.Status,
+			"publish_at": blog.PublishAt,
+			"expired_at": blog.ExpiredAt,
+		}).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Could not schedule blog",
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"status": "success",
+			"data":   blog,
+		})
+	}
+
+	flags, err := utils.PublishBlog(blog)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not publish blog",
+		})
+	}
+	blog.Photos = nil
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   blog,
+		"flags":  flags,
+	})
+}
+
+func GetBlogRevisions(c *fiber.Ctx) error {
+	blog, _, err := ownBlog(c)
+	if blog == nil {
+		return err
+	}
+
+	var revisions []models.BlogRevision
+	if err := initializers.DB.Where("blog_id = ?", blog.ID).
+		Order("number DESC").
+		Find(&revisions).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve revisions",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   revisions,
+	})
+}
+
+// DiffBlogRevision compares a revision with another revision given in the
+// against query parameter, or with the current version of the post.
+func DiffBlogRevision(c *fiber.Ctx) error {
+	blog, _, err := ownBlog(c)
+	if blog == nil {
+		return err
+	}
+
+	var from models.BlogRevision
+	if err := initializers.DB.Where("id = ? AND blog_id = ?", c.Params("revisionId"), blog.ID).First(&from).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Revision not found",
+		})
+	}
+
+	var to models.BlogRevision
+	if against := c.Query("against"); against != "" && against != "current" {
+		if err := initializers.DB.Where("id = ? AND blog_id = ?", against, blog.ID).First(&to).Error; err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Revision not found",
+			})
+		}
+	} else {
+		var photos []models.BlogPhoto
+		initializers.DB.Where("blog_id = ?", blog.ID).Find(&photos)
+		if to, err = utils.BlogRevisionFromBlog(blog, photos); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Could not compare revisions",
+			})
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   diffRevisions(&from, &to),
+	})
+}
+
+func diffRevisions(from, to *models.BlogRevision) []models.RevisionChange {
+	changes := []models.RevisionChange{}
+	if from.Title != to.Title {
+		changes = append(changes, models.RevisionChange{Field: "title", From: from.Title, To: to.Title})
+	}
+	if from.Descr != to.Descr {
+		changes = append(changes, models.RevisionChange{Field: "descr", From: from.Descr, To: to.Descr})
+	}
+	if from.Content != to.Content {
+		changes = append(changes, models.RevisionChange{Field: "content", From: from.Content, To: to.Content})
+	}
+	if from.Total != to.Total {
+		changes = append(changes, models.RevisionChange{Field: "total", From: from.Total, To: to.Total})
+	}
+
+	// Photos are reported as the removed and added files
+	fromPaths := utils.RevisionPhotoPaths(from)
+	toPaths := utils.RevisionPhotoPaths(to)
+	removed := missingPaths(fromPaths, toPaths)
+	added := missingPaths(toPaths, fromPaths)
+	if len(removed) > 0 || len(added) > 0 {
+		changes = append(changes, models.RevisionChange{Field: "photos", From: removed, To: added})
+	}
+	return changes
+}
+
+// missingPaths returns the paths of a that are not in b.
+func missingPaths(a, b []string) []string {
+	present := make(map[string]bool, len(b))
+	for _, path := range b {
+		present[path] = true
+	}
+
+	missing := []string{}
+	for _, path := range a {
+		if !present[path] {
+			missing = append(missing, path)
+		}
+	}
+	return missing
+}
+
+func RollbackBlogRevision(c *fiber.Ctx) error {
+	blog, user, err := ownBlog(c)
+	if blog == nil {
+		return err
+	}
+
+	var revision models.BlogRevision
+	if err := initializers.DB.Where("id = ? AND blog_id = ?", c.Params("revisionId"), blog.ID).First(&revision).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Revision not found",
+		})
+	}
+
+	// The rollback itself is a new revision, so it can be undone as well
+	var currentPhotos []models.BlogPhoto
+	initializers.DB.Where("blog_id = ?", blog.ID).Find(&currentPhotos)
+	if _, err := utils.SnapshotBlogRevision(blog, currentPhotos, user.ID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not save revision",
+		})
+	}
+
+	blog.Title = revision.Title
+	blog.Descr = revision.Descr
+	blog.Content = revision.Content
+	blog.Total = revision.Total
+	blog.NotAds = blog.Total == 0
+	translateBlog(blog)
+
+	// Rolled back posts of untrusted authors go back to the review queue
+	var flags []utils.ModerationFlag
+	if user.Role != "admin" && (blog.Status == models.BlogStatusActive || blog.Status == models.BlogStatusPending) {
+		var author models.User
+		if err := initializers.DB.Where("id = ?", blog.UserID).First(&author).Error; err == nil {
+			flags = moderateBlogStatus(&author, blog)
+		}
+	}
+
+	if err := initializers.DB.Save(blog).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not update blog post",
+		})
+	}
+
+	if len(flags) > 0 {
+		utils.FlagBlogForReview(blog, flags)
+	}
+
+	// Restore the photos of the revision, rows deleted since are created
+	// again and rows added since are removed
+	current := make(map[uint64]models.BlogPhoto, len(currentPhotos))
+	for _, photo := range currentPhotos {
+		current[photo.ID] = photo
+	}
+	var replacedFiles []pgtype.JSONB
+	for _, photo := range utils.RevisionPhotos(&revision) {
+		blogPhoto, ok := current[photo.ID]
+		delete(current, photo.ID)
+		filesJSONB, err := utils.RevisionFilesJSONB(photo.Files)
+		if err != nil {
+			continue
+		}
+
+		if !ok {
+			blogPhoto = models.BlogPhoto{BlogID: blog.ID}
+		}
+		existingFiles := blogPhoto.Files
+		blogPhoto.Files = filesJSONB
+		if err := initializers.DB.Save(&blogPhoto).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Failed to update photo",
+			})
+		}
+		if ok {
+			replacedFiles = append(replacedFiles, existingFiles)
+		}
+	}
+	for _, photo := range current {
+		if err := initializers.DB.Delete(&photo).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Failed to delete photo",
+			})
+		}
+		replacedFiles = append(replacedFiles, photo.Files)
+	}
+
+	// Files are only deleted once every row is restored, the ones still
+	// referenced by a photo or a revision are kept
+	for _, files := range replacedFiles {
+		deleteRemovedFiles(blog.UserID, files, pgtype.JSONB{})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   blog,
+	})
+}
+
+// translateBlog fills the multilingual title, description and content.
+func translateBlog(blog *models.Blog) {
+	var langs []models.Langs
+	if err := initializers.DB.Raw("SELECT * FROM langs").Scan(&langs).Error; err != nil {
+		return
+	}
+
+	translations := make(map[string]string)
+	translationsDescr := make(map[string]string)
+	translationsContent := make(map[string]string)
+
+	for _, lang := range langs {
+		translations[lang.Code], _ = gt.Translate(blog.Title, blog.Lang, lang.Code)
+		translationsDescr[lang.Code], _ = gt.Translate(blog.Descr, blog.Lang, lang.Code)
+		translationsContent[lang.Code], _ = gt.Translate(blog.Content, blog.Lang, lang.Code)
+	}
+
+	blog.MultilangTitle.En = translations["en"]
+	blog.MultilangTitle.Ru = translations["ru"]
+	blog.MultilangTitle.Ka = translations["ka"]
+	blog.MultilangTitle.Es = translations["es"]
+
+	blog.MultilangDescr.En = translationsDescr["en"]
+	blog.MultilangDescr.Ru = translationsDescr["ru"]
+	blog.MultilangDescr.Ka = translationsDescr["ka"]
+	blog.MultilangDescr.Es = translationsDescr["es"]
+
+	blog.MultilangContent.En = translationsContent["en"]
+	blog.MultilangContent.Ru = translationsContent["ru"]
+	blog.MultilangContent.Ka = translationsContent["ka"]
+	blog.MultilangContent.Es = translationsContent["es"]
+}
@@ -0,0 +1,138 @@
+package controllers
+
+import (
+	"strconv"
+
+	"hyperpage/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func seoLanguage(c *fiber.Ctx) string {
+	language := c.Query("language")
+	if language == "" {
+		language = "en"
+	}
+	return language
+}
+
+func GetSitemapIndex(c *fiber.Ctx) error {
+	body, err := utils.CachedSEO("sitemap:index", func() ([]byte, error) {
+		return utils.BuildSitemapIndex()
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not build sitemap",
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationXMLCharsetUTF8)
+	return c.Send(body)
+}
+
+func GetSitemapShard(c *fiber.Ctx) error {
+	kind := c.Params("kind")
+	shard, err := strconv.Atoi(c.Params("shard"))
+	if err != nil || shard < 1 || (kind != utils.SitemapBlogs && kind != utils.SitemapProfiles) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Sitemap not found",
+		})
+	}
+
+	body, err := utils.CachedSEO("sitemap:"+kind+":"+c.Params("shard"), func() ([]byte, error) {
+		return utils.BuildSitemapShard(kind, shard)
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not build sitemap",
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationXMLCharsetUTF8)
+	return c.Send(body)
+}
+
+// GetFeed serves the latest posts of a user, city or guild as RSS, Atom or
+// JSON Feed, chosen by the format query parameter.
+func GetFeed(c *fiber.Ctx) error {
+	scope := c.Params("scope")
+	id := c.Params("id")
+	language := seoLanguage(c)
+	format := c.Query("format", utils.FeedFormatRSS)
+
+	contentTypes := map[string]string{
+		utils.FeedFormatRSS:  "application/rss+xml; charset=utf-8",
+		utils.FeedFormatAtom: "application/atom+xml; charset=utf-8",
+		utils.FeedFormatJSON: "application/feed+json; charset=utf-8",
+	}
+	contentType, ok := contentTypes[format]
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Unknown feed format",
+		})
+	}
+	if scope != utils.FeedScopeUser && scope != utils.FeedScopeCity && scope != utils.FeedScopeGuild {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Feed not found",
+		})
+	}
+
+	body, err := utils.CachedSEO("feed:"+scope+":"+id+":"+language+":"+format, func() ([]byte, error) {
+		feed, err := utils.LoadFeed(scope, id, language)
+		if err != nil {
+			return nil, err
+		}
+		feed.FeedURL = utils.FeedURL(scope, id, language, format)
+		return utils.RenderFeed(feed, format)
+	})
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Feed not found",
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, contentType)
+	return c.Send(body)
+}
+
+func GetBlogJSONLD(c *fiber.Ctx) error {
+	blogID := c.Params("id")
+	language := seoLanguage(c)
+
+	body, err := utils.CachedSEO("jsonld:blog:"+blogID+":"+language, func() ([]byte, error) {
+		return utils.BlogJSONLD(blogID, language)
+	})
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Element not found",
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, "application/ld+json; charset=utf-8")
+	return c.Send(body)
+}
+
+func GetProfileJSONLD(c *fiber.Ctx) error {
+	name := c.Params("name")
+	language := seoLanguage(c)
+
+	body, err := utils.CachedSEO("jsonld:profile:"+name+":"+language, func() ([]byte, error) {
+		return utils.ProfileJSONLD(name, language)
+	})
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "User not found",
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, "application/ld+json; charset=utf-8")
+	return c.Send(body)
+}
@@ -3,6 +3,8 @@ package controllers
 import (
 	"hyperpage/initializers"
 	"hyperpage/models"
+	"hyperpage/utils"
+	"strconv"
 
 	"github.com/gofiber/fiber/v2"
 )
@@ -95,6 +97,9 @@ func AddLang(c *fiber.Ctx) error {
 		})
 	}
 
+	utils.AuditTarget(c, "lang", strconv.FormatUint(uint64(newLang.ID), 10))
+	utils.AuditChange(c, nil, newLang)
+
 	// Return success response
 	return c.JSON(AddLangResponse{
 		Status: "success",
@@ -131,6 +136,8 @@ func DeleteLang(c *fiber.Ctx) error {
 		})
 	}
 
+	utils.AuditChange(c, existingLang, nil)
+
 	// Return success response
 	return c.JSON(DeleteLangResponse{
 		Status: "success",
@@ -170,6 +177,7 @@ func UpdateLang(c *fiber.Ctx) error {
 	}
 
 	// Update the existing language with the new data
+	before := existingLang
 	existingLang.Name = updatedLang.Name
 
 	// Save the changes to the database
@@ -180,6 +188,8 @@ func UpdateLang(c *fiber.Ctx) error {
 		})
 	}
 
+	utils.AuditChange(c, before, existingLang)
+
 	// Return success response
 	return c.JSON(UpdateLangResponse{
 		Status: "success",
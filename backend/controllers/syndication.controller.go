@@ -0,0 +1,256 @@
+package controllers
+
+import (
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+	"hyperpage/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func GetSyndicationChannels(c *fiber.Ctx) error {
+	query := initializers.DB.Order("id ASC")
+	if c.Query("personal") != "true" {
+		query = query.Where("user_id IS NULL")
+	}
+
+	var channels []models.SyndicationChannel
+	if err := query.Find(&channels).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve data",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   channels,
+	})
+}
+
+func CreateSyndicationChannel(c *fiber.Ctx) error {
+	var payload models.SyndicationChannelInput
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	if errors := models.ValidateStruct(payload); errors != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "errors": errors})
+	}
+
+	channel := models.SyndicationChannel{
+		Outlet:   payload.Outlet,
+		Name:     payload.Name,
+		Target:   payload.Target,
+		Token:    payload.Token,
+		Language: payload.Language,
+		CityID:   payload.CityID,
+		GuildID:  payload.GuildID,
+		Active:   payload.Active == nil || *payload.Active,
+	}
+	if channel.Language == "" {
+		channel.Language = "ru"
+	}
+	if err := initializers.DB.Create(&channel).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not create channel",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   channel,
+	})
+}
+
+func UpdateSyndicationChannel(c *fiber.Ctx) error {
+	var channel models.SyndicationChannel
+	if err := initializers.DB.Where("id = ? AND user_id IS NULL", c.Params("id")).First(&channel).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Channel not found",
+		})
+	}
+
+	var payload models.SyndicationChannelInput
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	if errors := models.ValidateStruct(payload); errors != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "errors": errors})
+	}
+
+	channel.Outlet = payload.Outlet
+	channel.Name = payload.Name
+	channel.Target = payload.Target
+	channel.CityID = payload.CityID
+	channel.GuildID = payload.GuildID
+	// The token is never sent back, an empty one keeps the stored token
+	if payload.Token != "" {
+		channel.Token = payload.Token
+	}
+	if payload.Language != "" {
+		channel.Language = payload.Language
+	}
+	if payload.Active != nil {
+		channel.Active = *payload.Active
+	}
+
+	if err := initializers.DB.Save(&channel).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not update channel",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   channel,
+	})
+}
+
+// DeleteSyndicationChannel removes a channel. Messages already posted to it
+// stay, they are no longer edited or deleted.
+func DeleteSyndicationChannel(c *fiber.Ctx) error {
+	var channel models.SyndicationChannel
+	if err := initializers.DB.Where("id = ? AND user_id IS NULL", c.Params("id")).First(&channel).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Channel not found",
+		})
+	}
+
+	initializers.DB.Where("channel_id = ?", channel.ID).Delete(&models.BlogSyndication{})
+	if err := initializers.DB.Delete(&channel).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not delete channel",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Channel deleted",
+	})
+}
+
+func GetSyndicationTemplates(c *fiber.Ctx) error {
+	var templates []models.SyndicationTemplate
+	if err := initializers.DB.Order("language ASC").Find(&templates).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve data",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   templates,
+	})
+}
+
+func SaveSyndicationTemplate(c *fiber.Ctx) error {
+	var payload struct {
+		Body string `json:"body" validate:"required"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	if errors := models.ValidateStruct(payload); errors != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "fail", "errors": errors})
+	}
+
+	if _, err := utils.ParseSyndicationTemplate(payload.Body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid template: " + err.Error(),
+		})
+	}
+
+	var template models.SyndicationTemplate
+	initializers.DB.Where("language = ?", c.Params("language")).First(&template)
+	template.Language = c.Params("language")
+	template.Body = payload.Body
+	template.UpdatedAt = time.Now()
+
+	if err := initializers.DB.Save(&template).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not save template",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   template,
+	})
+}
+
+// GetBlogSyndications shows the author where a post was cross-posted and
+// which deliveries failed.
+func GetBlogSyndications(c *fiber.Ctx) error {
+	blog, _, err := ownBlog(c)
+	if blog == nil {
+		return err
+	}
+
+	type syndicationResponse struct {
+		models.BlogSyndication
+		Outlet  string `json:"outlet"`
+		Channel string `json:"channel"`
+	}
+
+	var records []syndicationResponse
+	if err := initializers.DB.Table("blog_syndications").
+		Select("blog_syndications.*, syndication_channels.outlet, syndication_channels.name AS channel").
+		Joins("JOIN syndication_channels ON syndication_channels.id = blog_syndications.channel_id").
+		Where("blog_syndications.blog_id = ?", blog.ID).
+		Order("blog_syndications.id ASC").
+		Scan(&records).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Could not retrieve data",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   records,
+	})
+}
+
+// RetryBlogSyndication resends a post to the channels where it failed.
+func RetryBlogSyndication(c *fiber.Ctx) error {
+	var blog models.Blog
+	if err := initializers.DB.Where("id = ?", c.Params("id")).First(&blog).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Element not found",
+		})
+	}
+
+	action := models.SyndicationActionPost
+	if blog.Status != models.BlogStatusActive {
+		action = models.SyndicationActionDelete
+	}
+	utils.SyndicateBlog(blog.ID, action)
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Syndication queued",
+	})
+}
@@ -7,8 +7,6 @@ import (
 	"hyperpage/initializers"
 	"hyperpage/models"
 	"hyperpage/utils"
-	"io"
-	"net/http"
 	"strconv"
 	"strings"
 
@@ -97,35 +95,19 @@ func TryActivated(bot *tgbotapi.BotAPI, msg *tgbotapi.Message, afterSpace string
 			log.Panic(err)
 		}
 
-		// Create a file with a unique name in the specified directory
-		fileName := filepath.Base(fileURL)
-		filePath := filepath.Join(appConfig.IMGStorePath, user.Storage, fileName)
-		file, err := os.Create(filePath)
-		if err != nil {
-			return
-		}
-		defer file.Close()
-
-		// Open the file URL for reading
-		resp, err := http.Get(fileURL)
-		if err != nil {
-			return
-		}
-		// Copy the contents of the file URL to the created file
-		_, err = io.Copy(file, resp.Body)
+		// Store the avatar with the other files of the user
+		photoKey, err := utils.StoreRemoteBlob(user.ID, fileURL)
 		if err != nil {
 			return
 		}
 
-		// Create a file with a unique name in the specified directory
-		fileName = filepath.Base(fileURL)
 		if msg.From != nil && msg.From.UserName != "" {
 			// If the field exists, assign the value
 			user.TelegramName = &msg.From.UserName
 			user.Tid = msg.From.ID
 			user.TelegramActivated = true
 			// user.Photo = fileURL
-			user.Photo = user.Storage + `/` + fileName
+			user.Photo = photoKey
 
 			err = utils.SendPersonalMessageToClient(user.Session, "Activated")
 			if err != nil {
@@ -161,8 +143,6 @@ func TryActivated(bot *tgbotapi.BotAPI, msg *tgbotapi.Message, afterSpace string
 
 		// bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "Спасибо @"+msg.From.UserName+" аккаунт активирован!"))
 
-		defer resp.Body.Close()
-
 	} else {
 		src := filepath.Join(appConfig.IMGStorePath, "default.jpg")
 		dst := filepath.Join(appConfig.IMGStorePath, user.Storage, "default.jpg")
@@ -1,27 +1,21 @@
 package controllers
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
-	"fmt"
+	"encoding/json"
+	"errors"
 	"hyperpage/initializers"
 	"hyperpage/models"
-	"image"
+	"hyperpage/utils"
 	"io"
-	"math/rand"
-	"os"
+	"mime/multipart"
 	"path/filepath"
-	"strconv"
 	"strings"
-
-	"github.com/disintegration/imaging"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 )
 
 func UploadPdf(c *fiber.Ctx) error {
-	config, _ := initializers.LoadConfig(".")
-
 	file, err := c.FormFile("pdf")
 	if err != nil {
 		return err
@@ -42,71 +36,30 @@ func UploadPdf(c *fiber.Ctx) error {
 		})
 	}
 
-	// Open the file
-	src, err := file.Open()
+	fileContents, err := readFormFile(file)
 	if err != nil {
 		return err
 	}
-	defer src.Close()
 
-	// Read the file contents into a byte slice
-	fileContents, err := io.ReadAll(src)
+	// Documents are private and only reachable by signed links
+	user := c.Locals("user").(models.UserResponse)
+	key, err := utils.StoreBlob(user.ID, fileContents, fileExt, "application/pdf", true)
 	if err != nil {
-		return err
-	}
-
-	// Create a new file in the uploads directory
-	hash := sha256.Sum256(fileContents)
-	hashStr := hex.EncodeToString(hash[:])
-
-	userId := c.Locals("user")
-	userResp := userId.(models.UserResponse)
-	userObj := models.User{
-		ID:                userResp.ID,
-		Name:              userResp.Name,
-		Email:             userResp.Email,
-		Role:              userResp.Role,
-		TelegramToken:     userResp.TelegramToken,
-		TelegramActivated: userResp.TelegramActivated,
-		Photo:             userResp.Photo,
-		Session:           userResp.Session,
-		Storage:           userResp.Storage,
-	}
-
-	dst, err := os.Create(filepath.Join(config.IMGStorePath, userObj.Storage, hashStr+fileExt))
-	if err != nil {
-		return err
-	}
-	defer dst.Close()
-
-	// Write the file contents to the new file
-	_, err = dst.Write(fileContents)
-	if err != nil {
-		return err
+		return uploadError(c, err)
 	}
 
-	// Return JSON response with the uploaded file's name
+	// Return JSON response with the uploaded file's key
 	return c.JSON(fiber.Map{
-		"filename": hashStr + fileExt,
+		"filename": key,
 	})
 }
 
 func UploadImage(c *fiber.Ctx) error {
-	config, _ := initializers.LoadConfig(".")
-
 	file, err := c.FormFile("image")
 	if err != nil {
 		return err
 	}
 
-	// Validate file type
-	fileExt := strings.ToLower(filepath.Ext(file.Filename))
-	if fileExt != ".png" && fileExt != ".jpg" && fileExt != ".jpeg" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Only PNG, JPEG, and JPG file types are allowed.",
-		})
-	}
-
 	// Validate file size
 	if file.Size > 10*1024*1024 { // 2 MB
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -114,52 +67,21 @@ func UploadImage(c *fiber.Ctx) error {
 		})
 	}
 
-	// Open the file
-	src, err := file.Open()
+	fileContents, err := readFormFile(file)
 	if err != nil {
 		return err
 	}
-	defer src.Close()
 
-	// Read the file contents into a byte slice
-	fileContents, err := io.ReadAll(src)
+	user := c.Locals("user").(models.UserResponse)
+	photo, err := utils.ProcessImage(user.ID, fileContents, file.Filename)
 	if err != nil {
-		return err
+		return uploadError(c, err)
 	}
 
-	// Create a new file in the uploads directory
-	hash := sha256.Sum256(fileContents)
-	hashStr := hex.EncodeToString(hash[:])
-
-	userId := c.Locals("user")
-	userResp := userId.(models.UserResponse)
-	userObj := models.User{
-		ID:                userResp.ID,
-		Name:              userResp.Name,
-		Email:             userResp.Email,
-		Role:              userResp.Role,
-		TelegramToken:     userResp.TelegramToken,
-		TelegramActivated: userResp.TelegramActivated,
-		Photo:             userResp.Photo,
-		Session:           userResp.Session,
-		Storage:           userResp.Storage,
-	}
-
-	dst, err := os.Create(filepath.Join(config.IMGStorePath, userObj.Storage, hashStr+fileExt))
-	if err != nil {
-		return err
-	}
-	defer dst.Close()
-
-	// Write the file contents to the new file
-	_, err = dst.Write(fileContents)
-	if err != nil {
-		return err
-	}
-
-	// Return JSON response with the uploaded file's name
+	// Return JSON response with the main file's key and every variant
 	return c.JSON(fiber.Map{
-		"filename": hashStr + fileExt,
+		"filename": photo.Path,
+		"file":     photo,
 	})
 }
 
@@ -168,71 +90,48 @@ type UploadedFile struct {
 	Path     string `json:"path"`
 }
 
-// Function to calculate directory size
-func getDirectorySize(dirname string) (int64, error) {
-	var size int64
-
-	err := filepath.Walk(dirname, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() {
-			size += info.Size()
-		}
-		return nil
-	})
-
-	return size, err
-}
-
-func compressImage(inputPath, outputPath string, maxWidth, maxHeight int) error {
-	// Open the input image file
-	file, err := os.Open(inputPath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	// Decode the image
-	img, _, err := image.Decode(file)
+func readFormFile(file *multipart.FileHeader) ([]byte, error) {
+	src, err := file.Open()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer src.Close()
 
-	// Resize the image to the desired dimensions
-	resized := imaging.Fit(img, maxWidth, maxHeight, imaging.Lanczos)
+	return io.ReadAll(src)
+}
 
-	// Save the compressed image
-	err = imaging.Save(resized, outputPath)
-	if err != nil {
-		return err
+func uploadError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, utils.ErrStorageQuota) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Directory size exceeds the storage limit",
+		})
 	}
-
-	return nil
+	if errors.Is(err, utils.ErrUnsupportedImage) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Only PNG, JPEG, and WebP images are allowed.",
+		})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"status":  "error",
+		"message": "Could not store file",
+	})
 }
 
 func UploadImages(c *fiber.Ctx) error {
-	config, _ := initializers.LoadConfig(".")
-
 	// Parse multipart form
 	form, err := c.MultipartForm()
 	if err != nil {
 		return err
 	}
 
+	user := c.Locals("user").(models.UserResponse)
+
 	// Loop through files
-	var filesData []map[string]string
+	var filesData []*models.PhotoFile
 	files := form.File["image"]
 	for _, file := range files {
 
-		// Validate file type
-		fileExt := strings.ToLower(filepath.Ext(file.Filename))
-		if fileExt != ".png" && fileExt != ".jpg" && fileExt != ".jpeg" {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "Only PNG, JPEG, and JPG file types are allowed.",
-			})
-		}
-
 		// Validate file size
 		if file.Size > 20*1024*1024 { // 20 MB
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -240,98 +139,98 @@ func UploadImages(c *fiber.Ctx) error {
 			})
 		}
 
-		// Open the file
-		src, err := file.Open()
+		fileContents, err := readFormFile(file)
 		if err != nil {
 			return err
 		}
-		defer src.Close()
 
-		// Read the file contents into a byte slice
-		fileContents, err := io.ReadAll(src)
+		// The type is sniffed, variants and the placeholder are generated
+		photo, err := utils.ProcessImage(user.ID, fileContents, file.Filename)
 		if err != nil {
-			return err
+			return uploadError(c, err)
 		}
 
-		// Create a new file in the uploads directory
-		hash := sha256.Sum256(fileContents)
-		hashStr := hex.EncodeToString(hash[:])
-		name := file.Filename
-		// Generate a random number
-		randomNum := rand.Intn(1000) // Adjust the maximum range as needed
-
-		// Concatenate the hash string and random number
-		filename := hashStr + "_" + strconv.Itoa(randomNum) + fileExt
-
-		userId := c.Locals("user")
-		userResp := userId.(models.UserResponse)
-		userObj := models.User{
-			ID:                userResp.ID,
-			Name:              userResp.Name,
-			Email:             userResp.Email,
-			Role:              userResp.Role,
-			TelegramToken:     userResp.TelegramToken,
-			TelegramActivated: userResp.TelegramActivated,
-			Photo:             userResp.Photo,
-			Session:           userResp.Session,
-			Storage:           userResp.Storage,
-			LimitStorage:      userResp.LimitStorage,
-		}
+		// Append the uploaded file's data to the filesData slice
+		filesData = append(filesData, photo)
+	}
 
-		// Check the size of the directory
-		dirname := filepath.Join(config.IMGStorePath, userObj.Storage)
-		size, err := getDirectorySize(dirname)
-		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"status":  "error",
-				"message": "Failed to calculate directory size",
-			})
-		}
+	// Return JSON response with the uploaded file data
+	return c.JSON(fiber.Map{
+		"files": filesData,
+	})
+}
 
-		// Convert the limit and size to megabytes
-		limitStorageMB := int64(userObj.LimitStorage) // Convert limit to bytes and cast to int
-		sizeMB := size / (1024 * 1024)                // Convert size to megabytes
+// documentURLTTL is how long a signed document link stays valid.
+const documentURLTTL = 15 * time.Minute
 
-		// Check if the size exceeds the limit
-		if sizeMB > limitStorageMB {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"status":  "error",
-				"message": "Directory size exceeds the storage limit",
-			})
-		}
+// GetDocumentURLs returns temporary links to the files of a profile
+// document, to the owner of the profile and admins.
+func GetDocumentURLs(c *fiber.Ctx) error {
+	user := c.Locals("user").(models.UserResponse)
 
-		dst, err := os.Create(filepath.Join(config.IMGStorePath, userObj.Storage, filename+fileExt))
-		if err != nil {
-			return err
-		}
-		defer dst.Close()
+	query := initializers.DB.Where("profile_documents.id = ?", c.Params("id"))
+	if user.Role != "admin" {
+		query = query.Joins("JOIN profiles ON profiles.id = profile_documents.profile_id").
+			Where("profiles.user_id = ?", user.ID)
+	}
 
-		// Write the file contents to the new file
-		_, err = dst.Write(fileContents)
-		if err != nil {
-			return err
-		}
+	var document models.ProfileDocuments
+	if err := query.First(&document).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Profile document not found",
+		})
+	}
 
-		inputPath := filepath.Join(config.IMGStorePath, userObj.Storage, filename+fileExt)
-		outputPath := filepath.Join(config.IMGStorePath, userObj.Storage, filename+fileExt)
-		maxWidth := 800  // Replace with the desired maximum width of the compressed photo
-		maxHeight := 600 // Replace with the desired maximum height of the compressed photo
+	var files []struct {
+		Filename string `json:"filename"`
+	}
+	_ = json.Unmarshal(document.Files.Bytes, &files)
 
-		err = compressImage(inputPath, outputPath, maxWidth, maxHeight)
+	urls := make([]UploadedFile, 0, len(files))
+	for _, file := range files {
+		url, err := utils.Blobs().SignedURL(file.Filename, documentURLTTL)
 		if err != nil {
-			// Handle the error
-			panic(err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Could not sign document link",
+			})
 		}
-
-		// Append the uploaded file's data to the filesData slice
-		filesData = append(filesData, map[string]string{
-			"name": name,
-			"path": fmt.Sprintf(userObj.Storage+"/%s%s", filename, fileExt),
-		})
+		urls = append(urls, UploadedFile{Filename: file.Filename, Path: url})
 	}
 
-	// Return JSON response with the uploaded file data
 	return c.JSON(fiber.Map{
-		"files": filesData,
+		"status": "success",
+		"data":   urls,
 	})
 }
+
+// ServeSignedFile serves a private file of the local store to the holder
+// of a signed link.
+func ServeSignedFile(c *fiber.Ctx) error {
+	key := c.Params("*")
+	if !utils.VerifyLocalBlobSignature(key, c.Query("expires"), c.Query("signature")) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Link is invalid or expired",
+		})
+	}
+
+	data, err := utils.ReadBlob(key)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status":  "error",
+			"message": "File not found",
+		})
+	}
+
+	var blob models.Blob
+	if err := initializers.DB.Where("key = ?", key).First(&blob).Error; err == nil {
+		c.Set(fiber.HeaderContentType, blob.ContentType)
+	} else {
+		// Files outside the quota, e.g. data exports, are downloads
+		c.Attachment(filepath.Base(key))
+	}
+	c.Set(fiber.HeaderCacheControl, "private, no-store")
+	return c.Send(data)
+}
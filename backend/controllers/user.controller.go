@@ -1,14 +1,9 @@
 package controllers
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"math"
-	"net/http"
-	"os"
-	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -95,8 +90,6 @@ func SetTokenIOSdevice(c *fiber.Ctx) error {
 }
 
 func GetMeH(id string, userName string, fileURL string, tId int64) (*models.User, error) {
-	config, _ := initializers.LoadConfig(".")
-
 	var user models.User
 
 	err := initializers.DB.Where("telegram_token = ?", id).First(&user).Error
@@ -111,24 +104,8 @@ func GetMeH(id string, userName string, fileURL string, tId int64) (*models.User
 
 	// fmt.Println(`DBBBB: ` + config.ClientOrigin)
 
-	// Open the file URL for reading
-	resp, err := http.Get(fileURL)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	// Create a file with a unique name in the specified directory
-	fileName := filepath.Base(fileURL)
-	filePath := filepath.Join(config.IMGStorePath, user.Storage, fileName)
-	file, err := os.Create(filePath)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	// Copy the contents of the file URL to the created file
-	_, err = io.Copy(file, resp.Body)
+	// Store the avatar with the other files of the user
+	photoKey, err := utils.StoreRemoteBlob(user.ID, fileURL)
 	if err != nil {
 		return nil, err
 	}
@@ -137,7 +114,7 @@ func GetMeH(id string, userName string, fileURL string, tId int64) (*models.User
 	user.Tid = tId
 	user.TelegramActivated = true
 	// user.Photo = fileURL
-	user.Photo = user.Storage + `/` + fileName
+	user.Photo = photoKey
 
 	err = utils.SendPersonalMessageToClient(user.Session, "Activated")
 	if err != nil {
@@ -164,32 +141,15 @@ func MyTime(c *fiber.Ctx) error {
 		}
 	}
 
-	// user := c.Locals("user").(models.UserResponse)
-
-	return c.Status(fiber.StatusOK).JSON(fiber.Map{"status": "success", "data": fiber.Map{"time": user.OnlineHours}})
-}
-
-func calculateDirSize(dirPath string) (float64, error) {
-	var totalSize int64
-
-	err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		if !info.IsDir() {
-			totalSize += info.Size()
-		}
-
-		return nil
-	})
-
+	// Online time of the current month
+	today := time.Now().UTC()
+	monthStart := time.Date(today.Year(), today.Month(), 1, 0, 0, 0, 0, time.UTC)
+	stats, err := utils.UserPresenceStats(user.ID, monthStart, today)
 	if err != nil {
-		return 0, err
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"status": "fail", "message": err.Error()})
 	}
 
-	sizeInMB := float64(totalSize) / (1024 * 1024)
-	return sizeInMB, nil
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"status": "success", "data": fiber.Map{"time": []models.TimeEntry{presenceTimeEntry(stats.TotalSeconds)}}})
 }
 
 func Plan(c *fiber.Ctx) error {
@@ -272,13 +232,14 @@ func Plan(c *fiber.Ctx) error {
 	}
 
 	// Update the user's plan, signed, and expired_plan_at columns
+	expiredPlanAt := time.Now().AddDate(0, 0, 31)
 	err = initializers.DB.Model(&models.User{}).
 		Where("id = ?", userObj.ID).
 		Updates(map[string]interface{}{
 			"plan":            user.Name,
 			"signed":          true,
 			"limit_storage":   limitstorage,
-			"expired_plan_at": time.Now().AddDate(0, 0, 31),
+			"expired_plan_at": expiredPlanAt,
 		}).
 		Error
 	if err != nil {
@@ -288,6 +249,14 @@ func Plan(c *fiber.Ctx) error {
 		})
 	}
 
+	utils.AuditTarget(c, "user", userObj.ID.String())
+	utils.AuditChange(c,
+		fiber.Map{"amount": billing.Amount},
+		fiber.Map{"amount": billing.Amount - amount, "plan": user.Name, "expiredPlanAt": expiredPlanAt})
+
+	// Custom domains are paid with the plan
+	utils.SyncCustomDomainExpiry(userObj.ID, expiredPlanAt)
+
 	return c.JSON(fiber.Map{
 		"status": "success",
 		"data":   "GOOD",
@@ -369,6 +338,9 @@ func AddBalance(c *fiber.Ctx) error {
 
 	initializers.DB.Create(&transaction)
 
+	utils.AuditTarget(c, "user", userObj.ID.String())
+	utils.AuditChange(c, nil, fiber.Map{"credited": balance, "codeId": code.ID})
+
 	return c.JSON(fiber.Map{
 		"status": "success",
 		"data":   code.Balance,
@@ -376,7 +348,6 @@ func AddBalance(c *fiber.Ctx) error {
 }
 
 func GetMe(c *fiber.Ctx) error {
-	config, _ := initializers.LoadConfig(".")
 	language := c.Query("language")
 
 	if language == "" {
@@ -393,15 +364,6 @@ func GetMe(c *fiber.Ctx) error {
 
 	balance := billing.Amount
 
-	dirPath := filepath.Join(config.IMGStorePath, user.Storage)
-	dirSize, err := calculateDirSize(dirPath)
-	if err != nil {
-		fmt.Printf("Error calculating directory size: %v\n", err)
-		return err
-	}
-
-	fmt.Printf("Directory size: %.2f MB\n", dirSize)
-
 	// update session ID in the user table
 
 	Time := models.User{}
@@ -414,6 +376,8 @@ func GetMe(c *fiber.Ctx) error {
 		// Return an appropriate response or error message
 	}
 
+	// Usage is tracked in bytes as files are stored and released
+	dirSize := float64(Time.StorageUsed) / (1024 * 1024)
 	roundedSize := math.Round(dirSize*10) / 10
 
 	// var profile models.Profile
@@ -435,137 +399,10 @@ func GetMe(c *fiber.Ctx) error {
 
 }
 
-func extractDirectoryName(path string) string {
-	// Unmarshal the path as JSON
-	var pathInfo struct {
-		Path string `json:"path"`
-	}
-	if err := json.Unmarshal([]byte(path), &pathInfo); err != nil {
-		// Handle the error
-		return ""
-	}
-
-	// Split the path and get the first part as the directory name
-	parts := strings.Split(pathInfo.Path, "/")
-	if len(parts) > 0 {
-		return parts[0]
-	}
-
-	return ""
-}
-
-func deleteDirectory(directoryName string) error {
-	config, _ := initializers.LoadConfig(".")
-
-	// Construct the full path to the directory on your server
-	// fullPath := "/path/to/your/server/" + directoryName
-	fullPath := filepath.Join(config.IMGStorePath, directoryName)
-
-	// Perform the directory deletion
-	err := os.RemoveAll(fullPath)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-// Define the route for deleting a user and its relations
+// DeleteUserWithRelations schedules the deletion of the account of the user,
+// the account is erased after the cooling-off period unless it is cancelled.
 func DeleteUserWithRelations(c *fiber.Ctx) error {
-	userId := c.Locals("user").(models.UserResponse)
-
-	// Fetch the user from the database
-	var user models.User
-	if err := initializers.DB.
-		Preload("Billing").
-		Preload("Profile").
-		Preload("Blogs").
-		First(&user, "id = ?", userId.ID).Error; err != nil {
-		// Handle the error (e.g., user not found)
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
-	}
-	// Begin a database transaction
-	tx := initializers.DB.Begin()
-
-	var profileID string
-	if err := initializers.DB.Model(&models.Profile{}).Where("user_id = ?", userId.ID).Select("id").Row().Scan(&profileID); err != nil {
-		// Handle the error (e.g., profile not found)
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User's profile not found"})
-	}
-
-	// Fetch the paths for profile_photos to be deleted
-	var files []string
-	if err := initializers.DB.Table("profile_photos").Where("profile_id = ?", profileID).Pluck("files", &files).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to retrieve profile photo paths"})
-	}
-
-	// Delete the directories on the server
-	for _, path := range files {
-		directoryName := extractDirectoryName(path)
-		if directoryName != "" {
-			err := deleteDirectory(directoryName)
-			if err != nil {
-				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete directories on the server"})
-			}
-		}
-	}
-	// Delete related entities using the profileID and user.ID before deleting the user
-	relatedEntities := []string{
-		"profiles_guilds",
-		"profiles_city",
-		"profiles_hashtags",
-		"profile_photos",
-		"billings",
-		"online_storages",
-		"transactions",
-		"blogs",
-		"user_relation",
-		"votes",
-		"codes",
-		"domains",
-		"payments",
-	}
-	for _, table := range relatedEntities {
-		whereColumn := "user_id"
-		id := user.ID.String()
-		if table == "profiles_guilds" || table == "profiles_city" || table == "profiles_hashtags" || table == "profile_photos" {
-			whereColumn = "profile_id"
-			id = profileID
-		}
-
-		if err := tx.Exec("DELETE FROM "+table+" WHERE "+whereColumn+" = ?", id).Error; err != nil {
-			tx.Rollback()
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete related entities from " + table})
-		}
-
-		if table == "user_relation" {
-			whereColumn = "following_id"
-			if err := tx.Exec("DELETE FROM "+table+" WHERE "+whereColumn+" = ?", id).Error; err != nil {
-				tx.Rollback()
-				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete related entities from " + table})
-			}
-		}
-	}
-
-	// Delete the associated profiles records
-	if err := tx.Delete(&user.Profile).Error; err != nil {
-		// Rollback the transaction if an error occurs
-		tx.Rollback()
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete user's profiles"})
-	}
-
-	// Delete the user and its related records
-	if err := tx.Delete(&user).Error; err != nil {
-		// Rollback the transaction if an error occurs
-		tx.Rollback()
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete user"})
-	}
-
-	// Commit the transaction
-	tx.Commit()
-
-	// Return a success response
-	return c.JSON(fiber.Map{"message": "User and related profiles deleted successfully"})
+	return ScheduleAccountDeletion(c)
 }
 
 // Function to delete all user accounts where IsBot is true, along with their related records
@@ -577,94 +414,18 @@ func DeleteAllBotUsersWithRelations(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch bot users"})
 	}
 
-	// Begin a database transaction
-	tx := initializers.DB.Begin()
-
-	// Loop through each bot user and delete
+	// Bots have no owner to wait for, they are erased right away
+	receipts := make([]string, 0, len(botUsers))
 	for _, user := range botUsers {
-		var profileID string
-		if err := tx.Model(&models.Profile{}).Where("user_id = ?", user.ID).Select("id").Scan(&profileID).Error; err != nil {
-			tx.Rollback()
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to find profile"})
-		}
-
-		// Fetch the paths for profile_photos to be deleted
-		var files []string
-		if err := tx.Table("profile_photos").Where("profile_id = ?", profileID).Pluck("path", &files).Error; err != nil {
-			tx.Rollback()
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch profile photos"})
-		}
-
-		// Delete the directories on the server for profile_photos
-		for _, path := range files {
-			directoryName := extractDirectoryName(path)
-			if directoryName != "" {
-				if err := deleteDirectory(directoryName); err != nil {
-					tx.Rollback()
-					return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete directory"})
-				}
-			}
-		}
-
-		// Delete related entities using the profileID and user.ID before deleting the user
-		relatedEntities := []string{
-			"profiles_guilds",
-			"profiles_city",
-			"profiles_hashtags",
-			"profile_photos",
-			"billings",
-			"online_storages",
-			"transactions",
-			"blogs",
-			"user_relation",
-			"votes",
-			"codes",
-			"domains",
-			"payments",
-		}
-		for _, table := range relatedEntities {
-			whereColumn := "user_id"
-			id := user.ID.String()
-			if table == "profiles_guilds" || table == "profiles_city" || table == "profiles_hashtags" || table == "profile_photos" {
-				whereColumn = "profile_id"
-				id = profileID
-			}
-
-			if err := tx.Exec("DELETE FROM "+table+" WHERE "+whereColumn+" = ?", id).Error; err != nil {
-				tx.Rollback()
-				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete related entities from " + table})
-			}
-
-			if table == "user_relation" {
-				whereColumn = "following_id"
-				if err := tx.Exec("DELETE FROM "+table+" WHERE "+whereColumn+" = ?", id).Error; err != nil {
-					tx.Rollback()
-					return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete related entities from " + table})
-				}
-			}
-		}
-
-		// Delete the associated profiles records
-		if err := tx.Delete(&user.Profile).Error; err != nil {
-			// Rollback the transaction if an error occurs
-			tx.Rollback()
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete user's profiles"})
-		}
-
-		// Delete the user itself
-		if err := tx.Delete(&user).Error; err != nil {
-			tx.Rollback()
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete user"})
+		receipt, err := utils.EraseUser(user.ID, time.Now())
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete bot user " + user.ID.String()})
 		}
-	}
-
-	// Commit the transaction
-	if err := tx.Commit().Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to commit deletion of bot users"})
+		receipts = append(receipts, receipt.ID.String())
 	}
 
 	// Return a success response
-	return c.JSON(fiber.Map{"message": "All bot users deleted successfully"})
+	return c.JSON(fiber.Map{"message": "All bot users deleted successfully", "receipts": receipts})
 }
 
 func GetMeFirst(c *fiber.Ctx) error {
@@ -758,6 +519,10 @@ func SetVipUser(c *fiber.Ctx) error {
 			"error": "User not found",
 		})
 	}
+	utils.AuditTarget(c, "user", user.ID.String())
+	utils.AuditChange(c,
+		fiber.Map{"role": user.Role, "amount": billing.Amount},
+		fiber.Map{"role": "vip", "amount": billing.Amount - priceFloat})
 
 	// Create domain settings
 	settings := pgtype.JSONB{}
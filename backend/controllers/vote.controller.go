@@ -3,6 +3,7 @@ package controllers
 import (
 	"hyperpage/initializers"
 	"hyperpage/models"
+	"hyperpage/utils"
 	"net/http"
 
 	"github.com/gofiber/fiber/v2"
@@ -85,6 +86,7 @@ func AddVote(c *fiber.Ctx) error {
 					"error":   err.Error(),
 				})
 			}
+			utils.TrackBlogEvent(blog.ID, models.BlogStatVotes)
 		} else {
 			// An error other than ErrRecordNotFound occurred
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
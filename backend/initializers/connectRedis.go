@@ -23,11 +23,6 @@ func ConnectRedis(config *Config) *redis.Client {
 		panic(err)
 	}
 
-	err := RedisClient.Set(ctx, "statusHealth", "ddrw api server is online", 0).Err()
-	if err != nil {
-		panic(err)
-	}
-
 	fmt.Println("✅ Redis client connected successfully...")
 
 	return RedisClient
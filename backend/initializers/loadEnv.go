@@ -24,6 +24,9 @@ type Config struct {
 	Amqpurl      string `mapstructure:"AMQP_URL"`
 	RabbitMQUri  string `mapstructure:"RABBITMQ_URL"`
 
+	ProxyHeader    string `mapstructure:"PROXY_HEADER"`
+	TrustedProxies string `mapstructure:"TRUSTED_PROXIES"`
+
 	AccessTokenPrivateKey  string        `mapstructure:"ACCESS_TOKEN_PRIVATE_KEY"`
 	AccessTokenPublicKey   string        `mapstructure:"ACCESS_TOKEN_PUBLIC_KEY"`
 	RefreshTokenPrivateKey string        `mapstructure:"REFRESH_TOKEN_PRIVATE_KEY"`
@@ -44,6 +47,52 @@ type Config struct {
 	CentrifugoHttpApiKey       string `mapstructure:"CENTRIFUGO_HTTP_API_KEY"`
 	CentrifugoBroadcastMode    string `mapstructure:"CENTRIFUGO_BROADCAST_MODE"`
 	CentrifugoOutboxPartitions int    `mapstructure:"CENTRIFUGO_OUTBOX_PARTITIONS"`
+
+	AcmeDirectory string `mapstructure:"ACME_DIRECTORY"`
+	AcmeEmail     string `mapstructure:"ACME_EMAIL"`
+	AcmeInsecure  bool   `mapstructure:"ACME_INSECURE"`
+	CertStorePath string `mapstructure:"CERT_STORE_PATH"`
+
+	StorageDriver    string `mapstructure:"STORAGE_DRIVER"`
+	PrivateStorePath string `mapstructure:"PRIVATE_STORE_PATH"`
+	BlobURLSecret    string `mapstructure:"BLOB_URL_SECRET"`
+	S3Endpoint       string `mapstructure:"S3_ENDPOINT"`
+	S3Region         string `mapstructure:"S3_REGION"`
+	S3Bucket         string `mapstructure:"S3_BUCKET"`
+	S3AccessKey      string `mapstructure:"S3_ACCESS_KEY"`
+	S3SecretKey      string `mapstructure:"S3_SECRET_KEY"`
+
+	PrivacyReceiptSecret string `mapstructure:"PRIVACY_RECEIPT_SECRET"`
+
+	AuditRetention time.Duration `mapstructure:"AUDIT_RETENTION"`
+
+	TurnSecret        string        `mapstructure:"TURN_SECRET"`
+	TurnCredentialTTL time.Duration `mapstructure:"TURN_CREDENTIAL_TTL"`
+	ICEServers        string        `mapstructure:"ICE_SERVERS"`
+	ICEDefaultRegion  string        `mapstructure:"ICE_DEFAULT_REGION"`
+	ICEServiceKey     string        `mapstructure:"ICE_SERVICE_KEY"`
+
+	PaxmeetServerURL  string `mapstructure:"PAXMEET_SERVER_URL"`
+	PaxmeetAPIKey     string `mapstructure:"PAXMEET_API_KEY"`
+	PaxmeetAPISecret  string `mapstructure:"PAXMEET_API_SECRET"`
+	PaxmeetWebhookURL string `mapstructure:"PAXMEET_WEBHOOK_URL"`
+
+	ConsultationFeePercent     *float64      `mapstructure:"CONSULTATION_FEE_PERCENT"`
+	ConsultationReserveMinutes int           `mapstructure:"CONSULTATION_RESERVE_MINUTES"`
+	ConsultationWarnBefore     time.Duration `mapstructure:"CONSULTATION_WARN_BEFORE"`
+
+	AppointmentReminderBefore time.Duration `mapstructure:"APPOINTMENT_REMINDER_BEFORE"`
+
+	LeadChallengeSecret string `mapstructure:"LEAD_CHALLENGE_SECRET"`
+	LeadRateLimit       int    `mapstructure:"LEAD_RATE_LIMIT"`
+
+	AdMinCPM           float64       `mapstructure:"AD_MIN_CPM"`
+	AdFrequencyCap     int           `mapstructure:"AD_FREQUENCY_CAP"`
+	AdRotationInterval time.Duration `mapstructure:"AD_ROTATION_INTERVAL"`
+
+	HealthCheckTimeout time.Duration `mapstructure:"HEALTH_CHECK_TIMEOUT"`
+	ShutdownDrainDelay time.Duration `mapstructure:"SHUTDOWN_DRAIN_DELAY"`
+	ShutdownTimeout    time.Duration `mapstructure:"SHUTDOWN_TIMEOUT"`
 }
 
 func LoadConfig(path string) (config Config, err error) {
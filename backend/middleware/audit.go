@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"errors"
+	"log"
+
+	"hyperpage/models"
+	"hyperpage/utils"
+
+	"github.com/gofiber/fiber/v2"
+	fiberutils "github.com/gofiber/fiber/v2/utils"
+)
+
+// Audit writes an audit event for the request once the rest of the chain
+// returned, denied and failed attempts included, so it goes before
+// DeserializeUser. The target defaults to the :id parameter, handlers add
+// what they know with utils.AuditTarget, utils.AuditActor and
+// utils.AuditChange. The route pattern is logged rather than the path, which
+// may carry reset and refresh tokens. Events without a known actor are
+// logged within the limits of utils.AllowAnonymousAudit.
+func Audit(action, targetType string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		record := &utils.AuditRecord{Action: action}
+		if targetType != "" {
+			record.TargetType = targetType
+			record.TargetID = fiberutils.CopyString(c.Params("id"))
+		}
+		c.Locals(utils.AuditLocalsKey, record)
+
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		if err != nil {
+			status = fiber.StatusInternalServerError
+			var fiberErr *fiber.Error
+			if errors.As(err, &fiberErr) {
+				status = fiberErr.Code
+			}
+		}
+
+		event := models.AuditEvent{
+			ActorID:    record.ActorID,
+			Action:     record.Action,
+			TargetType: record.TargetType,
+			TargetID:   record.TargetID,
+			Status:     status,
+			IP:         c.IP(),
+			UserAgent:  c.Get(fiber.HeaderUserAgent),
+			RequestID:  c.GetRespHeader(fiber.HeaderXRequestID),
+			Method:     c.Method(),
+			Path:       c.Route().Path,
+		}
+		switch user := c.Locals("user").(type) {
+		case models.UserResponse:
+			event.ActorID, event.ActorRole = &user.ID, user.Role
+		case *models.User:
+			event.ActorID, event.ActorRole = &user.ID, user.Role
+		}
+
+		// Anonymous requests are rate limited, they would otherwise let
+		// anyone take the chain lock at will
+		if event.ActorID == nil && !utils.AllowAnonymousAudit(event.IP) {
+			return err
+		}
+
+		if err := utils.RecordAudit(&event, record.Before, record.After); err != nil {
+			log.Println("Could not write audit event:", err)
+		}
+		return err
+	}
+}
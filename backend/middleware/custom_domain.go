@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"strings"
+
+	"hyperpage/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// CustomDomain serves the mini-sites on the custom domains of users. It
+// answers the ACME challenges of a host but never its ownership check,
+// stores the resolved domain in c.Locals("siteDomain") and sends the root of
+// the domain to the public site.
+func CustomDomain() func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		host := strings.ToLower(c.Hostname())
+		if i := strings.LastIndex(host, ":"); i != -1 && !strings.Contains(host[i:], "]") {
+			host = host[:i]
+		}
+		if host == "" || host == "localhost" || host == "myru.online" || strings.HasSuffix(host, ".myru.online") {
+			return c.Next()
+		}
+
+		path := c.Path()
+		if strings.HasPrefix(path, utils.ACMEChallengePath) {
+			keyAuth, ok := utils.ACMEChallengeResponse(strings.TrimPrefix(path, utils.ACMEChallengePath))
+			if !ok {
+				return c.SendStatus(fiber.StatusNotFound)
+			}
+			return c.SendString(keyAuth)
+		}
+		if path == utils.CustomDomainVerificationPath {
+			// The owner hosts the file, answering here would let anyone
+			// pointing a domain at us claim it
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+
+		domain := utils.ResolveCustomDomain(host)
+		if domain == nil {
+			return c.Next()
+		}
+		c.Locals("siteDomain", *domain)
+
+		if path == "/" {
+			c.Path("/api/site/public")
+			return c.RestartRouting()
+		}
+		return c.Next()
+	}
+}
@@ -52,6 +52,10 @@ func DeserializeUser(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"status": "fail", "message": "the user belonging to this token no longer exists"})
 	}
 
+	if user.Banned {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"status": "fail", "message": "this account is banned"})
+	}
+
 	c.Locals("user", models.FilterUserRecord(&user, language))
 	c.Locals("access_token_uuid", tokenClaims.TokenUuid)
 
@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+	"hyperpage/realtime"
+	"hyperpage/utils"
+)
+
+// RealtimeHandshake accepts websocket upgrades. Clients offering the realtime
+// subprotocol authenticate here, once for the whole connection, and get
+// their frame size negotiated, see package realtime.
+func RealtimeHandshake(c *fiber.Ctx) error {
+	if !websocket.IsWebSocketUpgrade(c) {
+		return fiber.ErrUpgradeRequired
+	}
+	c.Locals("allowed", true)
+
+	if !offersSubprotocol(c.Get(fiber.HeaderSecWebSocketProtocol), realtime.Subprotocol) {
+		return c.Next()
+	}
+
+	// Anonymous connections are allowed, a token that is sent must be valid
+	userID, status, err := tokenUser(c)
+	if err != nil {
+		return c.Status(status).JSON(fiber.Map{"status": "fail", "message": err.Error()})
+	}
+	if userID != "" {
+		c.Locals("realtime_user", userID)
+	}
+
+	c.Locals("realtime_max_frame", realtime.NegotiateFrameSize(c.Query("max_frame")))
+	return c.Next()
+}
+
+// TokenUserID returns the user of the access token sent with the request,
+// empty when there is none or it is not valid. For pages open to anonymous
+// visitors that give logged in users more.
+func TokenUserID(c *fiber.Ctx) string {
+	userID, _, err := tokenUser(c)
+	if err != nil {
+		return ""
+	}
+	return userID
+}
+
+// tokenUser checks the access token of the Authorization header, the
+// access_token cookie or query. It returns an empty ID when none is sent, or
+// the status to answer when it is not valid.
+func tokenUser(c *fiber.Ctx) (string, int, error) {
+	var accessToken string
+	authorization := c.Get("Authorization")
+	if strings.HasPrefix(authorization, "Bearer ") {
+		accessToken = strings.TrimPrefix(authorization, "Bearer ")
+	} else if c.Cookies("access_token") != "" {
+		accessToken = c.Cookies("access_token")
+	} else {
+		accessToken = c.Query("access_token")
+	}
+	if accessToken == "" {
+		return "", 0, nil
+	}
+
+	config, _ := initializers.LoadConfig(".")
+	tokenClaims, err := utils.ValidateToken(accessToken, config.AccessTokenPublicKey)
+	if err != nil {
+		return "", fiber.StatusUnauthorized, err
+	}
+
+	var user models.User
+	if err := initializers.DB.Select("id", "banned").First(&user, "id = ?", tokenClaims.UserID).Error; err != nil {
+		return "", fiber.StatusUnauthorized, errors.New("the user belonging to this token no longer exists")
+	}
+	if user.Banned {
+		return "", fiber.StatusForbidden, errors.New("this account is banned")
+	}
+	return user.ID.String(), 0, nil
+}
+
+func offersSubprotocol(header, protocol string) bool {
+	for _, offered := range strings.Split(header, ",") {
+		if strings.TrimSpace(offered) == protocol {
+			return true
+		}
+	}
+	return false
+}
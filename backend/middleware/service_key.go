@@ -0,0 +1,23 @@
+package middleware
+
+import (
+	"crypto/subtle"
+
+	"hyperpage/initializers"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// CheckServiceKey lets through the requests of other services of the
+// platform, which send ICE_SERVICE_KEY in the X-Service-Key header.
+func CheckServiceKey(c *fiber.Ctx) error {
+	config, _ := initializers.LoadConfig(".")
+	key := c.Get("X-Service-Key")
+	if config.ICEServiceKey == "" || subtle.ConstantTimeCompare([]byte(key), []byte(config.ICEServiceKey)) != 1 {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"status":  "fail",
+			"message": "Invalid service key",
+		})
+	}
+	return c.Next()
+}
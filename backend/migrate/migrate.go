@@ -122,6 +122,175 @@ func main() {
 	if err := initializers.DB.AutoMigrate(&models.Streaming{}); err != nil {
 		panic(err)
 	}
+	if err := initializers.DB.AutoMigrate(&models.Report{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.ModerationDecision{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.ModerationRule{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.BlogImageHash{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.Comment{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.BlogRevision{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.PromotionProduct{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.Promotion{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.BlogDailyStat{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.SavedSearchTerm{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.SavedSearchMatch{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.SyndicationChannel{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.SyndicationTemplate{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.BlogSyndication{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.CustomDomain{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.DomainCertificate{}); err != nil {
+		panic(err)
+	}
+	if err := initializers.DB.AutoMigrate(&models.AcmeAccount{}); err != nil {
+		panic(err)
+	}
+
+	if err := initializers.DB.AutoMigrate(&models.Blob{}); err != nil {
+		panic(err)
+	}
+
+	if err := initializers.DB.AutoMigrate(&models.UserBlob{}); err != nil {
+		panic(err)
+	}
+
+	if err := initializers.DB.AutoMigrate(&models.PhotoUpload{}); err != nil {
+		panic(err)
+	}
+
+	if err := initializers.DB.AutoMigrate(&models.DataExport{}); err != nil {
+		panic(err)
+	}
+
+	if err := initializers.DB.AutoMigrate(&models.AccountDeletion{}); err != nil {
+		panic(err)
+	}
+
+	if err := initializers.DB.AutoMigrate(&models.DeletionReceipt{}); err != nil {
+		panic(err)
+	}
+
+	if err := initializers.DB.AutoMigrate(&models.AuditEvent{}); err != nil {
+		panic(err)
+	}
+
+	if err := initializers.DB.AutoMigrate(&models.AuditCheckpoint{}); err != nil {
+		panic(err)
+	}
+
+	if err := utils.EnsureAuditAppendOnly(); err != nil {
+		panic(err)
+	}
+
+	if err := initializers.DB.AutoMigrate(&models.PresenceSession{}); err != nil {
+		panic(err)
+	}
+
+	if err := initializers.DB.AutoMigrate(&models.PresenceDaily{}); err != nil {
+		panic(err)
+	}
+
+	if err := initializers.DB.AutoMigrate(&models.Call{}); err != nil {
+		panic(err)
+	}
+
+	if err := initializers.DB.AutoMigrate(&models.ChatConference{}); err != nil {
+		panic(err)
+	}
+
+	if err := initializers.DB.AutoMigrate(&models.ConsultationRate{}); err != nil {
+		panic(err)
+	}
+
+	if err := initializers.DB.AutoMigrate(&models.Consultation{}); err != nil {
+		panic(err)
+	}
+
+	if err := initializers.DB.AutoMigrate(&models.AppointmentSchedule{}); err != nil {
+		panic(err)
+	}
+
+	if err := initializers.DB.AutoMigrate(&models.AppointmentAvailability{}); err != nil {
+		panic(err)
+	}
+
+	if err := initializers.DB.AutoMigrate(&models.AppointmentException{}); err != nil {
+		panic(err)
+	}
+
+	if err := initializers.DB.AutoMigrate(&models.Appointment{}); err != nil {
+		panic(err)
+	}
+
+	if err := initializers.DB.AutoMigrate(&models.Lead{}); err != nil {
+		panic(err)
+	}
+
+	if err := initializers.DB.AutoMigrate(&models.LeadNote{}); err != nil {
+		panic(err)
+	}
+
+	if err := initializers.DB.AutoMigrate(&models.LeadSettings{}); err != nil {
+		panic(err)
+	}
+
+	if err := initializers.DB.AutoMigrate(&models.AdCampaign{}); err != nil {
+		panic(err)
+	}
+
+	if err := initializers.DB.AutoMigrate(&models.AdCampaignTarget{}); err != nil {
+		panic(err)
+	}
+
+	if err := initializers.DB.AutoMigrate(&models.AdEvent{}); err != nil {
+		panic(err)
+	}
+
+	if err := initializers.DB.AutoMigrate(&models.StreamSession{}); err != nil {
+		panic(err)
+	}
+
+	if err := initializers.DB.AutoMigrate(&models.PlatformDailyStat{}); err != nil {
+		panic(err)
+	}
+
+	if err := initializers.DB.AutoMigrate(&models.ListingDailyStat{}); err != nil {
+		panic(err)
+	}
+
+	// Charge the files stored before usage was tracked
+	utils.BackfillStorageUsage()
+
+	// Platform KPIs of the time before the rollup job
+	utils.BackfillPlatformStats()
 
 	// Check if there are any users in the database
 	var userCount int64
@@ -204,27 +373,6 @@ func main() {
 		}
 		initializers.DB.Create(&profile)
 
-		// Create online storage for the admin user
-		onlineStorage := models.OnlineStorage{
-			UserID: admin.ID,
-			Year:   time.Now().Year(),
-			Data: []byte(`
-				[
-					{
-						"Month": "` + time.Now().Month().String() + `",
-						"Hours": [
-							{
-								"Hour": 0,
-								"Minutes": 0,
-								"Seconds": 0
-							}
-						]
-					}
-				]
-			`),
-		}
-		initializers.DB.Create(&onlineStorage)
-
 		code := models.Codes{
 			Code:      "paxintrade",
 			Balance:   "100",
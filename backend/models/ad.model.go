@@ -0,0 +1,82 @@
+package models
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Ad campaign statuses. Campaigns that spent their budget are exhausted,
+// ended ones had the rest of their budget refunded.
+const (
+	AdCampaignStatusActive    = "active"
+	AdCampaignStatusPaused    = "paused"
+	AdCampaignStatusExhausted = "exhausted"
+	AdCampaignStatusEnded     = "ended"
+)
+
+// Kinds of ad targets and events.
+const (
+	AdTargetCity     = "city"
+	AdTargetGuild    = "guild"
+	AdTargetLanguage = "language"
+
+	AdEventImpression = "impression"
+	AdEventClick      = "click"
+)
+
+// AdCampaign advertises a promoted post in the ad rotation until EndsAt, at
+// the latest when its promotion expires. Budget is reserved from the balance
+// of the author when the campaign starts, each impression costs CPM/1000 and
+// whatever was not spent is refunded when it ends. Spending is paced over
+// the days of the campaign, DailyBudget caps the days when it is set.
+// FrequencyCap is the number of impressions a viewer gets per day.
+type AdCampaign struct {
+	ID            uint64             `gorm:"primaryKey" json:"id"`
+	BlogID        uint64             `gorm:"not null;index" json:"blogId"`
+	UserID        uuid.UUID          `gorm:"type:uuid;not null;index" json:"userId"`
+	PromotionID   uint64             `gorm:"not null" json:"promotionId"`
+	Name          string             `gorm:"not null" json:"name"`
+	Status        string             `gorm:"not null;index" json:"status"`
+	CPM           float64            `gorm:"column:cpm;not null" json:"cpm"`
+	Budget        float64            `gorm:"not null" json:"budget"`
+	DailyBudget   float64            `gorm:"not null;default:0" json:"dailyBudget"`
+	Spent         float64            `gorm:"not null;default:0" json:"spent"`
+	DaySpent      float64            `gorm:"not null;default:0" json:"daySpent"`
+	DaySpentOn    string             `gorm:"type:varchar(10);not null;default:''" json:"daySpentOn"`
+	FrequencyCap  int                `gorm:"not null" json:"frequencyCap"`
+	Impressions   int64              `gorm:"not null;default:0" json:"impressions"`
+	Clicks        int64              `gorm:"not null;default:0" json:"clicks"`
+	TransactionID uint64             `gorm:"not null" json:"transactionId"`
+	Targets       []AdCampaignTarget `gorm:"foreignKey:CampaignID" json:"targets"`
+	StartsAt      time.Time          `gorm:"not null" json:"startsAt"`
+	EndsAt        time.Time          `gorm:"not null;index" json:"endsAt"`
+	EndedAt       *time.Time         `json:"endedAt"`
+	CreatedAt     time.Time          `gorm:"not null;default:now()" json:"createdAt"`
+	UpdatedAt     time.Time          `gorm:"not null;default:now()" json:"updatedAt"`
+}
+
+// AdCampaignTarget restricts a campaign to a city, guild or language. A
+// campaign without targets of a kind is shown everywhere for that kind.
+type AdCampaignTarget struct {
+	ID         uint64 `gorm:"primaryKey" json:"-"`
+	CampaignID uint64 `gorm:"not null;index" json:"-"`
+	Kind       string `gorm:"not null" json:"kind"`
+	Value      string `gorm:"not null" json:"value"`
+}
+
+// AdEvent is an impression or a click of a campaign. Clicks point to their
+// impression, Cost is what the impression was charged.
+type AdEvent struct {
+	ID           uint64    `gorm:"primaryKey" json:"id"`
+	CampaignID   uint64    `gorm:"not null;index" json:"campaignId"`
+	BlogID       uint64    `gorm:"not null" json:"blogId"`
+	Kind         string    `gorm:"not null" json:"kind"`
+	ImpressionID uint64    `gorm:"not null;default:0" json:"impressionId"`
+	ViewerKey    string    `gorm:"not null" json:"-"`
+	Language     string    `gorm:"not null;default:''" json:"language"`
+	CityID       uint      `gorm:"not null;default:0" json:"cityId"`
+	GuildID      uint      `gorm:"not null;default:0" json:"guildId"`
+	Cost         float64   `gorm:"not null;default:0" json:"cost"`
+	CreatedAt    time.Time `gorm:"not null;default:now();index" json:"createdAt"`
+}
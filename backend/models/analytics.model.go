@@ -0,0 +1,76 @@
+package models
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Counters collected per post and day.
+const (
+	BlogStatViews        = "views"
+	BlogStatFavorites    = "favorites"
+	BlogStatVotes        = "votes"
+	BlogStatChatRooms    = "chat_rooms"
+	BlogStatCallRequests = "call_requests"
+)
+
+// BlogDailyStat is the daily rollup of the view analytics of a post. Views
+// are deduplicated per visitor and day.
+type BlogDailyStat struct {
+	ID           uint64    `gorm:"primaryKey" json:"-"`
+	BlogID       uint64    `gorm:"not null;uniqueIndex:idx_blog_daily_stat" json:"blogId"`
+	Date         time.Time `gorm:"type:date;not null;uniqueIndex:idx_blog_daily_stat" json:"date"`
+	Views        int64     `gorm:"not null;default:0" json:"views"`
+	Favorites    int64     `gorm:"not null;default:0" json:"favorites"`
+	Votes        int64     `gorm:"not null;default:0" json:"votes"`
+	ChatRooms    int64     `gorm:"not null;default:0" json:"chatRooms"`
+	CallRequests int64     `gorm:"not null;default:0" json:"callRequests"`
+	UpdatedAt    time.Time `gorm:"not null;default:now()" json:"updatedAt"`
+}
+
+// PlatformDailyStat holds the platform KPIs of a UTC day. Active users come
+// from the presence sessions, MAU counts the 30 days up to the day.
+type PlatformDailyStat struct {
+	Date             time.Time `gorm:"type:date;primaryKey" json:"date"`
+	Signups          int64     `gorm:"not null;default:0" json:"signups"`
+	DAU              int64     `gorm:"column:dau;not null;default:0" json:"dau"`
+	MAU              int64     `gorm:"column:mau;not null;default:0" json:"mau"`
+	ListingsCreated  int64     `gorm:"not null;default:0" json:"listingsCreated"`
+	ListingsArchived int64     `gorm:"not null;default:0" json:"listingsArchived"`
+	TopUps           int64     `gorm:"not null;default:0" json:"topUps"`
+	TopUpVolume      float64   `gorm:"not null;default:0" json:"topUpVolume"`
+	Donations        int64     `gorm:"not null;default:0" json:"donations"`
+	DonationVolume   float64   `gorm:"not null;default:0" json:"donationVolume"`
+	ChatMessages     int64     `gorm:"not null;default:0" json:"chatMessages"`
+	StreamSessions   int64     `gorm:"not null;default:0" json:"streamSessions"`
+	StreamSeconds    int64     `gorm:"not null;default:0" json:"streamSeconds"`
+	UpdatedAt        time.Time `gorm:"not null;default:now()" json:"updatedAt"`
+}
+
+// Dimensions of ListingDailyStat.
+const (
+	ListingStatCity  = "city"
+	ListingStatGuild = "guild"
+)
+
+// ListingDailyStat counts the listings created and archived on a UTC day
+// per city or guild.
+type ListingDailyStat struct {
+	Date        time.Time `gorm:"type:date;primaryKey" json:"date"`
+	Dimension   string    `gorm:"primaryKey" json:"dimension"`
+	DimensionID uint      `gorm:"primaryKey;autoIncrement:false" json:"dimensionId"`
+	Created     int64     `gorm:"not null;default:0" json:"created"`
+	Archived    int64     `gorm:"not null;default:0" json:"archived"`
+}
+
+// StreamSession is a live stream of a user, kept after the stream ended
+// for the statistics.
+type StreamSession struct {
+	ID        uint64     `gorm:"primaryKey" json:"id"`
+	RoomID    string     `gorm:"not null;index" json:"roomId"`
+	UserID    uuid.UUID  `gorm:"type:uuid;not null;index" json:"userId"`
+	Title     string     `gorm:"null" json:"title"`
+	StartedAt time.Time  `gorm:"not null;index" json:"startedAt"`
+	EndedAt   *time.Time `gorm:"null" json:"endedAt"`
+}
@@ -0,0 +1,77 @@
+package models
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	AppointmentStatusBooked    = "booked"
+	AppointmentStatusCancelled = "cancelled"
+	AppointmentStatusCompleted = "completed"
+)
+
+// AppointmentSchedule is how a seller takes appointments. Slots of
+// SlotMinutes start in the weekly availability, in Timezone, with
+// BufferMinutes free between two appointments, up to HorizonDays ahead.
+// Price is paid in advance from the balance of the buyer, 0 for free
+// appointments. FeedToken is the secret of the iCalendar feed.
+type AppointmentSchedule struct {
+	UserID        uuid.UUID                 `gorm:"type:uuid;primaryKey" json:"userId"`
+	Timezone      string                    `gorm:"type:varchar(64);not null;default:'UTC'" json:"timezone"`
+	SlotMinutes   int                       `gorm:"not null;default:30" json:"slotMinutes"`
+	BufferMinutes int                       `gorm:"not null;default:0" json:"bufferMinutes"`
+	HorizonDays   int                       `gorm:"not null;default:30" json:"horizonDays"`
+	Price         float64                   `gorm:"not null;default:0" json:"price"`
+	Active        bool                      `gorm:"not null;default:true" json:"active"`
+	FeedToken     string                    `gorm:"type:varchar(64);not null;uniqueIndex" json:"-"`
+	Availability  []AppointmentAvailability `gorm:"foreignKey:UserID;references:UserID" json:"availability"`
+	CreatedAt     time.Time                 `gorm:"not null" json:"createdAt"`
+	UpdatedAt     time.Time                 `gorm:"not null" json:"updatedAt"`
+}
+
+// AppointmentAvailability is a weekly window of a schedule, Weekday 0 is
+// Sunday. Start and End are HH:MM in the timezone of the schedule.
+type AppointmentAvailability struct {
+	ID      uint64    `gorm:"primaryKey" json:"id"`
+	UserID  uuid.UUID `gorm:"type:uuid;not null;index" json:"-"`
+	Weekday int       `gorm:"not null" json:"weekday"`
+	Start   string    `gorm:"column:start_time;type:varchar(5);not null" json:"start"`
+	End     string    `gorm:"column:end_time;type:varchar(5);not null" json:"end"`
+}
+
+// AppointmentException changes the availability of a date, YYYY-MM-DD. It
+// blocks the window from Start to End, the whole day when they are empty,
+// or opens it when Available is set.
+type AppointmentException struct {
+	ID        uint64    `gorm:"primaryKey" json:"id"`
+	UserID    uuid.UUID `gorm:"type:uuid;not null;index" json:"-"`
+	Date      string    `gorm:"type:varchar(10);not null;index" json:"date"`
+	Start     string    `gorm:"column:start_time;type:varchar(5);not null;default:''" json:"start"`
+	End       string    `gorm:"column:end_time;type:varchar(5);not null;default:''" json:"end"`
+	Available bool      `gorm:"not null;default:false" json:"available"`
+	Note      string    `gorm:"not null;default:''" json:"note"`
+	CreatedAt time.Time `gorm:"not null" json:"createdAt"`
+}
+
+// Appointment is a slot a buyer booked with a seller. Price was paid in
+// advance with the deduction TransactionID, it goes to the seller once the
+// appointment is over. Sequence counts the changes, for calendar clients.
+type Appointment struct {
+	ID            uuid.UUID  `gorm:"type:uuid;default:uuid_generate_v4();primaryKey" json:"id"`
+	SellerID      uuid.UUID  `gorm:"type:uuid;not null;index" json:"sellerId"`
+	BuyerID       uuid.UUID  `gorm:"type:uuid;not null;index" json:"buyerId"`
+	StartsAt      time.Time  `gorm:"not null;index" json:"startsAt"`
+	EndsAt        time.Time  `gorm:"not null" json:"endsAt"`
+	Status        string     `gorm:"type:varchar(16);not null;index" json:"status"`
+	Note          string     `gorm:"not null;default:''" json:"note"`
+	Price         float64    `gorm:"not null;default:0" json:"price"`
+	TransactionID uint64     `gorm:"not null;default:0" json:"-"`
+	MeetRoomID    string     `gorm:"type:varchar(64);not null" json:"meetRoomId"`
+	Sequence      int        `gorm:"not null;default:0" json:"sequence"`
+	RemindedAt    *time.Time `gorm:"null" json:"-"`
+	CancelledBy   *uuid.UUID `gorm:"type:uuid" json:"cancelledBy"`
+	CreatedAt     time.Time  `gorm:"not null" json:"createdAt"`
+	UpdatedAt     time.Time  `gorm:"not null" json:"updatedAt"`
+}
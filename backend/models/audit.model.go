@@ -0,0 +1,69 @@
+package models
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// Audit event categories. Security events are shown to the user they
+// concern, the others only to admins.
+const (
+	AuditCategorySecurity = "security"
+	AuditCategoryAdmin    = "admin"
+	AuditCategoryBilling  = "billing"
+)
+
+// AuditEvent is an entry of the append-only audit log. Entries are hash
+// chained: Hash covers the fields of the entry and the Hash of the previous
+// one, so a changed or removed entry breaks the chain from there on. Before
+// and After hold only the fields the action changed.
+type AuditEvent struct {
+	ID         uint64         `gorm:"primaryKey" json:"id"`
+	ActorID    *uuid.UUID     `gorm:"type:uuid;index" json:"actorId"`
+	ActorRole  string         `gorm:"null" json:"actorRole"`
+	Category   string         `gorm:"not null;index" json:"category"`
+	Action     string         `gorm:"not null;index" json:"action"`
+	TargetType string         `gorm:"null;index:idx_audit_target" json:"targetType"`
+	TargetID   string         `gorm:"null;index:idx_audit_target" json:"targetId"`
+	Before     datatypes.JSON `gorm:"null" json:"before"`
+	After      datatypes.JSON `gorm:"null" json:"after"`
+	Status     int            `gorm:"not null" json:"status"`
+	IP         string         `gorm:"null" json:"ip"`
+	UserAgent  string         `gorm:"null" json:"userAgent"`
+	RequestID  string         `gorm:"null;index" json:"requestId"`
+	Method     string         `gorm:"null" json:"method"`
+	Path       string         `gorm:"null" json:"path"`
+	CreatedAt  time.Time      `gorm:"not null;index" json:"createdAt"`
+	PrevHash   string         `gorm:"not null" json:"prevHash"`
+	Hash       string         `gorm:"not null;uniqueIndex" json:"hash"`
+}
+
+func (e *AuditEvent) BeforeUpdate(tx *gorm.DB) error {
+	return ErrImmutableRecord
+}
+
+func (e *AuditEvent) BeforeDelete(tx *gorm.DB) error {
+	return ErrImmutableRecord
+}
+
+// AuditCheckpoint marks where old audit events were removed. LastHash is the
+// hash of the last removed event, the remaining log is verified from it.
+// Events are only removed once the part up to LastEventID was verified.
+type AuditCheckpoint struct {
+	ID          uint64    `gorm:"primaryKey" json:"id"`
+	LastEventID uint64    `gorm:"not null" json:"lastEventId"`
+	LastHash    string    `gorm:"not null" json:"lastHash"`
+	Removed     int64     `gorm:"not null" json:"removed"`
+	CreatedAt   time.Time `gorm:"not null" json:"createdAt"`
+}
+
+func (c *AuditCheckpoint) BeforeUpdate(tx *gorm.DB) error {
+	return ErrImmutableRecord
+}
+
+func (c *AuditCheckpoint) BeforeDelete(tx *gorm.DB) error {
+	return ErrImmutableRecord
+}
@@ -0,0 +1,26 @@
+package models
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Blob is a stored file addressed by the SHA-256 of its content. RefCount
+// is the number of users holding it, the file is removed from the store when
+// it drops to zero.
+type Blob struct {
+	Key         string    `gorm:"primaryKey" json:"key"`
+	Size        int64     `gorm:"not null" json:"size"`
+	ContentType string    `gorm:"not null" json:"contentType"`
+	Private     bool      `gorm:"not null;default:false" json:"private"`
+	RefCount    int       `gorm:"not null;default:0" json:"refCount"`
+	CreatedAt   time.Time `gorm:"not null;default:now()" json:"createdAt"`
+}
+
+// UserBlob charges a blob to the storage quota of a user.
+type UserBlob struct {
+	UserID    uuid.UUID `gorm:"type:uuid;primaryKey" json:"userId"`
+	BlobKey   string    `gorm:"primaryKey" json:"blobKey"`
+	CreatedAt time.Time `gorm:"not null;default:now()" json:"createdAt"`
+}
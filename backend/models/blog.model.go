@@ -8,6 +8,19 @@ import (
 	uuid "github.com/satori/go.uuid"
 )
 
+// Blog statuses. New and edited posts of untrusted accounts wait in
+// PENDING until a moderator approves or rejects them. DRAFT posts are only
+// visible to the author, SCHEDULED posts are published by the scheduler once
+// PublishAt has passed.
+const (
+	BlogStatusActive    = "ACTIVE"
+	BlogStatusArchived  = "ARCHIVED"
+	BlogStatusPending   = "PENDING"
+	BlogStatusRejected  = "REJECTED"
+	BlogStatusDraft     = "DRAFT"
+	BlogStatusScheduled = "SCHEDULED"
+)
+
 type Blog struct {
 	ID               uint64         `gorm:"primaryKey"`
 	Title            string         `gorm:"not null"`
@@ -38,7 +51,11 @@ type Blog struct {
 	UpdatedAt        time.Time      `gorm:"not null"`
 	DeletedAt        *time.Time     `gorm:"index"`
 	ExpiredAt        *time.Time     `gorm:"index"`
+	PublishAt        *time.Time     `gorm:"index"`
+	BumpedAt         *time.Time     `gorm:"index"`
 	Hashtags         []Hashtags     `gorm:"many2many:blog_hashtags;"`
+	CommentsCount    int            `gorm:"not null;default:0"`
+	CommentsLocked   bool           `gorm:"not null;default:false"`
 }
 
 type BlogResponse struct {
@@ -67,8 +84,11 @@ type BlogResponse struct {
 	UpdatedAt        time.Time      `json:"updatedAt"`
 	DeletedAt        *time.Time     `json:"deletedAt"`
 	ExpiredAt        *time.Time     `json:"expiredAt"`
+	PublishAt        *time.Time     `json:"publishAt"`
 	Photos           []BlogPhoto    `json:"photos"`
 	User             UserResponse   `json:"user"`
+	CommentsCount    int            `json:"commentsCount"`
+	CommentsLocked   bool           `json:"commentsLocked"`
 
 	Hashtags []string `json:"hashtags"`
 }
@@ -0,0 +1,52 @@
+package models
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// States of a call. A call starts initiated, rings once a device of the
+// callee is reached and ends accepted then ended, or rejected, busy or missed
+// without being answered.
+const (
+	CallStateInitiated = "initiated"
+	CallStateRinging   = "ringing"
+	CallStateAccepted  = "accepted"
+	CallStateRejected  = "rejected"
+	CallStateBusy      = "busy"
+	CallStateMissed    = "missed"
+	CallStateEnded     = "ended"
+)
+
+// Call is a 1:1 call between two users. CallerSession and CalleeSession are
+// the websocket sessions signaling it, the callee session is set by the
+// device that accepted. Duration is in seconds from the answer to the end.
+type Call struct {
+	ID            uuid.UUID  `gorm:"type:uuid;default:uuid_generate_v4();primaryKey" json:"id"`
+	CallerID      uuid.UUID  `gorm:"type:uuid;not null;index" json:"callerId"`
+	CalleeID      uuid.UUID  `gorm:"type:uuid;not null;index" json:"calleeId"`
+	Video         bool       `gorm:"not null;default:false" json:"video"`
+	State         string     `gorm:"type:varchar(16);not null;index" json:"state"`
+	CallerSession string     `gorm:"null" json:"-"`
+	CalleeSession string     `gorm:"null" json:"-"`
+	RingingAt     *time.Time `gorm:"null" json:"ringingAt"`
+	AnsweredAt    *time.Time `gorm:"null" json:"answeredAt"`
+	EndedAt       *time.Time `gorm:"null" json:"endedAt"`
+	Duration      int        `gorm:"not null;default:0" json:"duration"`
+	CreatedAt     time.Time  `gorm:"not null;index" json:"createdAt"`
+	UpdatedAt     time.Time  `gorm:"not null" json:"-"`
+}
+
+// Active reports whether the call is still ringing or in progress.
+func (c *Call) Active() bool {
+	switch c.State {
+	case CallStateInitiated, CallStateRinging, CallStateAccepted:
+		return true
+	}
+	return false
+}
+
+// ChatMessageTypeCall is the MsgType of the chat messages recording a missed
+// call, their JsonData holds the callId, state and video of the call.
+const ChatMessageTypeCall uint8 = 3
@@ -42,7 +42,7 @@ type ChatMessage struct {
 	IsDeleted bool       `gorm:"not null;default:false"`
 	CreatedAt time.Time  `gorm:"not null;default:now()"`
 	DeletedAt *time.Time `gorm:"index"`
-	MsgType   uint8      `gorm:"not null;default:0"` // 0: common, 1: conference, 2: attached post link
+	MsgType   uint8      `gorm:"not null;default:0"` // 0: common, 1: conference, 2: attached post link, 3: call
 	JsonData  *string    `gorm:"type:jsonb"`
 	// IsRead    bool       `gorm:"not null;default:false"`
 	ParentMessageID *uint64
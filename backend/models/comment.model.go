@@ -0,0 +1,76 @@
+package models
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Comment is a threaded comment on a blog post. Top level comments start a
+// thread, replies keep a reference to the thread root for paging.
+type Comment struct {
+	ID            uint64    `gorm:"primaryKey" json:"id"`
+	BlogID        uint64    `gorm:"not null;index" json:"blogId"`
+	UserID        uuid.UUID `gorm:"type:uuid;not null" json:"userId"`
+	User          User      `gorm:"foreignKey:UserID" json:"-"`
+	ParentID      *uint64   `gorm:"index" json:"parentId"`
+	RootID        *uint64   `gorm:"index" json:"rootId"`
+	Content       string    `gorm:"not null" json:"content"`
+	IsAuthorReply bool      `gorm:"not null;default:false" json:"isAuthorReply"`
+	IsEdited      bool      `gorm:"not null;default:false" json:"isEdited"`
+	IsDeleted     bool      `gorm:"not null;default:false" json:"isDeleted"`
+	RepliesCount  int       `gorm:"not null;default:0" json:"repliesCount"`
+	CreatedAt     time.Time `gorm:"not null;default:now()" json:"createdAt"`
+	UpdatedAt     time.Time `gorm:"not null;default:now()" json:"updatedAt"`
+}
+
+type CommentInput struct {
+	Content  string  `json:"content" validate:"required,min=1,max=2000"`
+	ParentID *uint64 `json:"parentId"`
+}
+
+type CommentResponse struct {
+	ID            uint64    `json:"id"`
+	BlogID        uint64    `json:"blogId"`
+	ParentID      *uint64   `json:"parentId"`
+	RootID        *uint64   `json:"rootId"`
+	Content       string    `json:"content"`
+	IsAuthorReply bool      `json:"isAuthorReply"`
+	IsEdited      bool      `json:"isEdited"`
+	IsDeleted     bool      `json:"isDeleted"`
+	RepliesCount  int       `json:"repliesCount"`
+	CreatedAt     time.Time `json:"createdAt"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+	User          struct {
+		ID    uuid.UUID `json:"id"`
+		Name  string    `json:"name"`
+		Photo string    `json:"photo"`
+	} `json:"user"`
+}
+
+func FilterCommentRecord(comment *Comment) CommentResponse {
+	response := CommentResponse{
+		ID:            comment.ID,
+		BlogID:        comment.BlogID,
+		ParentID:      comment.ParentID,
+		RootID:        comment.RootID,
+		Content:       comment.Content,
+		IsAuthorReply: comment.IsAuthorReply,
+		IsEdited:      comment.IsEdited,
+		IsDeleted:     comment.IsDeleted,
+		RepliesCount:  comment.RepliesCount,
+		CreatedAt:     comment.CreatedAt,
+		UpdatedAt:     comment.UpdatedAt,
+	}
+
+	// Deleted comments keep their place in the thread but hide the content and author
+	if comment.IsDeleted {
+		response.Content = ""
+		return response
+	}
+
+	response.User.ID = comment.User.ID
+	response.User.Name = comment.User.Name
+	response.User.Photo = comment.User.Photo
+	return response
+}
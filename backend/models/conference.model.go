@@ -0,0 +1,32 @@
+package models
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	ChatConferenceStatusActive = "active"
+	ChatConferenceStatusEnded  = "ended"
+)
+
+// ChatConference is a paxmeet room started from a chat room and announced by
+// a conference message (MsgType 1) in it. Only the members of the chat room
+// get join tokens. CallID is set when the conference continues a call.
+type ChatConference struct {
+	ID         uint64     `gorm:"primaryKey" json:"id"`
+	ChatRoomID uint64     `gorm:"not null;index" json:"chatRoomId"`
+	MessageID  uint64     `gorm:"not null;default:0" json:"messageId"`
+	MeetRoomID string     `gorm:"type:varchar(64);not null;uniqueIndex" json:"meetRoomId"`
+	StartedBy  uuid.UUID  `gorm:"type:uuid;not null" json:"startedBy"`
+	CallID     *uuid.UUID `gorm:"type:uuid" json:"callId"`
+	Status     string     `gorm:"type:varchar(16);not null;index" json:"status"`
+	EndedAt    *time.Time `gorm:"null" json:"endedAt"`
+	CreatedAt  time.Time  `gorm:"not null" json:"createdAt"`
+	UpdatedAt  time.Time  `gorm:"not null" json:"-"`
+}
+
+// ChatMessageTypeConference is the MsgType of the messages announcing a
+// conference, their JsonData holds its link and state.
+const ChatMessageTypeConference uint8 = 1
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// States of a consultation. The funds of the client are reserved while the
+// call rings, metered once it is answered and settled when it ends, or
+// released when it is not answered.
+const (
+	ConsultationStatusReserved = "reserved"
+	ConsultationStatusActive   = "active"
+	ConsultationStatusSettled  = "settled"
+	ConsultationStatusReleased = "released"
+)
+
+// ConsultationRate is the price per minute a seller charges for calls.
+type ConsultationRate struct {
+	UserID    uuid.UUID `gorm:"type:uuid;primaryKey" json:"userId"`
+	PerMinute float64   `gorm:"not null" json:"perMinute"`
+	Active    bool      `gorm:"not null;default:true" json:"active"`
+	CreatedAt time.Time `gorm:"not null" json:"createdAt"`
+	UpdatedAt time.Time `gorm:"not null" json:"updatedAt"`
+}
+
+// Consultation is a paid call from a client to a seller. Reserved is what
+// was taken from the balance of the client, Amount what the billed minutes
+// cost, split into the Fee of the platform and the Payout of the seller.
+// TransactionID is the deduction of the client.
+type Consultation struct {
+	ID            uint64     `gorm:"primaryKey" json:"id"`
+	CallID        uuid.UUID  `gorm:"type:uuid;not null;uniqueIndex" json:"callId"`
+	ClientID      uuid.UUID  `gorm:"type:uuid;not null;index" json:"clientId"`
+	SellerID      uuid.UUID  `gorm:"type:uuid;not null;index" json:"sellerId"`
+	Rate          float64    `gorm:"not null" json:"rate"`
+	FeePercent    float64    `gorm:"not null" json:"feePercent"`
+	Reserved      float64    `gorm:"not null" json:"reserved"`
+	Status        string     `gorm:"type:varchar(16);not null;index" json:"status"`
+	Seconds       int        `gorm:"not null;default:0" json:"seconds"`
+	Minutes       int        `gorm:"not null;default:0" json:"minutes"`
+	Amount        float64    `gorm:"not null;default:0" json:"amount"`
+	Fee           float64    `gorm:"not null;default:0" json:"fee"`
+	Payout        float64    `gorm:"not null;default:0" json:"payout"`
+	CutOff        bool       `gorm:"not null;default:false" json:"cutOff"`
+	TransactionID uint64     `gorm:"not null;default:0" json:"-"`
+	StartedAt     *time.Time `gorm:"null" json:"startedAt"`
+	WarnedAt      *time.Time `gorm:"null" json:"warnedAt"`
+	EndedAt       *time.Time `gorm:"null" json:"endedAt"`
+	CreatedAt     time.Time  `gorm:"not null;index" json:"createdAt"`
+	UpdatedAt     time.Time  `gorm:"not null" json:"-"`
+}
@@ -0,0 +1,91 @@
+package models
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Custom domain states. A domain serves the site once it is VERIFIED and
+// over HTTPS once it is ACTIVE.
+const (
+	CustomDomainStatusPending  = "PENDING"
+	CustomDomainStatusVerified = "VERIFIED"
+	CustomDomainStatusActive   = "ACTIVE"
+	CustomDomainStatusExpired  = "EXPIRED"
+)
+
+// Ownership verification methods.
+const (
+	DomainVerificationDNS  = "dns"
+	DomainVerificationHTTP = "http"
+)
+
+// CustomDomain points a domain of the user to the mini-site. It expires
+// together with the plan of the user.
+type CustomDomain struct {
+	ID                   uint64     `gorm:"primaryKey" json:"id"`
+	DomainID             uint64     `gorm:"not null;index" json:"domainId"`
+	UserID               uuid.UUID  `gorm:"type:uuid;not null;index" json:"userId"`
+	Host                 string     `gorm:"not null;uniqueIndex" json:"host"`
+	Method               string     `gorm:"not null" json:"method"`
+	Token                string     `gorm:"not null" json:"token"`
+	Status               string     `gorm:"not null;default:PENDING" json:"status"`
+	LastError            string     `gorm:"null" json:"lastError"`
+	VerifiedAt           *time.Time `gorm:"null" json:"verifiedAt"`
+	CheckedAt            *time.Time `gorm:"null" json:"checkedAt"`
+	CertificateExpiresAt *time.Time `gorm:"null" json:"certificateExpiresAt"`
+	ExpiredAt            *time.Time `gorm:"index" json:"expiredAt"`
+	CreatedAt            time.Time  `gorm:"not null;default:now()" json:"createdAt"`
+	UpdatedAt            time.Time  `gorm:"not null;default:now()" json:"updatedAt"`
+}
+
+type CustomDomainInput struct {
+	Host   string `json:"host" validate:"required,fqdn,max=253"`
+	Method string `json:"method" validate:"required,oneof=dns http"`
+}
+
+// DomainCertificate is the certificate chain and key issued for a host.
+type DomainCertificate struct {
+	ID        uint64    `gorm:"primaryKey" json:"id"`
+	Host      string    `gorm:"not null;uniqueIndex" json:"host"`
+	CertPEM   string    `gorm:"type:text;not null" json:"-"`
+	KeyPEM    string    `gorm:"type:text;not null" json:"-"`
+	NotAfter  time.Time `gorm:"not null" json:"notAfter"`
+	CreatedAt time.Time `gorm:"not null;default:now()" json:"createdAt"`
+	UpdatedAt time.Time `gorm:"not null;default:now()" json:"updatedAt"`
+}
+
+// AcmeAccount is the account key registered with an ACME directory.
+type AcmeAccount struct {
+	ID        uint64    `gorm:"primaryKey"`
+	Directory string    `gorm:"not null;uniqueIndex"`
+	Email     string    `gorm:"null"`
+	KeyPEM    string    `gorm:"type:text;not null"`
+	URI       string    `gorm:"null"`
+	CreatedAt time.Time `gorm:"not null;default:now()"`
+}
+
+// SiteSettings is the schema of Domain.Settings.
+type SiteSettings struct {
+	Logo      string        `json:"logo" validate:"max=255"`
+	Title     string        `json:"title" validate:"required,max=100"`
+	MetaDescr string        `json:"metadescr" validate:"max=300"`
+	Style     string        `json:"style" validate:"max=5000"`
+	Theme     SiteTheme     `json:"theme"`
+	Sections  []SiteSection `json:"sections" validate:"max=20,dive"`
+}
+
+type SiteTheme struct {
+	Mode       string `json:"mode" validate:"omitempty,oneof=light dark"`
+	Primary    string `json:"primary" validate:"omitempty,hexcolor"`
+	Background string `json:"background" validate:"omitempty,hexcolor"`
+	Font       string `json:"font" validate:"max=50"`
+}
+
+type SiteSection struct {
+	Type    string `json:"type" validate:"required,oneof=hero listings about services gallery contacts"`
+	Title   string `json:"title" validate:"max=100"`
+	Text    string `json:"text" validate:"max=5000"`
+	Visible bool   `json:"visible"`
+}
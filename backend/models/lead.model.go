@@ -0,0 +1,53 @@
+package models
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Lead statuses, sellers move their leads through them in the inbox.
+const (
+	LeadStatusNew       = "new"
+	LeadStatusContacted = "contacted"
+	LeadStatusWon       = "won"
+	LeadStatusLost      = "lost"
+)
+
+// Lead is a call-back request left by a visitor on a post. Price is the
+// price of the post when the request was made. The seller is reminded of
+// the lead at FollowUpAt, FollowUpSentAt is when that happened.
+type Lead struct {
+	ID             uint64     `gorm:"primaryKey" json:"id"`
+	BlogID         uint64     `gorm:"not null;index" json:"blogId"`
+	SellerID       uuid.UUID  `gorm:"type:uuid;not null;index" json:"sellerId"`
+	Name           string     `gorm:"not null" json:"name"`
+	Phone          string     `gorm:"not null" json:"phone"`
+	Price          float64    `gorm:"not null;default:0" json:"price"`
+	Status         string     `gorm:"not null;default:new;index" json:"status"`
+	FollowUpAt     *time.Time `gorm:"index" json:"followUpAt"`
+	FollowUpSentAt *time.Time `json:"followUpSentAt"`
+	IPHash         string     `gorm:"not null;default:''" json:"-"`
+	Notes          []LeadNote `gorm:"foreignKey:LeadID" json:"notes,omitempty"`
+	ContactedAt    *time.Time `json:"contactedAt"`
+	ClosedAt       *time.Time `json:"closedAt"`
+	CreatedAt      time.Time  `gorm:"not null;default:now()" json:"createdAt"`
+	UpdatedAt      time.Time  `gorm:"not null;default:now()" json:"updatedAt"`
+}
+
+// LeadNote is a note of the seller on a lead.
+type LeadNote struct {
+	ID        uint64    `gorm:"primaryKey" json:"id"`
+	LeadID    uint64    `gorm:"not null;index" json:"leadId"`
+	UserID    uuid.UUID `gorm:"type:uuid;not null" json:"userId"`
+	Text      string    `gorm:"not null" json:"text"`
+	CreatedAt time.Time `gorm:"not null;default:now()" json:"createdAt"`
+}
+
+// LeadSettings holds the comma separated alert channels new leads and
+// follow-ups of a seller are delivered to, see the AlertChannel constants.
+type LeadSettings struct {
+	UserID    uuid.UUID `gorm:"type:uuid;primaryKey" json:"userId"`
+	Channels  string    `gorm:"not null;default:inapp,telegram" json:"channels"`
+	UpdatedAt time.Time `gorm:"not null;default:now()" json:"updatedAt"`
+}
@@ -0,0 +1,99 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	ReportTargetBlog    = "blog"
+	ReportTargetUser    = "user"
+	ReportTargetComment = "comment"
+)
+
+const (
+	ReportStatusOpen      = "OPEN"
+	ReportStatusResolved  = "RESOLVED"
+	ReportStatusDismissed = "DISMISSED"
+)
+
+// ReportReasons is the list of reasons a user can pick when reporting content.
+var ReportReasons = []string{"spam", "fraud", "prohibited", "offensive", "duplicate", "other"}
+
+const (
+	ModerationActionApprove  = "approve"
+	ModerationActionReject   = "reject"
+	ModerationActionBan      = "ban"
+	ModerationActionUnban    = "unban"
+	ModerationActionDismiss  = "dismiss"
+	ModerationActionAutoFlag = "auto_flag"
+)
+
+const (
+	ModerationRuleKeyword = "keyword"
+	ModerationRuleLink    = "link"
+)
+
+var ErrImmutableRecord = errors.New("record is immutable")
+
+// Report is a complaint about a post or a profile. Reports created by the
+// automated pre-checks have no reporter.
+type Report struct {
+	ID         uint64     `gorm:"primaryKey" json:"id"`
+	ReporterID *uuid.UUID `gorm:"type:uuid" json:"reporterId"`
+	TargetType string     `gorm:"not null;index:idx_report_target" json:"targetType"`
+	TargetID   string     `gorm:"not null;index:idx_report_target" json:"targetId"`
+	Reason     string     `gorm:"not null" json:"reason"`
+	Comment    string     `gorm:"null" json:"comment"`
+	Status     string     `gorm:"not null;default:OPEN;index" json:"status"`
+	CreatedAt  time.Time  `gorm:"not null;default:now()" json:"createdAt"`
+	UpdatedAt  time.Time  `gorm:"not null;default:now()" json:"updatedAt"`
+}
+
+type CreateReportInput struct {
+	TargetType string `json:"targetType" validate:"required,oneof=blog user comment"`
+	TargetID   string `json:"targetId" validate:"required"`
+	Reason     string `json:"reason" validate:"required"`
+	Comment    string `json:"comment" validate:"max=1000"`
+}
+
+// ModerationDecision is an append-only log entry of a moderator action.
+type ModerationDecision struct {
+	ID          uint64     `gorm:"primaryKey" json:"id"`
+	ModeratorID *uuid.UUID `gorm:"type:uuid" json:"moderatorId"`
+	TargetType  string     `gorm:"not null;index:idx_decision_target" json:"targetType"`
+	TargetID    string     `gorm:"not null;index:idx_decision_target" json:"targetId"`
+	Action      string     `gorm:"not null" json:"action"`
+	Reason      string     `gorm:"null" json:"reason"`
+	CreatedAt   time.Time  `gorm:"not null;default:now()" json:"createdAt"`
+}
+
+func (d *ModerationDecision) BeforeUpdate(tx *gorm.DB) error {
+	return ErrImmutableRecord
+}
+
+func (d *ModerationDecision) BeforeDelete(tx *gorm.DB) error {
+	return ErrImmutableRecord
+}
+
+// ModerationRule feeds the keyword and link blacklist pre-checks.
+type ModerationRule struct {
+	ID        uint64    `gorm:"primaryKey" json:"id"`
+	Kind      string    `gorm:"not null;index" json:"kind"`
+	Value     string    `gorm:"not null" json:"value"`
+	CreatedAt time.Time `gorm:"not null;default:now()" json:"createdAt"`
+}
+
+// BlogImageHash stores the SHA-256 of every published photo so that the
+// same image reposted by another account can be detected.
+type BlogImageHash struct {
+	ID        uint64    `gorm:"primaryKey"`
+	Hash      string    `gorm:"not null;index"`
+	BlogID    uint64    `gorm:"not null;index"`
+	UserID    uuid.UUID `gorm:"type:uuid;not null"`
+	Path      string    `gorm:"not null"`
+	CreatedAt time.Time `gorm:"not null;default:now()"`
+}
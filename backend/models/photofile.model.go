@@ -0,0 +1,38 @@
+package models
+
+// PhotoFile is an entry of the files column of blog and profile photos. Path
+// is the largest variant in the original format, so clients that only read
+// path keep working. Variants hold every generated width in every format.
+type PhotoFile struct {
+	Name     string         `json:"name,omitempty"`
+	Path     string         `json:"path" validate:"required"`
+	Width    int            `json:"width,omitempty"`
+	Height   int            `json:"height,omitempty"`
+	Blurhash string         `json:"blurhash,omitempty"`
+	Color    string         `json:"color,omitempty"`
+	Variants []PhotoVariant `json:"variants,omitempty"`
+}
+
+type PhotoVariant struct {
+	Path   string `json:"path"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Type   string `json:"type"`
+}
+
+// Paths returns the stored files of the entry.
+func (f PhotoFile) Paths() []string {
+	paths := make([]string, 0, len(f.Variants)+1)
+	seen := make(map[string]bool)
+	if f.Path != "" {
+		paths = append(paths, f.Path)
+		seen[f.Path] = true
+	}
+	for _, variant := range f.Variants {
+		if variant.Path != "" && !seen[variant.Path] {
+			paths = append(paths, variant.Path)
+			seen[variant.Path] = true
+		}
+	}
+	return paths
+}
@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jackc/pgtype"
+	uuid "github.com/satori/go.uuid"
+)
+
+// PhotoUpload records what the server generated for an uploaded image, keyed
+// by its main path and owner. Blog and profile photos are rebuilt from it, so the
+// variants and placeholder of a stored photo never come from the client.
+type PhotoUpload struct {
+	Path      string       `gorm:"primaryKey" json:"path"`
+	UserID    uuid.UUID    `gorm:"type:uuid;primaryKey" json:"userId"`
+	File      pgtype.JSONB `gorm:"type:jsonb;not null" json:"file"`
+	CreatedAt time.Time    `gorm:"not null;default:now()" json:"createdAt"`
+}
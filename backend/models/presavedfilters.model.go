@@ -31,12 +31,56 @@ func (m *Meta) Scan(src interface{}) error {
 	return json.Unmarshal(data, m)
 }
 
+// Saved search alert frequencies.
+const (
+	AlertFrequencyOff     = "off"
+	AlertFrequencyInstant = "instant"
+	AlertFrequencyDaily   = "daily"
+	AlertFrequencyWeekly  = "weekly"
+)
+
+// Saved search alert delivery channels.
+const (
+	AlertChannelInApp    = "inapp"
+	AlertChannelPush     = "push"
+	AlertChannelEmail    = "email"
+	AlertChannelTelegram = "telegram"
+)
+
+// Presavedfilters is a saved search. Meta holds the GetAll query parameters
+// (city, category, hashtag, money, title). With a Frequency other than off
+// the filter is a subscription to new posts matching it, delivered to the
+// comma separated Channels.
 type Presavedfilters struct {
-	ID        uint64     `gorm:"primaryKey"`
-	UserID    uuid.UUID  `gorm:"type:uuid;not null"`
-	Name      string     `gorm:"not null"`
-	CreatedAt time.Time  `gorm:"autoCreateTime"`
-	Meta      Meta       `gorm:"type:jsonb"`
-	UpdatedAt time.Time  `gorm:"autoUpdateTime"`
-	DeletedAt *time.Time `gorm:"index"`
+	ID           uint64     `gorm:"primaryKey"`
+	UserID       uuid.UUID  `gorm:"type:uuid;not null"`
+	Name         string     `gorm:"not null"`
+	CreatedAt    time.Time  `gorm:"autoCreateTime"`
+	Meta         Meta       `gorm:"type:jsonb"`
+	Frequency    string     `gorm:"not null;default:off"`
+	Channels     string     `gorm:"not null;default:inapp"`
+	LastDigestAt *time.Time `gorm:"null"`
+	UpdatedAt    time.Time  `gorm:"autoUpdateTime"`
+	DeletedAt    *time.Time `gorm:"index"`
+}
+
+// SavedSearchTerm is an entry of the inverted index of saved searches. A
+// filter has one term per city, category and hashtag it requires, filters
+// without any of them have a single term of kind any.
+type SavedSearchTerm struct {
+	ID       uint64 `gorm:"primaryKey"`
+	FilterID uint64 `gorm:"not null;index"`
+	Kind     string `gorm:"not null;index:idx_saved_search_term"`
+	Value    string `gorm:"not null;index:idx_saved_search_term"`
+}
+
+// SavedSearchMatch is a post matched by a saved search, pending delivery
+// until Delivered is set.
+type SavedSearchMatch struct {
+	ID        uint64    `gorm:"primaryKey"`
+	FilterID  uint64    `gorm:"not null;uniqueIndex:idx_saved_search_match"`
+	BlogID    uint64    `gorm:"not null;uniqueIndex:idx_saved_search_match"`
+	UserID    uuid.UUID `gorm:"type:uuid;not null;index"`
+	Delivered bool      `gorm:"not null;default:false"`
+	CreatedAt time.Time `gorm:"autoCreateTime"`
 }
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// PresenceSession is one connection of a user, from connect to disconnect or
+// the last heartbeat before it went stale. LastSeenAt is refreshed by the
+// presence sweep, RolledUp marks ended sessions already counted in
+// PresenceDaily.
+type PresenceSession struct {
+	ID         uint64     `gorm:"primaryKey" json:"id"`
+	UserID     uuid.UUID  `gorm:"type:uuid;not null;index" json:"userId"`
+	ConnID     string     `gorm:"not null;uniqueIndex" json:"-"`
+	Device     string     `gorm:"null" json:"device"`
+	StartedAt  time.Time  `gorm:"not null;index" json:"startedAt"`
+	LastSeenAt time.Time  `gorm:"not null" json:"lastSeenAt"`
+	EndedAt    *time.Time `gorm:"null;index" json:"endedAt"`
+	RolledUp   bool       `gorm:"not null;default:false;index" json:"-"`
+	CreatedAt  time.Time  `gorm:"not null" json:"-"`
+	UpdatedAt  time.Time  `gorm:"not null" json:"-"`
+}
+
+// PresenceDaily is the online time of a user on a UTC day. Overlapping
+// sessions of several devices count once.
+type PresenceDaily struct {
+	UserID   uuid.UUID `gorm:"type:uuid;primaryKey" json:"-"`
+	Day      time.Time `gorm:"type:date;primaryKey" json:"day"`
+	Seconds  int64     `gorm:"not null;default:0" json:"seconds"`
+	Sessions int       `gorm:"not null;default:0" json:"sessions"`
+}
@@ -0,0 +1,81 @@
+package models
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// Data export states. READY exports can be downloaded until ExpiresAt, then
+// the archive is removed and the export is EXPIRED.
+const (
+	DataExportStatusPending = "PENDING"
+	DataExportStatusRunning = "RUNNING"
+	DataExportStatusReady   = "READY"
+	DataExportStatusFailed  = "FAILED"
+	DataExportStatusExpired = "EXPIRED"
+)
+
+// DataExport is a zip archive of everything stored about a user.
+type DataExport struct {
+	ID          uint64     `gorm:"primaryKey" json:"id"`
+	UserID      uuid.UUID  `gorm:"type:uuid;not null;index" json:"userId"`
+	Status      string     `gorm:"not null;default:PENDING;index" json:"status"`
+	Key         string     `gorm:"null" json:"-"`
+	Size        int64      `gorm:"not null;default:0" json:"size"`
+	Error       string     `gorm:"null" json:"error"`
+	ExpiresAt   *time.Time `gorm:"index" json:"expiresAt"`
+	CompletedAt *time.Time `gorm:"null" json:"completedAt"`
+	CreatedAt   time.Time  `gorm:"not null;default:now()" json:"createdAt"`
+	UpdatedAt   time.Time  `gorm:"not null;default:now()" json:"updatedAt"`
+}
+
+// Account deletion states. A SCHEDULED deletion can be cancelled until
+// ScheduledFor, then the account is erased.
+const (
+	AccountDeletionStatusScheduled = "SCHEDULED"
+	AccountDeletionStatusCancelled = "CANCELLED"
+	AccountDeletionStatusCompleted = "COMPLETED"
+)
+
+// AccountDeletion is a request of a user to erase the account.
+type AccountDeletion struct {
+	ID           uint64     `gorm:"primaryKey" json:"id"`
+	UserID       uuid.UUID  `gorm:"type:uuid;not null;index" json:"userId"`
+	Status       string     `gorm:"not null;default:SCHEDULED;index" json:"status"`
+	Reason       string     `gorm:"null" json:"reason"`
+	ScheduledFor time.Time  `gorm:"not null;index" json:"scheduledFor"`
+	CancelledAt  *time.Time `gorm:"null" json:"cancelledAt"`
+	CompletedAt  *time.Time `gorm:"null" json:"completedAt"`
+	ReceiptID    *uuid.UUID `gorm:"type:uuid" json:"receiptId"`
+	CreatedAt    time.Time  `gorm:"not null;default:now()" json:"createdAt"`
+	UpdatedAt    time.Time  `gorm:"not null;default:now()" json:"updatedAt"`
+}
+
+type AccountDeletionInput struct {
+	Reason string `json:"reason" validate:"max=1000"`
+}
+
+// DeletionReceipt proves what was removed when an account was erased. It
+// holds no personal data: SubjectHash is the SHA-256 of the email, so the
+// former owner can show the receipt is theirs, and Pseudonym is the ID the
+// kept financial records now carry. Items counts the removed rows per table.
+type DeletionReceipt struct {
+	ID          uuid.UUID      `gorm:"type:uuid;primaryKey" json:"id"`
+	SubjectHash string         `gorm:"not null;index" json:"subjectHash"`
+	Pseudonym   uuid.UUID      `gorm:"type:uuid;not null" json:"pseudonym"`
+	Items       datatypes.JSON `gorm:"not null" json:"items"`
+	RequestedAt time.Time      `gorm:"not null" json:"requestedAt"`
+	CompletedAt time.Time      `gorm:"not null" json:"completedAt"`
+	Signature   string         `gorm:"not null" json:"signature"`
+}
+
+func (r *DeletionReceipt) BeforeUpdate(tx *gorm.DB) error {
+	return ErrImmutableRecord
+}
+
+func (r *DeletionReceipt) BeforeDelete(tx *gorm.DB) error {
+	return ErrImmutableRecord
+}
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Promotion kinds. A pin keeps the post on top of a category or city, a
+// highlight sets a sticker, a bump moves the post to the top of the feed.
+const (
+	PromotionKindPin       = "pin"
+	PromotionKindHighlight = "highlight"
+	PromotionKindBump      = "bump"
+)
+
+const (
+	PromotionScopeCategory = "category"
+	PromotionScopeCity     = "city"
+)
+
+const (
+	PromotionStatusActive  = "ACTIVE"
+	PromotionStatusExpired = "EXPIRED"
+)
+
+// PromotionProduct is an entry of the promotion catalog.
+type PromotionProduct struct {
+	ID        uint64    `gorm:"primaryKey" json:"id"`
+	Kind      string    `gorm:"not null" json:"kind"`
+	Name      string    `gorm:"not null" json:"name"`
+	Price     float64   `gorm:"not null" json:"price"`
+	Days      int       `gorm:"not null" json:"days"`
+	Sticker   string    `gorm:"null" json:"sticker"`
+	Active    bool      `gorm:"not null;default:true" json:"active"`
+	CreatedAt time.Time `gorm:"not null;default:now()" json:"createdAt"`
+	UpdatedAt time.Time `gorm:"not null;default:now()" json:"updatedAt"`
+}
+
+type PromotionProductInput struct {
+	Kind    string  `json:"kind" validate:"required,oneof=pin highlight bump"`
+	Name    string  `json:"name" validate:"required,min=2,max=100"`
+	Price   float64 `json:"price" validate:"min=0"`
+	Days    int     `json:"days" validate:"required,min=1,max=365"`
+	Sticker string  `json:"sticker"`
+	Active  *bool   `json:"active"`
+}
+
+// Promotion is a purchased product applied to a post.
+type Promotion struct {
+	ID            uint64    `gorm:"primaryKey" json:"id"`
+	BlogID        uint64    `gorm:"not null;index" json:"blogId"`
+	UserID        uuid.UUID `gorm:"type:uuid;not null;index" json:"userId"`
+	ProductID     uint64    `gorm:"not null" json:"productId"`
+	Kind          string    `gorm:"not null;index" json:"kind"`
+	Scope         string    `gorm:"null" json:"scope"`
+	ScopeID       uint      `gorm:"not null;default:0" json:"scopeId"`
+	Sticker       string    `gorm:"null" json:"sticker"`
+	Price         float64   `gorm:"not null" json:"price"`
+	TransactionID uint64    `gorm:"not null" json:"transactionId"`
+	Status        string    `gorm:"not null;index" json:"status"`
+	Impressions   int64     `gorm:"not null;default:0" json:"impressions"`
+	Clicks        int64     `gorm:"not null;default:0" json:"clicks"`
+	StartsAt      time.Time `gorm:"not null" json:"startsAt"`
+	ExpiresAt     time.Time `gorm:"not null;index" json:"expiresAt"`
+	CreatedAt     time.Time `gorm:"not null;default:now()" json:"createdAt"`
+	UpdatedAt     time.Time `gorm:"not null;default:now()" json:"updatedAt"`
+}
+
+type PurchasePromotionInput struct {
+	ProductID uint64 `json:"productId" validate:"required"`
+	Scope     string `json:"scope" validate:"omitempty,oneof=category city"`
+	ScopeID   uint   `json:"scopeId"`
+}
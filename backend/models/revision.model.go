@@ -0,0 +1,41 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jackc/pgtype"
+	uuid "github.com/satori/go.uuid"
+)
+
+// BlogRevision is a snapshot of the editable fields of a post, taken before
+// every update so that authors can compare and roll back their changes.
+type BlogRevision struct {
+	ID        uint64       `gorm:"primaryKey" json:"id"`
+	BlogID    uint64       `gorm:"not null;index" json:"blogId"`
+	Number    int          `gorm:"not null" json:"number"`
+	UserID    uuid.UUID    `gorm:"type:uuid;not null" json:"userId"`
+	Title     string       `gorm:"not null" json:"title"`
+	Descr     string       `gorm:"not null" json:"descr"`
+	Content   string       `gorm:"null" json:"content"`
+	Total     float64      `gorm:"null" json:"total"`
+	Photos    pgtype.JSONB `gorm:"type:jsonb" json:"photos"`
+	CreatedAt time.Time    `gorm:"not null;default:now()" json:"createdAt"`
+}
+
+// RevisionPhoto is the photos entry of a revision, the files of a
+// blog_photos row at the time of the snapshot.
+type RevisionPhoto struct {
+	ID    uint64         `json:"id"`
+	Files []RevisionFile `json:"files"`
+}
+
+// RevisionFile keeps the variants of a photo so that a rollback restores
+// them too.
+type RevisionFile = PhotoFile
+
+// RevisionChange is a single changed field between two versions of a post.
+type RevisionChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
@@ -0,0 +1,83 @@
+package models
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Syndication outlets implemented in utils.
+const (
+	OutletTelegram = "telegram"
+	OutletVK       = "vk"
+	OutletWebhook  = "webhook"
+)
+
+// Pending syndication actions.
+const (
+	SyndicationActionPost   = "post"
+	SyndicationActionEdit   = "edit"
+	SyndicationActionDelete = "delete"
+)
+
+// Syndication states.
+const (
+	SyndicationStatusPending = "PENDING"
+	SyndicationStatusPosted  = "POSTED"
+	SyndicationStatusDeleted = "DELETED"
+	SyndicationStatusFailed  = "FAILED"
+)
+
+// SyndicationChannel is a place posts are cross-posted to. Channels without
+// a city or guild take every post, channels with a UserID are the personal
+// Telegram channel of an author.
+type SyndicationChannel struct {
+	ID        uint64     `gorm:"primaryKey" json:"id"`
+	Outlet    string     `gorm:"not null" json:"outlet"`
+	Name      string     `gorm:"not null" json:"name"`
+	Target    string     `gorm:"not null" json:"target"`
+	Token     string     `gorm:"null" json:"-"`
+	Language  string     `gorm:"not null;default:ru" json:"language"`
+	CityID    *uint      `gorm:"index" json:"cityId"`
+	GuildID   *uint      `gorm:"index" json:"guildId"`
+	UserID    *uuid.UUID `gorm:"type:uuid;index" json:"userId"`
+	Active    bool       `gorm:"not null;default:true" json:"active"`
+	CreatedAt time.Time  `gorm:"not null;default:now()" json:"createdAt"`
+	UpdatedAt time.Time  `gorm:"not null;default:now()" json:"updatedAt"`
+}
+
+type SyndicationChannelInput struct {
+	Outlet   string `json:"outlet" validate:"required,oneof=telegram vk webhook"`
+	Name     string `json:"name" validate:"required,min=2,max=100"`
+	Target   string `json:"target" validate:"required"`
+	Token    string `json:"token"`
+	Language string `json:"language" validate:"omitempty,min=2,max=5"`
+	CityID   *uint  `json:"cityId"`
+	GuildID  *uint  `json:"guildId"`
+	Active   *bool  `json:"active"`
+}
+
+// SyndicationTemplate is the message template of a language, a Go
+// text/template executed with utils.SyndicationMessage.
+type SyndicationTemplate struct {
+	ID        uint64    `gorm:"primaryKey" json:"id"`
+	Language  string    `gorm:"not null;uniqueIndex" json:"language"`
+	Body      string    `gorm:"type:text;not null" json:"body"`
+	UpdatedAt time.Time `gorm:"not null;default:now()" json:"updatedAt"`
+}
+
+// BlogSyndication tracks a post in a channel. ExternalIDs holds the comma
+// separated message IDs returned by the outlet, media groups have several.
+type BlogSyndication struct {
+	ID            uint64     `gorm:"primaryKey" json:"id"`
+	BlogID        uint64     `gorm:"not null;uniqueIndex:idx_blog_syndication" json:"blogId"`
+	ChannelID     uint64     `gorm:"not null;uniqueIndex:idx_blog_syndication" json:"channelId"`
+	ExternalIDs   string     `gorm:"null" json:"externalIds"`
+	Status        string     `gorm:"not null" json:"status"`
+	Action        string     `gorm:"null" json:"action"`
+	Attempts      int        `gorm:"not null;default:0" json:"attempts"`
+	NextAttemptAt *time.Time `gorm:"index" json:"nextAttemptAt"`
+	LastError     string     `gorm:"null" json:"lastError"`
+	CreatedAt     time.Time  `gorm:"not null;default:now()" json:"createdAt"`
+	UpdatedAt     time.Time  `gorm:"not null;default:now()" json:"updatedAt"`
+}
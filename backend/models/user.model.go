@@ -95,6 +95,7 @@ type User struct {
 	TotalBlogs                int              `gorm:"not null;default:0"`
 	Rating                    int              `gorm:"not null;default:0"`
 	LimitStorage              int              `gorm:"not null;default:20"`
+	StorageUsed               int64            `gorm:"not null;default:0"`
 	LastOnline                time.Time        `json:"last_online"`
 	Online                    bool             `json:"online"`
 	Domains                   []Domain         `json:"domains"`
@@ -153,6 +154,7 @@ type UserResponse struct {
 	TId               int64             `json:"tid"`
 	Tcid              int64             `json:"tcid"`
 	LimitStorage      int               `json:"limitstorage"`
+	StorageUsed       int64             `json:"storageused"`
 	Banned            bool              `bool:"banned"`
 	Plan              string            `bool:"plan"`
 	Profile           []ProfileResponse `json:"profile"`
@@ -249,6 +251,7 @@ func FilterUserRecord(user *User, language string) UserResponse {
 		Tcid:             user.Tcid,
 		Profile:          profileResponses,
 		LimitStorage:     user.LimitStorage,
+		StorageUsed:      user.StorageUsed,
 		Banned:           user.Banned,
 		Plan:             user.Plan,
 		Filled:           user.Filled,
@@ -0,0 +1,307 @@
+// Package client connects to the realtime websockets, for bots and tests.
+//
+//	c, err := client.Dial(ctx, "wss://go.myru.online/socket.io/", client.Options{Token: accessToken})
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//
+//	c.On("newblog", func(data json.RawMessage) { ... })
+//	err = c.Call(ctx, realtime.MethodTyping, realtime.TypingRequest{RoomID: "42"}, nil)
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"hyperpage/realtime"
+
+	"github.com/fasthttp/websocket"
+)
+
+var (
+	ErrClosed          = errors.New("realtime: connection closed")
+	ErrNotNegotiated   = errors.New("realtime: server did not accept the protocol")
+	ErrFrameTooLarge   = errors.New("realtime: frame exceeds the negotiated size")
+	ErrUnexpectedFrame = errors.New("realtime: expected a welcome frame")
+)
+
+const closeTimeout = time.Second
+
+// Options of a connection.
+type Options struct {
+	// Token is the access token of the user, none for anonymous connections.
+	Token string
+	// Header is added to the handshake, e.g. the paxcall_session cookie.
+	Header http.Header
+	// MaxFrameSize is proposed to the server, 0 for its default.
+	MaxFrameSize int
+	// Dialer defaults to websocket.DefaultDialer.
+	Dialer *websocket.Dialer
+}
+
+// Client is a realtime connection. Its methods are safe for concurrent use.
+type Client struct {
+	conn    *websocket.Conn
+	welcome realtime.Welcome
+
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	nextID   uint64
+	pending  map[string]chan *realtime.Frame
+	handlers map[string]func(json.RawMessage)
+	closed   bool
+	err      error
+
+	done chan struct{}
+}
+
+// Dial connects and waits for the welcome frame of the server.
+func Dial(ctx context.Context, rawURL string, opts Options) (*Client, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if opts.MaxFrameSize > 0 {
+		query := target.Query()
+		query.Set("max_frame", strconv.Itoa(opts.MaxFrameSize))
+		target.RawQuery = query.Encode()
+	}
+
+	header := http.Header{}
+	for key, values := range opts.Header {
+		header[key] = values
+	}
+	if opts.Token != "" {
+		header.Set("Authorization", "Bearer "+opts.Token)
+	}
+
+	dialer := websocket.DefaultDialer
+	if opts.Dialer != nil {
+		dialer = opts.Dialer
+	}
+	withProtocol := *dialer
+	withProtocol.Subprotocols = []string{realtime.Subprotocol}
+
+	conn, _, err := withProtocol.DialContext(ctx, target.String(), header)
+	if err != nil {
+		return nil, err
+	}
+	if conn.Subprotocol() != realtime.Subprotocol {
+		conn.Close()
+		return nil, ErrNotNegotiated
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+	}
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	frame, ferr := realtime.Decode(data)
+	if ferr != nil {
+		conn.Close()
+		return nil, ferr
+	}
+	if frame.Type != realtime.TypeWelcome {
+		conn.Close()
+		return nil, ErrUnexpectedFrame
+	}
+
+	c := &Client{
+		conn:     conn,
+		pending:  make(map[string]chan *realtime.Frame),
+		handlers: make(map[string]func(json.RawMessage)),
+		done:     make(chan struct{}),
+	}
+	if err := json.Unmarshal(frame.Data, &c.welcome); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+// Session returns the session the server assigned to the connection.
+func (c *Client) Session() string {
+	return c.welcome.Session
+}
+
+// UserID returns the user the server authenticated, empty for anonymous
+// connections.
+func (c *Client) UserID() string {
+	return c.welcome.UserID
+}
+
+// MaxFrameSize returns the largest frame the server accepts.
+func (c *Client) MaxFrameSize() int {
+	return c.welcome.MaxFrameSize
+}
+
+// On sets the handler of an event, it runs on the read loop and must not
+// block. A nil handler removes it.
+func (c *Client) On(event string, handler func(data json.RawMessage)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if handler == nil {
+		delete(c.handlers, event)
+		return
+	}
+	c.handlers[event] = handler
+}
+
+// Call sends a request and waits for its response, decoded into result
+// unless it is nil. Errors of the server are returned as *realtime.Error.
+func (c *Client) Call(ctx context.Context, method string, params, result interface{}) error {
+	reply, err := c.roundTrip(ctx, realtime.TypeRequest, method, params)
+	if err != nil {
+		return err
+	}
+	if reply.Type == realtime.TypeError {
+		return reply.Error
+	}
+	if result == nil || len(reply.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(reply.Data, result)
+}
+
+// Ping measures the round trip to the server.
+func (c *Client) Ping(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+	if _, err := c.roundTrip(ctx, realtime.TypePing, "", nil); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// Done is closed when the connection ends, Err then tells why.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the error that ended the connection.
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Close ends the connection.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+
+	c.writeMu.Lock()
+	c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(closeTimeout))
+	c.writeMu.Unlock()
+	return c.conn.Close()
+}
+
+func (c *Client) roundTrip(ctx context.Context, frameType, name string, params interface{}) (*realtime.Frame, error) {
+	reply := make(chan *realtime.Frame, 1)
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.nextID++
+	id := strconv.FormatUint(c.nextID, 10)
+	c.pending[id] = reply
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	data, err := realtime.Encode(frameType, id, name, params)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.write(data); err != nil {
+		return nil, err
+	}
+
+	select {
+	case frame := <-reply:
+		return frame, nil
+	case <-c.done:
+		return nil, c.Err()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) write(data []byte) error {
+	if c.welcome.MaxFrameSize > 0 && len(data) > c.welcome.MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func (c *Client) readLoop() {
+	var err error
+	defer func() {
+		c.mu.Lock()
+		if c.closed || websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			err = ErrClosed
+		}
+		c.err = err
+		c.mu.Unlock()
+		close(c.done)
+	}()
+
+	for {
+		var data []byte
+		if _, data, err = c.conn.ReadMessage(); err != nil {
+			return
+		}
+		frame, ferr := realtime.Decode(data)
+		if ferr != nil {
+			continue
+		}
+
+		switch frame.Type {
+		case realtime.TypePing:
+			pong, _ := realtime.Encode(realtime.TypePong, frame.ID, "", nil)
+			if err = c.write(pong); err != nil {
+				return
+			}
+		case realtime.TypeResponse, realtime.TypeError, realtime.TypePong:
+			c.mu.Lock()
+			reply, ok := c.pending[frame.ID]
+			c.mu.Unlock()
+			if ok {
+				select {
+				case reply <- frame:
+				default:
+				}
+			}
+		case realtime.TypeEvent:
+			c.mu.Lock()
+			handler := c.handlers[frame.Name]
+			c.mu.Unlock()
+			if handler != nil {
+				handler(frame.Data)
+			}
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"hyperpage/realtime"
+
+	"github.com/fasthttp/websocket"
+	fiberws "github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+)
+
+const testToken = "test-token"
+
+// testGateway is an in-process realtime endpoint speaking the protocol of
+// /socket.io: the handshake authenticates the token and negotiates the
+// frame size, requests go through a realtime.Router and the server pushes
+// events and pings.
+type testGateway struct {
+	url      string
+	app      *fiber.App
+	sessions atomic.Int64
+	pongs    chan string
+}
+
+// gatewayConn serializes the writes of a test connection.
+type gatewayConn struct {
+	conn *fiberws.Conn
+	mu   sync.Mutex
+}
+
+func (c *gatewayConn) write(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func startTestGateway(t *testing.T) *testGateway {
+	t.Helper()
+	gateway := &testGateway{app: fiber.New(), pongs: make(chan string, 1)}
+
+	gateway.app.Use("/socket.io/", func(c *fiber.Ctx) error {
+		if !fiberws.IsWebSocketUpgrade(c) {
+			return fiber.ErrUpgradeRequired
+		}
+		if auth := c.Get(fiber.HeaderAuthorization); auth != "" {
+			if auth != "Bearer "+testToken {
+				return fiber.ErrUnauthorized
+			}
+			c.Locals("realtime_user", "user-1")
+		}
+		c.Locals("realtime_max_frame", realtime.NegotiateFrameSize(c.Query("max_frame")))
+		return c.Next()
+	})
+	gateway.app.Get("/socket.io/", fiberws.New(gateway.serve, fiberws.Config{Subprotocols: []string{realtime.Subprotocol}}))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go gateway.app.Listener(listener)
+	t.Cleanup(func() { gateway.app.Shutdown() })
+
+	gateway.url = "ws://" + listener.Addr().String() + "/socket.io/"
+	return gateway
+}
+
+func (g *testGateway) serve(c *fiberws.Conn) {
+	if c.Subprotocol() != realtime.Subprotocol {
+		return
+	}
+	conn := &gatewayConn{conn: c}
+	session := "session-" + strconv.FormatInt(g.sessions.Add(1), 10)
+	userID, _ := c.Locals("realtime_user").(string)
+	maxFrameSize, _ := c.Locals("realtime_max_frame").(int)
+	c.SetReadLimit(int64(maxFrameSize))
+
+	welcome, _ := realtime.Encode(realtime.TypeWelcome, "", "", realtime.Welcome{
+		Session:      session,
+		UserID:       userID,
+		MaxFrameSize: maxFrameSize,
+		PingInterval: int(realtime.PingInterval / time.Second),
+	})
+	if conn.write(welcome) != nil {
+		return
+	}
+
+	drain := make(chan struct{}, 1)
+	router := realtime.NewRouter()
+	router.OnPong = func(session string) {
+		select {
+		case g.pongs <- session:
+		default:
+		}
+	}
+	router.Handle("echo", func(c *realtime.Context) (interface{}, error) {
+		return c.Frame.Data, nil
+	})
+	router.Handle(realtime.MethodTyping, func(c *realtime.Context) (interface{}, error) {
+		if c.UserID == "" {
+			return nil, realtime.ErrUnauthorized
+		}
+		var request realtime.TypingRequest
+		if err := c.Bind(&request); err != nil {
+			return nil, err
+		}
+		// Pushed after the response, like an event from another node
+		go func() {
+			for i := 0; i < 3; i++ {
+				event, _ := realtime.EncodeEvent("typing", map[string]interface{}{"roomId": request.RoomID, "n": i})
+				conn.write(event)
+			}
+			ping, _ := realtime.Encode(realtime.TypePing, "server-ping", "", nil)
+			conn.write(ping)
+		}()
+		return nil, nil
+	})
+	router.Handle("drain", func(c *realtime.Context) (interface{}, error) {
+		drain <- struct{}{}
+		return nil, nil
+	})
+
+	for {
+		_, message, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+		if reply := router.Serve(session, userID, message); reply != nil {
+			if conn.write(reply) != nil {
+				return
+			}
+		}
+		select {
+		case <-drain:
+			// What DrainGateway sends before the node stops
+			event, _ := realtime.EncodeEvent(realtime.EventServerDraining, realtime.ServerDrainingEvent{RetryAfter: 1})
+			conn.write(event)
+			conn.mu.Lock()
+			c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server restart"))
+			conn.mu.Unlock()
+			return
+		default:
+		}
+	}
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestConnect(t *testing.T) {
+	gateway := startTestGateway(t)
+	ctx := testContext(t)
+
+	c, err := Dial(ctx, gateway.url, Options{Token: testToken, MaxFrameSize: 8 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if c.Session() == "" {
+		t.Error("no session in the welcome frame")
+	}
+	if c.UserID() != "user-1" {
+		t.Errorf("user = %q, want user-1", c.UserID())
+	}
+	if c.MaxFrameSize() != 8<<10 {
+		t.Errorf("max frame size = %d, want %d", c.MaxFrameSize(), 8<<10)
+	}
+	if _, err := c.Ping(ctx); err != nil {
+		t.Error("ping:", err)
+	}
+
+	anonymous, err := Dial(ctx, gateway.url, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer anonymous.Close()
+	if anonymous.UserID() != "" {
+		t.Errorf("anonymous user = %q", anonymous.UserID())
+	}
+	if anonymous.Session() == c.Session() {
+		t.Error("two connections share a session")
+	}
+
+	if _, err := Dial(ctx, gateway.url, Options{Token: "forged"}); err == nil {
+		t.Error("a wrong token was accepted")
+	}
+}
+
+func TestCall(t *testing.T) {
+	gateway := startTestGateway(t)
+	ctx := testContext(t)
+
+	c, err := Dial(ctx, gateway.url, Options{Token: testToken, MaxFrameSize: realtime.MinMaxFrameSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type payload struct {
+		Text string `json:"text"`
+	}
+	// Concurrent calls are matched to their responses by ID
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var result payload
+			sent := payload{Text: "message " + strconv.Itoa(i)}
+			if err := c.Call(ctx, "echo", sent, &result); err != nil {
+				t.Error(err)
+				return
+			}
+			if result != sent {
+				t.Errorf("echo = %+v, want %+v", result, sent)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var rerr *realtime.Error
+	if err := c.Call(ctx, "missing", nil, nil); !errors.As(err, &rerr) || rerr.Code != realtime.CodeUnknownMethod {
+		t.Errorf("unknown method = %v, want %s", err, realtime.CodeUnknownMethod)
+	}
+
+	large := payload{Text: strings.Repeat("x", realtime.MinMaxFrameSize)}
+	if err := c.Call(ctx, "echo", large, nil); err != ErrFrameTooLarge {
+		t.Errorf("large frame = %v, want ErrFrameTooLarge", err)
+	}
+
+	anonymous, err := Dial(ctx, gateway.url, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer anonymous.Close()
+	err = anonymous.Call(ctx, realtime.MethodTyping, realtime.TypingRequest{RoomID: "42"}, nil)
+	if !errors.As(err, &rerr) || rerr.Code != realtime.CodeUnauthorized {
+		t.Errorf("anonymous typing = %v, want %s", err, realtime.CodeUnauthorized)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	gateway := startTestGateway(t)
+	ctx := testContext(t)
+
+	c, err := Dial(ctx, gateway.url, Options{Token: testToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	events := make(chan json.RawMessage, 3)
+	c.On("typing", func(data json.RawMessage) { events <- data })
+
+	if err := c.Call(ctx, realtime.MethodTyping, realtime.TypingRequest{RoomID: "42"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case data := <-events:
+			var event struct {
+				RoomID string `json:"roomId"`
+				N      int    `json:"n"`
+			}
+			if err := json.Unmarshal(data, &event); err != nil {
+				t.Fatal(err)
+			}
+			if event.RoomID != "42" || event.N != i {
+				t.Errorf("event %d = %+v", i, event)
+			}
+		case <-ctx.Done():
+			t.Fatal("event", i, "not received")
+		}
+	}
+
+	// The server pinged after the events, the client answers by itself
+	select {
+	case session := <-gateway.pongs:
+		if session != c.Session() {
+			t.Errorf("pong from %q, want %q", session, c.Session())
+		}
+	case <-ctx.Done():
+		t.Fatal("the server ping was not answered")
+	}
+
+	// Removed handlers receive nothing
+	c.On("typing", nil)
+	if err := c.Call(ctx, realtime.MethodTyping, realtime.TypingRequest{RoomID: "42"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-events:
+		t.Error("event delivered to a removed handler")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	gateway := startTestGateway(t)
+	ctx := testContext(t)
+
+	c, err := Dial(ctx, gateway.url, Options{Token: testToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	retryAfter := make(chan int, 1)
+	c.On(realtime.EventServerDraining, func(data json.RawMessage) {
+		var event realtime.ServerDrainingEvent
+		json.Unmarshal(data, &event)
+		retryAfter <- event.RetryAfter
+	})
+
+	if err := c.Call(ctx, "drain", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case wait := <-retryAfter:
+		if wait != 1 {
+			t.Errorf("retry after = %d, want 1", wait)
+		}
+	case <-ctx.Done():
+		t.Fatal("server.draining not received")
+	}
+	select {
+	case <-c.Done():
+	case <-ctx.Done():
+		t.Fatal("the connection was not closed")
+	}
+	if !websocket.IsCloseError(c.Err(), websocket.CloseServiceRestart) {
+		t.Errorf("err = %v, want a service restart close", c.Err())
+	}
+	if err := c.Call(ctx, "echo", nil, nil); err == nil {
+		t.Error("call on a closed connection succeeded")
+	}
+
+	// A new connection gets a new session
+	again, err := Dial(ctx, gateway.url, Options{Token: testToken})
+	if err != nil {
+		t.Fatal("reconnect:", err)
+	}
+	if again.Session() == c.Session() {
+		t.Error("the session was reused")
+	}
+	if _, err := again.Ping(ctx); err != nil {
+		t.Error(err)
+	}
+
+	// Closing on our side is not an error of the server
+	again.Close()
+	<-again.Done()
+	if again.Err() != ErrClosed {
+		t.Errorf("err after Close = %v, want ErrClosed", again.Err())
+	}
+}
@@ -0,0 +1,260 @@
+package realtime
+
+import "encoding/json"
+
+// Methods of /socket.io. Calls between users are signaled by the server,
+// see CallStartRequest.
+const (
+	MethodSessionGet = "session.get"
+	MethodTyping     = "typing"
+	MethodCallStart  = "call.start"
+	MethodCallAccept = "call.accept"
+	MethodCallReject = "call.reject"
+	MethodCallEnd    = "call.end"
+	MethodCallSignal = "call.signal"
+	MethodIceServers = "ice.servers"
+)
+
+// Methods of /paxcall/ws, relayed between anonymous sessions. ice.servers
+// is served there too.
+const (
+	MethodCallOffer    = "call.offer"
+	MethodCallAnswer   = "call.answer"
+	MethodCallFinish   = "call.finish"
+	MethodVideoStart   = "video.start"
+	MethodVideoStop    = "video.stop"
+	MethodIceCandidate = "ice.candidate"
+)
+
+// Events the server pushes to other sessions of a call. Notifications of
+// the platform, like newblog or BalanceAdded, are events named after them.
+const (
+	EventCallIncoming = "call.incoming"
+	EventCallAnswered = "call.answered"
+	EventCallRejected = "call.rejected"
+	EventCallFinished = "call.finished"
+	EventVideoStarted = "video.started"
+	EventVideoStopped = "video.stopped"
+	EventIceCandidate = "ice.candidate"
+)
+
+// Events of the calls between users. call.ring goes to every device of the
+// callee, call.answered_elsewhere to the other ones once a device accepted.
+// call.escalated tells both sides to move to a conference before the call
+// ends.
+const (
+	EventCallRing              = "call.ring"
+	EventCallAccepted          = "call.accepted"
+	EventCallAnsweredElsewhere = "call.answered_elsewhere"
+	EventCallEnded             = "call.ended"
+	EventCallSignal            = "call.signal"
+	EventCallEscalated         = "call.escalated"
+)
+
+// Events of paid consultation calls, sent to both users.
+// consultation.warning comes when the reserved minutes are about to run out,
+// consultation.settled is the receipt once the call is over.
+const (
+	EventConsultationWarning = "consultation.warning"
+	EventConsultationSettled = "consultation.settled"
+)
+
+// server.draining is sent before a node shuts down and closes the
+// connection with 1012 Service Restart. Clients reconnect after RetryAfter
+// seconds and reach another node.
+const (
+	EventServerDraining = "server.draining"
+)
+
+// SessionResult is the result of session.get.
+type SessionResult struct {
+	Session string `json:"session"`
+}
+
+// TypingRequest reports the user typing in a chat room.
+type TypingRequest struct {
+	RoomID string `json:"roomId"`
+}
+
+// SessionRequest targets another session, for call.finish and video.stop.
+type SessionRequest struct {
+	Session string `json:"session"`
+}
+
+// IceCandidate is a WebRTC ICE candidate.
+type IceCandidate struct {
+	Candidate        string `json:"candidate"`
+	SdpMid           string `json:"sdpMid"`
+	SdpMLineIndex    int    `json:"sdpMLineIndex"`
+	UsernameFragment string `json:"usernameFragment,omitempty"`
+}
+
+// OfferRequest sends an SDP offer to another session, for call.offer and
+// video.start.
+type OfferRequest struct {
+	Session string `json:"session"`
+	SDP     string `json:"sdp"`
+}
+
+// AnswerRequest sends the SDP answer to the calling session.
+type AnswerRequest struct {
+	Session       string         `json:"session"`
+	SDP           string         `json:"sdp"`
+	IceCandidates []IceCandidate `json:"iceCandidates,omitempty"`
+}
+
+// IceCandidateRequest sends an ICE candidate to the other session of a call.
+type IceCandidateRequest struct {
+	Session   string       `json:"session"`
+	Candidate IceCandidate `json:"candidate"`
+}
+
+// SessionEvent is the data of call.rejected, call.finished and
+// video.stopped, Session is the one that sent it.
+type SessionEvent struct {
+	Session string `json:"session"`
+}
+
+// OfferEvent is the data of call.incoming and video.started.
+type OfferEvent struct {
+	Session string `json:"session"`
+	SDP     string `json:"sdp"`
+}
+
+// AnswerEvent is the data of call.answered.
+type AnswerEvent struct {
+	Session       string         `json:"session"`
+	SDP           string         `json:"sdp"`
+	IceCandidates []IceCandidate `json:"iceCandidates,omitempty"`
+}
+
+// IceCandidateEvent is the data of ice.candidate.
+type IceCandidateEvent struct {
+	Session   string       `json:"session"`
+	Candidate IceCandidate `json:"candidate"`
+}
+
+// IceServersRequest asks for the ICE servers of WebRTC with TURN
+// credentials, of the default region when Region is empty. The data of
+// ice.servers is optional. Credentials are only issued to logged in users,
+// for the call CallID they take part in until it ends, or for a call they
+// are about to start.
+type IceServersRequest struct {
+	Region string `json:"region,omitempty"`
+	CallID string `json:"callId,omitempty"`
+}
+
+// CallStartRequest calls a user. The SDP offer is optional, it is passed on
+// to the callee with call.ring and the result of call.accept.
+type CallStartRequest struct {
+	CalleeID string `json:"calleeId"`
+	Video    bool   `json:"video"`
+	SDP      string `json:"sdp,omitempty"`
+}
+
+// CallRequest targets a call, for call.reject and call.end.
+type CallRequest struct {
+	CallID string `json:"callId"`
+}
+
+// CallAcceptRequest answers a call on this device. The SDP answer is
+// optional, it is passed on to the caller with call.accepted.
+type CallAcceptRequest struct {
+	CallID string `json:"callId"`
+	SDP    string `json:"sdp,omitempty"`
+}
+
+// CallSignalRequest relays an SDP or a trickled ICE candidate to the other
+// side of a call. Candidates of the caller sent before the call is accepted
+// are delivered to the device that accepts.
+type CallSignalRequest struct {
+	CallID    string        `json:"callId"`
+	SDP       string        `json:"sdp,omitempty"`
+	Candidate *IceCandidate `json:"candidate,omitempty"`
+}
+
+// Call is the state of a call, the result of call.start and call.accept.
+// SDP is the offer of the caller in the result of call.accept.
+type Call struct {
+	ID       string `json:"id"`
+	CallerID string `json:"callerId"`
+	CalleeID string `json:"calleeId"`
+	Video    bool   `json:"video"`
+	State    string `json:"state"`
+	SDP      string `json:"sdp,omitempty"`
+}
+
+// CallRingEvent is the data of call.ring.
+type CallRingEvent struct {
+	Call
+	CallerName  string `json:"callerName"`
+	CallerPhoto string `json:"callerPhoto,omitempty"`
+}
+
+// CallAcceptedEvent is the data of call.accepted, Session is the device of
+// the callee that accepted.
+type CallAcceptedEvent struct {
+	CallID  string `json:"callId"`
+	Session string `json:"session"`
+	SDP     string `json:"sdp,omitempty"`
+}
+
+// CallEndedEvent is the data of call.answered_elsewhere and call.ended,
+// State is the final one: rejected, busy, missed or ended.
+type CallEndedEvent struct {
+	CallID string `json:"callId"`
+	State  string `json:"state"`
+}
+
+// CallEscalatedEvent is the data of call.escalated, the conference of the
+// direct chat room of the two users that continues the call.
+type CallEscalatedEvent struct {
+	CallID       string `json:"callId"`
+	ConferenceID uint64 `json:"conferenceId"`
+	ChatRoomID   uint64 `json:"chatRoomId"`
+}
+
+// CallSignalEvent is the data of call.signal.
+type CallSignalEvent struct {
+	CallID    string        `json:"callId"`
+	SDP       string        `json:"sdp,omitempty"`
+	Candidate *IceCandidate `json:"candidate,omitempty"`
+}
+
+// ConsultationWarningEvent is the data of consultation.warning, Remaining is
+// in seconds.
+type ConsultationWarningEvent struct {
+	CallID    string  `json:"callId"`
+	Remaining int     `json:"remaining"`
+	Amount    float64 `json:"amount"`
+	Reserved  float64 `json:"reserved"`
+}
+
+// ConsultationSettledEvent is the data of consultation.settled. CutOff is
+// set when the call ended because the funds ran out.
+type ConsultationSettledEvent struct {
+	CallID  string  `json:"callId"`
+	Minutes int     `json:"minutes"`
+	Amount  float64 `json:"amount"`
+	Fee     float64 `json:"fee"`
+	Payout  float64 `json:"payout"`
+	Refund  float64 `json:"refund"`
+	CutOff  bool    `json:"cutOff"`
+}
+
+// ServerDrainingEvent is the data of server.draining, RetryAfter is in
+// seconds.
+type ServerDrainingEvent struct {
+	RetryAfter int `json:"retryAfter"`
+}
+
+// Bind decodes the data of a request into v.
+func Bind(data json.RawMessage, v interface{}) error {
+	if len(data) == 0 {
+		return &Error{Code: CodeInvalidData, Message: "Request data is missing"}
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return &Error{Code: CodeInvalidData, Message: "Request data is invalid"}
+	}
+	return nil
+}
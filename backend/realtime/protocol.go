@@ -0,0 +1,159 @@
+// Package realtime defines the versioned protocol spoken on the /socket.io
+// and /paxcall/ws websockets.
+//
+// Clients select it by offering the Subprotocol in the handshake, which is
+// also where they authenticate, with a bearer token, the access_token cookie
+// or the access_token query parameter. Every frame is a JSON envelope with
+// the protocol version and a type. Requests carry an ID that the server
+// echoes in the response or error frame, events are pushed by the server
+// without one. The server pings every PingInterval and expects a pong.
+// schema.json describes all frames.
+package realtime
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// Version of the protocol, carried in every frame.
+const Version = 1
+
+// Subprotocol negotiated in the websocket handshake.
+const Subprotocol = "hyperpage.v1"
+
+const (
+	TypeWelcome  = "welcome"
+	TypeRequest  = "request"
+	TypeResponse = "response"
+	TypeError    = "error"
+	TypeEvent    = "event"
+	TypePing     = "ping"
+	TypePong     = "pong"
+)
+
+// Frame size limits, the client proposes one with the max_frame query
+// parameter of the handshake and the welcome frame carries the one in use.
+const (
+	DefaultMaxFrameSize = 64 << 10
+	MinMaxFrameSize     = 4 << 10
+	MaxMaxFrameSize     = 1 << 20
+)
+
+// PingInterval is how often the server pings. Connections that sent nothing
+// for PongTimeout, two pings missed, are closed.
+const (
+	PingInterval = 30 * time.Second
+	PongTimeout  = 2*PingInterval + 10*time.Second
+)
+
+// Frame is the envelope of every message.
+type Frame struct {
+	V     int             `json:"v"`
+	Type  string          `json:"type"`
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+	Error *Error          `json:"error,omitempty"`
+}
+
+// Welcome is the data of the first frame of a connection.
+type Welcome struct {
+	Session      string `json:"session"`
+	UserID       string `json:"userId,omitempty"`
+	MaxFrameSize int    `json:"maxFrameSize"`
+	PingInterval int    `json:"pingInterval"`
+}
+
+const (
+	CodeBadFrame           = "bad_frame"
+	CodeUnsupportedVersion = "unsupported_version"
+	CodeUnknownMethod      = "unknown_method"
+	CodeInvalidData        = "invalid_data"
+	CodeUnauthorized       = "unauthorized"
+	CodeNotConnected       = "not_connected"
+	CodeNotFound           = "not_found"
+	CodeConflict           = "conflict"
+	CodePaymentRequired    = "payment_required"
+	CodeInternal           = "internal"
+)
+
+// Error is the payload of error frames.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var (
+	ErrUnauthorized = &Error{Code: CodeUnauthorized, Message: "Log in to use this method"}
+	ErrNotConnected = &Error{Code: CodeNotConnected, Message: "The session is not connected"}
+)
+
+// NegotiateFrameSize returns the frame size limit for the one a client
+// proposed, the default when it proposed none or an invalid one.
+func NegotiateFrameSize(proposed string) int {
+	size, err := strconv.Atoi(proposed)
+	if err != nil || size <= 0 {
+		return DefaultMaxFrameSize
+	}
+	if size < MinMaxFrameSize {
+		return MinMaxFrameSize
+	}
+	if size > MaxMaxFrameSize {
+		return MaxMaxFrameSize
+	}
+	return size
+}
+
+// Encode marshals a frame of the given type, data is marshaled unless it is
+// already raw JSON.
+func Encode(frameType, id, name string, data interface{}) ([]byte, error) {
+	frame := Frame{V: Version, Type: frameType, ID: id, Name: name}
+	if data != nil {
+		raw, ok := data.(json.RawMessage)
+		if !ok {
+			var err error
+			if raw, err = json.Marshal(data); err != nil {
+				return nil, err
+			}
+		}
+		frame.Data = raw
+	}
+	return json.Marshal(frame)
+}
+
+// EncodeEvent marshals an event frame.
+func EncodeEvent(name string, data interface{}) ([]byte, error) {
+	return Encode(TypeEvent, "", name, data)
+}
+
+// EncodeError marshals the error frame of a request.
+func EncodeError(id string, e *Error) []byte {
+	data, _ := json.Marshal(Frame{V: Version, Type: TypeError, ID: id, Error: e})
+	return data
+}
+
+// Decode parses a frame and checks its version and type.
+func Decode(data []byte) (*Frame, *Error) {
+	var frame Frame
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return nil, &Error{Code: CodeBadFrame, Message: "Frame is not a JSON envelope"}
+	}
+	if frame.V != Version {
+		return &frame, &Error{Code: CodeUnsupportedVersion, Message: "Protocol version " + strconv.Itoa(Version) + " is required"}
+	}
+	switch frame.Type {
+	case TypeWelcome, TypeResponse, TypeError, TypeEvent, TypePing, TypePong:
+	case TypeRequest:
+		if frame.ID == "" || frame.Name == "" {
+			return &frame, &Error{Code: CodeBadFrame, Message: "Requests need an id and a name"}
+		}
+	default:
+		return &frame, &Error{Code: CodeBadFrame, Message: "Unknown frame type"}
+	}
+	return &frame, nil
+}
@@ -0,0 +1,89 @@
+package realtime
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// Context is the request a handler serves.
+type Context struct {
+	// Session sending the request, UserID is empty for anonymous ones.
+	Session string
+	UserID  string
+	Frame   *Frame
+}
+
+// Bind decodes the data of the request into v.
+func (c *Context) Bind(v interface{}) error {
+	return Bind(c.Frame.Data, v)
+}
+
+// HandlerFunc serves a request, its result is the data of the response.
+// Errors that are not an *Error are reported as internal.
+type HandlerFunc func(c *Context) (interface{}, error)
+
+// Router dispatches the frames of a connection by request name.
+type Router struct {
+	handlers map[string]HandlerFunc
+	// OnPong is called with the session of every pong.
+	OnPong func(session string)
+}
+
+// NewRouter creates a router without methods.
+func NewRouter() *Router {
+	return &Router{handlers: make(map[string]HandlerFunc)}
+}
+
+// Handle registers the handler of a method.
+func (r *Router) Handle(method string, handler HandlerFunc) {
+	r.handlers[method] = handler
+}
+
+// Serve handles a frame received from a session and returns the frame to
+// send back, nil when there is none.
+func (r *Router) Serve(session, userID string, data []byte) []byte {
+	frame, ferr := Decode(data)
+	if ferr != nil {
+		id := ""
+		if frame != nil {
+			id = frame.ID
+		}
+		return EncodeError(id, ferr)
+	}
+
+	switch frame.Type {
+	case TypePing:
+		reply, _ := Encode(TypePong, frame.ID, "", nil)
+		return reply
+	case TypePong:
+		if r.OnPong != nil {
+			r.OnPong(session)
+		}
+		return nil
+	case TypeRequest:
+	default:
+		return EncodeError(frame.ID, &Error{Code: CodeBadFrame, Message: "Clients may only send requests, pings and pongs"})
+	}
+
+	handler, ok := r.handlers[frame.Name]
+	if !ok {
+		return EncodeError(frame.ID, &Error{Code: CodeUnknownMethod, Message: "Unknown method " + frame.Name})
+	}
+
+	result, err := handler(&Context{Session: session, UserID: userID, Frame: frame})
+	if err != nil {
+		if e, ok := err.(*Error); ok {
+			return EncodeError(frame.ID, e)
+		}
+		log.Println("Realtime method", frame.Name, "failed:", err)
+		return EncodeError(frame.ID, &Error{Code: CodeInternal, Message: "Request failed"})
+	}
+	if result == nil {
+		result = json.RawMessage("{}")
+	}
+	reply, err := Encode(TypeResponse, frame.ID, "", result)
+	if err != nil {
+		return EncodeError(frame.ID, &Error{Code: CodeInternal, Message: "Could not encode the response"})
+	}
+	return reply
+}
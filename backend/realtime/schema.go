@@ -0,0 +1,8 @@
+package realtime
+
+import _ "embed"
+
+// Schema is the JSON Schema of the frames.
+//
+//go:embed schema.json
+var Schema []byte
@@ -1,14 +1,11 @@
 package api
 
 import (
-	"context"
 	"fmt"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/redis/go-redis/v9"
 
 	"hyperpage/controllers"
-	"hyperpage/initializers"
 	"hyperpage/middleware"
 )
 
@@ -16,9 +13,9 @@ func Register(micro *fiber.App) {
 	micro.Route("/settings", func(router fiber.Router) {
 		router.Get("/base", controllers.GetBaseSystemData)
 		router.Get("/langs", controllers.Langs)
-		router.Post("/addlang", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.AddLang)
-		router.Delete("/deletelang/:id", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.DeleteLang)
-		router.Patch("/updatelang/:id", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.UpdateLang)
+		router.Post("/addlang", middleware.Audit("lang.create", ""), middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.AddLang)
+		router.Delete("/deletelang/:id", middleware.Audit("lang.delete", "lang"), middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.DeleteLang)
+		router.Patch("/updatelang/:id", middleware.Audit("lang.update", "lang"), middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.UpdateLang)
 	})
 
 	micro.Route("/presavedfilter", func(router fiber.Router) {
@@ -44,13 +41,13 @@ func Register(micro *fiber.App) {
 	})
 
 	micro.Route("/auth", func(router fiber.Router) {
-		router.Post("/register", controllers.SignUpUser)
-		router.Post("/login", controllers.SignInUser)
-		router.Post("/forgotpassword", controllers.ForgotPassword)
-		router.Patch("/resetpassword/:resetToken", controllers.ResetPassword)
+		router.Post("/register", middleware.Audit("auth.register", ""), controllers.SignUpUser)
+		router.Post("/login", middleware.Audit("auth.login", ""), controllers.SignInUser)
+		router.Post("/forgotpassword", middleware.Audit("auth.password_forgot", ""), controllers.ForgotPassword)
+		router.Patch("/resetpassword/:resetToken", middleware.Audit("auth.password_reset", ""), controllers.ResetPassword)
 		router.Get("/verifyemail/:verificationCode", controllers.VerifyEmail)
-		router.Get("/logout", middleware.DeserializeUser, controllers.LogoutUser)
-		router.Get("/refresh/:refreshToken", controllers.RefreshAccessToken)
+		router.Get("/logout", middleware.Audit("auth.logout", ""), middleware.DeserializeUser, controllers.LogoutUser)
+		router.Get("/refresh/:refreshToken", middleware.Audit("auth.token_refresh", ""), controllers.RefreshAccessToken)
 		router.Post("/checkTokenExp", controllers.CheckTokenExp)
 		router.Get("/check", middleware.DeserializeUser, controllers.GetUserDetails)
 	})
@@ -68,19 +65,56 @@ func Register(micro *fiber.App) {
 	micro.Route("/site", func(router fiber.Router) {
 		router.Post("/update", middleware.DeserializeUser, controllers.UpdateSite)
 		router.Get("/get", middleware.DeserializeUser, controllers.GetSite)
+		router.Get("/public", controllers.GetPublicSite)
+		router.Get("/domains", middleware.DeserializeUser, controllers.GetCustomDomains)
+		router.Post("/domains", middleware.DeserializeUser, controllers.AddCustomDomain)
+		router.Post("/domains/:id/verify", middleware.DeserializeUser, controllers.VerifyCustomDomain)
+		router.Post("/domains/:id/certificate", middleware.DeserializeUser, controllers.RetryDomainCertificate)
+		router.Delete("/domains/:id", middleware.DeserializeUser, controllers.DeleteCustomDomain)
+	})
+
+	micro.Route("/privacy", func(router fiber.Router) {
+		router.Get("/exports", middleware.DeserializeUser, controllers.GetDataExports)
+		router.Post("/exports", middleware.DeserializeUser, controllers.RequestDataExport)
+		router.Get("/deletion", middleware.DeserializeUser, controllers.GetAccountDeletion)
+		router.Post("/deletion", middleware.Audit("auth.deletion_schedule", ""), middleware.DeserializeUser, controllers.ScheduleAccountDeletion)
+		router.Delete("/deletion", middleware.Audit("auth.deletion_cancel", ""), middleware.DeserializeUser, controllers.CancelAccountDeletion)
+		router.Get("/receipts/:id", controllers.GetDeletionReceipt)
+	})
+
+	micro.Route("/presence", func(router fiber.Router) {
+		router.Get("/me/stats", middleware.DeserializeUser, controllers.GetMyPresenceStats)
+		router.Get("/:id", controllers.GetPresence)
+		router.Get("/:id/stats", middleware.DeserializeUser, controllers.GetPresenceStats)
+	})
+
+	micro.Route("/realtime", func(router fiber.Router) {
+		router.Get("/schema.json", controllers.GetRealtimeSchema)
+	})
+
+	micro.Route("/kpi", func(router fiber.Router) {
+		router.Get("/platform", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.GetPlatformStats)
+		router.Get("/listings", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.GetListingStats)
+	})
+
+	micro.Route("/audit", func(router fiber.Router) {
+		router.Get("/events", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.GetAuditEvents)
+		router.Get("/export", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.ExportAuditEvents)
+		router.Get("/verify", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.VerifyAuditLog)
+		router.Get("/me", middleware.DeserializeUser, controllers.GetSecurityActivity)
 	})
 
 	micro.Route("/users", func(router fiber.Router) {
 		router.Get("/myTime", controllers.MyTime)
-		router.Post("/deletme", middleware.DeserializeUser, controllers.DeleteUserWithRelations)
-		router.Post("/setvip", middleware.DeserializeUser, controllers.SetVipUser)
+		router.Post("/deletme", middleware.Audit("auth.deletion_schedule", ""), middleware.DeserializeUser, controllers.DeleteUserWithRelations)
+		router.Post("/setvip", middleware.Audit("billing.set_vip", ""), middleware.DeserializeUser, controllers.SetVipUser)
 		router.Patch("/changeName", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.ChangeNickName)
 		router.Patch("/setTokenDeivce", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.SetTokenIOSdevice)
 		router.Get("/notifications", middleware.DeserializeUser, controllers.GetNotifications)
 		router.Patch("/notifications/:id/read", middleware.DeserializeUser, controllers.MarkNotificationAsRead)
 		router.Delete("/notifications/:id", middleware.DeserializeUser, controllers.DeleteNotification)
 
-		router.Post("/sendrequestcall", controllers.SendBotCallRequest)
+		router.Post("/sendrequestcall", controllers.CreateLead)
 		// router.Get("/me", middleware.DeserializeUser, controllers.GetMe)
 		router.Get("/me", func(c *fiber.Ctx) error {
 			// Capture the language from the URL, headers, or any other source.
@@ -95,8 +129,8 @@ func Register(micro *fiber.App) {
 			return middleware.DeserializeUser(c)
 		}, controllers.GetMe)
 		router.Get("/getmefirst", middleware.DeserializeUser, controllers.GetMeFirst)
-		router.Post("/addbalance", middleware.DeserializeUser, controllers.AddBalance)
-		router.Post("/plan", middleware.DeserializeUser, controllers.Plan)
+		router.Post("/addbalance", middleware.Audit("billing.add_balance", ""), middleware.DeserializeUser, controllers.AddBalance)
+		router.Post("/plan", middleware.Audit("billing.plan", ""), middleware.DeserializeUser, controllers.Plan)
 	})
 
 	micro.Route("/billing", func(router fiber.Router) {
@@ -104,40 +138,84 @@ func Register(micro *fiber.App) {
 	})
 
 	micro.Route("/calls", func(router fiber.Router) {
-		router.Post("/makecall", controllers.MakeCall)
-		router.Post("/stopcall", controllers.StopCall)
+		router.Get("/", middleware.DeserializeUser, controllers.GetCalls)
+		router.Get("/:id", middleware.DeserializeUser, controllers.GetCall)
+		router.Post("/:id/reject", middleware.DeserializeUser, controllers.RejectCall)
+		router.Post("/:id/end", middleware.DeserializeUser, controllers.EndCall)
+		router.Post("/:id/conference", middleware.DeserializeUser, controllers.EscalateCall)
+	})
+
+	micro.Route("/consultations", func(router fiber.Router) {
+		router.Get("/", middleware.DeserializeUser, controllers.GetConsultations)
+		router.Get("/rate/:userId", controllers.GetConsultationRate)
+		router.Put("/rate", middleware.DeserializeUser, controllers.SetConsultationRate)
+		router.Post("/simulate", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.SimulateConsultation)
+	})
+
+	micro.Route("/appointments", func(router fiber.Router) {
+		router.Get("/", middleware.DeserializeUser, controllers.GetAppointments)
+		router.Post("/", middleware.DeserializeUser, controllers.BookAppointment)
+		router.Get("/feed/:token", controllers.GetAppointmentFeed)
+		router.Get("/sellers/:userId/slots", controllers.GetAppointmentSlots)
+		router.Get("/schedule", middleware.DeserializeUser, controllers.GetAppointmentSchedule)
+		router.Put("/schedule", middleware.DeserializeUser, controllers.SaveAppointmentSchedule)
+		router.Post("/schedule/exceptions", middleware.DeserializeUser, controllers.AddAppointmentException)
+		router.Delete("/schedule/exceptions/:id", middleware.DeserializeUser, controllers.DeleteAppointmentException)
+		router.Post("/schedule/feed", middleware.DeserializeUser, controllers.RotateAppointmentFeed)
+		router.Get("/:id", middleware.DeserializeUser, controllers.GetAppointment)
+		router.Get("/:id/ics", middleware.DeserializeUser, controllers.GetAppointmentICS)
+		router.Post("/:id/reschedule", middleware.DeserializeUser, controllers.RescheduleAppointment)
+		router.Post("/:id/cancel", middleware.DeserializeUser, controllers.CancelAppointment)
+		router.Post("/:id/join", middleware.DeserializeUser, controllers.JoinAppointment)
+	})
+
+	micro.Route("/leads", func(router fiber.Router) {
+		router.Get("/challenge", controllers.GetLeadChallenge)
+		router.Post("/", controllers.CreateLead)
+		router.Get("/", middleware.DeserializeUser, controllers.GetLeads)
+		router.Get("/stats", middleware.DeserializeUser, controllers.GetLeadStats)
+		router.Get("/settings", middleware.DeserializeUser, controllers.GetLeadSettings)
+		router.Put("/settings", middleware.DeserializeUser, controllers.SaveLeadSettings)
+		router.Get("/:id", middleware.DeserializeUser, controllers.GetLead)
+		router.Patch("/:id", middleware.DeserializeUser, controllers.UpdateLead)
+		router.Post("/:id/notes", middleware.DeserializeUser, controllers.AddLeadNote)
+	})
+
+	micro.Route("/ice", func(router fiber.Router) {
+		router.Get("/servers", middleware.DeserializeUser, controllers.GetICEServers)
+		router.Get("/service", middleware.CheckServiceKey, controllers.GetServiceICEServers)
 	})
 
 	micro.Route("/cities", func(router fiber.Router) {
 		router.Get("/all", controllers.GetCities)
 		router.Get("/query", controllers.GetName)
-		router.Post("/create", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.CreateCity)
-		router.Delete("/remove/:id", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.DeleteCity)
-		router.Patch("/update/:id", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.UpdateCity)
+		router.Post("/create", middleware.Audit("city.create", ""), middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.CreateCity)
+		router.Delete("/remove/:id", middleware.Audit("city.delete", "city"), middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.DeleteCity)
+		router.Patch("/update/:id", middleware.Audit("city.update", "city"), middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.UpdateCity)
 		router.Get("/get", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.GetCityTranslation)
 	})
 
 	micro.Route("/citiestranslator", func(router fiber.Router) {
-		router.Post("/create", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.CreateCityTranslation)
-		router.Delete("/remove", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.DeleteCityTranslation)
-		router.Patch("/update", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.UpdateCityTranslation)
+		router.Post("/create", middleware.Audit("city_translation.create", ""), middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.CreateCityTranslation)
+		router.Delete("/remove", middleware.Audit("city_translation.delete", ""), middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.DeleteCityTranslation)
+		router.Patch("/update", middleware.Audit("city_translation.update", ""), middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.UpdateCityTranslation)
 	})
 
 	micro.Route("/guilds", func(router fiber.Router) {
 		router.Get("/all", controllers.GetGuilds)
 		router.Get("/getAll", controllers.GetGuildsAll)
-		router.Post("/create", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.CreateGuild)
-		router.Delete("/remove/:id", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.DeleteGuild)
-		router.Patch("/update/:id", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.UpdateGuild)
+		router.Post("/create", middleware.Audit("guild.create", ""), middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.CreateGuild)
+		router.Delete("/remove/:id", middleware.Audit("guild.delete", "guild"), middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.DeleteGuild)
+		router.Patch("/update/:id", middleware.Audit("guild.update", "guild"), middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.UpdateGuild)
 
 		router.Get("/name", controllers.GetGuildName)
 		router.Get("/namecustom", controllers.GetGuildNameA)
 	})
 
 	micro.Route("/guildstranslator", func(router fiber.Router) {
-		router.Post("/create", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.CreateGuildTranslation)
-		router.Delete("/remove", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.DeleteGuildTranslation)
-		router.Patch("/update", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.UpdateGuildTranslation)
+		router.Post("/create", middleware.Audit("guild_translation.create", ""), middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.CreateGuildTranslation)
+		router.Delete("/remove", middleware.Audit("guild_translation.delete", ""), middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.DeleteGuildTranslation)
+		router.Patch("/update", middleware.Audit("guild_translation.update", ""), middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.UpdateGuildTranslation)
 	})
 
 	micro.Route("/profile", func(router fiber.Router) {
@@ -202,6 +280,77 @@ func Register(micro *fiber.App) {
 		router.Get("/edit/:id", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.EditBlogGetId)
 		router.Patch("/patch/:id", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.UpdateBlog)
 		router.Delete("/delete/:id", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.DeleteBlog)
+		router.Post("/publish/:id", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.PublishDraftBlog)
+		router.Get("/revisions/:id", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.GetBlogRevisions)
+		router.Get("/revisions/:id/diff/:revisionId", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.DiffBlogRevision)
+		router.Post("/revisions/:id/rollback/:revisionId", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.RollbackBlogRevision)
+	})
+
+	micro.Route("/analytics", func(router fiber.Router) {
+		router.Get("/blogs", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.GetAuthorAnalytics)
+		router.Get("/blog/:id", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.GetBlogAnalytics)
+	})
+
+	micro.Route("/promotion", func(router fiber.Router) {
+		router.Get("/products", controllers.GetPromotionProducts)
+		router.Post("/products", middleware.Audit("promotion_product.create", ""), middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.CreatePromotionProduct)
+		router.Patch("/products/:id", middleware.Audit("promotion_product.update", "promotion_product"), middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.UpdatePromotionProduct)
+		router.Post("/blog/:id", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.PurchasePromotion)
+		router.Get("/blog/:id/report", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.GetPromotionReport)
+		router.Get("/list", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.GetMyPromotions)
+	})
+
+	micro.Route("/ads", func(router fiber.Router) {
+		router.Post("/click/:impressionId", controllers.RecordAdClick)
+		router.Get("/campaigns", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.GetAdCampaigns)
+		router.Post("/campaigns", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.CreateAdCampaign)
+		router.Get("/campaigns/:id", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.GetAdCampaign)
+		router.Post("/campaigns/:id/pause", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.PauseAdCampaign)
+		router.Post("/campaigns/:id/resume", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.ResumeAdCampaign)
+		router.Post("/campaigns/:id/end", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.EndAdCampaign)
+	})
+
+	micro.Route("/seo", func(router fiber.Router) {
+		router.Get("/sitemap.xml", controllers.GetSitemapIndex)
+		router.Get("/sitemap/:kind/:shard", controllers.GetSitemapShard)
+		router.Get("/feed/:scope/:id", controllers.GetFeed)
+		router.Get("/jsonld/blog/:id", controllers.GetBlogJSONLD)
+		router.Get("/jsonld/profile/:name", controllers.GetProfileJSONLD)
+	})
+
+	micro.Route("/syndication", func(router fiber.Router) {
+		router.Get("/channels", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.GetSyndicationChannels)
+		router.Post("/channels", middleware.Audit("syndication_channel.create", ""), middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.CreateSyndicationChannel)
+		router.Patch("/channels/:id", middleware.Audit("syndication_channel.update", "syndication_channel"), middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.UpdateSyndicationChannel)
+		router.Delete("/channels/:id", middleware.Audit("syndication_channel.delete", "syndication_channel"), middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.DeleteSyndicationChannel)
+		router.Get("/templates", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.GetSyndicationTemplates)
+		router.Put("/templates/:language", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.SaveSyndicationTemplate)
+		router.Get("/blog/:id", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.GetBlogSyndications)
+		router.Post("/blog/:id/retry", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.RetryBlogSyndication)
+	})
+
+	micro.Route("/comments", func(router fiber.Router) {
+		router.Get("/blog/:id", controllers.GetComments)
+		router.Post("/blog/:id", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.CreateComment)
+		router.Patch("/blog/:id/lock", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.LockComments)
+		router.Get("/:commentId/replies", controllers.GetCommentReplies)
+		router.Patch("/:commentId", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.EditComment)
+		router.Delete("/:commentId", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.DeleteComment)
+	})
+
+	micro.Route("/moderation", func(router fiber.Router) {
+		router.Get("/reasons", controllers.GetReportReasons)
+		router.Post("/report", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.CreateReport)
+		router.Get("/queue", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.GetModerationQueue)
+		router.Post("/blog/:id/approve", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.ApproveBlog)
+		router.Post("/blog/:id/reject", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.RejectBlog)
+		router.Post("/user/:id/ban", middleware.Audit("user.ban", "user"), middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.BanUser)
+		router.Post("/user/:id/unban", middleware.Audit("user.unban", "user"), middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.UnbanUser)
+		router.Post("/report/:id/dismiss", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.DismissReport)
+		router.Get("/log", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.GetModerationLog)
+		router.Get("/rules", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.GetModerationRules)
+		router.Post("/rules", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.CreateModerationRule)
+		router.Delete("/rules/:id", middleware.DeserializeUser, middleware.CheckRole([]string{"admin"}), controllers.DeleteModerationRule)
 	})
 
 	micro.Route("/chat", func(router fiber.Router) {
@@ -220,6 +369,10 @@ func Register(micro *fiber.App) {
 		// Marks a message as read by the recipient
 		router.Patch("/read/:roomId", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.MarkMessageAsReadForDM)
 		router.Patch("/unread/:roomId/:status", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.MarkMessageAsUnReadForDM)
+
+		router.Post("/conference/webhook", controllers.ConferenceWebhook)
+		router.Post("/conference/token/:id", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.GetConferenceToken)
+		router.Post("/conference/:roomId", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.StartConference)
 	})
 
 	micro.Route("/contrifugoToken", func(router fiber.Router) {
@@ -231,31 +384,21 @@ func Register(micro *fiber.App) {
 		router.Post("/upload/file", middleware.DeserializeUser, middleware.CheckProfileFilled(), controllers.UploadPdf)
 		router.Post("/upload", middleware.DeserializeUser, middleware.CheckProfileFilled(), controllers.UploadImage)
 		router.Post("/upload/images", middleware.DeserializeUser, middleware.CheckProfileFilled(), controllers.UploadImages)
+		router.Get("/documents/:id", middleware.DeserializeUser, middleware.CheckRole([]string{"admin", "user", "vip"}), controllers.GetDocumentURLs)
+		router.Get("/signed/*", controllers.ServeSignedFile)
 	})
 
 	micro.Route("/server", func(router fiber.Router) {
-		ctx := context.TODO()
-		value, err := initializers.RedisClient.Get(ctx, "statusHealth").Result()
-
-		router.Get("/healthchecker", func(c *fiber.Ctx) error {
-			return c.Status(fiber.StatusOK).JSON(fiber.Map{
-				"status":  "success",
-				"message": value,
-			})
-		})
-
-		if err == redis.Nil {
-			fmt.Println("key: statusHealth does not exist")
-		} else if err != nil {
-			panic(err)
-		}
+		router.Get("/live", controllers.GetLiveness)
+		router.Get("/ready", controllers.GetReadiness)
+		router.Get("/healthchecker", controllers.GetHealthChecker)
 	})
 
 	micro.Route("/managebot", func(router fiber.Router) {
-		router.Post("/registerbot", controllers.SignUpBot)
-		router.Post("/deletebots", controllers.DeleteAllBotUsersWithRelations)
-		router.Patch("/updateprofile", controllers.UpdateBotProfile)
-		router.Patch("/updateadditionalinfo", controllers.UpdateBotProfileAdditional)
+		router.Post("/registerbot", middleware.Audit("bot.register", ""), controllers.SignUpBot)
+		router.Post("/deletebots", middleware.Audit("bot.delete_all", ""), controllers.DeleteAllBotUsersWithRelations)
+		router.Patch("/updateprofile", middleware.Audit("bot.update_profile", ""), controllers.UpdateBotProfile)
+		router.Patch("/updateadditionalinfo", middleware.Audit("bot.update_additional", ""), controllers.UpdateBotProfileAdditional)
 	})
 
 	micro.All("*", func(c *fiber.Ctx) error {
@@ -0,0 +1,90 @@
+package paxcall
+
+import (
+	"encoding/json"
+
+	"hyperpage/realtime"
+	"hyperpage/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// The relays of the call signaling, used by both protocols. Each message
+// carries the realtime event and the legacy command, so sessions of either
+// protocol can call each other.
+
+func offerCall(from, to, sdp string) error {
+	legacy, _ := json.Marshal(fiber.Map{
+		"command":  "coming_call",
+		"sessionA": from,
+		"sessionB": to,
+		"sdpOffer": sdp,
+		"message":  "Coming call from sessionA",
+	})
+	return hub.Send(to, utils.Message{
+		Event:  realtime.EventCallIncoming,
+		Data:   realtime.OfferEvent{Session: from, SDP: sdp},
+		Legacy: legacy,
+	})
+}
+
+func answerCall(from string, answer realtime.AnswerRequest) error {
+	legacy, _ := json.Marshal(fiber.Map{
+		"command":       "sdp_answer",
+		"sessionA":      answer.Session,
+		"sdpAnswer":     answer.SDP,
+		"iceCandidates": answer.IceCandidates,
+		"message-type":  "text",
+	})
+	return hub.Send(answer.Session, utils.Message{
+		Event:  realtime.EventCallAnswered,
+		Data:   realtime.AnswerEvent{Session: from, SDP: answer.SDP, IceCandidates: answer.IceCandidates},
+		Legacy: legacy,
+	})
+}
+
+func finishCall(from, to string) error {
+	legacy, _ := json.Marshal(fiber.Map{
+		"command":  "finish",
+		"sessionA": from,
+		"sessionB": to,
+		"message":  "call ended",
+	})
+	return hub.Send(to, utils.Message{
+		Event:  realtime.EventCallFinished,
+		Data:   realtime.SessionEvent{Session: from},
+		Legacy: legacy,
+	})
+}
+
+func startVideo(from, to, sdp string) error {
+	legacy, _ := json.Marshal(fiber.Map{
+		"command":  "start_video",
+		"sdpOffer": sdp,
+	})
+	return hub.Send(to, utils.Message{
+		Event:  realtime.EventVideoStarted,
+		Data:   realtime.OfferEvent{Session: from, SDP: sdp},
+		Legacy: legacy,
+	})
+}
+
+func stopVideo(from, to string) error {
+	legacy, _ := json.Marshal(fiber.Map{
+		"command": "stoped_video",
+	})
+	return hub.Send(to, utils.Message{
+		Event:  realtime.EventVideoStopped,
+		Data:   realtime.SessionEvent{Session: from},
+		Legacy: legacy,
+	})
+}
+
+func sendIceCandidate(from, to string, candidate realtime.IceCandidate) error {
+	legacy, _ := json.Marshal(candidate)
+	return hub.Send(to, utils.Message{
+		Event:  realtime.EventIceCandidate,
+		Data:   realtime.IceCandidateEvent{Session: from, Candidate: candidate},
+		Legacy: legacy,
+	})
+}
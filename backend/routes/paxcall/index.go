@@ -2,15 +2,14 @@ package paxcall
 
 import (
 	"fmt"
-	"log"
-	"strings"
-	"sync"
+	"time"
 
 	"encoding/base64"
-	"encoding/json"
-	"time"
 
-	"github.com/pion/webrtc/v3"
+	"hyperpage/middleware"
+	"hyperpage/realtime"
+	"hyperpage/utils"
+
 	uuid "github.com/satori/go.uuid"
 
 	"github.com/gofiber/contrib/websocket"
@@ -18,23 +17,15 @@ import (
 	"github.com/gofiber/fiber/v2/middleware/cors"
 )
 
-var Clients = make(map[string]*websocket.Conn)
-var ClientsLock sync.RWMutex
-
-type Peer struct {
-	Conn           *websocket.Conn
-	PeerConnection *webrtc.PeerConnection
-}
-
-var peers = make(map[string]*Peer)
-var peersLock sync.RWMutex
+// Calls are signaled through their own gateway hub, the two sessions of a
+// call may be connected to different nodes
+var hub = utils.NewHub("paxcall")
 
 func Register(app *fiber.App) {
 
 	app.Get("/", func(c *fiber.Ctx) error {
 		//Set session in cookie
-		id := uuid.NewV4()
-		idSession := base64.URLEncoding.EncodeToString(id[:])
+		idSession := newSession()
 
 		c.Cookie(&fiber.Cookie{
 			Name:     "paxcall_session",
@@ -46,338 +37,159 @@ func Register(app *fiber.App) {
 
 		})
 
+		// TURN credentials for the calls of the page when a user is logged
+		// in, STUN only for anonymous visitors or when the servers are not
+		// configured
+		iceServers := []utils.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}}
+		if userID := middleware.TokenUserID(c); userID != "" {
+			if ice, err := utils.GetCallICEConfig(uuid.FromStringOrNil(userID), uuid.Nil, c.Query("region", c.Get("X-Region"))); err == nil {
+				iceServers = ice.ICEServers
+			} else {
+				fmt.Println("error issuing ICE servers:", err)
+			}
+		}
+
 		return c.Render("index", fiber.Map{
 			"Title":       "Powerful paxintrade/paxcall server",
 			"Description": "server developed by paxintrade/paxcall",
+			"IceServers":  iceServers,
 		})
 	})
 
-	app.Use("/ws", func(c *fiber.Ctx) error {
-		// IsWebSocketUpgrade returns true if the client
-		// requested upgrade to the WebSocket protocol.
-		if websocket.IsWebSocketUpgrade(c) {
-			c.Locals("allowed", true)
-			return c.Next()
-		}
-		return fiber.ErrUpgradeRequired
-	})
-
-	// Set up WebSocket route
-	// app.Get("/ws", func(c *fiber.Ctx) error {
+	app.Use("/ws", middleware.RealtimeHandshake)
 
-	// 	return c.JSON(fiber.Map{
-	// 		"status": "success",
-	// 		"data":   "123123132",
-	// 	})
-	// })
+	// The session of the paxcall_session cookie identifies the caller,
+	// clients without one get a new session
 	app.Get("/ws", websocket.New(func(c *websocket.Conn) {
-		var session = c.Cookies("paxcall_session")
-		ClientsLock.Lock()
-		Clients[session] = c
-		ClientsLock.Unlock()
-
-		defer func() {
-			ClientsLock.Lock()
-			delete(Clients, session)
-			ClientsLock.Unlock()
-		}()
-
-		err := c.WriteMessage(websocket.TextMessage, []byte(session))
-		if err != nil {
-			fmt.Println("error writing message to client", session, ":", err)
-			return
-		}
-
-		// Add STUN server configuration
-		stunServer := webrtc.ICEServer{
-			URLs: []string{"stun:stun.l.google.com:19302"}, // Use a publicly available STUN server
-		}
-
-		// Create a new WebRTC peer connection with STUN server configuration
-		config := webrtc.Configuration{
-			ICEServers: []webrtc.ICEServer{stunServer},
+		session := c.Cookies("paxcall_session")
+		if session == "" {
+			session = newSession()
 		}
-
-		peerConnection, err := webrtc.NewPeerConnection(config)
-		if err != nil {
-			log.Fatal(err)
+		if c.Subprotocol() == realtime.Subprotocol {
+			serve(c, session)
 			return
 		}
+		serveLegacy(c, session)
+	}, websocket.Config{Subprotocols: []string{realtime.Subprotocol}}))
 
-		// Add the peerConnection to the Peer struct
-		peer := &Peer{
-			Conn:           c,
-			PeerConnection: peerConnection,
-		}
-
-		peersLock.Lock()
-		peers[session] = peer
-		peersLock.Unlock()
-
-		defer func() {
-			peersLock.Lock()
-			delete(peers, session)
-			peersLock.Unlock()
-		}()
-
-		// Handle incoming SDP messages
-		for {
-			messageType, msg, err := c.ReadMessage()
-			if err != nil {
-				break
-			}
-
-			strMessage := string(msg)
-
-			// Check and find session in the map for creating SDP
-			if strings.Contains(strMessage, "call") {
-
-				var callMessage map[string]string
-				if err := json.Unmarshal([]byte(strMessage), &callMessage); err != nil {
-					fmt.Println("Error decoding JSON:", err)
-					break
-				}
-
-				sessionA := callMessage["sessionA"]
-				sessionB := callMessage["sessionB"]
-				SDPOffer := callMessage["sdpOffer"]
-
-				ClientsLock.RLock()
-				_, foundA := Clients[sessionA]
-				clientB, foundB := Clients[sessionB]
-				ClientsLock.RUnlock()
-
-				if foundB && foundA {
-					// Send a message to sessionB
-					comingCallMessage := map[string]string{
-						"command":  "coming_call",
-						"sessionA": sessionA,
-						"sessionB": sessionB,
-						"sdpOffer": SDPOffer,
-						"message":  "Coming call from sessionA",
-					}
-
-					comingCallJSON, _ := json.Marshal(comingCallMessage)
-					clientB.WriteMessage(messageType, comingCallJSON)
-				} else {
-					fmt.Println("Session not found in map")
-				}
-			}
-
-			// if strings.Contains(strMessage, "video_answer") {
-
-			// 	var callMessage map[string]string
-			// 	if err := json.Unmarshal([]byte(strMessage), &callMessage); err != nil {
-			// 		fmt.Println("Error decoding JSON:", err)
-			// 		break
-			// 	}
-
-			// 	fmt.Println(callMessage)
-
-			// }
-
-			if strings.Contains(strMessage, "video_started") {
-
-				var callMessage map[string]string
-				if err := json.Unmarshal([]byte(strMessage), &callMessage); err != nil {
-					fmt.Println("Error decoding JSON:", err)
-					break
-				}
-
-				sessionB := callMessage["sessionB"]
-				clientB := Clients[sessionB]
-				SDPOffer := callMessage["sdpOffer"]
-
-				sdpAnswerJSON, _ := json.Marshal(map[string]interface{}{
-					"command":  "start_video",
-					"sdpOffer": SDPOffer,
-				})
-
-				clientB.WriteMessage(messageType, sdpAnswerJSON)
-
-			}
-
-			if strings.Contains(strMessage, "video_stoped") {
-				var callMessage map[string]string
-				if err := json.Unmarshal([]byte(strMessage), &callMessage); err != nil {
-					fmt.Println("Error decoding JSON:", err)
-					break
-				}
-
-				sdpAnswerJSON, _ := json.Marshal(map[string]interface{}{
-					"command": "stoped_video",
-				})
-
-				sessionB := callMessage["sessionB"]
-				clientB := Clients[sessionB]
-
-				clientB.WriteMessage(messageType, sdpAnswerJSON)
-
-			}
-			if strings.Contains(strMessage, "sdpAnswer") {
-
-				type IceCandidate struct {
-					Candidate        string `json:"candidate"`
-					SdpMid           string `json:"sdpMid"`
-					SdpMLineIndex    int    `json:"sdpMLineIndex"`
-					UsernameFragment string `json:"usernameFragment"`
-				}
-
-				type SdpAnswerMessage struct {
-					Command       string         `json:"command"`
-					SessionA      string         `json:"sessionA"`
-					SessionB      string         `json:"sessionB"`
-					SdpAnswer     string         `json:"sdpAnswer"`
-					IceCandidates []IceCandidate `json:"iceCandidates"`
-				}
-
-				var callMessage SdpAnswerMessage
-				if err := json.Unmarshal([]byte(strMessage), &callMessage); err != nil {
-					fmt.Println("Error decoding JSON:", err)
-					return
-				}
-
-				sessionA := callMessage.SessionA
-				sessionB := callMessage.SessionB
-
-				SDPOffer := callMessage.SdpAnswer
-				iceCandidates := callMessage.IceCandidates
-
-				ClientsLock.RLock()
-				clientA, foundA := Clients[sessionA]
-				clientB, foundB := Clients[sessionB]
-				ClientsLock.RUnlock()
-
-				if foundA {
-					// Отправить SDP Answer обоим клиентам
-					sdpAnswerJSON, _ := json.Marshal(map[string]interface{}{
-						"command":       "sdp_answer",
-						"sessionA":      sessionA,
-						"sdpAnswer":     SDPOffer,
-						"iceCandidates": iceCandidates,
-						"message-type":  "text",
-					})
-
-					clientA.WriteMessage(messageType, sdpAnswerJSON)
-				} else {
-					fmt.Println("Session not found in map")
-				}
-				if foundB {
-					// Отправить SDP Answer обоим клиентам
-					sdpAnswerJSON, _ := json.Marshal(map[string]interface{}{
-						"command":       "sdp_answer",
-						"sessionA":      sessionA,
-						"sdpAnswer":     SDPOffer,
-						"iceCandidates": iceCandidates,
-						"message-type":  "text",
-					})
-
-					clientB.WriteMessage(messageType, sdpAnswerJSON)
-				} else {
-					fmt.Println("Session not found in map")
-				}
-			}
+	app.Use(cors.New(cors.Config{
+		AllowOrigins:     "https://*.myru.online",
+		AllowHeaders:     "Origin, Content-Type, Accept, Authorization, Access-Control-Allow-Headers, Session, Mode",
+		AllowMethods:     "GET, POST, PATCH, DELETE",
+		AllowCredentials: true,
+	}))
+}
 
-			if strings.Contains(strMessage, "ice_candidate") {
-				type IceCandidateMessage struct {
-					Command      string `json:"command"`
-					SessionA     string `json:"sessionA"`
-					SessionB     string `json:"sessionB"`
-					IceCandidate struct {
-						Candidate     string `json:"candidate"`
-						SdpMid        string `json:"sdpMid"`
-						SdpMLineIndex int    `json:"sdpMLineIndex"`
-						UsernameFrag  string `json:"usernameFragment"`
-					} `json:"iceCandidate"`
-				}
-				var iceCandidateMsg IceCandidateMessage
-				err := json.Unmarshal([]byte(strMessage), &iceCandidateMsg)
-				if err != nil {
-					fmt.Println("Ошибка декодирования JSON:", err)
-					return
-				}
+func newSession() string {
+	id := uuid.NewV4()
+	return base64.URLEncoding.EncodeToString(id[:])
+}
 
-				if iceCandidateMsg.SessionB != "" {
+var router = newRouter()
 
-					sessionBID := iceCandidateMsg.SessionB
-					sessionB := Clients[sessionBID]
-					comingCallJSON, _ := json.Marshal(iceCandidateMsg.IceCandidate)
-					sessionB.WriteMessage(messageType, comingCallJSON)
+func newRouter() *realtime.Router {
+	router := realtime.NewRouter()
 
-				}
+	router.Handle(realtime.MethodCallOffer, func(c *realtime.Context) (interface{}, error) {
+		var request realtime.OfferRequest
+		if err := c.Bind(&request); err != nil {
+			return nil, err
+		}
+		return nil, offerCall(c.Session, request.Session, request.SDP)
+	})
 
-				if iceCandidateMsg.SessionA != "" {
+	router.Handle(realtime.MethodCallAnswer, func(c *realtime.Context) (interface{}, error) {
+		var request realtime.AnswerRequest
+		if err := c.Bind(&request); err != nil {
+			return nil, err
+		}
+		return nil, answerCall(c.Session, request)
+	})
 
-					// Отправить сообщение для SessionA
-					sessionAID := iceCandidateMsg.SessionA
-					sessionA := Clients[sessionAID]
-					comingCallJSON, _ := json.Marshal(iceCandidateMsg.IceCandidate)
-					sessionA.WriteMessage(messageType, comingCallJSON)
-				}
+	router.Handle(realtime.MethodCallFinish, func(c *realtime.Context) (interface{}, error) {
+		var request realtime.SessionRequest
+		if err := c.Bind(&request); err != nil {
+			return nil, err
+		}
+		return nil, finishCall(c.Session, request.Session)
+	})
 
-				// sessionBID := iceCandidateMsg.SessionB
-				// sessionB := Clients[sessionBID]
+	router.Handle(realtime.MethodVideoStart, func(c *realtime.Context) (interface{}, error) {
+		var request realtime.OfferRequest
+		if err := c.Bind(&request); err != nil {
+			return nil, err
+		}
+		return nil, startVideo(c.Session, request.Session, request.SDP)
+	})
 
-				// // iceCandidateMsg.Command = ""
-				// // iceCandidateMsg.SessionB = ""
+	router.Handle(realtime.MethodVideoStop, func(c *realtime.Context) (interface{}, error) {
+		var request realtime.SessionRequest
+		if err := c.Bind(&request); err != nil {
+			return nil, err
+		}
+		return nil, stopVideo(c.Session, request.Session)
+	})
 
-				// // fmt.Println(iceCandidateMsg)
-				// comingCallJSON, _ := json.Marshal(iceCandidateMsg.IceCandidate)
-				// sessionB.WriteMessage(messageType, comingCallJSON)
+	router.Handle(realtime.MethodIceCandidate, func(c *realtime.Context) (interface{}, error) {
+		var request realtime.IceCandidateRequest
+		if err := c.Bind(&request); err != nil {
+			return nil, err
+		}
+		return nil, sendIceCandidate(c.Session, request.Session, request.Candidate)
+	})
 
+	router.Handle(realtime.MethodIceServers, func(c *realtime.Context) (interface{}, error) {
+		var request realtime.IceServersRequest
+		if len(c.Frame.Data) > 0 {
+			if err := c.Bind(&request); err != nil {
+				return nil, err
 			}
+		}
+		// TURN would be an open relay for anonymous sessions
+		if c.UserID == "" {
+			return nil, realtime.ErrUnauthorized
+		}
+		return utils.GetCallICEConfig(uuid.FromStringOrNil(c.UserID), uuid.Nil, request.Region)
+	})
 
-			// End call
-			if strings.Contains(strMessage, "finish") {
-				var callMessage map[string]string
-				if err := json.Unmarshal([]byte(strMessage), &callMessage); err != nil {
-					fmt.Println("Error decoding JSON:", err)
-					break
-				}
-
-				sessionA := callMessage["sessionA"]
-				sessionB := callMessage["sessionB"]
+	return router
+}
 
-				ClientsLock.RLock()
-				clientA, foundA := Clients[sessionA]
-				clientB, foundB := Clients[sessionB]
-				ClientsLock.RUnlock()
+// serve runs a connection speaking the realtime protocol.
+func serve(c *websocket.Conn, session string) {
+	userID, _ := c.Locals("realtime_user").(string)
+	maxFrameSize, _ := c.Locals("realtime_max_frame").(int)
+	c.SetReadLimit(int64(maxFrameSize))
 
-				if foundA && foundB {
-					// Send a message to sessionA
-					outgoingCall := map[string]string{
-						"command":  "finish",
-						"sessionA": sessionA,
-						"sessionB": sessionB,
-						"message":  "call ended",
-					}
-					comingCallJSON, _ := json.Marshal(outgoingCall)
-					clientA.WriteMessage(messageType, comingCallJSON)
-				} else {
-					fmt.Println("Session not found in map")
-				}
+	hub.Register(session, c, realtime.Version)
+	defer hub.Unregister(session)
 
-				if foundB && foundA {
-					// Send a message to sessionB
-					comingCallMessage := map[string]string{
-						"command":  "finish",
-						"sessionA": sessionA,
-						"sessionB": sessionB,
-						"message":  "all ended",
-					}
-					comingCallJSON, _ := json.Marshal(comingCallMessage)
-					clientB.WriteMessage(messageType, comingCallJSON)
-				} else {
-					fmt.Println("Session not found in map")
-				}
+	welcome, _ := realtime.Encode(realtime.TypeWelcome, "", "", realtime.Welcome{
+		Session:      session,
+		UserID:       userID,
+		MaxFrameSize: maxFrameSize,
+		PingInterval: int(realtime.PingInterval / time.Second),
+	})
+	if err := hub.WriteLocal(session, websocket.TextMessage, welcome); err != nil {
+		fmt.Println("error writing message to client", session, ":", err)
+		return
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go hub.KeepAlive(session, done)
+
+	for {
+		c.SetReadDeadline(time.Now().Add(realtime.PongTimeout))
+		_, message, err := c.ReadMessage()
+		if err != nil {
+			break
+		}
+		if reply := router.Serve(session, userID, message); reply != nil {
+			if err := hub.WriteLocal(session, websocket.TextMessage, reply); err != nil {
+				fmt.Println("error writing message to client", session, ":", err)
+				break
 			}
 		}
-	}))
-
-	app.Use(cors.New(cors.Config{
-		AllowOrigins:     "https://*.myru.online",
-		AllowHeaders:     "Origin, Content-Type, Accept, Authorization, Access-Control-Allow-Headers, Session, Mode",
-		AllowMethods:     "GET, POST, PATCH, DELETE",
-		AllowCredentials: true,
-	}))
+	}
 }
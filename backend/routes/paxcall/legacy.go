@@ -0,0 +1,137 @@
+package paxcall
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+
+	"hyperpage/realtime"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+type Peer struct {
+	Conn           *websocket.Conn
+	PeerConnection *webrtc.PeerConnection
+}
+
+var peers = make(map[string]*Peer)
+var peersLock sync.RWMutex
+
+// legacyMessage is a message of the legacy protocol, its command selects the
+// fields in use.
+type legacyMessage struct {
+	Command       string                  `json:"command"`
+	SessionA      string                  `json:"sessionA"`
+	SessionB      string                  `json:"sessionB"`
+	SDPOffer      string                  `json:"sdpOffer"`
+	SDPAnswer     string                  `json:"sdpAnswer"`
+	IceCandidates []realtime.IceCandidate `json:"iceCandidates"`
+	IceCandidate  realtime.IceCandidate   `json:"iceCandidate"`
+}
+
+// serveLegacy runs a connection of a client that did not offer the realtime
+// subprotocol, the sessions of a call are sent with every message.
+//
+// Deprecated: served until the paxcall page moved to the realtime protocol.
+func serveLegacy(c *websocket.Conn, session string) {
+	hub.Register(session, c, 0)
+	defer hub.Unregister(session)
+
+	err := hub.WriteLocal(session, websocket.TextMessage, []byte(session))
+	if err != nil {
+		fmt.Println("error writing message to client", session, ":", err)
+		return
+	}
+
+	// Add STUN server configuration
+	stunServer := webrtc.ICEServer{
+		URLs: []string{"stun:stun.l.google.com:19302"}, // Use a publicly available STUN server
+	}
+
+	// Create a new WebRTC peer connection with STUN server configuration
+	config := webrtc.Configuration{
+		ICEServers: []webrtc.ICEServer{stunServer},
+	}
+
+	peerConnection, err := webrtc.NewPeerConnection(config)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	// Add the peerConnection to the Peer struct
+	peer := &Peer{
+		Conn:           c,
+		PeerConnection: peerConnection,
+	}
+
+	peersLock.Lock()
+	peers[session] = peer
+	peersLock.Unlock()
+
+	defer func() {
+		peersLock.Lock()
+		delete(peers, session)
+		peersLock.Unlock()
+	}()
+
+	// Handle incoming SDP messages
+	for {
+		_, msg, err := c.ReadMessage()
+		if err != nil {
+			break
+		}
+
+		var message legacyMessage
+		if err := json.Unmarshal(msg, &message); err != nil {
+			fmt.Println("Error decoding JSON:", err)
+			break
+		}
+
+		switch message.Command {
+		case "call":
+			if !hub.Connected(message.SessionA) {
+				fmt.Println("Session not found in map")
+				continue
+			}
+			err = offerCall(message.SessionA, message.SessionB, message.SDPOffer)
+
+		case "video_started":
+			err = startVideo(message.SessionA, message.SessionB, message.SDPOffer)
+
+		case "video_stoped":
+			err = stopVideo(message.SessionA, message.SessionB)
+
+		// Answers to video offers renegotiate the call like the first answer
+		case "sdpAnswer", "video_answer":
+			err = answerCall(session, realtime.AnswerRequest{
+				Session:       message.SessionA,
+				SDP:           message.SDPAnswer,
+				IceCandidates: message.IceCandidates,
+			})
+
+		case "ice_candidate":
+			if message.SessionB != "" {
+				err = sendIceCandidate(session, message.SessionB, message.IceCandidate)
+			}
+			if message.SessionA != "" {
+				err = sendIceCandidate(session, message.SessionA, message.IceCandidate)
+			}
+
+		// Both sides are told, the page cleans up the call on the finish
+		case "finish":
+			if err = finishCall(message.SessionA, message.SessionB); err == nil {
+				err = finishCall(message.SessionB, message.SessionA)
+			}
+
+		default:
+			continue
+		}
+		if err != nil {
+			fmt.Println("Session not found in map:", err)
+		}
+	}
+}
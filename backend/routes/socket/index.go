@@ -0,0 +1,267 @@
+package socket
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"time"
+
+	"hyperpage/controllers"
+	"hyperpage/initializers"
+	"hyperpage/middleware"
+	"hyperpage/models"
+	"hyperpage/realtime"
+	"hyperpage/utils"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Register serves the /socket.io websocket. Clients offering the realtime
+// subprotocol speak it, the others the legacy protocol.
+func Register(app *fiber.App) {
+	app.Use("/socket.io", middleware.RealtimeHandshake)
+
+	app.Get("/socket.io/", websocket.New(func(c *websocket.Conn) {
+		if c.Subprotocol() == realtime.Subprotocol {
+			serve(c)
+			return
+		}
+		serveLegacy(c)
+	}, websocket.Config{Subprotocols: []string{realtime.Subprotocol}}))
+}
+
+var router = newRouter()
+
+func newRouter() *realtime.Router {
+	router := realtime.NewRouter()
+	router.OnPong = func(session string) {
+		if err := utils.PresenceHeartbeat(session); err != nil {
+			fmt.Println("error refreshing presence:", err)
+		}
+	}
+
+	router.Handle(realtime.MethodSessionGet, func(c *realtime.Context) (interface{}, error) {
+		return realtime.SessionResult{Session: c.Session}, nil
+	})
+
+	router.Handle(realtime.MethodTyping, func(c *realtime.Context) (interface{}, error) {
+		if c.UserID == "" {
+			return nil, realtime.ErrUnauthorized
+		}
+		var request realtime.TypingRequest
+		if err := c.Bind(&request); err != nil {
+			return nil, err
+		}
+		if _, err := strconv.ParseUint(request.RoomID, 10, 64); err != nil {
+			return nil, &realtime.Error{Code: realtime.CodeInvalidData, Message: "roomId must be a positive number"}
+		}
+		return nil, controllers.SendUserTypingToCentrifugo(uuid.FromStringOrNil(c.UserID), request.RoomID)
+	})
+
+	router.Handle(realtime.MethodCallStart, func(c *realtime.Context) (interface{}, error) {
+		if c.UserID == "" {
+			return nil, realtime.ErrUnauthorized
+		}
+		var request realtime.CallStartRequest
+		if err := c.Bind(&request); err != nil {
+			return nil, err
+		}
+		calleeID, err := uuid.FromString(request.CalleeID)
+		if err != nil {
+			return nil, &realtime.Error{Code: realtime.CodeInvalidData, Message: "calleeId must be a user ID"}
+		}
+		call, err := utils.StartCall(uuid.FromStringOrNil(c.UserID), c.Session, calleeID, request.Video, request.SDP)
+		if err != nil {
+			return nil, callError(err)
+		}
+		return utils.CallView(call), nil
+	})
+
+	router.Handle(realtime.MethodCallAccept, func(c *realtime.Context) (interface{}, error) {
+		if c.UserID == "" {
+			return nil, realtime.ErrUnauthorized
+		}
+		var request realtime.CallAcceptRequest
+		if err := c.Bind(&request); err != nil {
+			return nil, err
+		}
+		call, offer, err := utils.AcceptCall(uuid.FromStringOrNil(c.UserID), c.Session, uuid.FromStringOrNil(request.CallID), request.SDP)
+		if err != nil {
+			return nil, callError(err)
+		}
+		result := utils.CallView(call)
+		result.SDP = offer
+		return result, nil
+	})
+
+	router.Handle(realtime.MethodCallReject, func(c *realtime.Context) (interface{}, error) {
+		if c.UserID == "" {
+			return nil, realtime.ErrUnauthorized
+		}
+		var request realtime.CallRequest
+		if err := c.Bind(&request); err != nil {
+			return nil, err
+		}
+		call, err := utils.RejectCall(uuid.FromStringOrNil(c.UserID), uuid.FromStringOrNil(request.CallID))
+		if err != nil {
+			return nil, callError(err)
+		}
+		return utils.CallView(call), nil
+	})
+
+	router.Handle(realtime.MethodCallEnd, func(c *realtime.Context) (interface{}, error) {
+		if c.UserID == "" {
+			return nil, realtime.ErrUnauthorized
+		}
+		var request realtime.CallRequest
+		if err := c.Bind(&request); err != nil {
+			return nil, err
+		}
+		call, err := utils.EndCall(uuid.FromStringOrNil(c.UserID), uuid.FromStringOrNil(request.CallID))
+		if err != nil {
+			return nil, callError(err)
+		}
+		return utils.CallView(call), nil
+	})
+
+	router.Handle(realtime.MethodCallSignal, func(c *realtime.Context) (interface{}, error) {
+		if c.UserID == "" {
+			return nil, realtime.ErrUnauthorized
+		}
+		var request realtime.CallSignalRequest
+		if err := c.Bind(&request); err != nil {
+			return nil, err
+		}
+		if request.SDP == "" && request.Candidate == nil {
+			return nil, &realtime.Error{Code: realtime.CodeInvalidData, Message: "sdp or candidate is required"}
+		}
+		err := utils.SignalCall(uuid.FromStringOrNil(c.UserID), c.Session, uuid.FromStringOrNil(request.CallID), request.SDP, request.Candidate)
+		return nil, callError(err)
+	})
+
+	router.Handle(realtime.MethodIceServers, func(c *realtime.Context) (interface{}, error) {
+		var request realtime.IceServersRequest
+		if len(c.Frame.Data) > 0 {
+			if err := c.Bind(&request); err != nil {
+				return nil, err
+			}
+		}
+		// TURN would be an open relay for anonymous sessions
+		if c.UserID == "" {
+			return nil, realtime.ErrUnauthorized
+		}
+		var callID uuid.UUID
+		if request.CallID != "" {
+			var err error
+			if callID, err = uuid.FromString(request.CallID); err != nil {
+				return nil, &realtime.Error{Code: realtime.CodeInvalidData, Message: "callId must be a call ID"}
+			}
+		}
+		config, err := utils.GetCallICEConfig(uuid.FromStringOrNil(c.UserID), callID, request.Region)
+		if err != nil {
+			return nil, callError(err)
+		}
+		return config, nil
+	})
+
+	return router
+}
+
+// serve runs a connection speaking the realtime protocol. The user, when
+// there is one, was authenticated in the handshake.
+func serve(c *websocket.Conn) {
+	session := newSession()
+	userID, _ := c.Locals("realtime_user").(string)
+	maxFrameSize, _ := c.Locals("realtime_max_frame").(int)
+	c.SetReadLimit(int64(maxFrameSize))
+
+	utils.SocketHub.Register(session, c, realtime.Version)
+	defer disconnect(c, session)
+
+	if userID != "" {
+		login(session, uuid.FromStringOrNil(userID), c.Headers(fiber.HeaderUserAgent))
+	}
+
+	welcome, _ := realtime.Encode(realtime.TypeWelcome, "", "", realtime.Welcome{
+		Session:      session,
+		UserID:       userID,
+		MaxFrameSize: maxFrameSize,
+		PingInterval: int(realtime.PingInterval / time.Second),
+	})
+	if err := utils.SocketHub.WriteLocal(session, websocket.TextMessage, welcome); err != nil {
+		fmt.Println("error writing message to client", session, ":", err)
+		return
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go utils.SocketHub.KeepAlive(session, done)
+
+	for {
+		c.SetReadDeadline(time.Now().Add(realtime.PongTimeout))
+		_, message, err := c.ReadMessage()
+		if err != nil {
+			break
+		}
+		if reply := router.Serve(session, userID, message); reply != nil {
+			if err := utils.SocketHub.WriteLocal(session, websocket.TextMessage, reply); err != nil {
+				fmt.Println("error writing message to client", session, ":", err)
+				break
+			}
+		}
+	}
+}
+
+func newSession() string {
+	id := uuid.NewV4()
+	return base64.URLEncoding.EncodeToString(id[:])
+}
+
+// login binds the session of a connection to its user.
+func login(session string, userID uuid.UUID, userAgent string) {
+	initializers.DB.Model(&models.User{}).Where("id = ?", userID).Update("session", session)
+	if err := utils.PresenceConnect(userID, session, userAgent); err != nil {
+		fmt.Println("error starting presence session:", err)
+	}
+	if err := utils.SocketHub.BindUser(session, userID); err != nil {
+		fmt.Println("error binding session to user:", err)
+	}
+}
+
+// disconnect ends the session of a connection, also when the user logged in
+// after connecting.
+func disconnect(c *websocket.Conn, session string) {
+	utils.SocketHub.Unregister(session)
+	utils.HangUpSession(session)
+	if err := utils.PresenceDisconnect(session); err != nil {
+		fmt.Println("error ending presence session:", err)
+	}
+	initializers.DB.Model(&models.User{}).Where("session = ?", session).Update("session", nil)
+
+	if err := c.Close(); err != nil {
+		fmt.Println("error closing WebSocket connection:", err)
+		return
+	}
+	fmt.Println("WebSocket client disconnected:", session)
+}
+
+// callError reports the errors of the call service with their realtime code.
+func callError(err error) error {
+	switch err {
+	case nil:
+		return nil
+	case utils.ErrCallNotFound:
+		return &realtime.Error{Code: realtime.CodeNotFound, Message: "Call not found"}
+	case utils.ErrCallState, utils.ErrCallerBusy, utils.ErrCallSession:
+		return &realtime.Error{Code: realtime.CodeConflict, Message: err.Error()}
+	case utils.ErrCallSelf:
+		return &realtime.Error{Code: realtime.CodeInvalidData, Message: err.Error()}
+	case utils.ErrInsufficientBalance:
+		return &realtime.Error{Code: realtime.CodePaymentRequired, Message: "Top up your balance to pay for this consultation"}
+	case utils.ErrSessionNotConnected:
+		return realtime.ErrNotConnected
+	}
+	return err
+}
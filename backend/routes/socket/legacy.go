@@ -0,0 +1,225 @@
+package socket
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"hyperpage/controllers"
+	"hyperpage/initializers"
+	"hyperpage/models"
+	"hyperpage/realtime"
+	"hyperpage/utils"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+	uuid "github.com/satori/go.uuid"
+)
+
+type legacyMessage struct {
+	MessageType string                   `json:"messageType"`
+	Data        []map[string]interface{} `json:"data"`
+}
+
+type legacySessionMessage struct {
+	SessionID string `json:"session"`
+}
+
+// serveLegacy runs a connection of a client that did not offer the realtime
+// subprotocol. Messages are {messageType, data} and the access token is sent
+// with each one that needs it.
+//
+// Deprecated: served until the web app and the bots moved to the realtime
+// protocol.
+func serveLegacy(c *websocket.Conn) {
+	// Timeout client 5min.
+	c.SetReadDeadline(time.Now().Add(5 * time.Hour))
+
+	session := newSession()
+
+	// Send the ID to the client
+	jsonData, err := json.Marshal(legacySessionMessage{SessionID: session})
+	if err != nil {
+		fmt.Println("Ошибка при преобразовании в JSON:", err)
+		return
+	}
+	if err := c.WriteMessage(websocket.TextMessage, jsonData); err != nil {
+		fmt.Println("error writing message to client", session, ":", err)
+		return
+	}
+
+	// Register the connection in the gateway, messages for this session
+	// from any node are routed here
+	utils.SocketHub.Register(session, c, 0)
+	defer disconnect(c, session)
+
+	//CHECK USER LOGIN OR NOT
+	if authToken := c.Cookies("access_token"); authToken != "" {
+		config, _ := initializers.LoadConfig(".")
+
+		tokenClaims, err := utils.ValidateToken(authToken, config.AccessTokenPublicKey)
+		if err != nil {
+			fmt.Println("TOKEN DIE")
+		}
+		if tokenClaims != nil {
+			var user models.User
+			initializers.DB.Select("id").Where("id = ?", tokenClaims.UserID).First(&user)
+			if user.ID != uuid.Nil {
+				login(session, user.ID, c.Headers(fiber.HeaderUserAgent))
+			} else {
+				fmt.Println("User is not logged in")
+			}
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := utils.SocketHub.WriteLocal(session, websocket.PingMessage, nil); err != nil {
+					fmt.Println("Ошибка при отправке ping сообщения:", err)
+					return
+				}
+			}
+		}
+	}()
+
+	c.SetPingHandler(func(appData string) error {
+		if err := c.WriteControl(websocket.PongMessage, nil, time.Now().Add(time.Second)); err != nil {
+			fmt.Println("Ошибка при отправке pong сообщения:", err)
+			return err
+		}
+		return nil
+	})
+
+	// Pongs to our pings are the heartbeat of the presence session
+	c.SetPongHandler(func(appData string) error {
+		if err := utils.PresenceHeartbeat(session); err != nil {
+			fmt.Println("error refreshing presence:", err)
+		}
+		return nil
+	})
+
+	// Wait for messages from the client
+	for {
+		_, message, err := c.ReadMessage()
+		if err != nil {
+			fmt.Println("error reading message from client", session, ":", err)
+			break
+		}
+
+		var Message legacyMessage
+		if err := json.Unmarshal(message, &Message); err != nil {
+			fmt.Println("error unmarshalling JSON:", err)
+			continue
+		}
+
+		switch Message.MessageType {
+		case "UserIsTyping":
+			legacyTyping(Message)
+
+		case "heartbeat":
+			if err := utils.PresenceHeartbeat(session); err != nil {
+				fmt.Println("error refreshing presence:", err)
+			}
+
+		case "getMySessionId":
+			jsonData, _ := json.Marshal(legacySessionMessage{SessionID: session})
+			if err := utils.SocketHub.WriteLocal(session, websocket.TextMessage, jsonData); err != nil {
+				fmt.Println("error writing message to client", session, ":", err)
+			}
+
+		case "reject":
+			for _, data := range Message.Data {
+				id, _ := data["id"].(string)
+				if err := rejectCall(session, id); err != nil {
+					fmt.Printf("Ошибка отправки запроса %s: %v\n", id, err)
+				}
+			}
+
+		case "sdpAnswer":
+			var data struct {
+				SessionID string `json:"sessionID"`
+				SdpAnswer string `json:"sdpAnswer"`
+			}
+			if err := json.Unmarshal(message, &data); err != nil || data.SessionID == "" || data.SdpAnswer == "" {
+				fmt.Println("Не удалось получить значение sessionID или sdpAnswer")
+				continue
+			}
+			if err := answerCall(session, realtime.AnswerRequest{Session: data.SessionID, SDP: data.SdpAnswer}); err != nil {
+				fmt.Printf("Ошибка отправки запроса %s: %v\n", data.SessionID, err)
+			}
+		}
+	}
+
+	// Show the number of clients connected to this node
+	fmt.Println("Currently connected clients on this node:", utils.SocketHub.LocalCount())
+}
+
+// legacyTyping validates the access token sent with the message and reports
+// the user typing in the room.
+func legacyTyping(message legacyMessage) {
+	if len(message.Data) == 0 {
+		return
+	}
+	authToken, ok := message.Data[0]["access_token"].(string)
+	if !ok {
+		log.Print("access token not provided")
+		return
+	}
+
+	config, _ := initializers.LoadConfig(".")
+	tokenClaims, err := utils.ValidateToken(authToken, config.AccessTokenPublicKey)
+	if err != nil {
+		log.Printf("Error validating token: %s", err)
+		return
+	}
+
+	var user models.User
+	if err := initializers.DB.Select("id").Where("id = ?", tokenClaims.UserID).First(&user).Error; err != nil {
+		log.Printf("Error getting User from DB :%s", err)
+		return
+	}
+
+	roomID, ok := message.Data[0]["roomID"].(string)
+	if !ok {
+		log.Printf("RoomID not found in message data")
+		return
+	}
+	if err := controllers.SendUserTypingToCentrifugo(user.ID, roomID); err != nil {
+		fmt.Printf("error sending message to centrifugo for user %s: %s\n", user.ID, err)
+	}
+}
+
+// rejectCall tells the calling session the call was rejected.
+func rejectCall(from, to string) error {
+	legacy, _ := json.Marshal(fiber.Map{"command": "endc"})
+	return utils.SocketHub.Send(to, utils.Message{
+		Event:  realtime.EventCallRejected,
+		Data:   realtime.SessionEvent{Session: from},
+		Legacy: legacy,
+	})
+}
+
+// answerCall sends the SDP answer to the calling session.
+func answerCall(from string, answer realtime.AnswerRequest) error {
+	legacy, _ := json.Marshal(fiber.Map{
+		"command": "sdpAnswer",
+		"userb":   answer.Session,
+		"sdp":     answer.SDP,
+		"usera":   from,
+	})
+	return utils.SocketHub.Send(answer.Session, utils.Message{
+		Event:  realtime.EventCallAnswered,
+		Data:   realtime.AnswerEvent{Session: from, SDP: answer.SDP, IceCandidates: answer.IceCandidates},
+		Legacy: legacy,
+	})
+}
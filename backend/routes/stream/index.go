@@ -0,0 +1,250 @@
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"hyperpage/utils"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+)
+
+type messageSocket struct {
+	MessageType string                   `json:"messageType"`
+	Data        []map[string]interface{} `json:"data"`
+}
+
+// Register serves the /stream/live websocket. Every connection gets its own
+// rotation of ads targeting the page it is on, the client reports the page
+// with a context message and clicks with adClick messages.
+func Register(app *fiber.App) {
+	app.Use("/stream", func(c *fiber.Ctx) error {
+		if websocket.IsWebSocketUpgrade(c) {
+			c.Locals("allowed", true)
+			return c.Next()
+		}
+		return fiber.ErrUpgradeRequired
+	})
+
+	app.Get("/stream/live", websocket.New(serveLive))
+}
+
+var (
+	liveMu    sync.Mutex
+	liveConns = map[*liveConn]struct{}{}
+)
+
+// Drain closes the /stream/live connections of this node with 1012 Service
+// Restart, clients reconnect and reach another node. It returns the number
+// of connections closed.
+func Drain() int {
+	liveMu.Lock()
+	conns := make([]*liveConn, 0, len(liveConns))
+	for live := range liveConns {
+		conns = append(conns, live)
+	}
+	liveMu.Unlock()
+
+	closeFrame := websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server restart")
+	for _, live := range conns {
+		live.writeMu.Lock()
+		live.conn.WriteMessage(websocket.CloseMessage, closeFrame)
+		live.writeMu.Unlock()
+		live.conn.Close()
+	}
+	return len(conns)
+}
+
+// A connection keeps the impressions it was served last, clicks on others
+// are ignored.
+const liveIssuedImpressions = 32
+
+// liveConn is a /stream/live connection. Ads are written by the rotation
+// and by getADS requests, so writes and the viewer are guarded. A new ad is
+// charged at most once per rotation interval, getADS in between gets the
+// current one again.
+type liveConn struct {
+	conn     *websocket.Conn
+	interval time.Duration
+
+	mu          sync.Mutex
+	viewer      utils.AdViewer
+	lastAd      uint64
+	current     []byte
+	servedAt    time.Time
+	impressions []uint64
+	writeMu     sync.Mutex
+}
+
+func parseID(value string) uint64 {
+	id, _ := strconv.ParseUint(value, 10, 64)
+	return id
+}
+
+// dataID reads an ID sent as a number or a string.
+func dataID(data map[string]interface{}, key string) (uint64, bool) {
+	switch value := data[key].(type) {
+	case float64:
+		return uint64(value), true
+	case string:
+		return parseID(value), true
+	}
+	return 0, false
+}
+
+func serveLive(c *websocket.Conn) {
+	language := c.Query("language")
+	if language == "" {
+		language = "en"
+	}
+	// The address of the reverse proxy header only from TRUSTED_PROXIES
+	ip := c.IP()
+
+	settings := utils.CurrentAdSettings()
+	live := &liveConn{
+		conn:     c,
+		interval: settings.RotationInterval,
+		viewer: utils.AdViewer{
+			Key:      utils.AdViewerKey(c.Query("session"), ip, c.Headers(fiber.HeaderUserAgent)),
+			IP:       ip,
+			Language: language,
+			CityID:   uint(parseID(c.Query("city"))),
+			GuildID:  uint(parseID(c.Query("guild"))),
+		},
+	}
+	liveMu.Lock()
+	liveConns[live] = struct{}{}
+	liveMu.Unlock()
+
+	done := make(chan struct{})
+	defer func() {
+		liveMu.Lock()
+		delete(liveConns, live)
+		liveMu.Unlock()
+		close(done)
+		c.Close()
+	}()
+
+	go func() {
+		rotation := time.NewTicker(settings.RotationInterval)
+		defer rotation.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-rotation.C:
+				live.sendAd(websocket.TextMessage, false)
+			}
+		}
+	}()
+
+	for {
+		_, message, err := c.ReadMessage()
+		if err != nil {
+			fmt.Println("error reading message from client:", err)
+			return
+		}
+
+		var messageData messageSocket
+		if err := json.Unmarshal(message, &messageData); err != nil {
+			fmt.Println("error parsing message:", err)
+			continue
+		}
+
+		switch messageData.MessageType {
+		case "getADS":
+			live.sendAd(websocket.BinaryMessage, true)
+		case "context":
+			if len(messageData.Data) == 0 {
+				continue
+			}
+			data := messageData.Data[0]
+			live.mu.Lock()
+			if value, ok := data["language"].(string); ok && value != "" {
+				live.viewer.Language = value
+			}
+			if value, ok := dataID(data, "city"); ok {
+				live.viewer.CityID = uint(value)
+			}
+			if value, ok := dataID(data, "guild"); ok {
+				live.viewer.GuildID = uint(value)
+			}
+			live.mu.Unlock()
+		case "adClick":
+			for _, data := range messageData.Data {
+				if id, ok := dataID(data, "adImpressionId"); ok && live.issued(id) {
+					if err := utils.RecordAdClick(id, live.viewer.Key); err != nil && err != utils.ErrAdImpressionNotFound {
+						fmt.Println("error recording ad click:", err)
+					}
+				}
+			}
+		}
+	}
+}
+
+// issued reports whether an impression was served on the connection.
+func (l *liveConn) issued(impressionID uint64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, id := range l.impressions {
+		if id == impressionID {
+			return true
+		}
+	}
+	return false
+}
+
+// sendAd writes the next ad of the rotation, nothing when no campaign is
+// eligible. Within the rotation interval of the last one it writes that ad
+// again with resend, nothing without. Ticks may come a little early.
+func (l *liveConn) sendAd(messageType int, resend bool) {
+	l.mu.Lock()
+	if time.Since(l.servedAt) < l.interval-l.interval/10 {
+		adJSON := l.current
+		l.mu.Unlock()
+		if resend && adJSON != nil {
+			l.write(messageType, adJSON)
+		}
+		return
+	}
+	// Taken before picking, concurrent requests get the current ad
+	l.servedAt = time.Now()
+	viewer, lastAd := l.viewer, l.lastAd
+	l.mu.Unlock()
+
+	ad, err := utils.NextAd(viewer, lastAd)
+	if err != nil {
+		fmt.Println("error picking ad:", err)
+		return
+	}
+	if ad == nil {
+		return
+	}
+	adJSON, err := json.Marshal(ad)
+	if err != nil {
+		fmt.Println("error encoding ad to JSON:", err)
+		return
+	}
+
+	l.mu.Lock()
+	l.lastAd = ad.CampaignID
+	l.current = adJSON
+	l.impressions = append(l.impressions, ad.ImpressionID)
+	if len(l.impressions) > liveIssuedImpressions {
+		l.impressions = l.impressions[len(l.impressions)-liveIssuedImpressions:]
+	}
+	l.mu.Unlock()
+	l.write(messageType, adJSON)
+}
+
+func (l *liveConn) write(messageType int, adJSON []byte) {
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+	if err := l.conn.WriteMessage(messageType, adJSON); err != nil {
+		fmt.Println("error writing ad to client:", err)
+	}
+}
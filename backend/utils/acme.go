@@ -0,0 +1,308 @@
+package utils
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+
+	"golang.org/x/crypto/acme"
+	"gorm.io/gorm/clause"
+)
+
+// Certificates are renewed a month before they expire. HTTP-01 key
+// authorizations are kept in Redis so that every instance can answer.
+const (
+	certificateRenewBefore = 30 * 24 * time.Hour
+	acmeChallengeKeyPrefix = "acme:http01:"
+	acmeChallengeTTL       = 15 * time.Minute
+	acmeOrderTimeout       = 5 * time.Minute
+)
+
+// ACMEChallengePath is where the ACME server fetches HTTP-01 responses.
+const ACMEChallengePath = "/.well-known/acme-challenge/"
+
+// acmeClient returns a client for the configured directory, registering the
+// account on first use. ACME_INSECURE skips TLS verification of the
+// directory, which is needed for a local pebble server.
+func acmeClient(ctx context.Context) (*acme.Client, error) {
+	config, _ := initializers.LoadConfig(".")
+	directory := config.AcmeDirectory
+	if directory == "" {
+		directory = acme.LetsEncryptURL
+	}
+
+	var account models.AcmeAccount
+	if err := initializers.DB.Where("directory = ?", directory).First(&account).Error; err != nil {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		keyPEM, err := encodeECKey(key)
+		if err != nil {
+			return nil, err
+		}
+		account = models.AcmeAccount{Directory: directory, Email: config.AcmeEmail, KeyPEM: keyPEM}
+		if err := initializers.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&account).Error; err != nil {
+			return nil, err
+		}
+		// Another instance may have registered at the same time
+		initializers.DB.Where("directory = ?", directory).First(&account)
+	}
+
+	key, err := decodeECKey(account.KeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &acme.Client{Key: key, DirectoryURL: directory, UserAgent: "myru"}
+	if config.AcmeInsecure {
+		client.HTTPClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	}
+
+	if account.URI == "" {
+		acct := &acme.Account{}
+		if config.AcmeEmail != "" {
+			acct.Contact = []string{"mailto:" + config.AcmeEmail}
+		}
+		registered, err := client.Register(ctx, acct, acme.AcceptTOS)
+		if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+			return nil, err
+		}
+		if registered != nil {
+			initializers.DB.Model(&account).Update("uri", registered.URI)
+		}
+	}
+	return client, nil
+}
+
+// ACMEChallengeResponse returns the key authorization of a pending HTTP-01
+// challenge.
+func ACMEChallengeResponse(token string) (string, bool) {
+	value, err := initializers.RedisClient.Get(context.Background(), acmeChallengeKeyPrefix+token).Result()
+	if err != nil {
+		return "", false
+	}
+	return value, true
+}
+
+// IssueDomainCertificate obtains a certificate for a verified custom domain
+// through the HTTP-01 challenge and activates the domain.
+func IssueDomainCertificate(domainID uint64) error {
+	var domain models.CustomDomain
+	if err := initializers.DB.Where("id = ?", domainID).First(&domain).Error; err != nil {
+		return err
+	}
+	if domain.Status != models.CustomDomainStatusVerified && domain.Status != models.CustomDomainStatusActive {
+		return fmt.Errorf("domain %s is not verified", domain.Host)
+	}
+
+	err := issueCertificate(domain.Host)
+	if err != nil {
+		log.Printf("Could not issue certificate for %s: %s", domain.Host, err)
+		initializers.DB.Model(&domain).Update("last_error", err.Error())
+		return err
+	}
+
+	var certificate models.DomainCertificate
+	initializers.DB.Where("host = ?", domain.Host).First(&certificate)
+	initializers.DB.Model(&domain).Updates(map[string]interface{}{
+		"status":                 models.CustomDomainStatusActive,
+		"certificate_expires_at": certificate.NotAfter,
+		"last_error":             "",
+	})
+	forgetCustomDomain(domain.Host)
+	return nil
+}
+
+func issueCertificate(host string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), acmeOrderTimeout)
+	defer cancel()
+
+	client, err := acmeClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	certPEM, key, notAfter, err := obtainCertificate(ctx, client, host, publishRedisHTTP01)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := encodeECKey(key)
+	if err != nil {
+		return err
+	}
+
+	certificate := models.DomainCertificate{Host: host, CertPEM: string(certPEM), KeyPEM: keyPEM, NotAfter: notAfter, UpdatedAt: time.Now()}
+	if err := initializers.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "host"}},
+		DoUpdates: clause.AssignmentColumns([]string{"cert_pem", "key_pem", "not_after", "updated_at"}),
+	}).Create(&certificate).Error; err != nil {
+		return err
+	}
+
+	return exportCertificate(host, certPEM, []byte(keyPEM))
+}
+
+// acmeHTTP01 makes the key authorization of an HTTP-01 challenge available
+// to the ACME server and returns a function removing it again.
+type acmeHTTP01 func(ctx context.Context, token, keyAuth string) (func(), error)
+
+// publishRedisHTTP01 keeps the key authorization in Redis, where
+// ACMEChallengeResponse of every instance finds it.
+func publishRedisHTTP01(ctx context.Context, token, keyAuth string) (func(), error) {
+	if err := initializers.RedisClient.Set(ctx, acmeChallengeKeyPrefix+token, keyAuth, acmeChallengeTTL).Err(); err != nil {
+		return nil, err
+	}
+	return func() {
+		initializers.RedisClient.Del(context.Background(), acmeChallengeKeyPrefix+token)
+	}, nil
+}
+
+// obtainCertificate orders a certificate for host, answering the HTTP-01
+// challenges through publish. It returns the PEM chain with its new key.
+func obtainCertificate(ctx context.Context, client *acme.Client, host string, publish acmeHTTP01) ([]byte, *ecdsa.PrivateKey, time.Time, error) {
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(host))
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+
+	for _, authzURL := range order.AuthzURLs {
+		authz, err := client.GetAuthorization(ctx, authzURL)
+		if err != nil {
+			return nil, nil, time.Time{}, err
+		}
+		if authz.Status == acme.StatusValid {
+			continue
+		}
+
+		var challenge *acme.Challenge
+		for _, c := range authz.Challenges {
+			if c.Type == "http-01" {
+				challenge = c
+				break
+			}
+		}
+		if challenge == nil {
+			return nil, nil, time.Time{}, errors.New("no http-01 challenge offered")
+		}
+
+		keyAuth, err := client.HTTP01ChallengeResponse(challenge.Token)
+		if err != nil {
+			return nil, nil, time.Time{}, err
+		}
+		remove, err := publish(ctx, challenge.Token, keyAuth)
+		if err != nil {
+			return nil, nil, time.Time{}, err
+		}
+		defer remove()
+
+		if _, err := client.Accept(ctx, challenge); err != nil {
+			return nil, nil, time.Time{}, err
+		}
+		if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+			return nil, nil, time.Time{}, err
+		}
+	}
+
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, nil, time.Time{}, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: host},
+		DNSNames: []string{host},
+	}, key)
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	if len(chain) == 0 {
+		return nil, nil, time.Time{}, errors.New("empty certificate chain")
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	return certPEM, key, leaf.NotAfter, nil
+}
+
+// exportCertificate writes the certificate to CERT_STORE_PATH, where the
+// reverse proxy picks it up by server name.
+func exportCertificate(host string, certPEM, keyPEM []byte) error {
+	config, _ := initializers.LoadConfig(".")
+	if config.CertStorePath == "" {
+		return nil
+	}
+	if err := os.MkdirAll(config.CertStorePath, 0o700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(config.CertStorePath, host+".crt"), certPEM, 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(config.CertStorePath, host+".key"), keyPEM, 0o600)
+}
+
+func removeExportedCertificate(host string) {
+	config, _ := initializers.LoadConfig(".")
+	if config.CertStorePath == "" {
+		return
+	}
+	os.Remove(filepath.Join(config.CertStorePath, host+".crt"))
+	os.Remove(filepath.Join(config.CertStorePath, host+".key"))
+}
+
+// RenewDomainCertificates reissues the certificates of active domains that
+// expire within a month.
+func RenewDomainCertificates() {
+	var domains []models.CustomDomain
+	initializers.DB.Where("status = ? AND certificate_expires_at < ?", models.CustomDomainStatusActive, time.Now().Add(certificateRenewBefore)).Find(&domains)
+
+	for _, domain := range domains {
+		IssueDomainCertificate(domain.ID)
+	}
+}
+
+func encodeECKey(key *ecdsa.PrivateKey) (string, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})), nil
+}
+
+func decodeECKey(keyPEM string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, errors.New("invalid key")
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
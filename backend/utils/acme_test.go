@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// TestObtainCertificatePebble orders a certificate from a pebble server. It
+// runs when ACME_TEST_DIRECTORY is set, for example with
+//
+//	docker run -p 14000:14000 -p 15000:15000 -e PEBBLE_VA_NOSLEEP=1 \
+//		ghcr.io/letsencrypt/pebble -dnsserver <challtestsrv>:8053
+//	docker run -p 8053:8053/udp ghcr.io/letsencrypt/pebble-challtestsrv \
+//		-defaultIPv6 "" -defaultIPv4 <address of this machine>
+//	ACME_TEST_DIRECTORY=https://localhost:14000/dir go test ./utils -run Pebble
+//
+// The challenges are answered on ACME_TEST_HTTP_ADDR, :5002 by default, the
+// port pebble validates HTTP-01 on. ACME_TEST_DOMAIN is the name ordered.
+func TestObtainCertificatePebble(t *testing.T) {
+	directory := os.Getenv("ACME_TEST_DIRECTORY")
+	if directory == "" {
+		t.Skip("ACME_TEST_DIRECTORY is not set")
+	}
+	addr := os.Getenv("ACME_TEST_HTTP_ADDR")
+	if addr == "" {
+		addr = ":5002"
+	}
+	host := os.Getenv("ACME_TEST_DOMAIN")
+	if host == "" {
+		host = "shop.example.test"
+	}
+
+	var challenges sync.Map
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keyAuth, ok := challenges.Load(strings.TrimPrefix(r.URL.Path, ACMEChallengePath))
+		if !strings.HasPrefix(r.URL.Path, ACMEChallengePath) || !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(keyAuth.(string)))
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	accountKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &acme.Client{
+		Key:          accountKey,
+		DirectoryURL: directory,
+		HTTPClient:   &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}},
+	}
+	if _, err := client.Register(ctx, &acme.Account{}, acme.AcceptTOS); err != nil {
+		t.Fatal("register:", err)
+	}
+
+	published := 0
+	publish := func(ctx context.Context, token, keyAuth string) (func(), error) {
+		published++
+		challenges.Store(token, keyAuth)
+		return func() { challenges.Delete(token) }, nil
+	}
+
+	certPEM, key, notAfter, err := obtainCertificate(ctx, client, host, publish)
+	if err != nil {
+		t.Fatal("obtain:", err)
+	}
+	if published == 0 {
+		t.Error("no HTTP-01 challenge was answered")
+	}
+	challenges.Range(func(token, _ interface{}) bool {
+		t.Errorf("challenge %v was not removed", token)
+		return true
+	})
+
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		t.Fatal("no certificate in the chain")
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.VerifyHostname(host); err != nil {
+		t.Error(err)
+	}
+	if !leaf.NotAfter.Equal(notAfter) {
+		t.Errorf("notAfter = %v, want %v", notAfter, leaf.NotAfter)
+	}
+	if !key.PublicKey.Equal(leaf.PublicKey) {
+		t.Error("the certificate is not for the returned key")
+	}
+}
@@ -0,0 +1,704 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+
+	"github.com/redis/go-redis/v9"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	defaultAdMinCPM           = 50
+	defaultAdFrequencyCap     = 3
+	defaultAdRotationInterval = 10 * time.Second
+	adFrequencyKeyPrefix      = "adfreq:"
+	adAddressKeyPrefix        = "adip:"
+	adDateFormat              = "2006-01-02"
+	// Running campaigns are cached by every node for this long.
+	adCampaignsRefresh = 30 * time.Second
+	// An address is charged at most this many impressions per rotation
+	// interval, whatever the number of its connections.
+	adImpressionsPerAddress = 10
+)
+
+var (
+	ErrAdCampaignInvalid    = errors.New("invalid campaign")
+	ErrAdCampaignNotFound   = errors.New("campaign not found")
+	ErrAdCampaignState      = errors.New("the campaign can not be changed in its status")
+	ErrAdNotPromoted        = errors.New("the post has no running promotion")
+	ErrAdImpressionNotFound = errors.New("impression not found")
+)
+
+// AdSettings are the settings of the ad rotation, see CurrentAdSettings.
+type AdSettings struct {
+	MinCPM           float64
+	FrequencyCap     int
+	RotationInterval time.Duration
+}
+
+// CurrentAdSettings returns the configured ad settings, with defaults for
+// the unset ones.
+func CurrentAdSettings() AdSettings {
+	config, _ := initializers.LoadConfig(".")
+	settings := AdSettings{
+		MinCPM:           config.AdMinCPM,
+		FrequencyCap:     config.AdFrequencyCap,
+		RotationInterval: config.AdRotationInterval,
+	}
+	if settings.MinCPM <= 0 {
+		settings.MinCPM = defaultAdMinCPM
+	}
+	if settings.FrequencyCap <= 0 {
+		settings.FrequencyCap = defaultAdFrequencyCap
+	}
+	if settings.RotationInterval <= 0 {
+		settings.RotationInterval = defaultAdRotationInterval
+	}
+	return settings
+}
+
+// AdCampaignInput creates a campaign for a promoted post. Without EndsAt
+// the campaign runs as long as the promotion.
+type AdCampaignInput struct {
+	BlogID       uint64     `json:"blogId"`
+	Name         string     `json:"name"`
+	CPM          float64    `json:"cpm"`
+	Budget       float64    `json:"budget"`
+	DailyBudget  float64    `json:"dailyBudget"`
+	FrequencyCap int        `json:"frequencyCap"`
+	EndsAt       *time.Time `json:"endsAt"`
+	Cities       []uint     `json:"cities"`
+	Guilds       []uint     `json:"guilds"`
+	Languages    []string   `json:"languages"`
+}
+
+// AdViewer is who an ad is served to. Key identifies them for frequency
+// capping, IP throttles the impressions of their address, the city and guild
+// are those of the page they are on.
+type AdViewer struct {
+	Key      string
+	IP       string
+	Language string
+	CityID   uint
+	GuildID  uint
+}
+
+// AdImpression is a served ad, the post of the campaign with the IDs needed
+// to report a click.
+type AdImpression struct {
+	models.Blog
+	ImpressionID uint64 `json:"adImpressionId"`
+	CampaignID   uint64 `json:"adCampaignId"`
+}
+
+// AdCampaignDay is the activity of a campaign on a UTC day.
+type AdCampaignDay struct {
+	Date        time.Time `json:"date"`
+	Impressions int64     `json:"impressions"`
+	Clicks      int64     `json:"clicks"`
+	Spent       float64   `json:"spent"`
+}
+
+// AdViewerKey identifies a viewer for frequency capping, by the user logged
+// in on the session or as a guest by the IP address and user agent.
+func AdViewerKey(session, ip, userAgent string) string {
+	if session != "" {
+		if userID, err := uuid.FromString(SocketHub.SessionUser(session)); err == nil {
+			return VisitorKey(&userID, ip, userAgent)
+		}
+	}
+	return VisitorKey(nil, ip, userAgent)
+}
+
+var adCampaignCache struct {
+	sync.Mutex
+	campaigns []models.AdCampaign
+	loadedAt  time.Time
+}
+
+func invalidateAdCampaigns() {
+	adCampaignCache.Lock()
+	adCampaignCache.loadedAt = time.Time{}
+	adCampaignCache.Unlock()
+}
+
+// runningAdCampaigns returns a copy of the cached running campaigns.
+func runningAdCampaigns(now time.Time) []models.AdCampaign {
+	adCampaignCache.Lock()
+	defer adCampaignCache.Unlock()
+
+	if now.Sub(adCampaignCache.loadedAt) > adCampaignsRefresh {
+		var campaigns []models.AdCampaign
+		err := initializers.DB.Preload("Targets").
+			Where("status = ? AND starts_at <= ? AND ends_at > ? AND spent < budget", models.AdCampaignStatusActive, now, now).
+			Find(&campaigns).Error
+		if err != nil {
+			log.Println("Could not load ad campaigns:", err)
+		} else {
+			adCampaignCache.campaigns = campaigns
+			adCampaignCache.loadedAt = now
+		}
+	}
+	return append([]models.AdCampaign(nil), adCampaignCache.campaigns...)
+}
+
+// noteAdSpend applies a charged impression to the cached campaign, so pacing
+// sees it before the next refresh.
+func noteAdSpend(campaignID uint64, cost float64, now time.Time) {
+	today := now.UTC().Format(adDateFormat)
+	adCampaignCache.Lock()
+	defer adCampaignCache.Unlock()
+	for i := range adCampaignCache.campaigns {
+		campaign := &adCampaignCache.campaigns[i]
+		if campaign.ID != campaignID {
+			continue
+		}
+		if campaign.DaySpentOn != today {
+			campaign.DaySpent, campaign.DaySpentOn = 0, today
+		}
+		campaign.Spent += cost
+		campaign.DaySpent += cost
+		campaign.Impressions++
+	}
+}
+
+// adTargeted reports whether the campaign targets the viewer. Kinds without
+// targets match everyone.
+func adTargeted(campaign *models.AdCampaign, viewer AdViewer) bool {
+	values := map[string]string{
+		models.AdTargetCity:     strconv.FormatUint(uint64(viewer.CityID), 10),
+		models.AdTargetGuild:    strconv.FormatUint(uint64(viewer.GuildID), 10),
+		models.AdTargetLanguage: viewer.Language,
+	}
+	targeted := make(map[string]bool)
+	matched := make(map[string]bool)
+	for _, target := range campaign.Targets {
+		targeted[target.Kind] = true
+		if target.Value == values[target.Kind] {
+			matched[target.Kind] = true
+		}
+	}
+	for kind := range targeted {
+		if !matched[kind] {
+			return false
+		}
+	}
+	return true
+}
+
+// adImpressionCost is what an impression of the campaign is charged.
+func adImpressionCost(campaign *models.AdCampaign) float64 {
+	return campaign.CPM / 1000
+}
+
+// adPaced reports whether the campaign may spend cost now. The budget left
+// at the start of the UTC day is spread over the days left, capped by the
+// daily budget, and a day's share is released evenly over its hours.
+func adPaced(campaign *models.AdCampaign, cost float64, now time.Time) bool {
+	if campaign.Spent+cost > campaign.Budget+1e-9 {
+		return false
+	}
+
+	now = now.UTC()
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	daySpent := 0.0
+	if campaign.DaySpentOn == now.Format(adDateFormat) {
+		daySpent = campaign.DaySpent
+	}
+
+	daysLeft := math.Ceil(campaign.EndsAt.Sub(dayStart).Hours() / 24)
+	if daysLeft < 1 {
+		daysLeft = 1
+	}
+	daily := (campaign.Budget - campaign.Spent + daySpent) / daysLeft
+	if campaign.DailyBudget > 0 && campaign.DailyBudget < daily {
+		daily = campaign.DailyBudget
+	}
+
+	// Small budgets still get the first impression of a day
+	if daySpent == 0 {
+		return true
+	}
+	elapsed := now.Sub(dayStart).Hours() / 24
+	if elapsed < 1.0/24 {
+		elapsed = 1.0 / 24
+	}
+	return daySpent+cost <= daily*elapsed+1e-9
+}
+
+func adFrequencyKey(campaignID uint64, viewerKey string, now time.Time) string {
+	return fmt.Sprintf("%s%d:%s:%s", adFrequencyKeyPrefix, campaignID, viewerKey, now.UTC().Format("20060102"))
+}
+
+// underFrequencyCap drops the campaigns the viewer has seen as often as
+// their cap allows today.
+func underFrequencyCap(campaigns []models.AdCampaign, viewerKey string, defaultCap int, now time.Time) []models.AdCampaign {
+	if len(campaigns) == 0 {
+		return campaigns
+	}
+	ctx := context.Background()
+	counts := make([]*redis.StringCmd, len(campaigns))
+	_, err := initializers.RedisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i := range campaigns {
+			counts[i] = pipe.Get(ctx, adFrequencyKey(campaigns[i].ID, viewerKey, now))
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		log.Println("Could not read ad frequency:", err)
+		return campaigns
+	}
+
+	kept := campaigns[:0]
+	for i := range campaigns {
+		limit := campaigns[i].FrequencyCap
+		if limit <= 0 {
+			limit = defaultCap
+		}
+		if seen, _ := counts[i].Int(); seen < limit {
+			kept = append(kept, campaigns[i])
+		}
+	}
+	return kept
+}
+
+// chargeAdImpression charges the campaign for an impression and records it.
+// It is nil when the campaign ran out of budget meanwhile.
+func chargeAdImpression(campaign *models.AdCampaign, viewer AdViewer, now time.Time) (*models.AdEvent, error) {
+	cost := adImpressionCost(campaign)
+	today := now.UTC().Format(adDateFormat)
+
+	var event *models.AdEvent
+	err := initializers.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.AdCampaign{}).
+			Where("id = ? AND status = ? AND spent + ? <= budget", campaign.ID, models.AdCampaignStatusActive, cost).
+			Updates(map[string]interface{}{
+				"spent":        gorm.Expr("spent + ?", cost),
+				"day_spent":    gorm.Expr("CASE WHEN day_spent_on = ? THEN day_spent + ? ELSE ? END", today, cost, cost),
+				"day_spent_on": today,
+				"impressions":  gorm.Expr("impressions + 1"),
+				"updated_at":   now,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return tx.Model(&models.AdCampaign{}).
+				Where("id = ? AND status = ?", campaign.ID, models.AdCampaignStatusActive).
+				Update("status", models.AdCampaignStatusExhausted).Error
+		}
+
+		event = &models.AdEvent{
+			CampaignID: campaign.ID,
+			BlogID:     campaign.BlogID,
+			Kind:       models.AdEventImpression,
+			ViewerKey:  viewer.Key,
+			Language:   viewer.Language,
+			CityID:     viewer.CityID,
+			GuildID:    viewer.GuildID,
+			Cost:       cost,
+			CreatedAt:  now,
+		}
+		return tx.Create(event).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	if event == nil {
+		invalidateAdCampaigns()
+		return nil, nil
+	}
+
+	ctx := context.Background()
+	key := adFrequencyKey(campaign.ID, viewer.Key, now)
+	if err := initializers.RedisClient.Incr(ctx, key).Err(); err != nil {
+		log.Println("Could not count ad frequency:", err)
+	}
+	initializers.RedisClient.Expire(ctx, key, 25*time.Hour)
+	noteAdSpend(campaign.ID, cost, now)
+	return event, nil
+}
+
+// allowAdImpression counts an impression of the address and reports whether
+// it is within adImpressionsPerAddress for the rotation interval.
+func allowAdImpression(ip string, interval time.Duration, now time.Time) bool {
+	ctx := context.Background()
+	key := adAddressKeyPrefix + ip + ":" + strconv.FormatInt(now.UnixNano()/int64(interval), 10)
+	count, err := initializers.RedisClient.Incr(ctx, key).Result()
+	if err != nil {
+		log.Println("Could not throttle ad impressions:", err)
+		return true
+	}
+	if count == 1 {
+		initializers.RedisClient.Expire(ctx, key, 2*interval)
+	}
+	return count <= adImpressionsPerAddress
+}
+
+// NextAd picks the ad to show to the viewer among the running campaigns
+// targeting them, weighted by their bids, and charges its impression. The
+// campaign of skip is left out when others are eligible, so consecutive ads
+// differ. It is nil when no campaign is eligible or the address of the
+// viewer had its share of impressions.
+func NextAd(viewer AdViewer, skip uint64) (*AdImpression, error) {
+	now := time.Now()
+	settings := CurrentAdSettings()
+	if !allowAdImpression(viewer.IP, settings.RotationInterval, now) {
+		return nil, nil
+	}
+
+	var candidates []models.AdCampaign
+	for _, campaign := range runningAdCampaigns(now) {
+		if adTargeted(&campaign, viewer) && adPaced(&campaign, adImpressionCost(&campaign), now) {
+			candidates = append(candidates, campaign)
+		}
+	}
+	candidates = underFrequencyCap(candidates, viewer.Key, settings.FrequencyCap, now)
+	if len(candidates) > 1 {
+		for i := range candidates {
+			if candidates[i].ID == skip {
+				candidates = append(candidates[:i], candidates[i+1:]...)
+				break
+			}
+		}
+	}
+
+	for len(candidates) > 0 {
+		total := 0.0
+		for i := range candidates {
+			total += candidates[i].CPM
+		}
+		pick := rand.Float64() * total
+		chosen := len(candidates) - 1
+		for i := range candidates {
+			if pick < candidates[i].CPM {
+				chosen = i
+				break
+			}
+			pick -= candidates[i].CPM
+		}
+		campaign := candidates[chosen]
+		candidates = append(candidates[:chosen], candidates[chosen+1:]...)
+
+		event, err := chargeAdImpression(&campaign, viewer, now)
+		if err != nil {
+			return nil, err
+		}
+		if event == nil {
+			continue
+		}
+
+		impression := &AdImpression{ImpressionID: event.ID, CampaignID: campaign.ID}
+		language := viewer.Language
+		if language == "" {
+			language = "en"
+		}
+		err = initializers.DB.
+			Preload("Photos").
+			Preload("City.Translations", "language = ?", language).
+			Preload("Catygory.Translations", "language = ?", language).
+			Preload("User").
+			Preload("Hashtags").
+			Where("id = ?", campaign.BlogID).
+			First(&impression.Blog).Error
+		if err != nil {
+			return nil, err
+		}
+		return impression, nil
+	}
+	return nil, nil
+}
+
+// RecordAdClick records the click of an impression served to the viewer,
+// once per impression.
+func RecordAdClick(impressionID uint64, viewerKey string) error {
+	var impression models.AdEvent
+	if err := initializers.DB.Where("id = ? AND kind = ? AND viewer_key = ?", impressionID, models.AdEventImpression, viewerKey).First(&impression).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrAdImpressionNotFound
+		}
+		return err
+	}
+
+	return initializers.DB.Transaction(func(tx *gorm.DB) error {
+		var clicks int64
+		tx.Model(&models.AdEvent{}).Where("impression_id = ? AND kind = ?", impression.ID, models.AdEventClick).Count(&clicks)
+		if clicks > 0 {
+			return nil
+		}
+		if err := tx.Create(&models.AdEvent{
+			CampaignID:   impression.CampaignID,
+			BlogID:       impression.BlogID,
+			Kind:         models.AdEventClick,
+			ImpressionID: impression.ID,
+			ViewerKey:    impression.ViewerKey,
+			Language:     impression.Language,
+			CityID:       impression.CityID,
+			GuildID:      impression.GuildID,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.AdCampaign{}).Where("id = ?", impression.CampaignID).
+			UpdateColumn("clicks", gorm.Expr("clicks + 1")).Error
+	})
+}
+
+// adCampaignTargets validates the targets of a campaign.
+func adCampaignTargets(input AdCampaignInput) ([]models.AdCampaignTarget, error) {
+	var targets []models.AdCampaignTarget
+	for _, city := range input.Cities {
+		targets = append(targets, models.AdCampaignTarget{Kind: models.AdTargetCity, Value: strconv.FormatUint(uint64(city), 10)})
+	}
+	for _, guild := range input.Guilds {
+		targets = append(targets, models.AdCampaignTarget{Kind: models.AdTargetGuild, Value: strconv.FormatUint(uint64(guild), 10)})
+	}
+	for _, language := range input.Languages {
+		language = strings.ToLower(strings.TrimSpace(language))
+		if len(language) < 2 || len(language) > 5 {
+			return nil, fmt.Errorf("%w: unknown language %q", ErrAdCampaignInvalid, language)
+		}
+		targets = append(targets, models.AdCampaignTarget{Kind: models.AdTargetLanguage, Value: language})
+	}
+	return targets, nil
+}
+
+// CreateAdCampaign starts a campaign for a promoted post of the user and
+// reserves its budget from their balance.
+func CreateAdCampaign(userID uuid.UUID, input AdCampaignInput) (*models.AdCampaign, error) {
+	settings := CurrentAdSettings()
+	now := time.Now()
+
+	name := strings.TrimSpace(input.Name)
+	switch {
+	case name == "" || len(name) > 100:
+		return nil, fmt.Errorf("%w: a name of up to 100 characters is required", ErrAdCampaignInvalid)
+	case input.CPM < settings.MinCPM:
+		return nil, fmt.Errorf("%w: the CPM must be at least %.2f", ErrAdCampaignInvalid, settings.MinCPM)
+	case roundMoney(input.Budget) < input.CPM/1000:
+		return nil, fmt.Errorf("%w: the budget does not pay for an impression", ErrAdCampaignInvalid)
+	case input.DailyBudget < 0 || input.FrequencyCap < 0 || input.FrequencyCap > 100:
+		return nil, fmt.Errorf("%w: invalid daily budget or frequency cap", ErrAdCampaignInvalid)
+	}
+	targets, err := adCampaignTargets(input)
+	if err != nil {
+		return nil, err
+	}
+
+	var blog models.Blog
+	if err := initializers.DB.Where("id = ? AND user_id = ? AND status = ?", input.BlogID, userID, models.BlogStatusActive).First(&blog).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrAdNotPromoted
+		}
+		return nil, err
+	}
+	var promotion models.Promotion
+	if err := initializers.DB.Where("blog_id = ? AND status = ? AND expires_at > ?", blog.ID, models.PromotionStatusActive, now).
+		Order("expires_at DESC").First(&promotion).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrAdNotPromoted
+		}
+		return nil, err
+	}
+
+	endsAt := promotion.ExpiresAt
+	if input.EndsAt != nil {
+		if !input.EndsAt.After(now) {
+			return nil, fmt.Errorf("%w: the end must be in the future", ErrAdCampaignInvalid)
+		}
+		if input.EndsAt.Before(endsAt) {
+			endsAt = *input.EndsAt
+		}
+	}
+
+	budget := roundMoney(input.Budget)
+	campaign := &models.AdCampaign{
+		BlogID:       blog.ID,
+		UserID:       userID,
+		PromotionID:  promotion.ID,
+		Name:         name,
+		Status:       models.AdCampaignStatusActive,
+		CPM:          input.CPM,
+		Budget:       budget,
+		DailyBudget:  roundMoney(input.DailyBudget),
+		FrequencyCap: input.FrequencyCap,
+		Targets:      targets,
+		StartsAt:     now,
+		EndsAt:       endsAt,
+	}
+
+	err = initializers.DB.Transaction(func(tx *gorm.DB) error {
+		var balance models.Billing
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_id = ?", userID).
+			First(&balance).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInsufficientBalance
+			}
+			return err
+		}
+		if balance.Amount < budget {
+			return ErrInsufficientBalance
+		}
+		balance.Amount -= budget
+		if err := tx.Save(&balance).Error; err != nil {
+			return err
+		}
+
+		transaction := models.Transaction{
+			UserID:      userID,
+			Amount:      budget,
+			Status:      "OPENED",
+			Module:      "ads",
+			ElementId:   blog.ID,
+			Total:       strconv.FormatFloat(budget, 'f', 2, 64),
+			Description: "Бюджет рекламной кампании: " + name,
+			Type:        "deduction",
+		}
+		if err := tx.Create(&transaction).Error; err != nil {
+			return err
+		}
+		campaign.TransactionID = transaction.ID
+		return tx.Create(campaign).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	invalidateAdCampaigns()
+	return campaign, nil
+}
+
+// FindAdCampaign returns a campaign of the user with its targets.
+func FindAdCampaign(userID uuid.UUID, campaignID uint64) (*models.AdCampaign, error) {
+	var campaign models.AdCampaign
+	if err := initializers.DB.Preload("Targets").Where("id = ? AND user_id = ?", campaignID, userID).First(&campaign).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrAdCampaignNotFound
+		}
+		return nil, err
+	}
+	return &campaign, nil
+}
+
+// PauseAdCampaign pauses a running campaign of the user or, with pause
+// false, resumes it.
+func PauseAdCampaign(userID uuid.UUID, campaignID uint64, pause bool) (*models.AdCampaign, error) {
+	from, to := models.AdCampaignStatusActive, models.AdCampaignStatusPaused
+	if !pause {
+		from, to = to, from
+	}
+	result := initializers.DB.Model(&models.AdCampaign{}).
+		Where("id = ? AND user_id = ? AND status = ?", campaignID, userID, from).
+		Updates(map[string]interface{}{"status": to, "updated_at": time.Now()})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	campaign, err := FindAdCampaign(userID, campaignID)
+	if err != nil {
+		return nil, err
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrAdCampaignState
+	}
+	invalidateAdCampaigns()
+	return campaign, nil
+}
+
+// EndAdCampaign ends a campaign of the user and refunds the rest of its
+// budget.
+func EndAdCampaign(userID uuid.UUID, campaignID uint64) (*models.AdCampaign, error) {
+	if _, err := FindAdCampaign(userID, campaignID); err != nil {
+		return nil, err
+	}
+	ended, err := settleAdCampaign(campaignID)
+	if err != nil {
+		return nil, err
+	}
+	if !ended {
+		return nil, ErrAdCampaignState
+	}
+	return FindAdCampaign(userID, campaignID)
+}
+
+// settleAdCampaign ends a campaign, closes its transaction with what was
+// spent and refunds the rest. It is false when the campaign had ended
+// already.
+func settleAdCampaign(campaignID uint64) (bool, error) {
+	ended := false
+	err := initializers.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		var campaigns []models.AdCampaign
+		if err := tx.Model(&campaigns).
+			Clauses(clause.Returning{}).
+			Where("id = ? AND status <> ?", campaignID, models.AdCampaignStatusEnded).
+			Updates(map[string]interface{}{"status": models.AdCampaignStatusEnded, "ended_at": now, "updated_at": now}).Error; err != nil {
+			return err
+		}
+		if len(campaigns) == 0 {
+			return nil
+		}
+		ended = true
+		campaign := campaigns[0]
+
+		spent := roundMoney(campaign.Spent)
+		if refund := roundMoney(campaign.Budget - spent); refund > 0 {
+			if err := creditBalance(tx, campaign.UserID, refund); err != nil {
+				return err
+			}
+		}
+		return tx.Model(&models.Transaction{}).Where("id = ?", campaign.TransactionID).Updates(map[string]interface{}{
+			"amount":      spent,
+			"total":       strconv.FormatFloat(spent, 'f', 2, 64),
+			"status":      "CLOSED_1",
+			"description": fmt.Sprintf("Рекламная кампания: %s, показов %d, кликов %d", campaign.Name, campaign.Impressions, campaign.Clicks),
+		}).Error
+	})
+	if ended {
+		invalidateAdCampaigns()
+	}
+	return ended, err
+}
+
+// EndAdCampaigns settles the campaigns that are over or spent their budget.
+func EndAdCampaigns() {
+	var ids []uint64
+	initializers.DB.Model(&models.AdCampaign{}).
+		Where("status = ? OR (status IN ? AND ends_at <= ?)", models.AdCampaignStatusExhausted,
+			[]string{models.AdCampaignStatusActive, models.AdCampaignStatusPaused}, time.Now()).
+		Pluck("id", &ids)
+
+	for _, id := range ids {
+		if _, err := settleAdCampaign(id); err != nil {
+			log.Println("Could not end ad campaign:", err)
+		}
+	}
+}
+
+// AdCampaignDays returns the daily impressions, clicks and spending of a
+// campaign.
+func AdCampaignDays(campaignID uint64) ([]AdCampaignDay, error) {
+	var days []AdCampaignDay
+	err := initializers.DB.Model(&models.AdEvent{}).
+		Select(`date_trunc('day', created_at AT TIME ZONE 'UTC') AS date,
+			count(*) FILTER (WHERE kind = ?) AS impressions,
+			count(*) FILTER (WHERE kind = ?) AS clicks,
+			coalesce(sum(cost), 0) AS spent`, models.AdEventImpression, models.AdEventClick).
+		Where("campaign_id = ?", campaignID).
+		Group("1").
+		Order("1").
+		Scan(&days).Error
+	return days, err
+}
@@ -0,0 +1,203 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm/clause"
+)
+
+// Raw analytics are kept in Redis for a few days and rolled up into
+// blog_daily_stats.
+const (
+	blogViewsKeyPrefix = "blogviews:"
+	blogStatsKeyPrefix = "blogstats:"
+	blogStatsDateFmt   = "20060102"
+	blogStatsTTL       = 72 * time.Hour
+)
+
+var crawlerRegexp = regexp.MustCompile(`(?i)bot|crawl|spider|slurp|facebookexternalhit|embedly|preview|curl|wget|python-requests|go-http-client|headless|lighthouse`)
+
+// IsCrawler reports whether the user agent belongs to a known crawler.
+func IsCrawler(userAgent string) bool {
+	return userAgent == "" || crawlerRegexp.MatchString(userAgent)
+}
+
+// VisitorKey identifies a visitor by the user ID or, for guests, by a hash of
+// the IP address and user agent.
+func VisitorKey(userID *uuid.UUID, ip, userAgent string) string {
+	if userID != nil {
+		return "u:" + userID.String()
+	}
+	sum := sha256.Sum256([]byte(ip + "|" + userAgent))
+	return "g:" + hex.EncodeToString(sum[:])
+}
+
+// TrackBlogView records a view of the post. It returns true when this is the
+// first view of the visitor today. Crawlers and the author are not counted.
+func TrackBlogView(blog *models.Blog, viewerID *uuid.UUID, ip, userAgent string) bool {
+	if IsCrawler(userAgent) || (viewerID != nil && *viewerID == blog.UserID) {
+		return false
+	}
+
+	ctx := context.Background()
+	key := blogViewsKey(blog.ID, time.Now())
+	added, err := initializers.RedisClient.PFAdd(ctx, key, VisitorKey(viewerID, ip, userAgent)).Result()
+	if err != nil {
+		log.Println("Could not track blog view:", err)
+		return false
+	}
+	initializers.RedisClient.Expire(ctx, key, blogStatsTTL)
+
+	return added == 1
+}
+
+// TrackBlogEvent increments a daily counter of the post, see the BlogStat
+// constants.
+func TrackBlogEvent(blogID uint64, stat string) {
+	if blogID == 0 {
+		return
+	}
+
+	ctx := context.Background()
+	key := blogStatsKeyPrefix + time.Now().Format(blogStatsDateFmt)
+	field := fmt.Sprintf("%d:%s", blogID, stat)
+	if err := initializers.RedisClient.HIncrBy(ctx, key, field, 1).Err(); err != nil {
+		log.Println("Could not track blog event:", err)
+		return
+	}
+	initializers.RedisClient.Expire(ctx, key, blogStatsTTL)
+}
+
+func blogViewsKey(blogID uint64, day time.Time) string {
+	return fmt.Sprintf("%s%s:%d", blogViewsKeyPrefix, day.Format(blogStatsDateFmt), blogID)
+}
+
+// RollupBlogStats writes the counters of today and yesterday from Redis to
+// blog_daily_stats. Rows are overwritten, so the rollup can run any number
+// of times.
+func RollupBlogStats() {
+	now := time.Now()
+	for _, day := range []time.Time{now.AddDate(0, 0, -1), now} {
+		rollupBlogStatsDay(day)
+	}
+}
+
+func rollupBlogStatsDay(day time.Time) {
+	ctx := context.Background()
+	date := day.Format(blogStatsDateFmt)
+	stats := make(map[uint64]*models.BlogDailyStat)
+	statFor := func(blogID uint64) *models.BlogDailyStat {
+		if stat, ok := stats[blogID]; ok {
+			return stat
+		}
+		stat := &models.BlogDailyStat{
+			BlogID: blogID,
+			Date:   time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC),
+		}
+		stats[blogID] = stat
+		return stat
+	}
+
+	counters, err := initializers.RedisClient.HGetAll(ctx, blogStatsKeyPrefix+date).Result()
+	if err != nil {
+		log.Println("Could not load blog stats:", err)
+		return
+	}
+	for field, value := range counters {
+		parts := strings.SplitN(field, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		blogID, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		count, _ := strconv.ParseInt(value, 10, 64)
+
+		stat := statFor(blogID)
+		switch parts[1] {
+		case models.BlogStatFavorites:
+			stat.Favorites = count
+		case models.BlogStatVotes:
+			stat.Votes = count
+		case models.BlogStatChatRooms:
+			stat.ChatRooms = count
+		case models.BlogStatCallRequests:
+			stat.CallRequests = count
+		}
+	}
+
+	var cursor uint64
+	pattern := blogViewsKeyPrefix + date + ":*"
+	for {
+		keys, next, err := initializers.RedisClient.Scan(ctx, cursor, pattern, 100).Result()
+		if err != nil {
+			log.Println("Could not scan blog views:", err)
+			break
+		}
+		for _, key := range keys {
+			blogID, err := strconv.ParseUint(key[strings.LastIndex(key, ":")+1:], 10, 64)
+			if err != nil {
+				continue
+			}
+			views, err := initializers.RedisClient.PFCount(ctx, key).Result()
+			if err != nil {
+				continue
+			}
+			statFor(blogID).Views = views
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+
+	for _, stat := range stats {
+		stat.UpdatedAt = time.Now()
+		if err := initializers.DB.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "blog_id"}, {Name: "date"}},
+			DoUpdates: clause.AssignmentColumns([]string{"views", "favorites", "votes", "chat_rooms", "call_requests", "updated_at"}),
+		}).Create(stat).Error; err != nil {
+			log.Println("Could not save blog stats:", err)
+		}
+	}
+}
+
+// blogCountersKeyPrefix marks the months whose post counters were rolled.
+const blogCountersKeyPrefix = "blogcounters:"
+
+// RollMonthlyBlogCounters moves the posts of the past month from TotalBlogs
+// into TotalRestBlogs, once in the first days of a month.
+func RollMonthlyBlogCounters() {
+	now := time.Now().UTC()
+	if now.Day() > 3 {
+		return
+	}
+
+	key := blogCountersKeyPrefix + now.Format("200601")
+	first, err := initializers.RedisClient.SetNX(context.Background(), key, now.Unix(), 40*24*time.Hour).Result()
+	if err != nil {
+		log.Println("Could not roll blog counters:", err)
+		return
+	}
+	if !first {
+		return
+	}
+
+	if err := initializers.DB.Exec("UPDATE users SET total_rest_blogs = total_rest_blogs + total_blogs, total_blogs = 0 WHERE total_blogs > 0").Error; err != nil {
+		log.Println("Could not roll blog counters:", err)
+		initializers.RedisClient.Del(context.Background(), key)
+	}
+}
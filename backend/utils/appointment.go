@@ -0,0 +1,902 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	defaultAppointmentReminderBefore = time.Hour
+	// Rooms of appointments stay open this long after their end.
+	appointmentRoomGrace  = 15 * time.Minute
+	appointmentDateFormat = "2006-01-02"
+)
+
+var (
+	ErrScheduleNotFound    = errors.New("the seller does not take appointments")
+	ErrSlotUnavailable     = errors.New("this slot is not available")
+	ErrAppointmentNotFound = errors.New("appointment not found")
+	ErrAppointmentState    = errors.New("the appointment is already over or cancelled")
+	ErrAppointmentSelf     = errors.New("you cannot book an appointment with yourself")
+	ErrScheduleInvalid     = errors.New("invalid schedule")
+)
+
+// AppointmentSlot is a free slot of a schedule.
+type AppointmentSlot struct {
+	StartsAt time.Time `json:"startsAt"`
+	EndsAt   time.Time `json:"endsAt"`
+}
+
+// ScheduleInput is the schedule a seller publishes.
+type ScheduleInput struct {
+	Timezone      string                           `json:"timezone"`
+	SlotMinutes   int                              `json:"slotMinutes"`
+	BufferMinutes int                              `json:"bufferMinutes"`
+	HorizonDays   int                              `json:"horizonDays"`
+	Price         float64                          `json:"price"`
+	Active        *bool                            `json:"active"`
+	Availability  []models.AppointmentAvailability `json:"availability"`
+}
+
+// AppointmentJoin is what a side joins the meeting of an appointment with.
+type AppointmentJoin struct {
+	Appointment *models.Appointment `json:"appointment"`
+	ServerURL   string              `json:"serverUrl"`
+	Token       string              `json:"token"`
+	Link        string              `json:"link"`
+}
+
+// minuteWindow is a window of a day, in minutes from midnight.
+type minuteWindow struct {
+	start, end int
+}
+
+// parseClock parses HH:MM into minutes from midnight, 24:00 is the end of
+// the day.
+func parseClock(clock string) (int, error) {
+	hours, minutes, ok := strings.Cut(clock, ":")
+	h, errH := strconv.Atoi(hours)
+	m, errM := strconv.Atoi(minutes)
+	if !ok || errH != nil || errM != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time %q, HH:MM is expected", clock)
+	}
+	return h*60 + m, nil
+}
+
+func parseWindow(start, end string) (minuteWindow, error) {
+	from, err := parseClock(start)
+	if err != nil {
+		return minuteWindow{}, err
+	}
+	to, err := parseClock(end)
+	if err != nil {
+		return minuteWindow{}, err
+	}
+	if to <= from {
+		return minuteWindow{}, fmt.Errorf("the window %s-%s ends before it starts", start, end)
+	}
+	return minuteWindow{from, to}, nil
+}
+
+// subtractWindow removes a window from the windows of a day.
+func subtractWindow(windows []minuteWindow, cut minuteWindow) []minuteWindow {
+	result := make([]minuteWindow, 0, len(windows)+1)
+	for _, w := range windows {
+		if cut.end <= w.start || cut.start >= w.end {
+			result = append(result, w)
+			continue
+		}
+		if cut.start > w.start {
+			result = append(result, minuteWindow{w.start, cut.start})
+		}
+		if cut.end < w.end {
+			result = append(result, minuteWindow{cut.end, w.end})
+		}
+	}
+	return result
+}
+
+// dayWindows returns the windows a schedule is open on a day: the weekly
+// ones with the exceptions of the date applied.
+func dayWindows(day time.Time, availability []models.AppointmentAvailability, exceptions []models.AppointmentException) []minuteWindow {
+	var windows []minuteWindow
+	for _, a := range availability {
+		if a.Weekday != int(day.Weekday()) {
+			continue
+		}
+		if w, err := parseWindow(a.Start, a.End); err == nil {
+			windows = append(windows, w)
+		}
+	}
+	date := day.Format(appointmentDateFormat)
+	for _, e := range exceptions {
+		if e.Date != date {
+			continue
+		}
+		w := minuteWindow{0, 24 * 60}
+		if e.Start != "" || e.End != "" {
+			var err error
+			if w, err = parseWindow(e.Start, e.End); err != nil {
+				continue
+			}
+		}
+		windows = subtractWindow(windows, w)
+		if e.Available {
+			windows = append(windows, w)
+		}
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i].start < windows[j].start })
+	return windows
+}
+
+// AppointmentSlots returns the free slots of a schedule between from and
+// to. Slots start at the beginning of each window, one after the other with
+// the buffer between them, and must keep the buffer away from the booked
+// appointments. Slots before now are left out.
+func AppointmentSlots(schedule *models.AppointmentSchedule, exceptions []models.AppointmentException, booked []models.Appointment, from, to, now time.Time) []AppointmentSlot {
+	location, err := time.LoadLocation(schedule.Timezone)
+	if err != nil {
+		location = time.UTC
+	}
+	slot := time.Duration(schedule.SlotMinutes) * time.Minute
+	buffer := time.Duration(schedule.BufferMinutes) * time.Minute
+	if slot <= 0 {
+		return nil
+	}
+
+	slots := []AppointmentSlot{}
+	start := from.In(location)
+	day := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, location)
+	for ; day.Before(to); day = time.Date(day.Year(), day.Month(), day.Day()+1, 0, 0, 0, 0, location) {
+		for _, w := range dayWindows(day, schedule.Availability, exceptions) {
+			windowEnd := time.Date(day.Year(), day.Month(), day.Day(), 0, w.end, 0, 0, location)
+			at := time.Date(day.Year(), day.Month(), day.Day(), 0, w.start, 0, 0, location)
+			for ; !at.Add(slot).After(windowEnd); at = at.Add(slot + buffer) {
+				end := at.Add(slot)
+				if at.Before(from) || at.Before(now) || !at.Before(to) {
+					continue
+				}
+				free := true
+				for _, b := range booked {
+					if at.Before(b.EndsAt.Add(buffer)) && end.After(b.StartsAt.Add(-buffer)) {
+						free = false
+						break
+					}
+				}
+				if free {
+					slots = append(slots, AppointmentSlot{StartsAt: at.UTC(), EndsAt: end.UTC()})
+				}
+			}
+		}
+	}
+	return slots
+}
+
+// newFeedToken returns the secret of an iCalendar feed.
+func newFeedToken() (string, error) {
+	token := make([]byte, 24)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// GetAppointmentSchedule returns the schedule of a seller with its weekly
+// availability.
+func GetAppointmentSchedule(userID uuid.UUID) (*models.AppointmentSchedule, error) {
+	var schedule models.AppointmentSchedule
+	err := initializers.DB.Preload("Availability", func(db *gorm.DB) *gorm.DB {
+		return db.Order("weekday, start_time")
+	}).Where("user_id = ?", userID).First(&schedule).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrScheduleNotFound
+		}
+		return nil, err
+	}
+	return &schedule, nil
+}
+
+// SaveAppointmentSchedule publishes the schedule of a seller, replacing its
+// weekly availability.
+func SaveAppointmentSchedule(userID uuid.UUID, input ScheduleInput) (*models.AppointmentSchedule, error) {
+	if input.Timezone == "" {
+		input.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(input.Timezone); err != nil {
+		return nil, fmt.Errorf("%w: unknown timezone %q", ErrScheduleInvalid, input.Timezone)
+	}
+	if input.SlotMinutes < 5 || input.SlotMinutes > 8*60 {
+		return nil, fmt.Errorf("%w: slots must last from 5 minutes to 8 hours", ErrScheduleInvalid)
+	}
+	if input.BufferMinutes < 0 || input.BufferMinutes > 4*60 {
+		return nil, fmt.Errorf("%w: the buffer must be from 0 to 4 hours", ErrScheduleInvalid)
+	}
+	if input.HorizonDays <= 0 {
+		input.HorizonDays = 30
+	}
+	if input.HorizonDays > 365 {
+		return nil, fmt.Errorf("%w: appointments can be booked up to 365 days ahead", ErrScheduleInvalid)
+	}
+	if input.Price < 0 {
+		return nil, fmt.Errorf("%w: the price cannot be negative", ErrScheduleInvalid)
+	}
+	for i, a := range input.Availability {
+		if a.Weekday < 0 || a.Weekday > 6 {
+			return nil, fmt.Errorf("%w: invalid weekday %d, 0 is Sunday", ErrScheduleInvalid, a.Weekday)
+		}
+		if _, err := parseWindow(a.Start, a.End); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrScheduleInvalid, err)
+		}
+		input.Availability[i] = models.AppointmentAvailability{UserID: userID, Weekday: a.Weekday, Start: a.Start, End: a.End}
+	}
+	active := true
+	if input.Active != nil {
+		active = *input.Active
+	}
+
+	err := initializers.DB.Transaction(func(tx *gorm.DB) error {
+		var schedule models.AppointmentSchedule
+		err := tx.Where("user_id = ?", userID).First(&schedule).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			token, err := newFeedToken()
+			if err != nil {
+				return err
+			}
+			schedule = models.AppointmentSchedule{UserID: userID, FeedToken: token}
+		} else if err != nil {
+			return err
+		}
+		schedule.Timezone = input.Timezone
+		schedule.SlotMinutes = input.SlotMinutes
+		schedule.BufferMinutes = input.BufferMinutes
+		schedule.HorizonDays = input.HorizonDays
+		schedule.Price = roundMoney(input.Price)
+		schedule.Active = active
+		if err := tx.Omit("Availability").Save(&schedule).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("user_id = ?", userID).Delete(&models.AppointmentAvailability{}).Error; err != nil {
+			return err
+		}
+		if len(input.Availability) > 0 {
+			return tx.Create(&input.Availability).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return GetAppointmentSchedule(userID)
+}
+
+// AddAppointmentException changes the availability of a seller on a date.
+func AddAppointmentException(userID uuid.UUID, exception models.AppointmentException) (*models.AppointmentException, error) {
+	if _, err := time.Parse(appointmentDateFormat, exception.Date); err != nil {
+		return nil, fmt.Errorf("%w: invalid date %q, YYYY-MM-DD is expected", ErrScheduleInvalid, exception.Date)
+	}
+	if exception.Start != "" || exception.End != "" {
+		if _, err := parseWindow(exception.Start, exception.End); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrScheduleInvalid, err)
+		}
+	} else if exception.Available {
+		return nil, fmt.Errorf("%w: an available exception needs a start and an end", ErrScheduleInvalid)
+	}
+	var count int64
+	initializers.DB.Model(&models.AppointmentSchedule{}).Where("user_id = ?", userID).Count(&count)
+	if count == 0 {
+		return nil, ErrScheduleNotFound
+	}
+
+	exception.ID = 0
+	exception.UserID = userID
+	if err := initializers.DB.Create(&exception).Error; err != nil {
+		return nil, err
+	}
+	return &exception, nil
+}
+
+// RotateAppointmentFeed gives the iCalendar feed of a seller a new URL, the
+// old one stops working.
+func RotateAppointmentFeed(userID uuid.UUID) (string, error) {
+	token, err := newFeedToken()
+	if err != nil {
+		return "", err
+	}
+	result := initializers.DB.Model(&models.AppointmentSchedule{}).Where("user_id = ?", userID).Update("feed_token", token)
+	if result.Error != nil {
+		return "", result.Error
+	}
+	if result.RowsAffected == 0 {
+		return "", ErrScheduleNotFound
+	}
+	return token, nil
+}
+
+// AppointmentFeedURL is the URL of the iCalendar feed of a seller.
+func AppointmentFeedURL(token string) string {
+	config, _ := initializers.LoadConfig(".")
+	return strings.TrimRight(config.SERVER_URL, "/") + "/api/appointments/feed/" + token + ".ics"
+}
+
+// loadSlots returns the free slots of a schedule, leaving out the
+// appointment being rescheduled.
+func loadSlots(tx *gorm.DB, schedule *models.AppointmentSchedule, from, to time.Time, except uuid.UUID) []AppointmentSlot {
+	var exceptions []models.AppointmentException
+	tx.Where("user_id = ? AND date BETWEEN ? AND ?", schedule.UserID,
+		from.AddDate(0, 0, -1).Format(appointmentDateFormat), to.AddDate(0, 0, 1).Format(appointmentDateFormat)).
+		Find(&exceptions)
+
+	buffer := time.Duration(schedule.BufferMinutes) * time.Minute
+	var booked []models.Appointment
+	tx.Where("seller_id = ? AND status = ? AND id <> ? AND starts_at < ? AND ends_at > ?",
+		schedule.UserID, models.AppointmentStatusBooked, except, to.Add(buffer), from.Add(-buffer)).
+		Find(&booked)
+
+	now := time.Now()
+	horizon := now.AddDate(0, 0, schedule.HorizonDays)
+	if to.After(horizon) {
+		to = horizon
+	}
+	return AppointmentSlots(schedule, exceptions, booked, from, to, now)
+}
+
+// FreeAppointmentSlots returns the free slots of a seller for the days from
+// a date.
+func FreeAppointmentSlots(sellerID uuid.UUID, from time.Time, days int) (*models.AppointmentSchedule, []AppointmentSlot, error) {
+	schedule, err := GetAppointmentSchedule(sellerID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !schedule.Active {
+		return nil, nil, ErrScheduleNotFound
+	}
+	return schedule, loadSlots(initializers.DB, schedule, from, from.AddDate(0, 0, days), uuid.Nil), nil
+}
+
+// lockSchedule locks the schedule of a seller, so that a slot is booked once.
+func lockSchedule(tx *gorm.DB, sellerID uuid.UUID) (*models.AppointmentSchedule, error) {
+	var schedule models.AppointmentSchedule
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("user_id = ?", sellerID).First(&schedule).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrScheduleNotFound
+		}
+		return nil, err
+	}
+	tx.Where("user_id = ?", sellerID).Find(&schedule.Availability)
+	return &schedule, nil
+}
+
+// findSlot returns the free slot starting at startsAt.
+func findSlot(tx *gorm.DB, schedule *models.AppointmentSchedule, startsAt time.Time, except uuid.UUID) (*AppointmentSlot, error) {
+	for _, slot := range loadSlots(tx, schedule, startsAt.Add(-time.Minute), startsAt.Add(time.Minute), except) {
+		if slot.StartsAt.Equal(startsAt) {
+			return &slot, nil
+		}
+	}
+	return nil, ErrSlotUnavailable
+}
+
+// BookAppointment books the slot of a seller starting at startsAt. The price
+// of the schedule is taken from the balance of the buyer and held until the
+// appointment is over. The meeting room is created at once.
+func BookAppointment(buyerID, sellerID uuid.UUID, startsAt time.Time, note string) (*models.Appointment, error) {
+	if buyerID == sellerID {
+		return nil, ErrAppointmentSelf
+	}
+	var buyer, seller models.User
+	if err := initializers.DB.Where("id = ?", buyerID).First(&buyer).Error; err != nil {
+		return nil, err
+	}
+	if err := initializers.DB.Where("id = ?", sellerID).First(&seller).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrScheduleNotFound
+		}
+		return nil, err
+	}
+
+	suffix := make([]byte, 6)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	appointment := models.Appointment{
+		ID:         uuid.NewV4(),
+		SellerID:   sellerID,
+		BuyerID:    buyerID,
+		Status:     models.AppointmentStatusBooked,
+		Note:       note,
+		MeetRoomID: "appt-" + hex.EncodeToString(suffix),
+	}
+
+	err := initializers.DB.Transaction(func(tx *gorm.DB) error {
+		schedule, err := lockSchedule(tx, sellerID)
+		if err != nil {
+			return err
+		}
+		if !schedule.Active {
+			return ErrScheduleNotFound
+		}
+		slot, err := findSlot(tx, schedule, startsAt.UTC(), uuid.Nil)
+		if err != nil {
+			return err
+		}
+		appointment.StartsAt = slot.StartsAt
+		appointment.EndsAt = slot.EndsAt
+		appointment.Price = schedule.Price
+
+		if appointment.Price > 0 {
+			var balance models.Billing
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+				Where("user_id = ?", buyerID).
+				First(&balance).Error; err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					return ErrInsufficientBalance
+				}
+				return err
+			}
+			if balance.Amount < appointment.Price {
+				return ErrInsufficientBalance
+			}
+			balance.Amount -= appointment.Price
+			if err := tx.Save(&balance).Error; err != nil {
+				return err
+			}
+
+			transaction := models.Transaction{
+				UserID:      buyerID,
+				Amount:      appointment.Price,
+				Status:      "OPENED",
+				Module:      "appointment",
+				Total:       strconv.FormatFloat(appointment.Price, 'f', 2, 64),
+				Description: "Предоплата записи: " + seller.Name + ", " + appointmentWhen(&appointment, schedule.Timezone),
+				Type:        "deduction",
+			}
+			if err := tx.Create(&transaction).Error; err != nil {
+				return err
+			}
+			appointment.TransactionID = transaction.ID
+		}
+		return tx.Create(&appointment).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	openAppointmentRoom(&appointment, &seller, &buyer)
+	go notifyAppointment(&appointment, appointmentBooked)
+	return &appointment, nil
+}
+
+// openAppointmentRoom creates the paxmeet room of an appointment, open until
+// a while after its end.
+func openAppointmentRoom(appointment *models.Appointment, seller, buyer *models.User) {
+	title := "Appointment: " + seller.Name + " & " + buyer.Name
+	emptyTimeout := time.Until(appointment.EndsAt.Add(appointmentRoomGrace))
+	if err := CreatePaxmeetRoom(appointment.MeetRoomID, seller.ID.String(), title, 2, emptyTimeout); err != nil && err != ErrPaxmeetNotConfigured {
+		log.Println("Could not create appointment room:", err)
+	}
+}
+
+// findAppointment returns an appointment of one of its sides.
+func findAppointment(tx *gorm.DB, userID, appointmentID uuid.UUID) (*models.Appointment, error) {
+	var appointment models.Appointment
+	err := tx.Where("id = ? AND (seller_id = ? OR buyer_id = ?)", appointmentID, userID, userID).First(&appointment).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrAppointmentNotFound
+		}
+		return nil, err
+	}
+	return &appointment, nil
+}
+
+// FindAppointment returns an appointment of the user.
+func FindAppointment(userID, appointmentID uuid.UUID) (*models.Appointment, error) {
+	return findAppointment(initializers.DB, userID, appointmentID)
+}
+
+// RescheduleAppointment moves an appointment that did not start to another
+// free slot of the seller, by either side.
+func RescheduleAppointment(userID, appointmentID uuid.UUID, startsAt time.Time) (*models.Appointment, error) {
+	var appointment *models.Appointment
+	err := initializers.DB.Transaction(func(tx *gorm.DB) error {
+		current, err := findAppointment(tx, userID, appointmentID)
+		if err != nil {
+			return err
+		}
+		if current.Status != models.AppointmentStatusBooked || !current.StartsAt.After(time.Now()) {
+			return ErrAppointmentState
+		}
+		schedule, err := lockSchedule(tx, current.SellerID)
+		if err != nil {
+			return err
+		}
+		slot, err := findSlot(tx, schedule, startsAt.UTC(), current.ID)
+		if err != nil {
+			return err
+		}
+
+		current.StartsAt = slot.StartsAt
+		current.EndsAt = slot.EndsAt
+		current.Sequence++
+		current.RemindedAt = nil
+		appointment = current
+		return tx.Model(current).Updates(map[string]interface{}{
+			"starts_at":   current.StartsAt,
+			"ends_at":     current.EndsAt,
+			"sequence":    current.Sequence,
+			"reminded_at": nil,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var seller, buyer models.User
+	initializers.DB.Where("id = ?", appointment.SellerID).First(&seller)
+	initializers.DB.Where("id = ?", appointment.BuyerID).First(&buyer)
+	openAppointmentRoom(appointment, &seller, &buyer)
+	go notifyAppointment(appointment, appointmentRescheduled)
+	return appointment, nil
+}
+
+// CancelAppointment cancels an appointment that did not start, by either
+// side. The prepayment goes back to the buyer.
+func CancelAppointment(userID, appointmentID uuid.UUID) (*models.Appointment, error) {
+	var appointment *models.Appointment
+	err := initializers.DB.Transaction(func(tx *gorm.DB) error {
+		current, err := findAppointment(tx, userID, appointmentID)
+		if err != nil {
+			return err
+		}
+		result := tx.Model(&models.Appointment{}).
+			Where("id = ? AND status = ? AND starts_at > ?", current.ID, models.AppointmentStatusBooked, time.Now()).
+			Updates(map[string]interface{}{
+				"status":       models.AppointmentStatusCancelled,
+				"cancelled_by": userID,
+				"sequence":     gorm.Expr("sequence + 1"),
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrAppointmentState
+		}
+		current.Status = models.AppointmentStatusCancelled
+		current.CancelledBy = &userID
+		current.Sequence++
+		current.UpdatedAt = time.Now()
+		appointment = current
+
+		if current.Price > 0 {
+			if err := creditBalance(tx, current.BuyerID, current.Price); err != nil {
+				return err
+			}
+			return tx.Model(&models.Transaction{}).Where("id = ?", current.TransactionID).Update("status", "CANCELLED").Error
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	go notifyAppointment(appointment, appointmentCancelled)
+	return appointment, nil
+}
+
+// JoinAppointment issues the token a side joins the meeting of a booked
+// appointment with, the seller as admin. A room that closed is opened again.
+func JoinAppointment(userID, appointmentID uuid.UUID) (*AppointmentJoin, error) {
+	appointment, err := FindAppointment(userID, appointmentID)
+	if err != nil {
+		return nil, err
+	}
+	if appointment.Status != models.AppointmentStatusBooked {
+		return nil, ErrAppointmentState
+	}
+
+	var seller, buyer models.User
+	if err := initializers.DB.Where("id = ?", appointment.SellerID).First(&seller).Error; err != nil {
+		return nil, err
+	}
+	if err := initializers.DB.Where("id = ?", appointment.BuyerID).First(&buyer).Error; err != nil {
+		return nil, err
+	}
+	if active, err := PaxmeetRoomActive(appointment.MeetRoomID); err != nil {
+		return nil, err
+	} else if !active {
+		openAppointmentRoom(appointment, &seller, &buyer)
+	}
+
+	user := buyer
+	if userID == seller.ID {
+		user = seller
+	}
+	token, err := PaxmeetJoinToken(appointment.MeetRoomID, PaxmeetUser{
+		ID:      user.ID.String(),
+		Name:    user.Name,
+		Photo:   user.Photo,
+		IsAdmin: user.ID == seller.ID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	config, _ := initializers.LoadConfig(".")
+	return &AppointmentJoin{
+		Appointment: appointment,
+		ServerURL:   config.PaxmeetServerURL,
+		Token:       token,
+		Link:        meetLink(appointment.MeetRoomID),
+	}, nil
+}
+
+// appointmentWhen formats the time of an appointment in a timezone.
+func appointmentWhen(appointment *models.Appointment, timezone string) string {
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		location = time.UTC
+	}
+	return appointment.StartsAt.In(location).Format("Mon, 02 Jan 2006 15:04") + "-" +
+		appointment.EndsAt.In(location).Format("15:04 MST")
+}
+
+// appointmentEvent is the calendar event of an appointment.
+func appointmentEvent(appointment *models.Appointment, seller, buyer *models.User) ICSEvent {
+	config, _ := initializers.LoadConfig(".")
+	stamp := appointment.UpdatedAt
+	if stamp.IsZero() {
+		stamp = time.Now()
+	}
+	description := "Appointment of " + buyer.Name + " with " + seller.Name
+	if appointment.Note != "" {
+		description += "\n" + appointment.Note
+	}
+	return ICSEvent{
+		UID:            appointment.ID.String() + "@myru.online",
+		Summary:        seller.Name + " & " + buyer.Name,
+		Description:    description + "\n" + meetLink(appointment.MeetRoomID),
+		URL:            meetLink(appointment.MeetRoomID),
+		Start:          appointment.StartsAt,
+		End:            appointment.EndsAt,
+		Stamp:          stamp,
+		Sequence:       appointment.Sequence,
+		Cancelled:      appointment.Status == models.AppointmentStatusCancelled,
+		OrganizerName:  seller.Name,
+		OrganizerEmail: config.EmailFrom,
+	}
+}
+
+// AppointmentICS returns the invitation of an appointment, a cancellation
+// once it is cancelled.
+func AppointmentICS(appointment *models.Appointment) []byte {
+	var seller, buyer models.User
+	initializers.DB.Where("id = ?", appointment.SellerID).First(&seller)
+	initializers.DB.Where("id = ?", appointment.BuyerID).First(&buyer)
+	return BuildICS(appointmentICSMethod(appointment), "", []ICSEvent{appointmentEvent(appointment, &seller, &buyer)})
+}
+
+func appointmentICSMethod(appointment *models.Appointment) string {
+	if appointment.Status == models.AppointmentStatusCancelled {
+		return "CANCEL"
+	}
+	return "REQUEST"
+}
+
+// AppointmentFeed returns the iCalendar feed of the seller with the token:
+// the appointments of the last month and the coming ones.
+func AppointmentFeed(token string) ([]byte, error) {
+	if token == "" {
+		return nil, ErrScheduleNotFound
+	}
+	var schedule models.AppointmentSchedule
+	if err := initializers.DB.Where("feed_token = ?", token).First(&schedule).Error; err != nil {
+		return nil, ErrScheduleNotFound
+	}
+	var seller models.User
+	if err := initializers.DB.Where("id = ?", schedule.UserID).First(&seller).Error; err != nil {
+		return nil, err
+	}
+
+	var appointments []models.Appointment
+	initializers.DB.Where("seller_id = ? AND starts_at > ?", seller.ID, time.Now().AddDate(0, -1, 0)).
+		Order("starts_at").Find(&appointments)
+
+	buyerIDs := make([]uuid.UUID, 0, len(appointments))
+	for _, appointment := range appointments {
+		buyerIDs = append(buyerIDs, appointment.BuyerID)
+	}
+	var buyers []models.User
+	initializers.DB.Where("id IN ?", buyerIDs).Find(&buyers)
+	buyersByID := make(map[uuid.UUID]*models.User, len(buyers))
+	for i := range buyers {
+		buyersByID[buyers[i].ID] = &buyers[i]
+	}
+
+	events := make([]ICSEvent, 0, len(appointments))
+	for i := range appointments {
+		buyer, ok := buyersByID[appointments[i].BuyerID]
+		if !ok {
+			buyer = &models.User{Name: "Deleted user"}
+		}
+		events = append(events, appointmentEvent(&appointments[i], &seller, buyer))
+	}
+	return BuildICS("PUBLISH", seller.Name+" appointments", events), nil
+}
+
+const (
+	appointmentBooked      = "booked"
+	appointmentRescheduled = "rescheduled"
+	appointmentCancelled   = "cancelled"
+	appointmentReminder    = "reminder"
+)
+
+// notifyAppointment tells both sides about an appointment by notification,
+// push, Telegram and email with the calendar attached.
+func notifyAppointment(appointment *models.Appointment, kind string) {
+	var seller, buyer models.User
+	if err := initializers.DB.Where("id = ?", appointment.SellerID).First(&seller).Error; err != nil {
+		return
+	}
+	if err := initializers.DB.Where("id = ?", appointment.BuyerID).First(&buyer).Error; err != nil {
+		return
+	}
+	timezone := "UTC"
+	var schedule models.AppointmentSchedule
+	if initializers.DB.Where("user_id = ?", seller.ID).First(&schedule).Error == nil {
+		timezone = schedule.Timezone
+	}
+	when := appointmentWhen(appointment, timezone)
+	link := meetLink(appointment.MeetRoomID)
+	method := appointmentICSMethod(appointment)
+	ics := BuildICS(method, "", []ICSEvent{appointmentEvent(appointment, &seller, &buyer)})
+
+	for _, side := range []struct {
+		user *models.User
+		peer *models.User
+	}{{&seller, &buyer}, {&buyer, &seller}} {
+		var title, message string
+		switch kind {
+		case appointmentBooked:
+			title = "Appointment booked"
+			message = "Your appointment with " + side.peer.Name + " is booked."
+		case appointmentRescheduled:
+			title = "Appointment rescheduled"
+			message = "Your appointment with " + side.peer.Name + " was moved."
+		case appointmentCancelled:
+			title = "Appointment cancelled"
+			message = "Your appointment with " + side.peer.Name + " was cancelled."
+		case appointmentReminder:
+			title = "Appointment soon"
+			message = "Your appointment with " + side.peer.Name + " starts soon."
+		}
+		pageURL := siteURL + "/ru/appointments/" + appointment.ID.String()
+
+		if err := Notification(title, message+" "+when, side.user.ID.String(), pageURL); err != nil {
+			log.Println("Could not create appointment notification:", err)
+		}
+		if side.user.DeviceIOS != "" {
+			if err := Push(title, message+" "+when, side.user.DeviceIOS, pageURL); err != nil {
+				log.Println("Could not push appointment:", err)
+			}
+		}
+		if bot := alertTelegramBot(); bot != nil && side.user.Tid != 0 {
+			text := title + "\n" + message + "\n" + when
+			if kind != appointmentCancelled {
+				text += "\n" + link
+			}
+			if _, err := bot.Send(tgbotapi.NewMessage(side.user.Tid, text)); err != nil {
+				log.Println("Could not send appointment to Telegram:", err)
+			}
+		}
+		if !side.user.IsBot && side.user.Email != "" {
+			mail := &AppointmentMail{
+				Subject:   title,
+				Name:      side.user.Name,
+				Message:   message,
+				When:      when,
+				Link:      link,
+				ICS:       ics,
+				ICSMethod: method,
+			}
+			if kind == appointmentCancelled {
+				mail.Link = ""
+			}
+			SendEmail(side.user, mail, "appointment", "en")
+		}
+	}
+}
+
+// RemindAppointments reminds both sides of the appointments starting within
+// APPOINTMENT_REMINDER_BEFORE.
+func RemindAppointments() {
+	config, _ := initializers.LoadConfig(".")
+	before := config.AppointmentReminderBefore
+	if before <= 0 {
+		before = defaultAppointmentReminderBefore
+	}
+
+	now := time.Now()
+	var appointments []models.Appointment
+	err := initializers.DB.Model(&appointments).
+		Clauses(clause.Returning{}).
+		Where("status = ? AND reminded_at IS NULL AND starts_at > ? AND starts_at <= ?",
+			models.AppointmentStatusBooked, now, now.Add(before)).
+		Update("reminded_at", now).Error
+	if err != nil {
+		log.Println("Could not remind appointments:", err)
+		return
+	}
+	for i := range appointments {
+		go notifyAppointment(&appointments[i], appointmentReminder)
+	}
+}
+
+// CompleteAppointments closes the appointments that are over and pays the
+// sellers the prepayments.
+func CompleteAppointments() {
+	var ids []uuid.UUID
+	initializers.DB.Model(&models.Appointment{}).
+		Where("status = ? AND ends_at <= ?", models.AppointmentStatusBooked, time.Now()).
+		Pluck("id", &ids)
+
+	for _, id := range ids {
+		err := initializers.DB.Transaction(func(tx *gorm.DB) error {
+			var appointments []models.Appointment
+			if err := tx.Model(&appointments).
+				Clauses(clause.Returning{}).
+				Where("id = ? AND status = ?", id, models.AppointmentStatusBooked).
+				Update("status", models.AppointmentStatusCompleted).Error; err != nil {
+				return err
+			}
+			if len(appointments) == 0 || appointments[0].Price <= 0 {
+				return nil
+			}
+			appointment := appointments[0]
+
+			if err := tx.Model(&models.Transaction{}).Where("id = ?", appointment.TransactionID).Update("status", "CLOSED_1").Error; err != nil {
+				return err
+			}
+			// Erased sellers are not paid
+			var sellers int64
+			if err := tx.Model(&models.User{}).Where("id = ?", appointment.SellerID).Count(&sellers).Error; err != nil {
+				return err
+			}
+			if sellers == 0 {
+				return nil
+			}
+			if err := creditBalance(tx, appointment.SellerID, appointment.Price); err != nil {
+				return err
+			}
+			var buyer models.User
+			tx.Where("id = ?", appointment.BuyerID).First(&buyer)
+			return tx.Create(&models.Transaction{
+				UserID:      appointment.SellerID,
+				Amount:      appointment.Price,
+				Status:      "CLOSED_1",
+				Module:      "appointment",
+				Total:       strconv.FormatFloat(appointment.Price, 'f', 2, 64),
+				Description: "Оплата записи: " + buyer.Name,
+				Type:        "addition",
+			}).Error
+		})
+		if err != nil {
+			log.Println("Could not complete appointment:", err)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+
+	"github.com/gofiber/fiber/v2"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// AuditLocalsKey holds the *AuditRecord of a request audited by
+// middleware.Audit.
+const AuditLocalsKey = "audit"
+
+// auditChainLock is the advisory lock serializing appends to the chain.
+const auditChainLock = 0x61756469
+
+// Events of requests without a user, failed logins or registrations, are
+// logged at most this many times a minute per IP and in total, so anonymous
+// traffic cannot flood the chain.
+const (
+	auditAnonymousPerIP     = 10
+	auditAnonymousPerMinute = 300
+	auditAnonymousKeyPrefix = "audit:anonymous:"
+)
+
+var errAuditChainBroken = errors.New("audit chain broken")
+
+// Changed fields whose name contains one of these are logged without value.
+var auditRedactedFields = []string{"password", "token", "secret", "session", "code"}
+
+// AuditRecord collects what a handler knows about its audited action.
+type AuditRecord struct {
+	Action     string
+	TargetType string
+	TargetID   string
+	ActorID    *uuid.UUID
+	Before     interface{}
+	After      interface{}
+}
+
+func currentAudit(c *fiber.Ctx) *AuditRecord {
+	record, _ := c.Locals(AuditLocalsKey).(*AuditRecord)
+	return record
+}
+
+// AuditTarget sets the object the audited request acted on.
+func AuditTarget(c *fiber.Ctx, targetType, targetID string) {
+	if record := currentAudit(c); record != nil {
+		record.TargetType = targetType
+		record.TargetID = targetID
+	}
+}
+
+// AuditActor sets the user of a request made without an access token, e.g.
+// a token refresh.
+func AuditActor(c *fiber.Ctx, userID uuid.UUID) {
+	if record := currentAudit(c); record != nil {
+		record.ActorID = &userID
+	}
+}
+
+// AuditChange records the state of the target before and after the request.
+// Only the fields that differ are logged, before is nil for created and after
+// is nil for deleted objects.
+func AuditChange(c *fiber.Ctx, before, after interface{}) {
+	if record := currentAudit(c); record != nil {
+		record.Before = before
+		record.After = after
+	}
+}
+
+// RecordAudit appends an event to the audit log.
+func RecordAudit(event *models.AuditEvent, before, after interface{}) error {
+	event.Before, event.After = auditDiff(before, after)
+	event.Category = AuditCategory(event.Action)
+	event.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+
+	return initializers.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", auditChainLock).Error; err != nil {
+			return err
+		}
+		var last models.AuditEvent
+		if err := tx.Select("hash").Order("id DESC").Limit(1).Find(&last).Error; err != nil {
+			return err
+		}
+		event.PrevHash = last.Hash
+		event.Hash = auditHash(event)
+		return tx.Create(event).Error
+	})
+}
+
+// AllowAnonymousAudit reports whether an event without an actor from ip is
+// still logged this minute.
+func AllowAnonymousAudit(ip string) bool {
+	if initializers.RedisClient == nil {
+		return true
+	}
+	ctx := context.Background()
+	minute := time.Now().Format("200601021504")
+	limits := map[string]int64{
+		auditAnonymousKeyPrefix + ip + ":" + minute: auditAnonymousPerIP,
+		auditAnonymousKeyPrefix + minute:            auditAnonymousPerMinute,
+	}
+	allowed := true
+	for key, limit := range limits {
+		count, err := initializers.RedisClient.Incr(ctx, key).Result()
+		if err != nil {
+			log.Println("Could not rate limit audit event:", err)
+			continue
+		}
+		if count == 1 {
+			initializers.RedisClient.Expire(ctx, key, time.Minute)
+		}
+		if count > limit {
+			allowed = false
+		}
+	}
+	return allowed
+}
+
+// AuditCategory derives the category from the action name.
+func AuditCategory(action string) string {
+	switch {
+	case strings.HasPrefix(action, "auth."):
+		return models.AuditCategorySecurity
+	case strings.HasPrefix(action, "billing."):
+		return models.AuditCategoryBilling
+	default:
+		return models.AuditCategoryAdmin
+	}
+}
+
+func auditFields(v interface{}) map[string]interface{} {
+	if v == nil || (reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil()) {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return map[string]interface{}{"value": json.RawMessage(data)}
+	}
+	return fields
+}
+
+func auditDiff(before, after interface{}) (datatypes.JSON, datatypes.JSON) {
+	beforeFields, afterFields := auditFields(before), auditFields(after)
+	if beforeFields != nil && afterFields != nil {
+		for key, value := range beforeFields {
+			if other, ok := afterFields[key]; ok && reflect.DeepEqual(value, other) {
+				delete(beforeFields, key)
+				delete(afterFields, key)
+			}
+		}
+	}
+	return auditJSON(beforeFields), auditJSON(afterFields)
+}
+
+func auditJSON(fields map[string]interface{}) datatypes.JSON {
+	if fields == nil {
+		return nil
+	}
+	for key := range fields {
+		name := strings.ToLower(key)
+		for _, redacted := range auditRedactedFields {
+			if strings.Contains(name, redacted) {
+				fields[key] = "[redacted]"
+				break
+			}
+		}
+	}
+	data, _ := json.Marshal(fields)
+	return data
+}
+
+// auditCanonical re-marshals stored JSON, jsonb does not keep the formatting.
+func auditCanonical(data datatypes.JSON) json.RawMessage {
+	if len(data) == 0 {
+		return json.RawMessage("null")
+	}
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return json.RawMessage("null")
+	}
+	canonical, _ := json.Marshal(value)
+	return canonical
+}
+
+func auditHash(event *models.AuditEvent) string {
+	actor := ""
+	if event.ActorID != nil {
+		actor = event.ActorID.String()
+	}
+	payload, _ := json.Marshal([]interface{}{
+		event.PrevHash,
+		actor,
+		event.ActorRole,
+		event.Category,
+		event.Action,
+		event.TargetType,
+		event.TargetID,
+		auditCanonical(event.Before),
+		auditCanonical(event.After),
+		event.Status,
+		event.IP,
+		event.UserAgent,
+		event.RequestID,
+		event.Method,
+		event.Path,
+		event.CreatedAt.UTC().Format(time.RFC3339Nano),
+	})
+	hash := sha256.Sum256(payload)
+	return hex.EncodeToString(hash[:])
+}
+
+// VerifyAuditChain walks the log in order from the last checkpoint and
+// returns the number of events checked and the first event whose hash does
+// not match, if any.
+func VerifyAuditChain() (int64, *models.AuditEvent, error) {
+	var checkpoint models.AuditCheckpoint
+	if err := initializers.DB.Order("id DESC").Limit(1).Find(&checkpoint).Error; err != nil {
+		return 0, nil, err
+	}
+	return verifyAuditEvents(initializers.DB.Where("id > ?", checkpoint.LastEventID), checkpoint.LastHash)
+}
+
+func verifyAuditEvents(query *gorm.DB, prevHash string) (int64, *models.AuditEvent, error) {
+	var checked int64
+	var broken *models.AuditEvent
+
+	var batch []models.AuditEvent
+	err := query.FindInBatches(&batch, 1000, func(tx *gorm.DB, _ int) error {
+		for i := range batch {
+			event := batch[i]
+			if event.PrevHash != prevHash || auditHash(&event) != event.Hash {
+				broken = &event
+				return errAuditChainBroken
+			}
+			prevHash = event.Hash
+			checked++
+		}
+		return nil
+	}).Error
+	if errors.Is(err, errAuditChainBroken) {
+		err = nil
+	}
+	return checked, broken, err
+}
+
+// PruneAuditLog removes the events older than AUDIT_RETENTION. The removed
+// part is verified first and a checkpoint keeps the hash of its last event,
+// so the rest of the chain stays verifiable. A broken chain is kept as it is.
+func PruneAuditLog() {
+	config, _ := initializers.LoadConfig(".")
+	if config.AuditRetention <= 0 {
+		return
+	}
+	if err := pruneAuditLog(time.Now().Add(-config.AuditRetention)); err != nil {
+		log.Println("Could not prune audit log:", err)
+	}
+}
+
+func pruneAuditLog(before time.Time) error {
+	var last models.AuditEvent
+	if err := initializers.DB.Where("created_at < ?", before).Order("id DESC").Limit(1).Find(&last).Error; err != nil {
+		return err
+	}
+	var checkpoint models.AuditCheckpoint
+	if err := initializers.DB.Order("id DESC").Limit(1).Find(&checkpoint).Error; err != nil {
+		return err
+	}
+	if last.ID <= checkpoint.LastEventID {
+		return nil
+	}
+
+	// Old events no longer change, they are checked outside of the lock
+	removed, broken, err := verifyAuditEvents(initializers.DB.Where("id > ? AND id <= ?", checkpoint.LastEventID, last.ID), checkpoint.LastHash)
+	if err != nil {
+		return err
+	}
+	if broken != nil {
+		return fmt.Errorf("%w at event %d", errAuditChainBroken, broken.ID)
+	}
+
+	return initializers.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", auditChainLock).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&models.AuditCheckpoint{
+			LastEventID: last.ID,
+			LastHash:    last.Hash,
+			Removed:     removed,
+			CreatedAt:   time.Now().UTC(),
+		}).Error; err != nil {
+			return err
+		}
+		// Raw SQL, the model refuses deletes made through GORM
+		return tx.Exec("DELETE FROM audit_events WHERE id <= ?", last.ID).Error
+	})
+}
+
+// EnsureAuditAppendOnly makes the database reject changes to logged events
+// and checkpoints, the model hooks only cover writes made through GORM.
+// Events can only be deleted up to the last checkpoint, see PruneAuditLog.
+func EnsureAuditAppendOnly() error {
+	return initializers.DB.Exec(`
+CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION '% is append-only', TG_TABLE_NAME;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION audit_events_checkpointed_delete() RETURNS trigger AS $$
+BEGIN
+	IF OLD.id > COALESCE((SELECT max(last_event_id) FROM audit_checkpoints), 0) THEN
+		RAISE EXCEPTION 'audit_events can only be removed up to a checkpoint';
+	END IF;
+	RETURN OLD;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events;
+CREATE TRIGGER audit_events_append_only BEFORE UPDATE OR TRUNCATE ON audit_events
+	FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only();
+
+DROP TRIGGER IF EXISTS audit_events_checkpointed_delete ON audit_events;
+CREATE TRIGGER audit_events_checkpointed_delete BEFORE DELETE ON audit_events
+	FOR EACH ROW EXECUTE FUNCTION audit_events_checkpointed_delete();
+
+DROP TRIGGER IF EXISTS audit_checkpoints_append_only ON audit_checkpoints;
+CREATE TRIGGER audit_checkpoints_append_only BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_checkpoints
+	FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only();
+`).Error
+}
@@ -0,0 +1,257 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Public files are stored under blobPublicPrefix and served as they are,
+// private files under blobPrivatePrefix are only reachable by signed links.
+const (
+	blobPublicPrefix  = "blobs/"
+	blobPrivatePrefix = "private/"
+)
+
+var ErrStorageQuota = errors.New("storage limit of the plan reached")
+
+// BlobKey is the content address of data.
+func BlobKey(data []byte, ext string, private bool) string {
+	hash := sha256.Sum256(data)
+	hashStr := hex.EncodeToString(hash[:])
+	prefix := blobPublicPrefix
+	if private {
+		prefix = blobPrivatePrefix
+	}
+	return prefix + hashStr[:2] + "/" + hashStr + ext
+}
+
+// StoreBlob saves data under its content address and charges it to the
+// quota of the user. Uploading a file the user already holds is free, a file
+// another user holds is shared and stored once.
+func StoreBlob(userID uuid.UUID, data []byte, ext, contentType string, private bool) (string, error) {
+	key := BlobKey(data, ext, private)
+	size := int64(len(data))
+
+	err := initializers.DB.Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "limit_storage", "storage_used").
+			Where("id = ?", userID).First(&user).Error; err != nil {
+			return err
+		}
+
+		var held int64
+		tx.Model(&models.UserBlob{}).Where("user_id = ? AND blob_key = ?", userID, key).Count(&held)
+		if held > 0 {
+			return nil
+		}
+
+		if user.StorageUsed+size > int64(user.LimitStorage)*1024*1024 {
+			return ErrStorageQuota
+		}
+
+		blob := models.Blob{Key: key, Size: size, ContentType: contentType, Private: private, RefCount: 1}
+		if err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "key"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{"ref_count": gorm.Expr("blobs.ref_count + 1")}),
+		}).Create(&blob).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&models.UserBlob{UserID: userID, BlobKey: key}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.User{}).Where("id = ?", userID).
+			Update("storage_used", gorm.Expr("storage_used + ?", size)).Error
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// Content addressed, so writing again is harmless and repairs a file
+	// lost from the store
+	if err := Blobs().Put(key, data, contentType); err != nil {
+		ReleaseBlob(userID, key)
+		return "", err
+	}
+	return key, nil
+}
+
+// maxRemoteBlobSize limits files fetched by StoreRemoteBlob.
+const maxRemoteBlobSize = 10 * 1024 * 1024
+
+// StoreRemoteBlob downloads a file, e.g. a Telegram avatar, and stores it for
+// the user like an upload.
+func StoreRemoteBlob(userID uuid.UUID, fileURL string) (string, error) {
+	resp, err := remoteBlobClient.Get(fileURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download failed: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteBlobSize))
+	if err != nil {
+		return "", err
+	}
+	return StoreBlob(userID, data, strings.ToLower(path.Ext(fileURL)), http.DetectContentType(data), false)
+}
+
+var remoteBlobClient = &http.Client{Timeout: 30 * time.Second}
+
+// ReadBlob returns the content of a stored file.
+func ReadBlob(key string) ([]byte, error) {
+	reader, err := Blobs().Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// ReleaseBlob drops the reference of the user to a file and deletes the file
+// once nobody holds it. Files stored before blobs were tracked are deleted
+// straight away when they are in the storage directory of the user.
+func ReleaseBlob(userID uuid.UUID, key string) error {
+	if key == "" {
+		return nil
+	}
+
+	var blob models.Blob
+	if err := initializers.DB.Where("key = ?", key).First(&blob).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			if !inUserStorage(userID, key) {
+				return nil
+			}
+			return Blobs().Delete(key)
+		}
+		return err
+	}
+
+	return initializers.DB.Transaction(func(tx *gorm.DB) error {
+		released := tx.Where("user_id = ? AND blob_key = ?", userID, key).Delete(&models.UserBlob{})
+		if released.Error != nil || released.RowsAffected == 0 {
+			return released.Error
+		}
+
+		if err := tx.Model(&models.User{}).Where("id = ?", userID).
+			Update("storage_used", gorm.Expr("GREATEST(storage_used - ?, 0)", blob.Size)).Error; err != nil {
+			return err
+		}
+
+		// The row stays locked until the file is gone, so a concurrent upload
+		// of the same content waits and writes it again
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("key = ?", key).First(&blob).Error; err != nil {
+			return err
+		}
+		if blob.RefCount > 1 {
+			return tx.Model(&blob).Update("ref_count", gorm.Expr("ref_count - 1")).Error
+		}
+		if err := tx.Delete(&blob).Error; err != nil {
+			return err
+		}
+		return Blobs().Delete(key)
+	})
+}
+
+// inUserStorage reports whether key is in the storage directory of the user,
+// where files were kept before blobs were tracked.
+func inUserStorage(userID uuid.UUID, key string) bool {
+	var user models.User
+	if err := initializers.DB.Select("id", "storage").Where("id = ?", userID).First(&user).Error; err != nil || user.Storage == "" {
+		return false
+	}
+	clean := path.Clean("/" + key)
+	return strings.HasPrefix(clean, "/"+strings.Trim(user.Storage, "/")+"/")
+}
+
+// ReleaseUserBlobs drops every file held by a user, used when the account is
+// deleted.
+func ReleaseUserBlobs(userID uuid.UUID) {
+	var keys []string
+	initializers.DB.Model(&models.UserBlob{}).Where("user_id = ?", userID).Pluck("blob_key", &keys)
+	for _, key := range keys {
+		if err := ReleaseBlob(userID, key); err != nil {
+			log.Println("Could not release blob:", err)
+		}
+	}
+}
+
+// StoredFileInUse reports whether a post, a revision, the profile or the
+// avatar of the user still references a stored file.
+func StoredFileInUse(userID uuid.UUID, path string) bool {
+	filesJSON, _ := json.Marshal([]models.RevisionFile{{Path: path}})
+	photosJSON, _ := json.Marshal([]map[string]interface{}{{"files": []models.RevisionFile{{Path: path}}}})
+	documentsJSON, _ := json.Marshal([]map[string]string{{"filename": path}})
+
+	var count int64
+	initializers.DB.Model(&models.BlogPhoto{}).
+		Joins("JOIN blogs ON blogs.id = blog_photos.blog_id").
+		Where("blogs.user_id = ? AND blog_photos.files @> ?", userID, string(filesJSON)).Count(&count)
+	if count > 0 {
+		return true
+	}
+
+	initializers.DB.Model(&models.BlogRevision{}).
+		Joins("JOIN blogs ON blogs.id = blog_revisions.blog_id").
+		Where("blogs.user_id = ? AND blog_revisions.photos @> ?", userID, string(photosJSON)).Count(&count)
+	if count > 0 {
+		return true
+	}
+
+	initializers.DB.Model(&models.ProfilePhoto{}).
+		Joins("JOIN profiles ON profiles.id = profile_photos.profile_id").
+		Where("profiles.user_id = ? AND profile_photos.files @> ?", userID, string(filesJSON)).Count(&count)
+	if count > 0 {
+		return true
+	}
+
+	initializers.DB.Model(&models.ProfileDocuments{}).
+		Joins("JOIN profiles ON profiles.id = profile_documents.profile_id").
+		Where("profiles.user_id = ? AND profile_documents.files @> ?", userID, string(documentsJSON)).Count(&count)
+	if count > 0 {
+		return true
+	}
+
+	initializers.DB.Model(&models.User{}).Where("id = ? AND photo = ?", userID, path).Count(&count)
+	return count > 0
+}
+
+// BackfillStorageUsage charges the files a user stored before blobs were
+// tracked, walking the storage directory once per user.
+func BackfillStorageUsage() {
+	config, _ := initializers.LoadConfig(".")
+
+	var users []models.User
+	initializers.DB.Select("id", "storage").Where("storage_used = 0 AND storage <> ''").Find(&users)
+	for _, user := range users {
+		var size int64
+		filepath.Walk(filepath.Join(config.IMGStorePath, user.Storage), func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				size += info.Size()
+			}
+			return nil
+		})
+		if size > 0 {
+			initializers.DB.Model(&models.User{}).Where("id = ?", user.ID).Update("storage_used", size)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalBlobStorePrivateRoot(t *testing.T) {
+	dir := t.TempDir()
+	store := &LocalBlobStore{
+		Root:        filepath.Join(dir, "img-store"),
+		PrivateRoot: filepath.Join(dir, "private-store"),
+	}
+
+	public := BlobKey([]byte("photo"), ".jpg", false)
+	private := BlobKey([]byte("passport"), ".pdf", true)
+	for _, key := range []string{public, private} {
+		if err := store.Put(key, []byte(key), "application/octet-stream"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(store.Root, public)); err != nil {
+		t.Error("public blob is not in the public root:", err)
+	}
+	if _, err := os.Stat(filepath.Join(store.Root, private)); !os.IsNotExist(err) {
+		t.Error("private blob is in the public root")
+	}
+	if _, err := os.Stat(filepath.Join(store.PrivateRoot, private)); err != nil {
+		t.Error("private blob is not in the private root:", err)
+	}
+
+	// Keys escaping the private prefix stay in the public root
+	if path, _ := store.path("private/../blobs/x.jpg"); !strings.HasPrefix(path, store.Root) {
+		t.Errorf("path = %s, want it under %s", path, store.Root)
+	}
+}
+
+// TestS3BlobStoreMinIO runs the S3 driver against a MinIO server. It runs
+// when S3_TEST_ENDPOINT is set, for example with
+//
+//	docker run -p 9000:9000 -e MINIO_ROOT_USER=minio -e MINIO_ROOT_PASSWORD=minio123 \
+//		minio/minio server /data
+//	S3_TEST_ENDPOINT=http://localhost:9000 S3_TEST_ACCESS_KEY=minio \
+//		S3_TEST_SECRET_KEY=minio123 go test ./utils -run MinIO
+//
+// The bucket S3_TEST_BUCKET, "myru-test" by default, is created when
+// missing.
+func TestS3BlobStoreMinIO(t *testing.T) {
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT is not set")
+	}
+	bucket := os.Getenv("S3_TEST_BUCKET")
+	if bucket == "" {
+		bucket = "myru-test"
+	}
+	store := &S3BlobStore{
+		Endpoint:  strings.TrimSuffix(endpoint, "/"),
+		Region:    os.Getenv("S3_TEST_REGION"),
+		Bucket:    bucket,
+		AccessKey: os.Getenv("S3_TEST_ACCESS_KEY"),
+		SecretKey: os.Getenv("S3_TEST_SECRET_KEY"),
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+
+	// Creating the bucket is a PUT on its path, an existing one answers 409
+	resp, err := store.do(http.MethodPut, "", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusConflict {
+		t.Fatal("create bucket:", s3Error(resp))
+	}
+
+	data := []byte("signed " + time.Now().String())
+	// Keys with characters that need escaping exercise the canonical path
+	key := "private/te st/" + BlobKey(data, ".txt", true)[len(blobPrivatePrefix):]
+
+	if err := store.Put(key, data, "text/plain"); err != nil {
+		t.Fatal("put:", err)
+	}
+	defer store.Delete(key)
+
+	exists, err := store.Exists(key)
+	if err != nil || !exists {
+		t.Fatalf("exists = %v, %v", exists, err)
+	}
+
+	reader, err := store.Get(key)
+	if err != nil {
+		t.Fatal("get:", err)
+	}
+	got, _ := io.ReadAll(reader)
+	reader.Close()
+	if !bytes.Equal(got, data) {
+		t.Errorf("get = %q, want %q", got, data)
+	}
+
+	link, err := store.SignedURL(key, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := http.Get(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ = io.ReadAll(signed.Body)
+	signed.Body.Close()
+	if signed.StatusCode != http.StatusOK || !bytes.Equal(got, data) {
+		t.Errorf("signed link answered %d %q", signed.StatusCode, got)
+	}
+
+	// A tampered signature is refused
+	tampered, err := http.Get(strings.Replace(link, "X-Amz-Expires=60", "X-Amz-Expires=61", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered.Body.Close()
+	if tampered.StatusCode != http.StatusForbidden {
+		t.Errorf("tampered link answered %d", tampered.StatusCode)
+	}
+
+	if err := store.Delete(key); err != nil {
+		t.Fatal("delete:", err)
+	}
+	if _, err := store.Get(key); err != ErrBlobNotFound {
+		t.Errorf("get after delete = %v, want ErrBlobNotFound", err)
+	}
+}
@@ -6,14 +6,33 @@ import (
 	"hyperpage/models"
 
 	"log"
-	"os"
-	"path/filepath"
 	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	uuid "github.com/satori/go.uuid"
 )
 
+// legacyTelegramChannel is the channel posts went to before syndication,
+// its message ID is kept in Blog.TmId.
+const legacyTelegramChannel = -1001638837209
+
+// unsyndicateBlog takes down the cross-posted messages of a post. Posts from
+// before syndication only have the message in the legacy channel.
+func unsyndicateBlog(bot *tgbotapi.BotAPI, blog *models.Blog) {
+	InvalidateSEOCache()
+
+	var count int64
+	initializers.DB.Model(&models.BlogSyndication{}).Where("blog_id = ?", blog.ID).Count(&count)
+	if count > 0 {
+		SyndicateBlog(blog.ID, models.SyndicationActionDelete)
+		return
+	}
+
+	if blog.TmId != 0 {
+		bot.Send(tgbotapi.NewDeleteMessage(legacyTelegramChannel, int(blog.TmId)))
+	}
+}
+
 func MoveToArch(bot *tgbotapi.BotAPI) {
 	configPath := "./app.env"
 	config, _ := initializers.LoadConfig(configPath)
@@ -22,13 +41,10 @@ func MoveToArch(bot *tgbotapi.BotAPI) {
 	initializers.DB.Where("expired_At < ?", time.Now()).Where("status = ?", "ACTIVE").Find(&blogs)
 
 	for _, blog := range blogs {
-		tmid := int(blog.TmId)
-		deleteMsg := tgbotapi.NewDeleteMessage(-1001638837209, tmid)
-		bot.Send(deleteMsg)
-
 		// initializers.DB.Delete(&blog)
 		blog.Status = "ARCHIVED"
 		initializers.DB.Save(&blog)
+		unsyndicateBlog(bot, &blog)
 		// Get the user_id from the blog record
 		userID := blog.UserID
 		// Fetch the corresponding user's data from the users table
@@ -86,8 +102,6 @@ func MoveToArch(bot *tgbotapi.BotAPI) {
 	}
 }
 func CheckExpiration(bot *tgbotapi.BotAPI) {
-	config, _ := initializers.LoadConfig(".")
-
 	var blogs []models.Blog
 
 	var transaction []models.Transaction
@@ -95,17 +109,17 @@ func CheckExpiration(bot *tgbotapi.BotAPI) {
 	initializers.DB.Where("expired_At < ?", time.Now()).Where("status = ?", "ACTIVE").Find(&blogs)
 
 	var blogIDs []uint
+	owners := make(map[uint64]uuid.UUID)
 	for _, blog := range blogs {
 		blogIDs = append(blogIDs, uint(blog.ID))
+		owners[blog.ID] = blog.UserID
 	}
 
 	var blogPhotos []models.BlogPhoto
 	initializers.DB.Where("blog_id IN (?)", blogIDs).Find(&blogPhotos)
 
 	for _, photo := range blogPhotos {
-		var files []struct {
-			Path string `json:"path"`
-		}
+		var files []models.PhotoFile
 
 		data, err := photo.Files.Value()
 		if err != nil {
@@ -119,16 +133,13 @@ func CheckExpiration(bot *tgbotapi.BotAPI) {
 			continue
 		}
 
-		for _, file := range files {
-			dst := filepath.Join(config.IMGStorePath, file.Path)
-			err := os.Remove(dst)
-			if err != nil {
-				// Handle error if file removal fails
-			}
-		}
 		// Delete the blog_photos record
 		initializers.DB.Delete(&photo)
 
+		for _, file := range files {
+			DeletePhotoFileIfUnused(owners[photo.BlogID], file)
+		}
+
 	}
 	// Delete the blogs records
 
@@ -136,9 +147,7 @@ func CheckExpiration(bot *tgbotapi.BotAPI) {
 
 	for _, blog := range blogs {
 
-		tmid := int(blog.TmId)
-		deleteMsg := tgbotapi.NewDeleteMessage(-1001638837209, tmid)
-		bot.Send(deleteMsg)
+		unsyndicateBlog(bot, &blog)
 
 		initializers.DB.Delete(&blog)
 	}
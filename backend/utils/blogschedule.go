@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"log"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+)
+
+// BlogExpiry returns the expiry date of a post published at from. A period of
+// 10 days stands for the unlimited plan and lasts 10 years.
+func BlogExpiry(days int, from time.Time) time.Time {
+	if days == 10 {
+		return from.AddDate(10, 0, 0)
+	}
+	return from.AddDate(0, 0, days)
+}
+
+// PublishBlog publishes a draft or scheduled post. The post goes through the
+// same moderation as a newly created one and its expiry date is counted from
+// now.
+func PublishBlog(blog *models.Blog) ([]ModerationFlag, error) {
+	var author models.User
+	if err := initializers.DB.Where("id = ?", blog.UserID).First(&author).Error; err != nil {
+		return nil, err
+	}
+
+	if blog.Photos == nil {
+		initializers.DB.Where("blog_id = ?", blog.ID).Find(&blog.Photos)
+	}
+
+	flags := RunModerationChecks(blog)
+	if len(flags) > 0 || !IsTrustedAuthor(&author) {
+		blog.Status = models.BlogStatusPending
+	} else {
+		blog.Status = models.BlogStatusActive
+	}
+
+	now := time.Now()
+	expiry := BlogExpiry(blog.Days, now)
+	blog.PublishAt = &now
+	blog.ExpiredAt = &expiry
+
+	if err := initializers.DB.Model(&models.Blog{}).Where("id = ?", blog.ID).Updates(map[string]interface{}{
+		"status":     blog.Status,
+		"publish_at": blog.PublishAt,
+		"expired_at": blog.ExpiredAt,
+	}).Error; err != nil {
+		return nil, err
+	}
+
+	if len(flags) > 0 {
+		FlagBlogForReview(blog, flags)
+	} else if blog.Status == models.BlogStatusActive {
+		RecordBlogImageHashes(blog)
+		go MatchSavedSearches(blog.ID)
+		InvalidateSEOCache()
+		go SyndicateBlog(blog.ID, models.SyndicationActionPost)
+	}
+	return flags, nil
+}
+
+// PublishScheduledBlogs publishes the scheduled posts whose time has come.
+func PublishScheduledBlogs() {
+	var blogs []models.Blog
+	if err := initializers.DB.Where("status = ? AND publish_at <= ?", models.BlogStatusScheduled, time.Now()).
+		Preload("Photos").
+		Find(&blogs).Error; err != nil {
+		log.Println("Could not load scheduled blogs:", err)
+		return
+	}
+
+	for i := range blogs {
+		if _, err := PublishBlog(&blogs[i]); err != nil {
+			log.Printf("Could not publish scheduled blog %d: %s", blogs[i].ID, err)
+		}
+	}
+}
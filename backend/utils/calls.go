@@ -0,0 +1,605 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+	"hyperpage/realtime"
+
+	"github.com/redis/go-redis/v9"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// An unanswered call is missed after this long.
+	CallRingTimeout = 45 * time.Second
+	// call:busy:<user> is the active call of a user, call:offer:<call> the
+	// SDP offer of the caller and call:ice:<call> the candidates the caller
+	// trickled before the call was accepted.
+	callBusyKeyPrefix  = "call:busy:"
+	callOfferKeyPrefix = "call:offer:"
+	callIceKeyPrefix   = "call:ice:"
+	// Longest a call keeps its users busy, calls whose sessions are gone are
+	// ended by the sweep long before.
+	callBusyTTL = CallMaxDuration
+)
+
+// CallMaxDuration is the longest a call lasts, TURN credentials of calls
+// are not issued for longer.
+const CallMaxDuration = 4 * time.Hour
+
+var (
+	ErrCallNotFound = errors.New("call not found")
+	ErrCallState    = errors.New("the call is already answered or over")
+	ErrCallSelf     = errors.New("you cannot call yourself")
+	ErrCallerBusy   = errors.New("you are already in a call")
+	ErrCallSession  = errors.New("the call is signaled on another device")
+)
+
+var (
+	ringingCallStates = []string{models.CallStateInitiated, models.CallStateRinging}
+	activeCallStates  = []string{models.CallStateInitiated, models.CallStateRinging, models.CallStateAccepted}
+)
+
+// releaseCallScript deletes a busy key only while it holds the given call.
+var releaseCallScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+func callBusyKey(userID uuid.UUID) string {
+	return callBusyKeyPrefix + userID.String()
+}
+
+// lockCallUser marks the user busy with the call. A key left by a call that
+// is over is taken over.
+func lockCallUser(ctx context.Context, userID, callID uuid.UUID) (bool, error) {
+	key := callBusyKey(userID)
+	for attempt := 0; attempt < 2; attempt++ {
+		ok, err := initializers.RedisClient.SetNX(ctx, key, callID.String(), callBusyTTL).Result()
+		if err != nil || ok {
+			return ok, err
+		}
+
+		held, err := initializers.RedisClient.Get(ctx, key).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		var active int64
+		initializers.DB.Model(&models.Call{}).
+			Where("id = ? AND state IN ?", held, activeCallStates).Count(&active)
+		if active > 0 {
+			return false, nil
+		}
+		releaseCallScript.Run(ctx, initializers.RedisClient, []string{key}, held)
+	}
+	return false, nil
+}
+
+func unlockCallUser(ctx context.Context, userID, callID uuid.UUID) {
+	if err := releaseCallScript.Run(ctx, initializers.RedisClient, []string{callBusyKey(userID)}, callID.String()).Err(); err != nil {
+		log.Println("Could not release call lock:", err)
+	}
+}
+
+// CallView is the realtime representation of a call.
+func CallView(call *models.Call) realtime.Call {
+	return realtime.Call{
+		ID:       call.ID.String(),
+		CallerID: call.CallerID.String(),
+		CalleeID: call.CalleeID.String(),
+		Video:    call.Video,
+		State:    call.State,
+	}
+}
+
+// FindCall returns a call of the user.
+func FindCall(userID, callID uuid.UUID) (*models.Call, error) {
+	var call models.Call
+	err := initializers.DB.Where("id = ? AND (caller_id = ? OR callee_id = ?)", callID, userID, userID).First(&call).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrCallNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &call, nil
+}
+
+// transitionCall moves the calls of the query in one of the from states by
+// applying the updates. The states are checked by the update itself, so of
+// racing transitions on several nodes only the first applies. It returns nil
+// when none did.
+func transitionCall(query *gorm.DB, from []string, updates map[string]interface{}) (*models.Call, error) {
+	var calls []models.Call
+	result := query.Model(&calls).Clauses(clause.Returning{}).Where("state IN ?", from).Updates(updates)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if len(calls) == 0 {
+		return nil, nil
+	}
+	return &calls[0], nil
+}
+
+// transitionError tells why a transition of the call did not apply.
+func transitionError(userID, callID uuid.UUID) error {
+	if _, err := FindCall(userID, callID); err != nil {
+		return err
+	}
+	return ErrCallState
+}
+
+// StartCall calls a user from a session of the caller. Every device of the
+// callee rings, over the websocket and with a VoIP push. A callee already in
+// a call makes it busy at once, an unanswered one is missed after
+// CallRingTimeout. Calls to sellers reserve the consultation from the
+// balance of the caller first.
+func StartCall(callerID uuid.UUID, session string, calleeID uuid.UUID, video bool, sdp string) (*models.Call, error) {
+	if callerID == calleeID {
+		return nil, ErrCallSelf
+	}
+	var caller, callee models.User
+	if err := initializers.DB.Where("id = ?", callerID).First(&caller).Error; err != nil {
+		return nil, err
+	}
+	if err := initializers.DB.Where("id = ?", calleeID).First(&callee).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrCallNotFound
+		}
+		return nil, err
+	}
+
+	ctx := context.Background()
+	call := models.Call{
+		ID:            uuid.NewV4(),
+		CallerID:      callerID,
+		CalleeID:      calleeID,
+		Video:         video,
+		State:         models.CallStateInitiated,
+		CallerSession: session,
+	}
+	locked, err := lockCallUser(ctx, callerID, call.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !locked {
+		return nil, ErrCallerBusy
+	}
+
+	free, err := lockCallUser(ctx, calleeID, call.ID)
+	if err != nil {
+		unlockCallUser(ctx, callerID, call.ID)
+		return nil, err
+	}
+	if !free {
+		// Recorded in the history of both, the callee is not disturbed
+		now := time.Now()
+		call.State = models.CallStateBusy
+		call.EndedAt = &now
+		unlockCallUser(ctx, callerID, call.ID)
+		if err := initializers.DB.Create(&call).Error; err != nil {
+			return nil, err
+		}
+		return &call, nil
+	}
+
+	// Calls to sellers with a rate are paid, the caller must afford a minute
+	rate := consultationRateOf(&caller, &callee)
+	if rate != nil {
+		if err := reserveConsultation(&call, &caller, &callee, rate); err != nil {
+			unlockCallUser(ctx, callerID, call.ID)
+			unlockCallUser(ctx, calleeID, call.ID)
+			return nil, err
+		}
+	}
+
+	if err := initializers.DB.Create(&call).Error; err != nil {
+		unlockCallUser(ctx, callerID, call.ID)
+		unlockCallUser(ctx, calleeID, call.ID)
+		if rate != nil {
+			settleConsultation(&call)
+		}
+		return nil, err
+	}
+	if sdp != "" {
+		initializers.RedisClient.Set(ctx, callOfferKeyPrefix+call.ID.String(), sdp, 2*CallRingTimeout)
+	}
+
+	ringCall(&call, &caller, &callee, sdp)
+	time.AfterFunc(CallRingTimeout, func() {
+		missCall(call.ID)
+	})
+	return &call, nil
+}
+
+// ringCall reaches the devices of the callee, the call rings once one of
+// them is.
+func ringCall(call *models.Call, caller, callee *models.User, sdp string) {
+	event := realtime.CallRingEvent{Call: CallView(call), CallerName: caller.Name, CallerPhoto: caller.Photo}
+	event.State = models.CallStateRinging
+	event.SDP = sdp
+
+	delivered, err := SocketHub.SendToUser(callee.ID.String(), Message{Event: realtime.EventCallRing, Data: event})
+	if err != nil {
+		log.Println("Could not ring the callee:", err)
+	}
+	if delivered > 0 {
+		if updated := markCallRinging(call.ID); updated != nil {
+			call.State = updated.State
+			call.RingingAt = updated.RingingAt
+		}
+	}
+
+	if callee.DeviceIOSVOIP == "" {
+		return
+	}
+	callID := call.ID
+	payload, _ := json.Marshal(map[string]interface{}{
+		"aps":        map[string]interface{}{},
+		"callId":     callID.String(),
+		"callerId":   caller.ID.String(),
+		"callerName": caller.Name,
+		"video":      call.Video,
+		"state":      models.CallStateRinging,
+	})
+	go func() {
+		if err := VoipCall(callee.DeviceIOSVOIP, string(payload)); err != nil {
+			log.Println("Could not send VoIP push:", err)
+			return
+		}
+		markCallRinging(callID)
+	}()
+}
+
+func markCallRinging(callID uuid.UUID) *models.Call {
+	updated, err := transitionCall(initializers.DB.Where("id = ?", callID), []string{models.CallStateInitiated},
+		map[string]interface{}{"state": models.CallStateRinging, "ringing_at": time.Now()})
+	if err != nil {
+		log.Println("Could not update call:", err)
+	}
+	return updated
+}
+
+// AcceptCall answers a ringing call on a session of the callee. The caller
+// gets the answer, the other devices of the callee stop ringing. It returns
+// the offer of the caller, empty when it did not send one yet.
+func AcceptCall(userID uuid.UUID, session string, callID uuid.UUID, sdp string) (*models.Call, string, error) {
+	call, err := transitionCall(initializers.DB.Where("id = ? AND callee_id = ?", callID, userID), ringingCallStates,
+		map[string]interface{}{"state": models.CallStateAccepted, "callee_session": session, "answered_at": time.Now()})
+	if err != nil {
+		return nil, "", err
+	}
+	if call == nil {
+		return nil, "", transitionError(userID, callID)
+	}
+
+	startConsultation(call)
+
+	ctx := context.Background()
+	offer, _ := initializers.RedisClient.Get(ctx, callOfferKeyPrefix+call.ID.String()).Result()
+
+	sendToCaller(call, Message{
+		Event: realtime.EventCallAccepted,
+		Data:  realtime.CallAcceptedEvent{CallID: call.ID.String(), Session: session, SDP: sdp},
+	})
+	ended := Message{
+		Event: realtime.EventCallAnsweredElsewhere,
+		Data:  realtime.CallEndedEvent{CallID: call.ID.String(), State: call.State},
+	}
+	if _, err := SocketHub.SendToOtherSessions(userID.String(), session, ended); err != nil {
+		log.Println("Could not stop the other devices ringing:", err)
+	}
+	stopVoipRinging(call)
+
+	// Candidates the caller trickled while it rang
+	iceKey := callIceKeyPrefix + call.ID.String()
+	candidates, _ := initializers.RedisClient.LRange(ctx, iceKey, 0, -1).Result()
+	for _, raw := range candidates {
+		var candidate realtime.IceCandidate
+		if json.Unmarshal([]byte(raw), &candidate) != nil {
+			continue
+		}
+		SocketHub.Send(session, Message{
+			Event: realtime.EventCallSignal,
+			Data:  realtime.CallSignalEvent{CallID: call.ID.String(), Candidate: &candidate},
+		})
+	}
+	initializers.RedisClient.Del(ctx, iceKey, callOfferKeyPrefix+call.ID.String())
+	return call, offer, nil
+}
+
+// RejectCall declines a ringing call, from any device of the callee.
+func RejectCall(userID, callID uuid.UUID) (*models.Call, error) {
+	call, err := transitionCall(initializers.DB.Where("id = ? AND callee_id = ?", callID, userID), ringingCallStates,
+		map[string]interface{}{"state": models.CallStateRejected, "ended_at": time.Now()})
+	if err != nil {
+		return nil, err
+	}
+	if call == nil {
+		return nil, transitionError(userID, callID)
+	}
+	finishCall(call)
+	return call, nil
+}
+
+// EndCall hangs up a call in progress. A caller hanging up before the answer
+// leaves a missed call.
+func EndCall(userID, callID uuid.UUID) (*models.Call, error) {
+	now := time.Now()
+	call, err := transitionCall(initializers.DB.Where("id = ? AND (caller_id = ? OR callee_id = ?)", callID, userID, userID),
+		[]string{models.CallStateAccepted},
+		map[string]interface{}{
+			"state":    models.CallStateEnded,
+			"ended_at": now,
+			"duration": gorm.Expr("GREATEST(EXTRACT(EPOCH FROM ? - answered_at)::int, 0)", now),
+		})
+	if err != nil {
+		return nil, err
+	}
+	if call == nil {
+		call, err = transitionCall(initializers.DB.Where("id = ? AND caller_id = ?", callID, userID), ringingCallStates,
+			map[string]interface{}{"state": models.CallStateMissed, "ended_at": now})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if call == nil {
+		return nil, transitionError(userID, callID)
+	}
+	finishCall(call)
+	return call, nil
+}
+
+// missCall ends a call still ringing after CallRingTimeout.
+func missCall(callID uuid.UUID) {
+	call, err := transitionCall(initializers.DB.Where("id = ?", callID), ringingCallStates,
+		map[string]interface{}{"state": models.CallStateMissed, "ended_at": time.Now()})
+	if err != nil {
+		log.Println("Could not expire call:", err)
+		return
+	}
+	if call != nil {
+		finishCall(call)
+	}
+}
+
+// SignalCall relays an SDP or an ICE candidate of one side of a call to the
+// other. Candidates of the caller are kept until a device accepts.
+func SignalCall(userID uuid.UUID, session string, callID uuid.UUID, sdp string, candidate *realtime.IceCandidate) error {
+	call, err := FindCall(userID, callID)
+	if err != nil {
+		return err
+	}
+	if !call.Active() {
+		return ErrCallState
+	}
+	event := Message{
+		Event: realtime.EventCallSignal,
+		Data:  realtime.CallSignalEvent{CallID: call.ID.String(), SDP: sdp, Candidate: candidate},
+	}
+
+	if call.CallerID == userID {
+		if call.CallerSession != session {
+			return ErrCallSession
+		}
+		if call.State == models.CallStateAccepted {
+			return SocketHub.Send(call.CalleeSession, event)
+		}
+
+		ctx := context.Background()
+		if sdp != "" {
+			initializers.RedisClient.Set(ctx, callOfferKeyPrefix+call.ID.String(), sdp, 2*CallRingTimeout)
+		}
+		if candidate != nil {
+			data, _ := json.Marshal(candidate)
+			iceKey := callIceKeyPrefix + call.ID.String()
+			initializers.RedisClient.RPush(ctx, iceKey, data)
+			initializers.RedisClient.Expire(ctx, iceKey, 2*CallRingTimeout)
+		}
+		return nil
+	}
+
+	if call.State != models.CallStateAccepted {
+		return ErrCallState
+	}
+	if call.CalleeSession != session {
+		return ErrCallSession
+	}
+	return SocketHub.Send(call.CallerSession, event)
+}
+
+// HangUpSession ends the calls signaled on a session that disconnected.
+func HangUpSession(session string) {
+	var calls []models.Call
+	initializers.DB.Where("state IN ? AND (caller_session = ? OR callee_session = ?)",
+		activeCallStates, session, session).Find(&calls)
+
+	for _, call := range calls {
+		userID := call.CallerID
+		if call.CalleeSession == session {
+			userID = call.CalleeID
+		}
+		if _, err := EndCall(userID, call.ID); err != nil && err != ErrCallState {
+			log.Println("Could not end call of disconnected session:", err)
+		}
+	}
+}
+
+// ExpireCalls misses the calls that rang out on a node which went away
+// before its timer fired, and ends the calls whose sessions are gone.
+func ExpireCalls() {
+	var ringing []uuid.UUID
+	initializers.DB.Model(&models.Call{}).
+		Where("state IN ? AND created_at < ?", ringingCallStates, time.Now().Add(-CallRingTimeout)).
+		Pluck("id", &ringing)
+	for _, id := range ringing {
+		missCall(id)
+	}
+
+	var accepted []models.Call
+	initializers.DB.Where("state = ?", models.CallStateAccepted).Find(&accepted)
+	for _, call := range accepted {
+		if SocketHub.Connected(call.CallerSession) && SocketHub.Connected(call.CalleeSession) {
+			continue
+		}
+		if _, err := EndCall(call.CallerID, call.ID); err != nil && err != ErrCallState {
+			log.Println("Could not end stale call:", err)
+		}
+	}
+}
+
+// finishCall tells both sides the final state of the call, frees its users
+// and settles a paid one. A missed call is left in the chat of the two.
+func finishCall(call *models.Call) {
+	ctx := context.Background()
+	unlockCallUser(ctx, call.CallerID, call.ID)
+	unlockCallUser(ctx, call.CalleeID, call.ID)
+	initializers.RedisClient.Del(ctx, callOfferKeyPrefix+call.ID.String(), callIceKeyPrefix+call.ID.String())
+
+	ended := Message{
+		Event: realtime.EventCallEnded,
+		Data:  realtime.CallEndedEvent{CallID: call.ID.String(), State: call.State},
+	}
+	sendToCaller(call, ended)
+	if call.CalleeSession != "" {
+		if err := SocketHub.Send(call.CalleeSession, ended); err != nil && err != ErrSessionNotConnected {
+			log.Println("Could not notify the callee:", err)
+		}
+	} else {
+		// Still ringing on every device
+		if _, err := SocketHub.SendToUser(call.CalleeID.String(), ended); err != nil {
+			log.Println("Could not notify the callee:", err)
+		}
+		stopVoipRinging(call)
+	}
+
+	settleConsultation(call)
+
+	if call.State == models.CallStateMissed {
+		if err := recordMissedCall(call); err != nil {
+			log.Println("Could not record missed call:", err)
+		}
+	}
+}
+
+func sendToCaller(call *models.Call, message Message) {
+	if err := SocketHub.Send(call.CallerSession, message); err != nil && err != ErrSessionNotConnected {
+		log.Println("Could not notify the caller:", err)
+	}
+}
+
+// stopVoipRinging tells the iOS device of the callee the call stopped
+// ringing, so it dismisses the call screen.
+func stopVoipRinging(call *models.Call) {
+	var callee models.User
+	if err := initializers.DB.Where("id = ?", call.CalleeID).First(&callee).Error; err != nil {
+		return
+	}
+	if callee.DeviceIOSVOIP == "" {
+		return
+	}
+	payload, _ := json.Marshal(map[string]interface{}{
+		"aps":    map[string]interface{}{},
+		"callId": call.ID.String(),
+		"state":  call.State,
+	})
+	go func() {
+		if err := VoipCall(callee.DeviceIOSVOIP, string(payload)); err != nil {
+			log.Println("Could not send VoIP push:", err)
+		}
+	}()
+}
+
+// recordMissedCall leaves a call message from the caller in the direct chat
+// of the two users, opening it when they have none, and notifies the callee.
+func recordMissedCall(call *models.Call) error {
+	var caller, callee models.User
+	if err := initializers.DB.Where("id = ?", call.CallerID).First(&caller).Error; err != nil {
+		return err
+	}
+	if err := initializers.DB.Where("id = ?", call.CalleeID).First(&callee).Error; err != nil {
+		return err
+	}
+
+	roomID, err := directChatRoom(&caller, &callee)
+	if err != nil {
+		return err
+	}
+
+	content := "Missed call"
+	if call.Video {
+		content = "Missed video call"
+	}
+	data, _ := json.Marshal(map[string]interface{}{
+		"callId": call.ID.String(),
+		"state":  call.State,
+		"video":  call.Video,
+	})
+	jsonData := string(data)
+	message := models.ChatMessage{
+		RoomID:   roomID,
+		UserID:   caller.ID,
+		Content:  content,
+		MsgType:  models.ChatMessageTypeCall,
+		JsonData: &jsonData,
+	}
+	if err := initializers.DB.Create(&message).Error; err != nil {
+		return err
+	}
+	initializers.DB.Model(&models.ChatRoom{}).Where("id = ?", roomID).Update("last_message_id", message.ID)
+
+	if err := CentrifugoBroadcast(roomMemberChannels(roomID), "new_message", SerializeChatMessage(message)); err != nil {
+		log.Println("Could not broadcast missed call:", err)
+	}
+
+	pageURL := fmt.Sprintf("%s/ru/chat/%d", siteURL, roomID)
+	if callee.DeviceIOS != "" {
+		if err := Push(content, caller.Name, callee.DeviceIOS, pageURL); err != nil {
+			log.Println("Could not push missed call:", err)
+		}
+	}
+	return Notification(content, content+" from "+caller.Name, callee.ID.String(), pageURL)
+}
+
+// directChatRoom returns the chat room of just the two users, created when
+// they have none yet.
+func directChatRoom(requestor, acceptor *models.User) (uint64, error) {
+	var room models.ChatRoom
+	err := initializers.DB.
+		Joins("JOIN chat_room_members AS rm1 ON rm1.room_id = chat_rooms.id AND rm1.user_id = ?", requestor.ID).
+		Joins("JOIN chat_room_members AS rm2 ON rm2.room_id = chat_rooms.id AND rm2.user_id = ?", acceptor.ID).
+		Where("chat_rooms.id IN (SELECT room_id FROM chat_room_members GROUP BY room_id HAVING COUNT(DISTINCT user_id) = 2)").
+		First(&room).Error
+	if err == nil {
+		return room.ID, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, err
+	}
+
+	err = initializers.DB.Transaction(func(tx *gorm.DB) error {
+		room = models.ChatRoom{Name: requestor.Name + " & " + acceptor.Name}
+		if err := tx.Create(&room).Error; err != nil {
+			return err
+		}
+		members := []models.ChatRoomMember{
+			{RoomID: room.ID, UserID: requestor.ID, IsSubscribed: true},
+			{RoomID: room.ID, UserID: acceptor.ID, IsNew: true},
+		}
+		return tx.Create(&members).Error
+	})
+	return room.ID, err
+}
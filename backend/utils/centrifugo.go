@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// centrifugoBatch limits the channels of one broadcast request.
+const centrifugoBatch = 500
+
+var centrifugoClient = &http.Client{Timeout: 10 * time.Second}
+
+// CentrifugoBroadcast publishes an event to the given channels through the
+// Centrifugo HTTP API.
+func CentrifugoBroadcast(channels []string, eventType string, body map[string]interface{}) error {
+	config, _ := initializers.LoadConfig(".")
+	if config.CentrifugoBroadcastMode != "api" {
+		return fmt.Errorf("broadcast mode '%s' is not implemented", config.CentrifugoBroadcastMode)
+	}
+
+	for start := 0; start < len(channels); start += centrifugoBatch {
+		end := start + centrifugoBatch
+		if end > len(channels) {
+			end = len(channels)
+		}
+
+		payload, err := json.Marshal(map[string]interface{}{
+			"channels": channels[start:end],
+			"data": map[string]interface{}{
+				"type": eventType,
+				"body": body,
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		request, err := http.NewRequest(http.MethodPost, config.CentrifugoHttpApiEndpoint+"/api/broadcast", bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("X-API-Key", config.CentrifugoHttpApiKey)
+		request.Header.Set("X-Centrifugo-Error-Mode", "transport")
+
+		response, err := centrifugoClient.Do(request)
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return fmt.Errorf("received non-OK response from Centrifugo: %d", response.StatusCode)
+		}
+	}
+	return nil
+}
+
+// roomMemberChannels returns the personal channels of the members of a chat
+// room, where its events are broadcast.
+func roomMemberChannels(roomID uint64) []string {
+	var members []uuid.UUID
+	initializers.DB.Model(&models.ChatRoomMember{}).Where("room_id = ?", roomID).Pluck("user_id", &members)
+	channels := make([]string, 0, len(members))
+	for _, member := range members {
+		channels = append(channels, "personal:"+member.String())
+	}
+	return channels
+}
@@ -0,0 +1,295 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+	"hyperpage/realtime"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrConferenceNotFound = errors.New("conference not found")
+	ErrConferenceEnded    = errors.New("the conference is over")
+	ErrNotChatMember      = errors.New("you are not a member of this chat")
+	// Paid consultations are metered on the call, they cannot move to a
+	// conference.
+	ErrConsultationEscalation = errors.New("a paid consultation cannot become a conference")
+)
+
+// ConferenceJoin is what a member joins a conference with.
+type ConferenceJoin struct {
+	Conference *models.ChatConference `json:"conference"`
+	ServerURL  string                 `json:"serverUrl"`
+	Token      string                 `json:"token"`
+	Link       string                 `json:"link"`
+}
+
+// meetLink is the page of the frontend where a paxmeet room is joined.
+func meetLink(meetRoomID string) string {
+	return siteURL + "/meet/" + meetRoomID
+}
+
+// conferenceMessageData is the JsonData of the message of a conference. The
+// link is the one the chat already renders for conference messages.
+func conferenceMessageData(conference *models.ChatConference) string {
+	data := map[string]interface{}{
+		"link":         meetLink(conference.MeetRoomID),
+		"conferenceId": conference.ID,
+		"roomId":       conference.MeetRoomID,
+		"status":       conference.Status,
+		"startedBy":    conference.StartedBy.String(),
+		"startedAt":    conference.CreatedAt,
+	}
+	if conference.EndedAt != nil {
+		data["endedAt"] = conference.EndedAt
+		data["duration"] = int(conference.EndedAt.Sub(conference.CreatedAt) / time.Second)
+	}
+	raw, _ := json.Marshal(data)
+	return string(raw)
+}
+
+// StartChatConference starts a conference in a chat room for its members.
+// The active conference of the room is returned when there is one already.
+func StartChatConference(roomID uint64, userID uuid.UUID, callID *uuid.UUID) (*models.ChatConference, error) {
+	var user models.User
+	if err := initializers.DB.Where("id = ?", userID).First(&user).Error; err != nil {
+		return nil, err
+	}
+
+	// A room whose end was not reported does not hold the chat back
+	var previous models.ChatConference
+	if initializers.DB.Where("chat_room_id = ? AND status = ?", roomID, models.ChatConferenceStatusActive).First(&previous).Error == nil {
+		if active, err := PaxmeetRoomActive(previous.MeetRoomID); err == nil && !active {
+			if err := FinishConference(previous.MeetRoomID); err != nil {
+				log.Println("Could not finish conference:", err)
+			}
+		}
+	}
+
+	var conference models.ChatConference
+	var message models.ChatMessage
+	started := false
+	err := initializers.DB.Transaction(func(tx *gorm.DB) error {
+		// Locking the room keeps concurrent starts from opening two conferences
+		var room models.ChatRoom
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", roomID).First(&room).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotChatMember
+			}
+			return err
+		}
+		var members int64
+		tx.Model(&models.ChatRoomMember{}).Where("room_id = ?", roomID).Count(&members)
+		var isMember int64
+		tx.Model(&models.ChatRoomMember{}).Where("room_id = ? AND user_id = ?", roomID, userID).Count(&isMember)
+		if isMember == 0 {
+			return ErrNotChatMember
+		}
+
+		err := tx.Where("chat_room_id = ? AND status = ?", roomID, models.ChatConferenceStatusActive).First(&conference).Error
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		suffix := make([]byte, 6)
+		if _, err := rand.Read(suffix); err != nil {
+			return err
+		}
+		meetRoomID := fmt.Sprintf("chat-%d-%s", roomID, hex.EncodeToString(suffix))
+		if err := CreatePaxmeetRoom(meetRoomID, user.ID.String(), room.Name, int(members), paxmeetEmptyTimeout); err != nil {
+			return err
+		}
+
+		conference = models.ChatConference{
+			ChatRoomID: roomID,
+			MeetRoomID: meetRoomID,
+			StartedBy:  userID,
+			CallID:     callID,
+			Status:     models.ChatConferenceStatusActive,
+		}
+		if err := tx.Create(&conference).Error; err != nil {
+			return err
+		}
+
+		jsonData := conferenceMessageData(&conference)
+		message = models.ChatMessage{
+			RoomID:   roomID,
+			UserID:   userID,
+			Content:  "Conference started",
+			MsgType:  models.ChatMessageTypeConference,
+			JsonData: &jsonData,
+		}
+		if err := tx.Create(&message).Error; err != nil {
+			return err
+		}
+		conference.MessageID = message.ID
+		if err := tx.Model(&conference).Update("message_id", message.ID).Error; err != nil {
+			return err
+		}
+		started = true
+		return tx.Model(&room).Updates(map[string]interface{}{"last_message_id": message.ID, "bumped_at": time.Now()}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !started {
+		return &conference, nil
+	}
+
+	if err := CentrifugoBroadcast(roomMemberChannels(roomID), "new_message", SerializeChatMessage(message)); err != nil {
+		log.Println("Could not broadcast conference:", err)
+	}
+	go notifyConference(&conference, &user)
+	return &conference, nil
+}
+
+// notifyConference invites the other members of the chat room.
+func notifyConference(conference *models.ChatConference, user *models.User) {
+	var members []uuid.UUID
+	initializers.DB.Model(&models.ChatRoomMember{}).
+		Where("room_id = ? AND user_id <> ?", conference.ChatRoomID, user.ID).
+		Pluck("user_id", &members)
+
+	pageURL := fmt.Sprintf("%s/ru/chat/%d", siteURL, conference.ChatRoomID)
+	for _, member := range members {
+		if err := Notification("Conference", user.Name+" started a conference", member.String(), pageURL); err != nil {
+			log.Println("Could not notify conference:", err)
+		}
+	}
+}
+
+// ConferenceJoinToken issues a join token to a member of the chat room of an
+// active conference. The member who started it joins as admin.
+func ConferenceJoinToken(conferenceID uint64, userID uuid.UUID) (*ConferenceJoin, error) {
+	var conference models.ChatConference
+	if err := initializers.DB.Where("id = ?", conferenceID).First(&conference).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrConferenceNotFound
+		}
+		return nil, err
+	}
+	var isMember int64
+	initializers.DB.Model(&models.ChatRoomMember{}).Where("room_id = ? AND user_id = ?", conference.ChatRoomID, userID).Count(&isMember)
+	if isMember == 0 {
+		return nil, ErrConferenceNotFound
+	}
+	if conference.Status != models.ChatConferenceStatusActive {
+		return nil, ErrConferenceEnded
+	}
+
+	var user models.User
+	if err := initializers.DB.Where("id = ?", userID).First(&user).Error; err != nil {
+		return nil, err
+	}
+	token, err := PaxmeetJoinToken(conference.MeetRoomID, PaxmeetUser{
+		ID:      user.ID.String(),
+		Name:    user.Name,
+		Photo:   user.Photo,
+		IsAdmin: user.ID == conference.StartedBy,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	config, _ := initializers.LoadConfig(".")
+	return &ConferenceJoin{
+		Conference: &conference,
+		ServerURL:  config.PaxmeetServerURL,
+		Token:      token,
+		Link:       meetLink(conference.MeetRoomID),
+	}, nil
+}
+
+// FinishConference marks the conference of a paxmeet room ended and updates
+// its message, when paxmeet reports the room finished.
+func FinishConference(meetRoomID string) error {
+	now := time.Now()
+	var conferences []models.ChatConference
+	err := initializers.DB.Model(&conferences).
+		Clauses(clause.Returning{}).
+		Where("meet_room_id = ? AND status = ?", meetRoomID, models.ChatConferenceStatusActive).
+		Updates(map[string]interface{}{"status": models.ChatConferenceStatusEnded, "ended_at": now}).Error
+	if err != nil || len(conferences) == 0 {
+		// Rooms not started from a chat, or reported twice
+		return err
+	}
+	conference := conferences[0]
+
+	var message models.ChatMessage
+	if err := initializers.DB.Where("id = ?", conference.MessageID).First(&message).Error; err != nil {
+		return err
+	}
+	jsonData := conferenceMessageData(&conference)
+	message.Content = "Conference ended"
+	message.JsonData = &jsonData
+	if err := initializers.DB.Model(&message).Updates(map[string]interface{}{"content": message.Content, "json_data": jsonData}).Error; err != nil {
+		return err
+	}
+	if err := CentrifugoBroadcast(roomMemberChannels(conference.ChatRoomID), "edit_message", SerializeChatMessage(message)); err != nil {
+		log.Println("Could not broadcast conference end:", err)
+	}
+	return nil
+}
+
+// EscalateCall moves a call in progress to a conference in the direct chat
+// of its users, where more members can be added. Both sides are told to
+// join it, then the call ends.
+func EscalateCall(userID, callID uuid.UUID) (*models.ChatConference, error) {
+	call, err := FindCall(userID, callID)
+	if err != nil {
+		return nil, err
+	}
+	if call.State != models.CallStateAccepted {
+		return nil, ErrCallState
+	}
+	var paid int64
+	initializers.DB.Model(&models.Consultation{}).Where("call_id = ?", call.ID).Count(&paid)
+	if paid > 0 {
+		// Conferences are not metered, paid calls stay 1:1
+		return nil, ErrConsultationEscalation
+	}
+
+	var caller, callee models.User
+	if err := initializers.DB.Where("id = ?", call.CallerID).First(&caller).Error; err != nil {
+		return nil, err
+	}
+	if err := initializers.DB.Where("id = ?", call.CalleeID).First(&callee).Error; err != nil {
+		return nil, err
+	}
+	roomID, err := directChatRoom(&caller, &callee)
+	if err != nil {
+		return nil, err
+	}
+	conference, err := StartChatConference(roomID, userID, &call.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	escalated := Message{
+		Event: realtime.EventCallEscalated,
+		Data:  realtime.CallEscalatedEvent{CallID: call.ID.String(), ConferenceID: conference.ID, ChatRoomID: roomID},
+	}
+	sendToCaller(call, escalated)
+	if err := SocketHub.Send(call.CalleeSession, escalated); err != nil && err != ErrSessionNotConnected {
+		log.Println("Could not notify the callee:", err)
+	}
+
+	if _, err := EndCall(userID, callID); err != nil && err != ErrCallState {
+		log.Println("Could not end escalated call:", err)
+	}
+	return conference, nil
+}
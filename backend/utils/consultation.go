@@ -0,0 +1,912 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+	"hyperpage/realtime"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	defaultConsultationFeePercent     = 10
+	defaultConsultationReserveMinutes = 30
+	defaultConsultationWarnBefore     = time.Minute
+)
+
+var ErrConsultationRate = errors.New("the rate per minute must be positive")
+
+// ConsultationSettings are the terms of new consultations.
+type ConsultationSettings struct {
+	FeePercent     float64       `json:"feePercent"`
+	ReserveMinutes int           `json:"reserveMinutes"`
+	WarnBefore     time.Duration `json:"-"`
+}
+
+// CurrentConsultationSettings returns the configured terms.
+func CurrentConsultationSettings() ConsultationSettings {
+	config, _ := initializers.LoadConfig(".")
+	settings := ConsultationSettings{
+		FeePercent:     defaultConsultationFeePercent,
+		ReserveMinutes: config.ConsultationReserveMinutes,
+		WarnBefore:     config.ConsultationWarnBefore,
+	}
+	// Zero is a valid fee, only an unset one is defaulted
+	if fee := config.ConsultationFeePercent; fee != nil && *fee >= 0 && *fee < 100 {
+		settings.FeePercent = *fee
+	}
+	if settings.ReserveMinutes <= 0 {
+		settings.ReserveMinutes = defaultConsultationReserveMinutes
+	}
+	if settings.WarnBefore <= 0 {
+		settings.WarnBefore = defaultConsultationWarnBefore
+	}
+	return settings
+}
+
+func roundMoney(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// consultationReserve returns the whole minutes at the rate a balance pays
+// for, at most maxMinutes, and what they cost.
+func consultationReserve(balance, rate float64, maxMinutes int) (int, float64) {
+	minutes := int(math.Floor(balance/rate + 1e-9))
+	if minutes > maxMinutes {
+		minutes = maxMinutes
+	}
+	if minutes < 0 {
+		minutes = 0
+	}
+	return minutes, roundMoney(float64(minutes) * rate)
+}
+
+// ConsultationUsage is the metering of a consultation after some time. Every
+// started minute is billed, up to the minutes the reservation covers.
+type ConsultationUsage struct {
+	Seconds   int     `json:"seconds"`
+	Minutes   int     `json:"minutes"`
+	Amount    float64 `json:"amount"`
+	Covered   int     `json:"covered"`
+	Remaining int     `json:"remaining"`
+	Warn      bool    `json:"warn"`
+	CutOff    bool    `json:"cutOff"`
+}
+
+// MeterConsultation meters a consultation at the rate with reserved funds,
+// elapsed after the answer. Warn is set once less than warnBefore is left,
+// CutOff once the reservation is used up.
+func MeterConsultation(rate, reserved float64, elapsed, warnBefore time.Duration) ConsultationUsage {
+	coveredMinutes, _ := consultationReserve(reserved, rate, math.MaxInt32)
+	usage := ConsultationUsage{Covered: coveredMinutes * 60}
+
+	usage.Seconds = int(elapsed / time.Second)
+	if usage.Seconds < 0 {
+		usage.Seconds = 0
+	}
+	usage.Minutes = (usage.Seconds + 59) / 60
+	if usage.Minutes > coveredMinutes {
+		usage.Minutes = coveredMinutes
+	}
+	usage.Amount = roundMoney(float64(usage.Minutes) * rate)
+
+	usage.Remaining = usage.Covered - usage.Seconds
+	if usage.Remaining < 0 {
+		usage.Remaining = 0
+	}
+	usage.Warn = time.Duration(usage.Remaining)*time.Second <= warnBefore
+	usage.CutOff = usage.Remaining == 0
+	return usage
+}
+
+// ConsultationFee splits what a consultation cost into the fee of the
+// platform and the payout of the seller.
+func ConsultationFee(amount, feePercent float64) (float64, float64) {
+	fee := roundMoney(amount * feePercent / 100)
+	return fee, roundMoney(amount - fee)
+}
+
+// SetConsultationRate sets the price per minute of the calls to a seller.
+func SetConsultationRate(userID uuid.UUID, perMinute float64, active bool) (*models.ConsultationRate, error) {
+	if perMinute <= 0 {
+		return nil, ErrConsultationRate
+	}
+	rate := models.ConsultationRate{UserID: userID, PerMinute: roundMoney(perMinute), Active: active}
+	err := initializers.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"per_minute", "active", "updated_at"}),
+	}).Create(&rate).Error
+	if err != nil {
+		return nil, err
+	}
+	return &rate, nil
+}
+
+// consultationRateOf returns the rate a call from caller to callee is paid
+// at, nil for free calls.
+func consultationRateOf(caller, callee *models.User) *models.ConsultationRate {
+	if !callee.Seller || caller.ID == callee.ID {
+		return nil
+	}
+	var rate models.ConsultationRate
+	if err := initializers.DB.Where("user_id = ? AND active = ? AND per_minute > 0", callee.ID, true).First(&rate).Error; err != nil {
+		return nil
+	}
+	return &rate
+}
+
+// creditBalance adds an amount to the balance of a user. Erased users get
+// no balance back.
+func creditBalance(tx *gorm.DB, userID uuid.UUID, amount float64) error {
+	result := tx.Model(&models.Billing{}).Where("user_id = ?", userID).
+		Update("amount", gorm.Expr("amount + ?", amount))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		return nil
+	}
+	var users int64
+	if err := tx.Model(&models.User{}).Where("id = ?", userID).Count(&users).Error; err != nil {
+		return err
+	}
+	if users == 0 {
+		return nil
+	}
+	return tx.Create(&models.Billing{UserID: userID, Amount: amount}).Error
+}
+
+// consultationLedger keeps consultations and the balances they are paid
+// from. Paid calls use the database, simulations a ledger in memory.
+type consultationLedger interface {
+	// reserve takes the reservation of a new consultation, at most
+	// reserveMinutes, from the balance of its client and records it.
+	reserve(consultation *models.Consultation, reserveMinutes int, sellerName string) error
+	// start makes the reserved consultation of a call active, nil when
+	// there is none.
+	start(callID uuid.UUID, at time.Time) (*models.Consultation, error)
+	// active returns the consultation in progress of a call.
+	active(callID uuid.UUID) (*models.Consultation, error)
+	// extend takes up to reserveMinutes more from the balance of the
+	// client of a consultation in progress.
+	extend(id uint64, reserveMinutes int) (*models.Consultation, error)
+	// markCutOff and markWarned flag a consultation in progress, they
+	// return false when it already was.
+	markCutOff(id uint64) (bool, error)
+	markWarned(id uint64, at time.Time) (bool, error)
+	// settle closes the open consultation of a call with closeConsultation
+	// and moves the funds, nil when it was already closed.
+	settle(callID uuid.UUID, endedAt time.Time) (*models.Consultation, error)
+}
+
+// consultationNotifier tells the sides of a consultation what the meter
+// decided.
+type consultationNotifier interface {
+	warned(consultation *models.Consultation, usage ConsultationUsage)
+	// cutOff ends a call whose funds are used up, which settles it.
+	cutOff(consultation *models.Consultation)
+	settled(consultation *models.Consultation)
+}
+
+// consultationClock is the time of the meter.
+type consultationClock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func())
+}
+
+// consultationMeter reserves, meters and settles consultations.
+type consultationMeter struct {
+	ledger   consultationLedger
+	notifier consultationNotifier
+	clock    consultationClock
+	settings func() ConsultationSettings
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) AfterFunc(d time.Duration, f func()) { time.AfterFunc(d, f) }
+
+// consultations is the meter of paid calls.
+var consultations = &consultationMeter{
+	ledger:   dbConsultations{},
+	notifier: dbConsultations{},
+	clock:    systemClock{},
+	settings: CurrentConsultationSettings,
+}
+
+// closeConsultation meters a consultation that ended at endedAt and returns
+// what goes back to the client. A consultation that was not answered is
+// released.
+func closeConsultation(consultation *models.Consultation, endedAt time.Time) float64 {
+	consultation.EndedAt = &endedAt
+	if consultation.StartedAt == nil {
+		consultation.Status = models.ConsultationStatusReleased
+		return consultation.Reserved
+	}
+	usage := MeterConsultation(consultation.Rate, consultation.Reserved, endedAt.Sub(*consultation.StartedAt), 0)
+	fee, payout := ConsultationFee(usage.Amount, consultation.FeePercent)
+	consultation.Status = models.ConsultationStatusSettled
+	consultation.Seconds = usage.Seconds
+	consultation.Minutes = usage.Minutes
+	consultation.Amount = usage.Amount
+	consultation.Fee = fee
+	consultation.Payout = payout
+	return roundMoney(consultation.Reserved - usage.Amount)
+}
+
+// reserve takes the minutes of CONSULTATION_RESERVE_MINUTES, or as many as
+// the balance pays for, from the client before the seller rings. At least
+// one minute must be paid for.
+func (m *consultationMeter) reserve(callID, clientID, sellerID uuid.UUID, sellerName string, rate float64) error {
+	settings := m.settings()
+	consultation := models.Consultation{
+		CallID:     callID,
+		ClientID:   clientID,
+		SellerID:   sellerID,
+		Rate:       rate,
+		FeePercent: settings.FeePercent,
+		Status:     models.ConsultationStatusReserved,
+	}
+	return m.ledger.reserve(&consultation, settings.ReserveMinutes, sellerName)
+}
+
+// start starts metering a paid call answered at a time.
+func (m *consultationMeter) start(callID uuid.UUID, at time.Time) {
+	consultation, err := m.ledger.start(callID, at)
+	if err != nil {
+		log.Println("Could not start consultation:", err)
+		return
+	}
+	if consultation != nil {
+		m.schedule(consultation)
+	}
+}
+
+// schedule meters a consultation when its warning and its cut off are due.
+// MeterConsultations catches the ones of nodes that went away.
+func (m *consultationMeter) schedule(consultation *models.Consultation) {
+	if consultation.StartedAt == nil {
+		return
+	}
+	settings := m.settings()
+	usage := MeterConsultation(consultation.Rate, consultation.Reserved, 0, 0)
+	cutOffAt := consultation.StartedAt.Add(time.Duration(usage.Covered) * time.Second)
+	callID := consultation.CallID
+	for _, at := range []time.Time{cutOffAt.Add(-settings.WarnBefore), cutOffAt} {
+		m.clock.AfterFunc(at.Sub(m.clock.Now()), func() {
+			m.meter(callID)
+		})
+	}
+}
+
+// meter checks a consultation in progress. When its funds are about to run
+// out it takes more from the balance of the client, or warns both sides,
+// and the call is cut off once they are used up.
+func (m *consultationMeter) meter(callID uuid.UUID) {
+	consultation, err := m.ledger.active(callID)
+	if err != nil {
+		return
+	}
+	settings := m.settings()
+	usage := MeterConsultation(consultation.Rate, consultation.Reserved, m.clock.Now().Sub(*consultation.StartedAt), settings.WarnBefore)
+	if !usage.Warn {
+		return
+	}
+
+	extended, err := m.ledger.extend(consultation.ID, settings.ReserveMinutes)
+	if err == nil {
+		m.schedule(extended)
+		return
+	}
+	if err != ErrInsufficientBalance && !errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Println("Could not extend consultation:", err)
+	}
+
+	if usage.CutOff {
+		if ok, err := m.ledger.markCutOff(consultation.ID); err != nil || !ok {
+			return
+		}
+		consultation.CutOff = true
+		m.notifier.cutOff(consultation)
+		return
+	}
+
+	if ok, err := m.ledger.markWarned(consultation.ID, m.clock.Now()); err != nil || !ok {
+		return
+	}
+	m.notifier.warned(consultation, usage)
+}
+
+// settle closes the consultation of a call that ended at a time. The billed
+// minutes go to the seller less the fee of the platform and the rest of the
+// reservation back to the client, a call that was not answered releases all
+// of it. Both sides of a settled consultation get a receipt.
+func (m *consultationMeter) settle(callID uuid.UUID, endedAt time.Time) {
+	consultation, err := m.ledger.settle(callID, endedAt)
+	if err != nil {
+		log.Println("Could not settle consultation:", err)
+		return
+	}
+	if consultation != nil && consultation.Status == models.ConsultationStatusSettled {
+		m.notifier.settled(consultation)
+	}
+}
+
+// reserveConsultation reserves the funds of a paid call before the seller
+// rings.
+func reserveConsultation(call *models.Call, caller, seller *models.User, rate *models.ConsultationRate) error {
+	return consultations.reserve(call.ID, caller.ID, seller.ID, seller.Name, rate.PerMinute)
+}
+
+// startConsultation starts metering a paid call once it is answered.
+func startConsultation(call *models.Call) {
+	if call.AnsweredAt == nil {
+		return
+	}
+	consultations.start(call.ID, *call.AnsweredAt)
+}
+
+// MeterConsultations meters the consultations in progress, for the ones whose
+// timers were lost with their node.
+func MeterConsultations() {
+	var calls []uuid.UUID
+	initializers.DB.Model(&models.Consultation{}).
+		Where("status = ?", models.ConsultationStatusActive).
+		Pluck("call_id", &calls)
+	for _, callID := range calls {
+		consultations.meter(callID)
+	}
+}
+
+// settleConsultation closes the consultation of a call that is over.
+func settleConsultation(call *models.Call) {
+	endedAt := consultations.clock.Now()
+	if call.EndedAt != nil {
+		endedAt = *call.EndedAt
+	}
+	consultations.settle(call.ID, endedAt)
+}
+
+// dbConsultations keeps the consultations of paid calls in the database
+// and notifies their sides.
+type dbConsultations struct{}
+
+func (dbConsultations) reserve(consultation *models.Consultation, reserveMinutes int, sellerName string) error {
+	return initializers.DB.Transaction(func(tx *gorm.DB) error {
+		var balance models.Billing
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_id = ?", consultation.ClientID).
+			First(&balance).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInsufficientBalance
+			}
+			return err
+		}
+
+		minutes, reserved := consultationReserve(balance.Amount, consultation.Rate, reserveMinutes)
+		if minutes == 0 {
+			return ErrInsufficientBalance
+		}
+		balance.Amount -= reserved
+		if err := tx.Save(&balance).Error; err != nil {
+			return err
+		}
+
+		consultation.Reserved = reserved
+		if err := tx.Create(consultation).Error; err != nil {
+			return err
+		}
+
+		transaction := models.Transaction{
+			UserID:      consultation.ClientID,
+			Amount:      reserved,
+			Status:      "OPENED",
+			Module:      "consultation",
+			ElementId:   consultation.ID,
+			Total:       strconv.FormatFloat(reserved, 'f', 2, 64),
+			Description: "Резерв за консультацию: " + sellerName,
+			Type:        "deduction",
+		}
+		if err := tx.Create(&transaction).Error; err != nil {
+			return err
+		}
+		consultation.TransactionID = transaction.ID
+		return tx.Model(consultation).Update("transaction_id", transaction.ID).Error
+	})
+}
+
+func (dbConsultations) start(callID uuid.UUID, at time.Time) (*models.Consultation, error) {
+	var started []models.Consultation
+	err := initializers.DB.Model(&started).
+		Clauses(clause.Returning{}).
+		Where("call_id = ? AND status = ?", callID, models.ConsultationStatusReserved).
+		Updates(map[string]interface{}{"status": models.ConsultationStatusActive, "started_at": at}).Error
+	if err != nil || len(started) == 0 {
+		return nil, err
+	}
+	return &started[0], nil
+}
+
+func (dbConsultations) active(callID uuid.UUID) (*models.Consultation, error) {
+	var consultation models.Consultation
+	if err := initializers.DB.Where("call_id = ? AND status = ?", callID, models.ConsultationStatusActive).First(&consultation).Error; err != nil {
+		return nil, err
+	}
+	return &consultation, nil
+}
+
+func (dbConsultations) extend(id uint64, reserveMinutes int) (*models.Consultation, error) {
+	var extended models.Consultation
+	err := initializers.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND status = ?", id, models.ConsultationStatusActive).
+			First(&extended).Error; err != nil {
+			return err
+		}
+		var balance models.Billing
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_id = ?", extended.ClientID).
+			First(&balance).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInsufficientBalance
+			}
+			return err
+		}
+		minutes, amount := consultationReserve(balance.Amount, extended.Rate, reserveMinutes)
+		if minutes == 0 {
+			return ErrInsufficientBalance
+		}
+		balance.Amount -= amount
+		if err := tx.Save(&balance).Error; err != nil {
+			return err
+		}
+		extended.Reserved = roundMoney(extended.Reserved + amount)
+		extended.WarnedAt = nil
+		if err := tx.Model(&extended).Updates(map[string]interface{}{"reserved": extended.Reserved, "warned_at": nil}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.Transaction{}).Where("id = ?", extended.TransactionID).Updates(map[string]interface{}{
+			"amount": extended.Reserved,
+			"total":  strconv.FormatFloat(extended.Reserved, 'f', 2, 64),
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &extended, nil
+}
+
+func (dbConsultations) markCutOff(id uint64) (bool, error) {
+	result := initializers.DB.Model(&models.Consultation{}).
+		Where("id = ? AND status = ? AND cut_off = ?", id, models.ConsultationStatusActive, false).
+		Update("cut_off", true)
+	return result.RowsAffected > 0, result.Error
+}
+
+func (dbConsultations) markWarned(id uint64, at time.Time) (bool, error) {
+	result := initializers.DB.Model(&models.Consultation{}).
+		Where("id = ? AND status = ? AND warned_at IS NULL", id, models.ConsultationStatusActive).
+		Update("warned_at", at)
+	return result.RowsAffected > 0, result.Error
+}
+
+func (dbConsultations) settle(callID uuid.UUID, endedAt time.Time) (*models.Consultation, error) {
+	var consultation models.Consultation
+	closed := false
+	err := initializers.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("call_id = ? AND status IN ?", callID, []string{models.ConsultationStatusReserved, models.ConsultationStatusActive}).
+			First(&consultation).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				// Free call, or settled by another node
+				return nil
+			}
+			return err
+		}
+		closed = true
+
+		refund := closeConsultation(&consultation, endedAt)
+		if refund > 0 {
+			if err := creditBalance(tx, consultation.ClientID, refund); err != nil {
+				return err
+			}
+		}
+
+		if consultation.Status == models.ConsultationStatusReleased {
+			if err := tx.Model(&models.Transaction{}).Where("id = ?", consultation.TransactionID).
+				Update("status", "CANCELLED").Error; err != nil {
+				return err
+			}
+			return tx.Model(&consultation).Updates(map[string]interface{}{
+				"status":   consultation.Status,
+				"ended_at": endedAt,
+			}).Error
+		}
+
+		var client, seller models.User
+		tx.Where("id = ?", consultation.ClientID).First(&client)
+		tx.Where("id = ?", consultation.SellerID).First(&seller)
+
+		if err := tx.Model(&models.Transaction{}).Where("id = ?", consultation.TransactionID).Updates(map[string]interface{}{
+			"amount":      consultation.Amount,
+			"total":       strconv.FormatFloat(consultation.Amount, 'f', 2, 64),
+			"status":      "CLOSED_1",
+			"description": fmt.Sprintf("Консультация: %s, %d мин.", seller.Name, consultation.Minutes),
+		}).Error; err != nil {
+			return err
+		}
+
+		if consultation.Payout > 0 {
+			if err := creditBalance(tx, consultation.SellerID, consultation.Payout); err != nil {
+				return err
+			}
+			transaction := models.Transaction{
+				UserID:      consultation.SellerID,
+				Amount:      consultation.Payout,
+				Status:      "CLOSED_1",
+				Module:      "consultation",
+				ElementId:   consultation.ID,
+				Total:       strconv.FormatFloat(consultation.Amount, 'f', 2, 64),
+				Description: fmt.Sprintf("Оплата консультации: %s, %d мин., комиссия %.2f", client.Name, consultation.Minutes, consultation.Fee),
+				Type:        "addition",
+			}
+			if err := tx.Create(&transaction).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Model(&consultation).Updates(map[string]interface{}{
+			"status":   consultation.Status,
+			"seconds":  consultation.Seconds,
+			"minutes":  consultation.Minutes,
+			"amount":   consultation.Amount,
+			"fee":      consultation.Fee,
+			"payout":   consultation.Payout,
+			"ended_at": endedAt,
+		}).Error
+	})
+	if err != nil || !closed {
+		return nil, err
+	}
+	return &consultation, nil
+}
+
+func (dbConsultations) warned(consultation *models.Consultation, usage ConsultationUsage) {
+	warning := Message{
+		Event: realtime.EventConsultationWarning,
+		Data: realtime.ConsultationWarningEvent{
+			CallID:    consultation.CallID.String(),
+			Remaining: usage.Remaining,
+			Amount:    usage.Amount,
+			Reserved:  consultation.Reserved,
+		},
+	}
+	for _, userID := range []uuid.UUID{consultation.ClientID, consultation.SellerID} {
+		if _, err := SocketHub.SendToUser(userID.String(), warning); err != nil {
+			log.Println("Could not warn consultation:", err)
+		}
+	}
+}
+
+func (dbConsultations) cutOff(consultation *models.Consultation) {
+	if _, err := EndCall(consultation.ClientID, consultation.CallID); err != nil && err != ErrCallState {
+		log.Println("Could not cut off consultation:", err)
+	}
+}
+
+func (dbConsultations) settled(consultation *models.Consultation) {
+	var client, seller models.User
+	initializers.DB.Where("id = ?", consultation.ClientID).First(&client)
+	initializers.DB.Where("id = ?", consultation.SellerID).First(&seller)
+	sendConsultationReceipts(consultation, &client, &seller)
+}
+
+// sendConsultationReceipts tells both sides what a consultation cost, over
+// the websocket, as a notification and by email.
+func sendConsultationReceipts(consultation *models.Consultation, client, seller *models.User) {
+	event := Message{
+		Event: realtime.EventConsultationSettled,
+		Data: realtime.ConsultationSettledEvent{
+			CallID:  consultation.CallID.String(),
+			Minutes: consultation.Minutes,
+			Amount:  consultation.Amount,
+			Fee:     consultation.Fee,
+			Payout:  consultation.Payout,
+			Refund:  roundMoney(consultation.Reserved - consultation.Amount),
+			CutOff:  consultation.CutOff,
+		},
+	}
+	pageURL := siteURL + "/ru/profile/transactions"
+	receipts := []struct {
+		user *models.User
+		mail *ConsultationReceiptMail
+	}{
+		{client, &ConsultationReceiptMail{
+			Subject: "Consultation receipt",
+			Name:    client.Name,
+			Peer:    seller.Name,
+			Minutes: consultation.Minutes,
+			Rate:    fmt.Sprintf("%.2f", consultation.Rate),
+			Amount:  fmt.Sprintf("%.2f", consultation.Amount),
+			Refund:  fmt.Sprintf("%.2f", consultation.Reserved-consultation.Amount),
+			URL:     pageURL,
+		}},
+		{seller, &ConsultationReceiptMail{
+			Subject: "Consultation payout",
+			Name:    seller.Name,
+			Peer:    client.Name,
+			Minutes: consultation.Minutes,
+			Rate:    fmt.Sprintf("%.2f", consultation.Rate),
+			Amount:  fmt.Sprintf("%.2f", consultation.Amount),
+			Fee:     fmt.Sprintf("%.2f", consultation.Fee),
+			Payout:  fmt.Sprintf("%.2f", consultation.Payout),
+			Seller:  true,
+			URL:     pageURL,
+		}},
+	}
+	for _, receipt := range receipts {
+		if _, err := SocketHub.SendToUser(receipt.user.ID.String(), event); err != nil {
+			log.Println("Could not send consultation receipt:", err)
+		}
+		text := fmt.Sprintf("%s, %d min: %s", receipt.mail.Peer, consultation.Minutes, receipt.mail.Amount)
+		if err := Notification(receipt.mail.Subject, text, receipt.user.ID.String(), pageURL); err != nil {
+			log.Println("Could not notify consultation receipt:", err)
+		}
+		if !receipt.user.IsBot && receipt.user.Email != "" {
+			SendEmail(receipt.user, receipt.mail, "consultationReceipt", "en")
+		}
+	}
+}
+
+// ConsultationEvent is a simulated call event, At seconds after the call
+// was placed. Events are started, ended and topup, which adds Amount to
+// the balance of the client.
+type ConsultationEvent struct {
+	Type   string  `json:"type"`
+	At     int     `json:"at"`
+	Amount float64 `json:"amount,omitempty"`
+}
+
+// ConsultationStep is an outcome of a simulation: reserved, extended,
+// warned, cut_off, settled or released.
+type ConsultationStep struct {
+	Type     string             `json:"type"`
+	At       int                `json:"at"`
+	Balance  float64            `json:"balance"`
+	Reserved float64            `json:"reserved"`
+	Usage    *ConsultationUsage `json:"usage,omitempty"`
+	Fee      float64            `json:"fee,omitempty"`
+	Payout   float64            `json:"payout,omitempty"`
+}
+
+// consultationSimulation is the ledger, notifier and clock of a simulated
+// consultation. Its timers run when the clock is advanced.
+type consultationSimulation struct {
+	meter        *consultationMeter
+	origin       time.Time
+	now          time.Time
+	timers       []consultationTimer
+	balance      float64
+	consultation *models.Consultation
+	steps        []ConsultationStep
+}
+
+type consultationTimer struct {
+	at time.Time
+	f  func()
+}
+
+func (s *consultationSimulation) Now() time.Time { return s.now }
+
+func (s *consultationSimulation) AfterFunc(d time.Duration, f func()) {
+	s.timers = append(s.timers, consultationTimer{at: s.now.Add(d), f: f})
+}
+
+// advance runs the timers due until a time, in order.
+func (s *consultationSimulation) advance(until time.Time) {
+	for {
+		next := -1
+		for i, timer := range s.timers {
+			if !timer.at.After(until) && (next < 0 || timer.at.Before(s.timers[next].at)) {
+				next = i
+			}
+		}
+		if next < 0 {
+			break
+		}
+		timer := s.timers[next]
+		s.timers = append(s.timers[:next], s.timers[next+1:]...)
+		if timer.at.After(s.now) {
+			s.now = timer.at
+		}
+		timer.f()
+	}
+	if until.After(s.now) {
+		s.now = until
+	}
+}
+
+// open returns the consultation while it has a status.
+func (s *consultationSimulation) open(status string) *models.Consultation {
+	if s.consultation == nil || s.consultation.Status != status {
+		return nil
+	}
+	return s.consultation
+}
+
+func (s *consultationSimulation) closed() bool {
+	return s.consultation != nil && s.consultation.EndedAt != nil
+}
+
+func (s *consultationSimulation) step(kind string, usage *ConsultationUsage) {
+	step := ConsultationStep{
+		Type:     kind,
+		At:       int(s.now.Sub(s.origin) / time.Second),
+		Balance:  s.balance,
+		Reserved: s.consultation.Reserved,
+		Usage:    usage,
+	}
+	if kind == models.ConsultationStatusSettled {
+		step.Fee = s.consultation.Fee
+		step.Payout = s.consultation.Payout
+	}
+	s.steps = append(s.steps, step)
+}
+
+func (s *consultationSimulation) reserve(consultation *models.Consultation, reserveMinutes int, sellerName string) error {
+	minutes, reserved := consultationReserve(s.balance, consultation.Rate, reserveMinutes)
+	if minutes == 0 {
+		return ErrInsufficientBalance
+	}
+	s.balance = roundMoney(s.balance - reserved)
+	consultation.ID = 1
+	consultation.Reserved = reserved
+	consultation.CreatedAt = s.now
+	s.consultation = consultation
+	s.step("reserved", nil)
+	return nil
+}
+
+func (s *consultationSimulation) start(callID uuid.UUID, at time.Time) (*models.Consultation, error) {
+	consultation := s.open(models.ConsultationStatusReserved)
+	if consultation == nil {
+		return nil, nil
+	}
+	consultation.Status = models.ConsultationStatusActive
+	consultation.StartedAt = &at
+	started := *consultation
+	return &started, nil
+}
+
+func (s *consultationSimulation) active(callID uuid.UUID) (*models.Consultation, error) {
+	consultation := s.open(models.ConsultationStatusActive)
+	if consultation == nil {
+		return nil, gorm.ErrRecordNotFound
+	}
+	active := *consultation
+	return &active, nil
+}
+
+func (s *consultationSimulation) extend(id uint64, reserveMinutes int) (*models.Consultation, error) {
+	consultation := s.open(models.ConsultationStatusActive)
+	if consultation == nil {
+		return nil, gorm.ErrRecordNotFound
+	}
+	minutes, amount := consultationReserve(s.balance, consultation.Rate, reserveMinutes)
+	if minutes == 0 {
+		return nil, ErrInsufficientBalance
+	}
+	s.balance = roundMoney(s.balance - amount)
+	consultation.Reserved = roundMoney(consultation.Reserved + amount)
+	consultation.WarnedAt = nil
+	s.step("extended", nil)
+	extended := *consultation
+	return &extended, nil
+}
+
+func (s *consultationSimulation) markCutOff(id uint64) (bool, error) {
+	consultation := s.open(models.ConsultationStatusActive)
+	if consultation == nil || consultation.CutOff {
+		return false, nil
+	}
+	consultation.CutOff = true
+	return true, nil
+}
+
+func (s *consultationSimulation) markWarned(id uint64, at time.Time) (bool, error) {
+	consultation := s.open(models.ConsultationStatusActive)
+	if consultation == nil || consultation.WarnedAt != nil {
+		return false, nil
+	}
+	consultation.WarnedAt = &at
+	return true, nil
+}
+
+func (s *consultationSimulation) settle(callID uuid.UUID, endedAt time.Time) (*models.Consultation, error) {
+	consultation := s.open(models.ConsultationStatusReserved)
+	if consultation == nil {
+		consultation = s.open(models.ConsultationStatusActive)
+	}
+	if consultation == nil {
+		return nil, nil
+	}
+	s.balance = roundMoney(s.balance + closeConsultation(consultation, endedAt))
+
+	var usage *ConsultationUsage
+	if consultation.StartedAt != nil {
+		metered := MeterConsultation(consultation.Rate, consultation.Reserved, endedAt.Sub(*consultation.StartedAt), 0)
+		usage = &metered
+	}
+	s.step(consultation.Status, usage)
+	settled := *consultation
+	return &settled, nil
+}
+
+func (s *consultationSimulation) warned(consultation *models.Consultation, usage ConsultationUsage) {
+	s.step("warned", &usage)
+}
+
+func (s *consultationSimulation) cutOff(consultation *models.Consultation) {
+	usage := MeterConsultation(consultation.Rate, consultation.Reserved, s.now.Sub(*consultation.StartedAt), 0)
+	s.step("cut_off", &usage)
+	// Ending the call settles it, like EndCall does
+	s.meter.settle(consultation.CallID, s.now)
+}
+
+func (s *consultationSimulation) settled(consultation *models.Consultation) {}
+
+// SimulateConsultation replays call events through the meter of paid calls,
+// on a ledger in memory and a simulated clock, and returns what would
+// happen.
+func SimulateConsultation(rate, balance float64, settings ConsultationSettings, events []ConsultationEvent) ([]ConsultationStep, error) {
+	if rate <= 0 {
+		return nil, ErrConsultationRate
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].At < events[j].At })
+
+	origin := time.Unix(0, 0).UTC()
+	simulation := &consultationSimulation{origin: origin, now: origin, balance: roundMoney(balance)}
+	meter := &consultationMeter{
+		ledger:   simulation,
+		notifier: simulation,
+		clock:    simulation,
+		settings: func() ConsultationSettings { return settings },
+	}
+	simulation.meter = meter
+
+	callID := uuid.NewV4()
+	if err := meter.reserve(callID, uuid.NewV4(), uuid.NewV4(), "", rate); err != nil {
+		return nil, err
+	}
+	for _, event := range events {
+		simulation.advance(origin.Add(time.Duration(event.At) * time.Second))
+		if simulation.closed() {
+			// Cut off before the event
+			return simulation.steps, nil
+		}
+		switch event.Type {
+		case "started":
+			meter.start(callID, simulation.Now())
+		case "topup":
+			simulation.balance = roundMoney(simulation.balance + event.Amount)
+		case "ended":
+			meter.settle(callID, simulation.Now())
+			return simulation.steps, nil
+		default:
+			return nil, fmt.Errorf("unknown event %q", event.Type)
+		}
+	}
+	return nil, errors.New("the events must end with an ended event")
+}
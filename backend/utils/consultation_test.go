@@ -0,0 +1,153 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+var testConsultationSettings = ConsultationSettings{
+	FeePercent:     10,
+	ReserveMinutes: 30,
+	WarnBefore:     time.Minute,
+}
+
+// checkSteps compares the type, time, balance and reservation of steps.
+func checkSteps(t *testing.T, steps, want []ConsultationStep) {
+	t.Helper()
+	if len(steps) != len(want) {
+		t.Fatalf("steps = %+v, want %+v", steps, want)
+	}
+	for i, step := range steps {
+		if step.Type != want[i].Type || step.At != want[i].At || step.Balance != want[i].Balance || step.Reserved != want[i].Reserved {
+			t.Errorf("step %d = %s at %d, balance %.2f, reserved %.2f; want %s at %d, balance %.2f, reserved %.2f",
+				i, step.Type, step.At, step.Balance, step.Reserved,
+				want[i].Type, want[i].At, want[i].Balance, want[i].Reserved)
+		}
+	}
+}
+
+func TestConsultationReserve(t *testing.T) {
+	steps, err := SimulateConsultation(7, 100, testConsultationSettings, []ConsultationEvent{{Type: "ended", At: 20}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 14 whole minutes, a call that is not answered releases them
+	checkSteps(t, steps, []ConsultationStep{
+		{Type: "reserved", Balance: 2, Reserved: 98},
+		{Type: "released", At: 20, Balance: 100, Reserved: 98},
+	})
+
+	if _, err := SimulateConsultation(7, 5, testConsultationSettings, []ConsultationEvent{{Type: "ended"}}); err != ErrInsufficientBalance {
+		t.Errorf("err = %v, want ErrInsufficientBalance", err)
+	}
+	if _, err := SimulateConsultation(0, 100, testConsultationSettings, nil); err != ErrConsultationRate {
+		t.Errorf("err = %v, want ErrConsultationRate", err)
+	}
+}
+
+func TestConsultationSettle(t *testing.T) {
+	steps, err := SimulateConsultation(10, 1000, testConsultationSettings, []ConsultationEvent{
+		{Type: "ended", At: 130},
+		{Type: "started", At: 5},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 125 seconds bill 3 minutes
+	checkSteps(t, steps, []ConsultationStep{
+		{Type: "reserved", Balance: 700, Reserved: 300},
+		{Type: "settled", At: 130, Balance: 970, Reserved: 300},
+	})
+	settled := steps[1]
+	if settled.Usage == nil || settled.Usage.Minutes != 3 || settled.Usage.Amount != 30 {
+		t.Errorf("usage = %+v, want 3 minutes for 30", settled.Usage)
+	}
+	if settled.Fee != 3 || settled.Payout != 27 {
+		t.Errorf("fee %.2f, payout %.2f; want 3 and 27", settled.Fee, settled.Payout)
+	}
+
+	// A zero fee pays the seller everything
+	free := testConsultationSettings
+	free.FeePercent = 0
+	steps, err = SimulateConsultation(10, 1000, free, []ConsultationEvent{{Type: "started"}, {Type: "ended", At: 60}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settled := steps[len(steps)-1]; settled.Fee != 0 || settled.Payout != 10 {
+		t.Errorf("fee %.2f, payout %.2f; want 0 and 10", settled.Fee, settled.Payout)
+	}
+}
+
+func TestConsultationExtend(t *testing.T) {
+	settings := testConsultationSettings
+	settings.ReserveMinutes = 2
+	steps, err := SimulateConsultation(10, 30, settings, []ConsultationEvent{
+		{Type: "started"},
+		{Type: "topup", At: 30, Amount: 50},
+		{Type: "ended", At: 400},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each warning takes two more minutes from the topped up balance
+	checkSteps(t, steps, []ConsultationStep{
+		{Type: "reserved", Balance: 10, Reserved: 20},
+		{Type: "extended", At: 60, Balance: 40, Reserved: 40},
+		{Type: "extended", At: 180, Balance: 20, Reserved: 60},
+		{Type: "extended", At: 300, Balance: 0, Reserved: 80},
+		{Type: "settled", At: 400, Balance: 10, Reserved: 80},
+	})
+	if settled := steps[len(steps)-1]; settled.Usage.Minutes != 7 || settled.Payout != 63 {
+		t.Errorf("usage = %+v, payout %.2f; want 7 minutes and 63", settled.Usage, settled.Payout)
+	}
+}
+
+func TestConsultationCutOff(t *testing.T) {
+	steps, err := SimulateConsultation(10, 25, testConsultationSettings, []ConsultationEvent{
+		{Type: "started", At: 10},
+		{Type: "ended", At: 200},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Warned a minute before the two reserved minutes are used up, then
+	// cut off and settled before the call would have ended
+	checkSteps(t, steps, []ConsultationStep{
+		{Type: "reserved", Balance: 5, Reserved: 20},
+		{Type: "warned", At: 70, Balance: 5, Reserved: 20},
+		{Type: "cut_off", At: 130, Balance: 5, Reserved: 20},
+		{Type: "settled", At: 130, Balance: 5, Reserved: 20},
+	})
+	if warned := steps[1].Usage; warned == nil || warned.Remaining != 60 {
+		t.Errorf("warning usage = %+v, want 60 seconds remaining", warned)
+	}
+	if settled := steps[3]; settled.Usage.Minutes != 2 || settled.Fee != 2 || settled.Payout != 18 {
+		t.Errorf("usage = %+v, fee %.2f, payout %.2f; want 2 minutes, 2 and 18", settled.Usage, settled.Fee, settled.Payout)
+	}
+
+	// A top up after the warning extends instead of cutting off
+	steps, err = SimulateConsultation(10, 25, testConsultationSettings, []ConsultationEvent{
+		{Type: "started", At: 10},
+		{Type: "topup", At: 100, Amount: 10},
+		{Type: "ended", At: 150},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSteps(t, steps, []ConsultationStep{
+		{Type: "reserved", Balance: 5, Reserved: 20},
+		{Type: "warned", At: 70, Balance: 5, Reserved: 20},
+		{Type: "extended", At: 130, Balance: 5, Reserved: 30},
+		{Type: "warned", At: 130, Balance: 5, Reserved: 30},
+		{Type: "settled", At: 150, Balance: 5, Reserved: 30},
+	})
+}
+
+func TestConsultationEventsMustEnd(t *testing.T) {
+	if _, err := SimulateConsultation(10, 100, testConsultationSettings, []ConsultationEvent{{Type: "started"}}); err == nil {
+		t.Error("events without an end were accepted")
+	}
+	if _, err := SimulateConsultation(10, 100, testConsultationSettings, []ConsultationEvent{{Type: "paused"}}); err == nil {
+		t.Error("an unknown event was accepted")
+	}
+}
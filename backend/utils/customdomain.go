@@ -0,0 +1,301 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Ownership is proven by a TXT record on customDomainTXTPrefix+host or by a
+// file with the token the owner hosts on CustomDomainVerificationPath of the
+// host before moving it here. This backend never serves the token, pointing
+// a dangling domain here proves nothing. Pending domains are checked again
+// for customDomainVerifyWindow.
+const (
+	CustomDomainVerificationPath = "/.well-known/myru-verification"
+	customDomainTXTPrefix        = "_myru-verification."
+	customDomainVerifyWindow     = 72 * time.Hour
+	customDomainCacheTTL         = time.Minute
+	customDomainCacheSize        = 10000
+	certificateRetryInterval     = 10 * time.Minute
+	certificateRetryKeyPrefix    = "domain:certificate:retry:"
+)
+
+// Custom domains allowed by each paid plan.
+var customDomainLimits = map[string]int{
+	"Начальный":   1,
+	"Бизнесс":     3,
+	"Расширенный": 10,
+}
+
+var (
+	ErrCustomDomainPlan  = errors.New("custom domains need an active paid plan")
+	ErrCustomDomainLimit = errors.New("custom domain limit of the plan reached")
+	ErrCustomDomainTaken = errors.New("domain is already connected")
+	ErrCertificateRetry  = errors.New("a certificate was requested recently, try again later")
+)
+
+// NewCustomDomain registers a domain for the site of the user. The domain
+// expires with the plan of the user.
+func NewCustomDomain(user *models.User, site *models.Domain, input *models.CustomDomainInput) (*models.CustomDomain, error) {
+	limit := customDomainLimits[user.Plan]
+	if !user.Signed || user.ExpiredPlanAt == nil || user.ExpiredPlanAt.Before(time.Now()) || limit == 0 {
+		return nil, ErrCustomDomainPlan
+	}
+
+	var count int64
+	initializers.DB.Model(&models.CustomDomain{}).Where("user_id = ?", user.ID).Count(&count)
+	if int(count) >= limit {
+		return nil, ErrCustomDomainLimit
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(input.Host), ".")
+	if host == "myru.online" || strings.HasSuffix(host, ".myru.online") {
+		return nil, ErrCustomDomainTaken
+	}
+
+	var existing int64
+	initializers.DB.Model(&models.CustomDomain{}).Where("host = ?", host).Count(&existing)
+	if existing > 0 {
+		return nil, ErrCustomDomainTaken
+	}
+
+	token, err := newDomainToken()
+	if err != nil {
+		return nil, err
+	}
+
+	domain := &models.CustomDomain{
+		DomainID:  site.ID,
+		UserID:    user.ID,
+		Host:      host,
+		Method:    input.Method,
+		Token:     token,
+		Status:    models.CustomDomainStatusPending,
+		ExpiredAt: user.ExpiredPlanAt,
+	}
+	if err := initializers.DB.Create(domain).Error; err != nil {
+		return nil, err
+	}
+	return domain, nil
+}
+
+func newDomainToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "myru-" + hex.EncodeToString(buf), nil
+}
+
+// CustomDomainTXTName is the record name the TXT token is looked up at.
+func CustomDomainTXTName(host string) string {
+	return customDomainTXTPrefix + host
+}
+
+// VerifyCustomDomain checks the ownership token of a pending domain. On
+// success the domain starts serving the site and a certificate is requested.
+func VerifyCustomDomain(domain *models.CustomDomain) error {
+	now := time.Now()
+	err := checkDomainToken(domain)
+	if err != nil {
+		initializers.DB.Model(domain).Updates(map[string]interface{}{"checked_at": now, "last_error": err.Error()})
+		return err
+	}
+
+	domain.Status = models.CustomDomainStatusVerified
+	domain.VerifiedAt = &now
+	domain.CheckedAt = &now
+	domain.LastError = ""
+	if err := initializers.DB.Model(domain).Updates(map[string]interface{}{
+		"status":      domain.Status,
+		"verified_at": now,
+		"checked_at":  now,
+		"last_error":  "",
+	}).Error; err != nil {
+		return err
+	}
+	forgetCustomDomain(domain.Host)
+
+	go IssueDomainCertificate(domain.ID)
+	return nil
+}
+
+var domainCheckClient = &http.Client{
+	Timeout: 10 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func checkDomainToken(domain *models.CustomDomain) error {
+	switch domain.Method {
+	case models.DomainVerificationDNS:
+		records, err := net.LookupTXT(CustomDomainTXTName(domain.Host))
+		if err != nil {
+			return errors.New("TXT record not found")
+		}
+		for _, record := range records {
+			if strings.TrimSpace(record) == domain.Token {
+				return nil
+			}
+		}
+		return errors.New("TXT record does not match the token")
+	case models.DomainVerificationHTTP:
+		resp, err := domainCheckClient.Get("http://" + domain.Host + CustomDomainVerificationPath)
+		if err != nil {
+			return errors.New("domain is not reachable")
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		if resp.StatusCode != http.StatusOK || strings.TrimSpace(string(body)) != domain.Token {
+			return errors.New("verification file does not match the token")
+		}
+		return nil
+	}
+	return errors.New("unknown verification method")
+}
+
+// VerifyPendingCustomDomains retries the verification of domains added
+// recently, DNS changes take a while to propagate.
+func VerifyPendingCustomDomains() {
+	var domains []models.CustomDomain
+	initializers.DB.Where("status = ? AND created_at > ?", models.CustomDomainStatusPending, time.Now().Add(-customDomainVerifyWindow)).Find(&domains)
+
+	for i := range domains {
+		VerifyCustomDomain(&domains[i])
+	}
+}
+
+// SyncCustomDomainExpiry moves the expiry of the domains of a user to the
+// end of the paid plan and revives domains that expired with the old plan.
+func SyncCustomDomainExpiry(userID uuid.UUID, expiredAt time.Time) {
+	initializers.DB.Model(&models.CustomDomain{}).Where("user_id = ?", userID).Update("expired_at", expiredAt)
+
+	var expired []models.CustomDomain
+	initializers.DB.Where("user_id = ? AND status = ?", userID, models.CustomDomainStatusExpired).Find(&expired)
+	for _, domain := range expired {
+		status := models.CustomDomainStatusPending
+		if domain.VerifiedAt != nil {
+			status = models.CustomDomainStatusVerified
+		}
+		initializers.DB.Model(&domain).Update("status", status)
+		forgetCustomDomain(domain.Host)
+		if status == models.CustomDomainStatusVerified {
+			go IssueDomainCertificate(domain.ID)
+		}
+	}
+}
+
+// ExpireCustomDomains stops serving the domains whose plan has ended.
+func ExpireCustomDomains() {
+	var domains []models.CustomDomain
+	initializers.DB.Where("status <> ? AND expired_at < ?", models.CustomDomainStatusExpired, time.Now()).Find(&domains)
+
+	for _, domain := range domains {
+		initializers.DB.Model(&domain).Update("status", models.CustomDomainStatusExpired)
+		forgetCustomDomain(domain.Host)
+		removeExportedCertificate(domain.Host)
+
+		title := "Custom domain disabled"
+		text := "The plan has ended, " + domain.Host + " no longer shows your site. Renew the plan to enable it again."
+		if err := Notification(title, text, domain.UserID.String(), "https://www.myru.online/profile/site"); err != nil {
+			log.Println("Could not notify about expired domain:", err)
+		}
+	}
+}
+
+// DeleteCustomDomain disconnects a domain and removes its certificate.
+func DeleteCustomDomain(domain *models.CustomDomain) error {
+	if err := initializers.DB.Delete(domain).Error; err != nil {
+		return err
+	}
+	initializers.DB.Where("host = ?", domain.Host).Delete(&models.DomainCertificate{})
+	removeExportedCertificate(domain.Host)
+	forgetCustomDomain(domain.Host)
+	return nil
+}
+
+type cachedCustomDomain struct {
+	domain  *models.CustomDomain
+	expires time.Time
+}
+
+// Every Host header reaching the backend is looked up, so the cache is
+// bounded: expired entries are dropped when it is full and misses are not
+// cached while it stays full.
+var (
+	customDomainCacheLock sync.Mutex
+	customDomainCache     = map[string]cachedCustomDomain{}
+)
+
+// ResolveCustomDomain returns the verified or active domain serving host, or
+// nil. Lookups are cached briefly since every request on a custom host needs
+// one.
+func ResolveCustomDomain(host string) *models.CustomDomain {
+	host = strings.ToLower(host)
+	now := time.Now()
+
+	customDomainCacheLock.Lock()
+	entry, ok := customDomainCache[host]
+	customDomainCacheLock.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.domain
+	}
+
+	var domain *models.CustomDomain
+	var found models.CustomDomain
+	if err := initializers.DB.Where("host = ? AND status IN ?", host, []string{models.CustomDomainStatusVerified, models.CustomDomainStatusActive}).
+		First(&found).Error; err == nil {
+		domain = &found
+	}
+
+	customDomainCacheLock.Lock()
+	defer customDomainCacheLock.Unlock()
+	if len(customDomainCache) >= customDomainCacheSize {
+		for key, cached := range customDomainCache {
+			if now.After(cached.expires) {
+				delete(customDomainCache, key)
+			}
+		}
+	}
+	if len(customDomainCache) < customDomainCacheSize || domain != nil {
+		customDomainCache[host] = cachedCustomDomain{domain: domain, expires: now.Add(customDomainCacheTTL)}
+	}
+	return domain
+}
+
+func forgetCustomDomain(host string) {
+	customDomainCacheLock.Lock()
+	defer customDomainCacheLock.Unlock()
+	delete(customDomainCache, host)
+}
+
+// RetryDomainCertificate requests the certificate of a domain again, at most
+// once per certificateRetryInterval since every order counts against the
+// rate limits of the ACME server.
+func RetryDomainCertificate(domain *models.CustomDomain) error {
+	ok, err := initializers.RedisClient.SetNX(context.Background(), certificateRetryKeyPrefix+strconv.FormatUint(domain.ID, 10), 1, certificateRetryInterval).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrCertificateRetry
+	}
+	go IssueDomainCertificate(domain.ID)
+	return nil
+}
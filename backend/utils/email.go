@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"fmt"
 	"html/template"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -58,6 +59,64 @@ type ContactUs struct {
 	Msg        string
 }
 
+type SavedSearchPost struct {
+	Title string
+	URL   string
+}
+
+type SavedSearchAlert struct {
+	Subject string
+	Name    string
+	Filter  string
+	Posts   []SavedSearchPost
+}
+
+type DeletionReceiptMail struct {
+	Subject     string
+	Name        string
+	ReceiptID   string
+	URL         string
+	CompletedAt string
+}
+
+type ConsultationReceiptMail struct {
+	Subject string
+	Name    string
+	Peer    string
+	Minutes int
+	Rate    string
+	Amount  string
+	Refund  string
+	Fee     string
+	Payout  string
+	Seller  bool
+	URL     string
+}
+
+// AppointmentMail is about an appointment, ICS is the calendar attached to
+// it with its iTIP method, REQUEST or CANCEL.
+type AppointmentMail struct {
+	Subject   string
+	Name      string
+	Message   string
+	When      string
+	Link      string
+	ICS       []byte
+	ICSMethod string
+}
+
+// LeadMail delivers a call-back request, or its follow-up, to the seller.
+type LeadMail struct {
+	Subject string
+	Name    string
+	Message string
+	Contact string
+	Phone   string
+	Post    string
+	PostURL string
+	URL     string
+}
+
 // ? Email template parser
 
 func ParseTemplateDir(dir string) (*template.Template, error) {
@@ -110,6 +169,16 @@ func SendEmail(user *models.User, data interface{}, emailTemplatePrefix string,
 		emailTemplate = emailTemplatePrefix + "_" + language + ".html"
 	case *ContactUs:
 		emailTemplate = emailTemplatePrefix + "_" + language + ".html"
+	case *SavedSearchAlert:
+		emailTemplate = emailTemplatePrefix + "_" + language + ".html"
+	case *DeletionReceiptMail:
+		emailTemplate = emailTemplatePrefix + "_" + language + ".html"
+	case *ConsultationReceiptMail:
+		emailTemplate = emailTemplatePrefix + "_" + language + ".html"
+	case *AppointmentMail:
+		emailTemplate = emailTemplatePrefix + "_" + language + ".html"
+	case *LeadMail:
+		emailTemplate = emailTemplatePrefix + "_" + language + ".html"
 	default:
 		log.Fatal("Unsupported email data type")
 	}
@@ -138,11 +207,29 @@ func SendEmail(user *models.User, data interface{}, emailTemplatePrefix string,
 		m.SetHeader("Subject", data.Subject)
 	case *ContactUs:
 		m.SetHeader("Subject", data.Subject)
+	case *SavedSearchAlert:
+		m.SetHeader("Subject", data.Subject)
+	case *DeletionReceiptMail:
+		m.SetHeader("Subject", data.Subject)
+	case *ConsultationReceiptMail:
+		m.SetHeader("Subject", data.Subject)
+	case *AppointmentMail:
+		m.SetHeader("Subject", data.Subject)
+	case *LeadMail:
+		m.SetHeader("Subject", data.Subject)
 	default:
 		log.Println("Unsupported email data type")
 	}
 	m.SetBody("text/html", body.String())
 	m.AddAlternative("text/plain", html2text.HTML2Text(body.String()))
+	if mail, ok := data.(*AppointmentMail); ok && len(mail.ICS) > 0 {
+		m.Attach("invite.ics", gomail.SetCopyFunc(func(w io.Writer) error {
+			_, err := w.Write(mail.ICS)
+			return err
+		}), gomail.SetHeader(map[string][]string{
+			"Content-Type": {"text/calendar; charset=utf-8; method=" + mail.ICSMethod},
+		}))
+	}
 
 	fmt.Println(data)
 
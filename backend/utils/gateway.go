@@ -0,0 +1,646 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/realtime"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/redis/go-redis/v9"
+	uuid "github.com/satori/go.uuid"
+)
+
+// The websocket gateway routes messages to connections held by any node.
+// Each hub registers its connections in Redis, ws:<hub>:session:<id> holds
+// the node and user of a connection and ws:<hub>:user:<id> the connections
+// of a user. Nodes receive messages for their connections on their own
+// pub/sub channel and broadcasts on a shared one.
+const (
+	gatewayKeyPrefix        = "ws:"
+	gatewayNodeChannel      = "ws:node:"
+	gatewayBroadcastChannel = "ws:broadcast"
+	gatewaySweepLock        = "ws:sweep"
+	// Connections of a node that stopped refreshing them expire after this.
+	gatewaySessionTTL = 90 * time.Second
+	gatewayHeartbeat  = 30 * time.Second
+	gatewaySweepEvery = 5 * time.Minute
+	gatewayUserTTL    = 24 * time.Hour
+
+	// Each connection has its own writer, a client that does not read its
+	// frames for gatewayWriteTimeout or lets gatewaySendQueue of them pile
+	// up is dropped, so it cannot hold back the others.
+	gatewaySendQueue    = 256
+	gatewayWriteTimeout = 10 * time.Second
+)
+
+var errSlowConsumer = errors.New("websocket client too slow, connection dropped")
+
+// ErrSessionNotConnected is returned for sessions no node holds. It is the
+// not_connected error of the realtime protocol, handlers return it as is.
+var ErrSessionNotConnected error = realtime.ErrNotConnected
+
+// GatewayNodeID identifies this process in the connection registry.
+var GatewayNodeID = gatewayNodeID()
+
+func gatewayNodeID() string {
+	host, _ := os.Hostname()
+	return host + "-" + uuid.NewV4().String()[:8]
+}
+
+var (
+	hubs   = make(map[string]*Hub)
+	hubsMu sync.RWMutex
+)
+
+// SocketHub holds the connections of the main websocket.
+var SocketHub = NewHub("socket")
+
+// Hub is a namespace of websocket connections keyed by session ID.
+type Hub struct {
+	name  string
+	mu    sync.RWMutex
+	conns map[string]*hubConn
+}
+
+// hubConn queues the writes to a connection, which must not be concurrent,
+// for its writer goroutine. Version is the realtime protocol it negotiated,
+// 0 for the legacy one.
+type hubConn struct {
+	conn    *websocket.Conn
+	version int
+	send    chan hubFrame
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+type hubFrame struct {
+	messageType int
+	data        []byte
+}
+
+func newHubConn(conn *websocket.Conn, version int) *hubConn {
+	c := &hubConn{
+		conn:    conn,
+		version: version,
+		send:    make(chan hubFrame, gatewaySendQueue),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go c.writeLoop()
+	return c
+}
+
+// write queues a frame. A full queue means the client stopped reading, it
+// is disconnected rather than blocking the caller.
+func (c *hubConn) write(messageType int, data []byte) error {
+	select {
+	case <-c.done:
+		return ErrSessionNotConnected
+	default:
+	}
+	select {
+	case c.send <- hubFrame{messageType: messageType, data: data}:
+		return nil
+	case <-c.done:
+		return ErrSessionNotConnected
+	default:
+		c.drop()
+		return errSlowConsumer
+	}
+}
+
+func (c *hubConn) writeLoop() {
+	defer close(c.stopped)
+	for {
+		select {
+		case <-c.done:
+			return
+		case frame := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(gatewayWriteTimeout))
+			if err := c.conn.WriteMessage(frame.messageType, frame.data); err != nil {
+				c.drop()
+				return
+			}
+			if frame.messageType == websocket.CloseMessage {
+				c.drop()
+				return
+			}
+		}
+	}
+}
+
+// drop stops the writer and closes the connection, the read loop of its
+// handler then fails and unregisters it.
+func (c *hubConn) drop() {
+	c.once.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// stop ends the writer and waits for it, the connection must not be written
+// once its handler returned.
+func (c *hubConn) stop() {
+	c.once.Do(func() {
+		close(c.done)
+	})
+	<-c.stopped
+}
+
+// Message is delivered to each connection in the encoding of its protocol,
+// as the realtime event or, to legacy connections, as the Legacy payload.
+// Connections are skipped when their encoding is missing.
+type Message struct {
+	Event  string
+	Data   interface{}
+	Legacy []byte
+}
+
+type gatewayEnvelope struct {
+	Hub     string          `json:"hub"`
+	Session string          `json:"session,omitempty"`
+	Event   string          `json:"event,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Legacy  []byte          `json:"legacy,omitempty"`
+}
+
+func newGatewayEnvelope(hub, sessionID string, message Message) (*gatewayEnvelope, error) {
+	envelope := &gatewayEnvelope{Hub: hub, Session: sessionID, Event: message.Event, Legacy: message.Legacy}
+	if message.Event != "" && message.Data != nil {
+		data, err := json.Marshal(message.Data)
+		if err != nil {
+			return nil, err
+		}
+		envelope.Data = data
+	}
+	return envelope, nil
+}
+
+// deliver writes the envelope to a connection of this node.
+func (e *gatewayEnvelope) deliver(conn *hubConn) error {
+	if conn.version == 0 {
+		if e.Legacy == nil {
+			return nil
+		}
+		return conn.write(websocket.TextMessage, e.Legacy)
+	}
+	if e.Event == "" {
+		return nil
+	}
+	frame, err := realtime.EncodeEvent(e.Event, e.Data)
+	if err != nil {
+		return err
+	}
+	return conn.write(websocket.TextMessage, frame)
+}
+
+// NewHub creates a hub, the name separates its sessions from the other hubs.
+func NewHub(name string) *Hub {
+	hub := &Hub{name: name, conns: make(map[string]*hubConn)}
+	hubsMu.Lock()
+	hubs[name] = hub
+	hubsMu.Unlock()
+	return hub
+}
+
+func (h *Hub) sessionKey(sessionID string) string {
+	return gatewayKeyPrefix + h.name + ":session:" + sessionID
+}
+
+func (h *Hub) userKey(userID string) string {
+	return gatewayKeyPrefix + h.name + ":user:" + userID
+}
+
+// Register adds a connection of this node speaking the given version of the
+// realtime protocol, 0 for the legacy one.
+func (h *Hub) Register(sessionID string, conn *websocket.Conn, version int) {
+	h.mu.Lock()
+	previous := h.conns[sessionID]
+	h.conns[sessionID] = newHubConn(conn, version)
+	h.mu.Unlock()
+	if previous != nil {
+		previous.drop()
+	}
+
+	ctx := context.Background()
+	_, err := initializers.RedisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, h.sessionKey(sessionID), "node", GatewayNodeID)
+		pipe.Expire(ctx, h.sessionKey(sessionID), gatewaySessionTTL)
+		return nil
+	})
+	if err != nil {
+		log.Println("Could not register websocket session:", err)
+	}
+}
+
+// Unregister removes a connection of this node.
+func (h *Hub) Unregister(sessionID string) {
+	h.mu.Lock()
+	conn := h.conns[sessionID]
+	delete(h.conns, sessionID)
+	h.mu.Unlock()
+	if conn != nil {
+		conn.stop()
+	}
+
+	ctx := context.Background()
+	userID, _ := initializers.RedisClient.HGet(ctx, h.sessionKey(sessionID), "user").Result()
+	initializers.RedisClient.Del(ctx, h.sessionKey(sessionID))
+	if userID != "" {
+		initializers.RedisClient.SRem(ctx, h.userKey(userID), sessionID)
+	}
+}
+
+// BindUser links a connection to the user logged in on it, messages for the
+// user then reach all of their tabs and devices.
+func (h *Hub) BindUser(sessionID string, userID uuid.UUID) error {
+	ctx := context.Background()
+	exists, err := initializers.RedisClient.Exists(ctx, h.sessionKey(sessionID)).Result()
+	if err != nil || exists == 0 {
+		return err
+	}
+	_, err = initializers.RedisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, h.sessionKey(sessionID), "user", userID.String())
+		pipe.SAdd(ctx, h.userKey(userID.String()), sessionID)
+		pipe.Expire(ctx, h.userKey(userID.String()), gatewayUserTTL)
+		return nil
+	})
+	return err
+}
+
+// SessionUser returns the ID of the user logged in on a connection, empty
+// for guests.
+func (h *Hub) SessionUser(sessionID string) string {
+	userID, _ := initializers.RedisClient.HGet(context.Background(), h.sessionKey(sessionID), "user").Result()
+	return userID
+}
+
+// UnbindUser unlinks a connection from its user, e.g. on logout.
+func (h *Hub) UnbindUser(sessionID string) {
+	ctx := context.Background()
+	userID, _ := initializers.RedisClient.HGet(ctx, h.sessionKey(sessionID), "user").Result()
+	if userID == "" {
+		return
+	}
+	initializers.RedisClient.HDel(ctx, h.sessionKey(sessionID), "user")
+	initializers.RedisClient.SRem(ctx, h.userKey(userID), sessionID)
+}
+
+// LocalCount returns the number of connections of this node.
+func (h *Hub) LocalCount() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.conns)
+}
+
+// WriteLocal queues a frame for a connection of this node, for control
+// messages of the connection handler itself.
+func (h *Hub) WriteLocal(sessionID string, messageType int, data []byte) error {
+	h.mu.RLock()
+	conn, ok := h.conns[sessionID]
+	h.mu.RUnlock()
+	if !ok {
+		return ErrSessionNotConnected
+	}
+	return conn.write(messageType, data)
+}
+
+// KeepAlive pings a realtime connection of this node every
+// realtime.PingInterval until done is closed or the write fails.
+func (h *Hub) KeepAlive(sessionID string, done <-chan struct{}) {
+	ping, _ := realtime.Encode(realtime.TypePing, "", "", nil)
+	ticker := time.NewTicker(realtime.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := h.WriteLocal(sessionID, websocket.TextMessage, ping); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Connected reports whether a session is connected to any node.
+func (h *Hub) Connected(sessionID string) bool {
+	h.mu.RLock()
+	_, ok := h.conns[sessionID]
+	h.mu.RUnlock()
+	if ok {
+		return true
+	}
+	exists, _ := initializers.RedisClient.Exists(context.Background(), h.sessionKey(sessionID)).Result()
+	return exists > 0
+}
+
+// Send delivers a message to one connection on whichever node holds it.
+func (h *Hub) Send(sessionID string, message Message) error {
+	envelope, err := newGatewayEnvelope(h.name, sessionID, message)
+	if err != nil {
+		return err
+	}
+	return h.send(envelope)
+}
+
+func (h *Hub) send(envelope *gatewayEnvelope) error {
+	sessionID := envelope.Session
+	h.mu.RLock()
+	conn, ok := h.conns[sessionID]
+	h.mu.RUnlock()
+	if ok {
+		return envelope.deliver(conn)
+	}
+
+	ctx := context.Background()
+	node, err := initializers.RedisClient.HGet(ctx, h.sessionKey(sessionID), "node").Result()
+	if err == redis.Nil || node == GatewayNodeID {
+		return ErrSessionNotConnected
+	}
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	receivers, err := initializers.RedisClient.Publish(ctx, gatewayNodeChannel+node, payload).Result()
+	if err != nil {
+		return err
+	}
+	if receivers == 0 {
+		// The node is gone, its entry is stale
+		h.Unregister(sessionID)
+		return ErrSessionNotConnected
+	}
+	return nil
+}
+
+// SendToUser delivers a message to every connection of the user. It returns
+// the number of connections reached.
+func (h *Hub) SendToUser(userID string, message Message) (int, error) {
+	return h.sendToUser(userID, "", message)
+}
+
+// SendToOtherSessions delivers a message to the connections of the user
+// except the given one.
+func (h *Hub) SendToOtherSessions(userID, sessionID string, message Message) (int, error) {
+	return h.sendToUser(userID, sessionID, message)
+}
+
+func (h *Hub) sendToUser(userID, except string, message Message) (int, error) {
+	sessions, err := initializers.RedisClient.SMembers(context.Background(), h.userKey(userID)).Result()
+	if err != nil {
+		return 0, err
+	}
+	envelope, err := newGatewayEnvelope(h.name, "", message)
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	var lastErr error
+	for _, sessionID := range sessions {
+		if sessionID == except {
+			continue
+		}
+		envelope.Session = sessionID
+		err := h.send(envelope)
+		switch err {
+		case nil:
+			delivered++
+		case ErrSessionNotConnected:
+			initializers.RedisClient.SRem(context.Background(), h.userKey(userID), sessionID)
+		default:
+			lastErr = err
+		}
+	}
+	if delivered == 0 && lastErr != nil {
+		return 0, lastErr
+	}
+	return delivered, nil
+}
+
+// Deliver sends a message to the session and, when a user is logged in on
+// it, to all the other connections of that user too.
+func (h *Hub) Deliver(sessionID string, message Message) error {
+	userID, err := initializers.RedisClient.HGet(context.Background(), h.sessionKey(sessionID), "user").Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if userID == "" {
+		return h.Send(sessionID, message)
+	}
+
+	delivered, err := h.SendToUser(userID, message)
+	if err != nil {
+		return err
+	}
+	if delivered == 0 {
+		return ErrSessionNotConnected
+	}
+	return nil
+}
+
+// Broadcast delivers a message to every connection of the hub on all nodes.
+func (h *Hub) Broadcast(message Message) error {
+	envelope, err := newGatewayEnvelope(h.name, "", message)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	return initializers.RedisClient.Publish(context.Background(), gatewayBroadcastChannel, payload).Err()
+}
+
+func (h *Hub) deliverLocal(envelope *gatewayEnvelope) {
+	if envelope.Session != "" {
+		h.mu.RLock()
+		conn, ok := h.conns[envelope.Session]
+		h.mu.RUnlock()
+		if !ok {
+			log.Println("Could not deliver websocket message:", ErrSessionNotConnected)
+			return
+		}
+		if err := envelope.deliver(conn); err != nil {
+			log.Println("Could not deliver websocket message:", err)
+		}
+		return
+	}
+
+	h.mu.RLock()
+	conns := make([]*hubConn, 0, len(h.conns))
+	for _, conn := range h.conns {
+		conns = append(conns, conn)
+	}
+	h.mu.RUnlock()
+	for _, conn := range conns {
+		if err := envelope.deliver(conn); err != nil {
+			log.Println("Could not broadcast websocket message:", err)
+		}
+	}
+}
+
+// refresh extends the registry entries of the connections of this node.
+func (h *Hub) refresh(ctx context.Context) error {
+	h.mu.RLock()
+	sessions := make([]string, 0, len(h.conns))
+	for sessionID := range h.conns {
+		sessions = append(sessions, sessionID)
+	}
+	h.mu.RUnlock()
+	if len(sessions) == 0 {
+		return nil
+	}
+
+	_, err := initializers.RedisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, sessionID := range sessions {
+			pipe.HSet(ctx, h.sessionKey(sessionID), "node", GatewayNodeID)
+			pipe.Expire(ctx, h.sessionKey(sessionID), gatewaySessionTTL)
+		}
+		return nil
+	})
+	return err
+}
+
+// sweep removes the connections whose entry expired from the user sets.
+func (h *Hub) sweep(ctx context.Context) {
+	var cursor uint64
+	for {
+		keys, next, err := initializers.RedisClient.Scan(ctx, cursor, h.userKey("*"), 100).Result()
+		if err != nil {
+			log.Println("Could not scan websocket users:", err)
+			return
+		}
+		for _, key := range keys {
+			sessions, err := initializers.RedisClient.SMembers(ctx, key).Result()
+			if err != nil {
+				continue
+			}
+			for _, sessionID := range sessions {
+				if exists, err := initializers.RedisClient.Exists(ctx, h.sessionKey(sessionID)).Result(); err == nil && exists == 0 {
+					initializers.RedisClient.SRem(ctx, key, sessionID)
+				}
+			}
+		}
+		if next == 0 {
+			return
+		}
+		cursor = next
+	}
+}
+
+// DrainGateway sends server.draining to the connections of this node, and
+// the legacy reconnect command, then closes them with 1012 Service Restart.
+// Reconnects are spread over retryAfter so the other nodes are not flooded.
+// It returns the number of connections closed.
+func DrainGateway(retryAfter time.Duration) int {
+	legacy, _ := json.Marshal(ClientMessage{Command: "reconnect"})
+	closeFrame := websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server restart")
+
+	closed := 0
+	for _, hub := range allHubs() {
+		hub.mu.RLock()
+		conns := make([]*hubConn, 0, len(hub.conns))
+		for _, conn := range hub.conns {
+			conns = append(conns, conn)
+		}
+		hub.mu.RUnlock()
+
+		for _, conn := range conns {
+			wait := 1 + rand.Intn(int(retryAfter/time.Second)+1)
+			envelope, err := newGatewayEnvelope(hub.name, "", Message{
+				Event:  realtime.EventServerDraining,
+				Data:   realtime.ServerDrainingEvent{RetryAfter: wait},
+				Legacy: legacy,
+			})
+			if err == nil {
+				envelope.deliver(conn)
+			}
+			// The writer closes the connection once the close frame is out
+			if conn.write(websocket.CloseMessage, closeFrame) != nil {
+				conn.drop()
+			}
+			closed++
+		}
+	}
+	return closed
+}
+
+func allHubs() []*Hub {
+	hubsMu.RLock()
+	defer hubsMu.RUnlock()
+	list := make([]*Hub, 0, len(hubs))
+	for _, hub := range hubs {
+		list = append(list, hub)
+	}
+	return list
+}
+
+// StartGateway subscribes this node to its channels and keeps its registry
+// entries alive until ctx is done.
+func StartGateway(ctx context.Context) {
+	pubsub := initializers.RedisClient.Subscribe(ctx, gatewayNodeChannel+GatewayNodeID, gatewayBroadcastChannel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		log.Println("Could not subscribe to websocket channels:", err)
+	}
+
+	go func() {
+		defer pubsub.Close()
+		for message := range pubsub.Channel() {
+			var envelope gatewayEnvelope
+			if err := json.Unmarshal([]byte(message.Payload), &envelope); err != nil {
+				log.Println("Invalid websocket envelope:", err)
+				continue
+			}
+			hubsMu.RLock()
+			hub, ok := hubs[envelope.Hub]
+			hubsMu.RUnlock()
+			if ok {
+				hub.deliverLocal(&envelope)
+			}
+		}
+	}()
+
+	go func() {
+		heartbeat := time.NewTicker(gatewayHeartbeat)
+		defer heartbeat.Stop()
+		sweep := time.NewTicker(gatewaySweepEvery)
+		defer sweep.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-heartbeat.C:
+				for _, hub := range allHubs() {
+					if err := hub.refresh(ctx); err != nil {
+						log.Println("Could not refresh websocket sessions:", err)
+					}
+				}
+			case <-sweep.C:
+				// One node sweeps per interval
+				if ok, err := initializers.RedisClient.SetNX(ctx, gatewaySweepLock, GatewayNodeID, gatewaySweepEvery).Result(); err != nil || !ok {
+					continue
+				}
+				for _, hub := range allHubs() {
+					hub.sweep(ctx)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,251 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"hyperpage/initializers"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	defaultHealthCheckTimeout = 2 * time.Second
+	defaultShutdownDrainDelay = 5 * time.Second
+	defaultShutdownTimeout    = 25 * time.Second
+
+	// Readiness is probed often by every load balancer, the checks are
+	// reused for this long.
+	healthReportTTL = 5 * time.Second
+)
+
+// ShutdownSettings are the settings of the probes and the graceful
+// shutdown, see CurrentShutdownSettings.
+type ShutdownSettings struct {
+	CheckTimeout time.Duration
+	DrainDelay   time.Duration
+	Timeout      time.Duration
+}
+
+// CurrentShutdownSettings returns the configured probe and shutdown
+// settings, with defaults for the unset ones.
+func CurrentShutdownSettings() ShutdownSettings {
+	config, _ := initializers.LoadConfig(".")
+	settings := ShutdownSettings{
+		CheckTimeout: config.HealthCheckTimeout,
+		DrainDelay:   config.ShutdownDrainDelay,
+		Timeout:      config.ShutdownTimeout,
+	}
+	if settings.CheckTimeout <= 0 {
+		settings.CheckTimeout = defaultHealthCheckTimeout
+	}
+	if settings.DrainDelay <= 0 {
+		settings.DrainDelay = defaultShutdownDrainDelay
+	}
+	if settings.Timeout <= 0 {
+		settings.Timeout = defaultShutdownTimeout
+	}
+	return settings
+}
+
+var (
+	startedAt = time.Now()
+	draining  atomic.Bool
+
+	healthMu     sync.Mutex
+	healthReport *HealthReport
+)
+
+// SetDraining marks the node as shutting down, it is not ready from then on.
+func SetDraining() {
+	draining.Store(true)
+}
+
+// Draining reports whether the node is shutting down.
+func Draining() bool {
+	return draining.Load()
+}
+
+// HealthCheck is the result of checking one dependency. Critical
+// dependencies make the node unready when they fail.
+type HealthCheck struct {
+	Name      string `json:"name"`
+	Critical  bool   `json:"critical"`
+	OK        bool   `json:"ok"`
+	Skipped   bool   `json:"skipped,omitempty"`
+	LatencyMS int64  `json:"latencyMs"`
+	Error     string `json:"error,omitempty"`
+}
+
+// HealthReport is the readiness of the node.
+type HealthReport struct {
+	Ready     bool          `json:"ready"`
+	Draining  bool          `json:"draining"`
+	Checks    []HealthCheck `json:"checks"`
+	CheckedAt time.Time     `json:"checkedAt"`
+}
+
+// Liveness reports that the process is up, it checks no dependency so a
+// failing database does not get the node restarted.
+func Liveness() map[string]interface{} {
+	return map[string]interface{}{
+		"uptime":     int64(time.Since(startedAt).Seconds()),
+		"goroutines": runtime.NumGoroutine(),
+		"draining":   Draining(),
+	}
+}
+
+type healthProbe struct {
+	name     string
+	critical bool
+	check    func(ctx context.Context, config initializers.Config, timeout time.Duration) (bool, error)
+}
+
+// Postgres and Redis back nearly every request, RabbitMQ, Centrifugo and
+// Telegram only some features, so those are reported but do not make the
+// node unready.
+var healthProbes = []healthProbe{
+	{name: "postgres", critical: true, check: checkPostgres},
+	{name: "redis", critical: true, check: checkRedis},
+	{name: "rabbitmq", check: checkRabbitMQ},
+	{name: "centrifugo", check: checkCentrifugo},
+	{name: "telegram", check: checkTelegram},
+}
+
+// Readiness checks the dependencies of the node, each within the configured
+// timeout, and reuses the result for a few seconds. A draining node is
+// never ready.
+func Readiness() HealthReport {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+
+	if healthReport == nil || time.Since(healthReport.CheckedAt) > healthReportTTL {
+		report := checkHealth()
+		healthReport = &report
+	}
+
+	report := *healthReport
+	report.Draining = Draining()
+	if report.Draining {
+		report.Ready = false
+	}
+	return report
+}
+
+func checkHealth() HealthReport {
+	config, _ := initializers.LoadConfig(".")
+	timeout := CurrentShutdownSettings().CheckTimeout
+
+	checks := make([]HealthCheck, len(healthProbes))
+	var wg sync.WaitGroup
+	for i, probe := range healthProbes {
+		wg.Add(1)
+		go func(i int, probe healthProbe) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			started := time.Now()
+			ran, err := probe.check(ctx, config, timeout)
+			checks[i] = HealthCheck{
+				Name:      probe.name,
+				Critical:  probe.critical,
+				OK:        err == nil,
+				Skipped:   !ran,
+				LatencyMS: time.Since(started).Milliseconds(),
+			}
+			if err != nil {
+				checks[i].Error = err.Error()
+			}
+		}(i, probe)
+	}
+	wg.Wait()
+
+	report := HealthReport{Ready: true, Checks: checks, CheckedAt: time.Now()}
+	for _, check := range checks {
+		if check.Critical && !check.OK {
+			report.Ready = false
+		}
+	}
+	return report
+}
+
+func checkPostgres(ctx context.Context, config initializers.Config, timeout time.Duration) (bool, error) {
+	if initializers.DB == nil {
+		return true, fmt.Errorf("not connected")
+	}
+	db, err := initializers.DB.DB()
+	if err != nil {
+		return true, err
+	}
+	return true, db.PingContext(ctx)
+}
+
+func checkRedis(ctx context.Context, config initializers.Config, timeout time.Duration) (bool, error) {
+	if initializers.RedisClient == nil {
+		return true, fmt.Errorf("not connected")
+	}
+	return true, initializers.RedisClient.Ping(ctx).Err()
+}
+
+func checkRabbitMQ(ctx context.Context, config initializers.Config, timeout time.Duration) (bool, error) {
+	if config.RabbitMQUri == "" {
+		return false, nil
+	}
+	conn, err := amqp.DialConfig(config.RabbitMQUri, amqp.Config{
+		Dial: amqp.DefaultDial(timeout),
+	})
+	if err != nil {
+		return true, err
+	}
+	return true, conn.Close()
+}
+
+func checkCentrifugo(ctx context.Context, config initializers.Config, timeout time.Duration) (bool, error) {
+	if config.CentrifugoHttpApiEndpoint == "" {
+		return false, nil
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, config.CentrifugoHttpApiEndpoint+"/api/info", strings.NewReader("{}"))
+	if err != nil {
+		return true, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-API-Key", config.CentrifugoHttpApiKey)
+	return true, checkHTTP(request)
+}
+
+func checkTelegram(ctx context.Context, config initializers.Config, timeout time.Duration) (bool, error) {
+	if config.TELEGRAM_TOKEN == "" {
+		return false, nil
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://api.telegram.org/bot"+config.TELEGRAM_TOKEN+"/getMe", nil)
+	if err != nil {
+		return true, err
+	}
+	return true, checkHTTP(request)
+}
+
+func checkHTTP(request *http.Request) error {
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		// The URL of a failed request would leak the bot token.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err
+		}
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("received status %d", response.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const icsTimeFormat = "20060102T150405Z"
+
+// ICSEvent is a VEVENT of an iCalendar.
+type ICSEvent struct {
+	UID            string
+	Summary        string
+	Description    string
+	URL            string
+	Start          time.Time
+	End            time.Time
+	Stamp          time.Time
+	Sequence       int
+	Cancelled      bool
+	OrganizerName  string
+	OrganizerEmail string
+}
+
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// writeICSLine writes a content line, folded at 75 octets as RFC 5545 asks.
+func writeICSLine(buf *bytes.Buffer, line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		buf.WriteString(line[:cut])
+		buf.WriteString("\r\n ")
+		line = line[cut:]
+		// The leading space of continuation lines counts
+		limit = 74
+	}
+	buf.WriteString(line)
+	buf.WriteString("\r\n")
+}
+
+// BuildICS returns an iCalendar with the events. method is the iTIP method,
+// PUBLISH for feeds, REQUEST for invitations and CANCEL for cancellations.
+func BuildICS(method, name string, events []ICSEvent) []byte {
+	var buf bytes.Buffer
+	writeICSLine(&buf, "BEGIN:VCALENDAR")
+	writeICSLine(&buf, "VERSION:2.0")
+	writeICSLine(&buf, "PRODID:-//myru.online//Appointments//EN")
+	writeICSLine(&buf, "CALSCALE:GREGORIAN")
+	writeICSLine(&buf, "METHOD:"+method)
+	if name != "" {
+		writeICSLine(&buf, "X-WR-CALNAME:"+icsEscaper.Replace(name))
+	}
+	for _, event := range events {
+		writeICSLine(&buf, "BEGIN:VEVENT")
+		writeICSLine(&buf, "UID:"+event.UID)
+		writeICSLine(&buf, "DTSTAMP:"+event.Stamp.UTC().Format(icsTimeFormat))
+		writeICSLine(&buf, "DTSTART:"+event.Start.UTC().Format(icsTimeFormat))
+		writeICSLine(&buf, "DTEND:"+event.End.UTC().Format(icsTimeFormat))
+		writeICSLine(&buf, "SEQUENCE:"+strconv.Itoa(event.Sequence))
+		writeICSLine(&buf, "SUMMARY:"+icsEscaper.Replace(event.Summary))
+		if event.Description != "" {
+			writeICSLine(&buf, "DESCRIPTION:"+icsEscaper.Replace(event.Description))
+		}
+		if event.URL != "" {
+			writeICSLine(&buf, "URL:"+event.URL)
+			writeICSLine(&buf, "LOCATION:"+icsEscaper.Replace(event.URL))
+		}
+		if event.OrganizerEmail != "" {
+			writeICSLine(&buf, `ORGANIZER;CN="`+strings.ReplaceAll(event.OrganizerName, `"`, "")+`":mailto:`+event.OrganizerEmail)
+		}
+		if event.Cancelled {
+			writeICSLine(&buf, "STATUS:CANCELLED")
+		} else {
+			writeICSLine(&buf, "STATUS:CONFIRMED")
+		}
+		writeICSLine(&buf, "END:VEVENT")
+	}
+	writeICSLine(&buf, "END:VCALENDAR")
+	return buf.Bytes()
+}
@@ -0,0 +1,167 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	// TURN credentials are valid this long unless TURN_CREDENTIAL_TTL is set.
+	defaultTurnCredentialTTL = 12 * time.Hour
+	// ICE_SERVERS entries of this region are given to every region.
+	iceAnyRegion = "*"
+)
+
+var ErrICENotConfigured = errors.New("no ICE servers are configured")
+
+// ICEServer is an RTCIceServer of the WebRTC configuration. TURN servers
+// carry the credentials.
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// ICEConfig is handed to WebRTC clients. The TURN credentials stop working
+// at ExpiresAt, clients fetch a new configuration for later connections.
+type ICEConfig struct {
+	Region     string      `json:"region"`
+	Regions    []string    `json:"regions"`
+	ICEServers []ICEServer `json:"iceServers"`
+	TTL        int         `json:"ttl"`
+	ExpiresAt  time.Time   `json:"expiresAt"`
+}
+
+// iceServerURLs parses ICE_SERVERS into the URLs of each region.
+func iceServerURLs(servers string) map[string][]string {
+	regions := make(map[string][]string)
+	for _, entry := range strings.Split(servers, ",") {
+		region, url, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || url == "" {
+			continue
+		}
+		region = strings.ToLower(strings.TrimSpace(region))
+		regions[region] = append(regions[region], strings.TrimSpace(url))
+	}
+	return regions
+}
+
+// TurnCredentials returns the username and password of the coturn REST API
+// scheme: the username is the expiry and the identity of the user, the
+// password its HMAC with the secret shared with the TURN servers.
+func TurnCredentials(secret, identity string, expiresAt time.Time) (string, string) {
+	username := strconv.FormatInt(expiresAt.Unix(), 10)
+	if identity != "" {
+		username += ":" + identity
+	}
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// GetICEConfig returns the ICE servers of the region, the default region for
+// an unknown or empty one, with TURN credentials issued to identity.
+func GetICEConfig(identity, region string) (*ICEConfig, error) {
+	return iceConfig(identity, region, 0)
+}
+
+// GetCallICEConfig returns the ICE servers of a call of the user. The TURN
+// credentials last until the call reaches CallMaxDuration, so the relay is
+// not open to anyone after it. Without a call, for the offer of a call
+// about to start, they last CallMaxDuration.
+func GetCallICEConfig(userID, callID uuid.UUID, region string) (*ICEConfig, error) {
+	ttl := CallMaxDuration
+	if callID != uuid.Nil {
+		var call models.Call
+		if err := initializers.DB.First(&call, "id = ?", callID).Error; err != nil {
+			return nil, ErrCallNotFound
+		}
+		if call.CallerID != userID && call.CalleeID != userID {
+			return nil, ErrCallNotFound
+		}
+		if !call.Active() {
+			return nil, ErrCallState
+		}
+		ttl = time.Until(call.CreatedAt.Add(CallMaxDuration))
+		if ttl < time.Minute {
+			ttl = time.Minute
+		}
+	}
+	return iceConfig(userID.String(), region, ttl)
+}
+
+// iceConfig issues credentials for ttl, capped by TURN_CREDENTIAL_TTL, or
+// for TURN_CREDENTIAL_TTL when ttl is 0.
+func iceConfig(identity, region string, ttl time.Duration) (*ICEConfig, error) {
+	config, _ := initializers.LoadConfig(".")
+
+	servers := iceServerURLs(config.ICEServers)
+	regions := make([]string, 0, len(servers))
+	for name := range servers {
+		if name != iceAnyRegion {
+			regions = append(regions, name)
+		}
+	}
+	sort.Strings(regions)
+
+	region = strings.ToLower(strings.TrimSpace(region))
+	if _, ok := servers[region]; !ok || region == iceAnyRegion {
+		region = strings.ToLower(config.ICEDefaultRegion)
+		if _, ok := servers[region]; !ok {
+			region = ""
+			if len(regions) > 0 {
+				region = regions[0]
+			}
+		}
+	}
+
+	urls := append(append([]string{}, servers[iceAnyRegion]...), servers[region]...)
+	if len(urls) == 0 {
+		return nil, ErrICENotConfigured
+	}
+
+	maxTTL := config.TurnCredentialTTL
+	if maxTTL <= 0 {
+		maxTTL = defaultTurnCredentialTTL
+	}
+	if ttl <= 0 || ttl > maxTTL {
+		ttl = maxTTL
+	}
+	expiresAt := time.Now().Add(ttl).UTC().Truncate(time.Second)
+
+	var stun, turn []string
+	for _, url := range urls {
+		if strings.HasPrefix(url, "turn:") || strings.HasPrefix(url, "turns:") {
+			turn = append(turn, url)
+		} else {
+			stun = append(stun, url)
+		}
+	}
+
+	result := &ICEConfig{
+		Region:     region,
+		Regions:    regions,
+		ICEServers: []ICEServer{},
+		TTL:        int(ttl / time.Second),
+		ExpiresAt:  expiresAt,
+	}
+	if len(stun) > 0 {
+		result.ICEServers = append(result.ICEServers, ICEServer{URLs: stun})
+	}
+	if len(turn) > 0 && config.TurnSecret != "" {
+		username, credential := TurnCredentials(config.TurnSecret, identity, expiresAt)
+		result.ICEServers = append(result.ICEServers, ICEServer{URLs: turn, Username: username, Credential: credential})
+	}
+	return result, nil
+}
@@ -0,0 +1,369 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+
+	"github.com/disintegration/imaging"
+	"github.com/jackc/pgtype"
+	uuid "github.com/satori/go.uuid"
+	_ "golang.org/x/image/webp"
+	"gorm.io/gorm/clause"
+)
+
+// Widths of the generated variants. An image narrower than the largest
+// width also gets a variant at its own width, images are never upscaled.
+var imageVariantWidths = []int{320, 640, 1024, 1600}
+
+const (
+	imageJPEGQuality  = 82
+	imageWebPQuality  = 80
+	imageSummaryWidth = 32
+
+	// cwebp takes well under a second for the largest variant.
+	imageWebPTimeout = 30 * time.Second
+)
+
+var ErrUnsupportedImage = errors.New("only PNG, JPEG and WebP images are allowed")
+
+// ProcessImage stores an uploaded image as a set of variants for srcset. The
+// content type is sniffed rather than taken from the file name, the image is
+// turned according to its EXIF orientation and re-encoded, which drops EXIF,
+// GPS and every other metadata. Each width is stored in the original format,
+// WebP uploads fall back to JPEG or PNG, and as WebP when that is smaller.
+// The result is recorded as a PhotoUpload, see ResolvePhotoFiles.
+func ProcessImage(userID uuid.UUID, data []byte, name string) (*models.PhotoFile, error) {
+	var format imaging.Format
+	switch http.DetectContentType(data) {
+	case "image/jpeg":
+		format = imaging.JPEG
+	case "image/png":
+		format = imaging.PNG
+	case "image/webp":
+		format = imaging.JPEG
+	default:
+		return nil, ErrUnsupportedImage
+	}
+
+	img, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, ErrUnsupportedImage
+	}
+	if format == imaging.JPEG && !imageOpaque(img) {
+		format = imaging.PNG
+	}
+
+	file := &models.PhotoFile{Name: name}
+
+	for _, width := range variantWidths(img.Bounds().Dx()) {
+		resized := img
+		if width < img.Bounds().Dx() {
+			resized = imaging.Resize(img, width, 0, imaging.Lanczos)
+		}
+		height := resized.Bounds().Dy()
+
+		var buf bytes.Buffer
+		if err := imaging.Encode(&buf, resized, format, imaging.JPEGQuality(imageJPEGQuality)); err != nil {
+			releasePhotoVariants(userID, file)
+			return nil, err
+		}
+		ext, contentType := ".jpg", "image/jpeg"
+		if format == imaging.PNG {
+			ext, contentType = ".png", "image/png"
+		}
+		key, err := StoreBlob(userID, buf.Bytes(), ext, contentType, false)
+		if err != nil {
+			releasePhotoVariants(userID, file)
+			return nil, err
+		}
+		file.Variants = append(file.Variants, models.PhotoVariant{Path: key, Width: width, Height: height, Type: contentType})
+
+		// The largest variant in the original format is the main file
+		file.Path, file.Width, file.Height = key, width, height
+
+		webp, err := webpVariant(resized, buf.Len())
+		if err != nil {
+			releasePhotoVariants(userID, file)
+			return nil, err
+		}
+		if webp == nil {
+			continue
+		}
+		key, err = StoreBlob(userID, webp, ".webp", "image/webp", false)
+		if err != nil {
+			releasePhotoVariants(userID, file)
+			return nil, err
+		}
+		file.Variants = append(file.Variants, models.PhotoVariant{Path: key, Width: width, Height: height, Type: "image/webp"})
+	}
+
+	summary := imaging.Resize(img, imageSummaryWidth, 0, imaging.Box)
+	file.Blurhash = Blurhash(summary, 4, 3)
+	file.Color = dominantColor(summary)
+
+	if err := recordPhotoUpload(userID, file); err != nil {
+		releasePhotoVariants(userID, file)
+		return nil, err
+	}
+	return file, nil
+}
+
+// webpVariant encodes img as WebP and returns nil when the result is not
+// smaller than the original format, size bytes. Lossy cwebp is used when it
+// is installed, the built-in encoder is lossless and mostly wins on flat
+// graphics only.
+func webpVariant(img image.Image, size int) ([]byte, error) {
+	data, err := encodeLossyWebP(img)
+	if err == errNoWebPEncoder {
+		var buf bytes.Buffer
+		if err := EncodeWebP(&buf, img); err != nil {
+			return nil, err
+		}
+		data, err = buf.Bytes(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) >= size {
+		return nil, nil
+	}
+	return data, nil
+}
+
+var errNoWebPEncoder = errors.New("cwebp is not installed")
+
+// encodeLossyWebP encodes img with cwebp, from the libwebp tools.
+func encodeLossyWebP(img image.Image) ([]byte, error) {
+	cwebp, err := exec.LookPath("cwebp")
+	if err != nil {
+		return nil, errNoWebPEncoder
+	}
+
+	dir, err := os.MkdirTemp("", "webp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	input, output := filepath.Join(dir, "in.png"), filepath.Join(dir, "out.webp")
+	// Fast compression, the PNG only lives for the call
+	if err := imaging.Save(img, input, imaging.PNGCompressionLevel(-1)); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), imageWebPTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, cwebp, "-quiet", "-q", fmt.Sprint(imageWebPQuality), "-metadata", "none", input, "-o", output)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("cwebp: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return os.ReadFile(output)
+}
+
+func recordPhotoUpload(userID uuid.UUID, file *models.PhotoFile) error {
+	upload := models.PhotoUpload{Path: file.Path, UserID: userID}
+	if err := upload.File.Set(file); err != nil {
+		return err
+	}
+	return initializers.DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(&upload).Error
+}
+
+// ResolvePhotoFiles rebuilds the files a client sends for a blog or profile
+// photo from the uploads of the user. Only the path and name are taken from
+// the client, the variants, size and placeholder come from the upload
+// record. Files uploaded before the records existed keep their path only.
+func ResolvePhotoFiles(userID uuid.UUID, files []models.PhotoFile) []models.PhotoFile {
+	paths := make([]string, 0, len(files))
+	for _, file := range files {
+		paths = append(paths, file.Path)
+	}
+
+	var uploads []models.PhotoUpload
+	if len(paths) > 0 {
+		initializers.DB.Where("user_id = ? AND path IN ?", userID, paths).Find(&uploads)
+	}
+	recorded := make(map[string]pgtype.JSONB, len(uploads))
+	for _, upload := range uploads {
+		recorded[upload.Path] = upload.File
+	}
+
+	resolved := make([]models.PhotoFile, 0, len(files))
+	for _, file := range files {
+		photo := models.PhotoFile{Path: file.Path}
+		if data, ok := recorded[file.Path]; ok {
+			if err := data.AssignTo(&photo); err != nil {
+				photo = models.PhotoFile{Path: file.Path}
+			}
+		}
+		if file.Name != "" {
+			photo.Name = file.Name
+		}
+		resolved = append(resolved, photo)
+	}
+	return resolved
+}
+
+func variantWidths(width int) []int {
+	var widths []int
+	for _, w := range imageVariantWidths {
+		if w >= width {
+			break
+		}
+		widths = append(widths, w)
+	}
+	if width <= imageVariantWidths[len(imageVariantWidths)-1] {
+		widths = append(widths, width)
+	}
+	return widths
+}
+
+func releasePhotoVariants(userID uuid.UUID, file *models.PhotoFile) {
+	for _, path := range file.Paths() {
+		ReleaseBlob(userID, path)
+	}
+}
+
+func imageOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+// dominantColor returns the most common color of a small image as #rrggbb.
+// Colors are grouped by their 4 high bits so that gradients count as one.
+func dominantColor(img image.Image) string {
+	type bucket struct{ r, g, b, n int }
+	buckets := make(map[int]*bucket)
+	best := -1
+
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A < 128 {
+				continue
+			}
+			key := int(c.R>>4)<<8 | int(c.G>>4)<<4 | int(c.B>>4)
+			b, ok := buckets[key]
+			if !ok {
+				b = &bucket{}
+				buckets[key] = b
+			}
+			b.r += int(c.R)
+			b.g += int(c.G)
+			b.b += int(c.B)
+			b.n++
+			if best < 0 || b.n > buckets[best].n {
+				best = key
+			}
+		}
+	}
+	if best < 0 {
+		return ""
+	}
+	b := buckets[best]
+	return fmt.Sprintf("#%02x%02x%02x", b.r/b.n, b.g/b.n, b.b/b.n)
+}
+
+const blurhashCharacters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// Blurhash encodes a placeholder of img with xComponents x yComponents
+// cosine components, see https://blurha.sh.
+func Blurhash(img image.Image, xComponents, yComponents int) string {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var r, g, b float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(height))
+					c := color.NRGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+					r += basis * sRGBToLinear(c.R)
+					g += basis * sRGBToLinear(c.G)
+					b += basis * sRGBToLinear(c.B)
+				}
+			}
+			scale := normalisation / float64(width*height)
+			factors = append(factors, [3]float64{r * scale, g * scale, b * scale})
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(base83(xComponents-1+(yComponents-1)*9, 1))
+
+	maximum := 1.0
+	if ac := factors[1:]; len(ac) > 0 {
+		actual := 0.0
+		for _, f := range ac {
+			actual = math.Max(actual, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quantised := int(math.Max(0, math.Min(82, math.Floor(actual*166-0.5))))
+		maximum = float64(quantised+1) / 166
+		hash.WriteString(base83(quantised, 1))
+	} else {
+		hash.WriteString(base83(0, 1))
+	}
+
+	dc := factors[0]
+	hash.WriteString(base83(linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4))
+
+	for _, f := range factors[1:] {
+		quant := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maximum, 0.5)*9+9.5))))
+		}
+		hash.WriteString(base83(quant(f[0])*19*19+quant(f[1])*19+quant(f[2]), 2))
+	}
+	return hash.String()
+}
+
+func base83(value, length int) string {
+	out := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		out[i] = blurhashCharacters[value%83]
+		value /= 83
+	}
+	return string(out)
+}
+
+func sRGBToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
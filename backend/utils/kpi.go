@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"log"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Days recomputed by the scheduled KPI rollup, today included. Earlier days
+// are final, listings deleted since then stay counted.
+const kpiRollupDays = 2
+
+// Longest history computed on the first run.
+const kpiBackfillDays = 365
+
+// RollupPlatformStats recomputes the platform and listing KPIs of the last
+// days.
+func RollupPlatformStats() {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	for day := today.AddDate(0, 0, 1-kpiRollupDays); !day.After(today); day = day.AddDate(0, 0, 1) {
+		if err := rollupPlatformDay(day); err != nil {
+			log.Println("Could not roll up platform stats of", day.Format("2006-01-02"), ":", err)
+		}
+	}
+}
+
+// BackfillPlatformStats computes the KPIs of the past year when none were
+// computed yet.
+func BackfillPlatformStats() {
+	var count int64
+	if err := initializers.DB.Model(&models.PlatformDailyStat{}).Count(&count).Error; err != nil || count > 0 {
+		return
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	for day := today.AddDate(0, 0, -kpiBackfillDays); !day.After(today); day = day.AddDate(0, 0, 1) {
+		if err := rollupPlatformDay(day); err != nil {
+			log.Println("Could not roll up platform stats of", day.Format("2006-01-02"), ":", err)
+		}
+	}
+}
+
+func rollupPlatformDay(day time.Time) error {
+	next := day.AddDate(0, 0, 1)
+	stat := models.PlatformDailyStat{Date: day, UpdatedAt: time.Now()}
+
+	var err error
+	scan := func(dest interface{}, query string, args ...interface{}) {
+		if err == nil {
+			err = initializers.DB.Raw(query, args...).Row().Scan(dest)
+		}
+	}
+	scanPair := func(count *int64, volume *float64, query string, args ...interface{}) {
+		if err == nil {
+			err = initializers.DB.Raw(query, args...).Row().Scan(count, volume)
+		}
+	}
+
+	scan(&stat.Signups, "SELECT count(*) FROM users WHERE created_at >= ? AND created_at < ?", day, next)
+	scan(&stat.DAU, "SELECT count(DISTINCT user_id) FROM presence_sessions WHERE started_at < ? AND (ended_at IS NULL OR ended_at >= ?)", next, day)
+	scan(&stat.MAU, "SELECT count(DISTINCT user_id) FROM presence_sessions WHERE started_at < ? AND (ended_at IS NULL OR ended_at >= ?)", next, day.AddDate(0, 0, -29))
+	scan(&stat.ListingsCreated, "SELECT count(*) FROM blogs WHERE created_at >= ? AND created_at < ?", day, next)
+	scan(&stat.ListingsArchived, "SELECT count(*) FROM blogs WHERE status = ? AND expired_at >= ? AND expired_at < ?", models.BlogStatusArchived, day, next)
+	scanPair(&stat.TopUps, &stat.TopUpVolume, "SELECT count(*), COALESCE(sum(amount), 0) FROM payments WHERE status = ? AND updated_at >= ? AND updated_at < ?", "applied", day, next)
+	scanPair(&stat.Donations, &stat.DonationVolume, "SELECT count(*), COALESCE(sum(amount), 0) FROM transactions WHERE module = ? AND type = ? AND created_at >= ? AND created_at < ?", "donat", "deduction", day, next)
+	scan(&stat.ChatMessages, "SELECT count(*) FROM chat_messages WHERE created_at >= ? AND created_at < ?", day, next)
+	scan(&stat.StreamSessions, "SELECT count(*) FROM stream_sessions WHERE started_at >= ? AND started_at < ?", day, next)
+	scan(&stat.StreamSeconds, "SELECT COALESCE(sum(EXTRACT(EPOCH FROM ended_at - started_at)), 0)::bigint FROM stream_sessions WHERE started_at >= ? AND started_at < ? AND ended_at IS NOT NULL", day, next)
+	if err != nil {
+		return err
+	}
+
+	return initializers.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&stat).Error; err != nil {
+			return err
+		}
+		if err := rollupListingDay(tx, day, models.ListingStatCity, "blog_city", "city_id"); err != nil {
+			return err
+		}
+		return rollupListingDay(tx, day, models.ListingStatGuild, "blog_guilds", "guilds_id")
+	})
+}
+
+// rollupListingDay replaces the listing counts of a day per city or guild.
+func rollupListingDay(tx *gorm.DB, day time.Time, dimension, joinTable, column string) error {
+	next := day.AddDate(0, 0, 1)
+
+	var rows []models.ListingDailyStat
+	if err := tx.Raw(`
+SELECT j.`+column+` AS dimension_id,
+	count(*) FILTER (WHERE b.created_at >= @day AND b.created_at < @next) AS created,
+	count(*) FILTER (WHERE b.status = @archived AND b.expired_at >= @day AND b.expired_at < @next) AS archived
+FROM blogs b JOIN `+joinTable+` j ON j.blog_id = b.id
+WHERE (b.created_at >= @day AND b.created_at < @next)
+	OR (b.status = @archived AND b.expired_at >= @day AND b.expired_at < @next)
+GROUP BY j.`+column,
+		map[string]interface{}{"day": day, "next": next, "archived": models.BlogStatusArchived}).
+		Scan(&rows).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Where("date = ? AND dimension = ?", day, dimension).Delete(&models.ListingDailyStat{}).Error; err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	for i := range rows {
+		rows[i].Date = day
+		rows[i].Dimension = dimension
+	}
+	return tx.Create(&rows).Error
+}
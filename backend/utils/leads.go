@@ -0,0 +1,585 @@
+package utils
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Challenge tokens are issued to the call-back form of a visitor and can be
+// used once, by the same address, between leadChallengeMinAge and
+// leadChallengeTTL after they were issued. Bots posting straight away or
+// replaying a token are refused. A visitor gets leadChallengesPerLead
+// tokens per request it may leave.
+const (
+	leadChallengeKeyPrefix     = "leadchallenge:"
+	leadRateKeyPrefix          = "leadrate:"
+	leadChallengeRateKeyPrefix = "leadchallengerate:"
+	leadChallengeTTL           = 30 * time.Minute
+	leadChallengeMinAge        = 2 * time.Second
+	leadChallengesPerLead      = 4
+	// A phone number can leave one request per post in this window.
+	leadDuplicateWindow  = 24 * time.Hour
+	defaultLeadRateLimit = 5
+	leadNoteMaxLength    = 2000
+)
+
+var (
+	ErrLeadsNotConfigured = errors.New("LEAD_CHALLENGE_SECRET is not set")
+	ErrLeadChallenge      = errors.New("invalid or expired challenge")
+	ErrLeadRateLimited    = errors.New("too many requests, try again later")
+	ErrLeadDuplicate      = errors.New("a request was already sent for this post")
+	ErrLeadInvalid        = errors.New("a name and a valid phone number are required")
+	ErrLeadNotFound       = errors.New("lead not found")
+	ErrLeadPostNotFound   = errors.New("post not found")
+	ErrLeadUpdate         = errors.New("invalid status or note")
+	ErrLeadChannels       = errors.New("invalid channels")
+)
+
+// LeadInput is a call-back request from the form of a post.
+type LeadInput struct {
+	BlogID    uint64 `json:"blogId"`
+	Name      string `json:"name"`
+	Phone     string `json:"phone"`
+	Challenge string `json:"challenge"`
+}
+
+// LeadUpdate changes the status or follow-up of a lead, ClearFollowUp
+// removes the follow-up.
+type LeadUpdate struct {
+	Status        string     `json:"status"`
+	FollowUpAt    *time.Time `json:"followUpAt"`
+	ClearFollowUp bool       `json:"clearFollowUp"`
+}
+
+// LeadListingStats is the funnel of a post of a seller. Conversion is the
+// share of the views that turned into leads, WinRate the share of the leads
+// that were won.
+type LeadListingStats struct {
+	BlogID     uint64  `json:"blogId"`
+	Title      string  `json:"title"`
+	URL        string  `json:"url"`
+	Views      int64   `json:"views"`
+	Leads      int64   `json:"leads"`
+	Contacted  int64   `json:"contacted"`
+	Won        int64   `json:"won"`
+	Lost       int64   `json:"lost"`
+	Conversion float64 `json:"conversion"`
+	WinRate    float64 `json:"winRate"`
+}
+
+func leadChallengeSignature(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// leadPost returns the active post leads are left on.
+func leadPost(blogID uint64) (*models.Blog, error) {
+	var blog models.Blog
+	if err := initializers.DB.Where("id = ? AND status = ? AND deleted_at IS NULL", blogID, models.BlogStatusActive).First(&blog).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrLeadPostNotFound
+		}
+		return nil, err
+	}
+	return &blog, nil
+}
+
+// leadIPHash is how the address of a visitor is kept.
+func leadIPHash(ip string) string {
+	sum := sha256.Sum256([]byte(ip))
+	return hex.EncodeToString(sum[:])
+}
+
+// IssueLeadChallenge returns a challenge token for the call-back form of a
+// post shown to a visitor with the ip.
+func IssueLeadChallenge(blogID uint64, ip string) (string, error) {
+	config, _ := initializers.LoadConfig(".")
+	if config.LeadChallengeSecret == "" {
+		return "", ErrLeadsNotConfigured
+	}
+	ipHash := leadIPHash(ip)
+	if !allowLead(leadChallengeRateKeyPrefix, ipHash, leadRateLimit(config.LeadRateLimit)*leadChallengesPerLead) {
+		return "", ErrLeadRateLimited
+	}
+	if _, err := leadPost(blogID); err != nil {
+		return "", err
+	}
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	payload := fmt.Sprintf("%d.%d.%s.%s", blogID, time.Now().Unix(), hex.EncodeToString(nonce), ipHash[:16])
+	return payload + "." + leadChallengeSignature(config.LeadChallengeSecret, payload), nil
+}
+
+// checkLeadChallenge verifies a challenge token for the post and the visitor
+// and returns its nonce.
+func checkLeadChallenge(secret, token string, blogID uint64, ipHash string, now time.Time) (string, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 5 {
+		return "", false
+	}
+	payload := strings.Join(parts[:4], ".")
+	if !hmac.Equal([]byte(parts[4]), []byte(leadChallengeSignature(secret, payload))) {
+		return "", false
+	}
+	if parts[0] != strconv.FormatUint(blogID, 10) || parts[3] != ipHash[:16] {
+		return "", false
+	}
+	issued, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", false
+	}
+	age := now.Sub(time.Unix(issued, 0))
+	if age < leadChallengeMinAge || age > leadChallengeTTL {
+		return "", false
+	}
+	return parts[2], true
+}
+
+// normalizePhone keeps the digits of a phone number with its leading plus.
+func normalizePhone(phone string) (string, bool) {
+	phone = strings.TrimSpace(phone)
+	var digits strings.Builder
+	for i, r := range phone {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r == '+' && i == 0:
+			digits.WriteRune(r)
+		case r == ' ' || r == '-' || r == '(' || r == ')' || r == '.':
+		default:
+			return "", false
+		}
+	}
+	count := len(strings.TrimPrefix(digits.String(), "+"))
+	if count < 7 || count > 15 {
+		return "", false
+	}
+	return digits.String(), true
+}
+
+// leadRateLimit is LEAD_RATE_LIMIT, the requests a visitor can leave per
+// hour.
+func leadRateLimit(limit int) int {
+	if limit <= 0 {
+		return defaultLeadRateLimit
+	}
+	return limit
+}
+
+// allowLead counts a request of the visitor under the key prefix and reports
+// whether it is within limit per hour.
+func allowLead(prefix, ipHash string, limit int) bool {
+	ctx := context.Background()
+	key := prefix + ipHash + ":" + time.Now().Format("2006010215")
+	count, err := initializers.RedisClient.Incr(ctx, key).Result()
+	if err != nil {
+		log.Println("Could not rate limit lead:", err)
+		return true
+	}
+	if count == 1 {
+		initializers.RedisClient.Expire(ctx, key, time.Hour)
+	}
+	return count <= int64(limit)
+}
+
+// CreateLead stores a call-back request left on a post by a visitor with the
+// ip and delivers it to the seller.
+func CreateLead(input LeadInput, ip string) (*models.Lead, error) {
+	config, _ := initializers.LoadConfig(".")
+	if config.LeadChallengeSecret == "" {
+		return nil, ErrLeadsNotConfigured
+	}
+
+	name := strings.TrimSpace(input.Name)
+	phone, ok := normalizePhone(input.Phone)
+	if name == "" || utf8.RuneCountInString(name) > 100 || !ok {
+		return nil, ErrLeadInvalid
+	}
+
+	ipHash := leadIPHash(ip)
+	nonce, ok := checkLeadChallenge(config.LeadChallengeSecret, input.Challenge, input.BlogID, ipHash, time.Now())
+	if !ok {
+		return nil, ErrLeadChallenge
+	}
+	if !allowLead(leadRateKeyPrefix, ipHash, leadRateLimit(config.LeadRateLimit)) {
+		return nil, ErrLeadRateLimited
+	}
+	fresh, err := initializers.RedisClient.SetNX(context.Background(), leadChallengeKeyPrefix+nonce, 1, leadChallengeTTL).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		return nil, ErrLeadChallenge
+	}
+
+	blog, err := leadPost(input.BlogID)
+	if err != nil {
+		return nil, err
+	}
+
+	var duplicates int64
+	initializers.DB.Model(&models.Lead{}).
+		Where("blog_id = ? AND phone = ? AND created_at > ?", blog.ID, phone, time.Now().Add(-leadDuplicateWindow)).
+		Count(&duplicates)
+	if duplicates > 0 {
+		return nil, ErrLeadDuplicate
+	}
+
+	lead := models.Lead{
+		BlogID:   blog.ID,
+		SellerID: blog.UserID,
+		Name:     name,
+		Phone:    phone,
+		Price:    blog.Total,
+		Status:   models.LeadStatusNew,
+		IPHash:   ipHash,
+	}
+	if err := initializers.DB.Create(&lead).Error; err != nil {
+		return nil, err
+	}
+	TrackBlogEvent(blog.ID, models.BlogStatCallRequests)
+
+	go deliverLead(&lead, blog, false)
+	return &lead, nil
+}
+
+// leadChannels returns the channels the seller gets leads on.
+func leadChannels(sellerID uuid.UUID) []string {
+	settings := models.LeadSettings{Channels: models.AlertChannelInApp + "," + models.AlertChannelTelegram}
+	initializers.DB.Where("user_id = ?", sellerID).First(&settings)
+	return strings.Split(settings.Channels, ",")
+}
+
+// GetLeadSettings returns the lead settings of a seller, with the default
+// channels when none were saved.
+func GetLeadSettings(userID uuid.UUID) models.LeadSettings {
+	return models.LeadSettings{UserID: userID, Channels: strings.Join(leadChannels(userID), ",")}
+}
+
+// SaveLeadSettings sets the channels new leads and follow-ups of a seller are
+// delivered to.
+func SaveLeadSettings(userID uuid.UUID, channels string) (*models.LeadSettings, error) {
+	channels, ok := normalizeAlertChannels(channels)
+	if !ok {
+		return nil, ErrLeadChannels
+	}
+	settings := models.LeadSettings{UserID: userID, Channels: channels, UpdatedAt: time.Now()}
+	err := initializers.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"channels", "updated_at"}),
+	}).Create(&settings).Error
+	if err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+func formatLeadPrice(price float64) string {
+	digits := strconv.FormatInt(int64(price), 10)
+	var formatted strings.Builder
+	for i := range digits {
+		formatted.WriteByte(digits[i])
+		if (len(digits)-i-1)%3 == 0 && i != len(digits)-1 {
+			formatted.WriteByte('.')
+		}
+	}
+	return formatted.String()
+}
+
+// deliverLead sends a lead, or its follow-up reminder, to the channels of
+// the seller.
+func deliverLead(lead *models.Lead, blog *models.Blog, followUp bool) {
+	var seller models.User
+	if err := initializers.DB.Where("id = ?", lead.SellerID).First(&seller).Error; err != nil {
+		return
+	}
+
+	postURL := BlogURL(blog, "")
+	pageURL := siteURL + "/ru/leads/" + strconv.FormatUint(lead.ID, 10)
+	title := "New call-back request"
+	message := lead.Name + " asks you to call back about " + blog.Title + "."
+	if followUp {
+		title = "Lead follow-up"
+		message = "Time to follow up with " + lead.Name + " about " + blog.Title + "."
+	}
+
+	for _, channel := range leadChannels(seller.ID) {
+		switch channel {
+		case models.AlertChannelInApp:
+			if err := Notification(title, message+" "+lead.Phone, seller.ID.String(), pageURL); err != nil {
+				log.Println("Could not create lead notification:", err)
+			}
+			if seller.Session != "" {
+				SendPersonalMessageToClient(seller.Session, "new_notification")
+			}
+		case models.AlertChannelPush:
+			if seller.DeviceIOS != "" {
+				if err := Push(title, message, seller.DeviceIOS, pageURL); err != nil {
+					log.Println("Could not push lead:", err)
+				}
+			}
+		case models.AlertChannelEmail:
+			if !seller.IsBot && seller.Email != "" {
+				SendEmail(&seller, &LeadMail{
+					Subject: title,
+					Name:    seller.Name,
+					Message: message,
+					Contact: lead.Name,
+					Phone:   lead.Phone,
+					Post:    blog.Title,
+					PostURL: postURL,
+					URL:     pageURL,
+				}, "lead", "en")
+			}
+		case models.AlertChannelTelegram:
+			// Posts can carry the chat of their own Telegram channel
+			chatID := seller.Tid
+			if chatID == 0 {
+				chatID = int64(blog.TmId)
+			}
+			bot := alertTelegramBot()
+			if bot == nil || chatID == 0 {
+				continue
+			}
+			text := fmt.Sprintf("Здравствуйте, для вас новый запрос!\nИмя: %s\nТелефон: %s\nСсылка: %s\nЦена: %s ₽",
+				lead.Name, lead.Phone, postURL, formatLeadPrice(lead.Price))
+			if followUp {
+				text = fmt.Sprintf("Напоминание: свяжитесь с клиентом\nИмя: %s\nТелефон: %s\nСсылка: %s",
+					lead.Name, lead.Phone, postURL)
+			}
+			if _, err := bot.Send(tgbotapi.NewMessage(chatID, text)); err != nil {
+				log.Println("Could not send lead to Telegram:", err)
+			}
+		}
+	}
+}
+
+// FindLead returns a lead of the seller with its notes.
+func FindLead(sellerID uuid.UUID, leadID uint64) (*models.Lead, error) {
+	var lead models.Lead
+	err := initializers.DB.
+		Preload("Notes", func(db *gorm.DB) *gorm.DB { return db.Order("created_at") }).
+		Where("id = ? AND seller_id = ?", leadID, sellerID).
+		First(&lead).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrLeadNotFound
+		}
+		return nil, err
+	}
+	return &lead, nil
+}
+
+// LeadStatusCounts counts the leads of a seller per status.
+func LeadStatusCounts(sellerID uuid.UUID) map[string]int64 {
+	var rows []struct {
+		Status string
+		Count  int64
+	}
+	initializers.DB.Model(&models.Lead{}).
+		Select("status, count(*) AS count").
+		Where("seller_id = ?", sellerID).
+		Group("status").
+		Scan(&rows)
+
+	counts := map[string]int64{
+		models.LeadStatusNew:       0,
+		models.LeadStatusContacted: 0,
+		models.LeadStatusWon:       0,
+		models.LeadStatusLost:      0,
+	}
+	for _, row := range rows {
+		counts[row.Status] = row.Count
+	}
+	return counts
+}
+
+// UpdateLead moves a lead of the seller to another status and sets or
+// clears its follow-up. A new follow-up is reminded again.
+func UpdateLead(sellerID uuid.UUID, leadID uint64, update LeadUpdate) (*models.Lead, error) {
+	lead, err := FindLead(sellerID, leadID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	changes := map[string]interface{}{"updated_at": now}
+	switch update.Status {
+	case "", lead.Status:
+	case models.LeadStatusNew, models.LeadStatusContacted:
+		changes["status"] = update.Status
+		changes["closed_at"] = nil
+		if update.Status == models.LeadStatusContacted && lead.ContactedAt == nil {
+			changes["contacted_at"] = now
+		}
+	case models.LeadStatusWon, models.LeadStatusLost:
+		changes["status"] = update.Status
+		changes["closed_at"] = now
+		if lead.ContactedAt == nil {
+			changes["contacted_at"] = now
+		}
+	default:
+		return nil, ErrLeadUpdate
+	}
+	if update.ClearFollowUp {
+		changes["follow_up_at"] = nil
+		changes["follow_up_sent_at"] = nil
+	} else if update.FollowUpAt != nil {
+		changes["follow_up_at"] = *update.FollowUpAt
+		changes["follow_up_sent_at"] = nil
+	}
+
+	if err := initializers.DB.Model(lead).Updates(changes).Error; err != nil {
+		return nil, err
+	}
+	return FindLead(sellerID, leadID)
+}
+
+// AddLeadNote adds a note of the seller to a lead.
+func AddLeadNote(sellerID uuid.UUID, leadID uint64, text string) (*models.LeadNote, error) {
+	text = strings.TrimSpace(text)
+	if text == "" || utf8.RuneCountInString(text) > leadNoteMaxLength {
+		return nil, ErrLeadUpdate
+	}
+	if _, err := FindLead(sellerID, leadID); err != nil {
+		return nil, err
+	}
+
+	note := models.LeadNote{LeadID: leadID, UserID: sellerID, Text: text}
+	if err := initializers.DB.Create(&note).Error; err != nil {
+		return nil, err
+	}
+	initializers.DB.Model(&models.Lead{}).Where("id = ?", leadID).Update("updated_at", time.Now())
+	return &note, nil
+}
+
+// LeadStats returns the funnel of the posts of a seller with views or leads
+// since the day, most leads first.
+func LeadStats(sellerID uuid.UUID, since time.Time) ([]LeadListingStats, error) {
+	var leadRows []struct {
+		BlogID    uint64
+		Leads     int64
+		Contacted int64
+		Won       int64
+		Lost      int64
+	}
+	err := initializers.DB.Model(&models.Lead{}).
+		Select(`blog_id, count(*) AS leads,
+			count(*) FILTER (WHERE contacted_at IS NOT NULL) AS contacted,
+			count(*) FILTER (WHERE status = ?) AS won,
+			count(*) FILTER (WHERE status = ?) AS lost`, models.LeadStatusWon, models.LeadStatusLost).
+		Where("seller_id = ? AND created_at >= ?", sellerID, since).
+		Group("blog_id").
+		Scan(&leadRows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var viewRows []struct {
+		BlogID uint64
+		Views  int64
+	}
+	err = initializers.DB.Model(&models.BlogDailyStat{}).
+		Select("blog_daily_stats.blog_id, sum(blog_daily_stats.views) AS views").
+		Joins("JOIN blogs ON blogs.id = blog_daily_stats.blog_id").
+		Where("blogs.user_id = ? AND blog_daily_stats.date >= ?", sellerID, since.Format("2006-01-02")).
+		Group("blog_daily_stats.blog_id").
+		Scan(&viewRows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make(map[uint64]*LeadListingStats)
+	statsOf := func(blogID uint64) *LeadListingStats {
+		if stats[blogID] == nil {
+			stats[blogID] = &LeadListingStats{BlogID: blogID}
+		}
+		return stats[blogID]
+	}
+	for _, row := range leadRows {
+		entry := statsOf(row.BlogID)
+		entry.Leads, entry.Contacted, entry.Won, entry.Lost = row.Leads, row.Contacted, row.Won, row.Lost
+	}
+	for _, row := range viewRows {
+		statsOf(row.BlogID).Views = row.Views
+	}
+
+	ids := make([]uint64, 0, len(stats))
+	for id := range stats {
+		ids = append(ids, id)
+	}
+	var blogs []models.Blog
+	if len(ids) > 0 {
+		initializers.DB.Select("id, title, slug, uniq_id").Where("id IN ?", ids).Find(&blogs)
+	}
+	for i := range blogs {
+		stats[blogs[i].ID].Title = blogs[i].Title
+		stats[blogs[i].ID].URL = BlogURL(&blogs[i], "")
+	}
+
+	result := make([]LeadListingStats, 0, len(stats))
+	for _, entry := range stats {
+		if entry.Views > 0 {
+			entry.Conversion = float64(entry.Leads) / float64(entry.Views)
+		}
+		if entry.Leads > 0 {
+			entry.WinRate = float64(entry.Won) / float64(entry.Leads)
+		}
+		result = append(result, *entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Leads != result[j].Leads {
+			return result[i].Leads > result[j].Leads
+		}
+		if result[i].Views != result[j].Views {
+			return result[i].Views > result[j].Views
+		}
+		return result[i].BlogID < result[j].BlogID
+	})
+	return result, nil
+}
+
+// RemindLeadFollowUps reminds the sellers of the open leads whose follow-up
+// is due.
+func RemindLeadFollowUps() {
+	now := time.Now()
+	var leads []models.Lead
+	err := initializers.DB.Model(&leads).
+		Clauses(clause.Returning{}).
+		Where("follow_up_sent_at IS NULL AND follow_up_at <= ? AND status IN ?",
+			now, []string{models.LeadStatusNew, models.LeadStatusContacted}).
+		Update("follow_up_sent_at", now).Error
+	if err != nil {
+		log.Println("Could not remind lead follow-ups:", err)
+		return
+	}
+	for i := range leads {
+		var blog models.Blog
+		if initializers.DB.Where("id = ?", leads[i].BlogID).First(&blog).Error != nil {
+			continue
+		}
+		go deliverLead(&leads[i], &blog, true)
+	}
+}
@@ -0,0 +1,278 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// ModerationCheck is an automated pre-check run against a post before it is
+// published. Check returns a human readable reason when the post must be
+// held for manual review.
+type ModerationCheck interface {
+	Name() string
+	Check(blog *models.Blog) (string, bool)
+}
+
+var (
+	moderationChecksLock sync.RWMutex
+	moderationChecks     = []ModerationCheck{
+		KeywordCheck{},
+		LinkBlacklistCheck{},
+		DuplicateImageCheck{},
+	}
+)
+
+// RegisterModerationCheck adds a check to the pipeline used by RunModerationChecks.
+func RegisterModerationCheck(check ModerationCheck) {
+	moderationChecksLock.Lock()
+	defer moderationChecksLock.Unlock()
+	moderationChecks = append(moderationChecks, check)
+}
+
+// ModerationFlag is a single failed pre-check.
+type ModerationFlag struct {
+	Check  string `json:"check"`
+	Reason string `json:"reason"`
+}
+
+// RunModerationChecks runs every registered check and returns the failed ones.
+func RunModerationChecks(blog *models.Blog) []ModerationFlag {
+	moderationChecksLock.RLock()
+	checks := append([]ModerationCheck(nil), moderationChecks...)
+	moderationChecksLock.RUnlock()
+
+	var flags []ModerationFlag
+	for _, check := range checks {
+		if reason, flagged := check.Check(blog); flagged {
+			flags = append(flags, ModerationFlag{Check: check.Name(), Reason: reason})
+		}
+	}
+	return flags
+}
+
+// IsTrustedAuthor reports whether posts of the user skip the review queue.
+// Admins and VIPs are trusted, other accounts after they have a few approved
+// posts and are at least a week old.
+func IsTrustedAuthor(user *models.User) bool {
+	if user.Role == "admin" || user.Role == "vip" {
+		return true
+	}
+	if !user.Verified || time.Since(user.CreatedAt) < 7*24*time.Hour {
+		return false
+	}
+
+	var approved int64
+	initializers.DB.Model(&models.Blog{}).
+		Where("user_id = ? AND status IN (?)", user.ID, []string{models.BlogStatusActive, models.BlogStatusArchived}).
+		Count(&approved)
+
+	return approved >= 3
+}
+
+// FlagBlogForReview stores the failed pre-checks as system reports so that
+// they show up in the moderation queue next to user reports.
+func FlagBlogForReview(blog *models.Blog, flags []ModerationFlag) {
+	targetID := fmt.Sprint(blog.ID)
+	for _, flag := range flags {
+		report := models.Report{
+			TargetType: models.ReportTargetBlog,
+			TargetID:   targetID,
+			Reason:     "auto:" + flag.Check,
+			Comment:    flag.Reason,
+			Status:     models.ReportStatusOpen,
+		}
+		if err := initializers.DB.Create(&report).Error; err != nil {
+			log.Println("Could not create moderation report:", err)
+		}
+	}
+
+	if len(flags) > 0 {
+		LogModerationDecision(nil, models.ReportTargetBlog, targetID, models.ModerationActionAutoFlag, flags[0].Reason)
+	}
+}
+
+// ErrBlogNotReviewable is returned for a moderation decision on a post that
+// is not waiting for one.
+var ErrBlogNotReviewable = errors.New("the post is not waiting for review")
+
+// BlogDecisionStatus returns the status a moderation decision moves a post
+// to. Pending posts are approved or rejected, rejected posts can still be
+// approved.
+func BlogDecisionStatus(status, action string) (string, error) {
+	switch {
+	case action == models.ModerationActionApprove && (status == models.BlogStatusPending || status == models.BlogStatusRejected):
+		return models.BlogStatusActive, nil
+	case action == models.ModerationActionReject && status == models.BlogStatusPending:
+		return models.BlogStatusRejected, nil
+	}
+	return "", ErrBlogNotReviewable
+}
+
+// LogModerationDecision appends an entry to the moderation log.
+func LogModerationDecision(moderatorID *uuid.UUID, targetType, targetID, action, reason string) {
+	decision := models.ModerationDecision{
+		ModeratorID: moderatorID,
+		TargetType:  targetType,
+		TargetID:    targetID,
+		Action:      action,
+		Reason:      reason,
+	}
+	if err := initializers.DB.Create(&decision).Error; err != nil {
+		log.Println("Could not log moderation decision:", err)
+	}
+}
+
+func moderationRules(kind string) []string {
+	var rules []models.ModerationRule
+	if err := initializers.DB.Where("kind = ?", kind).Find(&rules).Error; err != nil {
+		log.Println("Could not load moderation rules:", err)
+		return nil
+	}
+
+	values := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		values = append(values, strings.ToLower(strings.TrimSpace(rule.Value)))
+	}
+	return values
+}
+
+func blogText(blog *models.Blog) string {
+	return strings.ToLower(blog.Title + "\n" + blog.Descr + "\n" + blog.Content)
+}
+
+// KeywordCheck holds posts containing a blacklisted word or phrase.
+type KeywordCheck struct{}
+
+func (KeywordCheck) Name() string { return "keyword" }
+
+func (KeywordCheck) Check(blog *models.Blog) (string, bool) {
+	text := blogText(blog)
+	for _, keyword := range moderationRules(models.ModerationRuleKeyword) {
+		if keyword != "" && strings.Contains(text, keyword) {
+			return fmt.Sprintf("contains blacklisted keyword %q", keyword), true
+		}
+	}
+	return "", false
+}
+
+var linkRegexp = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"]+`)
+
+// LinkBlacklistCheck holds posts linking to a blacklisted domain or any of
+// its subdomains.
+type LinkBlacklistCheck struct{}
+
+func (LinkBlacklistCheck) Name() string { return "link" }
+
+func (LinkBlacklistCheck) Check(blog *models.Blog) (string, bool) {
+	links := linkRegexp.FindAllString(blogText(blog), -1)
+	if len(links) == 0 {
+		return "", false
+	}
+
+	blacklist := moderationRules(models.ModerationRuleLink)
+	for _, link := range links {
+		if !strings.Contains(link, "://") {
+			link = "http://" + link
+		}
+		parsed, err := url.Parse(link)
+		if err != nil {
+			continue
+		}
+		host := strings.TrimPrefix(parsed.Hostname(), "www.")
+		for _, domain := range blacklist {
+			if domain != "" && (host == domain || strings.HasSuffix(host, "."+domain)) {
+				return fmt.Sprintf("links to blacklisted domain %s", domain), true
+			}
+		}
+	}
+	return "", false
+}
+
+// DuplicateImageCheck holds posts whose photos were already published by
+// another account.
+type DuplicateImageCheck struct{}
+
+func (DuplicateImageCheck) Name() string { return "duplicate_image" }
+
+func (DuplicateImageCheck) Check(blog *models.Blog) (string, bool) {
+	for _, path := range BlogPhotoPaths(blog.Photos) {
+		hash, err := hashStoredFile(path)
+		if err != nil {
+			continue
+		}
+
+		var existing models.BlogImageHash
+		err = initializers.DB.Where("hash = ? AND user_id <> ?", hash, blog.UserID).First(&existing).Error
+		if err == nil {
+			return fmt.Sprintf("photo %s duplicates a photo of post %d", path, existing.BlogID), true
+		}
+	}
+	return "", false
+}
+
+// RecordBlogImageHashes remembers the hashes of the post photos for the
+// duplicate image check.
+func RecordBlogImageHashes(blog *models.Blog) {
+	for _, path := range BlogPhotoPaths(blog.Photos) {
+		hash, err := hashStoredFile(path)
+		if err != nil {
+			continue
+		}
+
+		record := models.BlogImageHash{
+			Hash:   hash,
+			BlogID: blog.ID,
+			UserID: blog.UserID,
+			Path:   path,
+		}
+		initializers.DB.Where(models.BlogImageHash{BlogID: blog.ID, Path: path}).FirstOrCreate(&record)
+	}
+}
+
+// BlogPhotoPaths extracts the stored file paths from the photos JSON.
+func BlogPhotoPaths(photos []models.BlogPhoto) []string {
+	var paths []string
+	for _, photo := range photos {
+		var files []struct {
+			Path string `json:"path"`
+		}
+		if err := json.Unmarshal(photo.Files.Bytes, &files); err != nil {
+			continue
+		}
+		for _, file := range files {
+			if file.Path != "" {
+				paths = append(paths, file.Path)
+			}
+		}
+	}
+	return paths
+}
+
+func hashStoredFile(path string) (string, error) {
+	file, err := Blobs().Get(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
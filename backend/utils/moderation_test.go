@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"testing"
+
+	"hyperpage/models"
+)
+
+func TestBlogDecisionStatus(t *testing.T) {
+	tests := []struct {
+		status, action, want string
+	}{
+		{models.BlogStatusPending, models.ModerationActionApprove, models.BlogStatusActive},
+		{models.BlogStatusPending, models.ModerationActionReject, models.BlogStatusRejected},
+		{models.BlogStatusRejected, models.ModerationActionApprove, models.BlogStatusActive},
+	}
+	for _, tt := range tests {
+		status, err := BlogDecisionStatus(tt.status, tt.action)
+		if err != nil || status != tt.want {
+			t.Errorf("%s %s = %q, %v; want %q", tt.action, tt.status, status, err, tt.want)
+		}
+	}
+
+	// Posts that are not waiting for a decision are left alone
+	for _, status := range []string{
+		models.BlogStatusRejected,
+		models.BlogStatusActive,
+		models.BlogStatusArchived,
+		models.BlogStatusDraft,
+		models.BlogStatusScheduled,
+	} {
+		if _, err := BlogDecisionStatus(status, models.ModerationActionReject); err != ErrBlogNotReviewable {
+			t.Errorf("reject %s: err = %v, want ErrBlogNotReviewable", status, err)
+		}
+		if status == models.BlogStatusRejected {
+			continue
+		}
+		if _, err := BlogDecisionStatus(status, models.ModerationActionApprove); err != ErrBlogNotReviewable {
+			t.Errorf("approve %s: err = %v, want ErrBlogNotReviewable", status, err)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Telegram allows up to 10 photos in a media group and 1024 characters in a
+// caption.
+const (
+	telegramMaxMediaGroup = 10
+	telegramMaxCaption    = 1024
+)
+
+var (
+	syndicationBotLock sync.Mutex
+	syndicationBot     *tgbotapi.BotAPI
+)
+
+func telegramSyndicationBot() (*tgbotapi.BotAPI, error) {
+	syndicationBotLock.Lock()
+	defer syndicationBotLock.Unlock()
+
+	if syndicationBot != nil {
+		return syndicationBot, nil
+	}
+
+	config, _ := initializers.LoadConfig(".")
+	bot, err := initializers.ConnectTelegram(&initializers.Config{TELEGRAM_TOKEN: config.TELEGRAM_TOKEN})
+	if err != nil {
+		return nil, err
+	}
+	syndicationBot = bot
+	return bot, nil
+}
+
+// TelegramOutlet posts to a Telegram channel or chat. Posts with photos are
+// sent as a media group with the text as caption of the first photo.
+type TelegramOutlet struct{}
+
+func (TelegramOutlet) Name() string { return models.OutletTelegram }
+
+func (TelegramOutlet) Post(channel *models.SyndicationChannel, message *SyndicationMessage) ([]string, error) {
+	bot, err := telegramSyndicationBot()
+	if err != nil {
+		return nil, err
+	}
+	chatID, err := strconv.ParseInt(channel.Target, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid chat id %q", channel.Target)
+	}
+
+	photos := message.Photos
+	if len(photos) > telegramMaxMediaGroup {
+		photos = photos[:telegramMaxMediaGroup]
+	}
+
+	switch len(photos) {
+	case 0:
+		sent, err := bot.Send(tgbotapi.NewMessage(chatID, message.Text))
+		if err != nil {
+			return nil, err
+		}
+		return []string{strconv.Itoa(sent.MessageID)}, nil
+	case 1:
+		file, err := telegramBlobFile(photos[0])
+		if err != nil {
+			return nil, err
+		}
+		photo := tgbotapi.NewPhoto(chatID, file)
+		photo.Caption = telegramCaption(message.Text)
+		sent, err := bot.Send(photo)
+		if err != nil {
+			return nil, err
+		}
+		return []string{strconv.Itoa(sent.MessageID)}, nil
+	}
+
+	media := make([]interface{}, 0, len(photos))
+	for i, key := range photos {
+		file, err := telegramBlobFile(key)
+		if err != nil {
+			return nil, err
+		}
+		photo := tgbotapi.NewInputMediaPhoto(file)
+		if i == 0 {
+			photo.Caption = telegramCaption(message.Text)
+		}
+		media = append(media, photo)
+	}
+
+	sent, err := bot.SendMediaGroup(tgbotapi.NewMediaGroup(chatID, media))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(sent))
+	for _, msg := range sent {
+		ids = append(ids, strconv.Itoa(msg.MessageID))
+	}
+	return ids, nil
+}
+
+// Edit updates the text of the first message. Telegram does not allow to
+// change the photos of a sent media group, so they stay as posted.
+func (outlet TelegramOutlet) Edit(channel *models.SyndicationChannel, externalIDs []string, message *SyndicationMessage) ([]string, error) {
+	if len(externalIDs) == 0 {
+		return outlet.Post(channel, message)
+	}
+
+	bot, err := telegramSyndicationBot()
+	if err != nil {
+		return nil, err
+	}
+	chatID, err := strconv.ParseInt(channel.Target, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid chat id %q", channel.Target)
+	}
+	messageID, err := strconv.Atoi(externalIDs[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if len(message.Photos) > 0 {
+		_, err = bot.Request(tgbotapi.NewEditMessageCaption(chatID, messageID, telegramCaption(message.Text)))
+	} else {
+		_, err = bot.Request(tgbotapi.NewEditMessageText(chatID, messageID, message.Text))
+	}
+	if err != nil && !strings.Contains(err.Error(), "message is not modified") {
+		return nil, err
+	}
+	return externalIDs, nil
+}
+
+func (TelegramOutlet) Delete(channel *models.SyndicationChannel, externalIDs []string) error {
+	bot, err := telegramSyndicationBot()
+	if err != nil {
+		return err
+	}
+	chatID, err := strconv.ParseInt(channel.Target, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid chat id %q", channel.Target)
+	}
+
+	for _, id := range externalIDs {
+		messageID, err := strconv.Atoi(id)
+		if err != nil {
+			continue
+		}
+		if _, err := bot.Request(tgbotapi.NewDeleteMessage(chatID, messageID)); err != nil {
+			// Messages that are already gone do not need a retry
+			if strings.Contains(err.Error(), "message to delete not found") || strings.Contains(err.Error(), "chat not found") {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func telegramCaption(text string) string {
+	runes := []rune(text)
+	if len(runes) <= telegramMaxCaption {
+		return text
+	}
+	return string(runes[:telegramMaxCaption-1]) + "…"
+}
+
+// telegramBlobFile reads a stored photo for upload, the store may not be on
+// the local disk.
+func telegramBlobFile(key string) (tgbotapi.RequestFileData, error) {
+	data, err := ReadBlob(key)
+	if err != nil {
+		return nil, err
+	}
+	return tgbotapi.FileBytes{Name: path.Base(key), Bytes: data}, nil
+}
+
+var syndicationHTTPClient = &http.Client{Timeout: 15 * time.Second}
+
+// VKOutlet posts to the wall of a VK community. Target is the owner ID of
+// the wall, e.g. -123456, Token a community access token. Photos are not
+// uploaded, the post links to the listing instead.
+type VKOutlet struct{}
+
+const vkAPIVersion = "5.131"
+
+func (VKOutlet) Name() string { return models.OutletVK }
+
+func (VKOutlet) call(method string, channel *models.SyndicationChannel, params url.Values) (json.RawMessage, error) {
+	params.Set("access_token", channel.Token)
+	params.Set("v", vkAPIVersion)
+
+	resp, err := syndicationHTTPClient.PostForm("https://api.vk.com/method/"+method, params)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Response json.RawMessage `json:"response"`
+		Error    *struct {
+			Code    int    `json:"error_code"`
+			Message string `json:"error_msg"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if result.Error != nil {
+		return nil, fmt.Errorf("vk error %d: %s", result.Error.Code, result.Error.Message)
+	}
+	return result.Response, nil
+}
+
+func (outlet VKOutlet) Post(channel *models.SyndicationChannel, message *SyndicationMessage) ([]string, error) {
+	response, err := outlet.call("wall.post", channel, url.Values{
+		"owner_id":    {channel.Target},
+		"from_group":  {"1"},
+		"message":     {message.Text},
+		"attachments": {message.URL},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var post struct {
+		PostID int64 `json:"post_id"`
+	}
+	if err := json.Unmarshal(response, &post); err != nil {
+		return nil, err
+	}
+	return []string{strconv.FormatInt(post.PostID, 10)}, nil
+}
+
+func (outlet VKOutlet) Edit(channel *models.SyndicationChannel, externalIDs []string, message *SyndicationMessage) ([]string, error) {
+	if len(externalIDs) == 0 {
+		return outlet.Post(channel, message)
+	}
+
+	_, err := outlet.call("wall.edit", channel, url.Values{
+		"owner_id":    {channel.Target},
+		"post_id":     {externalIDs[0]},
+		"message":     {message.Text},
+		"attachments": {message.URL},
+	})
+	return externalIDs, err
+}
+
+func (outlet VKOutlet) Delete(channel *models.SyndicationChannel, externalIDs []string) error {
+	for _, id := range externalIDs {
+		if _, err := outlet.call("wall.delete", channel, url.Values{
+			"owner_id": {channel.Target},
+			"post_id":  {id},
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WebhookOutlet sends every action as JSON to the Target URL. When Token is
+// set the body is signed with HMAC-SHA256 in the X-Signature header.
+type WebhookOutlet struct{}
+
+func (WebhookOutlet) Name() string { return models.OutletWebhook }
+
+type webhookPayload struct {
+	Event   string              `json:"event"`
+	IDs     []string            `json:"ids,omitempty"`
+	Message *SyndicationMessage `json:"message,omitempty"`
+}
+
+func (WebhookOutlet) send(channel *models.SyndicationChannel, payload webhookPayload) ([]string, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, channel.Target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if channel.Token != "" {
+		mac := hmac.New(sha256.New, []byte(channel.Token))
+		mac.Write(body)
+		req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := syndicationHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return nil, errors.New("webhook responded with " + resp.Status)
+	}
+
+	// The receiver may answer with its own ID of the post
+	var answer struct {
+		ID string `json:"id"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&answer)
+	return []string{answer.ID}, nil
+}
+
+func (outlet WebhookOutlet) Post(channel *models.SyndicationChannel, message *SyndicationMessage) ([]string, error) {
+	ids, err := outlet.send(channel, webhookPayload{Event: models.SyndicationActionPost, Message: message})
+	if err != nil {
+		return nil, err
+	}
+	if ids[0] == "" {
+		ids[0] = strconv.FormatUint(message.BlogID, 10)
+	}
+	return ids, nil
+}
+
+func (outlet WebhookOutlet) Edit(channel *models.SyndicationChannel, externalIDs []string, message *SyndicationMessage) ([]string, error) {
+	_, err := outlet.send(channel, webhookPayload{Event: models.SyndicationActionEdit, IDs: externalIDs, Message: message})
+	return externalIDs, err
+}
+
+func (outlet WebhookOutlet) Delete(channel *models.SyndicationChannel, externalIDs []string) error {
+	_, err := outlet.send(channel, webhookPayload{Event: models.SyndicationActionDelete, IDs: externalIDs})
+	return err
+}
@@ -0,0 +1,216 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"hyperpage/initializers"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Conference rooms close when nobody joined them for this long.
+const paxmeetEmptyTimeout = 15 * time.Minute
+
+var (
+	ErrPaxmeetNotConfigured = errors.New("paxmeet is not configured")
+	ErrPaxmeetWebhook       = errors.New("invalid paxmeet webhook signature")
+)
+
+var paxmeetClient = &http.Client{Timeout: 10 * time.Second}
+
+// PaxmeetUser is a participant a join token is issued to.
+type PaxmeetUser struct {
+	ID      string
+	Name    string
+	Photo   string
+	IsAdmin bool
+}
+
+// PaxmeetEvent is the webhook notification of a paxmeet room.
+type PaxmeetEvent struct {
+	Event string `json:"event"`
+	Room  struct {
+		Sid    string `json:"sid"`
+		RoomID string `json:"room_id"`
+	} `json:"room"`
+	ID        string `json:"id"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// paxmeetError is a request paxmeet answered with a false status.
+type paxmeetError struct {
+	Method string
+	Msg    string
+}
+
+func (e *paxmeetError) Error() string {
+	return "paxmeet " + e.Method + ": " + e.Msg
+}
+
+type paxmeetResponse struct {
+	Status bool   `json:"status"`
+	Msg    string `json:"msg"`
+	Token  string `json:"token"`
+}
+
+// paxmeetRequest calls a method of the paxmeet auth API. Requests are signed
+// with the HMAC-SHA256 of the body keyed with the API secret.
+func paxmeetRequest(method string, body interface{}) (*paxmeetResponse, error) {
+	config, _ := initializers.LoadConfig(".")
+	if config.PaxmeetServerURL == "" || config.PaxmeetAPIKey == "" || config.PaxmeetAPISecret == "" {
+		return nil, ErrPaxmeetNotConfigured
+	}
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, []byte(config.PaxmeetAPISecret))
+	mac.Write(payload)
+
+	url := strings.TrimRight(config.PaxmeetServerURL, "/") + "/auth/" + method
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("API-KEY", config.PaxmeetAPIKey)
+	request.Header.Set("HASH-SIGNATURE", hex.EncodeToString(mac.Sum(nil)))
+
+	response, err := paxmeetClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var result paxmeetResponse
+	if err := json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(&result); err != nil {
+		return nil, fmt.Errorf("paxmeet %s: status %d: %w", method, response.StatusCode, err)
+	}
+	if !result.Status {
+		return nil, &paxmeetError{Method: method, Msg: result.Msg}
+	}
+	return &result, nil
+}
+
+// CreatePaxmeetRoom creates a room that reports its end to PAXMEET_WEBHOOK_URL
+// and closes when nobody joined it for emptyTimeout.
+func CreatePaxmeetRoom(roomID, creator, title string, maxParticipants int, emptyTimeout time.Duration) error {
+	config, _ := initializers.LoadConfig(".")
+
+	_, err := paxmeetRequest("room/create", map[string]interface{}{
+		"room_id":          roomID,
+		"creator":          creator,
+		"empty_timeout":    int(emptyTimeout / time.Second),
+		"max_participants": maxParticipants,
+		"metadata": map[string]interface{}{
+			"room_title":  title,
+			"webhook_url": config.PaxmeetWebhookURL,
+			"room_features": map[string]interface{}{
+				"allow_webcams":               true,
+				"mute_on_start":               false,
+				"allow_screen_share":          true,
+				"allow_rtmp":                  false,
+				"admin_only_webcams":          false,
+				"allow_view_other_webcams":    true,
+				"allow_view_other_users_list": true,
+				"allow_polls":                 false,
+				"room_duration":               0,
+				"chat_features": map[string]interface{}{
+					"allow_chat":        true,
+					"allow_file_upload": true,
+				},
+				"shared_note_pad_features": map[string]interface{}{
+					"allowed_shared_note_pad": false,
+				},
+				"whiteboard_features": map[string]interface{}{
+					"allowed_whiteboard": true,
+				},
+				"breakout_room_features": map[string]interface{}{
+					"is_allow": false,
+				},
+				"waiting_room_features": map[string]interface{}{
+					"is_active": false,
+				},
+			},
+		},
+	})
+	return err
+}
+
+// PaxmeetJoinToken issues the token a participant joins a room with.
+func PaxmeetJoinToken(roomID string, user PaxmeetUser) (string, error) {
+	result, err := paxmeetRequest("room/getJoinToken", map[string]interface{}{
+		"room_id": roomID,
+		"user_info": map[string]interface{}{
+			"name":      user.Name,
+			"user_id":   user.ID,
+			"is_admin":  user.IsAdmin,
+			"is_hidden": false,
+			"user_metadata": map[string]interface{}{
+				"profile_pic": user.Photo,
+				"is_admin":    user.IsAdmin,
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	return result.Token, nil
+}
+
+// PaxmeetRoomActive reports whether a room is still running.
+func PaxmeetRoomActive(roomID string) (bool, error) {
+	_, err := paxmeetRequest("room/isRoomActive", map[string]interface{}{"room_id": roomID})
+	if err == ErrPaxmeetNotConfigured {
+		return false, err
+	}
+	// paxmeet answers with a false status for the rooms that are not running
+	var apiError *paxmeetError
+	if errors.As(err, &apiError) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// VerifyPaxmeetWebhook checks the token a webhook body came with: a JWT
+// signed with the API secret, issued by the API key, whose sha256 claim is
+// the hash of the body.
+func VerifyPaxmeetWebhook(body []byte, token string) error {
+	config, _ := initializers.LoadConfig(".")
+	if config.PaxmeetAPIKey == "" || config.PaxmeetAPISecret == "" {
+		return ErrPaxmeetNotConfigured
+	}
+
+	parsedToken, err := jwt.Parse(strings.TrimPrefix(token, "Bearer "), func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected method: %s", t.Header["alg"])
+		}
+		return []byte(config.PaxmeetAPISecret), nil
+	})
+	if err != nil || !parsedToken.Valid {
+		return ErrPaxmeetWebhook
+	}
+	claims, ok := parsedToken.Claims.(jwt.MapClaims)
+	if !ok || !claims.VerifyIssuer(config.PaxmeetAPIKey, true) {
+		return ErrPaxmeetWebhook
+	}
+
+	sum := sha256.Sum256(body)
+	hash, _ := claims["sha256"].(string)
+	if !hmac.Equal([]byte(hash), []byte(base64.StdEncoding.EncodeToString(sum[:]))) {
+		return ErrPaxmeetWebhook
+	}
+	return nil
+}
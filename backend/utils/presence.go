@@ -0,0 +1,476 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+
+	"github.com/redis/go-redis/v9"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// A connection without heartbeat for this long is offline.
+	presenceStaleAfter = 90 * time.Second
+	// presence:user:<id> is a sorted set of the connections of a user scored
+	// by their last heartbeat, presence:conn:<id> the user of a connection.
+	presenceUserKeyPrefix = "presence:user:"
+	presenceConnKeyPrefix = "presence:conn:"
+	// Ended sessions rolled up per run.
+	presenceRollupBatch = 5000
+	// Longest range of the activity statistics, in days.
+	maxPresenceStatsDays = 366
+)
+
+var ErrPresenceRange = errors.New("invalid presence range")
+
+// PresenceStatus is whether a user is online and on how many devices.
+type PresenceStatus struct {
+	UserID     uuid.UUID `json:"userId"`
+	Online     bool      `json:"online"`
+	Devices    int64     `json:"devices"`
+	LastOnline time.Time `json:"lastOnline"`
+}
+
+// PresenceStats is the online time of a user per day of a range.
+type PresenceStats struct {
+	From         time.Time              `json:"from"`
+	To           time.Time              `json:"to"`
+	TotalSeconds int64                  `json:"totalSeconds"`
+	Sessions     int                    `json:"sessions"`
+	ActiveDays   int                    `json:"activeDays"`
+	Days         []models.PresenceDaily `json:"days"`
+}
+
+func presenceUserKey(userID uuid.UUID) string {
+	return presenceUserKeyPrefix + userID.String()
+}
+
+func presenceDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// presenceDevices counts the connections of a user with a fresh heartbeat.
+func presenceDevices(ctx context.Context, userID uuid.UUID, now time.Time) (int64, error) {
+	min := strconv.FormatInt(now.Add(-presenceStaleAfter).Unix(), 10)
+	return initializers.RedisClient.ZCount(ctx, presenceUserKey(userID), min, "+inf").Result()
+}
+
+// touchPresence records a heartbeat of a connection.
+func touchPresence(ctx context.Context, userID uuid.UUID, connID string, now time.Time) error {
+	_, err := initializers.RedisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, presenceUserKey(userID), redis.Z{Score: float64(now.Unix()), Member: connID})
+		pipe.Expire(ctx, presenceUserKey(userID), 2*presenceStaleAfter)
+		pipe.Set(ctx, presenceConnKeyPrefix+connID, userID.String(), 2*presenceStaleAfter)
+		return nil
+	})
+	return err
+}
+
+// PresenceConnect starts a session of the user on a connection. The first
+// device to come online sets the user online and tells the followers.
+func PresenceConnect(userID uuid.UUID, connID, device string) error {
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	devices, err := presenceDevices(ctx, userID, now)
+	if err != nil {
+		return err
+	}
+	if err := touchPresence(ctx, userID, connID, now); err != nil {
+		return err
+	}
+
+	if len(device) > 255 {
+		device = device[:255]
+	}
+	session := models.PresenceSession{
+		UserID:     userID,
+		ConnID:     connID,
+		Device:     device,
+		StartedAt:  now,
+		LastSeenAt: now,
+	}
+	if err := initializers.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "conn_id"}},
+		DoNothing: true,
+	}).Create(&session).Error; err != nil {
+		return err
+	}
+
+	if devices == 0 {
+		setPresence(userID, true, now)
+	}
+	return nil
+}
+
+// PresenceHeartbeat keeps the session of a connection alive. Connections of
+// visitors that are not logged in are ignored.
+func PresenceHeartbeat(connID string) error {
+	ctx := context.Background()
+	value, err := initializers.RedisClient.Get(ctx, presenceConnKeyPrefix+connID).Result()
+	if err == redis.Nil {
+		// Swept or never started, the session may still be open
+		var session models.PresenceSession
+		if err := initializers.DB.Where("conn_id = ? AND ended_at IS NULL", connID).Limit(1).Find(&session).Error; err != nil || session.ID == 0 {
+			return err
+		}
+		value = session.UserID.String()
+	} else if err != nil {
+		return err
+	}
+
+	userID, err := uuid.FromString(value)
+	if err != nil {
+		return err
+	}
+	return touchPresence(ctx, userID, connID, time.Now().UTC())
+}
+
+// PresenceDisconnect ends the session of a connection.
+func PresenceDisconnect(connID string) error {
+	var session models.PresenceSession
+	if err := initializers.DB.Where("conn_id = ? AND ended_at IS NULL", connID).Limit(1).Find(&session).Error; err != nil {
+		return err
+	}
+	if session.ID == 0 {
+		return nil
+	}
+	return endPresenceSession(&session, time.Now().UTC())
+}
+
+// endPresenceSession closes a session at endedAt. The last device to go
+// offline sets the user offline and tells the followers.
+func endPresenceSession(session *models.PresenceSession, endedAt time.Time) error {
+	ctx := context.Background()
+	if endedAt.Before(session.StartedAt) {
+		endedAt = session.StartedAt
+	}
+
+	if err := initializers.RedisClient.ZRem(ctx, presenceUserKey(session.UserID), session.ConnID).Err(); err != nil {
+		return err
+	}
+	initializers.RedisClient.Del(ctx, presenceConnKeyPrefix+session.ConnID)
+
+	result := initializers.DB.Model(&models.PresenceSession{}).
+		Where("id = ? AND ended_at IS NULL", session.ID).
+		Updates(map[string]interface{}{"ended_at": endedAt, "last_seen_at": endedAt})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil
+	}
+
+	devices, err := presenceDevices(ctx, session.UserID, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if devices == 0 {
+		setPresence(session.UserID, false, endedAt)
+	}
+	return nil
+}
+
+// setPresence stores the online state of the user and broadcasts it to the
+// personal channels of the followers.
+func setPresence(userID uuid.UUID, online bool, at time.Time) {
+	updates := map[string]interface{}{"online": online}
+	if !online {
+		updates["last_online"] = at
+	}
+	if err := initializers.DB.Model(&models.User{}).Where("id = ?", userID).Updates(updates).Error; err != nil {
+		log.Println("Could not update presence of user", userID, ":", err)
+	}
+
+	go func() {
+		var followerIDs []string
+		if err := initializers.DB.Table("user_relation").
+			Where("following_id = ?", userID).Pluck("user_id", &followerIDs).Error; err != nil {
+			log.Println("Could not load followers of user", userID, ":", err)
+			return
+		}
+		if len(followerIDs) == 0 {
+			return
+		}
+
+		channels := make([]string, 0, len(followerIDs))
+		for _, followerID := range followerIDs {
+			channels = append(channels, "personal:"+followerID)
+		}
+		if err := CentrifugoBroadcast(channels, "presence", map[string]interface{}{
+			"userId": userID,
+			"online": online,
+			"at":     at,
+		}); err != nil {
+			log.Println("Could not broadcast presence of user", userID, ":", err)
+		}
+	}()
+}
+
+// GetPresence reports whether a user is online now.
+func GetPresence(userID uuid.UUID) (*PresenceStatus, error) {
+	var user models.User
+	if err := initializers.DB.Select("id", "last_online").Where("id = ?", userID).First(&user).Error; err != nil {
+		return nil, err
+	}
+
+	devices, err := presenceDevices(context.Background(), userID, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	return &PresenceStatus{
+		UserID:     userID,
+		Online:     devices > 0,
+		Devices:    devices,
+		LastOnline: user.LastOnline,
+	}, nil
+}
+
+// ExpirePresence ends the sessions whose connection stopped sending
+// heartbeats without a disconnect, e.g. after a crash, at their last
+// heartbeat.
+func ExpirePresence() {
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	var sessions []models.PresenceSession
+	if err := initializers.DB.Where("ended_at IS NULL").Find(&sessions).Error; err != nil {
+		log.Println("Could not load presence sessions:", err)
+		return
+	}
+
+	var alive []uint64
+	for i := range sessions {
+		session := &sessions[i]
+		lastSeen := session.LastSeenAt
+		score, err := initializers.RedisClient.ZScore(ctx, presenceUserKey(session.UserID), session.ConnID).Result()
+		if err != nil && err != redis.Nil {
+			log.Println("Could not read presence:", err)
+			continue
+		}
+		if err == nil {
+			lastSeen = time.Unix(int64(score), 0).UTC()
+		}
+
+		if now.Sub(lastSeen) < presenceStaleAfter {
+			alive = append(alive, session.ID)
+			continue
+		}
+		if err := endPresenceSession(session, lastSeen); err != nil {
+			log.Println("Could not end presence session", session.ID, ":", err)
+		}
+	}
+
+	if len(alive) > 0 {
+		initializers.DB.Model(&models.PresenceSession{}).Where("id IN ?", alive).Update("last_seen_at", now)
+	}
+}
+
+// presenceDayTotals computes the online time of a user per day of
+// [from, to) from the sessions. Open sessions count until now when
+// includeOpen is set and are left out otherwise.
+func presenceDayTotals(userID uuid.UUID, from, to, now time.Time, includeOpen bool) (map[time.Time]*models.PresenceDaily, error) {
+	query := initializers.DB.Where("user_id = ? AND started_at < ?", userID, to)
+	if includeOpen {
+		query = query.Where("ended_at IS NULL OR ended_at > ?", from)
+	} else {
+		query = query.Where("ended_at > ?", from)
+	}
+	var sessions []models.PresenceSession
+	if err := query.Order("started_at").Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+
+	type interval struct{ start, end time.Time }
+	perDay := make(map[time.Time][]interval)
+	totals := make(map[time.Time]*models.PresenceDaily)
+
+	for _, session := range sessions {
+		end := now
+		if session.EndedAt != nil {
+			end = *session.EndedAt
+		}
+		if startDay := presenceDay(session.StartedAt); !startDay.Before(from) && startDay.Before(to) {
+			if totals[startDay] == nil {
+				totals[startDay] = &models.PresenceDaily{UserID: userID, Day: startDay}
+			}
+			totals[startDay].Sessions++
+		}
+		for day := presenceDay(session.StartedAt); day.Before(end) && day.Before(to); day = day.AddDate(0, 0, 1) {
+			if day.Before(from) {
+				continue
+			}
+			start, stop := session.StartedAt, end
+			if start.Before(day) {
+				start = day
+			}
+			if next := day.AddDate(0, 0, 1); stop.After(next) {
+				stop = next
+			}
+			if stop.After(start) {
+				perDay[day] = append(perDay[day], interval{start, stop})
+			}
+		}
+	}
+
+	// Overlapping sessions of several devices count once
+	for day, intervals := range perDay {
+		sort.Slice(intervals, func(i, j int) bool { return intervals[i].start.Before(intervals[j].start) })
+		var seconds float64
+		current := intervals[0]
+		for _, next := range intervals[1:] {
+			if !next.start.After(current.end) {
+				if next.end.After(current.end) {
+					current.end = next.end
+				}
+				continue
+			}
+			seconds += current.end.Sub(current.start).Seconds()
+			current = next
+		}
+		seconds += current.end.Sub(current.start).Seconds()
+
+		if totals[day] == nil {
+			totals[day] = &models.PresenceDaily{UserID: userID, Day: day}
+		}
+		totals[day].Seconds = int64(seconds)
+	}
+	return totals, nil
+}
+
+// RollupPresence recomputes the daily totals of the days touched by sessions
+// ended since the last run.
+func RollupPresence() {
+	var sessions []models.PresenceSession
+	if err := initializers.DB.Where("ended_at IS NOT NULL AND rolled_up = ?", false).
+		Order("id").Limit(presenceRollupBatch).Find(&sessions).Error; err != nil {
+		log.Println("Could not load presence sessions:", err)
+		return
+	}
+	if len(sessions) == 0 {
+		return
+	}
+
+	type dayRange struct{ from, to time.Time }
+	ranges := make(map[uuid.UUID]*dayRange)
+	idsByUser := make(map[uuid.UUID][]uint64)
+	for _, session := range sessions {
+		from := presenceDay(session.StartedAt)
+		to := presenceDay(*session.EndedAt).AddDate(0, 0, 1)
+		if r, ok := ranges[session.UserID]; ok {
+			if from.Before(r.from) {
+				r.from = from
+			}
+			if to.After(r.to) {
+				r.to = to
+			}
+		} else {
+			ranges[session.UserID] = &dayRange{from, to}
+		}
+		idsByUser[session.UserID] = append(idsByUser[session.UserID], session.ID)
+	}
+
+	now := time.Now().UTC()
+	for userID, r := range ranges {
+		totals, err := presenceDayTotals(userID, r.from, r.to, now, false)
+		if err != nil {
+			log.Println("Could not compute presence of user", userID, ":", err)
+			continue
+		}
+
+		rows := make([]models.PresenceDaily, 0, len(totals))
+		for _, total := range totals {
+			rows = append(rows, *total)
+		}
+		if len(rows) > 0 {
+			if err := initializers.DB.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "user_id"}, {Name: "day"}},
+				DoUpdates: clause.AssignmentColumns([]string{"seconds", "sessions"}),
+			}).Create(&rows).Error; err != nil {
+				log.Println("Could not save presence of user", userID, ":", err)
+				continue
+			}
+		}
+
+		initializers.DB.Model(&models.PresenceSession{}).Where("id IN ?", idsByUser[userID]).Update("rolled_up", true)
+	}
+}
+
+// UserPresenceStats returns the online time of a user for the days from to
+// to, both included. Days with sessions not rolled up yet are computed from
+// the sessions, so the current day is always up to date.
+func UserPresenceStats(userID uuid.UUID, from, to time.Time) (*PresenceStats, error) {
+	from, to = presenceDay(from), presenceDay(to)
+	if to.Before(from) || to.Sub(from) > maxPresenceStatsDays*24*time.Hour {
+		return nil, ErrPresenceRange
+	}
+	end := to.AddDate(0, 0, 1)
+
+	var rows []models.PresenceDaily
+	if err := initializers.DB.Where("user_id = ? AND day >= ? AND day < ?", userID, from, end).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	days := make(map[time.Time]models.PresenceDaily, len(rows))
+	for _, row := range rows {
+		days[presenceDay(row.Day)] = row
+	}
+
+	var pending []models.PresenceSession
+	if err := initializers.DB.Select("started_at", "ended_at").
+		Where("user_id = ? AND (ended_at IS NULL OR rolled_up = ?)", userID, false).
+		Where("started_at < ? AND (ended_at IS NULL OR ended_at > ?)", end, from).
+		Find(&pending).Error; err != nil {
+		return nil, err
+	}
+	if len(pending) > 0 {
+		now := time.Now().UTC()
+		liveFrom, liveTo := end, from
+		for _, session := range pending {
+			sessionEnd := now
+			if session.EndedAt != nil {
+				sessionEnd = *session.EndedAt
+			}
+			if day := presenceDay(session.StartedAt); day.Before(liveFrom) {
+				liveFrom = day
+			}
+			if day := presenceDay(sessionEnd).AddDate(0, 0, 1); day.After(liveTo) {
+				liveTo = day
+			}
+		}
+		if liveFrom.Before(from) {
+			liveFrom = from
+		}
+		if liveTo.After(end) {
+			liveTo = end
+		}
+
+		totals, err := presenceDayTotals(userID, liveFrom, liveTo, now, true)
+		if err != nil {
+			return nil, err
+		}
+		for day, total := range totals {
+			days[day] = *total
+		}
+	}
+
+	stats := &PresenceStats{From: from, To: to, Days: make([]models.PresenceDaily, 0, len(days))}
+	for _, day := range days {
+		if day.Seconds == 0 && day.Sessions == 0 {
+			continue
+		}
+		stats.Days = append(stats.Days, day)
+		stats.TotalSeconds += day.Seconds
+		stats.Sessions += day.Sessions
+		stats.ActiveDays++
+	}
+	sort.Slice(stats.Days, func(i, j int) bool { return stats.Days[i].Day.Before(stats.Days[j].Day) })
+	return stats, nil
+}
@@ -0,0 +1,807 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+// Exports can be downloaded for dataExportTTL and requested once per
+// dataExportInterval. Deletions are carried out after AccountDeletionGrace,
+// until then the user can cancel them.
+const (
+	dataExportTTL        = 7 * 24 * time.Hour
+	dataExportInterval   = 24 * time.Hour
+	dataExportStaleAfter = time.Hour
+	dataExportPoll       = time.Minute
+	dataExportPrefix     = blobPrivatePrefix + "exports/"
+	AccountDeletionGrace = 14 * 24 * time.Hour
+
+	// Exports zip all the media of a user, at most this many are built at
+	// once by an instance.
+	dataExportWorkers = 2
+)
+
+var (
+	ErrDataExportPending      = errors.New("an export is already being prepared")
+	ErrDataExportRecent       = errors.New("an export can be requested once a day")
+	ErrAccountDeletionPending = errors.New("account deletion is already scheduled")
+)
+
+// RequestDataExport queues an export of the data of the user, it is built by
+// RunDataExports.
+func RequestDataExport(userID uuid.UUID) (*models.DataExport, error) {
+	var last models.DataExport
+	err := initializers.DB.Where("user_id = ?", userID).Order("created_at DESC").First(&last).Error
+	if err == nil {
+		if last.Status == models.DataExportStatusPending || last.Status == models.DataExportStatusRunning {
+			return nil, ErrDataExportPending
+		}
+		if last.Status != models.DataExportStatusFailed && time.Since(last.CreatedAt) < dataExportInterval {
+			return nil, ErrDataExportRecent
+		}
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	export := models.DataExport{UserID: userID, Status: models.DataExportStatusPending}
+	if err := initializers.DB.Create(&export).Error; err != nil {
+		return nil, err
+	}
+	wakeDataExports()
+	return &export, nil
+}
+
+// dataExportWake starts the export workers before the next poll.
+var dataExportWake = make(chan struct{}, 1)
+
+func wakeDataExports() {
+	select {
+	case dataExportWake <- struct{}{}:
+	default:
+	}
+}
+
+// RunDataExports builds the pending exports until ctx is done, at most
+// dataExportWorkers at a time. It runs apart from the tickers so that a large
+// export does not hold back call expiry or consultation cut-offs. Exports
+// left running by a stopped instance are picked up again. Exports being
+// built are finished before it returns.
+func RunDataExports(ctx context.Context) {
+	slots := make(chan struct{}, dataExportWorkers)
+	var running sync.WaitGroup
+	defer running.Wait()
+
+	ticker := time.NewTicker(dataExportPoll)
+	defer ticker.Stop()
+
+	for {
+		initializers.DB.Model(&models.DataExport{}).
+			Where("status = ? AND updated_at < ?", models.DataExportStatusRunning, time.Now().Add(-dataExportStaleAfter)).
+			Update("status", models.DataExportStatusPending)
+
+	claim:
+		for {
+			select {
+			case slots <- struct{}{}:
+			default:
+				break claim
+			}
+			export, ok := claimDataExport()
+			if !ok {
+				<-slots
+				break claim
+			}
+			running.Add(1)
+			go func() {
+				defer running.Done()
+				processDataExport(export)
+				<-slots
+				// A free worker takes the next export right away
+				wakeDataExports()
+			}()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-dataExportWake:
+		}
+	}
+}
+
+// claimDataExport marks the oldest pending export as running, another
+// instance may be claiming it at the same time.
+func claimDataExport() (models.DataExport, bool) {
+	for {
+		var export models.DataExport
+		if err := initializers.DB.Where("status = ?", models.DataExportStatusPending).Order("created_at").First(&export).Error; err != nil {
+			return export, false
+		}
+		claimed := initializers.DB.Model(&models.DataExport{}).
+			Where("id = ? AND status = ?", export.ID, models.DataExportStatusPending).
+			Updates(map[string]interface{}{"status": models.DataExportStatusRunning, "updated_at": time.Now()})
+		if claimed.Error != nil {
+			return export, false
+		}
+		if claimed.RowsAffected == 1 {
+			return export, true
+		}
+	}
+}
+
+func processDataExport(export models.DataExport) {
+	data, err := buildDataExport(export.UserID)
+	if err == nil {
+		export.Key = dataExportPrefix + uuid.NewV4().String() + ".zip"
+		err = Blobs().Put(export.Key, data, "application/zip")
+	}
+	if err != nil {
+		log.Println("Could not build data export:", err)
+		initializers.DB.Model(&export).Updates(map[string]interface{}{"status": models.DataExportStatusFailed, "error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(dataExportTTL)
+	initializers.DB.Model(&export).Updates(map[string]interface{}{
+		"status":       models.DataExportStatusReady,
+		"key":          export.Key,
+		"size":         len(data),
+		"expires_at":   expiresAt,
+		"completed_at": now,
+	})
+	export.ExpiresAt = &expiresAt
+
+	url, err := DataExportURL(&export)
+	if err != nil {
+		log.Println("Could not sign data export link:", err)
+		return
+	}
+	title := "Your data export is ready"
+	text := "The archive with your profile, listings, messages and payments can be downloaded until " + expiresAt.Format("02.01.2006") + "."
+	if err := Notification(title, text, export.UserID.String(), url); err != nil {
+		log.Println("Could not notify about data export:", err)
+	}
+}
+
+// DataExportURL returns a download link of a ready export valid until the
+// export expires.
+func DataExportURL(export *models.DataExport) (string, error) {
+	if export.Status != models.DataExportStatusReady || export.ExpiresAt == nil {
+		return "", ErrBlobNotFound
+	}
+	return Blobs().SignedURL(export.Key, time.Until(*export.ExpiresAt))
+}
+
+// ExpireDataExports removes the archives of expired exports.
+func ExpireDataExports() {
+	var exports []models.DataExport
+	initializers.DB.Where("status = ? AND expires_at < ?", models.DataExportStatusReady, time.Now()).Find(&exports)
+
+	for _, export := range exports {
+		if err := Blobs().Delete(export.Key); err != nil {
+			log.Println("Could not delete data export:", err)
+			continue
+		}
+		initializers.DB.Model(&export).Updates(map[string]interface{}{"status": models.DataExportStatusExpired, "key": ""})
+	}
+}
+
+type exportChatMessage struct {
+	ID              uint64    `json:"id"`
+	RoomID          uint64    `json:"roomId"`
+	Content         string    `json:"content"`
+	MsgType         uint8     `json:"msgType"`
+	ParentMessageID *uint64   `json:"parentMessageId"`
+	IsEdited        bool      `json:"isEdited"`
+	IsDeleted       bool      `json:"isDeleted"`
+	CreatedAt       time.Time `json:"createdAt"`
+}
+
+type exportFollow struct {
+	ID   uuid.UUID `json:"id"`
+	Name string    `json:"name"`
+}
+
+type exportOnlineStorage struct {
+	Year      int             `json:"year"`
+	Data      json.RawMessage `json:"data"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+}
+
+// buildDataExport zips the data of a user as JSON files together with the
+// photos and documents under media/.
+func buildDataExport(userID uuid.UUID) ([]byte, error) {
+	var user models.User
+	if err := initializers.DB.Where("id = ?", userID).First(&user).Error; err != nil {
+		return nil, err
+	}
+
+	var profile models.Profile
+	initializers.DB.Preload("City").Preload("Guilds").Preload("Hashtags").Preload("Photos").Preload("Documents").
+		Where("user_id = ?", userID).Limit(1).Find(&profile)
+
+	var blogs []models.Blog
+	initializers.DB.Preload("City").Preload("Catygory").Preload("Hashtags").Preload("Photos").
+		Where("user_id = ?", userID).Order("created_at").Find(&blogs)
+
+	var messages []exportChatMessage
+	initializers.DB.Model(&models.ChatMessage{}).Where("user_id = ?", userID).Order("created_at").Find(&messages)
+
+	var transactions []models.Transaction
+	initializers.DB.Where("user_id = ?", userID).Order("created_at").Find(&transactions)
+
+	var notifications []models.Notification
+	initializers.DB.Where("user_id = ?", userID).Order("created_at").Find(&notifications)
+
+	var following, followers []exportFollow
+	initializers.DB.Table("users").Select("users.id, users.name").
+		Joins("JOIN user_relation ON user_relation.following_id = users.id").
+		Where("user_relation.user_id = ?", userID).Find(&following)
+	initializers.DB.Table("users").Select("users.id, users.name").
+		Joins("JOIN user_relation ON user_relation.user_id = users.id").
+		Where("user_relation.following_id = ?", userID).Find(&followers)
+
+	var storages []models.OnlineStorage
+	initializers.DB.Where("user_id = ?", userID).Order("year").Find(&storages)
+	online := make([]exportOnlineStorage, 0, len(storages))
+	for _, storage := range storages {
+		data := json.RawMessage("null")
+		if json.Valid(storage.Data) {
+			data = storage.Data
+		}
+		online = append(online, exportOnlineStorage{Year: storage.Year, Data: data, UpdatedAt: storage.UpdatedAt})
+	}
+
+	var presence []models.PresenceSession
+	initializers.DB.Where("user_id = ?", userID).Order("started_at").Find(&presence)
+
+	var calls []models.Call
+	initializers.DB.Where("caller_id = ? OR callee_id = ?", userID, userID).Order("created_at").Find(&calls)
+
+	var conferences []models.ChatConference
+	initializers.DB.Where("started_by = ?", userID).Order("created_at").Find(&conferences)
+
+	var consultations []models.Consultation
+	initializers.DB.Where("client_id = ? OR seller_id = ?", userID, userID).Order("created_at").Find(&consultations)
+	var consultationRate *models.ConsultationRate
+	var rate models.ConsultationRate
+	if initializers.DB.Where("user_id = ?", userID).Limit(1).Find(&rate).RowsAffected > 0 {
+		consultationRate = &rate
+	}
+
+	var schedule *models.AppointmentSchedule
+	var appointmentSchedule models.AppointmentSchedule
+	if initializers.DB.Preload("Availability").Where("user_id = ?", userID).Limit(1).Find(&appointmentSchedule).RowsAffected > 0 {
+		schedule = &appointmentSchedule
+	}
+	var exceptions []models.AppointmentException
+	initializers.DB.Where("user_id = ?", userID).Order("date").Find(&exceptions)
+	var appointments []models.Appointment
+	initializers.DB.Where("seller_id = ? OR buyer_id = ?", userID, userID).Order("starts_at").Find(&appointments)
+
+	var leads []models.Lead
+	initializers.DB.Preload("Notes").Where("seller_id = ?", userID).Order("created_at").Find(&leads)
+	var leadSettings *models.LeadSettings
+	var settings models.LeadSettings
+	if initializers.DB.Where("user_id = ?", userID).Limit(1).Find(&settings).RowsAffected > 0 {
+		leadSettings = &settings
+	}
+
+	var campaigns []models.AdCampaign
+	initializers.DB.Preload("Targets").Where("user_id = ?", userID).Order("created_at").Find(&campaigns)
+	var adEvents []models.AdEvent
+	initializers.DB.Where("viewer_key = ?", VisitorKey(&userID, "", "")).Order("created_at").Find(&adEvents)
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+
+	files := []struct {
+		name string
+		data interface{}
+	}{
+		{"profile.json", map[string]interface{}{"user": models.FilterUserRecord(&user, "en"), "profile": profile}},
+		{"listings.json", blogs},
+		{"chat_messages.json", messages},
+		{"transactions.json", transactions},
+		{"notifications.json", notifications},
+		{"follows.json", map[string]interface{}{"following": following, "followers": followers}},
+		{"online_storage.json", online},
+		{"presence_sessions.json", presence},
+		{"calls.json", calls},
+		{"chat_conferences.json", conferences},
+		{"consultations.json", map[string]interface{}{"rate": consultationRate, "consultations": consultations}},
+		{"appointments.json", map[string]interface{}{"schedule": schedule, "exceptions": exceptions, "appointments": appointments}},
+		{"leads.json", map[string]interface{}{"settings": leadSettings, "leads": leads}},
+		{"ads.json", map[string]interface{}{"campaigns": campaigns, "seen": adEvents}},
+	}
+	for _, file := range files {
+		data, err := json.MarshalIndent(file.data, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		w, err := archive.Create(file.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+	}
+
+	// Media the user uploaded, files missing from the store are skipped
+	for _, key := range exportMediaKeys(&user, &profile, blogs) {
+		data, err := ReadBlob(key)
+		if err != nil {
+			continue
+		}
+		w, err := archive.Create("media/" + strings.TrimPrefix(key, "/"))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func exportMediaKeys(user *models.User, profile *models.Profile, blogs []models.Blog) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	add := func(key string) {
+		if key != "" && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	add(user.Photo)
+	for _, photo := range profile.Photos {
+		var files []models.PhotoFile
+		_ = json.Unmarshal(photo.Files.Bytes, &files)
+		for _, file := range files {
+			add(file.Path)
+		}
+	}
+	for _, document := range profile.Documents {
+		var files []struct {
+			Filename string `json:"filename"`
+		}
+		_ = json.Unmarshal(document.Files.Bytes, &files)
+		for _, file := range files {
+			add(file.Filename)
+		}
+	}
+	for _, blog := range blogs {
+		for _, photo := range blog.Photos {
+			var files []models.PhotoFile
+			_ = json.Unmarshal(photo.Files.Bytes, &files)
+			for _, file := range files {
+				add(file.Path)
+			}
+		}
+	}
+	return keys
+}
+
+// ScheduleAccountDeletion schedules the erasure of the account after the
+// cooling-off period.
+func ScheduleAccountDeletion(userID uuid.UUID, reason string) (*models.AccountDeletion, error) {
+	var count int64
+	initializers.DB.Model(&models.AccountDeletion{}).
+		Where("user_id = ? AND status = ?", userID, models.AccountDeletionStatusScheduled).Count(&count)
+	if count > 0 {
+		return nil, ErrAccountDeletionPending
+	}
+
+	deletion := models.AccountDeletion{
+		UserID:       userID,
+		Status:       models.AccountDeletionStatusScheduled,
+		Reason:       reason,
+		ScheduledFor: time.Now().Add(AccountDeletionGrace),
+	}
+	if err := initializers.DB.Create(&deletion).Error; err != nil {
+		return nil, err
+	}
+
+	title := "Account deletion scheduled"
+	text := "Your account and all its data will be deleted on " + deletion.ScheduledFor.Format("02.01.2006") + ". You can cancel the deletion until then."
+	if err := Notification(title, text, userID.String(), siteURL+"/profile/privacy"); err != nil {
+		log.Println("Could not notify about account deletion:", err)
+	}
+	return &deletion, nil
+}
+
+// CancelAccountDeletion cancels the scheduled deletion of the account.
+func CancelAccountDeletion(userID uuid.UUID) error {
+	now := time.Now()
+	result := initializers.DB.Model(&models.AccountDeletion{}).
+		Where("user_id = ? AND status = ?", userID, models.AccountDeletionStatusScheduled).
+		Updates(map[string]interface{}{"status": models.AccountDeletionStatusCancelled, "cancelled_at": now})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// ProcessAccountDeletions erases the accounts whose cooling-off period is
+// over. Failed erasures stay scheduled and are retried on the next run.
+func ProcessAccountDeletions() {
+	var deletions []models.AccountDeletion
+	initializers.DB.Where("status = ? AND scheduled_for < ?", models.AccountDeletionStatusScheduled, time.Now()).Find(&deletions)
+
+	for _, deletion := range deletions {
+		receipt, err := EraseUser(deletion.UserID, deletion.CreatedAt)
+		if err != nil {
+			log.Println("Could not erase account:", err)
+			continue
+		}
+		initializers.DB.Model(&deletion).Updates(map[string]interface{}{
+			"status":       models.AccountDeletionStatusCompleted,
+			"completed_at": receipt.CompletedAt,
+			"receipt_id":   receipt.ID,
+		})
+	}
+}
+
+// Tables holding rows of the posts of a user, keyed by blog_id.
+var erasedBlogTables = []string{
+	"blog_hashtags",
+	"blog_guilds",
+	"blog_city",
+	"blog_photos",
+	"blog_revisions",
+	"blog_daily_stats",
+	"blog_image_hashes",
+	"votes",
+	"favorites",
+	"comments",
+	"promotions",
+	"saved_search_matches",
+}
+
+// Tables holding rows of a user, keyed by user_id.
+var erasedUserTables = []string{
+	"comments",
+	"favorites",
+	"votes",
+	"notifications",
+	"online_storages",
+	"billings",
+	"codes",
+	"domains",
+	"saved_search_matches",
+	"presavedfilters",
+	"blog_image_hashes",
+	"promotions",
+	"data_exports",
+	"presence_sessions",
+	"presence_dailies",
+	"stream_sessions",
+	"photo_uploads",
+	"consultation_rates",
+	"appointment_schedules",
+	"appointment_availabilities",
+	"appointment_exceptions",
+	"lead_notes",
+	"lead_settings",
+}
+
+// Tables of the profile, keyed by profile_id.
+var erasedProfileTables = []string{
+	"profiles_guilds",
+	"profiles_city",
+	"profiles_hashtags",
+	"profile_photos",
+	"profile_documents",
+	"profile_services",
+}
+
+// EraseUser deletes a user with everything stored about them and returns
+// the signed receipt. Transactions and payments are kept for accounting but
+// moved to a random pseudonym, so they no longer point to the person.
+func EraseUser(userID uuid.UUID, requestedAt time.Time) (*models.DeletionReceipt, error) {
+	config, _ := initializers.LoadConfig(".")
+	if config.PrivacyReceiptSecret == "" {
+		return nil, errors.New("PRIVACY_RECEIPT_SECRET is not set")
+	}
+
+	var user models.User
+	if err := initializers.DB.Where("id = ?", userID).First(&user).Error; err != nil {
+		return nil, err
+	}
+
+	var blogIDs []uint64
+	initializers.DB.Model(&models.Blog{}).Where("user_id = ?", userID).Pluck("id", &blogIDs)
+	var profileIDs []uint64
+	initializers.DB.Model(&models.Profile{}).Where("user_id = ?", userID).Pluck("id", &profileIDs)
+
+	// Posts already sent to channels are taken down by the syndication queue
+	for _, blogID := range blogIDs {
+		SyndicateBlog(blogID, models.SyndicationActionDelete)
+	}
+
+	var domains []models.CustomDomain
+	initializers.DB.Where("user_id = ?", userID).Find(&domains)
+	for i := range domains {
+		if err := DeleteCustomDomain(&domains[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	// Running campaigns are ended and their transactions closed
+	var campaignIDs []uint64
+	initializers.DB.Model(&models.AdCampaign{}).Where("user_id = ? AND status <> ?", userID, models.AdCampaignStatusEnded).Pluck("id", &campaignIDs)
+	for _, campaignID := range campaignIDs {
+		if _, err := settleAdCampaign(campaignID); err != nil {
+			return nil, err
+		}
+	}
+
+	var exports []models.DataExport
+	initializers.DB.Where("user_id = ? AND key <> ''", userID).Find(&exports)
+	for _, export := range exports {
+		if err := Blobs().Delete(export.Key); err != nil {
+			return nil, err
+		}
+	}
+
+	pseudonym := uuid.NewV4()
+	items := make(map[string]int64)
+
+	err := initializers.DB.Transaction(func(tx *gorm.DB) error {
+		exec := func(item, query string, args ...interface{}) error {
+			result := tx.Exec(query, args...)
+			if result.Error != nil {
+				return fmt.Errorf("%s: %w", item, result.Error)
+			}
+			if result.RowsAffected > 0 {
+				items[item] += result.RowsAffected
+			}
+			return nil
+		}
+
+		if len(blogIDs) > 0 {
+			for _, table := range erasedBlogTables {
+				if err := exec(table, "DELETE FROM "+table+" WHERE blog_id IN ?", blogIDs); err != nil {
+					return err
+				}
+			}
+		}
+		if len(profileIDs) > 0 {
+			for _, table := range erasedProfileTables {
+				if err := exec(table, "DELETE FROM "+table+" WHERE profile_id IN ?", profileIDs); err != nil {
+					return err
+				}
+			}
+		}
+
+		// Replies of others stay, without the quoted message
+		if err := exec("chat_messages_unlinked", "UPDATE chat_messages SET parent_message_id = NULL WHERE parent_message_id IN (SELECT id FROM chat_messages WHERE user_id = ?)", userID); err != nil {
+			return err
+		}
+		if err := exec("chat_rooms_unlinked", "UPDATE chat_rooms SET last_message_id = NULL WHERE last_message_id IN (SELECT id FROM chat_messages WHERE user_id = ?)", userID); err != nil {
+			return err
+		}
+		if err := exec("chat_messages", "DELETE FROM chat_messages WHERE user_id = ?", userID); err != nil {
+			return err
+		}
+		if err := exec("chat_room_members", "DELETE FROM chat_room_members WHERE user_id = ?", userID); err != nil {
+			return err
+		}
+
+		// Call-back requests left with the user, with the phone numbers of
+		// the visitors
+		if err := exec("lead_notes", "DELETE FROM lead_notes WHERE lead_id IN (SELECT id FROM leads WHERE seller_id = ?)", userID); err != nil {
+			return err
+		}
+		if err := exec("leads", "DELETE FROM leads WHERE seller_id = ?", userID); err != nil {
+			return err
+		}
+
+		// Campaigns of the user with their events, the spending stays in the
+		// transactions
+		if err := exec("ad_events", "DELETE FROM ad_events WHERE campaign_id IN (SELECT id FROM ad_campaigns WHERE user_id = ?)", userID); err != nil {
+			return err
+		}
+		if err := exec("ad_campaign_targets", "DELETE FROM ad_campaign_targets WHERE campaign_id IN (SELECT id FROM ad_campaigns WHERE user_id = ?)", userID); err != nil {
+			return err
+		}
+		if err := exec("ad_campaigns", "DELETE FROM ad_campaigns WHERE user_id = ?", userID); err != nil {
+			return err
+		}
+		// Ads the user saw stay in the statistics of their campaigns
+		if err := exec("ad_events_anonymized", "UPDATE ad_events SET viewer_key = ? WHERE viewer_key = ?", VisitorKey(&pseudonym, "", ""), VisitorKey(&userID, "", "")); err != nil {
+			return err
+		}
+
+		if err := exec("saved_search_terms", "DELETE FROM saved_search_terms WHERE filter_id IN (SELECT id FROM presavedfilters WHERE user_id = ?)", userID); err != nil {
+			return err
+		}
+		if err := exec("blog_syndications", "DELETE FROM blog_syndications WHERE channel_id IN (SELECT id FROM syndication_channels WHERE user_id = ?)", userID); err != nil {
+			return err
+		}
+		if err := exec("syndication_channels", "DELETE FROM syndication_channels WHERE user_id = ?", userID); err != nil {
+			return err
+		}
+		for _, table := range erasedUserTables {
+			if err := exec(table, "DELETE FROM "+table+" WHERE user_id = ?", userID); err != nil {
+				return err
+			}
+		}
+
+		if err := exec("followers_updated", "UPDATE users SET total_followers = GREATEST(total_followers - 1, 0) WHERE id IN (SELECT following_id FROM user_relation WHERE user_id = ?)", userID); err != nil {
+			return err
+		}
+		// Conferences of others that continued a call of the user stay
+		if err := exec("chat_conferences_unlinked", "UPDATE chat_conferences SET call_id = NULL WHERE started_by <> ? AND call_id IN (SELECT id FROM calls WHERE caller_id = ? OR callee_id = ?)", userID, userID, userID); err != nil {
+			return err
+		}
+		if err := exec("chat_conferences", "DELETE FROM chat_conferences WHERE started_by = ?", userID); err != nil {
+			return err
+		}
+		if err := exec("calls", "DELETE FROM calls WHERE caller_id = ? OR callee_id = ?", userID, userID); err != nil {
+			return err
+		}
+		if err := exec("user_relation", "DELETE FROM user_relation WHERE user_id = ? OR following_id = ?", userID, userID); err != nil {
+			return err
+		}
+		if err := exec("reports_anonymized", "UPDATE reports SET reporter_id = NULL WHERE reporter_id = ?", userID); err != nil {
+			return err
+		}
+
+		if err := exec("transactions_anonymized", "UPDATE transactions SET user_id = ? WHERE user_id = ?", pseudonym, userID); err != nil {
+			return err
+		}
+		if err := exec("payments_anonymized", "UPDATE payments SET user_id = ? WHERE user_id = ?", pseudonym, userID); err != nil {
+			return err
+		}
+		// Paid consultations are accounting records like the transactions
+		if err := exec("consultations_anonymized", "UPDATE consultations SET client_id = ? WHERE client_id = ?", pseudonym, userID); err != nil {
+			return err
+		}
+		if err := exec("consultations_anonymized", "UPDATE consultations SET seller_id = ? WHERE seller_id = ?", pseudonym, userID); err != nil {
+			return err
+		}
+
+		// Booked appointments with the user are cancelled, the buyers of the
+		// user get their prepayment back
+		var booked []models.Appointment
+		if err := tx.Where("status = ? AND seller_id = ? AND buyer_id <> ? AND price > 0", models.AppointmentStatusBooked, userID, userID).
+			Find(&booked).Error; err != nil {
+			return fmt.Errorf("appointments: %w", err)
+		}
+		for _, appointment := range booked {
+			if err := creditBalance(tx, appointment.BuyerID, appointment.Price); err != nil {
+				return fmt.Errorf("appointments_refunded: %w", err)
+			}
+			if err := exec("appointments_refunded", "UPDATE transactions SET status = ? WHERE id = ?", "CANCELLED", appointment.TransactionID); err != nil {
+				return err
+			}
+		}
+		if err := exec("appointments_cancelled", "UPDATE appointments SET status = ?, cancelled_by = ?, sequence = sequence + 1 WHERE status = ? AND (seller_id = ? OR buyer_id = ?)",
+			models.AppointmentStatusCancelled, pseudonym, models.AppointmentStatusBooked, userID, userID); err != nil {
+			return err
+		}
+		// The rest are accounting records, without the notes of the buyer
+		if err := exec("appointments_anonymized", "UPDATE appointments SET seller_id = ?, note = '' WHERE seller_id = ?", pseudonym, userID); err != nil {
+			return err
+		}
+		if err := exec("appointments_anonymized", "UPDATE appointments SET buyer_id = ?, note = '' WHERE buyer_id = ?", pseudonym, userID); err != nil {
+			return err
+		}
+		if err := exec("appointments_anonymized", "UPDATE appointments SET cancelled_by = ? WHERE cancelled_by = ?", pseudonym, userID); err != nil {
+			return err
+		}
+
+		if err := exec("blogs", "DELETE FROM blogs WHERE user_id = ?", userID); err != nil {
+			return err
+		}
+		if err := exec("profiles", "DELETE FROM profiles WHERE user_id = ?", userID); err != nil {
+			return err
+		}
+		return exec("users", "DELETE FROM users WHERE id = ?", userID)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Shared files stay with the other users holding them
+	var blobs int64
+	initializers.DB.Model(&models.UserBlob{}).Where("user_id = ?", userID).Count(&blobs)
+	ReleaseUserBlobs(userID)
+	if blobs > 0 {
+		items["files"] = blobs
+	}
+
+	// Files stored before blobs were tracked live in the directory of the user
+	if dir := filepath.Clean(user.Storage); dir != "." && dir != "/" && !strings.HasPrefix(dir, "..") {
+		if err := os.RemoveAll(filepath.Join(config.IMGStorePath, dir)); err != nil {
+			log.Println("Could not delete storage directory:", err)
+		}
+	}
+	InvalidateSEOCache()
+
+	itemsJSON, _ := json.Marshal(items)
+	receipt := models.DeletionReceipt{
+		ID:          uuid.NewV4(),
+		SubjectHash: DeletionSubjectHash(user.Email),
+		Pseudonym:   pseudonym,
+		Items:       itemsJSON,
+		RequestedAt: requestedAt,
+		CompletedAt: time.Now(),
+	}
+	receipt.Signature = deletionReceiptSignature(config.PrivacyReceiptSecret, &receipt)
+	if err := initializers.DB.Create(&receipt).Error; err != nil {
+		return nil, err
+	}
+
+	if !user.IsBot && user.Email != "" {
+		SendEmail(&user, &DeletionReceiptMail{
+			Subject:     "Your account has been deleted",
+			Name:        user.Name,
+			ReceiptID:   receipt.ID.String(),
+			URL:         siteURL + "/privacy/receipts/" + receipt.ID.String(),
+			CompletedAt: receipt.CompletedAt.Format("02.01.2006 15:04"),
+		}, "deletionReceipt", "en")
+	}
+	return &receipt, nil
+}
+
+// DeletionSubjectHash identifies the owner of a receipt without storing the
+// email.
+func DeletionSubjectHash(email string) string {
+	hash := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(hash[:])
+}
+
+// deletionReceiptSignature signs the fields of a receipt. Items are marshaled
+// again since jsonb does not keep the formatting they were stored with.
+func deletionReceiptSignature(secret string, receipt *models.DeletionReceipt) string {
+	var items map[string]int64
+	_ = json.Unmarshal(receipt.Items, &items)
+	itemsJSON, _ := json.Marshal(items)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%d\n%d\n%s", receipt.ID, receipt.SubjectHash, receipt.Pseudonym,
+		receipt.RequestedAt.Unix(), receipt.CompletedAt.Unix(), itemsJSON)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyDeletionReceipt checks the signature of a stored receipt.
+func VerifyDeletionReceipt(receipt *models.DeletionReceipt) bool {
+	config, _ := initializers.LoadConfig(".")
+	if config.PrivacyReceiptSecret == "" {
+		return false
+	}
+	expected := deletionReceiptSignature(config.PrivacyReceiptSecret, receipt)
+	return hmac.Equal([]byte(expected), []byte(receipt.Signature))
+}
@@ -0,0 +1,156 @@
+package utils
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrInsufficientBalance = errors.New("insufficient balance")
+
+// PurchasePromotion charges the author for the product and applies it to the
+// post. The charge, the transaction log and the promotion are stored in one
+// database transaction.
+func PurchasePromotion(blog *models.Blog, product *models.PromotionProduct, scope string, scopeID uint) (*models.Promotion, error) {
+	now := time.Now()
+	promotion := &models.Promotion{
+		BlogID:    blog.ID,
+		UserID:    blog.UserID,
+		ProductID: product.ID,
+		Kind:      product.Kind,
+		Scope:     scope,
+		ScopeID:   scopeID,
+		Sticker:   product.Sticker,
+		Price:     product.Price,
+		Status:    models.PromotionStatusActive,
+		StartsAt:  now,
+		ExpiresAt: now.AddDate(0, 0, product.Days),
+	}
+
+	err := initializers.DB.Transaction(func(tx *gorm.DB) error {
+		var balance models.Billing
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_id = ?", blog.UserID).
+			First(&balance).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInsufficientBalance
+			}
+			return err
+		}
+
+		if balance.Amount < product.Price {
+			return ErrInsufficientBalance
+		}
+
+		balance.Amount -= product.Price
+		if err := tx.Save(&balance).Error; err != nil {
+			return err
+		}
+
+		transaction := models.Transaction{
+			UserID:      blog.UserID,
+			Amount:      product.Price,
+			Status:      "OPENED",
+			Module:      "promotion",
+			ElementId:   blog.ID,
+			Total:       strconv.FormatFloat(product.Price, 'f', 2, 64),
+			Description: "Списание за продвижение объявления: " + product.Name,
+			Type:        "deduction",
+		}
+		if err := tx.Create(&transaction).Error; err != nil {
+			return err
+		}
+
+		promotion.TransactionID = transaction.ID
+		if err := tx.Create(promotion).Error; err != nil {
+			return err
+		}
+
+		switch product.Kind {
+		case models.PromotionKindHighlight:
+			return tx.Model(&models.Blog{}).Where("id = ?", blog.ID).Update("sticker", product.Sticker).Error
+		case models.PromotionKindBump:
+			return tx.Model(&models.Blog{}).Where("id = ?", blog.ID).Update("bumped_at", now).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return promotion, nil
+}
+
+// ExpirePromotions closes the promotions whose period is over and removes
+// the highlight sticker when no other highlight is running for the post.
+func ExpirePromotions() {
+	var promotions []models.Promotion
+	if err := initializers.DB.Where("status = ? AND expires_at < ?", models.PromotionStatusActive, time.Now()).
+		Find(&promotions).Error; err != nil {
+		log.Println("Could not load expired promotions:", err)
+		return
+	}
+
+	for _, promotion := range promotions {
+		if err := initializers.DB.Model(&promotion).Update("status", models.PromotionStatusExpired).Error; err != nil {
+			log.Println("Could not expire promotion:", err)
+			continue
+		}
+
+		if promotion.Kind != models.PromotionKindHighlight {
+			continue
+		}
+
+		var running models.Promotion
+		err := initializers.DB.Where("blog_id = ? AND kind = ? AND status = ?", promotion.BlogID, models.PromotionKindHighlight, models.PromotionStatusActive).
+			Order("expires_at DESC").
+			First(&running).Error
+		sticker := "standart"
+		if err == nil {
+			sticker = running.Sticker
+		}
+		initializers.DB.Model(&models.Blog{}).Where("id = ?", promotion.BlogID).Update("sticker", sticker)
+	}
+}
+
+// ActivePinnedPromotions returns the posts pinned to the given category or
+// city. Posts that were shown least come first so that every promoted post
+// gets a fair share of the top slots.
+func ActivePinnedPromotions(scope string, scopeID uint, limit int) []models.Promotion {
+	var promotions []models.Promotion
+	initializers.DB.
+		Joins("JOIN blogs ON blogs.id = promotions.blog_id AND blogs.status = ?", models.BlogStatusActive).
+		Where("promotions.kind = ? AND promotions.status = ? AND promotions.scope = ? AND promotions.scope_id = ?",
+			models.PromotionKindPin, models.PromotionStatusActive, scope, scopeID).
+		Where("promotions.expires_at > ?", time.Now()).
+		Order("promotions.impressions ASC").
+		Order("promotions.id ASC").
+		Limit(limit).
+		Find(&promotions)
+	return promotions
+}
+
+// TrackPromotionImpressions counts an impression for every running promotion
+// of the shown posts.
+func TrackPromotionImpressions(blogIDs []uint64) {
+	if len(blogIDs) == 0 {
+		return
+	}
+	initializers.DB.Model(&models.Promotion{}).
+		Where("blog_id IN ? AND status = ?", blogIDs, models.PromotionStatusActive).
+		UpdateColumn("impressions", gorm.Expr("impressions + 1"))
+}
+
+// TrackPromotionClick counts a click for every running promotion of the post.
+// It is called for views of the post opened from a promoted slot only.
+func TrackPromotionClick(blogID uint64) {
+	initializers.DB.Model(&models.Promotion{}).
+		Where("blog_id = ? AND status = ?", blogID, models.PromotionStatusActive).
+		UpdateColumn("clicks", gorm.Expr("clicks + 1"))
+}
@@ -0,0 +1,175 @@
+package utils
+
+import (
+	"encoding/json"
+	"log"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+
+	"github.com/jackc/pgtype"
+	uuid "github.com/satori/go.uuid"
+)
+
+// maxBlogRevisions is the number of revisions kept per post. Older revisions
+// are pruned and their photos released.
+const maxBlogRevisions = 20
+
+// BlogRevisionFromBlog builds an unsaved revision from the current state of
+// a post and its photos.
+func BlogRevisionFromBlog(blog *models.Blog, photos []models.BlogPhoto) (models.BlogRevision, error) {
+	revisionPhotos := make([]models.RevisionPhoto, 0, len(photos))
+	for _, photo := range photos {
+		var files []models.RevisionFile
+		_ = json.Unmarshal(photo.Files.Bytes, &files)
+		revisionPhotos = append(revisionPhotos, models.RevisionPhoto{ID: photo.ID, Files: files})
+	}
+
+	revision := models.BlogRevision{
+		BlogID:  blog.ID,
+		Title:   blog.Title,
+		Descr:   blog.Descr,
+		Content: blog.Content,
+		Total:   blog.Total,
+	}
+
+	photosJSON, err := json.Marshal(revisionPhotos)
+	if err != nil {
+		return revision, err
+	}
+	err = revision.Photos.Set(photosJSON)
+	return revision, err
+}
+
+// RevisionPhotos decodes the photos of a revision.
+func RevisionPhotos(revision *models.BlogRevision) []models.RevisionPhoto {
+	var photos []models.RevisionPhoto
+	_ = json.Unmarshal(revision.Photos.Bytes, &photos)
+	return photos
+}
+
+// RevisionPhotoPaths returns the stored file paths referenced by a revision.
+func RevisionPhotoPaths(revision *models.BlogRevision) []string {
+	var paths []string
+	for _, photo := range RevisionPhotos(revision) {
+		for _, file := range photo.Files {
+			if file.Path != "" {
+				paths = append(paths, file.Path)
+			}
+		}
+	}
+	return paths
+}
+
+// SnapshotBlogRevision stores the current state of a post as a new revision
+// and prunes revisions beyond maxBlogRevisions.
+func SnapshotBlogRevision(blog *models.Blog, photos []models.BlogPhoto, userID uuid.UUID) (*models.BlogRevision, error) {
+	revision, err := BlogRevisionFromBlog(blog, photos)
+	if err != nil {
+		return nil, err
+	}
+
+	var last models.BlogRevision
+	initializers.DB.Where("blog_id = ?", blog.ID).Order("number DESC").Limit(1).Find(&last)
+	revision.Number = last.Number + 1
+	revision.UserID = userID
+
+	if err := initializers.DB.Create(&revision).Error; err != nil {
+		return nil, err
+	}
+
+	pruneBlogRevisions(blog.ID)
+	return &revision, nil
+}
+
+func pruneBlogRevisions(blogID uint64) {
+	var stale []models.BlogRevision
+	if err := initializers.DB.Where("blog_id = ?", blogID).
+		Order("number DESC").
+		Offset(maxBlogRevisions).
+		Find(&stale).Error; err != nil {
+		log.Println("Could not load stale revisions:", err)
+		return
+	}
+
+	ownerID := blogOwnerID(blogID)
+	for _, revision := range stale {
+		if err := initializers.DB.Delete(&revision).Error; err != nil {
+			log.Println("Could not delete revision:", err)
+			continue
+		}
+		for _, photo := range RevisionPhotos(&revision) {
+			for _, file := range photo.Files {
+				DeletePhotoFileIfUnused(ownerID, file)
+			}
+		}
+	}
+}
+
+// DeleteBlogRevisions removes every revision of a post and releases the
+// photos only they referenced.
+func DeleteBlogRevisions(blogID uint64) {
+	var revisions []models.BlogRevision
+	initializers.DB.Where("blog_id = ?", blogID).Find(&revisions)
+	if len(revisions) == 0 {
+		return
+	}
+
+	if err := initializers.DB.Where("blog_id = ?", blogID).Delete(&models.BlogRevision{}).Error; err != nil {
+		log.Println("Could not delete revisions:", err)
+		return
+	}
+	ownerID := blogOwnerID(blogID)
+	for i := range revisions {
+		for _, photo := range RevisionPhotos(&revisions[i]) {
+			for _, file := range photo.Files {
+				DeletePhotoFileIfUnused(ownerID, file)
+			}
+		}
+	}
+}
+
+// DeleteStoredFileIfUnused releases a stored file of the user once nothing
+// of the user references it.
+func DeleteStoredFileIfUnused(userID uuid.UUID, path string) {
+	if path == "" || StoredFileInUse(userID, path) {
+		return
+	}
+	if err := ReleaseBlob(userID, path); err != nil {
+		log.Println("Could not release stored file:", err)
+	}
+}
+
+// DeletePhotoFileIfUnused releases a photo together with its variants once
+// nothing of the user references it.
+func DeletePhotoFileIfUnused(userID uuid.UUID, file models.PhotoFile) {
+	if file.Path == "" || StoredFileInUse(userID, file.Path) {
+		return
+	}
+	for _, path := range file.Paths() {
+		if err := ReleaseBlob(userID, path); err != nil {
+			log.Println("Could not release stored file:", err)
+		}
+	}
+}
+
+func blogOwnerID(blogID uint64) uuid.UUID {
+	var blog models.Blog
+	initializers.DB.Unscoped().Select("id", "user_id").Where("id = ?", blogID).First(&blog)
+	return blog.UserID
+}
+
+// RevisionFilesJSONB converts the files of a revision photo back to the
+// blog_photos column format.
+func RevisionFilesJSONB(files []models.RevisionFile) (pgtype.JSONB, error) {
+	var filesJSONB pgtype.JSONB
+	if files == nil {
+		files = []models.RevisionFile{}
+	}
+	filesJSON, err := json.Marshal(files)
+	if err != nil {
+		return filesJSONB, err
+	}
+	err = filesJSONB.Set(filesJSON)
+	return filesJSONB, err
+}
@@ -0,0 +1,330 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Kinds of saved search terms.
+const (
+	savedSearchTermAny      = "any"
+	savedSearchTermCity     = "city"
+	savedSearchTermCategory = "category"
+	savedSearchTermHashtag  = "hashtag"
+)
+
+var ErrInvalidSavedSearch = fmt.Errorf("invalid frequency or channels")
+
+// NormalizeSavedSearch validates the alert settings of a saved search and
+// fills in the defaults.
+func NormalizeSavedSearch(filter *models.Presavedfilters) error {
+	switch filter.Frequency {
+	case "":
+		filter.Frequency = models.AlertFrequencyOff
+	case models.AlertFrequencyOff, models.AlertFrequencyInstant, models.AlertFrequencyDaily, models.AlertFrequencyWeekly:
+	default:
+		return ErrInvalidSavedSearch
+	}
+
+	channels, ok := normalizeAlertChannels(filter.Channels)
+	if !ok {
+		return ErrInvalidSavedSearch
+	}
+	filter.Channels = channels
+	return nil
+}
+
+// normalizeAlertChannels cleans a comma separated list of alert channels, an
+// empty list means in-app only. It is false when a channel is unknown.
+func normalizeAlertChannels(list string) (string, bool) {
+	var channels []string
+	for _, channel := range strings.Split(list, ",") {
+		channel = strings.TrimSpace(channel)
+		switch channel {
+		case "":
+			continue
+		case models.AlertChannelInApp, models.AlertChannelPush, models.AlertChannelEmail, models.AlertChannelTelegram:
+			channels = append(channels, channel)
+		default:
+			return "", false
+		}
+	}
+	if len(channels) == 0 {
+		channels = []string{models.AlertChannelInApp}
+	}
+	return strings.Join(channels, ","), true
+}
+
+// IndexSavedSearch rebuilds the inverted index entries of a saved search.
+// City and category names are resolved to IDs the same way GetAll does.
+func IndexSavedSearch(filter *models.Presavedfilters) error {
+	var terms []models.SavedSearchTerm
+	addTerm := func(kind, value string) {
+		terms = append(terms, models.SavedSearchTerm{FilterID: filter.ID, Kind: kind, Value: value})
+	}
+
+	language := filter.Meta["language"]
+	if language == "" {
+		language = "en"
+	}
+
+	if city := filter.Meta["city"]; city != "" && city != "all" {
+		var cityTranslation models.CityTranslation
+		initializers.DB.Where("name = ? AND language = ?", city, language).First(&cityTranslation)
+		if cityTranslation.ID != 0 {
+			addTerm(savedSearchTermCity, strconv.FormatUint(uint64(cityTranslation.CityID), 10))
+		}
+	}
+
+	if category := filter.Meta["category"]; category != "" && category != "all" {
+		var guildTranslation models.GuildTranslation
+		initializers.DB.Where("name = ? AND language = ?", category, language).First(&guildTranslation)
+		if guildTranslation.ID != 0 {
+			addTerm(savedSearchTermCategory, strconv.FormatUint(uint64(guildTranslation.GuildID), 10))
+		}
+	}
+
+	if hashtags := filter.Meta["hashtag"]; hashtags != "" && hashtags != "all" {
+		for _, tag := range strings.Split(hashtags, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				addTerm(savedSearchTermHashtag, tag)
+			}
+		}
+	}
+
+	if len(terms) == 0 {
+		addTerm(savedSearchTermAny, "")
+	}
+
+	return initializers.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("filter_id = ?", filter.ID).Delete(&models.SavedSearchTerm{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&terms).Error
+	})
+}
+
+// RemoveSavedSearch drops the index entries and pending matches of a
+// deleted saved search.
+func RemoveSavedSearch(filterID uint64) {
+	initializers.DB.Where("filter_id = ?", filterID).Delete(&models.SavedSearchTerm{})
+	initializers.DB.Where("filter_id = ?", filterID).Delete(&models.SavedSearchMatch{})
+}
+
+// MatchSavedSearches finds the saved searches matching a post that became
+// ACTIVE and delivers instant alerts. Candidates come from the term index:
+// a filter matches when every kind of term it has matches the post, the
+// price range and title text are checked afterwards.
+func MatchSavedSearches(blogID uint64) {
+	var blog models.Blog
+	if err := initializers.DB.Preload("City").Preload("Catygory").Preload("Hashtags").
+		Where("id = ? AND status = ?", blogID, models.BlogStatusActive).
+		First(&blog).Error; err != nil {
+		return
+	}
+
+	cities := []string{}
+	for _, city := range blog.City {
+		cities = append(cities, strconv.FormatUint(uint64(city.ID), 10))
+	}
+	categories := []string{}
+	for _, category := range blog.Catygory {
+		categories = append(categories, strconv.FormatUint(uint64(category.ID), 10))
+	}
+	hashtags := []string{}
+	for _, tag := range blog.Hashtags {
+		hashtags = append(hashtags, tag.Hashtag)
+	}
+
+	// Hashtags match when any of them is on the post, so the kinds are
+	// counted rather than the terms
+	var filterIDs []uint64
+	if err := initializers.DB.Raw(`
+		SELECT t.filter_id FROM saved_search_terms t
+		WHERE t.kind = ?
+			OR (t.kind = ? AND t.value IN ?)
+			OR (t.kind = ? AND t.value IN ?)
+			OR (t.kind = ? AND t.value IN ?)
+		GROUP BY t.filter_id
+		HAVING COUNT(DISTINCT t.kind) = (SELECT COUNT(DISTINCT k.kind) FROM saved_search_terms k WHERE k.filter_id = t.filter_id)`,
+		savedSearchTermAny,
+		savedSearchTermCity, append(cities, ""),
+		savedSearchTermCategory, append(categories, ""),
+		savedSearchTermHashtag, append(hashtags, ""),
+	).Scan(&filterIDs).Error; err != nil {
+		log.Println("Could not match saved searches:", err)
+		return
+	}
+	if len(filterIDs) == 0 {
+		return
+	}
+
+	var filters []models.Presavedfilters
+	initializers.DB.Where("id IN ? AND frequency <> ? AND user_id <> ?", filterIDs, models.AlertFrequencyOff, blog.UserID).Find(&filters)
+
+	for _, filter := range filters {
+		if !savedSearchMatchesDetails(&filter, &blog) {
+			continue
+		}
+
+		match := models.SavedSearchMatch{FilterID: filter.ID, BlogID: blog.ID, UserID: filter.UserID}
+		result := initializers.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&match)
+		if result.Error != nil || result.RowsAffected == 0 {
+			continue
+		}
+
+		if filter.Frequency == models.AlertFrequencyInstant {
+			deliverSavedSearchAlert(&filter, []models.Blog{blog})
+			initializers.DB.Model(&match).Update("delivered", true)
+		}
+	}
+}
+
+// savedSearchMatchesDetails checks the price range and title text of a
+// saved search with the semantics of GetAll.
+func savedSearchMatchesDetails(filter *models.Presavedfilters, blog *models.Blog) bool {
+	if title := filter.Meta["title"]; title != "" && title != "all" {
+		if !strings.Contains(strings.ToLower(blog.Title), strings.ToLower(title)) {
+			return false
+		}
+	}
+
+	if money := filter.Meta["money"]; money != "" && money != "all" {
+		if strings.Contains(money, "-") {
+			totalRange := strings.Split(money, "-")
+			if len(totalRange) != 2 {
+				return false
+			}
+			lowerTotal, err := strconv.Atoi(strings.TrimSpace(totalRange[0]))
+			if err != nil {
+				return false
+			}
+			upperTotal, err := strconv.Atoi(strings.TrimSpace(totalRange[1]))
+			if err != nil {
+				return false
+			}
+			if blog.Total < float64(lowerTotal) || blog.Total > float64(upperTotal) {
+				return false
+			}
+		} else {
+			totalInt, err := strconv.Atoi(money)
+			if err != nil || blog.Total < float64(totalInt) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// SendSavedSearchDigests delivers the pending matches of daily and weekly
+// saved searches whose period is over.
+func SendSavedSearchDigests() {
+	now := time.Now()
+	periods := map[string]time.Duration{
+		models.AlertFrequencyDaily:  24 * time.Hour,
+		models.AlertFrequencyWeekly: 7 * 24 * time.Hour,
+	}
+
+	for frequency, period := range periods {
+		var filters []models.Presavedfilters
+		initializers.DB.Where("frequency = ? AND (last_digest_at IS NULL OR last_digest_at <= ?)", frequency, now.Add(-period)).
+			Where("id IN (?)", initializers.DB.Model(&models.SavedSearchMatch{}).Select("filter_id").Where("delivered = ?", false)).
+			Find(&filters)
+
+		for _, filter := range filters {
+			var matches []models.SavedSearchMatch
+			initializers.DB.Where("filter_id = ? AND delivered = ?", filter.ID, false).Find(&matches)
+
+			blogIDs := make([]uint64, 0, len(matches))
+			for _, match := range matches {
+				blogIDs = append(blogIDs, match.BlogID)
+			}
+
+			var blogs []models.Blog
+			initializers.DB.Where("id IN ? AND status = ?", blogIDs, models.BlogStatusActive).Order("created_at DESC").Find(&blogs)
+			if len(blogs) > 0 {
+				deliverSavedSearchAlert(&filter, blogs)
+			}
+
+			initializers.DB.Model(&models.SavedSearchMatch{}).Where("filter_id = ? AND delivered = ?", filter.ID, false).Update("delivered", true)
+			initializers.DB.Model(&filter).Update("last_digest_at", now)
+		}
+	}
+}
+
+var (
+	alertBotOnce sync.Once
+	alertBot     *tgbotapi.BotAPI
+)
+
+// alertTelegramBot is the bot that sends alerts to the Telegram chats of
+// users.
+func alertTelegramBot() *tgbotapi.BotAPI {
+	alertBotOnce.Do(func() {
+		config, _ := initializers.LoadConfig(".")
+		bot, err := initializers.ConnectTelegram(&initializers.Config{TELEGRAM_TOKEN: config.TELEGRAM_TOKEN})
+		if err != nil {
+			log.Println("Could not connect Telegram bot for alerts:", err)
+			return
+		}
+		alertBot = bot
+	})
+	return alertBot
+}
+
+func deliverSavedSearchAlert(filter *models.Presavedfilters, blogs []models.Blog) {
+	var user models.User
+	if err := initializers.DB.Where("id = ?", filter.UserID).First(&user).Error; err != nil {
+		return
+	}
+
+	title := "New posts for " + filter.Name
+	pageURL := "https://www.myru.online/" + blogs[0].UniqId + "/" + blogs[0].Slug
+	if len(blogs) == 1 {
+		title = "New post for " + filter.Name
+	}
+
+	lines := make([]string, 0, len(blogs))
+	posts := make([]SavedSearchPost, 0, len(blogs))
+	for _, blog := range blogs {
+		url := "https://www.myru.online/" + blog.UniqId + "/" + blog.Slug
+		lines = append(lines, blog.Title+" "+url)
+		posts = append(posts, SavedSearchPost{Title: blog.Title, URL: url})
+	}
+	text := strings.Join(lines, "\n")
+
+	for _, channel := range strings.Split(filter.Channels, ",") {
+		switch channel {
+		case models.AlertChannelInApp:
+			if err := Notification(title, text, user.ID.String(), pageURL); err != nil {
+				log.Println("Could not create saved search notification:", err)
+			}
+			if user.Session != "" {
+				SendPersonalMessageToClient(user.Session, "new_notification")
+			}
+		case models.AlertChannelPush:
+			if user.DeviceIOS != "" {
+				Push(title, blogs[0].Title, user.DeviceIOS, pageURL)
+			}
+		case models.AlertChannelEmail:
+			SendEmail(&user, &SavedSearchAlert{Subject: title, Name: user.Name, Filter: filter.Name, Posts: posts}, "savedSearch", "en")
+		case models.AlertChannelTelegram:
+			if bot := alertTelegramBot(); bot != nil && user.Tid != 0 {
+				if _, err := bot.Send(tgbotapi.NewMessage(user.Tid, title+"\n"+text)); err != nil {
+					log.Println("Error sending saved search alert:", err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,603 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	siteURL   = "https://www.myru.online"
+	imagesURL = "https://images.myru.online/"
+
+	// Sitemaps may hold 50000 URLs, the hreflang alternates make every
+	// entry several times larger so shards are kept smaller.
+	SitemapShardSize = 5000
+	feedItemsLimit   = 50
+
+	seoGenerationKey = "seo:generation"
+	seoCacheTTL      = 6 * time.Hour
+)
+
+// Sitemap shard kinds.
+const (
+	SitemapBlogs    = "blogs"
+	SitemapProfiles = "profiles"
+)
+
+// Feed scopes and formats.
+const (
+	FeedScopeUser  = "user"
+	FeedScopeCity  = "city"
+	FeedScopeGuild = "guild"
+
+	FeedFormatRSS  = "rss"
+	FeedFormatAtom = "atom"
+	FeedFormatJSON = "json"
+)
+
+// CachedSEO returns the cached document for key or builds and caches it.
+// Keys are prefixed with the cache generation, so InvalidateSEOCache drops
+// every document at once.
+func CachedSEO(key string, build func() ([]byte, error)) ([]byte, error) {
+	ctx := context.Background()
+	generation, err := initializers.RedisClient.Get(ctx, seoGenerationKey).Result()
+	if err == redis.Nil {
+		generation = "0"
+	} else if err != nil {
+		return build()
+	}
+
+	cacheKey := "seo:" + generation + ":" + key
+	if cached, err := initializers.RedisClient.Get(ctx, cacheKey).Bytes(); err == nil {
+		return cached, nil
+	}
+
+	body, err := build()
+	if err != nil {
+		return nil, err
+	}
+	if err := initializers.RedisClient.Set(ctx, cacheKey, body, seoCacheTTL).Err(); err != nil {
+		log.Println("Could not cache SEO document:", err)
+	}
+	return body, nil
+}
+
+// InvalidateSEOCache is called whenever a post is published, changed or
+// taken down. Documents of the old generation expire on their own.
+func InvalidateSEOCache() {
+	if err := initializers.RedisClient.Incr(context.Background(), seoGenerationKey).Err(); err != nil {
+		log.Println("Could not invalidate SEO cache:", err)
+	}
+}
+
+func seoLanguages() []string {
+	var langs []models.Langs
+	initializers.DB.Raw("SELECT * FROM langs").Scan(&langs)
+
+	codes := make([]string, 0, len(langs))
+	for _, lang := range langs {
+		if lang.DeletedAt == nil {
+			codes = append(codes, lang.Code)
+		}
+	}
+	if len(codes) == 0 {
+		codes = []string{"en"}
+	}
+	return codes
+}
+
+// BlogURL is the public address of a post, in a language when one is given.
+func BlogURL(blog *models.Blog, language string) string {
+	if language == "" {
+		return siteURL + "/" + blog.UniqId + "/" + blog.Slug
+	}
+	return siteURL + "/" + language + "/" + blog.UniqId + "/" + blog.Slug
+}
+
+// ProfileURL is the public address of the site of a user.
+func ProfileURL(name, language string) string {
+	url := "https://" + strings.ToLower(name) + ".myru.online/"
+	if language != "" {
+		url += language
+	}
+	return url
+}
+
+func multilangText(text models.MultilangTitle, language, fallback string) string {
+	var value string
+	switch language {
+	case "en":
+		value = text.En
+	case "ru":
+		value = text.Ru
+	case "ka":
+		value = text.Ka
+	case "es":
+		value = text.Es
+	}
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name       `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 sitemapindex"`
+	Sitemaps []sitemapEntry `xml:"sitemap"`
+}
+
+type sitemapEntry struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	XHTML   string       `xml:"xmlns:xhtml,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc        string             `xml:"loc"`
+	LastMod    string             `xml:"lastmod,omitempty"`
+	Alternates []sitemapAlternate `xml:"xhtml:link"`
+}
+
+type sitemapAlternate struct {
+	Rel      string `xml:"rel,attr"`
+	Hreflang string `xml:"hreflang,attr"`
+	Href     string `xml:"href,attr"`
+}
+
+func sitemapAlternates(languages []string, url func(language string) string) []sitemapAlternate {
+	alternates := make([]sitemapAlternate, 0, len(languages)+1)
+	for _, language := range languages {
+		alternates = append(alternates, sitemapAlternate{Rel: "alternate", Hreflang: language, Href: url(language)})
+	}
+	return append(alternates, sitemapAlternate{Rel: "alternate", Hreflang: "x-default", Href: url("")})
+}
+
+func marshalXML(document interface{}) ([]byte, error) {
+	body, err := xml.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), body...), nil
+}
+
+func activeProfilesQuery() *gorm.DB {
+	return initializers.DB.Model(&models.User{}).Where("banned = ? AND filled = ?", false, true)
+}
+
+// seoAPIURL is the address the SEO endpoints are served at. Links in
+// sitemaps and feeds are built from it, never from the request, as the
+// responses are cached for everyone.
+func seoAPIURL() string {
+	config, _ := initializers.LoadConfig(".")
+	return strings.TrimRight(config.SERVER_URL, "/") + "/api/seo"
+}
+
+// FeedURL is the URL of a feed.
+func FeedURL(scope, id, language, format string) string {
+	query := url.Values{"language": {language}, "format": {format}}
+	return seoAPIURL() + "/feed/" + scope + "/" + url.PathEscape(id) + "?" + query.Encode()
+}
+
+// BuildSitemapIndex lists the shards of all sitemaps.
+func BuildSitemapIndex() ([]byte, error) {
+	baseURL := seoAPIURL() + "/sitemap"
+
+	var blogs, profiles int64
+	if err := initializers.DB.Model(&models.Blog{}).Where("status = ?", models.BlogStatusActive).Count(&blogs).Error; err != nil {
+		return nil, err
+	}
+	if err := activeProfilesQuery().Count(&profiles).Error; err != nil {
+		return nil, err
+	}
+
+	index := sitemapIndex{}
+	now := time.Now().Format("2006-01-02")
+	for _, sitemap := range []struct {
+		kind  string
+		count int64
+	}{{SitemapBlogs, blogs}, {SitemapProfiles, profiles}} {
+		kind := sitemap.kind
+		shards := int((sitemap.count + SitemapShardSize - 1) / SitemapShardSize)
+		for shard := 1; shard <= shards; shard++ {
+			index.Sitemaps = append(index.Sitemaps, sitemapEntry{
+				Loc:     fmt.Sprintf("%s/%s/%d", baseURL, kind, shard),
+				LastMod: now,
+			})
+		}
+	}
+	return marshalXML(index)
+}
+
+// BuildSitemapShard renders a shard of a sitemap, shards are numbered from 1.
+func BuildSitemapShard(kind string, shard int) ([]byte, error) {
+	languages := seoLanguages()
+	urlset := sitemapURLSet{XHTML: "http://www.w3.org/1999/xhtml"}
+	offset := (shard - 1) * SitemapShardSize
+
+	switch kind {
+	case SitemapBlogs:
+		var blogs []models.Blog
+		if err := initializers.DB.Select("id, uniq_id, slug, updated_at").
+			Where("status = ?", models.BlogStatusActive).
+			Order("id ASC").Offset(offset).Limit(SitemapShardSize).
+			Find(&blogs).Error; err != nil {
+			return nil, err
+		}
+		for i := range blogs {
+			blog := &blogs[i]
+			urlset.URLs = append(urlset.URLs, sitemapURL{
+				Loc:        BlogURL(blog, ""),
+				LastMod:    blog.UpdatedAt.Format("2006-01-02"),
+				Alternates: sitemapAlternates(languages, func(language string) string { return BlogURL(blog, language) }),
+			})
+		}
+	case SitemapProfiles:
+		var users []models.User
+		if err := activeProfilesQuery().Select("id, name, updated_at").
+			Order("created_at ASC").Offset(offset).Limit(SitemapShardSize).
+			Find(&users).Error; err != nil {
+			return nil, err
+		}
+		for _, user := range users {
+			name := user.Name
+			urlset.URLs = append(urlset.URLs, sitemapURL{
+				Loc:        ProfileURL(name, ""),
+				LastMod:    user.UpdatedAt.Format("2006-01-02"),
+				Alternates: sitemapAlternates(languages, func(language string) string { return ProfileURL(name, language) }),
+			})
+		}
+	default:
+		return nil, fmt.Errorf("unknown sitemap %q", kind)
+	}
+	return marshalXML(urlset)
+}
+
+// FeedItem is a post in a feed, independent of the format.
+type FeedItem struct {
+	ID        string
+	Title     string
+	Summary   string
+	URL       string
+	Image     string
+	Author    string
+	Published time.Time
+	Updated   time.Time
+}
+
+// Feed is the format independent content of a feed.
+type Feed struct {
+	Title   string
+	URL     string
+	FeedURL string
+	Updated time.Time
+	Items   []FeedItem
+}
+
+// LoadFeed collects the latest active posts of a user, city or guild. id is
+// the user name for user feeds.
+func LoadFeed(scope, id, language string) (*Feed, error) {
+	query := initializers.DB.Model(&models.Blog{}).Preload("User").Preload("Photos").
+		Where("blogs.status = ?", models.BlogStatusActive)
+
+	feed := &Feed{}
+	switch scope {
+	case FeedScopeUser:
+		var user models.User
+		if err := initializers.DB.Where("LOWER(name) = ?", strings.ToLower(id)).First(&user).Error; err != nil {
+			return nil, err
+		}
+		query = query.Where("blogs.user_id = ?", user.ID)
+		feed.Title = user.Name
+		feed.URL = ProfileURL(user.Name, language)
+	case FeedScopeCity:
+		var translation models.CityTranslation
+		if err := initializers.DB.Where("city_id = ?", id).Order(languageFirst(language)).First(&translation).Error; err != nil {
+			return nil, err
+		}
+		query = query.Where("blogs.id IN (?)", initializers.DB.Table("blog_city").Select("blog_id").Where("city_id = ?", translation.CityID))
+		feed.Title = translation.Name
+		feed.URL = siteURL + "/" + language
+	case FeedScopeGuild:
+		var translation models.GuildTranslation
+		if err := initializers.DB.Where("guild_id = ?", id).Order(languageFirst(language)).First(&translation).Error; err != nil {
+			return nil, err
+		}
+		query = query.Where("blogs.id IN (?)", initializers.DB.Table("blog_guilds").Select("blog_id").Where("guilds_id = ?", translation.GuildID))
+		feed.Title = translation.Name
+		feed.URL = siteURL + "/" + language
+	default:
+		return nil, fmt.Errorf("unknown feed %q", scope)
+	}
+
+	var blogs []models.Blog
+	if err := query.Order("COALESCE(blogs.publish_at, blogs.created_at) DESC").Limit(feedItemsLimit).Find(&blogs).Error; err != nil {
+		return nil, err
+	}
+
+	for i := range blogs {
+		blog := &blogs[i]
+		published := blog.CreatedAt
+		if blog.PublishAt != nil {
+			published = *blog.PublishAt
+		}
+		item := FeedItem{
+			ID:        strconv.FormatUint(blog.ID, 10),
+			Title:     multilangText(blog.MultilangTitle, language, blog.Title),
+			Summary:   multilangText(blog.MultilangDescr, language, blog.Descr),
+			URL:       BlogURL(blog, language),
+			Author:    blog.User.Name,
+			Published: published,
+			Updated:   blog.UpdatedAt,
+		}
+		if paths := BlogPhotoPaths(blog.Photos); len(paths) > 0 {
+			item.Image = imagesURL + paths[0]
+		}
+		if item.Updated.After(feed.Updated) {
+			feed.Updated = item.Updated
+		}
+		feed.Items = append(feed.Items, item)
+	}
+	if feed.Updated.IsZero() {
+		feed.Updated = time.Now()
+	}
+	return feed, nil
+}
+
+// languageFirst orders the translation in language before the others.
+func languageFirst(language string) clause.OrderBy {
+	return clause.OrderBy{Expression: clause.Expr{SQL: "language = ? DESC", Vars: []interface{}{language}, WithoutParentheses: true}}
+}
+
+type rssDocument struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string        `xml:"title"`
+	Link        string        `xml:"link"`
+	GUID        string        `xml:"guid"`
+	Description string        `xml:"description"`
+	Author      string        `xml:"author,omitempty"`
+	PubDate     string        `xml:"pubDate"`
+	Enclosure   *rssEnclosure `xml:"enclosure,omitempty"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Type   string `xml:"type,attr"`
+	Length int    `xml:"length,attr"`
+}
+
+type atomDocument struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID        string     `xml:"id"`
+	Title     string     `xml:"title"`
+	Summary   string     `xml:"summary"`
+	Published string     `xml:"published"`
+	Updated   string     `xml:"updated"`
+	Author    atomAuthor `xml:"author"`
+	Links     []atomLink `xml:"link"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type jsonFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageURL string         `json:"home_page_url"`
+	FeedURL     string         `json:"feed_url"`
+	Items       []jsonFeedItem `json:"items"`
+}
+
+type jsonFeedItem struct {
+	ID            string           `json:"id"`
+	URL           string           `json:"url"`
+	Title         string           `json:"title"`
+	Summary       string           `json:"summary"`
+	ContentText   string           `json:"content_text"`
+	Image         string           `json:"image,omitempty"`
+	DatePublished string           `json:"date_published"`
+	DateModified  string           `json:"date_modified"`
+	Authors       []jsonFeedAuthor `json:"authors,omitempty"`
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+}
+
+// RenderFeed encodes a feed as RSS 2.0, Atom or JSON Feed 1.1.
+func RenderFeed(feed *Feed, format string) ([]byte, error) {
+	switch format {
+	case FeedFormatRSS:
+		document := rssDocument{Version: "2.0", Channel: rssChannel{
+			Title:         feed.Title,
+			Link:          feed.URL,
+			Description:   feed.Title,
+			LastBuildDate: feed.Updated.Format(time.RFC1123Z),
+		}}
+		for _, item := range feed.Items {
+			rss := rssItem{
+				Title:       item.Title,
+				Link:        item.URL,
+				GUID:        item.URL,
+				Description: item.Summary,
+				Author:      item.Author,
+				PubDate:     item.Published.Format(time.RFC1123Z),
+			}
+			if item.Image != "" {
+				rss.Enclosure = &rssEnclosure{URL: item.Image, Type: "image/jpeg"}
+			}
+			document.Channel.Items = append(document.Channel.Items, rss)
+		}
+		return marshalXML(document)
+	case FeedFormatAtom:
+		document := atomDocument{
+			ID:      feed.FeedURL,
+			Title:   feed.Title,
+			Updated: feed.Updated.Format(time.RFC3339),
+			Links:   []atomLink{{Href: feed.URL}, {Rel: "self", Href: feed.FeedURL}},
+		}
+		for _, item := range feed.Items {
+			document.Entries = append(document.Entries, atomEntry{
+				ID:        item.URL,
+				Title:     item.Title,
+				Summary:   item.Summary,
+				Published: item.Published.Format(time.RFC3339),
+				Updated:   item.Updated.Format(time.RFC3339),
+				Author:    atomAuthor{Name: item.Author},
+				Links:     []atomLink{{Rel: "alternate", Href: item.URL}},
+			})
+		}
+		return marshalXML(document)
+	case FeedFormatJSON:
+		document := jsonFeed{
+			Version:     "https://jsonfeed.org/version/1.1",
+			Title:       feed.Title,
+			HomePageURL: feed.URL,
+			FeedURL:     feed.FeedURL,
+			Items:       []jsonFeedItem{},
+		}
+		for _, item := range feed.Items {
+			document.Items = append(document.Items, jsonFeedItem{
+				ID:            item.ID,
+				URL:           item.URL,
+				Title:         item.Title,
+				Summary:       item.Summary,
+				ContentText:   item.Summary,
+				Image:         item.Image,
+				DatePublished: item.Published.Format(time.RFC3339),
+				DateModified:  item.Updated.Format(time.RFC3339),
+				Authors:       []jsonFeedAuthor{{Name: item.Author}},
+			})
+		}
+		return json.Marshal(document)
+	}
+	return nil, fmt.Errorf("unknown feed format %q", format)
+}
+
+// BlogJSONLD describes an active post as a schema.org Product with an Offer
+// by its author.
+func BlogJSONLD(blogID, language string) ([]byte, error) {
+	var blog models.Blog
+	if err := initializers.DB.Preload("User").Preload("Photos").Preload("Catygory.Translations", "language = ?", language).
+		Where("id = ? AND status = ?", blogID, models.BlogStatusActive).
+		First(&blog).Error; err != nil {
+		return nil, err
+	}
+
+	images := []string{}
+	for _, path := range BlogPhotoPaths(blog.Photos) {
+		images = append(images, imagesURL+path)
+	}
+
+	product := map[string]interface{}{
+		"@context":    "https://schema.org",
+		"@type":       "Product",
+		"name":        multilangText(blog.MultilangTitle, language, blog.Title),
+		"description": multilangText(blog.MultilangDescr, language, blog.Descr),
+		"sku":         blog.UniqId,
+		"url":         BlogURL(&blog, language),
+		"image":       images,
+		"offers": map[string]interface{}{
+			"@type":         "Offer",
+			"price":         strconv.FormatFloat(blog.Total, 'f', 2, 64),
+			"priceCurrency": "RUB",
+			"availability":  "https://schema.org/InStock",
+			"url":           BlogURL(&blog, language),
+			"seller": map[string]interface{}{
+				"@type": "Person",
+				"name":  blog.User.Name,
+				"url":   ProfileURL(blog.User.Name, language),
+			},
+		},
+	}
+	if blog.ExpiredAt != nil {
+		product["offers"].(map[string]interface{})["priceValidUntil"] = blog.ExpiredAt.Format("2006-01-02")
+	}
+	for _, guild := range blog.Catygory {
+		for _, translation := range guild.Translations {
+			product["category"] = translation.Name
+		}
+	}
+	return json.Marshal(product)
+}
+
+// ProfileJSONLD describes a user as a schema.org Person.
+func ProfileJSONLD(name, language string) ([]byte, error) {
+	var user models.User
+	if err := initializers.DB.Where("LOWER(name) = ? AND banned = ?", strings.ToLower(name), false).First(&user).Error; err != nil {
+		return nil, err
+	}
+
+	person := map[string]interface{}{
+		"@context": "https://schema.org",
+		"@type":    "Person",
+		"name":     user.Name,
+		"url":      ProfileURL(user.Name, language),
+		"image":    imagesURL + user.Photo,
+	}
+
+	var profile models.Profile
+	if err := initializers.DB.Preload("City.Translations", "language = ?", language).
+		Where("user_id = ?", user.ID).First(&profile).Error; err == nil {
+		if profile.Firstname != "" {
+			person["givenName"] = profile.Firstname
+		}
+		if descr := multilangText(profile.MultilangDescr, language, profile.Descr); descr != "" {
+			person["description"] = descr
+		}
+		for _, city := range profile.City {
+			for _, translation := range city.Translations {
+				person["address"] = map[string]interface{}{
+					"@type":           "PostalAddress",
+					"addressLocality": translation.Name,
+				}
+			}
+		}
+	}
+	return json.Marshal(person)
+}
@@ -0,0 +1,386 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"hyperpage/initializers"
+	"hyperpage/models"
+
+	"gorm.io/gorm/clause"
+)
+
+// SyndicationOutlet cross-posts posts to an external service. Post returns
+// the IDs of the created messages, Edit may return new IDs when the outlet
+// has to recreate the messages.
+type SyndicationOutlet interface {
+	Name() string
+	Post(channel *models.SyndicationChannel, message *SyndicationMessage) ([]string, error)
+	Edit(channel *models.SyndicationChannel, externalIDs []string, message *SyndicationMessage) ([]string, error)
+	Delete(channel *models.SyndicationChannel, externalIDs []string) error
+}
+
+var (
+	syndicationOutletsLock sync.RWMutex
+	syndicationOutlets     = map[string]SyndicationOutlet{}
+)
+
+// RegisterSyndicationOutlet makes an outlet available to channels with the
+// same outlet name.
+func RegisterSyndicationOutlet(outlet SyndicationOutlet) {
+	syndicationOutletsLock.Lock()
+	defer syndicationOutletsLock.Unlock()
+	syndicationOutlets[outlet.Name()] = outlet
+}
+
+func syndicationOutlet(name string) SyndicationOutlet {
+	syndicationOutletsLock.RLock()
+	defer syndicationOutletsLock.RUnlock()
+	return syndicationOutlets[name]
+}
+
+func init() {
+	RegisterSyndicationOutlet(TelegramOutlet{})
+	RegisterSyndicationOutlet(VKOutlet{})
+	RegisterSyndicationOutlet(WebhookOutlet{})
+}
+
+// SyndicationMessage is the data a post is rendered from. Photos are the
+// keys of the stored files in Blobs().
+type SyndicationMessage struct {
+	BlogID   uint64
+	Title    string
+	Descr    string
+	City     string
+	Category string
+	Total    float64
+	URL      string
+	Author   string
+	Hashtags []string
+	Photos   []string
+	Text     string
+}
+
+// defaultSyndicationTemplates are used for languages without a template in
+// the syndication_templates table.
+var defaultSyndicationTemplates = map[string]string{
+	"ru": "\nГород: {{.City}} \nРубрика: {{.Category}} \nЗаголовок: {{.Title}} {{if .Total}}\nЦена: {{printf \"%.2f\" .Total}} ₽ {{end}}\nURL: {{.URL}}{{if .Hashtags}}\nХештеги: {{join .Hashtags \", \"}}{{end}}",
+	"en": "\nCity: {{.City}} \nCategory: {{.Category}} \nTitle: {{.Title}} {{if .Total}}\nPrice: {{printf \"%.2f\" .Total}} ₽ {{end}}\nURL: {{.URL}}{{if .Hashtags}}\nHashtags: {{join .Hashtags \", \"}}{{end}}",
+}
+
+// Failed deliveries are retried with exponential backoff.
+const (
+	maxSyndicationAttempts = 8
+	syndicationBaseBackoff = time.Minute
+	syndicationMaxBackoff  = 6 * time.Hour
+	syndicationClaimWindow = 5 * time.Minute
+)
+
+// syndicationPhotoWindow is how long the cross-post of a post waits for
+// more photos. The photos of a post are uploaded one request each, every
+// photo restarts the wait so the post goes out once with all of them.
+const syndicationPhotoWindow = 30 * time.Second
+
+// SyndicateBlog queues an action for every channel of a post and processes
+// the queue of the post right away. Posting to a channel the post is already
+// in turns into an edit, so post and edit only differ for the caller.
+func SyndicateBlog(blogID uint64, action string) {
+	queueBlogSyndication(blogID, action, time.Now())
+	go ProcessBlogSyndications(blogID)
+}
+
+// SyndicateBlogPhotos queues the cross-post of a post whose photos are being
+// uploaded. It runs once no photo was added for syndicationPhotoWindow.
+func SyndicateBlogPhotos(blogID uint64) {
+	queueBlogSyndication(blogID, models.SyndicationActionPost, time.Now().Add(syndicationPhotoWindow))
+	time.AfterFunc(syndicationPhotoWindow+time.Second, func() {
+		ProcessBlogSyndications(blogID)
+	})
+}
+
+func queueBlogSyndication(blogID uint64, action string, at time.Time) {
+	if action == models.SyndicationActionDelete {
+		initializers.DB.Model(&models.BlogSyndication{}).
+			Where("blog_id = ? AND status IN ?", blogID, []string{models.SyndicationStatusPosted, models.SyndicationStatusFailed}).
+			Where("external_ids <> ''").
+			Updates(map[string]interface{}{"action": action, "attempts": 0, "next_attempt_at": at, "last_error": ""})
+		initializers.DB.Model(&models.BlogSyndication{}).
+			Where("blog_id = ? AND (external_ids IS NULL OR external_ids = '')", blogID).
+			Updates(map[string]interface{}{"action": "", "status": models.SyndicationStatusDeleted, "next_attempt_at": nil})
+		return
+	}
+
+	var blog models.Blog
+	if err := initializers.DB.Preload("City").Preload("Catygory").Preload("User").
+		Where("id = ?", blogID).First(&blog).Error; err != nil {
+		return
+	}
+
+	for _, channel := range blogSyndicationChannels(&blog) {
+		record := models.BlogSyndication{
+			BlogID:        blog.ID,
+			ChannelID:     channel.ID,
+			Status:        models.SyndicationStatusPending,
+			Action:        models.SyndicationActionPost,
+			NextAttemptAt: &at,
+		}
+		if err := initializers.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&record).Error; err != nil {
+			log.Println("Could not queue syndication:", err)
+			continue
+		}
+
+		// Records without messages are posted (again), the others edited
+		initializers.DB.Model(&models.BlogSyndication{}).
+			Where("blog_id = ? AND channel_id = ?", blog.ID, channel.ID).
+			Where("status = ? OR external_ids IS NULL OR external_ids = ''", models.SyndicationStatusDeleted).
+			Updates(map[string]interface{}{"action": models.SyndicationActionPost, "status": models.SyndicationStatusPending, "attempts": 0, "next_attempt_at": at})
+		initializers.DB.Model(&models.BlogSyndication{}).
+			Where("blog_id = ? AND channel_id = ? AND status <> ? AND external_ids <> ''", blog.ID, channel.ID, models.SyndicationStatusDeleted).
+			Updates(map[string]interface{}{"action": models.SyndicationActionEdit, "attempts": 0, "next_attempt_at": at, "last_error": ""})
+	}
+}
+
+// blogSyndicationChannels returns the active channels matching the cities
+// and guilds of the post, including the personal channel of the author.
+func blogSyndicationChannels(blog *models.Blog) []models.SyndicationChannel {
+	cityIDs := []uint{0}
+	for _, city := range blog.City {
+		cityIDs = append(cityIDs, city.ID)
+	}
+	guildIDs := []uint{0}
+	for _, guild := range blog.Catygory {
+		guildIDs = append(guildIDs, guild.ID)
+	}
+
+	var channels []models.SyndicationChannel
+	initializers.DB.Where("active = ? AND user_id IS NULL", true).
+		Where("city_id IS NULL OR city_id IN ?", cityIDs).
+		Where("guild_id IS NULL OR guild_id IN ?", guildIDs).
+		Find(&channels)
+
+	if personal := userSyndicationChannel(&blog.User); personal != nil {
+		channels = append(channels, *personal)
+	}
+	return channels
+}
+
+// userSyndicationChannel keeps the personal Telegram channel of an author in
+// sync with the profile. Posts go to the linked channel, or to the private
+// chat with the bot when no channel is linked.
+func userSyndicationChannel(user *models.User) *models.SyndicationChannel {
+	var channel models.SyndicationChannel
+	err := initializers.DB.Where("user_id = ?", user.ID).First(&channel).Error
+
+	target := ""
+	if user.Tcid != 0 {
+		target = fmt.Sprint(-user.Tcid)
+	} else if user.Tid != 0 {
+		target = fmt.Sprint(user.Tid)
+	}
+	active := user.TelegramActivated && target != ""
+
+	if err != nil {
+		if !active {
+			return nil
+		}
+		userID := user.ID
+		channel = models.SyndicationChannel{
+			Outlet:   models.OutletTelegram,
+			Name:     user.Name,
+			Target:   target,
+			Language: "ru",
+			UserID:   &userID,
+			Active:   true,
+		}
+		if err := initializers.DB.Create(&channel).Error; err != nil {
+			log.Println("Could not create personal syndication channel:", err)
+			return nil
+		}
+		return &channel
+	}
+
+	if channel.Active != active || (active && channel.Target != target) {
+		channel.Active = active
+		if target != "" {
+			channel.Target = target
+		}
+		initializers.DB.Save(&channel)
+	}
+	if !active {
+		return nil
+	}
+	return &channel
+}
+
+// ProcessSyndicationQueue runs the due actions of all posts, it is called by
+// the scheduler to retry failed deliveries.
+func ProcessSyndicationQueue() {
+	var blogIDs []uint64
+	initializers.DB.Model(&models.BlogSyndication{}).
+		Where("action <> '' AND next_attempt_at <= ?", time.Now()).
+		Distinct("blog_id").
+		Pluck("blog_id", &blogIDs)
+
+	for _, blogID := range blogIDs {
+		ProcessBlogSyndications(blogID)
+	}
+}
+
+// ProcessBlogSyndications runs the due actions of a post.
+func ProcessBlogSyndications(blogID uint64) {
+	var records []models.BlogSyndication
+	initializers.DB.Where("blog_id = ? AND action <> '' AND next_attempt_at <= ?", blogID, time.Now()).Find(&records)
+	if len(records) == 0 {
+		return
+	}
+
+	var blog models.Blog
+	if err := initializers.DB.Preload("Photos").Preload("Hashtags").Preload("User").
+		Preload("City.Translations").Preload("Catygory.Translations").
+		Where("id = ?", blogID).First(&blog).Error; err != nil {
+		// The post is gone, only its messages can still be deleted
+		blog = models.Blog{ID: blogID}
+	}
+
+	for i := range records {
+		record := &records[i]
+		if blog.UniqId == "" && record.Action != models.SyndicationActionDelete {
+			record.Action = models.SyndicationActionDelete
+		}
+
+		// Claim the record so that the scheduler and a request do not run
+		// the same action twice
+		now := time.Now()
+		claimed := initializers.DB.Model(&models.BlogSyndication{}).
+			Where("id = ? AND next_attempt_at <= ?", record.ID, now).
+			Update("next_attempt_at", now.Add(syndicationClaimWindow))
+		if claimed.Error != nil || claimed.RowsAffected == 0 {
+			continue
+		}
+
+		var channel models.SyndicationChannel
+		if err := initializers.DB.Where("id = ?", record.ChannelID).First(&channel).Error; err != nil {
+			initializers.DB.Model(record).Updates(map[string]interface{}{"action": "", "status": models.SyndicationStatusFailed, "last_error": "channel not found", "next_attempt_at": nil})
+			continue
+		}
+
+		runSyndicationAction(record, &channel, &blog)
+	}
+}
+
+func runSyndicationAction(record *models.BlogSyndication, channel *models.SyndicationChannel, blog *models.Blog) {
+	outlet := syndicationOutlet(channel.Outlet)
+	if outlet == nil {
+		initializers.DB.Model(record).Updates(map[string]interface{}{"action": "", "status": models.SyndicationStatusFailed, "last_error": "unknown outlet " + channel.Outlet, "next_attempt_at": nil})
+		return
+	}
+
+	var externalIDs []string
+	if record.ExternalIDs != "" {
+		externalIDs = strings.Split(record.ExternalIDs, ",")
+	}
+
+	var err error
+	var ids []string
+	status := models.SyndicationStatusPosted
+	switch record.Action {
+	case models.SyndicationActionPost:
+		ids, err = outlet.Post(channel, buildSyndicationMessage(blog, channel.Language))
+	case models.SyndicationActionEdit:
+		ids, err = outlet.Edit(channel, externalIDs, buildSyndicationMessage(blog, channel.Language))
+	case models.SyndicationActionDelete:
+		err = outlet.Delete(channel, externalIDs)
+		status = models.SyndicationStatusDeleted
+	}
+
+	if err != nil {
+		record.Attempts++
+		updates := map[string]interface{}{"attempts": record.Attempts, "last_error": err.Error()}
+		if record.Attempts >= maxSyndicationAttempts {
+			updates["action"] = ""
+			updates["status"] = models.SyndicationStatusFailed
+			updates["next_attempt_at"] = nil
+		} else {
+			backoff := syndicationBaseBackoff << uint(record.Attempts-1)
+			if backoff > syndicationMaxBackoff {
+				backoff = syndicationMaxBackoff
+			}
+			updates["next_attempt_at"] = time.Now().Add(backoff)
+		}
+		initializers.DB.Model(record).Updates(updates)
+		log.Printf("Syndication of blog %d to channel %d failed: %s", blog.ID, channel.ID, err)
+		return
+	}
+
+	updates := map[string]interface{}{"action": "", "status": status, "attempts": 0, "last_error": "", "next_attempt_at": nil}
+	if status == models.SyndicationStatusDeleted {
+		updates["external_ids"] = ""
+	} else if len(ids) > 0 {
+		updates["external_ids"] = strings.Join(ids, ",")
+	}
+	initializers.DB.Model(record).Updates(updates)
+}
+
+// buildSyndicationMessage renders the post with the template of the channel
+// language. City and category names are translated to that language.
+func buildSyndicationMessage(blog *models.Blog, language string) *SyndicationMessage {
+	message := &SyndicationMessage{
+		BlogID: blog.ID,
+		Title:  blog.Title,
+		Descr:  blog.Descr,
+		Total:  blog.Total,
+		URL:    "https://www.myru.online/" + blog.UniqId + "/" + blog.Slug,
+		Author: blog.User.Name,
+	}
+
+	for _, city := range blog.City {
+		for _, translation := range city.Translations {
+			if translation.Language == language {
+				message.City = translation.Name
+			}
+		}
+	}
+	for _, guild := range blog.Catygory {
+		for _, translation := range guild.Translations {
+			if translation.Language == language {
+				message.Category = translation.Name
+			}
+		}
+	}
+	for _, tag := range blog.Hashtags {
+		message.Hashtags = append(message.Hashtags, tag.Hashtag)
+	}
+	message.Photos = BlogPhotoPaths(blog.Photos)
+
+	body := defaultSyndicationTemplates["ru"]
+	if text, ok := defaultSyndicationTemplates[language]; ok {
+		body = text
+	}
+	var stored models.SyndicationTemplate
+	if err := initializers.DB.Where("language = ?", language).First(&stored).Error; err == nil {
+		body = stored.Body
+	}
+
+	var buf bytes.Buffer
+	tmpl, err := ParseSyndicationTemplate(body)
+	if err == nil {
+		err = tmpl.Execute(&buf, message)
+	}
+	if err != nil {
+		log.Println("Could not render syndication template:", err)
+		buf.Reset()
+		buf.WriteString(message.Title + "\n" + message.URL)
+	}
+	message.Text = buf.String()
+	return message
+}
+
+// ParseSyndicationTemplate parses a message template.
+func ParseSyndicationTemplate(body string) (*template.Template, error) {
+	return template.New("syndication").Funcs(template.FuncMap{"join": strings.Join}).Parse(body)
+}
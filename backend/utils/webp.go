@@ -0,0 +1,595 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+	"math/bits"
+	"sort"
+)
+
+// EncodeWebP writes img as a lossless WebP (VP8L) image. The encoder applies
+// the subtract green and predictor transforms and codes the residuals with a
+// single group of prefix codes, using backward references only for runs and
+// no color cache. It is simple rather than small, but needs no cgo.
+func EncodeWebP(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width < 1 || height < 1 || width > 1<<14 || height > 1<<14 {
+		return errors.New("webp: invalid image size")
+	}
+
+	nrgba, ok := img.(*image.NRGBA)
+	if !ok || nrgba.Rect.Min != (image.Point{}) {
+		nrgba = image.NewNRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(nrgba, nrgba.Rect, img, bounds.Min, draw.Src)
+	}
+
+	argb := make([]uint32, width*height)
+	alphaUsed := false
+	for y := 0; y < height; y++ {
+		row := nrgba.Pix[y*nrgba.Stride:]
+		for x := 0; x < width; x++ {
+			r, g, b, a := row[x*4], row[x*4+1], row[x*4+2], row[x*4+3]
+			if a != 0xff {
+				alphaUsed = true
+			}
+			// Subtract green transform
+			argb[y*width+x] = uint32(a)<<24 | uint32(r-g)<<16 | uint32(g)<<8 | uint32(b-g)
+		}
+	}
+
+	bw := &vp8lBitWriter{}
+	bw.write(0x2f, 8)
+	bw.write(uint32(width-1), 14)
+	bw.write(uint32(height-1), 14)
+	if alphaUsed {
+		bw.write(1, 1)
+	} else {
+		bw.write(0, 1)
+	}
+	bw.write(0, 3)
+
+	bw.write(1, 1)
+	bw.write(vp8lSubtractGreen, 2)
+
+	modes, residuals := vp8lPredict(argb, width, height)
+	tilesX := vp8lSubSampleSize(width, vp8lPredictorBits)
+	bw.write(1, 1)
+	bw.write(vp8lPredictorTransform, 2)
+	bw.write(vp8lPredictorBits-2, 3)
+	vp8lWriteImage(bw, modes, tilesX, false)
+
+	bw.write(0, 1)
+	vp8lWriteImage(bw, residuals, width, true)
+	bw.flush()
+
+	data := bw.buf
+	if len(data)%2 == 1 {
+		data = append(data, 0)
+	}
+	header := make([]byte, 20)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(12+len(data)))
+	copy(header[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(header[16:], uint32(len(bw.buf)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+const (
+	vp8lPredictorTransform = 0
+	vp8lSubtractGreen      = 2
+	vp8lPredictorBits      = 5
+	vp8lMaxCodeLength      = 15
+	vp8lMaxCodeLengthCode  = 7
+	vp8lNumLengthCodes     = 24
+	vp8lNumDistanceCodes   = 40
+)
+
+var vp8lCodeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+func vp8lSubSampleSize(size, bits int) int {
+	return (size + (1 << bits) - 1) >> bits
+}
+
+// vp8lPredict picks for every tile the predictor with the smallest
+// residuals and returns the mode image and the residuals.
+func vp8lPredict(argb []uint32, width, height int) ([]uint32, []uint32) {
+	tileSize := 1 << vp8lPredictorBits
+	tilesX := vp8lSubSampleSize(width, vp8lPredictorBits)
+	tilesY := vp8lSubSampleSize(height, vp8lPredictorBits)
+	modes := make([]uint32, tilesX*tilesY)
+	residuals := make([]uint32, len(argb))
+
+	for ty := 0; ty < tilesY; ty++ {
+		for tx := 0; tx < tilesX; tx++ {
+			best, bestCost := 0, -1
+			for mode := 0; mode < 14; mode++ {
+				cost := 0
+				for y := ty * tileSize; y < (ty+1)*tileSize && y < height; y++ {
+					for x := tx * tileSize; x < (tx+1)*tileSize && x < width; x++ {
+						pos := y*width + x
+						cost += vp8lResidualCost(vp8lSub(argb[pos], vp8lPredictPixel(argb, width, x, y, mode)))
+					}
+				}
+				if bestCost < 0 || cost < bestCost {
+					best, bestCost = mode, cost
+				}
+			}
+			modes[ty*tilesX+tx] = 0xff000000 | uint32(best)<<8
+
+			for y := ty * tileSize; y < (ty+1)*tileSize && y < height; y++ {
+				for x := tx * tileSize; x < (tx+1)*tileSize && x < width; x++ {
+					pos := y*width + x
+					residuals[pos] = vp8lSub(argb[pos], vp8lPredictPixel(argb, width, x, y, best))
+				}
+			}
+		}
+	}
+	return modes, residuals
+}
+
+func vp8lResidualCost(residual uint32) int {
+	cost := 0
+	for shift := 0; shift < 32; shift += 8 {
+		v := int(int8(residual >> shift))
+		if v < 0 {
+			v = -v
+		}
+		cost += v
+	}
+	return cost
+}
+
+// vp8lPredictPixel predicts the pixel at x, y. The top row predicts from the
+// left and the left column from the top whatever the mode.
+func vp8lPredictPixel(argb []uint32, width, x, y, mode int) uint32 {
+	if x == 0 && y == 0 {
+		return 0xff000000
+	}
+	pos := y*width + x
+	if y == 0 {
+		return argb[pos-1]
+	}
+	if x == 0 {
+		return argb[pos-width]
+	}
+
+	l, t, tl := argb[pos-1], argb[pos-width], argb[pos-width-1]
+	// The rightmost pixel uses the leftmost pixel of its own row as TR
+	tr := argb[pos-width+1]
+	switch mode {
+	case 0:
+		return 0xff000000
+	case 1:
+		return l
+	case 2:
+		return t
+	case 3:
+		return tr
+	case 4:
+		return tl
+	case 5:
+		return vp8lAverage2(vp8lAverage2(l, tr), t)
+	case 6:
+		return vp8lAverage2(l, tl)
+	case 7:
+		return vp8lAverage2(l, t)
+	case 8:
+		return vp8lAverage2(tl, t)
+	case 9:
+		return vp8lAverage2(t, tr)
+	case 10:
+		return vp8lAverage2(vp8lAverage2(l, tl), vp8lAverage2(t, tr))
+	case 11:
+		return vp8lSelect(l, t, tl)
+	case 12:
+		return vp8lClampAddSubtractFull(l, t, tl)
+	default:
+		return vp8lClampAddSubtractHalf(vp8lAverage2(l, t), tl)
+	}
+}
+
+func vp8lSub(a, b uint32) uint32 {
+	var out uint32
+	for shift := 0; shift < 32; shift += 8 {
+		out |= uint32(uint8(a>>shift)-uint8(b>>shift)) << shift
+	}
+	return out
+}
+
+func vp8lAverage2(a, b uint32) uint32 {
+	var out uint32
+	for shift := 0; shift < 32; shift += 8 {
+		out |= ((a>>shift&0xff + b>>shift&0xff) / 2) << shift
+	}
+	return out
+}
+
+func vp8lSelect(l, t, tl uint32) uint32 {
+	pl, pt := 0, 0
+	for shift := 0; shift < 32; shift += 8 {
+		cl, ct, ctl := int(l>>shift&0xff), int(t>>shift&0xff), int(tl>>shift&0xff)
+		p := cl + ct - ctl
+		pl += vp8lAbs(p - cl)
+		pt += vp8lAbs(p - ct)
+	}
+	if pl < pt {
+		return l
+	}
+	return t
+}
+
+func vp8lClampAddSubtractFull(a, b, c uint32) uint32 {
+	var out uint32
+	for shift := 0; shift < 32; shift += 8 {
+		v := int(a>>shift&0xff) + int(b>>shift&0xff) - int(c>>shift&0xff)
+		out |= uint32(vp8lClamp(v)) << shift
+	}
+	return out
+}
+
+func vp8lClampAddSubtractHalf(a, b uint32) uint32 {
+	var out uint32
+	for shift := 0; shift < 32; shift += 8 {
+		ca, cb := int(a>>shift&0xff), int(b>>shift&0xff)
+		out |= uint32(vp8lClamp(ca+(ca-cb)/2)) << shift
+	}
+	return out
+}
+
+func vp8lClamp(v int) int {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return v
+}
+
+func vp8lAbs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// vp8lToken is a literal pixel or a backward reference copying length
+// pixels from the left or the row above.
+type vp8lToken struct {
+	literal  bool
+	argb     uint32
+	length   int
+	distance int
+}
+
+// vp8lTokenize finds runs of pixels repeating the left pixel or the row
+// above, flat areas cost a few bits per run instead of per pixel.
+func vp8lTokenize(argb []uint32, width int) []vp8lToken {
+	const minRun, maxRun = 3, 4096
+
+	var tokens []vp8lToken
+	for pos := 0; pos < len(argb); {
+		best, bestCode := 0, 0
+		for code, dist := range [2]int{width, 1} {
+			if pos < dist {
+				continue
+			}
+			n := 0
+			for pos+n < len(argb) && n < maxRun && argb[pos+n] == argb[pos+n-dist] {
+				n++
+			}
+			if n > best {
+				best, bestCode = n, code+1
+			}
+		}
+		if best >= minRun {
+			tokens = append(tokens, vp8lToken{length: best, distance: bestCode})
+			pos += best
+			continue
+		}
+		tokens = append(tokens, vp8lToken{literal: true, argb: argb[pos]})
+		pos++
+	}
+	return tokens
+}
+
+// vp8lPrefixValue splits a length or distance code into its prefix symbol
+// and extra bits.
+func vp8lPrefixValue(value int) (symbol int, extraBits uint, extra uint32) {
+	value--
+	if value < 4 {
+		return value, 0, 0
+	}
+	highest := bits.Len(uint(value)) - 1
+	second := (value >> (highest - 1)) & 1
+	extraBits = uint(highest - 1)
+	extra = uint32(value & (1<<extraBits - 1))
+	return 2*highest + second, extraBits, extra
+}
+
+// vp8lWriteImage writes an entropy coded image. The main image additionally
+// states that it uses a single prefix code group.
+func vp8lWriteImage(bw *vp8lBitWriter, argb []uint32, width int, main bool) {
+	bw.write(0, 1) // no color cache
+	if main {
+		bw.write(0, 1) // no meta prefix codes
+	}
+
+	tokens := vp8lTokenize(argb, width)
+
+	green := make([]uint32, 256+vp8lNumLengthCodes)
+	red := make([]uint32, 256)
+	blue := make([]uint32, 256)
+	alpha := make([]uint32, 256)
+	distance := make([]uint32, vp8lNumDistanceCodes)
+	for _, token := range tokens {
+		if token.literal {
+			p := token.argb
+			green[p>>8&0xff]++
+			red[p>>16&0xff]++
+			blue[p&0xff]++
+			alpha[p>>24]++
+			continue
+		}
+		lengthSymbol, _, _ := vp8lPrefixValue(token.length)
+		distanceSymbol, _, _ := vp8lPrefixValue(token.distance)
+		green[256+lengthSymbol]++
+		distance[distanceSymbol]++
+	}
+
+	greenCode := vp8lWritePrefixCode(bw, green)
+	redCode := vp8lWritePrefixCode(bw, red)
+	blueCode := vp8lWritePrefixCode(bw, blue)
+	alphaCode := vp8lWritePrefixCode(bw, alpha)
+	distanceCode := vp8lWritePrefixCode(bw, distance)
+
+	for _, token := range tokens {
+		if token.literal {
+			p := token.argb
+			greenCode.write(bw, int(p>>8&0xff))
+			redCode.write(bw, int(p>>16&0xff))
+			blueCode.write(bw, int(p&0xff))
+			alphaCode.write(bw, int(p>>24))
+			continue
+		}
+		symbol, extraBits, extra := vp8lPrefixValue(token.length)
+		greenCode.write(bw, 256+symbol)
+		bw.write(extra, extraBits)
+		symbol, extraBits, extra = vp8lPrefixValue(token.distance)
+		distanceCode.write(bw, symbol)
+		bw.write(extra, extraBits)
+	}
+}
+
+type vp8lPrefixCode struct {
+	lengths []uint8
+	codes   []uint32
+}
+
+func (c *vp8lPrefixCode) write(bw *vp8lBitWriter, symbol int) {
+	if n := c.lengths[symbol]; n > 0 {
+		bw.write(c.codes[symbol], uint(n))
+	}
+}
+
+// vp8lWritePrefixCode chooses a prefix code for the histogram and writes its
+// definition. One or two small symbols use the simple code, anything else a
+// normal code with literal code lengths.
+func vp8lWritePrefixCode(bw *vp8lBitWriter, counts []uint32) *vp8lPrefixCode {
+	var used []int
+	for symbol, count := range counts {
+		if count > 0 {
+			used = append(used, symbol)
+		}
+	}
+
+	if len(used) <= 2 && (len(used) == 0 || used[len(used)-1] < 256) {
+		if len(used) == 0 {
+			used = []int{0}
+		}
+		lengths := make([]uint8, len(counts))
+		bw.write(1, 1)
+		bw.write(uint32(len(used)-1), 1)
+		if used[0] < 2 {
+			bw.write(0, 1)
+			bw.write(uint32(used[0]), 1)
+		} else {
+			bw.write(1, 1)
+			bw.write(uint32(used[0]), 8)
+		}
+		if len(used) == 2 {
+			bw.write(uint32(used[1]), 8)
+			lengths[used[0]] = 1
+			lengths[used[1]] = 1
+		}
+		return &vp8lPrefixCode{lengths: lengths, codes: vp8lCanonicalCodes(lengths)}
+	}
+
+	lengths := vp8lCodeLengths(counts, vp8lMaxCodeLength)
+	codes := vp8lCanonicalCodes(lengths)
+
+	lengthCounts := make([]uint32, 19)
+	for _, length := range lengths {
+		lengthCounts[length]++
+	}
+	// A code needs two symbols, give an unused length a dummy count
+	if nonZero(lengthCounts) < 2 {
+		if lengthCounts[0] == 0 {
+			lengthCounts[0] = 1
+		} else {
+			lengthCounts[1] = 1
+		}
+	}
+	lengthLengths := vp8lCodeLengths(lengthCounts, vp8lMaxCodeLengthCode)
+	lengthCodes := vp8lCanonicalCodes(lengthLengths)
+
+	bw.write(0, 1)
+	bw.write(19-4, 4)
+	for _, symbol := range vp8lCodeLengthOrder {
+		bw.write(uint32(lengthLengths[symbol]), 3)
+	}
+	bw.write(0, 1) // lengths of every symbol follow
+	for _, length := range lengths {
+		bw.write(lengthCodes[length], uint(lengthLengths[length]))
+	}
+	return &vp8lPrefixCode{lengths: lengths, codes: codes}
+}
+
+func nonZero(counts []uint32) int {
+	n := 0
+	for _, count := range counts {
+		if count > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// vp8lCodeLengths builds Huffman code lengths no longer than maxLength. Rare
+// symbols are made more frequent until the tree is shallow enough.
+func vp8lCodeLengths(counts []uint32, maxLength int) []uint8 {
+	weights := make([]uint64, len(counts))
+	for i, count := range counts {
+		weights[i] = uint64(count)
+	}
+
+	for minWeight := uint64(1); ; minWeight *= 2 {
+		for i, weight := range weights {
+			if weight > 0 && weight < minWeight {
+				weights[i] = minWeight
+			}
+		}
+		lengths, depth := huffmanLengths(weights)
+		if depth <= maxLength {
+			return lengths
+		}
+	}
+}
+
+type huffmanNode struct {
+	weight      uint64
+	symbol      int
+	left, right int
+}
+
+func huffmanLengths(weights []uint64) ([]uint8, int) {
+	lengths := make([]uint8, len(weights))
+
+	var nodes []huffmanNode
+	for symbol, weight := range weights {
+		if weight > 0 {
+			nodes = append(nodes, huffmanNode{weight: weight, symbol: symbol, left: -1, right: -1})
+		}
+	}
+	if len(nodes) == 0 {
+		return lengths, 0
+	}
+	if len(nodes) == 1 {
+		lengths[nodes[0].symbol] = 1
+		return lengths, 1
+	}
+	sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].weight < nodes[j].weight })
+
+	// Two queue construction, leaves are sorted and merged nodes are
+	// created in order of weight
+	leaves := len(nodes)
+	next, merged := 0, leaves
+	take := func() int {
+		if next < leaves && (merged >= len(nodes) || nodes[next].weight <= nodes[merged].weight) {
+			next++
+			return next - 1
+		}
+		merged++
+		return merged - 1
+	}
+	for len(nodes) < 2*leaves-1 {
+		a := take()
+		b := take()
+		nodes = append(nodes, huffmanNode{weight: nodes[a].weight + nodes[b].weight, symbol: -1, left: a, right: b})
+	}
+
+	depth := 0
+	type item struct{ node, depth int }
+	stack := []item{{len(nodes) - 1, 0}}
+	for len(stack) > 0 {
+		it := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		node := nodes[it.node]
+		if node.symbol >= 0 {
+			lengths[node.symbol] = uint8(it.depth)
+			if it.depth > depth {
+				depth = it.depth
+			}
+			continue
+		}
+		stack = append(stack, item{node.left, it.depth + 1}, item{node.right, it.depth + 1})
+	}
+	return lengths, depth
+}
+
+// vp8lCanonicalCodes assigns canonical codes to the lengths, bit reversed
+// since the bit writer is least significant bit first.
+func vp8lCanonicalCodes(lengths []uint8) []uint32 {
+	var count [vp8lMaxCodeLength + 1]uint32
+	for _, length := range lengths {
+		count[length]++
+	}
+	count[0] = 0
+
+	var next [vp8lMaxCodeLength + 2]uint32
+	code := uint32(0)
+	for length := 1; length <= vp8lMaxCodeLength; length++ {
+		code = (code + count[length-1]) << 1
+		next[length] = code
+	}
+
+	codes := make([]uint32, len(lengths))
+	for symbol, length := range lengths {
+		if length == 0 {
+			continue
+		}
+		codes[symbol] = reverseBits(next[length], uint(length))
+		next[length]++
+	}
+	return codes
+}
+
+func reverseBits(code uint32, length uint) uint32 {
+	var out uint32
+	for i := uint(0); i < length; i++ {
+		out = out<<1 | code&1
+		code >>= 1
+	}
+	return out
+}
+
+type vp8lBitWriter struct {
+	buf  []byte
+	acc  uint64
+	bits uint
+}
+
+func (w *vp8lBitWriter) write(value uint32, bits uint) {
+	w.acc |= uint64(value) << w.bits
+	w.bits += bits
+	for w.bits >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.bits -= 8
+	}
+}
+
+func (w *vp8lBitWriter) flush() {
+	if w.bits > 0 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc, w.bits = 0, 0
+	}
+}
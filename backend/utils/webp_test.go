@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"os/exec"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/webp"
+)
+
+// photoLike is a smooth gradient with sensor-like noise, the kind of image
+// where a lossless encoder loses to JPEG.
+func photoLike(width, height int) *image.NRGBA {
+	random := rand.New(rand.NewSource(1))
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			noise := random.Intn(16)
+			img.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(x*200/width + noise),
+				G: uint8(y*200/height + noise),
+				B: uint8((x+y)*100/(width+height) + noise),
+				A: 0xff,
+			})
+		}
+	}
+	return img
+}
+
+func TestEncodeWebPRoundTrip(t *testing.T) {
+	img := photoLike(67, 41)
+	// A translucent corner makes the encoder write alpha
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: 10, G: 20, B: 30, A: uint8(x * 25)})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := EncodeWebP(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := webp.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Bounds() != img.Bounds() {
+		t.Fatalf("bounds = %v, want %v", decoded.Bounds(), img.Bounds())
+	}
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		for x := 0; x < img.Bounds().Dx(); x++ {
+			want := img.NRGBAAt(x, y)
+			got := color.NRGBAModel.Convert(decoded.At(x, y)).(color.NRGBA)
+			if want.A == 0 {
+				// Fully transparent pixels may lose their color
+				got.R, got.G, got.B, want.R, want.G, want.B = 0, 0, 0, 0, 0, 0
+			}
+			if got != want {
+				t.Fatalf("pixel (%d, %d) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestEncodeWebPInvalidSize(t *testing.T) {
+	if err := EncodeWebP(&bytes.Buffer{}, image.NewNRGBA(image.Rect(0, 0, 0, 10))); err == nil {
+		t.Error("an empty image was encoded")
+	}
+}
+
+func TestWebPVariantOnlyWhenSmaller(t *testing.T) {
+	img := photoLike(320, 240)
+	var jpeg bytes.Buffer
+	if err := imaging.Encode(&jpeg, img, imaging.JPEG, imaging.JPEGQuality(imageJPEGQuality)); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := webpVariant(img, jpeg.Len())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data != nil && len(data) >= jpeg.Len() {
+		t.Errorf("webp variant of %d B kept for a %d B JPEG", len(data), jpeg.Len())
+	}
+
+	// A flat image compresses far below any original
+	flat := imaging.New(320, 240, color.NRGBA{R: 200, G: 100, B: 50, A: 0xff})
+	data, err = webpVariant(flat, jpeg.Len())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data == nil {
+		t.Fatal("no webp variant for a flat image")
+	}
+	if _, err := webp.Decode(bytes.NewReader(data)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEncodeLossyWebP(t *testing.T) {
+	if _, err := exec.LookPath("cwebp"); err != nil {
+		t.Skip("cwebp is not installed")
+	}
+
+	img := photoLike(320, 240)
+	data, err := encodeLossyWebP(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lossless bytes.Buffer
+	if err := EncodeWebP(&lossless, img); err != nil {
+		t.Fatal(err)
+	}
+	if len(data) >= lossless.Len() {
+		t.Errorf("lossy webp is %d B, lossless %d B", len(data), lossless.Len())
+	}
+
+	decoded, err := webp.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Bounds().Dx() != 320 || decoded.Bounds().Dy() != 240 {
+		t.Errorf("bounds = %v", decoded.Bounds())
+	}
+}
@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"encoding/json"
 	"fmt"
 	"streaming/initializers"
 	"streaming/middleware"
@@ -51,11 +52,24 @@ func GenerateToken(c *fiber.Ctx, config *initializers.Config) error {
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"status": "success",
 		"data": fiber.Map{
-			"token": livekitToken,
+			"token":      livekitToken,
+			"iceServers": iceServers(c, config, user.ID),
 		},
 	})
 }
 
+// iceServers returns the ICE servers with TURN credentials of the user for
+// the token responses, null when the backend could not issue them and the
+// clients keep their defaults.
+func iceServers(c *fiber.Ctx, config *initializers.Config, identity string) json.RawMessage {
+	servers, err := utils.FetchICEServers(config, identity, c.Query("region", c.Get("X-Region")))
+	if err != nil {
+		fmt.Println("Error fetching ICE servers:", err)
+		return nil
+	}
+	return servers
+}
+
 func RefreshToken(c *fiber.Ctx, config *initializers.Config) error {
 	token := c.Get("token")
 	tokenStr, err := jwt.ParseSigned(token)
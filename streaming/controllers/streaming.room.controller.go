@@ -165,7 +165,8 @@ func CreateTradingRoom(c *fiber.Ctx, config *initializers.Config) error {
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"status": "success",
 		"data": fiber.Map{
-			"token": livekitToken,
+			"token":      livekitToken,
+			"iceServers": iceServers(c, config, user.ID),
 		},
 	})
 }
@@ -208,7 +209,8 @@ func EntryTradingRoom(c *fiber.Ctx, config *initializers.Config) error {
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"status": "success",
 		"data": fiber.Map{
-			"token": livekitToken,
+			"token":      livekitToken,
+			"iceServers": iceServers(c, config, user.ID),
 		},
 	})
 }
@@ -268,7 +270,8 @@ func JoinTradingRoom(c *fiber.Ctx, config *initializers.Config) error {
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"status": "success",
 		"data": fiber.Map{
-			"token": livekitToken,
+			"token":      livekitToken,
+			"iceServers": iceServers(c, config, requestData.UserId),
 		},
 	})
 }
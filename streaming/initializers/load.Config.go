@@ -26,9 +26,11 @@ type AuthConfig struct {
 	Uri string `yaml:"uri"`
 }
 
-// BackendConfig represents the nested "auth" structure in the YAML
+// BackendConfig represents the nested "backend" structure in the YAML.
+// ServiceKey is the ICE_SERVICE_KEY of the backend.
 type BackendConfig struct {
-	Uri string `yaml:"uri"`
+	Uri        string `yaml:"uri"`
+	ServiceKey string `yaml:"service_key"`
 }
 
 // RedisConfig represents the nested "redis" structure in the YAML
@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"streaming/initializers"
+	"time"
+)
+
+var iceClient = &http.Client{Timeout: 5 * time.Second}
+
+// FetchICEServers gets the ICE servers with TURN credentials issued to the
+// user from the backend. Clients pass them to LiveKit as the iceServers of
+// rtcConfig.
+func FetchICEServers(config *initializers.Config, identity, region string) (json.RawMessage, error) {
+	query := url.Values{}
+	query.Set("identity", identity)
+	if region != "" {
+		query.Set("region", region)
+	}
+
+	req, err := http.NewRequest("GET", config.Backend.Uri+"/ice/service?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Service-Key", config.Backend.ServiceKey)
+
+	resp, err := iceClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch ICE servers: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("backend responded with non-200 status code: %d", resp.StatusCode)
+	}
+
+	var backendResponse struct {
+		Data struct {
+			ICEServers json.RawMessage `json:"iceServers"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&backendResponse); err != nil {
+		return nil, fmt.Errorf("failed to decode backend response: %w", err)
+	}
+	return backendResponse.Data.ICEServers, nil
+}